@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Before writing to a device or benchmarking a disk, its I/O counters are
+// watched for a moment. A disk other processes keep busy, like one hosting a
+// live database, is refused unless --allow-busy is given.
+
+const (
+	// activityWindow is how long the counters are watched
+	activityWindow = time.Second
+	// A disk busier than this is in use
+	activityBusyPercent = 10
+	activityBusyIOPS    = 50
+)
+
+// allowBusy is set by --allow-busy to write to disks that are in use
+var allowBusy bool
+
+// checkDeviceActivity refuses a disk that other processes are using. Light
+// activity only warns, and disks without counters are not checked.
+func checkDeviceActivity(path, operation string) error {
+	sampler := newDiskStatsSampler(path)
+	if sampler == nil {
+		return nil
+	}
+	time.Sleep(activityWindow)
+	rates, err := sampler.sample()
+	if err != nil {
+		return nil
+	}
+
+	iops := rates.ReadIOPS + rates.WriteIOPS
+	if iops == 0 {
+		return nil
+	}
+	activity := fmt.Sprintf("%.0f%% busy, %.0f reads/s and %.0f writes/s (%.2f MB/s read, %.2f MB/s written)",
+		rates.Utilization, rates.ReadIOPS, rates.WriteIOPS, rates.ReadMBps, rates.WriteMBps)
+	if rates.Utilization < activityBusyPercent && iops < activityBusyIOPS {
+		warnf(warnDeviceActivity, path, "%s shows some activity before %s: %s", rates.Name, operation, activity)
+		return nil
+	}
+	if allowBusy {
+		warnf(warnDeviceBusy, path, "%s is in use by other processes, going on with %s as --allow-busy is set: %s",
+			rates.Name, operation, activity)
+		return nil
+	}
+	return fmt.Errorf("%s is in use by other processes: %s. Stop them before %s, or pass --allow-busy", rates.Name, activity, operation)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Smart images hold only the allocated parts of a disk. The filesystems say
+// which of their blocks are in use, the rest of the disk is kept up to the
+// end of the last partition, where boot loaders and unknown filesystems live.
+// A block map next to the image lists the ranges it holds, in order, so the
+// full disk can be rebuilt.
+
+// allocationReader is implemented by filesystems that know which of their
+// bytes are in use
+type allocationReader interface {
+	allocatedRanges(size int64) ([]byteRange, error)
+}
+
+// normalizeRanges sorts ranges and merges the overlapping and adjacent ones
+func normalizeRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	var merged []byteRange
+	for _, r := range ranges {
+		if r.End <= r.Start {
+			continue
+		}
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangesLength returns the number of bytes in ranges
+func rangesLength(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// bitmapRanges turns the set bits of an allocation bitmap into byte ranges,
+// bit i standing for the unit at base+i*unit
+func bitmapRanges(bitmap []byte, bits uint64, base, unit int64) []byteRange {
+	var ranges []byteRange
+	for i := uint64(0); i < bits && i/8 < uint64(len(bitmap)); {
+		if bitmap[i/8] == 0 && i%8 == 0 {
+			i += 8
+			continue
+		}
+		if bitmap[i/8]&(1<<(i%8)) == 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < bits && j/8 < uint64(len(bitmap)) && bitmap[j/8]&(1<<(j%8)) != 0 {
+			j++
+		}
+		ranges = append(ranges, byteRange{base + int64(i)*unit, base + int64(j)*unit})
+		i = j
+	}
+	return ranges
+}
+
+// allocatedRanges returns the blocks marked in the block bitmaps, plus the
+// superblock, group descriptors, bitmaps and inode tables. Groups with an
+// uninitialized bitmap only keep their superblock backup area.
+func (e *extFS) allocatedRanges(size int64) ([]byteRange, error) {
+	sb := make([]byte, 1024)
+	if _, err := e.r.ReadAt(sb, 1024); err != nil {
+		return nil, err
+	}
+	blocks := uint64(le32(sb, 0x04))
+	if e.featureIncompat&extIncompat64Bit != 0 {
+		blocks |= uint64(le32(sb, 0x150)) << 32
+	}
+	blocksPerGroup := uint64(le32(sb, 0x20))
+	if blocksPerGroup == 0 || blocks <= uint64(e.firstDataBlock) {
+		return nil, fmt.Errorf("invalid ext geometry")
+	}
+	groups := (blocks - uint64(e.firstDataBlock) + blocksPerGroup - 1) / blocksPerGroup
+	descBlocks := (groups*uint64(e.descSize) + uint64(e.blockSize) - 1) / uint64(e.blockSize)
+	headerBlocks := 1 + descBlocks + uint64(le16(sb, 0xce))
+	tableBlocks := (uint64(e.inodesPerGroup)*uint64(e.inodeSize) + uint64(e.blockSize) - 1) / uint64(e.blockSize)
+
+	descs := make([]byte, groups*uint64(e.descSize))
+	if _, err := e.r.ReadAt(descs, int64(e.firstDataBlock+1)*e.blockSize); err != nil {
+		return nil, fmt.Errorf("reading group descriptors: %v", err)
+	}
+	block := func(n uint64) int64 { return int64(n) * e.blockSize }
+
+	ranges := []byteRange{{0, block(uint64(e.firstDataBlock) + headerBlocks)}}
+	bitmap := make([]byte, e.blockSize)
+	for g := uint64(0); g < groups; g++ {
+		desc := descs[g*uint64(e.descSize):]
+		blockBitmap, inodeBitmap, inodeTable := uint64(le32(desc, 0x00)), uint64(le32(desc, 0x04)), uint64(le32(desc, 0x08))
+		if e.descSize >= 64 {
+			blockBitmap |= uint64(le32(desc, 0x20)) << 32
+			inodeBitmap |= uint64(le32(desc, 0x24)) << 32
+			inodeTable |= uint64(le32(desc, 0x28)) << 32
+		}
+		ranges = append(ranges,
+			byteRange{block(blockBitmap), block(blockBitmap + 1)},
+			byteRange{block(inodeBitmap), block(inodeBitmap + 1)},
+			byteRange{block(inodeTable), block(inodeTable + tableBlocks)})
+
+		first := uint64(e.firstDataBlock) + g*blocksPerGroup
+		count := min(blocksPerGroup, blocks-first)
+		const blockUninit = 0x2
+		if le16(desc, 0x12)&blockUninit != 0 {
+			ranges = append(ranges, byteRange{block(first), block(first + min(headerBlocks, count))})
+			continue
+		}
+		if _, err := e.r.ReadAt(bitmap, block(blockBitmap)); err != nil {
+			return nil, fmt.Errorf("reading the block bitmap of group %d: %v", g, err)
+		}
+		ranges = append(ranges, bitmapRanges(bitmap, count, block(first), e.blockSize)...)
+	}
+	return clampRanges(normalizeRanges(ranges), size), nil
+}
+
+// allocatedRanges returns the reserved sectors, the FATs, the root directory
+// and the clusters in use
+func (f *fatFS) allocatedRanges(size int64) ([]byteRange, error) {
+	ranges := []byteRange{{0, int64(f.firstDataSector) * int64(f.bytesPerSector)}}
+	for c := uint32(2); c < f.clusterCount+2; c++ {
+		if v, ok := f.entry(c); ok && v != 0 {
+			ranges = append(ranges, byteRange{f.clusterOffset(c), f.clusterOffset(c) + f.clusterSize})
+		}
+	}
+	return clampRanges(normalizeRanges(ranges), size), nil
+}
+
+// allocatedRanges returns the clusters marked in $Bitmap and the backup boot
+// sector at the end of the volume
+func (n *ntfsFS) allocatedRanges(size int64) ([]byteRange, error) {
+	record, err := n.readRecord(ntfsBitmapRecord)
+	if err != nil {
+		return nil, fmt.Errorf("reading $Bitmap: %v", err)
+	}
+	data := record.attribute(ntfsAttrData, "")
+	if data == nil {
+		return nil, fmt.Errorf("$Bitmap has no data")
+	}
+	bitmap, err := n.attrData(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading $Bitmap: %v", err)
+	}
+
+	boot := make([]byte, 512)
+	if _, err := n.r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	bytesPerSector := int64(le16(boot, 0x0b))
+	volumeEnd := int64(le64(boot, 0x28)) * bytesPerSector
+	clusters := uint64(volumeEnd / n.clusterSize)
+
+	ranges := bitmapRanges(bitmap, clusters, 0, n.clusterSize)
+	ranges = append(ranges, byteRange{0, n.clusterSize}, byteRange{volumeEnd, volumeEnd + bytesPerSector})
+	return clampRanges(normalizeRanges(ranges), size), nil
+}
+
+// clampRanges cuts ranges off at size
+func clampRanges(ranges []byteRange, size int64) []byteRange {
+	for i := range ranges {
+		if ranges[i].Start >= size {
+			return ranges[:i]
+		}
+		if ranges[i].End > size {
+			ranges[i].End = size
+			return ranges[:i+1]
+		}
+	}
+	return ranges
+}
+
+// smartRanges returns the byte ranges of a disk a smart image holds, and how
+// many bytes of filesystems were left out
+func smartRanges(r io.ReaderAt, size int64, sectorSize uint64) ([]byteRange, int64, error) {
+	table, err := readPartitionTable(r, sectorSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading the partition table: %v", err)
+	}
+
+	// Everything up to the end of the last partition, and the backup GPT,
+	// unless a filesystem says it is unused
+	var end int64
+	for _, part := range table.Partitions {
+		end = max(end, part.Offset(table.SectorSize)+part.Size(table.SectorSize))
+	}
+	ranges := []byteRange{{0, min(end, size)}}
+	if h := table.Header; h != nil {
+		sectors := (uint64(h.NumPartEntries)*uint64(h.PartEntrySize)+table.SectorSize-1)/table.SectorSize + 1
+		ranges = append(ranges, byteRange{size - int64(sectors*table.SectorSize), size})
+	}
+
+	var skipped int64
+	for _, part := range table.Partitions {
+		offset, length := part.Offset(table.SectorSize), part.Size(table.SectorSize)
+		if offset+length > size {
+			continue
+		}
+		fsys, err := openFileSystem(io.NewSectionReader(r, offset, length), length)
+		if err != nil {
+			continue
+		}
+		allocation, ok := fsys.(allocationReader)
+		if !ok {
+			continue
+		}
+		used, err := allocation.allocatedRanges(length)
+		if err != nil {
+			warnf(warnUnreadable, "", "partition %d is imaged in full, its allocation could not be read: %v", part.Number, err)
+			continue
+		}
+		ranges = subtractRange(ranges, byteRange{offset, offset + length})
+		for _, u := range used {
+			ranges = append(ranges, byteRange{offset + u.Start, offset + u.End})
+		}
+		skipped += length - rangesLength(used)
+	}
+	return normalizeRanges(ranges), skipped, nil
+}
+
+// subtractRange removes cut from ranges
+func subtractRange(ranges []byteRange, cut byteRange) []byteRange {
+	var result []byteRange
+	for _, r := range ranges {
+		if r.End <= cut.Start || r.Start >= cut.End {
+			result = append(result, r)
+			continue
+		}
+		if r.Start < cut.Start {
+			result = append(result, byteRange{r.Start, cut.Start})
+		}
+		if r.End > cut.End {
+			result = append(result, byteRange{cut.End, r.End})
+		}
+	}
+	return result
+}
+
+// rangesReader reads the ranges of r as one stream, the layout of a smart image
+type rangesReader struct {
+	r      io.ReaderAt
+	ranges []byteRange
+	starts []int64 // offset of each range in the stream
+	size   int64
+}
+
+func newRangesReader(r io.ReaderAt, ranges []byteRange) *rangesReader {
+	rr := &rangesReader{r: r, ranges: ranges}
+	for _, br := range ranges {
+		rr.starts = append(rr.starts, rr.size)
+		rr.size += br.End - br.Start
+	}
+	return rr
+}
+
+// physical returns the offset on the disk of an offset in the stream
+func (rr *rangesReader) physical(off int64) int64 {
+	i := sort.Search(len(rr.starts), func(i int) bool { return rr.starts[i] > off }) - 1
+	if i < 0 {
+		return off
+	}
+	return rr.ranges[i].Start + off - rr.starts[i]
+}
+
+func (rr *rangesReader) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if off >= rr.size {
+			return total, io.EOF
+		}
+		i := sort.Search(len(rr.starts), func(i int) bool { return rr.starts[i] > off }) - 1
+		within := off - rr.starts[i]
+		n := min(int64(len(p)), rr.ranges[i].End-rr.ranges[i].Start-within)
+		if _, err := rr.r.ReadAt(p[:n], rr.ranges[i].Start+within); err != nil {
+			return total, err
+		}
+		total += int(n)
+		p = p[n:]
+		off += n
+	}
+	return total, nil
+}
+
+// blockMapPath returns the path of the block map of an image
+func blockMapPath(image string) string {
+	return image + ".blockmap"
+}
+
+// blockMap lists the byte ranges of a disk a smart, partition or zero
+// skipping image holds
+type blockMap struct {
+	Size   int64 // of the disk
+	Ranges []byteRange
+	// Zeros is set when the rest of the disk, or partition, was all zeros
+	// and is restored as such
+	Zeros bool
+	// Partition is the partition a partition image was taken of, at
+	// PartitionRange on the disk, 0 for smart images of the whole disk
+	Partition      int
+	PartitionRange byteRange
+}
+
+// writeBlockMap writes the size of the disk and the ranges an image holds
+func writeBlockMap(w io.Writer, m *blockMap) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# dsktool block map, the image holds these byte ranges of the disk in order\n")
+	fmt.Fprintf(bw, "size %d\n", m.Size)
+	if m.Partition > 0 {
+		fmt.Fprintf(bw, "partition %d %d %d\n", m.Partition, m.PartitionRange.Start, m.PartitionRange.End-m.PartitionRange.Start)
+	}
+	if m.Zeros {
+		fmt.Fprintf(bw, "zeros\n")
+	}
+	for _, r := range m.Ranges {
+		fmt.Fprintf(bw, "%d %d\n", r.Start, r.End-r.Start)
+	}
+	return bw.Flush()
+}
+
+// writeImageBlockMap stores the block map next to an image, wherever the
+// image went
+func writeImageBlockMap(image string, options outputOptions, m *blockMap) error {
+	output, err := createOutput(blockMapPath(image), options)
+	if err != nil {
+		return err
+	}
+	if err := writeBlockMap(output, m); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// readBlockMap reads the block map of an image, nil if it has none
+func readBlockMap(image string) (*blockMap, error) {
+	if isURL(image) {
+		return nil, nil
+	}
+	f, err := os.Open(blockMapPath(image))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &blockMap{Size: -1}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if line == "zeros" {
+			m.Zeros = true
+			continue
+		}
+		if fields[0] == "partition" {
+			var number int
+			var start, size int64
+			if _, err := fmt.Sscanf(line, "partition %d %d %d", &number, &start, &size); err != nil || number <= 0 || start < 0 || size <= 0 {
+				return nil, fmt.Errorf("%s line %d: invalid partition", blockMapPath(image), lineNumber)
+			}
+			m.Partition, m.PartitionRange = number, byteRange{start, start + size}
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected two fields", blockMapPath(image), lineNumber)
+		}
+		b, errB := strconv.ParseInt(fields[1], 10, 64)
+		if fields[0] == "size" && errB == nil && b >= 0 {
+			m.Size = b
+			continue
+		}
+		a, errA := strconv.ParseInt(fields[0], 10, 64)
+		if errA != nil || errB != nil || a < 0 || b < 0 {
+			return nil, fmt.Errorf("%s line %d: invalid range", blockMapPath(image), lineNumber)
+		}
+		m.Ranges = append(m.Ranges, byteRange{a, a + b})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.Size < 0 {
+		return nil, fmt.Errorf("%s has no size line", blockMapPath(image))
+	}
+	return m, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The Apple Partition Map of old Macs and some firmware disks is big endian.
+// Block 0 holds the driver descriptor map with the block size, the map
+// entries follow from block 1, the first of them describing the map itself.
+
+// apmDriverDescriptor is the start of block 0 of an APM disk
+type apmDriverDescriptor struct {
+	Signature [2]byte // ER
+	BlockSize uint16
+	Blocks    uint32
+}
+
+// apmPartition is an entry of the partition map
+type apmPartition struct {
+	Signature    [2]byte // PM
+	_            [2]byte
+	MapEntries   uint32
+	StartBlock   uint32
+	Blocks       uint32
+	Name         [32]byte
+	Type         [32]byte
+	DataStart    uint32
+	DataBlocks   uint32
+	Status       uint32
+	BootStart    uint32
+	BootSize     uint32
+	BootLoadAddr uint64
+	BootEntry    uint64
+	BootChecksum uint32
+	Processor    [16]byte
+}
+
+// apmString trims the NUL padding of a name or type field
+func apmString(raw []byte) string {
+	if i := bytes.IndexByte(raw, 0); i >= 0 {
+		raw = raw[:i]
+	}
+	return string(raw)
+}
+
+// readAPM fills pt from an Apple Partition Map and reports whether there is
+// one. The LBAs are in the blocks of the map, which become the sector size.
+func readAPM(r io.ReaderAt, pt *partitionTable) (bool, error) {
+	var ddm apmDriverDescriptor
+	if err := binary.Read(io.NewSectionReader(r, 0, 8), binary.BigEndian, &ddm); err != nil || string(ddm.Signature[:]) != "ER" {
+		return false, nil
+	}
+
+	// Hybrid CD images give 2048 byte blocks in the descriptor but may lay
+	// the map out in 512 byte blocks
+	var first apmPartition
+	blockSize := uint64(0)
+	for _, size := range []uint64{uint64(ddm.BlockSize), 512} {
+		if size == 0 || size%512 != 0 {
+			continue
+		}
+		err := binary.Read(io.NewSectionReader(r, int64(size), 512), binary.BigEndian, &first)
+		if err == nil && string(first.Signature[:]) == "PM" {
+			blockSize = size
+			break
+		}
+	}
+	if blockSize == 0 {
+		return false, nil
+	}
+	if first.MapEntries == 0 || first.MapEntries > 256 {
+		return true, fmt.Errorf("the Apple Partition Map claims %d entries", first.MapEntries)
+	}
+
+	pt.Type = "APM"
+	pt.SectorSize = blockSize
+	for i := uint32(0); i < first.MapEntries; i++ {
+		var entry apmPartition
+		if err := binary.Read(io.NewSectionReader(r, int64(uint64(i+1)*blockSize), 512), binary.BigEndian, &entry); err != nil {
+			return true, fmt.Errorf("reading Apple Partition Map entry %d: %v", i+1, err)
+		}
+		if string(entry.Signature[:]) != "PM" {
+			return true, fmt.Errorf("Apple Partition Map entry %d has no PM signature", i+1)
+		}
+		if entry.Blocks == 0 {
+			continue
+		}
+		pt.Partitions = append(pt.Partitions, partitionEntry{
+			Number:   int(i) + 1,
+			FirstLBA: uint64(entry.StartBlock),
+			LastLBA:  uint64(entry.StartBlock) + uint64(entry.Blocks) - 1,
+			Name:     apmString(entry.Name[:]),
+			APM:      &entry,
+		})
+	}
+	return true, nil
+}
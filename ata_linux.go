@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ATA commands go to SATA drives as SCSI ATA PASS-THROUGH (16) commands
+// through the SG_IO ioctl, which libata and most USB bridges translate.
+
+const (
+	sgIO = 0x2285
+
+	sgDxferNone    = -1
+	sgDxferToDev   = -2
+	sgDxferFromDev = -3
+
+	ataIdentifyDevice     = 0xec
+	ataSecuritySetPass    = 0xf1
+	ataSecurityErasePrep  = 0xf3
+	ataSecurityEraseUnit  = 0xf4
+	ataPassThrough16      = 0x85
+	ataProtocolNonData    = 3
+	ataProtocolPIODataIn  = 4
+	ataProtocolPIODataOut = 5
+)
+
+// sgIOHdr is struct sg_io_hdr of <scsi/sg.h>
+type sgIOHdr struct {
+	InterfaceID    int32
+	DxferDirection int32
+	CmdLen         uint8
+	MxSbLen        uint8
+	IovecCount     uint16
+	DxferLen       uint32
+	Dxferp         uintptr
+	Cmdp           uintptr
+	Sbp            uintptr
+	Timeout        uint32
+	Flags          uint32
+	PackID         int32
+	UsrPtr         uintptr
+	Status         uint8
+	MaskedStatus   uint8
+	MsgStatus      uint8
+	SbLenWr        uint8
+	HostStatus     uint16
+	DriverStatus   uint16
+	Resid          int32
+	Duration       uint32
+	Info           uint32
+}
+
+// ataCommand runs a 28-bit ATA command with one sector of data or none,
+// waiting up to timeout for the drive
+func ataCommand(f *os.File, command, features byte, protocol int, data []byte, timeout time.Duration) error {
+	cdb := make([]byte, 16)
+	cdb[0] = ataPassThrough16
+	cdb[1] = byte(protocol << 1)
+	hdr := sgIOHdr{InterfaceID: 'S', DxferDirection: sgDxferNone, Timeout: uint32(timeout / time.Millisecond)}
+	switch protocol {
+	case ataProtocolPIODataIn:
+		// The length is in the sector count, in blocks, read from the drive
+		cdb[2] = 0x0e
+		hdr.DxferDirection = sgDxferFromDev
+	case ataProtocolPIODataOut:
+		cdb[2] = 0x06
+		hdr.DxferDirection = sgDxferToDev
+	}
+	cdb[4] = features
+	if len(data) > 0 {
+		cdb[6] = byte(len(data) / 512)
+		hdr.Dxferp = uintptr(unsafe.Pointer(&data[0]))
+		hdr.DxferLen = uint32(len(data))
+	}
+	cdb[14] = command
+
+	sense := make([]byte, 32)
+	hdr.CmdLen, hdr.Cmdp = uint8(len(cdb)), uintptr(unsafe.Pointer(&cdb[0]))
+	hdr.MxSbLen, hdr.Sbp = uint8(len(sense)), uintptr(unsafe.Pointer(&sense[0]))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), sgIO, uintptr(unsafe.Pointer(&hdr)))
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(cdb)
+	runtime.KeepAlive(sense)
+	if errno != 0 {
+		return fmt.Errorf("ATA command 0x%02x: %v", command, errno)
+	}
+	if hdr.Status == 0 && hdr.HostStatus == 0 {
+		return nil
+	}
+
+	// Descriptor and fixed format sense data keep the key in different places
+	key := sense[2] & 0x0f
+	if sense[0]&0x7f == 0x72 {
+		key = sense[1] & 0x0f
+	}
+	switch {
+	case hdr.HostStatus != 0:
+		return fmt.Errorf("ATA command 0x%02x did not reach the drive (host status 0x%x), the controller or USB bridge may not pass ATA commands through", command, hdr.HostStatus)
+	case key == 0x0b:
+		return fmt.Errorf("the drive aborted ATA command 0x%02x", command)
+	case key == 0x05:
+		return fmt.Errorf("ATA command 0x%02x was rejected as illegal, the controller or USB bridge may not pass ATA commands through", command)
+	}
+	return fmt.Errorf("ATA command 0x%02x failed, SCSI status 0x%x, sense key 0x%x", command, hdr.Status, key)
+}
+
+// ataIdentify reads the 256 words of IDENTIFY DEVICE
+func ataIdentify(f *os.File) ([256]uint16, error) {
+	var words [256]uint16
+	data := make([]byte, 512)
+	if err := ataCommand(f, ataIdentifyDevice, 0, ataProtocolPIODataIn, data, 10*time.Second); err != nil {
+		return words, err
+	}
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return words, nil
+}
+
+// ataString decodes a string of IDENTIFY data, which keeps two characters a
+// word with the first in the high byte
+func ataString(words []uint16) string {
+	b := make([]byte, 0, len(words)*2)
+	for _, w := range words {
+		b = append(b, byte(w>>8), byte(w))
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ataSecurity is the security feature set state from IDENTIFY word 128
+type ataSecurity struct {
+	Supported         bool
+	Enabled           bool // a user password is set
+	Locked            bool
+	Frozen            bool
+	CountExpired      bool
+	EnhancedSupported bool
+	// NormalTime and EnhancedTime are the erase times the drive gives, 0 if
+	// it gives none
+	NormalTime   time.Duration
+	EnhancedTime time.Duration
+}
+
+func parseATASecurity(words [256]uint16) ataSecurity {
+	w := words[128]
+	return ataSecurity{
+		Supported:         w&1 != 0,
+		Enabled:           w&2 != 0,
+		Locked:            w&4 != 0,
+		Frozen:            w&8 != 0,
+		CountExpired:      w&16 != 0,
+		EnhancedSupported: w&32 != 0,
+		NormalTime:        ataEraseTime(words[89]),
+		EnhancedTime:      ataEraseTime(words[90]),
+	}
+}
+
+// ataEraseTime decodes the erase time of word 89 or 90, in units of two
+// minutes. Bit 15 marks the extended format of ACS-3 with 15 bits of time.
+func ataEraseTime(w uint16) time.Duration {
+	units := w & 0xff
+	if w&0x8000 != 0 {
+		units = w & 0x7fff
+	}
+	return time.Duration(units) * 2 * time.Minute
+}
+
+// ataSecurityData builds the 512 bytes SECURITY SET PASSWORD and SECURITY
+// ERASE UNIT take: the control word and the 32 byte user password
+func ataSecurityData(password string, enhanced bool) []byte {
+	data := make([]byte, 512)
+	if enhanced {
+		data[0] = 2
+	}
+	copy(data[2:34], password)
+	return data
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Azure Block Blob outputs are given as azure://container/blob and use the
+// Azure CLI environment variables: AZURE_STORAGE_ACCOUNT with either
+// AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN. AZURE_STORAGE_BLOB_ENDPOINT
+// overrides the endpoint, e.g. for the Azurite emulator.
+
+const (
+	azureAPIVersion  = "2021-08-06"
+	azureConcurrency = 4
+)
+
+// azureLimits are the limits of the blocks of a block blob
+var azureLimits = cloudLimits{maxParts: 50000, maxPartSize: 4000 * mb}
+
+// azureClient signs requests for one storage account
+type azureClient struct {
+	account  string
+	key      []byte
+	sasToken url.Values
+	endpoint *url.URL
+}
+
+func newAzureClient() (*azureClient, error) {
+	c := &azureClient{account: os.Getenv("AZURE_STORAGE_ACCOUNT")}
+	if c.account == "" {
+		return nil, fmt.Errorf("set AZURE_STORAGE_ACCOUNT for azure:// outputs")
+	}
+
+	switch {
+	case os.Getenv("AZURE_STORAGE_KEY") != "":
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("AZURE_STORAGE_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY is not valid base64: %v", err)
+		}
+		c.key = key
+	case os.Getenv("AZURE_STORAGE_SAS_TOKEN") != "":
+		token, err := url.ParseQuery(strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"))
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN is not a valid query string: %v", err)
+		}
+		c.sasToken = token
+	default:
+		return nil, fmt.Errorf("set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN for azure:// outputs")
+	}
+
+	endpoint := firstNonEmpty(os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT"), fmt.Sprintf("https://%s.blob.core.windows.net", c.account))
+	var err error
+	if c.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid Azure endpoint %q: %v", endpoint, err)
+	}
+	return c, nil
+}
+
+// sign adds a Shared Key signature to a request
+func (c *azureClient) sign(req *http.Request, contentLength int) {
+	length := ""
+	if contentLength > 0 {
+		length = fmt.Sprint(contentLength)
+	}
+
+	var msHeaders []string
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + c.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+
+	h := req.Header
+	stringToSign := strings.Join([]string{
+		req.Method, h.Get("Content-Encoding"), h.Get("Content-Language"), length, h.Get("Content-MD5"),
+		h.Get("Content-Type"), "", h.Get("If-Modified-Since"), h.Get("If-Match"), h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"), h.Get("Range"), strings.Join(msHeaders, "\n"), resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+c.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// do sends a request for a blob, authorised by the key or the SAS token
+func (c *azureClient) do(method, container, blob string, query url.Values, headers map[string]string, body []byte) error {
+	target := *c.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + container + "/" + blob
+	if query == nil {
+		query = url.Values{}
+	}
+	for name, values := range c.sasToken {
+		query[name] = values
+	}
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if c.key != nil {
+		c.sign(req, len(body))
+	}
+	_, _, err = cloudDo(req)
+	return err
+}
+
+// azureUpload uploads a block blob as blocks and commits the block list at the end
+type azureUpload struct {
+	client    *azureClient
+	container string
+	blob      string
+
+	mu    sync.Mutex
+	parts int
+}
+
+// azureBlockID is the ID of a block, all IDs of a blob must have the same length
+func azureBlockID(number int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("dsktool-%08d", number)))
+}
+
+func (u *azureUpload) begin() error {
+	return nil
+}
+
+func (u *azureUpload) uploadPart(number int, data []byte) error {
+	u.mu.Lock()
+	u.parts = max(u.parts, number)
+	u.mu.Unlock()
+	query := url.Values{"comp": {"block"}, "blockid": {azureBlockID(number)}}
+	return u.client.do(http.MethodPut, u.container, u.blob, query, nil, data)
+}
+
+func (u *azureUpload) complete() error {
+	var list struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+	for number := 1; number <= u.parts; number++ {
+		list.Latest = append(list.Latest, azureBlockID(number))
+	}
+	body, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return u.client.do(http.MethodPut, u.container, u.blob, url.Values{"comp": {"blocklist"}}, nil, append([]byte(xml.Header), body...))
+}
+
+// abort leaves the uncommitted blocks, Azure discards them after a week
+func (u *azureUpload) abort() error {
+	return nil
+}
+
+func (u *azureUpload) putObject(data []byte) error {
+	return u.client.do(http.MethodPut, u.container, u.blob, nil, map[string]string{"X-Ms-Blob-Type": "BlockBlob"}, data)
+}
+
+// newAzureOutput streams to a block blob given as azure://container/blob
+func newAzureOutput(target string, options outputOptions) (io.WriteCloser, error) {
+	container, blob, _ := strings.Cut(strings.TrimPrefix(target, "azure://"), "/")
+	if container == "" || blob == "" {
+		return nil, fmt.Errorf("%s is not a valid Azure URL, use azure://container/blob", target)
+	}
+	if options.SSE != "" || options.SSEKMSKey != "" {
+		return nil, fmt.Errorf("Azure encrypts blobs with the account settings, --sse and --sse-kms-key do not apply")
+	}
+
+	client, err := newAzureClient()
+	if err != nil {
+		return nil, err
+	}
+	return newCloudWriter(target, &azureUpload{client: client, container: container, blob: blob}, azureConcurrency, azureLimits, options), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Batch scripts are plain text, one dsktool command per line without the
+// program name. Blank lines and lines starting with # are ignored, and these
+// directives are understood:
+//
+//	set NAME VALUE            define ${NAME} for the following lines
+//	on-error stop             abort the script when a step fails (default)
+//	on-error continue         record the failure and go on
+//	on-error retry N          run a failing step up to N more times, then stop
+//
+// ${DEVICE} is the device given on the command line and ${DATE} the start
+// date, so one script can run the same pipeline on every disk of a line.
+
+// batchStep is one command of a batch script with the error policy in effect for it
+type batchStep struct {
+	Line    int
+	Args    []string
+	OnError string
+	Retries int
+}
+
+// batchResult records how a step went
+type batchResult struct {
+	Step     batchStep
+	Attempts int
+	Err      error
+	Duration time.Duration
+}
+
+// batchForbidden are commands that make no sense unattended
+var batchForbidden = []string{"batch", "tui"}
+
+// splitBatchLine splits a line into words, honouring single and double quotes
+func splitBatchLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// parseBatchScript reads a script and expands its variables. All errors are
+// reported before anything runs.
+func parseBatchScript(path string, vars map[string]string) ([]batchStep, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var steps []batchStep
+	var problems []string
+	onError, retries := "stop", 0
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words, err := splitBatchLine(line)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", lineNumber, err))
+			continue
+		}
+
+		var undefined []string
+		for i, word := range words {
+			words[i] = os.Expand(word, func(name string) string {
+				value, ok := vars[name]
+				if !ok {
+					undefined = append(undefined, name)
+				}
+				return value
+			})
+		}
+		if len(undefined) > 0 {
+			problems = append(problems, fmt.Sprintf("line %d: undefined variable %s", lineNumber, strings.Join(undefined, ", ")))
+			continue
+		}
+
+		switch words[0] {
+		case "set":
+			if len(words) != 3 {
+				problems = append(problems, fmt.Sprintf("line %d: use set NAME VALUE", lineNumber))
+				continue
+			}
+			vars[words[1]] = words[2]
+
+		case "on-error":
+			switch {
+			case len(words) == 2 && (words[1] == "stop" || words[1] == "continue"):
+				onError, retries = words[1], 0
+			case len(words) == 3 && words[1] == "retry":
+				n, err := strconv.Atoi(words[2])
+				if err != nil || n < 1 {
+					problems = append(problems, fmt.Sprintf("line %d: retry needs a positive count", lineNumber))
+					continue
+				}
+				onError, retries = "retry", n
+			default:
+				problems = append(problems, fmt.Sprintf("line %d: use on-error stop, continue or retry N", lineNumber))
+			}
+
+		default:
+			if containsString(batchForbidden, words[0]) {
+				problems = append(problems, fmt.Sprintf("line %d: %s cannot run in a batch", lineNumber, words[0]))
+				continue
+			}
+			steps = append(steps, batchStep{Line: lineNumber, Args: words, OnError: onError, Retries: retries})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s has errors:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return steps, nil
+}
+
+// runBatch runs the steps of a script in order, each as a separate dsktool process
+func runBatch(script, device string, defines []string) error {
+	vars := map[string]string{"DEVICE": device, "DATE": time.Now().Format("2006-01-02")}
+	for _, define := range defines {
+		name, value, ok := strings.Cut(define, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid --set %q, use NAME=VALUE", define)
+		}
+		vars[name] = value
+	}
+
+	steps, err := parseBatchScript(script, vars)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("%s has no steps", script)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var results []batchResult
+	failed := 0
+	for i, step := range steps {
+		args := step.Args
+		if dryRun {
+			args = append([]string{"--dry-run"}, args...)
+		}
+
+		result := batchResult{Step: step}
+		start := time.Now()
+		for {
+			result.Attempts++
+			fmt.Printf("%s[%d/%d] line %d: dsktool %s%s\n", yellow, i+1, len(steps), step.Line, strings.Join(step.Args, " "), reset)
+			cmd := exec.Command(self, args...)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			result.Err = cmd.Run()
+			if result.Err == nil || step.OnError != "retry" || result.Attempts > step.Retries {
+				break
+			}
+			fmt.Printf("%sStep failed (%v), retrying %d/%d%s\n", red, result.Err, result.Attempts, step.Retries, reset)
+		}
+		result.Duration = time.Since(start)
+		results = append(results, result)
+
+		if result.Err != nil {
+			failed++
+			if step.OnError != "continue" {
+				fmt.Printf("%sStep on line %d failed, stopping%s\n", red, step.Line, reset)
+				break
+			}
+		}
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LINE\tSTATUS\tTIME\tCOMMAND")
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "failed"
+		}
+		if result.Attempts > 1 {
+			status += fmt.Sprintf(" (%d attempts)", result.Attempts)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", result.Step.Line, status, result.Duration.Round(time.Millisecond), strings.Join(result.Step.Args, " "))
+	}
+	for _, step := range steps[len(results):] {
+		fmt.Fprintf(w, "%d\tskipped\t\t%s\n", step.Line, strings.Join(step.Args, " "))
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d steps failed", failed, len(steps))
+	}
+	return nil
+}
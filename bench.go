@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+var benchRecordHeaders = []string{"test", "run", "size_bytes", "write_mbps", "read_mbps"}
+
+// benchReport prints benchmark results as text, or collects them as records
+// for a machine readable --format with the progress going to stderr
+type benchReport struct {
+	format string
+	rows   [][]string
+	live   io.Writer // above the progress display of the running test
+}
+
+// output is where the text goes, stderr for a machine readable --format
+func (r *benchReport) output() io.Writer {
+	if r.live != nil {
+		return r.live
+	}
+	if r.format != "text" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// infof prints progress and setup details
+func (r *benchReport) infof(format string, args ...any) {
+	fmt.Fprintf(r.output(), format, args...)
+}
+
+// startTest shows the progress of a test to the progress sinks, reported
+// with reportProgress after each iteration, until the returned function
+// stops it
+func (r *benchReport) startTest(name string) func() {
+	display := startProgressDisplay(name, r.output())
+	r.live = display.Bypass()
+	return func() {
+		display.stop()
+		r.live = nil
+	}
+}
+
+// result records the speeds of a run, run is the iteration number or average
+func (r *benchReport) result(test, run string, size int, writeMBps, readMBps float64) {
+	if r.format != "text" {
+		r.rows = append(r.rows, []string{test, run, strconv.Itoa(size),
+			strconv.FormatFloat(writeMBps, 'f', 2, 64), strconv.FormatFloat(readMBps, 'f', 2, 64)})
+		return
+	}
+	if run == "average" {
+		fmt.Fprintf(r.output(), "[%s] Average: Write speed: %.2f MB/s, Read speed: %.2f MB/s\n\n", test, writeMBps, readMBps)
+		return
+	}
+	fmt.Fprintf(r.output(), "[%s] Test %s: Write speed: %.2f MB/s, Read speed: %.2f MB/s\n", test, run, writeMBps, readMBps)
+}
+
+// flush writes the collected records
+func (r *benchReport) flush() error {
+	if r.format == "text" {
+		return nil
+	}
+	return writeRecords(os.Stdout, r.format, benchRecordHeaders, r.rows)
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 )
 
-func benchFullTest(size, iterations int, dir string) {
+func benchFullTest(size, iterations int, dir string, report *benchReport) {
 	// Handle default case
 	if dir == "." {
 		// Use Windows system drive
@@ -24,32 +25,54 @@ func benchFullTest(size, iterations int, dir string) {
 		}
 	}
 
-	fmt.Printf("Testing with file size: %d MB\n", size)
-	fmt.Printf("Testing on device: %s\n\n", dir)
+	// The tests write to the disk itself, like every other writer they
+	// are subject to the write policy and --dry-run
+	if err := checkWritePolicy(dir, "benchmark writes"); err != nil {
+		reportFailure("Cannot benchmark:", err.Error())
+		return
+	}
+	if err := checkDeviceActivity(dir, "benchmarking"); err != nil {
+		reportFailure("Cannot benchmark:", err.Error())
+		return
+	}
+	if dryRun {
+		fmt.Printf("Dry run: would write and read %s %d times per test at the start of %s, nothing was written\n", formatBytes(size), iterations, dir)
+		return
+	}
+
+	report.infof("Testing with file size: %s\n", formatBytes(size))
+	report.infof("Testing on device: %s\n\n", dir)
 
 	// Open the device once to check permissions
 	testFile, err := openForAsyncIO(dir)
 	if err != nil {
 		fmt.Printf("Error opening device %s: %v\n", dir, err)
-		fmt.Println("Please run with administrator privileges")
+		if isPermissionError(err) {
+			offerElevation("Benchmarking " + dir)
+		}
 		return
 	}
 	testFile.Close()
 
-	runTest("Sequential Read/Write", size*mb, iterations, dir, sequentialReadWrite)
-	runTest("512K Blocks", size*mb, iterations, dir, func(f *os.File, size int) (time.Duration, time.Duration) {
+	runTest("Sequential Read/Write", size, iterations, dir, report, sequentialReadWrite)
+	runTest("512K Blocks", size, iterations, dir, report, func(f *os.File, size int) (time.Duration, time.Duration) {
 		return blockReadWrite(f, size, 512*kb)
 	})
-	runTest("4K Blocks", size*mb, iterations, dir, func(f *os.File, size int) (time.Duration, time.Duration) {
+	runTest("4K Blocks", size, iterations, dir, report, func(f *os.File, size int) (time.Duration, time.Duration) {
 		return blockReadWrite(f, size, 4*kb)
 	})
-	runTest("4KQD32", size*mb, iterations, dir, func(f *os.File, size int) (time.Duration, time.Duration) {
+	runTest("4KQD32", size, iterations, dir, report, func(f *os.File, size int) (time.Duration, time.Duration) {
 		return queuedBlockReadWrite(f, size, 4*kb, 32)
 	})
 }
 
-func runTest(name string, size, iterations int, devicePath string, testFunc func(*os.File, int) (writeDuration, readDuration time.Duration)) {
+func runTest(name string, size, iterations int, devicePath string, report *benchReport, testFunc func(*os.File, int) (writeDuration, readDuration time.Duration)) {
 	var totalWriteDuration, totalReadDuration time.Duration
+	stop := report.startTest(name)
+	defer stop()
+	// Each iteration writes and reads the size once
+	total := int64(2 * size * iterations)
+	reportProgress("benchmarking "+name, 0, total)
 
 	for i := 0; i < iterations; i++ {
 		tmpFile, err := openForAsyncIO(devicePath)
@@ -64,12 +87,13 @@ func runTest(name string, size, iterations int, devicePath string, testFunc func
 
 		writeSpeed := float64(size) / writeDuration.Seconds() / mb
 		readSpeed := float64(size) / readDuration.Seconds() / mb
-		fmt.Printf("[%s] Test %d: Write speed: %.2f MB/s, Read speed: %.2f MB/s\n", name, i+1, writeSpeed, readSpeed)
+		report.result(name, strconv.Itoa(i+1), size, writeSpeed, readSpeed)
+		reportProgress("benchmarking "+name, int64(2*size*(i+1)), total)
 
 		tmpFile.Close()
 	}
 
 	avgWriteSpeed := float64(size*iterations) / totalWriteDuration.Seconds() / mb
 	avgReadSpeed := float64(size*iterations) / totalReadDuration.Seconds() / mb
-	fmt.Printf("[%s] Average: Write speed: %.2f MB/s, Read speed: %.2f MB/s\n\n", name, avgWriteSpeed, avgReadSpeed)
+	report.result(name, "average", size, avgWriteSpeed, avgReadSpeed)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Virtual disk formats that hypervisors attach directly are written block by
+// block: the device is read in order, blocks that are all zeros, or outside
+// the ranges of a smart image, are left out and the format's metadata is
+// written at the end.
+
+// blockImageWriter lays out the blocks of a virtual disk in an image file
+type blockImageWriter interface {
+	// writeBlock stores a block with data, blocks come in ascending order
+	writeBlock(index int64, data []byte) error
+	// finish writes the metadata once every block is stored
+	finish() error
+	// allocated is how much data the image holds so far
+	allocated() int64
+}
+
+// blockImageFormat is an image format the image command writes with --format
+type blockImageFormat struct {
+	Name      string
+	Extension string
+	BlockSize int64 // the unit zero blocks are skipped in
+	New       func(file *os.File, size, sectorSize int64) (blockImageWriter, error)
+}
+
+var blockImageFormats = map[string]blockImageFormat{
+	"qcow2": {Name: "qcow2", Extension: ".qcow2", BlockSize: qcow2ClusterSize, New: newQcow2Writer},
+	"vhd": {Name: "dynamic VHD", Extension: ".vhd", BlockSize: vhdBlockSize, New: func(file *os.File, size, sectorSize int64) (blockImageWriter, error) {
+		return newVHDWriter(file, size, false)
+	}},
+	"vhd-fixed": {Name: "fixed VHD", Extension: ".vhd", BlockSize: qcow2ClusterSize, New: func(file *os.File, size, sectorSize int64) (blockImageWriter, error) {
+		return newVHDWriter(file, size, true)
+	}},
+	"vhdx": {Name: "dynamic VHDX", Extension: ".vhdx", BlockSize: vhdxBlockSize, New: func(file *os.File, size, sectorSize int64) (blockImageWriter, error) {
+		return newVHDXWriter(file, size, sectorSize, false)
+	}},
+	"vhdx-fixed": {Name: "fixed VHDX", Extension: ".vhdx", BlockSize: qcow2ClusterSize, New: func(file *os.File, size, sectorSize int64) (blockImageWriter, error) {
+		return newVHDXWriter(file, size, sectorSize, true)
+	}},
+}
+
+// writeBlockImage images a device into a virtual disk file in one of the
+// blockImageFormats. Smart images read only the ranges filesystems use.
+func writeBlockImage(device, outputfile, formatName string, imaging imageOptions) error {
+	format, ok := blockImageFormats[formatName]
+	if !ok {
+		return fmt.Errorf("unknown image format %q, leave it out for a compressed image or use qcow2, vhd, vhd-fixed, vhdx or vhdx-fixed", formatName)
+	}
+	if strings.Contains(outputfile, "://") {
+		return fmt.Errorf("%s images are written to local files only", formatName)
+	}
+	if imaging.Partition > 0 {
+		return fmt.Errorf("%s images hold whole disks, --partition applies to compressed images", formatName)
+	}
+	if imaging.Encrypt != "" || imaging.Resume || imaging.Estimate > 0 || imaging.AutoCompress || imaging.Compression != (compressionOptions{}) {
+		return fmt.Errorf("%s images are not compressed, --encrypt, --resume, --estimate and the compression options do not apply", formatName)
+	}
+	blockSize := format.BlockSize
+
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	// Fixed images take the whole disk, sparse ones at most that
+	if outputfile, err = prepareOutput(device, outputfile, format.Extension, imaging.Output, false, image.Size, strings.HasSuffix(formatName, "-fixed")); err != nil {
+		return err
+	}
+
+	tuning, err := tuneIO(image.File, image.Path, image.Size, image.SectorSize, imaging.Tuning)
+	if err != nil {
+		return fmt.Errorf("invalid I/O settings: %v", err)
+	}
+	// Chunks split into whole blocks
+	tuning.BlockSize = (tuning.BlockSize + blockSize - 1) / blockSize * blockSize
+
+	ranges := []byteRange{{Start: 0, End: image.Size}}
+	if imaging.Smart {
+		var skipped int64
+		if ranges, skipped, err = smartRanges(image, image.Size, image.SectorSize); err != nil {
+			return fmt.Errorf("smart imaging needs a partition table: %v", err)
+		}
+		fmt.Printf("Smart imaging, skipping %s of unused filesystem blocks\n", formatBytes(skipped))
+	}
+	// Ranges are read in whole blocks, which may join neighbours
+	var blocks []byteRange
+	for _, r := range ranges {
+		start := r.Start &^ (blockSize - 1)
+		end := min((r.End+blockSize-1)&^(blockSize-1), image.Size)
+		if n := len(blocks); n > 0 && start <= blocks[n-1].End {
+			blocks[n-1].End = max(blocks[n-1].End, end)
+			continue
+		}
+		blocks = append(blocks, byteRange{Start: start, End: end})
+	}
+	total := rangesLength(blocks)
+
+	var source io.ReaderAt = image
+	var rescue *rescueReader
+	if imaging.Rescue {
+		fill, err := parseFillPattern(imaging.Fill)
+		if err != nil {
+			return err
+		}
+		rescue = newRescueReader(image, image.SectorSize, imaging.ReadRetries, fill)
+		source = rescue
+	}
+
+	file, err := os.Create(outputfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w, err := format.New(file, image.Size, int64(image.SectorSize))
+	if err != nil {
+		file.Close()
+		os.Remove(outputfile)
+		return err
+	}
+	fmt.Printf("Writing %s image %s of %s, reading %s\n", format.Name, outputfile, formatBytes(image.Size), tuning)
+	manifest := newImageManifest(device, outputfile, image, image.Size, image.SectorSize)
+	manifest.Format, manifest.Smart = formatName, imaging.Smart
+
+	listenForPause()
+	var (
+		imaged    int64
+		imageHash = sha256.New()
+		zero      = make([]byte, blockSize)
+		start     = time.Now()
+		display   = startProgressDisplay("", nil)
+	)
+	display.extra = func() []string { return imagingProgressLines(tuning, nil, rescue) }
+	for _, r := range blocks {
+		err = readChunks(io.NewSectionReader(source, r.Start, r.End-r.Start), r.End-r.Start, tuning, func(chunk []byte, offset int64) error {
+			imageHash.Write(chunk)
+			for at := int64(0); at < int64(len(chunk)); at += blockSize {
+				block := chunk[at:min(at+blockSize, int64(len(chunk)))]
+				if bytes.Equal(block, zero[:len(block)]) {
+					continue
+				}
+				// The last block of a disk that is not a multiple of the block size is padded
+				if int64(len(block)) < blockSize {
+					block = append(bytes.Clone(block), zero[len(block):]...)
+				}
+				if err := w.writeBlock((r.Start+offset+at)/blockSize, block); err != nil {
+					return fmt.Errorf("writing the image: %v", err)
+				}
+			}
+
+			imaged += int64(len(chunk))
+			reportWritten("imaging", w.allocated())
+			reportProgress("imaging", imaged, total)
+			start = start.Add(pausePoint(display.Bypass(), file.Sync))
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	display.stop()
+	if err != nil {
+		return err
+	}
+
+	if err := w.finish(); err != nil {
+		return fmt.Errorf("writing the %s metadata: %v", formatName, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if rescue != nil {
+		if err := rescue.writeImageRescueMap(outputfile, outputOptions{}, image.Size, blocks); err != nil {
+			return fmt.Errorf("writing the rescue map: %v", err)
+		}
+	}
+	info, err := os.Stat(outputfile)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("Imaged %s in %s (%.2f MB/s), %s allocated, the image file has %s\n",
+		formatBytes(imaged), elapsed.Truncate(time.Second), float64(imaged)/mb/elapsed.Seconds(),
+		formatBytes(w.allocated()), formatBytes(info.Size()))
+	// Smart images read whole blocks around the ranges, so their hash would not compare
+	var hash []byte
+	if !imaging.Smart {
+		hash = imageHash.Sum(nil)
+		fmt.Printf("SHA-256 of the imaged data: %x\n", hash)
+	}
+	if err := manifest.finish(outputOptions{}, imaged, info.Size(), hash); err != nil {
+		return fmt.Errorf("writing the manifest: %v", err)
+	}
+	fmt.Println("Manifest:", manifestPath(outputfile))
+	if hash != nil {
+		printResult("%x  %s", hash, outputfile)
+	} else {
+		printResult("%s", outputfile)
+	}
+	return nil
+}
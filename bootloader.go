@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// maxBootloaderSize is the largest blob write-bootloader takes, U-Boot with
+// its SPL stays far below it, anything larger is likely the wrong file
+const maxBootloaderSize = 32 * mb
+
+// bootRegion is a part of the disk a bootloader must not overwrite
+type bootRegion struct {
+	Name  string
+	Range byteRange
+}
+
+// protectedBootRegions returns the partition table structures and the
+// partitions of a disk
+func protectedBootRegions(table *partitionTable, size int64) []bootRegion {
+	sector := int64(table.SectorSize)
+	// The boot code in front of the MBR partition table may be replaced,
+	// the disk signature, the table and the boot signature not
+	regions := []bootRegion{{Name: "the MBR partition table", Range: byteRange{Start: 440, End: 512}}}
+
+	if h := table.Header; h != nil {
+		entries := (int64(h.NumPartEntries)*int64(h.PartEntrySize) + sector - 1) / sector
+		regions = append(regions,
+			bootRegion{Name: "the primary GPT header", Range: byteRange{Start: sector, End: 2 * sector}},
+			bootRegion{Name: "the primary GPT entries", Range: byteRange{
+				Start: int64(h.PartitionEntryLBA) * sector,
+				End:   (int64(h.PartitionEntryLBA) + entries) * sector,
+			}},
+			bootRegion{Name: "the backup GPT", Range: byteRange{Start: size - (entries+1)*sector, End: size}},
+		)
+	}
+	for _, part := range table.Partitions {
+		regions = append(regions, bootRegion{
+			Name:  fmt.Sprintf("partition %d", part.Number),
+			Range: byteRange{Start: part.Offset(table.SectorSize), End: part.Offset(table.SectorSize) + part.Size(table.SectorSize)},
+		})
+	}
+	return regions
+}
+
+// writeBootloader writes a bootloader blob like U-Boot or an SPL at a raw
+// offset of a disk, after making sure it stays clear of the partition table
+// and the partitions
+func writeBootloader(file, device, offsetValue, confirm string) error {
+	blob, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(blob) == 0 {
+		return fmt.Errorf("%s is empty", file)
+	}
+	if len(blob) > maxBootloaderSize {
+		return fmt.Errorf("%s has %s, more than the %s a bootloader takes", file, formatBytes(int64(len(blob))), formatBytes(maxBootloaderSize))
+	}
+
+	writer, err := openDeviceWriter(device, "write-bootloader "+file)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	offset, err := parseSize(offsetValue, int64(writer.SectorSize), writer.Size)
+	if err != nil {
+		return fmt.Errorf("invalid offset: %v", err)
+	}
+	area := byteRange{Start: offset, End: offset + int64(len(blob))}
+	if area.End > writer.Size {
+		return fmt.Errorf("%s at offset %d goes %s past the end of %s", file, offset, formatBytes(area.End-writer.Size), device)
+	}
+
+	table, err := writer.partitionTable()
+	if err != nil {
+		fmt.Printf("%s has no partition table (%v), only the size is checked\n", device, err)
+	} else {
+		for _, region := range protectedBootRegions(table, writer.Size) {
+			if area.Start < region.Range.End && region.Range.Start < area.End {
+				hint := "pick another offset"
+				if table.Header != nil && region.Name == "the primary GPT entries" {
+					hint = "move the GPT entries behind it, e.g. with sgdisk -j, or pick another offset"
+				}
+				return fmt.Errorf("bytes %d-%d of %s would overwrite %s at bytes %d-%d, %s",
+					area.Start, area.End-1, file, region.Name, region.Range.Start, region.Range.End-1, hint)
+			}
+		}
+	}
+
+	current := make([]byte, len(blob))
+	if _, err := writer.ReadAt(current, offset); err != nil {
+		return fmt.Errorf("reading offset %d: %v", offset, err)
+	}
+	switch {
+	case bytes.Equal(current, blob):
+		fmt.Printf("%s already holds %s at offset %d\n", device, file, offset)
+		return nil
+	case isZero(current):
+		fmt.Printf("The %s at offset %d are empty\n", formatBytes(area.End-area.Start), offset)
+	default:
+		fmt.Printf("%sThe %s at offset %d hold data, likely an older bootloader, which is replaced%s\n", yellow, formatBytes(area.End-area.Start), offset, reset)
+	}
+
+	description := fmt.Sprintf("%s at offset %d of %s", formatBytes(area.End-area.Start), offset, device)
+	if serial := diskSerial(device); serial != "" {
+		description += fmt.Sprintf(" (serial %s)", serial)
+	}
+	if !writer.DryRun {
+		if err := confirmTyped(device, description, confirm); err != nil {
+			return err
+		}
+	}
+
+	if _, err := writer.WriteAt(blob, offset); err != nil {
+		return fmt.Errorf("writing at offset %d: %v", offset, err)
+	}
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	if writer.DryRun {
+		return nil
+	}
+
+	// Read back past the cache, a bootloader that is off by one byte does not boot
+	dropCache(writer.File)
+	if _, err := writer.ReadAt(current, offset); err != nil {
+		return fmt.Errorf("reading back: %v", err)
+	}
+	if !bytes.Equal(current, blob) {
+		return fmt.Errorf("what was read back from offset %d differs from %s", offset, file)
+	}
+	fmt.Printf("%sWrote and verified %s of %s at offset %d of %s%s\n", green, formatBytes(int64(len(blob))), file, offset, device, reset)
+	printResult("%s", device)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A BSD disklabel sits in the second sector of the disk, or of the MBR slice
+// holding it, and divides it into partitions a, b, c and on. The c partition
+// covers the whole slice by convention, its offset tells whether the other
+// offsets count from the disk or from the slice.
+
+const (
+	bsdLabelMagic      = 0x82564557
+	bsdMaxPartitions   = 22
+	bsdRawPartition    = 2
+	bsdPartitionsStart = 148
+)
+
+// bsdSliceTypes are the MBR types of slices that hold a disklabel
+var bsdSliceTypes = map[uint8]bool{0xa5: true, 0xa6: true, 0xa9: true}
+
+// bsdPartition is a partition entry of a disklabel
+type bsdPartition struct {
+	Sectors      uint32
+	Offset       uint32
+	FragmentSize uint32
+	FSType       uint8
+	Fragments    uint8
+	CylPerGroup  uint16
+}
+
+// bsdFSTypeNames are the names of the disklabel filesystem types
+var bsdFSTypeNames = map[uint8]string{
+	1:  "swap",
+	7:  "4.2BSD (UFS)",
+	8:  "MSDOS",
+	9:  "4.4LFS",
+	11: "HPFS",
+	12: "ISO9660",
+	13: "boot",
+	17: "ext2fs",
+	18: "NTFS",
+	19: "RAID",
+	21: "JFS2",
+	23: "vinum",
+	24: "UDF",
+	27: "ZFS",
+}
+
+// bsdPartitionLetter returns the letter of the partition with a 1 based number
+func bsdPartitionLetter(number int) string {
+	return string(rune('a' + number - 1))
+}
+
+// readBSDLabel reads the disklabel of the slice starting at base and returns
+// its partitions with LBAs on the disk, false if there is no valid label
+func readBSDLabel(r io.ReaderAt, base, sectorSize uint64) ([]partitionEntry, bool) {
+	block := make([]byte, 512)
+	if _, err := r.ReadAt(block, int64((base+1)*sectorSize)); err != nil {
+		return nil, false
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint16(block[138:]))
+	if le.Uint32(block[0:]) != bsdLabelMagic || le.Uint32(block[132:]) != bsdLabelMagic ||
+		count == 0 || count > bsdMaxPartitions {
+		return nil, false
+	}
+
+	// The 16 bit words of the label XOR to zero with the checksum
+	var sum uint16
+	for i := 0; i < bsdPartitionsStart+count*16; i += 2 {
+		sum ^= le.Uint16(block[i:])
+	}
+	if sum != 0 {
+		return nil, false
+	}
+
+	entries := make([]bsdPartition, count)
+	for i := range entries {
+		e := block[bsdPartitionsStart+i*16:]
+		entries[i] = bsdPartition{
+			Sectors:      le.Uint32(e[0:]),
+			Offset:       le.Uint32(e[4:]),
+			FragmentSize: le.Uint32(e[8:]),
+			FSType:       e[12],
+			Fragments:    e[13],
+			CylPerGroup:  le.Uint16(e[14:]),
+		}
+	}
+	var rawOffset uint64
+	if count > bsdRawPartition {
+		rawOffset = uint64(entries[bsdRawPartition].Offset)
+	}
+
+	var parts []partitionEntry
+	for i := range entries {
+		entry := entries[i]
+		// Unused entries include the c partition, which is the slice itself
+		if entry.Sectors == 0 || entry.FSType == 0 || uint64(entry.Offset) < rawOffset {
+			continue
+		}
+		first := base + uint64(entry.Offset) - rawOffset
+		parts = append(parts, partitionEntry{
+			Number:   i + 1,
+			FirstLBA: first,
+			LastLBA:  first + uint64(entry.Sectors) - 1,
+			Name:     bsdPartitionLetter(i + 1),
+			BSD:      &entry,
+		})
+	}
+	return parts, true
+}
+
+// bsdTypeName returns the name of a disklabel filesystem type
+func bsdTypeName(fsType uint8) string {
+	if name, ok := bsdFSTypeNames[fsType]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", fsType)
+}
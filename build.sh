@@ -16,6 +16,10 @@ echo Building "$CDIR"
     echo "Statically Building in $BINDIR for $BUILDOS ($BUILDARCH)"
     GOOS=$BUILDOS GOARCH=$BUILDARCH CGO_ENABLED=$CGO go build -o "$BINDIR"/"$CDIR"
 
+    # Without the TUI and FUSE, for initramfs and PXE rescue images
+    echo "Statically Building tiny in $BINDIR for $BUILDOS ($BUILDARCH)"
+    GOOS=$BUILDOS GOARCH=$BUILDARCH CGO_ENABLED=$CGO go build -tags tiny -ldflags "-s -w" -o "$BINDIR"/"$CDIR"-tiny
+
     BUILDOS="windows"
     echo "Statically Building in $BINDIR for $BUILDOS ($BUILDARCH)"
     GOOS=$BUILDOS GOARCH=$BUILDARCH CGO_ENABLED=$CGO go build -o "$BINDIR"/"$CDIR".exe
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// capabilityReport describes what this build can do on this platform, for
+// tools that drive dsktool
+type capabilityReport struct {
+	Version       string          `json:"version"`
+	OS            string          `json:"os"`
+	Arch          string          `json:"arch"`
+	Build         string          `json:"build"`
+	Features      map[string]bool `json:"features"`
+	Compression   []string        `json:"compression"`
+	OutputFormats []string        `json:"output_formats"`
+	Outputs       []string        `json:"outputs"`
+	FileSystems   []string        `json:"filesystems"`
+	Mkfs          []string        `json:"mkfs"`
+	Plugins       []string        `json:"plugins"`
+}
+
+// capabilities probes the build, the platform and the installed tools
+func capabilities() capabilityReport {
+	report := capabilityReport{
+		Version:       appversion,
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Build:         "full",
+		Compression:   compressionAlgorithms,
+		OutputFormats: append([]string(nil), outputFormats...),
+		Outputs:       []string{"file"},
+		FileSystems:   []string{"fat", "ext", "ntfs"},
+		Mkfs:          append([]string{"fat32", "fat16"}, externalMkfsTypes()...),
+		Plugins:       []string{},
+	}
+	if !tuiAvailable {
+		report.Build = "tiny"
+	}
+
+	_, smartErr := exec.LookPath("smartctl")
+	report.Features = map[string]bool{
+		"partition_editing": true,
+		"smart":             smartErr == nil,
+		"direct_io":         false,
+		"disk_stats":        diskStatsAvailable(),
+		"tui":               tuiAvailable,
+		"fuse_mount":        fuseAvailable,
+		"nbd_serve":         true,
+		"hooks":             true,
+		"plugins":           true,
+	}
+
+	for scheme := range outputBackends {
+		report.Outputs = append(report.Outputs, scheme)
+	}
+	for _, plugin := range plugins() {
+		if plugin.Err != nil {
+			continue
+		}
+		report.Plugins = append(report.Plugins, plugin.Name)
+		report.Outputs = append(report.Outputs, plugin.Outputs...)
+		report.OutputFormats = append(report.OutputFormats, plugin.Formats...)
+		if plugin.Probe {
+			report.FileSystems = append(report.FileSystems, plugin.Name)
+		}
+	}
+	sort.Strings(report.Outputs[1:])
+	return report
+}
+
+// showCapabilities prints the capabilities, as JSON for scripts
+func showCapabilities(asJSON bool) error {
+	report := capabilities()
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("dsktool %s, %s/%s, %s build\n", report.Version, report.OS, report.Arch, report.Build)
+	names := make([]string, 0, len(report.Features))
+	for name := range report.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if report.Features[name] {
+			fmt.Printf("  %s%-18s yes%s\n", green, name, reset)
+		} else {
+			fmt.Printf("  %s%-18s no%s\n", red, name, reset)
+		}
+	}
+	fmt.Printf("Compression:    %s\n", strings.Join(report.Compression, ", "))
+	fmt.Printf("Output formats: %s\n", strings.Join(report.OutputFormats, ", "))
+	fmt.Printf("Outputs:        %s\n", strings.Join(report.Outputs, ", "))
+	fmt.Printf("Filesystems:    %s\n", strings.Join(report.FileSystems, ", "))
+	fmt.Printf("mkfs:           %s\n", strings.Join(report.Mkfs, ", "))
+	if len(report.Plugins) > 0 {
+		fmt.Printf("Plugins:        %s\n", strings.Join(report.Plugins, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// cloneOptions are the settings of a device-to-device clone
+type cloneOptions struct {
+	Verify    bool
+	AssumeYes bool
+	Tuning    ioTuning
+}
+
+// cloneDevice copies a device or raw image block for block onto another
+// device, which must be at least as large
+func cloneDevice(src, dst string, options cloneOptions) error {
+	// Partition images go back into their partition, the rest of dst stays
+	blocks, err := readBlockMap(src)
+	if err != nil {
+		return err
+	}
+	if blocks != nil && blocks.Partition > 0 {
+		return restorePartitionImage(src, dst, blocks, options)
+	}
+
+	source, err := openImage(src, false)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	writer, err := openDeviceWriter(dst, "clone "+src)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if sameFile(source.File, writer.File) {
+		return fmt.Errorf("%s and %s are the same device", src, dst)
+	}
+	if writer.Size < source.Size {
+		return fmt.Errorf("%s (%s) is smaller than %s (%s)", dst, formatBytes(writer.Size), src, formatBytes(source.Size))
+	}
+	if writer.SectorSize != source.SectorSize {
+		warnf(warnSectorSize, dst, "%s has %d byte sectors and %s %d byte sectors, the partition table will not fit the target",
+			src, source.SectorSize, dst, writer.SectorSize)
+	}
+
+	if writer.DryRun {
+		fmt.Printf("Dry run: would copy %s from %s onto %s\n", formatBytes(source.Size), src, dst)
+		return nil
+	}
+	if !options.AssumeYes && !confirm(fmt.Sprintf("Overwrite %s (%s) with %s?", dst, formatBytes(writer.Size), src)) {
+		return fmt.Errorf("aborted")
+	}
+
+	tuning, err := tuneIO(source.File, src, source.Size, source.SectorSize, options.Tuning)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Cloning %s to %s with %s\n", src, dst, tuning)
+
+	listenForPause()
+	display := startProgressDisplay("", nil)
+	stats := newDiskStatsSampler(dst)
+	display.extra = func() []string { return []string{stats.progressLine()} }
+
+	start := time.Now()
+	method, err := copyBlocks(writer.File, source.File, source.Size, tuning, func(copied int64) {
+		reportProgress("cloning", copied, source.Size)
+		start = start.Add(pausePoint(display.Bypass(), writer.Sync))
+	})
+	display.stop()
+	if err != nil {
+		return err
+	}
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("Cloned %s in %s (%.2f MB/s, %s copy)\n", formatBytes(source.Size), elapsed.Truncate(time.Second),
+		float64(source.Size)/mb/elapsed.Seconds(), method)
+
+	rereadPartitionTableOrWarn(writer.File, writer.Path)
+
+	if options.Verify {
+		return verifyClone(source, writer.diskImage, tuning)
+	}
+	printResult("%s", dst)
+	return nil
+}
+
+// verifyClone re-reads both devices over the length of the source and
+// compares their hashes
+func verifyClone(source, target *diskImage, tuning ioTuning) error {
+	fmt.Println("Verifying")
+	hashes := make([][]byte, 2)
+	errs := make(chan error, 2)
+	var hashed atomic.Int64
+	display := startProgressDisplay("", nil)
+	for i, image := range []*diskImage{source, target} {
+		go func(i int, image *diskImage) {
+			h := sha256.New()
+			err := readChunks(image.File, source.Size, tuning, func(chunk []byte, offset int64) error {
+				_, err := h.Write(chunk)
+				reportProgress("verifying", hashed.Add(int64(len(chunk)))/2, source.Size)
+				return err
+			})
+			hashes[i] = h.Sum(nil)
+			errs <- err
+		}(i, image)
+	}
+	for range hashes {
+		if err := <-errs; err != nil {
+			display.stop()
+			return fmt.Errorf("verifying: %v", err)
+		}
+	}
+	display.stop()
+
+	fmt.Printf("Source SHA-256: %s\nTarget SHA-256: %s\n", hex.EncodeToString(hashes[0]), hex.EncodeToString(hashes[1]))
+	if !bytes.Equal(hashes[0], hashes[1]) {
+		return fmt.Errorf("%s does not match %s", target.Path, source.Path)
+	}
+	fmt.Printf("%sVerified, the clone matches%s\n", green, reset)
+	printResult("%s  %s", hex.EncodeToString(hashes[1]), target.Path)
+	return nil
+}
+
+// sameFile reports whether two open files are the same file or device
+func sameFile(a, b *os.File) bool {
+	infoA, errA := a.Stat()
+	infoB, errB := b.Stat()
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
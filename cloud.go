@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// outputOptions are settings for image outputs in object storage
+type outputOptions struct {
+	SSE       string // server-side encryption, AES256 or aws:kms
+	SSEKMSKey string // KMS key for aws:kms
+	SizeHint  int64  // bytes expected to be written, 0 if not known
+}
+
+// outputBackends open image outputs for URL schemes
+var outputBackends = map[string]func(url string, options outputOptions) (io.WriteCloser, error){
+	"s3":    newS3Output,
+	"azure": newAzureOutput,
+	"gs":    newGCSOutput,
+	"ssh":   newSSHOutput,
+	"tcp":   newTCPOutput,
+}
+
+// createOutput creates the file an image is written to. URLs are streamed to
+// the object store backend or the plugin that handles their scheme.
+func createOutput(path string, options outputOptions) (io.WriteCloser, error) {
+	scheme, _, found := strings.Cut(path, "://")
+	if !found {
+		return os.Create(path)
+	}
+	if open, ok := outputBackends[scheme]; ok {
+		return open(path, options)
+	}
+	return createPluginOutput(scheme, path)
+}
+
+// cloudUpload is an object store upload that takes the data in numbered parts
+type cloudUpload interface {
+	begin() error
+	uploadPart(number int, data []byte) error
+	complete() error
+	abort() error
+	putObject(data []byte) error // objects smaller than a part in one request
+}
+
+// cloudLastPartUploader is a cloudUpload that sends the final part
+// differently, if there is data left for one after the full parts
+type cloudLastPartUploader interface {
+	uploadLastPart(number int, data []byte) error
+}
+
+const (
+	cloudPartSize    = 16 * mb
+	cloudPartsPerLap = 1000 // the part size doubles after this many parts
+)
+
+// cloudLimits are the limits of the multipart uploads of a store
+type cloudLimits struct {
+	maxParts    int // 0 if there is no limit
+	maxPartSize int
+}
+
+// partSizeFor picks the part size of an upload of about size bytes, large
+// enough to stay below the part limit and a multiple of a MiB, or the
+// smallest part size when the size is not known
+func (l cloudLimits) partSizeFor(size int64) int {
+	partSize := int64(cloudPartSize)
+	if l.maxParts > 0 && size > 0 {
+		// A tenth more for streams that grow under compression
+		need := (size + size/10 + int64(l.maxParts) - 1) / int64(l.maxParts)
+		partSize = max(partSize, (need+mb-1)/mb*mb)
+	}
+	return int(min(partSize, int64(l.maxPartSize)))
+}
+
+// cloudWriter buffers a stream into parts and uploads them, several at a
+// time if the store allows it. Small streams are stored with a single request.
+type cloudWriter struct {
+	upload      cloudUpload
+	name        string
+	partSize    int
+	maxPartSize int
+	concurrency int
+
+	buf     []byte
+	parts   int
+	started bool
+	slots   chan struct{}
+	wg      sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newCloudWriter returns the writer of an upload, its parts sized for the
+// size hint of the options
+func newCloudWriter(name string, upload cloudUpload, concurrency int, limits cloudLimits, options outputOptions) *cloudWriter {
+	return &cloudWriter{
+		upload:      upload,
+		name:        name,
+		partSize:    limits.partSizeFor(options.SizeHint),
+		maxPartSize: limits.maxPartSize,
+		concurrency: concurrency,
+		slots:       make(chan struct{}, concurrency),
+	}
+}
+
+func (w *cloudWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// fail records the first error, later writes return it
+func (w *cloudWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *cloudWriter) Write(p []byte) (int, error) {
+	if err := w.failed(); err != nil {
+		return 0, err
+	}
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), w.partSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		if len(w.buf) == w.partSize {
+			if err := w.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush uploads the buffered part in the background
+func (w *cloudWriter) flush(last bool) error {
+	if !w.started {
+		if err := networkRetry.do(w.name+" start", w.upload.begin); err != nil {
+			w.fail(err)
+			return err
+		}
+		w.started = true
+	}
+
+	w.parts++
+	number, data := w.parts, w.buf
+	w.buf = make([]byte, 0, w.partSize)
+	// Streams larger than their hint, or without one, get larger parts
+	// as they go, up to the largest part the store takes
+	if w.parts%cloudPartsPerLap == 0 {
+		w.partSize = min(w.partSize*2, w.maxPartSize)
+	}
+
+	w.slots <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() { <-w.slots; w.wg.Done() }()
+		err := networkRetry.do(fmt.Sprintf("%s part %d", w.name, number), func() error {
+			if uploader, ok := w.upload.(cloudLastPartUploader); ok && last {
+				return uploader.uploadLastPart(number, data)
+			}
+			return w.upload.uploadPart(number, data)
+		})
+		if err != nil {
+			w.fail(err)
+		}
+	}()
+
+	// One part at a time means the caller waits, like a plain write
+	if w.concurrency == 1 {
+		w.wg.Wait()
+	}
+	return w.failed()
+}
+
+// Close uploads what is left and completes the upload, or aborts it after an error
+func (w *cloudWriter) Close() error {
+	w.closeOnce.Do(func() {
+		if !w.started && w.failed() == nil {
+			w.closeErr = networkRetry.do(w.name, func() error { return w.upload.putObject(w.buf) })
+			return
+		}
+
+		if len(w.buf) > 0 && w.failed() == nil {
+			w.flush(true)
+		}
+		w.wg.Wait()
+		if err := w.failed(); err != nil {
+			if !w.started {
+				w.closeErr = err
+				return
+			}
+			if abortErr := w.upload.abort(); abortErr != nil {
+				err = fmt.Errorf("%v, aborting the upload also failed: %v", err, abortErr)
+			}
+			w.closeErr = err
+			return
+		}
+		w.closeErr = networkRetry.do(w.name+" complete", w.upload.complete)
+	})
+	return w.closeErr
+}
+
+// cloudHTTPError is an error response of an object store
+type cloudHTTPError struct {
+	Status int
+	Body   string
+}
+
+func (e *cloudHTTPError) Error() string {
+	if e.Body == "" {
+		return http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(e.Status), e.Body)
+}
+
+// temporary reports whether the request may work when it is repeated
+func (e *cloudHTTPError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests
+}
+
+// cloudDo sends a request and returns the response body, or a
+// cloudHTTPError for a status other than 2xx
+func cloudDo(req *http.Request) ([]byte, http.Header, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, &cloudHTTPError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return body, resp.Header, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"os"
 )
@@ -10,12 +11,47 @@ func isPrintable(b byte) bool {
 	return b >= 32 && b <= 126
 }
 
-// Exit if we don't have permission to read the device
+// printHexDump writes buf as hex and printable characters, 16 bytes a line
+// labelled with their offset from base
+func printHexDump(w io.Writer, buf []byte, base int64) {
+	for i := 0; i < len(buf); i += 16 {
+		hexStr := ""
+		charStr := ""
+		for j := 0; j < 16 && i+j < len(buf); j++ {
+			b := buf[i+j]
+			hexStr += fmt.Sprintf("%02X ", b)
+			if j == 7 {
+				hexStr += " " // Extra space after 8 bytes
+			}
+			if isPrintable(b) {
+				charStr += string(b)
+			} else {
+				charStr += "."
+			}
+		}
+		fmt.Fprintf(w, "%08X  %-49s  |%s|\n", base+int64(i), hexStr, charStr)
+	}
+}
+
+// Exit if we can't read the device, after offering to run the command
+// elevated if it is a matter of permissions
 func checkForPerms(deviceToRead string) {
-	if !hasReadPermission(deviceToRead) {
-		fmt.Printf("No permission to read the device: %s, try with elevated priviledges\n", deviceToRead)
-		os.Exit(13)
+	if isURL(deviceToRead) {
+		return
+	}
+	err := readAccess(deviceToRead)
+	if err == nil {
+		return
 	}
+	if !isPermissionError(err) {
+		fmt.Printf("Cannot open the device: %v\n", err)
+		runHooks(1, err)
+		os.Exit(1)
+	}
+	fmt.Printf("No permission to read the device: %s\n", deviceToRead)
+	offerElevation("Reading " + deviceToRead)
+	runHooks(13, fmt.Errorf("no permission to read %s", deviceToRead))
+	os.Exit(13)
 }
 
 func formatBytes[T dataSizeNumber](bytes T) string {
@@ -49,3 +85,13 @@ func formatBytes[T dataSizeNumber](bytes T) string {
 	}
 	return fmt.Sprintf("%.1f %s", value, unit)
 }
+
+// firstNonEmpty returns the first of values that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
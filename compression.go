@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// getCompressionExtension returns the file extension used for the compression algorithm
+func getCompressionExtension(compressionAlgorithm string) (string, error) {
+	switch compressionAlgorithm {
+	case "gzip":
+		return ".gz", nil
+	case "zlib":
+		return ".zlib", nil
+	case "bzip2":
+		return ".bz2", nil
+	case "snappy":
+		return ".snappy", nil
+	case "s2":
+		return ".s2", nil
+	case "zstd":
+		return ".zst", nil
+	case "zip":
+		return ".zip", nil
+	case "xz":
+		return ".xz", nil
+	case "lz4":
+		return ".lz4", nil
+	}
+	return "", fmt.Errorf("unsupported compression algorithm: %s", compressionAlgorithm)
+}
+
+// zipEntryWriter closes both the zip entry and the archive
+type zipEntryWriter struct {
+	io.Writer
+	zw *zip.Writer
+}
+
+func (z *zipEntryWriter) Close() error {
+	return z.zw.Close()
+}
+
+// compressionAlgorithms are the algorithms createCompressionWriter supports
+var compressionAlgorithms = []string{"gzip", "bzip2", "zip", "snappy", "s2", "zlib", "zstd", "xz", "lz4"}
+
+// compressionOptions tune the compressor, the zero value keeps the defaults
+// of each algorithm
+type compressionOptions struct {
+	// Level trades speed for ratio, from 1 for the fastest up to the highest
+	// level of compressionLevels, 0 for the default
+	Level int
+	// ZstdWindow is how far back zstd finds matches, a power of two in bytes
+	ZstdWindow int
+	// GzipStrategy is "huffman" to only Huffman code, fast on data that
+	// repeats little, or "stateless" to keep no history between blocks, for
+	// the deflate based gzip, zlib and zip
+	GzipStrategy string
+}
+
+// compressionLevels are the levels the algorithms take, snappy, xz and lz4 have none
+var compressionLevels = map[string]int{"gzip": 9, "zlib": 9, "zip": 9, "bzip2": 9, "zstd": 22, "s2": 3}
+
+// gzipStrategies are the deflate settings --gzip-strategy picks
+var gzipStrategies = map[string]int{"default": 0, "huffman": gzip.HuffmanOnly, "stateless": gzip.StatelessCompression}
+
+// check returns an error if the options do not apply to the algorithm
+func (o compressionOptions) check(algorithm string) error {
+	if o.Level != 0 {
+		highest, ok := compressionLevels[algorithm]
+		if !ok {
+			return fmt.Errorf("%s has no compression levels", algorithm)
+		}
+		if o.Level < 1 || o.Level > highest {
+			return fmt.Errorf("%s takes levels 1 to %d", algorithm, highest)
+		}
+	}
+	if o.ZstdWindow != 0 && algorithm != "zstd" {
+		return fmt.Errorf("--zstd-window applies to zstd, not %s", algorithm)
+	}
+	if o.ZstdWindow != 0 && (o.ZstdWindow&(o.ZstdWindow-1) != 0 || o.ZstdWindow < zstd.MinWindowSize || o.ZstdWindow > zstd.MaxWindowSize) {
+		return fmt.Errorf("the zstd window must be a power of two from %s to %s", formatBytes(zstd.MinWindowSize), formatBytes(zstd.MaxWindowSize))
+	}
+	if o.GzipStrategy != "" {
+		if _, ok := gzipStrategies[o.GzipStrategy]; !ok {
+			return fmt.Errorf("unknown gzip strategy %q, use default, huffman or stateless", o.GzipStrategy)
+		}
+		if algorithm != "gzip" && algorithm != "zlib" && algorithm != "zip" {
+			return fmt.Errorf("--gzip-strategy applies to gzip, zlib and zip, not %s", algorithm)
+		}
+		if o.Level != 0 && o.GzipStrategy != "default" {
+			return fmt.Errorf("the %s strategy has no levels", o.GzipStrategy)
+		}
+	}
+	return nil
+}
+
+// deflateLevel is the flate level of the options, the default if none is set
+func (o compressionOptions) deflateLevel() int {
+	if strategy := gzipStrategies[o.GzipStrategy]; strategy != 0 {
+		return strategy
+	}
+	if o.Level != 0 {
+		return o.Level
+	}
+	return flate.DefaultCompression
+}
+
+// createCompressionWriter wraps w with the writer for the compression algorithm
+func createCompressionWriter(w io.Writer, compressionAlgorithm string, options compressionOptions) (io.WriteCloser, error) {
+	if err := options.check(compressionAlgorithm); err != nil {
+		return nil, err
+	}
+	switch compressionAlgorithm {
+	case "gzip":
+		return gzip.NewWriterLevel(w, options.deflateLevel())
+	case "zlib":
+		return zlib.NewWriterLevel(w, options.deflateLevel())
+	case "bzip2":
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: options.Level})
+	case "snappy":
+		return snappy.NewBufferedWriter(w), nil
+	case "s2":
+		var opts []s2.WriterOption
+		switch options.Level {
+		case 2:
+			opts = append(opts, s2.WriterBetterCompression())
+		case 3:
+			opts = append(opts, s2.WriterBestCompression())
+		}
+		return s2.NewWriter(w, opts...), nil
+	case "zstd":
+		var opts []zstd.EOption
+		if options.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.Level)))
+		}
+		if options.ZstdWindow != 0 {
+			opts = append(opts, zstd.WithWindowSize(options.ZstdWindow))
+		}
+		return zstd.NewWriter(w, opts...)
+	case "zip":
+		zipWriter := zip.NewWriter(w)
+		zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, options.deflateLevel())
+		})
+		zipFile, err := zipWriter.Create("compressedData")
+		if err != nil {
+			return nil, err
+		}
+		return &zipEntryWriter{Writer: zipFile, zw: zipWriter}, nil
+	case "xz":
+		return xz.NewWriter(w)
+	case "lz4":
+		return newLZ4Writer(w)
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm: %s", compressionAlgorithm)
+}
+
+// detectCompression guesses the compression algorithm from the magic bytes of an image
+func detectCompression(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return "bzip2"
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return "zip"
+	case bytes.HasPrefix(header, []byte("\xff\x06\x00\x00sNaPpY")):
+		return "snappy"
+	case bytes.HasPrefix(header, []byte("\xff\x06\x00\x00S2sTwO")):
+		return "s2"
+	case bytes.HasPrefix(header, []byte("\xfd7zXZ\x00")):
+		return "xz"
+	case bytes.HasPrefix(header, []byte{0x04, 0x22, 0x4d, 0x18}), bytes.HasPrefix(header, []byte{0x02, 0x21, 0x4c, 0x18}):
+		return "lz4"
+	case len(header) >= 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0:
+		return "zlib"
+	}
+	return ""
+}
+
+// readCloser pairs a decompressed reader with the closers of the underlying streams
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	var firstErr error
+	for _, c := range rc.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openDecompressionReader opens an image file and returns a reader of its raw contents
+// together with the detected compression algorithm ("" for raw images)
+func openDecompressionReader(path string) (io.ReadCloser, string, error) {
+	var file io.ReadCloser
+	if isURL(path) {
+		file = openHTTPSource(path)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, "", err
+		}
+		file = f
+	}
+
+	br := bufio.NewReaderSize(file, 1<<20)
+	header, _ := br.Peek(len(ageMagic))
+
+	// Encrypted images are decrypted first, the compression is inside
+	encrypted := bytes.HasPrefix(header, []byte(ageMagic))
+	if encrypted {
+		dr, err := newDecryptReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", fmt.Errorf("decrypting %s: %v", path, err)
+		}
+		br = bufio.NewReaderSize(dr, 1<<20)
+		header, _ = br.Peek(16)
+	}
+	algorithm := detectCompression(header)
+
+	// zlib headers are only two bytes, so trust them only with a matching extension
+	if algorithm == "zlib" && !strings.HasSuffix(strings.TrimSuffix(path, encryptExtension), ".zlib") {
+		algorithm = ""
+	}
+	if encrypted && algorithm == "zip" {
+		file.Close()
+		return nil, "", fmt.Errorf("encrypted zip archives are not supported")
+	}
+
+	var r io.Reader
+	closers := []io.Closer{file}
+	switch algorithm {
+	case "":
+		r = br
+	case "gzip":
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		r = gz
+		closers = append([]io.Closer{gz}, closers...)
+	case "zlib":
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		r = zr
+		closers = append([]io.Closer{zr}, closers...)
+	case "bzip2":
+		bz, err := bzip2.NewReader(br, &bzip2.ReaderConfig{})
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		r = bz
+		closers = append([]io.Closer{bz}, closers...)
+	case "snappy":
+		r = snappy.NewReader(br)
+	case "s2":
+		r = s2.NewReader(br)
+	case "zstd":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		r = zr
+		closers = append([]io.Closer{zr.IOReadCloser()}, closers...)
+	case "xz":
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		r = xr
+	case "lz4":
+		r = newLZ4Reader(br)
+	case "zip":
+		f, ok := file.(*os.File)
+		if !ok {
+			file.Close()
+			return nil, "", fmt.Errorf("zip archives need random access, download %s first", path)
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		zr, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		if len(zr.File) == 0 {
+			file.Close()
+			return nil, "", fmt.Errorf("zip archive %s is empty", path)
+		}
+		entry, err := zr.File[0].Open()
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		r = entry
+		closers = append([]io.Closer{entry}, closers...)
+	}
+
+	if encrypted {
+		algorithm = strings.TrimSpace("encrypted " + algorithm)
+	}
+	return &readCloser{Reader: r, closers: closers}, algorithm, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// configDir returns the dsktool configuration directory, creating it if needed
+func configDir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "dsktool")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// loadConfigFile decodes a JSON file from the config directory, leaving v untouched if it does not exist
+func loadConfigFile(name string, v interface{}) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveConfigFile writes v as JSON into the config directory
+func saveConfigFile(name string, v interface{}) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write next to the target and rename so a crash never leaves a truncated file
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Copies between devices and raw images skip user space where the platform
+// can: the kernel moves the data with copy_file_range, or splice through a
+// pipe for block devices, and the buffered loop is the fallback.
+
+// errZeroCopyUnsupported means the kernel can not copy between the two files
+// itself, before anything was copied
+var errZeroCopyUnsupported = errors.New("zero-copy is not supported between these files")
+
+// copyBlocks copies size bytes from the start of src to the start of dst.
+// progress is called after each block with the bytes copied so far. It
+// returns the copy path used, for the report.
+func copyBlocks(dst, src *os.File, size int64, tuning ioTuning, progress func(copied int64)) (string, error) {
+	method, err := zeroCopy(dst, src, size, tuning.BlockSize, progress)
+	if !errors.Is(err, errZeroCopyUnsupported) {
+		return method, err
+	}
+
+	err = readChunks(src, size, tuning, func(chunk []byte, offset int64) error {
+		if _, err := dst.WriteAt(chunk, offset); err != nil {
+			return fmt.Errorf("writing at offset %d: %v", offset, err)
+		}
+		progress(offset + int64(len(chunk)))
+		return nil
+	})
+	return "buffered", err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroCopy copies in the kernel, with copy_file_range between regular files
+// and splice for block devices, which copy_file_range does not take
+func zeroCopy(dst, src *os.File, size, blockSize int64, progress func(copied int64)) (string, error) {
+	if err := copyFileRange(dst, src, size, blockSize, progress); !errors.Is(err, errZeroCopyUnsupported) {
+		return "copy_file_range", err
+	}
+	return "splice", spliceCopy(dst, src, size, blockSize, progress)
+}
+
+// unsupportedCopy reports whether a copy error means the kernel can not do
+// the copy at all, as opposed to a failing device
+func unsupportedCopy(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EBADF)
+}
+
+func copyFileRange(dst, src *os.File, size, blockSize int64, progress func(copied int64)) error {
+	var copied int64
+	for copied < size {
+		srcOffset, dstOffset := copied, copied
+		n, err := unix.CopyFileRange(int(src.Fd()), &srcOffset, int(dst.Fd()), &dstOffset, int(min(blockSize, size-copied)), 0)
+		if err != nil {
+			if copied == 0 && unsupportedCopy(err) {
+				return errZeroCopyUnsupported
+			}
+			return fmt.Errorf("copying at offset %d: %v", copied, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("copying at offset %d: unexpected end of the source", copied)
+		}
+		copied += int64(n)
+		progress(copied)
+	}
+	return nil
+}
+
+func spliceCopy(dst, src *os.File, size, blockSize int64, progress func(copied int64)) error {
+	var pipe [2]int
+	if err := unix.Pipe2(pipe[:], unix.O_CLOEXEC); err != nil {
+		return errZeroCopyUnsupported
+	}
+	defer unix.Close(pipe[0])
+	defer unix.Close(pipe[1])
+	// A pipe holds 64 KiB by default, a bigger one moves a block per call
+	if n, err := unix.FcntlInt(uintptr(pipe[1]), unix.F_SETPIPE_SZ, int(blockSize)); err == nil {
+		blockSize = min(blockSize, int64(n))
+	} else {
+		blockSize = min(blockSize, 64*kb)
+	}
+
+	var srcOffset, dstOffset int64
+	for srcOffset < size {
+		n, err := unix.Splice(int(src.Fd()), &srcOffset, pipe[1], nil, int(min(blockSize, size-srcOffset)), unix.SPLICE_F_MOVE)
+		if err != nil {
+			if srcOffset == 0 && unsupportedCopy(err) {
+				return errZeroCopyUnsupported
+			}
+			return fmt.Errorf("reading at offset %d: %v", dstOffset, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("reading at offset %d: unexpected end of the source", dstOffset)
+		}
+		for n > 0 {
+			written, err := unix.Splice(pipe[0], nil, int(dst.Fd()), &dstOffset, int(n), unix.SPLICE_F_MOVE)
+			if err != nil {
+				if dstOffset == 0 && unsupportedCopy(err) {
+					return errZeroCopyUnsupported
+				}
+				return fmt.Errorf("writing at offset %d: %v", dstOffset, err)
+			}
+			n -= written
+		}
+		progress(dstOffset)
+	}
+	return nil
+}
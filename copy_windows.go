@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// zeroCopy is not implemented on Windows, copies use the buffered path
+func zeroCopy(dst, src *os.File, size, blockSize int64, progress func(copied int64)) (string, error) {
+	return "", errZeroCopyUnsupported
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// decompressedPath names the raw image of a compressed one, image.img.zst
+// becomes image.img and names without a known extension get .raw added
+func decompressedPath(src, algorithm string) string {
+	path := strings.TrimSuffix(src, encryptExtension)
+	if extension, err := getCompressionExtension(algorithm); err == nil {
+		path = strings.TrimSuffix(path, extension)
+	}
+	if path == src {
+		path += ".raw"
+	}
+	return path
+}
+
+// decompressImage writes the raw contents of an image taken by dsktool to
+// out, or to stdout for -, whatever compression and encryption it has.
+// Smart and partition images are rebuilt from their block map with holes
+// for the blocks left out. The data is checked against the SHA-256 of the
+// manifest when the image has one.
+func decompressImage(src, out string, overwrite bool) error {
+	manifest, _ := readManifest(src)
+	if manifest != nil && manifest.Format != "" {
+		return fmt.Errorf("%s is a %s image, qemu-img convert -O raw turns it into a raw image", src, manifest.Format)
+	}
+	blocks, err := readBlockMap(src)
+	if err != nil {
+		return err
+	}
+	reader, algorithm, err := openDecompressionReader(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	toStdout := out == "-"
+	messages := messageOutput(os.Stdout)
+	if toStdout {
+		messages = os.Stderr
+	}
+	if out == "" {
+		if algorithm == "" && blocks == nil {
+			return fmt.Errorf("%s is a raw image already", src)
+		}
+		out = decompressedPath(src, algorithm)
+	}
+
+	var output *os.File
+	if toStdout {
+		output = os.Stdout
+	} else {
+		if info, err := os.Stat(out); err == nil {
+			if source, err := os.Stat(src); err == nil && os.SameFile(info, source) {
+				return fmt.Errorf("%s is the image being read, it cannot be written to", out)
+			}
+			if !overwrite {
+				return fmt.Errorf("%s exists, use --overwrite to replace it", out)
+			}
+		}
+		if output, err = os.Create(out); err != nil {
+			return err
+		}
+		defer output.Close()
+	}
+	// Left out blocks become holes in files and zeros in streams
+	sparse := false
+	if info, err := output.Stat(); err == nil && info.Mode().IsRegular() {
+		sparse = true
+	}
+
+	// What the stream holds and where it goes in the raw image
+	var (
+		ranges []byteRange
+		size   int64 = -1
+		base   int64
+	)
+	switch {
+	case blocks != nil && blocks.Partition != 0:
+		ranges, base, size = blocks.Ranges, blocks.PartitionRange.Start, blocks.PartitionRange.End-blocks.PartitionRange.Start
+	case blocks != nil:
+		ranges, size = blocks.Ranges, blocks.Size
+	case manifest != nil && manifest.Imaged > 0:
+		size = manifest.Imaged
+	}
+
+	if algorithm == "" {
+		algorithm = "raw"
+	}
+	kind := "image"
+	if blocks != nil {
+		kind = "smart image"
+		if blocks.Partition != 0 {
+			kind = fmt.Sprintf("image of partition %d", blocks.Partition)
+		}
+	}
+	target := out
+	if toStdout {
+		target = "stdout"
+	}
+	fmt.Fprintf(messages, "Decompressing %s %s to %s\n", algorithm, kind, target)
+
+	listenForPauseTo(messages)
+	display := startProgressDisplay("", messages)
+
+	var (
+		hash    = sha256.New()
+		written int64 // position in the raw image
+		buf     = make([]byte, 4*mb)
+		begin   = time.Now()
+	)
+	progress := func() {
+		reportProgress("decompressing", written, max(size, 0))
+		begin = begin.Add(pausePoint(display.Bypass(), nil))
+	}
+	// skip moves to offset of the raw image past a left out region
+	zero := make([]byte, len(buf))
+	skip := func(offset int64) error {
+		if sparse {
+			if _, err := output.Seek(offset-written, io.SeekCurrent); err != nil {
+				return err
+			}
+			written = offset
+			progress()
+			return nil
+		}
+		for written < offset {
+			n, err := output.Write(zero[:min(int64(len(zero)), offset-written)])
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+			progress()
+		}
+		return nil
+	}
+	// copyStream copies n bytes of the stream, all of it for a negative n
+	copyStream := func(n int64) error {
+		for n != 0 {
+			chunk := buf
+			if n > 0 {
+				chunk = buf[:min(int64(len(buf)), n)]
+			}
+			read, err := io.ReadFull(reader, chunk)
+			if read > 0 {
+				hash.Write(chunk[:read])
+				if _, err := output.Write(chunk[:read]); err != nil {
+					return err
+				}
+				written += int64(read)
+				if n > 0 {
+					n -= int64(read)
+				}
+				progress()
+			}
+			if n < 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("reading %s: %v", src, err)
+			}
+		}
+		return nil
+	}
+
+	if blocks != nil {
+		for _, r := range ranges {
+			if err = skip(r.Start - base); err != nil {
+				break
+			}
+			if err = copyStream(r.End - r.Start); err != nil {
+				break
+			}
+		}
+		if err == nil && sparse {
+			err = output.Truncate(size)
+			written = size
+		} else if err == nil {
+			err = skip(size)
+		}
+	} else {
+		err = copyStream(-1)
+	}
+	display.stop()
+	if err != nil {
+		return err
+	}
+	if !toStdout {
+		if err := output.Sync(); err != nil {
+			return err
+		}
+	}
+	elapsed := time.Since(begin)
+	fmt.Fprintf(messages, "Decompressed %s in %s (%.2f MB/s)\n", formatBytes(written), elapsed.Truncate(time.Second), float64(written)/mb/elapsed.Seconds())
+
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	switch {
+	case manifest == nil || manifest.SHA256 == "":
+		fmt.Fprintf(messages, "SHA-256: %s, %s has no manifest with a hash to check it against\n", sum, src)
+	case manifest.SHA256 != sum:
+		return fmt.Errorf("the SHA-256 of the data is %s, the manifest of %s has %s, the image is damaged", sum, src, manifest.SHA256)
+	default:
+		fmt.Fprintf(messages, "%sVerified, the SHA-256 %s matches the manifest%s\n", green, sum, reset)
+	}
+	if !toStdout {
+		printResult("%s  %s", sum, out)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Devices can be given by an identifier that stays the same across boots
+// instead of a path like /dev/sdb that changes when disks are added or
+// enumerated in a different order.
+
+// resolveDeviceArgs replaces the serial:, wwn:, gpt: and label: arguments of
+// a command line by the device they name
+func resolveDeviceArgs(args []string) ([]string, error) {
+	resolved := make([]string, len(args))
+	for i, arg := range args {
+		device, err := resolveDeviceID(arg)
+		if err != nil {
+			return nil, err
+		}
+		resolved[i] = device
+	}
+	return resolved, nil
+}
+
+// resolveDeviceID returns the device named by an identifier, other arguments
+// are returned as they are
+func resolveDeviceID(arg string) (string, error) {
+	kind, value, ok := strings.Cut(arg, ":")
+	if !ok || value == "" {
+		return arg, nil
+	}
+
+	var matches []string
+	switch kind {
+	case "label":
+		labelled, err := devicesByLabel(value)
+		if err != nil {
+			return "", err
+		}
+		matches = labelled
+	case "serial", "wwn", "gpt":
+		disks, err := discoverDisks()
+		if err != nil {
+			return "", fmt.Errorf("listing disks to find %s: %v", arg, err)
+		}
+		for _, disk := range disks {
+			if diskHasID(disk, kind, value) {
+				matches = append(matches, disk)
+			}
+		}
+	default:
+		return arg, nil
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no device has the %s %s", kind, value)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%s matches %d devices: %s", arg, len(matches), strings.Join(matches, ", "))
+}
+
+// diskHasID reports whether a disk has the serial, WWN or GPT disk GUID
+func diskHasID(disk, kind, value string) bool {
+	if kind == "wwn" {
+		wwn := diskWWN(disk)
+		return wwn != "" && normalizeWWN(wwn) == normalizeWWN(value)
+	}
+	for _, key := range diskKeys(disk) {
+		if strings.EqualFold(key, kind+":"+value) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeWWN strips the notations of a WWN, so 0x5000c500a1b2c3d4 and
+// naa.5000c500a1b2c3d4 compare equal
+func normalizeWWN(wwn string) string {
+	wwn = strings.ToLower(strings.TrimSpace(wwn))
+	for _, prefix := range []string{"0x", "naa.", "eui.", "wwn-"} {
+		wwn = strings.TrimPrefix(wwn, prefix)
+	}
+	return wwn
+}
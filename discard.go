@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// discardChunk is how much one discard request covers, so large discards
+// show progress and can be paused
+const discardChunk = 1 << 30
+
+// discardOptions are the settings of a discard
+type discardOptions struct {
+	// Offset and Length select a range of the device or partition, sizes
+	// like 1M, 2048s or 50%
+	Offset string
+	Length string
+	// Secure asks the device to also erase the discarded blocks
+	Secure bool
+	// Confirm is the device path typed on the command line instead of at the prompt
+	Confirm string
+}
+
+// discard tells an SSD or thin provisioned volume that a range of a device,
+// or partition N of DEVICE:N, holds no data. Image files get holes punched
+// instead, which frees their space.
+func discard(spec string, options discardOptions) error {
+	device, number := parsePartitionSpec(spec)
+	operation := "discard"
+	if options.Secure {
+		operation = "secure discard"
+	}
+	writer, err := openDeviceWriterTo(device, operation, io.Discard)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if info, err := writer.File.Stat(); err == nil && info.Mode().IsRegular() && options.Secure {
+		return fmt.Errorf("--secure needs a device, image files only get holes punched")
+	}
+
+	area := byteRange{End: writer.Size}
+	if number > 0 {
+		table, err := writer.partitionTable()
+		if err != nil {
+			return fmt.Errorf("reading the partition table: %v", err)
+		}
+		part, err := table.findPartition(number)
+		if err != nil {
+			return err
+		}
+		area.Start = part.Offset(table.SectorSize)
+		area.End = area.Start + part.Size(table.SectorSize)
+	}
+
+	// Offsets count from the start of the partition, percentages of its size
+	sector, total := int64(writer.SectorSize), area.End-area.Start
+	if options.Offset != "" {
+		offset, err := parseSize(options.Offset, sector, total)
+		if err != nil {
+			return fmt.Errorf("invalid offset: %v", err)
+		}
+		if offset > total {
+			return fmt.Errorf("the offset %d is past the end of %s (%d bytes)", offset, spec, total)
+		}
+		area.Start += offset
+	}
+	if options.Length != "" {
+		length, err := parseSize(options.Length, sector, total)
+		if err != nil {
+			return fmt.Errorf("invalid length: %v", err)
+		}
+		if area.Start+length > area.End {
+			return fmt.Errorf("the length %d goes past the end of %s", length, spec)
+		}
+		area.End = area.Start + length
+	}
+	// Devices discard whole sectors only
+	area.Start = (area.Start + sector - 1) / sector * sector
+	area.End = area.End / sector * sector
+	if area.End <= area.Start {
+		return fmt.Errorf("the range holds no whole sector of %d bytes", sector)
+	}
+	size := area.End - area.Start
+
+	description := fmt.Sprintf("%s at offset %d of %s", formatBytes(size), area.Start, device)
+	if serial := diskSerial(device); serial != "" {
+		description += fmt.Sprintf(" (serial %s)", serial)
+	}
+	if writer.DryRun {
+		fmt.Printf("Dry run: would %s %s\n", operation, description)
+		return nil
+	}
+	if err := confirmTyped(spec, description, options.Confirm); err != nil {
+		return err
+	}
+
+	listenForPause()
+	display := startProgressDisplay("Discarding "+spec, nil)
+
+	start := time.Now()
+	for done := int64(0); done < size; {
+		start = start.Add(pausePoint(display.Bypass(), nil))
+		n := min(int64(discardChunk), size-done)
+		if err := discardRange(writer.File, area.Start+done, n, options.Secure); err != nil {
+			display.stop()
+			return fmt.Errorf("discarding at offset %d: %v", area.Start+done, err)
+		}
+		done += n
+		reportProgress("discarding", done, size)
+	}
+	display.stop()
+
+	fmt.Printf("%sDiscarded %s of %s in %s%s\n", green, formatBytes(size), spec, time.Since(start).Truncate(time.Millisecond), reset)
+	printResult("%s", spec)
+	return nil
+}
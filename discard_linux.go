@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	blkDiscard    = 0x1277 // _IO(0x12, 119)
+	blkSecDiscard = 0x127d // _IO(0x12, 125)
+)
+
+// discardRange discards a byte range of a block device with BLKDISCARD or
+// BLKSECDISCARD, or punches a hole into an image file
+func discardRange(f *os.File, offset, length int64, secure bool) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return fmt.Errorf("the filesystem of %s cannot punch holes", f.Name())
+		}
+		return err
+	}
+
+	request := uintptr(blkDiscard)
+	if secure {
+		request = blkSecDiscard
+	}
+	span := [2]uint64{uint64(offset), uint64(length)}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), request, uintptr(unsafe.Pointer(&span))); errno != 0 {
+		if errno == unix.EOPNOTSUPP {
+			if secure {
+				return fmt.Errorf("%s does not support secure discard", f.Name())
+			}
+			return fmt.Errorf("%s does not support discard", f.Name())
+		}
+		return errno
+	}
+	return nil
+}
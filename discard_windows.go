@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// discardRange is not implemented on Windows yet
+func discardRange(f *os.File, offset, length int64, secure bool) error {
+	return fmt.Errorf("discard is not supported on Windows yet")
+}
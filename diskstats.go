@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// diskCounters are the cumulative I/O counters the OS keeps for a disk
+type diskCounters struct {
+	Name       string
+	Reads      uint64
+	Writes     uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+	BusyTime   time.Duration // time with at least one I/O in flight
+	QueueTime  time.Duration // time weighted by the I/Os in flight, zero if not kept
+	InFlight   uint64
+}
+
+// diskRates are the changes of the counters between two samples
+type diskRates struct {
+	Name        string
+	ReadMBps    float64
+	WriteMBps   float64
+	ReadIOPS    float64
+	WriteIOPS   float64
+	Utilization float64 // percent of the time the device was busy
+	QueueDepth  float64 // average I/Os in flight
+}
+
+// diskStatsSampler turns successive counter readings of a device into rates
+type diskStatsSampler struct {
+	device   string
+	last     diskCounters
+	lastTime time.Time
+}
+
+// newDiskStatsSampler starts sampling the disk behind a device or image
+// file. It returns nil when the OS keeps no counters for it.
+func newDiskStatsSampler(device string) *diskStatsSampler {
+	counters, err := readDiskCounters(device)
+	if err != nil {
+		return nil
+	}
+	return &diskStatsSampler{device: device, last: counters, lastTime: time.Now()}
+}
+
+// sample reads the counters and returns the rates since the previous sample
+func (s *diskStatsSampler) sample() (diskRates, error) {
+	counters, err := readDiskCounters(s.device)
+	if err != nil {
+		return diskRates{}, err
+	}
+	now := time.Now()
+	rates := diskCounterRates(s.last, counters, now.Sub(s.lastTime))
+	s.last, s.lastTime = counters, now
+	return rates, nil
+}
+
+// diskCounterRates computes the rates between two readings taken elapsed apart
+func diskCounterRates(before, after diskCounters, elapsed time.Duration) diskRates {
+	rates := diskRates{Name: after.Name, QueueDepth: float64(after.InFlight)}
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return rates
+	}
+	delta := func(a, b uint64) float64 {
+		if b < a {
+			return 0 // the counters wrapped or were reset
+		}
+		return float64(b - a)
+	}
+	rates.ReadMBps = delta(before.ReadBytes, after.ReadBytes) / mb / seconds
+	rates.WriteMBps = delta(before.WriteBytes, after.WriteBytes) / mb / seconds
+	rates.ReadIOPS = delta(before.Reads, after.Reads) / seconds
+	rates.WriteIOPS = delta(before.Writes, after.Writes) / seconds
+	rates.Utilization = min(100, max(0, float64(after.BusyTime-before.BusyTime)*100/float64(elapsed)))
+	if after.QueueTime > 0 {
+		rates.QueueDepth = max(0, float64(after.QueueTime-before.QueueTime)/float64(elapsed))
+	}
+	return rates
+}
+
+// bottleneck guesses what limits a transfer from how busy the device is. A
+// device without I/O is usually served from the page cache, so it says nothing.
+func (r diskRates) bottleneck() string {
+	switch {
+	case r.ReadIOPS == 0 && r.WriteIOPS == 0:
+		return ""
+	case r.Utilization >= 90:
+		return "device bound"
+	case r.Utilization < 50:
+		return "tool bound"
+	}
+	return ""
+}
+
+// progressLine describes the device activity for the progress output of
+// long operations, empty if the device has no counters
+func (s *diskStatsSampler) progressLine() string {
+	if s == nil {
+		return ""
+	}
+	rates, err := s.sample()
+	if err != nil {
+		return ""
+	}
+	line := fmt.Sprintf("Device %s: %.0f%% busy, queue depth %.1f, read %.2f MB/s (%.0f IOPS), write %.2f MB/s (%.0f IOPS)",
+		rates.Name, rates.Utilization, rates.QueueDepth, rates.ReadMBps, rates.ReadIOPS, rates.WriteMBps, rates.WriteIOPS)
+	if hint := rates.bottleneck(); hint != "" {
+		line += ", " + hint
+	}
+	return line
+}
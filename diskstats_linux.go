@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// diskStatsAvailable reports whether the kernel exports disk counters
+func diskStatsAvailable() bool {
+	_, err := os.Stat("/proc/diskstats")
+	return err == nil
+}
+
+// diskStatsName returns the kernel name of the block device a device node or
+// image file lives on, as used in /proc/diskstats
+func diskStatsName(device string) (string, error) {
+	info, err := os.Stat(device)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no device number for %s", device)
+	}
+
+	// Device nodes are the disk themselves, for files it is the disk they are stored on
+	dev := stat.Dev
+	if info.Mode()&os.ModeDevice != 0 {
+		dev = stat.Rdev
+	}
+	link, err := os.Readlink(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(dev), unix.Minor(dev)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+// readDiskCounters reads the counters of a device from /proc/diskstats
+func readDiskCounters(device string) (diskCounters, error) {
+	name, err := diskStatsName(device)
+	if err != nil {
+		return diskCounters{}, err
+	}
+	file, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return diskCounters{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 || fields[2] != name {
+			continue
+		}
+		value := func(i int) uint64 {
+			v, _ := strconv.ParseUint(fields[i], 10, 64)
+			return v
+		}
+		// The sector counts are always in 512 byte units
+		return diskCounters{
+			Name:       name,
+			Reads:      value(3),
+			ReadBytes:  value(5) * 512,
+			Writes:     value(7),
+			WriteBytes: value(9) * 512,
+			InFlight:   value(11),
+			BusyTime:   time.Duration(value(12)) * time.Millisecond,
+			QueueTime:  time.Duration(value(13)) * time.Millisecond,
+		}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return diskCounters{}, err
+	}
+	return diskCounters{}, fmt.Errorf("%s is not in /proc/diskstats", name)
+}
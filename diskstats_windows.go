@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// diskStatsAvailable reports whether the disk counters can be read, Windows
+// keeps them for every physical drive
+func diskStatsAvailable() bool {
+	return true
+}
+
+// readDiskCounters reads the performance counters of a physical drive. The
+// times are in 100ns units and there is no weighted queue time, only the
+// current queue depth.
+func readDiskCounters(device string) (diskCounters, error) {
+	if !strings.HasPrefix(strings.ToLower(device), `\\.\physicaldrive`) {
+		return diskCounters{}, fmt.Errorf("%s is not a physical drive", device)
+	}
+	handle, err := windows.CreateFile(windows.StringToUTF16Ptr(device), 0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return diskCounters{}, err
+	}
+	defer windows.CloseHandle(handle)
+
+	var perf DiskPerformance
+	var bytesReturned uint32
+	err = windows.DeviceIoControl(handle, IOCTL_DISK_PERFORMANCE, nil, 0,
+		(*byte)(unsafe.Pointer(&perf)), uint32(unsafe.Sizeof(perf)), &bytesReturned, nil)
+	if err != nil {
+		return diskCounters{}, fmt.Errorf("error getting disk performance: %v", err)
+	}
+	return diskCounters{
+		Name:       device[len(`\\.\`):],
+		Reads:      uint64(perf.ReadCount),
+		Writes:     uint64(perf.WriteCount),
+		ReadBytes:  uint64(perf.BytesRead),
+		WriteBytes: uint64(perf.BytesWritten),
+		BusyTime:   time.Duration(max(perf.QueryTime-perf.IdleTime, 0)) * 100,
+		InFlight:   uint64(perf.QueueDepth),
+	}, nil
+}
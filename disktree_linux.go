@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// blockDevice is a disk or partition as shown by disks --tree
+type blockDevice struct {
+	Name       string
+	Path       string
+	Size       int64
+	FSType     string
+	Label      string
+	MountPoint string
+	Tags       string
+	Inventory  diskInventory // of disks, not partitions
+	Children   []*blockDevice
+
+	Unresponsive bool // probing it timed out
+}
+
+// excludedBlockDevice filters out devices that are known not to be physical disks
+func excludedBlockDevice(name string) bool {
+	for _, prefix := range []string{"loop", "zram", "ram"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanBlockDevices builds the disk and partition hierarchy from sysfs
+func scanBlockDevices() ([]*blockDevice, error) {
+	entries, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		return nil, err
+	}
+
+	tags, _ := loadTags()
+	devices := map[string]*blockDevice{}
+	parents := map[string]string{}
+	var list []*blockDevice
+	for _, entry := range entries {
+		name := entry.Name()
+		if excludedBlockDevice(name) {
+			continue
+		}
+		sysPath := filepath.Join("/sys/class/block", name)
+
+		dev := &blockDevice{Name: name, Path: "/dev/" + name}
+		if data, err := os.ReadFile(filepath.Join(sysPath, "size")); err == nil {
+			// sysfs always counts 512 byte sectors regardless of the logical sector size
+			sectors, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+			dev.Size = sectors * 512
+		}
+
+		if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+			if resolved, err := filepath.EvalSymlinks(sysPath); err == nil {
+				parents[name] = filepath.Base(filepath.Dir(resolved))
+			}
+		} else {
+			dev.Tags = tags.describe(dev.Path)
+			dev.Inventory = readDiskInventory(dev.Path)
+		}
+
+		// Device mapper targets (LUKS, LVM) hang below the device they are built on
+		if holders, err := os.ReadDir(filepath.Join(sysPath, "holders")); err == nil {
+			for _, holder := range holders {
+				if _, ok := parents[holder.Name()]; !ok {
+					parents[holder.Name()] = name
+				}
+			}
+		}
+		devices[name] = dev
+		list = append(list, dev)
+	}
+
+	// Reading the filesystem of a hung device blocks, so the devices are
+	// probed in parallel and one that times out is listed without it
+	var paths []string
+	for _, dev := range list {
+		paths = append(paths, dev.Path)
+	}
+	type probedFS struct {
+		FSType, Label, MountPoint string
+		Hung                      bool
+	}
+	probed, errs := probeParallel(paths, func(path string) probedFS {
+		var fs probedFS
+		name := filepath.Base(path)
+		props := udevProperties(name)
+		fs.FSType, fs.Label = props["ID_FS_TYPE"], props["ID_FS_LABEL"]
+		if fs.FSType == "" {
+			fs.FSType, fs.Label, fs.Hung = probeFileSystem(path, devices[name].Size)
+		}
+		fs.MountPoint, _ = findMountPointForDevice(path)
+		return fs
+	})
+	for i, dev := range list {
+		if errs[i] != nil || probed[i].Hung {
+			dev.Unresponsive = true
+			continue
+		}
+		dev.FSType, dev.Label, dev.MountPoint = probed[i].FSType, probed[i].Label, probed[i].MountPoint
+	}
+
+	var roots []*blockDevice
+	for name, dev := range devices {
+		if parent, ok := devices[parents[name]]; ok {
+			parent.Children = append(parent.Children, dev)
+		} else {
+			roots = append(roots, dev)
+		}
+	}
+
+	sortBlockDevices(roots)
+	return roots, nil
+}
+
+// sortBlockDevices orders devices naturally, so sda2 comes before sda10
+func sortBlockDevices(devices []*blockDevice) {
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i].Name, devices[j].Name
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	for _, dev := range devices {
+		sortBlockDevices(dev.Children)
+	}
+}
+
+// probeFileSystem reads the filesystem type and label directly when udev
+// does not know them. hung is set if the device stopped answering.
+func probeFileSystem(path string, size int64) (fsType, label string, hung bool) {
+	// O_NONBLOCK keeps the open from waiting for media, e.g. in a card reader
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return "", "", false
+	}
+	defer file.Close()
+
+	r := newTimeoutReaderAt(file, path)
+	if fsys, err := openFileSystem(r, size); err == nil {
+		return strings.ToLower(fsys.Type()), volumeLabel(fsys), r.hung
+	}
+	return identifyFileSystem(r, 0, size), "", r.hung
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func listDisksTree() {
+	roots, err := scanBlockDevices()
+	if err != nil {
+		fmt.Printf("Error reading /sys/class/block: %v\n", err)
+		return
+	}
+	printBlockTree(os.Stdout, roots, isTerminal(os.Stdout))
+}
+
+type treeRow struct {
+	cells  []string
+	colors []string
+}
+
+func printBlockTree(w io.Writer, roots []*blockDevice, color bool) {
+	rows := []treeRow{{cells: []string{"NAME", "SIZE", "MODEL", "TRAN", "FSTYPE", "LABEL", "MOUNTPOINT", "TAGS"}}}
+
+	var walk func(dev *blockDevice, prefix, branch string)
+	walk = func(dev *blockDevice, prefix, branch string) {
+		nameColor := ""
+		if len(dev.Children) > 0 || branch == "" {
+			nameColor = "\033[1m"
+		}
+		row := treeRow{
+			cells: []string{prefix + branch + dev.Name, formatBytes(dev.Size), dev.Inventory.name(), dev.Inventory.kind(),
+				dev.FSType, dev.Label, dev.MountPoint, dev.Tags},
+			colors: []string{nameColor, "", "", "", "", "", green, yellow},
+		}
+		if dev.Unresponsive {
+			row.cells[4], row.colors[4] = "unresponsive", red
+		}
+		rows = append(rows, row)
+
+		childPrefix := prefix
+		switch branch {
+		case "├─":
+			childPrefix += "│ "
+		case "└─":
+			childPrefix += "  "
+		}
+		for i, child := range dev.Children {
+			if i == len(dev.Children)-1 {
+				walk(child, childPrefix, "└─")
+			} else {
+				walk(child, childPrefix, "├─")
+			}
+		}
+	}
+	for _, root := range roots {
+		walk(root, "", "")
+	}
+
+	// tabwriter counts bytes, so pad by rune count to keep the tree and colors aligned
+	widths := make([]int, len(rows[0].cells))
+	for _, row := range rows {
+		for i, cell := range row.cells {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	for _, row := range rows {
+		var line strings.Builder
+		for i, cell := range row.cells {
+			padded := cell
+			if i < len(row.cells)-1 {
+				padded += strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2)
+			}
+			if color && i < len(row.colors) && row.colors[i] != "" && cell != "" {
+				padded = row.colors[i] + cell + reset + padded[len(cell):]
+			}
+			line.WriteString(padded)
+		}
+		fmt.Fprintln(w, strings.TrimRight(line.String(), " "))
+	}
+}
+
+// diskRecords flattens the device tree into one record per disk, partition or holder
+func diskRecords() ([][]string, error) {
+	roots, err := scanBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	var walk func(dev *blockDevice, parent *blockDevice)
+	walk = func(dev *blockDevice, parent *blockDevice) {
+		kind, parentPath := "disk", ""
+		if parent != nil {
+			kind, parentPath = "part", parent.Path
+			if _, err := os.Stat(filepath.Join("/sys/class/block", dev.Name, "partition")); err != nil {
+				kind = "holder"
+			}
+		}
+
+		var total, used, free string
+		if dev.MountPoint != "" {
+			if t, u, f, err := getFsSpace(dev.MountPoint); err == nil {
+				total, used, free = strconv.FormatInt(t, 10), strconv.FormatInt(u, 10), strconv.FormatInt(f, 10)
+			}
+		}
+
+		var inv diskInventory
+		if kind == "disk" {
+			inv = readDiskInventory(dev.Path)
+		}
+
+		rows = append(rows, []string{
+			dev.Path, parentPath, kind, strconv.FormatInt(dev.Size, 10), dev.FSType, dev.Label, dev.MountPoint,
+			total, used, free, inv.Serial, dev.Tags, inv.Vendor, inv.Model, inv.WWN, inv.Media, inv.Transport,
+		})
+		for _, child := range dev.Children {
+			walk(child, dev)
+		}
+	}
+	for _, root := range roots {
+		walk(root, nil)
+	}
+	return rows, nil
+}
+
+// devicesByLabel returns the disks and partitions whose filesystem has the label
+func devicesByLabel(label string) ([]string, error) {
+	roots, err := scanBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	var walk func(devices []*blockDevice)
+	walk = func(devices []*blockDevice) {
+		for _, dev := range devices {
+			if dev.Label == label {
+				matches = append(matches, dev.Path)
+			}
+			walk(dev.Children)
+		}
+	}
+	walk(roots)
+	return matches, nil
+}
+
+// discoverDisks returns the paths of the whole disks on the system
+func discoverDisks() ([]string, error) {
+	roots, err := scanBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, dev := range roots {
+		paths = append(paths, dev.Path)
+	}
+	return paths, nil
+}
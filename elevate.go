@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// When the system refuses a command access to a disk, dsktool offers to run
+// that one command again elevated, with sudo or doas, or through UAC on
+// Windows, and says how to do it by hand where it cannot ask.
+
+// elevationOffered keeps a command from asking twice
+var elevationOffered bool
+
+// isPermissionError tells whether err is the system refusing access
+func isPermissionError(err error) bool {
+	for _, denied := range permissionErrors {
+		if errors.Is(err, denied) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPermissionMessage tells whether an error message ends in the system
+// refusing access, for the errors that only reach fatalf as text
+func isPermissionMessage(message string) bool {
+	for _, denied := range permissionErrors {
+		if strings.HasSuffix(strings.TrimSpace(message), denied.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// offerElevation asks to run the command again elevated after access was
+// refused, and exits with the status of the elevated run. It returns if
+// that is not possible or the user declines, after showing how to elevate.
+func offerElevation(reason string) {
+	if elevationOffered || isElevated() {
+		return
+	}
+	elevationOffered = true
+
+	args := os.Args[1:]
+	if recording != nil && !containsString(args, "--record") {
+		args = append([]string{"--record", recording.path}, args...)
+	}
+	tool := elevationTool()
+	if tool == "" || !isTerminal(os.Stdin) {
+		fmt.Printf("%s%s needs elevated privileges, run it again %s%s\n", yellow, reason, elevationHint(args), reset)
+		return
+	}
+	if !confirm(fmt.Sprintf("%s needs elevated privileges. Run this command again with %s?", reason, tool)) {
+		return
+	}
+
+	recordEvent("info", fmt.Sprintf("Running the command again with %s", tool))
+	status, err := runElevated(args)
+	if err != nil {
+		fmt.Printf("%sRunning the command with %s: %v%s\n", red, tool, err, reset)
+		return
+	}
+	finishRecording(status, nil)
+	os.Exit(status)
+}
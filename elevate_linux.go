@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// permissionErrors are the errors the system refuses access with
+var permissionErrors = []error{syscall.EACCES, syscall.EPERM}
+
+// elevationTools are tried in order to run a command as root
+var elevationTools = []string{"sudo", "doas"}
+
+func isElevated() bool {
+	return os.Geteuid() == 0
+}
+
+// elevationTool returns the first of the elevationTools that is installed
+func elevationTool() string {
+	for _, tool := range elevationTools {
+		if _, err := exec.LookPath(tool); err == nil {
+			return tool
+		}
+	}
+	return ""
+}
+
+// elevationHint shows the command line that runs args as root
+func elevationHint(args []string) string {
+	tool := elevationTool()
+	if tool == "" {
+		return "as root"
+	}
+	return "as root: " + tool + " " + os.Args[0] + " " + strings.Join(args, " ")
+}
+
+// runElevated runs dsktool with args as root on this terminal and returns its exit status
+func runElevated(args []string) (int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(elevationTool(), append([]string{self}, args...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), nil
+	}
+	return 0, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// permissionErrors are the errors the system refuses access with
+var permissionErrors = []error{windows.ERROR_ACCESS_DENIED, windows.ERROR_PRIVILEGE_NOT_HELD}
+
+var procShellExecuteEx = windows.NewLazySystemDLL("shell32.dll").NewProc("ShellExecuteExW")
+
+// shellExecuteInfo is SHELLEXECUTEINFOW
+type shellExecuteInfo struct {
+	cbSize       uint32
+	fMask        uint32
+	hwnd         windows.Handle
+	lpVerb       *uint16
+	lpFile       *uint16
+	lpParameters *uint16
+	lpDirectory  *uint16
+	nShow        int32
+	hInstApp     windows.Handle
+	lpIDList     uintptr
+	lpClass      *uint16
+	hkeyClass    windows.Handle
+	dwHotKey     uint32
+	hIcon        windows.Handle
+	hProcess     windows.Handle
+}
+
+const seeMaskNoCloseProcess = 0x40
+
+func isElevated() bool {
+	return isAdmin()
+}
+
+// elevationTool is UAC, which asks before the command runs as administrator
+func elevationTool() string {
+	return "administrator rights"
+}
+
+// elevationHint tells how to run a command as administrator
+func elevationHint(args []string) string {
+	return "from a command prompt opened with Run as administrator"
+}
+
+// runElevated runs dsktool with args as administrator after the UAC prompt
+// and returns its exit status. It runs in a console window of its own.
+func runElevated(args []string) (int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = windows.EscapeArg(arg)
+	}
+	cwd, _ := os.Getwd()
+	info := shellExecuteInfo{
+		fMask:        seeMaskNoCloseProcess,
+		lpVerb:       windows.StringToUTF16Ptr("runas"),
+		lpFile:       windows.StringToUTF16Ptr(self),
+		lpParameters: windows.StringToUTF16Ptr(strings.Join(quoted, " ")),
+		lpDirectory:  windows.StringToUTF16Ptr(cwd),
+		nShow:        windows.SW_SHOWNORMAL,
+	}
+	info.cbSize = uint32(unsafe.Sizeof(info))
+	if ok, _, err := procShellExecuteEx.Call(uintptr(unsafe.Pointer(&info))); ok == 0 {
+		return 0, err
+	}
+	defer windows.CloseHandle(info.hProcess)
+
+	fmt.Println("The command runs as administrator in a window of its own")
+	if _, err := windows.WaitForSingleObject(info.hProcess, windows.INFINITE); err != nil {
+		return 0, err
+	}
+	var status uint32
+	if err := windows.GetExitCodeProcess(info.hProcess, &status); err != nil {
+		return 0, err
+	}
+	return int(status), nil
+}
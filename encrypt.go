@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"golang.org/x/term"
+)
+
+// Encrypted images are age files holding the compressed stream, so age can
+// open them as well. They are encrypted to an age recipient made by
+// age-keygen or to a passphrase, with age's scrypt key derivation.
+
+const (
+	// encryptWorkFactor is the scrypt work factor, log2 N, of new images
+	encryptWorkFactor = 18
+	// encryptMaxWorkFactor is the highest work factor an image to read may
+	// ask for, eight times the work of a new one, so a crafted header can
+	// not keep restore or verify busy for hours
+	encryptMaxWorkFactor = encryptWorkFactor + 3
+	encryptExtension     = ".age"
+)
+
+// ageMagic starts the header of age files
+const ageMagic = "age-encryption.org/v1\n"
+
+// decryptIdentityFile holds the age identities tried on encrypted images, set by --identity
+var decryptIdentityFile string
+
+// loadAgeIdentities reads the identities of an age identity file
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return identities, nil
+}
+
+// readPassphrase takes the passphrase from DSKTOOL_PASSPHRASE or asks for it
+// on the terminal, twice when it is new
+func readPassphrase(confirmNew bool) ([]byte, error) {
+	if env := os.Getenv("DSKTOOL_PASSPHRASE"); env != "" {
+		return []byte(env), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase, set DSKTOOL_PASSPHRASE")
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the passphrase is empty")
+	}
+	if confirmNew {
+		fmt.Fprint(os.Stderr, "Repeat the passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("the passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// encryptWriter encrypts what is written to it to the recipient
+type encryptWriter struct {
+	recipient age.Recipient
+	w         io.WriteCloser
+}
+
+// newEncryptWriter sets up encryption for the mode, "passphrase" or an
+// age1... recipient, before anything is written, start gives it the output
+func newEncryptWriter(mode string) (*encryptWriter, error) {
+	if mode != "passphrase" {
+		recipient, err := age.ParseX25519Recipient(mode)
+		if err != nil {
+			return nil, fmt.Errorf("--encrypt takes passphrase or an age recipient: %v", err)
+		}
+		return &encryptWriter{recipient: recipient}, nil
+	}
+	passphrase, err := readPassphrase(true)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := age.NewScryptRecipient(string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	recipient.SetWorkFactor(encryptWorkFactor)
+	return &encryptWriter{recipient: recipient}, nil
+}
+
+// start writes the header to the output the stream is encrypted into
+func (e *encryptWriter) start(w io.Writer) (err error) {
+	e.w, err = age.Encrypt(w, e.recipient)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	return e.w.Write(p)
+}
+
+// Close encrypts the last chunk, the underlying writer stays open
+func (e *encryptWriter) Close() error {
+	return e.w.Close()
+}
+
+// newDecryptReader reads the header of an encrypted image, recovers the file
+// key with a passphrase or the identities of --identity and returns a reader
+// of the stream
+func newDecryptReader(r *bufio.Reader) (io.Reader, error) {
+	// Passphrase images have a single scrypt stanza in the header
+	header, _ := r.Peek(min(r.Size(), 4*kb))
+	var identities []age.Identity
+	if bytes.Contains(header, []byte("\n-> scrypt ")) {
+		passphrase, err := readPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(string(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		identity.SetMaxWorkFactor(encryptMaxWorkFactor)
+		identities = append(identities, identity)
+	} else {
+		if decryptIdentityFile == "" {
+			return nil, fmt.Errorf("the image is encrypted to an age recipient, give its identity file with --identity")
+		}
+		var err error
+		if identities, err = loadAgeIdentities(decryptIdentityFile); err != nil {
+			return nil, err
+		}
+	}
+
+	dr, err := age.Decrypt(r, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		if decryptIdentityFile == "" {
+			return nil, fmt.Errorf("wrong passphrase")
+		}
+		return nil, fmt.Errorf("none of the identities in %s can decrypt the image", decryptIdentityFile)
+	}
+	return dr, err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// estimateSampleSize is how much of the disk each sample of an estimate reads
+const estimateSampleSize = mb
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
+
+// imageEstimate is what an image is expected to take
+type imageEstimate struct {
+	Size     int64
+	Ratio    float64
+	Duration time.Duration
+}
+
+// estimateImage reads samples from random places of the source, compresses
+// them with the algorithm and extrapolates the size of the image and how long
+// making it takes, limited by the slower of reading and compressing
+func estimateImage(source io.ReaderAt, size int64, algorithm string, options compressionOptions, samples int) (imageEstimate, error) {
+	if size <= 0 {
+		return imageEstimate{}, nil
+	}
+	cw := &countingWriter{w: io.Discard}
+	compressor, err := createCompressionWriter(cw, algorithm, options)
+	if err != nil {
+		return imageEstimate{}, err
+	}
+
+	var (
+		buf                    = make([]byte, min(estimateSampleSize, size))
+		sampled                int64
+		readTime, compressTime time.Duration
+	)
+	for i := 0; i < samples; i++ {
+		// Samples start on 4 KiB boundaries like filesystem blocks do
+		offset := rand.Int63n(size-int64(len(buf))+1) &^ (4*kb - 1)
+		start := time.Now()
+		n, err := source.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return imageEstimate{}, fmt.Errorf("reading a sample at %d: %v", offset, err)
+		}
+		readTime += time.Since(start)
+
+		start = time.Now()
+		if _, err := compressor.Write(buf[:n]); err != nil {
+			return imageEstimate{}, err
+		}
+		compressTime += time.Since(start)
+		sampled += int64(n)
+	}
+	start := time.Now()
+	if err := compressor.Close(); err != nil {
+		return imageEstimate{}, err
+	}
+	compressTime += time.Since(start)
+	if sampled == 0 {
+		return imageEstimate{}, nil
+	}
+
+	ratio := float64(cw.count) / float64(sampled)
+	perByte := max(readTime, compressTime).Seconds() / float64(sampled)
+	return imageEstimate{
+		Size:     int64(ratio * float64(size)),
+		Ratio:    ratio,
+		Duration: time.Duration(perByte * float64(size) * float64(time.Second)),
+	}, nil
+}
+
+// autoCompressionAlgorithms are the algorithms --auto chooses from, zlib and
+// zip compress like gzip
+var autoCompressionAlgorithms = []string{"zstd", "gzip", "s2", "snappy", "lz4", "bzip2", "xz"}
+
+// autoCompressionSamples is how many samples --auto compresses unless --estimate sets it
+const autoCompressionSamples = 16
+
+// autoCompressionSlack is how much longer than with the fastest algorithm
+// imaging may take for a smaller image
+const autoCompressionSlack = 1.25
+
+// pickCompression compresses the same samples of the source with every
+// algorithm and picks the one with the smallest image among those that
+// image about as fast as the fastest one
+func pickCompression(source io.ReaderAt, size int64, samples int, options compressionOptions) (string, error) {
+	var (
+		data     [][]byte
+		sampled  int64
+		readTime time.Duration
+	)
+	for i := 0; i < samples && size > 0; i++ {
+		buf := make([]byte, min(estimateSampleSize, size))
+		offset := rand.Int63n(size-int64(len(buf))+1) &^ (4*kb - 1)
+		start := time.Now()
+		n, err := source.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("reading a sample at %d: %v", offset, err)
+		}
+		readTime += time.Since(start)
+		data = append(data, buf[:n])
+		sampled += int64(n)
+	}
+	if sampled == 0 {
+		return "", fmt.Errorf("there is nothing to sample")
+	}
+
+	estimates := map[string]imageEstimate{}
+	fastest := time.Duration(math.MaxInt64)
+	for _, algorithm := range autoCompressionAlgorithms {
+		// Options for another algorithm, like a zstd window, are left out
+		algorithmOptions := options
+		if options.check(algorithm) != nil {
+			algorithmOptions = compressionOptions{}
+		}
+		cw := &countingWriter{w: io.Discard}
+		compressor, err := createCompressionWriter(cw, algorithm, algorithmOptions)
+		if err != nil {
+			return "", err
+		}
+		start := time.Now()
+		for _, sample := range data {
+			if _, err := compressor.Write(sample); err != nil {
+				return "", err
+			}
+		}
+		if err := compressor.Close(); err != nil {
+			return "", err
+		}
+		compressTime := time.Since(start)
+
+		ratio := float64(cw.count) / float64(sampled)
+		perByte := max(readTime, compressTime).Seconds() / float64(sampled)
+		estimate := imageEstimate{
+			Size:     int64(ratio * float64(size)),
+			Ratio:    ratio,
+			Duration: time.Duration(perByte * float64(size) * float64(time.Second)),
+		}
+		estimates[algorithm] = estimate
+		fastest = min(fastest, estimate.Duration)
+	}
+
+	picked := ""
+	fmt.Printf("Compressing %d samples of %s to pick the compression:\n", len(data), formatBytes(estimateSampleSize))
+	for _, algorithm := range autoCompressionAlgorithms {
+		estimate := estimates[algorithm]
+		fmt.Printf("  %-7s %5.1f%%, about %s to make\n", algorithm, estimate.Ratio*100, estimate.Duration.Truncate(time.Second))
+		if float64(estimate.Duration) <= float64(fastest)*autoCompressionSlack &&
+			(picked == "" || estimate.Size < estimates[picked].Size) {
+			picked = algorithm
+		}
+	}
+	return picked, nil
+}
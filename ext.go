@@ -0,0 +1,485 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	extMagic = 0xef53
+
+	extCompatHasJournal = 0x4
+	extIncompatFiletype = 0x2
+	extIncompatExtents  = 0x40
+	extIncompat64Bit    = 0x80
+
+	extExtentsFlag    = 0x80000
+	extInlineDataFlag = 0x10000000
+
+	extRootInode = 2
+)
+
+// extFS is a read-only ext2/3/4 filesystem
+type extFS struct {
+	r               io.ReaderAt
+	blockSize       int64
+	inodesPerGroup  uint32
+	inodeSize       uint32
+	descSize        uint32
+	firstDataBlock  uint32
+	featureCompat   uint32
+	featureIncompat uint32
+	Label           string
+	UUID            [16]byte
+}
+
+// extInode holds the fields of an on-disk inode we need
+type extInode struct {
+	Mode  uint16
+	Size  int64
+	MTime time.Time
+	Flags uint32
+	Block [60]byte
+}
+
+// extExtent maps a run of logical file blocks to physical blocks
+type extExtent struct {
+	Logical   uint64
+	Physical  uint64
+	Length    uint64
+	Unwritten bool
+}
+
+// isExtSuperblock checks the ext magic in the superblock
+func isExtSuperblock(sb []byte) bool {
+	return len(sb) >= 0x3a && le16(sb, 0x38) == extMagic
+}
+
+func openExt(r io.ReaderAt) (*extFS, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, 1024); err != nil {
+		return nil, fmt.Errorf("reading superblock: %v", err)
+	}
+	if !isExtSuperblock(sb) {
+		return nil, fmt.Errorf("not an ext filesystem")
+	}
+
+	e := &extFS{
+		r:               r,
+		blockSize:       1024 << le32(sb, 0x18),
+		inodesPerGroup:  le32(sb, 0x28),
+		firstDataBlock:  le32(sb, 0x14),
+		inodeSize:       128,
+		descSize:        32,
+		featureCompat:   le32(sb, 0x5c),
+		featureIncompat: le32(sb, 0x60),
+		Label:           trimNull(sb[0x78:0x88]),
+	}
+	copy(e.UUID[:], sb[0x68:0x78])
+
+	if le32(sb, 0x4c) >= 1 {
+		e.inodeSize = uint32(le16(sb, 0x58))
+	}
+	if e.featureIncompat&extIncompat64Bit != 0 && le16(sb, 0xfe) >= 32 {
+		e.descSize = uint32(le16(sb, 0xfe))
+	}
+	if e.blockSize > 64*kb || e.inodesPerGroup == 0 || e.inodeSize < 128 {
+		return nil, fmt.Errorf("invalid ext superblock")
+	}
+
+	return e, nil
+}
+
+func (e *extFS) Type() string {
+	switch {
+	case e.featureIncompat&extIncompatExtents != 0:
+		return "ext4"
+	case e.featureCompat&extCompatHasJournal != 0:
+		return "ext3"
+	}
+	return "ext2"
+}
+
+func (e *extFS) readInode(ino uint32) (*extInode, error) {
+	if ino == 0 {
+		return nil, fmt.Errorf("invalid inode 0")
+	}
+	group := (ino - 1) / e.inodesPerGroup
+	index := (ino - 1) % e.inodesPerGroup
+
+	desc := make([]byte, e.descSize)
+	descOffset := int64(e.firstDataBlock+1)*e.blockSize + int64(group)*int64(e.descSize)
+	if _, err := e.r.ReadAt(desc, descOffset); err != nil {
+		return nil, fmt.Errorf("reading group descriptor %d: %v", group, err)
+	}
+	table := uint64(le32(desc, 0x08))
+	if e.descSize >= 64 {
+		table |= uint64(le32(desc, 0x28)) << 32
+	}
+
+	raw := make([]byte, 128)
+	if _, err := e.r.ReadAt(raw, int64(table)*e.blockSize+int64(index)*int64(e.inodeSize)); err != nil {
+		return nil, fmt.Errorf("reading inode %d: %v", ino, err)
+	}
+
+	inode := &extInode{
+		Mode:  le16(raw, 0x00),
+		Size:  int64(le32(raw, 0x04)) | int64(le32(raw, 0x6c))<<32,
+		MTime: time.Unix(int64(le32(raw, 0x10)), 0),
+		Flags: le32(raw, 0x20),
+	}
+	copy(inode.Block[:], raw[0x28:0x64])
+	return inode, nil
+}
+
+func (i *extInode) fileMode() os.FileMode {
+	mode := os.FileMode(i.Mode & 0777)
+	switch i.Mode & 0xf000 {
+	case 0x4000:
+		mode |= os.ModeDir
+	case 0xa000:
+		mode |= os.ModeSymlink
+	case 0x8000:
+	default:
+		mode |= os.ModeIrregular
+	}
+	return mode
+}
+
+// extents returns the sorted block mapping of an inode, holes are simply missing
+func (e *extFS) extents(inode *extInode) ([]extExtent, error) {
+	var extents []extExtent
+	var err error
+	if inode.Flags&extExtentsFlag != 0 {
+		err = e.walkExtentTree(inode.Block[:], &extents, 0)
+	} else {
+		err = e.walkBlockMap(inode, &extents)
+	}
+	sort.Slice(extents, func(a, b int) bool { return extents[a].Logical < extents[b].Logical })
+	return extents, err
+}
+
+func (e *extFS) walkExtentTree(node []byte, extents *[]extExtent, level int) error {
+	if le16(node, 0) != 0xf30a {
+		return fmt.Errorf("bad extent header magic")
+	}
+	if level > 5 {
+		return fmt.Errorf("extent tree too deep")
+	}
+	entries := int(le16(node, 2))
+	depth := le16(node, 6)
+
+	for i := 0; i < entries && 12+i*12+12 <= len(node); i++ {
+		entry := node[12+i*12:]
+		if depth == 0 {
+			length := uint64(le16(entry, 4))
+			unwritten := length > 32768
+			if unwritten {
+				length -= 32768
+			}
+			*extents = append(*extents, extExtent{
+				Logical:   uint64(le32(entry, 0)),
+				Physical:  uint64(le16(entry, 6))<<32 | uint64(le32(entry, 8)),
+				Length:    length,
+				Unwritten: unwritten,
+			})
+			continue
+		}
+
+		leaf := uint64(le16(entry, 8))<<32 | uint64(le32(entry, 4))
+		child := make([]byte, e.blockSize)
+		if _, err := e.r.ReadAt(child, int64(leaf)*e.blockSize); err != nil {
+			return err
+		}
+		if err := e.walkExtentTree(child, extents, level+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkBlockMap converts the ext2/3 direct and indirect block pointers into extents
+func (e *extFS) walkBlockMap(inode *extInode, extents *[]extExtent) error {
+	add := func(logical, physical uint64) {
+		if n := len(*extents); n > 0 {
+			last := &(*extents)[n-1]
+			if last.Logical+last.Length == logical && last.Physical+last.Length == physical {
+				last.Length++
+				return
+			}
+		}
+		*extents = append(*extents, extExtent{Logical: logical, Physical: physical, Length: 1})
+	}
+
+	perBlock := uint64(e.blockSize / 4)
+	blocks := uint64((inode.Size + e.blockSize - 1) / e.blockSize)
+
+	var walk func(block uint64, level int, logical uint64) error
+	walk = func(block uint64, level int, logical uint64) error {
+		if level == 0 {
+			add(logical, block)
+			return nil
+		}
+		data := make([]byte, e.blockSize)
+		if _, err := e.r.ReadAt(data, int64(block)*e.blockSize); err != nil {
+			return err
+		}
+		span := uint64(1)
+		for i := 1; i < level; i++ {
+			span *= perBlock
+		}
+		for i := uint64(0); i < perBlock && logical+i*span < blocks; i++ {
+			child := uint64(le32(data, int(i*4)))
+			if child == 0 {
+				continue
+			}
+			if err := walk(child, level-1, logical+i*span); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	logical := uint64(0)
+	for i := 0; i < 12 && logical < blocks; i, logical = i+1, logical+1 {
+		if block := uint64(le32(inode.Block[:], i*4)); block != 0 {
+			add(logical, block)
+		}
+	}
+	span := perBlock
+	for level := 1; level <= 3 && logical < blocks; level++ {
+		if block := uint64(le32(inode.Block[:], (11+level)*4)); block != 0 {
+			if err := walk(block, level, logical); err != nil {
+				return err
+			}
+		}
+		logical += span
+		span *= perBlock
+	}
+	return nil
+}
+
+// extFileReader reads file contents through its extents, holes read as zeros
+type extFileReader struct {
+	fs      *extFS
+	extents []extExtent
+	inline  []byte
+}
+
+func (f *extFileReader) ReadAt(p []byte, off int64) (int, error) {
+	if f.inline != nil {
+		if off >= int64(len(f.inline)) {
+			return 0, io.EOF
+		}
+		return copy(p, f.inline[off:]), nil
+	}
+
+	bs := f.fs.blockSize
+	total := 0
+	for len(p) > 0 {
+		logical := uint64(off / bs)
+		within := off % bs
+		n := int64(len(p))
+		if n > bs-within {
+			n = bs - within
+		}
+
+		i := sort.Search(len(f.extents), func(i int) bool {
+			return f.extents[i].Logical+f.extents[i].Length > logical
+		})
+		if i < len(f.extents) && f.extents[i].Logical <= logical && !f.extents[i].Unwritten {
+			physical := f.extents[i].Physical + logical - f.extents[i].Logical
+			if _, err := f.fs.r.ReadAt(p[:n], int64(physical)*bs+within); err != nil {
+				return total, err
+			}
+		} else {
+			clear(p[:n])
+		}
+
+		total += int(n)
+		p = p[n:]
+		off += n
+	}
+	return total, nil
+}
+
+// contents returns a reader for the data of an inode
+func (e *extFS) contents(inode *extInode) (*io.SectionReader, error) {
+	if inode.Flags&extInlineDataFlag != 0 {
+		size := inode.Size
+		if size > int64(len(inode.Block)) {
+			size = int64(len(inode.Block))
+		}
+		return io.NewSectionReader(&extFileReader{inline: inode.Block[:size]}, 0, size), nil
+	}
+
+	extents, err := e.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(&extFileReader{fs: e, extents: extents}, 0, inode.Size), nil
+}
+
+// extDirEntry is a parsed directory entry
+type extDirEntry struct {
+	Inode uint32
+	Name  string
+}
+
+func (e *extFS) readDirEntries(inode *extInode) ([]extDirEntry, error) {
+	data, err := e.contents(inode)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, data.Size())
+	if _, err := data.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var entries []extDirEntry
+	for off := 0; off+8 <= len(buf); {
+		ino := le32(buf, off)
+		recLen := int(le16(buf, off+4))
+		nameLen := int(buf[off+6])
+		if e.featureIncompat&extIncompatFiletype == 0 {
+			nameLen = int(le16(buf, off+6))
+		}
+		if recLen < 8 || off+8+nameLen > len(buf) {
+			break
+		}
+
+		name := string(buf[off+8 : off+8+nameLen])
+		if ino != 0 && name != "." && name != ".." {
+			entries = append(entries, extDirEntry{Inode: ino, Name: name})
+		}
+		off += recLen
+	}
+	return entries, nil
+}
+
+func (e *extFS) lookup(name string) (uint32, *extInode, error) {
+	ino := uint32(extRootInode)
+	inode, err := e.readInode(ino)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, part := range splitPath(name) {
+		if inode.Mode&0xf000 != 0x4000 {
+			return 0, nil, fmt.Errorf("%s: not a directory", name)
+		}
+		entries, err := e.readDirEntries(inode)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		found := false
+		for _, entry := range entries {
+			if entry.Name == part {
+				ino, found = entry.Inode, true
+				break
+			}
+		}
+		if !found {
+			return 0, nil, fmt.Errorf("%s: no such file or directory", name)
+		}
+		if inode, err = e.readInode(ino); err != nil {
+			return 0, nil, err
+		}
+	}
+	return ino, inode, nil
+}
+
+func (e *extFS) entry(name string, inode *extInode) (fsEntry, error) {
+	entry := fsEntry{
+		Name:    name,
+		Size:    inode.Size,
+		Mode:    inode.fileMode(),
+		ModTime: inode.MTime,
+	}
+
+	if entry.Mode&os.ModeSymlink != 0 {
+		// Fast symlinks keep the target inside the block pointers
+		if inode.Size < 60 && inode.Flags&(extExtentsFlag|extInlineDataFlag) == 0 {
+			entry.Target = string(inode.Block[:inode.Size])
+		} else {
+			data, err := e.contents(inode)
+			if err != nil {
+				return entry, err
+			}
+			target := make([]byte, inode.Size)
+			if _, err := data.ReadAt(target, 0); err != nil && err != io.EOF {
+				return entry, err
+			}
+			entry.Target = string(target)
+		}
+	}
+	return entry, nil
+}
+
+func (e *extFS) Stat(name string) (fsEntry, error) {
+	_, inode, err := e.lookup(name)
+	if err != nil {
+		return fsEntry{}, err
+	}
+	parts := splitPath(name)
+	base := "/"
+	if len(parts) > 0 {
+		base = parts[len(parts)-1]
+	}
+	return e.entry(base, inode)
+}
+
+func (e *extFS) ReadDir(name string) ([]fsEntry, error) {
+	_, dir, err := e.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir.Mode&0xf000 != 0x4000 {
+		return nil, fmt.Errorf("%s: not a directory", name)
+	}
+
+	entries, err := e.readDirEntries(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]fsEntry, 0, len(entries))
+	for _, de := range entries {
+		inode, err := e.readInode(de.Inode)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := e.entry(de.Name, inode)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Name < result[b].Name })
+	return result, nil
+}
+
+func (e *extFS) Open(name string) (*io.SectionReader, error) {
+	_, inode, err := e.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if inode.Mode&0xf000 == 0x4000 {
+		return nil, fmt.Errorf("%s: is a directory", name)
+	}
+	return e.contents(inode)
+}
+
+// trimNull returns the string up to the first NUL byte
+func trimNull(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
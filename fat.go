@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatAttrReadOnly  = 0x01
+	fatAttrHidden    = 0x02
+	fatAttrSystem    = 0x04
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrLongName  = 0x0f
+
+	fatEntryFree    = 0x00
+	fatEntryDeleted = 0xe5
+)
+
+// fatFS is a read-only FAT12/16/32 filesystem
+type fatFS struct {
+	r                 io.ReaderAt
+	fatType           string
+	bytesPerSector    uint32
+	sectorsPerCluster uint32
+	clusterSize       int64
+	firstDataSector   uint32
+	rootDirSector     uint32 // FAT12/16 fixed root directory
+	rootDirSectors    uint32
+	rootCluster       uint32 // FAT32 root directory
+	clusterCount      uint32
+	label             string
+	serial            uint32
+	fat               []byte
+}
+
+// fatDirEntry is a parsed directory entry including its long file name
+type fatDirEntry struct {
+	fsEntry
+	ShortName string
+	Attr      uint8
+	Cluster   uint32
+	Deleted   bool
+}
+
+// isFATBootSector checks the boot sector for a sane FAT BIOS parameter block
+func isFATBootSector(boot []byte) bool {
+	if boot[510] != 0x55 || boot[511] != 0xaa {
+		return false
+	}
+	if boot[0] != 0xeb && boot[0] != 0xe9 {
+		return false
+	}
+	bps := le16(boot, 0x0b)
+	spc := boot[0x0d]
+	if bps < 512 || bps > 4096 || bps&(bps-1) != 0 || spc == 0 || spc&(spc-1) != 0 {
+		return false
+	}
+	// exFAT and NTFS have a zeroed or missing FAT count
+	return boot[0x10] != 0 && le16(boot, 0x0e) != 0
+}
+
+func openFAT(r io.ReaderAt, size int64) (*fatFS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if !isFATBootSector(boot) {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+
+	f := &fatFS{
+		r:                 r,
+		bytesPerSector:    uint32(le16(boot, 0x0b)),
+		sectorsPerCluster: uint32(boot[0x0d]),
+	}
+	f.clusterSize = int64(f.bytesPerSector * f.sectorsPerCluster)
+
+	reserved := uint32(le16(boot, 0x0e))
+	numFATs := uint32(boot[0x10])
+	rootEntries := uint32(le16(boot, 0x11))
+	totalSectors := uint32(le16(boot, 0x13))
+	if totalSectors == 0 {
+		totalSectors = le32(boot, 0x20)
+	}
+	fatSize := uint32(le16(boot, 0x16))
+	if fatSize == 0 {
+		fatSize = le32(boot, 0x24)
+	}
+
+	f.rootDirSectors = (rootEntries*32 + f.bytesPerSector - 1) / f.bytesPerSector
+	f.rootDirSector = reserved + numFATs*fatSize
+	f.firstDataSector = f.rootDirSector + f.rootDirSectors
+	if totalSectors <= f.firstDataSector {
+		return nil, fmt.Errorf("invalid FAT geometry")
+	}
+	f.clusterCount = (totalSectors - f.firstDataSector) / f.sectorsPerCluster
+
+	switch {
+	case f.clusterCount < 4085:
+		f.fatType = "FAT12"
+	case f.clusterCount < 65525:
+		f.fatType = "FAT16"
+	default:
+		f.fatType = "FAT32"
+		f.rootCluster = le32(boot, 0x2c)
+	}
+
+	// The extended boot signature tells whether the label field is present
+	ebpb := 0x24
+	if f.fatType == "FAT32" {
+		ebpb = 0x40
+	}
+	if boot[ebpb+2] == 0x29 {
+		f.serial = le32(boot, ebpb+3)
+		label := strings.TrimRight(string(boot[ebpb+7:ebpb+18]), " \x00")
+		if label != "NO NAME" {
+			f.label = label
+		}
+	}
+
+	f.fat = make([]byte, int64(fatSize)*int64(f.bytesPerSector))
+	if _, err := r.ReadAt(f.fat, int64(reserved)*int64(f.bytesPerSector)); err != nil {
+		return nil, fmt.Errorf("reading FAT: %v", err)
+	}
+
+	return f, nil
+}
+
+func (f *fatFS) Type() string {
+	return f.fatType
+}
+
+// entry returns the FAT entry of cluster n, false if it is past the FAT
+func (f *fatFS) entry(n uint32) (uint32, bool) {
+	switch f.fatType {
+	case "FAT12":
+		off := n + n/2
+		if int(off)+1 >= len(f.fat) {
+			return 0, false
+		}
+		v := uint32(le16(f.fat, int(off)))
+		if n&1 == 1 {
+			return v >> 4, true
+		}
+		return v & 0xfff, true
+	case "FAT16":
+		if int(n)*2+1 >= len(f.fat) {
+			return 0, false
+		}
+		return uint32(le16(f.fat, int(n)*2)), true
+	default:
+		if int(n)*4+3 >= len(f.fat) {
+			return 0, false
+		}
+		return le32(f.fat, int(n)*4) & 0x0fffffff, true
+	}
+}
+
+// next returns the cluster following n in the chain and whether the chain continues
+func (f *fatFS) next(n uint32) (uint32, bool) {
+	v, ok := f.entry(n)
+	if !ok {
+		return 0, false
+	}
+	eoc := map[string]uint32{"FAT12": 0xff7, "FAT16": 0xfff7}[f.fatType]
+	if eoc == 0 {
+		eoc = 0x0ffffff7
+	}
+	return v, v >= 2 && v < eoc && v < f.clusterCount+2
+}
+
+// chain follows the cluster chain starting at start
+func (f *fatFS) chain(start uint32) []uint32 {
+	var clusters []uint32
+	seen := map[uint32]bool{}
+	for c, ok := start, start >= 2; ok && !seen[c]; c, ok = f.next(c) {
+		seen[c] = true
+		clusters = append(clusters, c)
+	}
+	return clusters
+}
+
+func (f *fatFS) clusterOffset(cluster uint32) int64 {
+	return int64(f.firstDataSector+(cluster-2)*f.sectorsPerCluster) * int64(f.bytesPerSector)
+}
+
+// clusterReader reads a file stored in a list of clusters
+type clusterReader struct {
+	fs       *fatFS
+	clusters []uint32
+}
+
+func (c *clusterReader) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		index := off / c.fs.clusterSize
+		if index >= int64(len(c.clusters)) {
+			return total, io.EOF
+		}
+		within := off % c.fs.clusterSize
+		n := int64(len(p))
+		if n > c.fs.clusterSize-within {
+			n = c.fs.clusterSize - within
+		}
+		read, err := c.fs.r.ReadAt(p[:n], c.fs.clusterOffset(c.clusters[index])+within)
+		total += read
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		off += n
+	}
+	return total, nil
+}
+
+// dirData returns the raw contents of a directory, cluster 0 being the root
+func (f *fatFS) dirData(cluster uint32) ([]byte, error) {
+	if cluster == 0 && f.fatType != "FAT32" {
+		buf := make([]byte, int64(f.rootDirSectors)*int64(f.bytesPerSector))
+		_, err := f.r.ReadAt(buf, int64(f.rootDirSector)*int64(f.bytesPerSector))
+		return buf, err
+	}
+	if cluster == 0 {
+		cluster = f.rootCluster
+	}
+
+	clusters := f.chain(cluster)
+	buf := make([]byte, int64(len(clusters))*f.clusterSize)
+	_, err := (&clusterReader{fs: f, clusters: clusters}).ReadAt(buf, 0)
+	return buf, err
+}
+
+// readDirEntries parses the directory at cluster, optionally keeping deleted entries
+func (f *fatFS) readDirEntries(cluster uint32, includeDeleted bool) ([]fatDirEntry, error) {
+	data, err := f.dirData(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []fatDirEntry
+	var lfn []uint16
+	var lfnChecksum uint8
+	for off := 0; off+32 <= len(data); off += 32 {
+		raw := data[off : off+32]
+		if raw[0] == fatEntryFree {
+			break
+		}
+		deleted := raw[0] == fatEntryDeleted
+		attr := raw[11]
+
+		if attr == fatAttrLongName {
+			if deleted && !includeDeleted {
+				lfn = nil
+				continue
+			}
+			// The ordinal of deleted entries is overwritten, so only live entries mark the start
+			if !deleted && raw[0]&0x40 != 0 {
+				lfn = nil
+			}
+			lfnChecksum = raw[13]
+			lfn = append(fatLongNamePart(raw), lfn...)
+			continue
+		}
+
+		if (deleted && !includeDeleted) || attr&fatAttrVolumeID != 0 {
+			lfn = nil
+			continue
+		}
+
+		shortName := fatShortName(raw)
+		if shortName == "." || shortName == ".." {
+			lfn = nil
+			continue
+		}
+
+		entry := fatDirEntry{
+			ShortName: shortName,
+			Attr:      attr,
+			Cluster:   uint32(le16(raw, 20))<<16 | uint32(le16(raw, 26)),
+			Deleted:   deleted,
+		}
+		entry.Name = shortName
+		if lfn != nil && (deleted || fatShortNameChecksum(raw[:11]) == lfnChecksum) {
+			entry.Name = fatDecodeLongName(lfn)
+		}
+		lfn = nil
+
+		entry.Size = int64(le32(raw, 28))
+		entry.ModTime = fatTime(le16(raw, 24), le16(raw, 22))
+		entry.Mode = 0644
+		if attr&fatAttrReadOnly != 0 {
+			entry.Mode = 0444
+		}
+		if attr&fatAttrDirectory != 0 {
+			entry.Mode = os.ModeDir | 0755
+			entry.Size = 0
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// lookup resolves a path to its directory entry, the root having cluster 0
+func (f *fatFS) lookup(name string) (fatDirEntry, error) {
+	current := fatDirEntry{fsEntry: fsEntry{Name: "/", Mode: os.ModeDir | 0755}}
+	for _, part := range splitPath(name) {
+		if !current.Mode.IsDir() {
+			return current, fmt.Errorf("%s: not a directory", current.Name)
+		}
+		entries, err := f.readDirEntries(current.Cluster, false)
+		if err != nil {
+			return current, err
+		}
+
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name, part) || strings.EqualFold(e.ShortName, part) {
+				current, found = e, true
+				break
+			}
+		}
+		if !found {
+			return current, fmt.Errorf("%s: no such file or directory", name)
+		}
+	}
+	return current, nil
+}
+
+func (f *fatFS) Stat(name string) (fsEntry, error) {
+	entry, err := f.lookup(name)
+	return entry.fsEntry, err
+}
+
+func (f *fatFS) ReadDir(name string) ([]fsEntry, error) {
+	dir, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.Mode.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", name)
+	}
+
+	entries, err := f.readDirEntries(dir.Cluster, false)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]fsEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.fsEntry)
+	}
+	return result, nil
+}
+
+func (f *fatFS) Open(name string) (*io.SectionReader, error) {
+	entry, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Mode.IsDir() {
+		return nil, fmt.Errorf("%s: is a directory", name)
+	}
+	return io.NewSectionReader(&clusterReader{fs: f, clusters: f.chain(entry.Cluster)}, 0, entry.Size), nil
+}
+
+// fatShortName formats the 8.3 name, honouring the lowercase flags Windows sets
+func fatShortName(raw []byte) string {
+	base := strings.TrimRight(string(raw[0:8]), " ")
+	ext := strings.TrimRight(string(raw[8:11]), " ")
+	if raw[0] == 0x05 || raw[0] == fatEntryDeleted {
+		// 0x05 stands for a real 0xe5, deleted entries lost their first character
+		base = "_" + base[1:]
+	}
+	if raw[12]&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if raw[12]&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func fatShortNameChecksum(name []byte) uint8 {
+	var sum uint8
+	for _, c := range name {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// fatLongNamePart returns the 13 UTF-16 characters stored in a long name entry
+func fatLongNamePart(raw []byte) []uint16 {
+	var part []uint16
+	for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+		part = append(part, le16(raw, off))
+	}
+	return part
+}
+
+func fatDecodeLongName(name []uint16) string {
+	for i, c := range name {
+		if c == 0 || c == 0xffff {
+			name = name[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(name))
+}
+
+func fatTime(date, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0x0f), int(date&0x1f),
+		int(tm>>11), int(tm>>5&0x3f), int(tm&0x1f)*2, 0, time.Local)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// fingerprintRegion is a hashed byte range of a device
+type fingerprintRegion struct {
+	Name   string
+	Offset int64
+	Length int64
+	Sum    [sha256.Size]byte
+}
+
+// diskFingerprint identifies a device by the hashes of a few strategic regions
+type diskFingerprint struct {
+	Device  string
+	Size    int64
+	Sum     string
+	Regions []fingerprintRegion
+}
+
+// fingerprintRegions picks the regions to hash: the partition tables, the
+// first and last MiB and the start of every partition, where superblocks live
+func fingerprintRegions(image *diskImage) []fingerprintRegion {
+	regions := []fingerprintRegion{
+		{Name: "table", Offset: 0, Length: 34 * int64(image.SectorSize)},
+		{Name: "head", Offset: 0, Length: mb},
+		{Name: "tail", Offset: image.Size - mb, Length: mb},
+	}
+
+	if table, err := image.partitionTable(); err == nil {
+		for _, part := range table.Partitions {
+			regions = append(regions, fingerprintRegion{
+				Name:   fmt.Sprintf("part%d", part.Number),
+				Offset: part.Offset(table.SectorSize),
+				Length: 128 * kb,
+			})
+		}
+	}
+
+	// Clamp everything to the device so small images still work
+	for i := range regions {
+		if regions[i].Offset < 0 {
+			regions[i].Offset = 0
+		}
+		if regions[i].Offset+regions[i].Length > image.Size {
+			regions[i].Length = image.Size - regions[i].Offset
+		}
+		if regions[i].Length < 0 {
+			regions[i].Length = 0
+		}
+	}
+	return regions
+}
+
+func fingerprintDevice(device string) (*diskFingerprint, error) {
+	image, err := openImage(device, false)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	fp := &diskFingerprint{Device: device, Size: image.Size, Regions: fingerprintRegions(image)}
+
+	total := sha256.New()
+	binary.Write(total, binary.LittleEndian, image.Size)
+	for i := range fp.Regions {
+		region := &fp.Regions[i]
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(image, region.Offset, region.Length)); err != nil {
+			return nil, fmt.Errorf("reading %s region: %v", region.Name, err)
+		}
+		copy(region.Sum[:], h.Sum(nil))
+		total.Write([]byte(region.Name))
+		total.Write(region.Sum[:])
+	}
+	fp.Sum = hex.EncodeToString(total.Sum(nil))[:16]
+
+	return fp, nil
+}
+
+func fingerprintDisks(devices []string, verbose bool) error {
+	var fingerprints []*diskFingerprint
+	for _, device := range devices {
+		fp, err := fingerprintDevice(device)
+		if err != nil {
+			return fmt.Errorf("%s: %v", device, err)
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, fp := range fingerprints {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", fp.Device, formatBytes(fp.Size), fp.Sum)
+		if verbose {
+			for _, region := range fp.Regions {
+				fmt.Fprintf(w, "  %s\t@%d+%d\t%x\n", region.Name, region.Offset, region.Length, region.Sum[:8])
+			}
+		}
+	}
+	w.Flush()
+
+	if len(fingerprints) < 2 {
+		return nil
+	}
+
+	fmt.Println()
+	for i := 0; i < len(fingerprints); i++ {
+		for j := i + 1; j < len(fingerprints); j++ {
+			fmt.Println(compareFingerprints(fingerprints[i], fingerprints[j]))
+		}
+	}
+	return nil
+}
+
+// compareFingerprints describes how alike two devices are
+func compareFingerprints(a, b *diskFingerprint) string {
+	if a.Sum == b.Sum {
+		return fmt.Sprintf("%s and %s are clones (identical fingerprint)", a.Device, b.Device)
+	}
+
+	regions := map[string][sha256.Size]byte{}
+	for _, region := range a.Regions {
+		regions[region.Name] = region.Sum
+	}
+
+	var same []string
+	for _, region := range b.Regions {
+		if sum, ok := regions[region.Name]; ok && sum == region.Sum && region.Length > 0 {
+			same = append(same, region.Name)
+		}
+	}
+
+	if len(same) == 0 {
+		return fmt.Sprintf("%s and %s differ", a.Device, b.Device)
+	}
+	return fmt.Sprintf("%s and %s differ but share %s", a.Device, b.Device, strings.Join(same, ", "))
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mkfixture writes disk images with a partition table laid out from a seed,
+// and on request broken the ways real disks are: entries that overlap,
+// checksums that do not match, a backup GPT cut off by a short copy, long or
+// looping chains of extended boot records. The same seed and options make the
+// same image, so a bug report can name a fixture instead of attaching it.
+
+// fixtureKind is a pathology mkfixture can build into an image
+type fixtureKind struct {
+	Name        string
+	Table       string // the table type it applies to
+	Description string
+}
+
+var fixtureKinds = []fixtureKind{
+	{"overlap", "GPT", "a partition starts inside the one before it"},
+	{"bad-header-crc", "GPT", "the primary GPT header checksum does not match"},
+	{"bad-entries-crc", "GPT", "the primary GPT entry array checksum does not match"},
+	{"truncated-backup", "GPT", "the image ends before the backup GPT, like a short copy"},
+	{"ebr-chain", "MBR", "an extended partition with --depth logical partitions"},
+	{"ebr-loop", "MBR", "an extended partition whose last EBR links back to the first"},
+}
+
+// fixtureOptions are the mkfixture settings
+type fixtureOptions struct {
+	Size       int64
+	Seed       int64 // 0 picks one and prints it
+	Partitions int   // 0 picks 2 to 6
+	Depth      int   // logical partitions of the EBR kinds
+	Force      bool
+}
+
+const fixtureAlignment = 2048 // sectors, 1 MiB
+
+// fixtureGPTTypes and fixtureMBRTypes are the partition types fixtures pick from
+var (
+	fixtureGPTTypes = []string{"Linux filesystem", "EFI System", "Microsoft basic data", "Linux swap", "Linux LVM"}
+	fixtureMBRTypes = []uint8{0x83, 0x0c, 0x07, 0x82}
+)
+
+// fixture is an image being made
+type fixture struct {
+	path    string
+	file    *os.File
+	rng     *rand.Rand
+	sectors uint64
+	kinds   map[string]bool
+	options fixtureOptions
+}
+
+// makeFixture writes a fixture image to path with the kinds of damage named
+func makeFixture(path string, kinds []string, options fixtureOptions) error {
+	f := &fixture{path: path, kinds: map[string]bool{}, options: options}
+	tableType := "GPT"
+	for _, name := range kinds {
+		kind, err := findFixtureKind(name)
+		if err != nil {
+			return err
+		}
+		for other := range f.kinds {
+			if previous, _ := findFixtureKind(other); previous.Table != kind.Table {
+				return fmt.Errorf("%s is for %s tables and %s for %s tables, make them separate fixtures", other, previous.Table, name, kind.Table)
+			}
+		}
+		f.kinds[name] = true
+		tableType = kind.Table
+	}
+	if f.kinds["ebr-chain"] && f.kinds["ebr-loop"] {
+		return fmt.Errorf("ebr-loop already makes a chain, leave out ebr-chain")
+	}
+	if options.Size < 8*mb || options.Size%512 != 0 {
+		return fmt.Errorf("fixtures are at least 8 MiB and a multiple of 512 bytes")
+	}
+	if options.Partitions < 0 || options.Partitions > 128 || options.Depth < 1 {
+		return fmt.Errorf("--partitions is between 1 and 128 and --depth at least 1")
+	}
+	if options.Seed == 0 {
+		options.Seed = time.Now().UnixNano()
+		f.options.Seed = options.Seed
+	}
+	if _, err := os.Stat(path); err == nil && !options.Force {
+		return fmt.Errorf("%s exists, use --force to replace it", path)
+	}
+	f.rng = rand.New(rand.NewSource(options.Seed))
+	f.sectors = uint64(options.Size / 512)
+
+	var (
+		table *partitionTable
+		err   error
+	)
+	if tableType == "GPT" {
+		table, err = f.gptLayout()
+	} else {
+		table, err = f.mbrLayout()
+	}
+	if err != nil {
+		return err
+	}
+
+	damage := "none"
+	if len(kinds) > 0 {
+		damage = strings.Join(kinds, ", ")
+	}
+	fmt.Printf("Fixture %s: %s, %s table, seed %d, damage: %s\n", path, formatBytes(options.Size), tableType, options.Seed, damage)
+	for _, part := range table.Partitions {
+		fmt.Printf("  %d  %s\n", part.Number, joinFields(partitionFields(part, 512)))
+	}
+	if f.kinds["ebr-chain"] || f.kinds["ebr-loop"] {
+		fmt.Printf("  %d logical partitions in the extended partition\n", options.Depth)
+	}
+	if dryRun {
+		fmt.Println("Dry run: the fixture was not written")
+		return nil
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if options.Force {
+		if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file, --force only replaces fixture files", path)
+		}
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	if f.file, err = os.OpenFile(path, flags, 0o644); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s exists, use --force to replace it", path)
+		}
+		return err
+	}
+	defer f.file.Close()
+	if err := f.file.Truncate(options.Size); err != nil {
+		return err
+	}
+
+	if tableType == "GPT" {
+		err = f.writeGPT(table)
+	} else {
+		err = f.writeMBR(table)
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, make it again with: dsktool mkfixture --size %d --seed %d%s %s\n",
+		path, options.Size, options.Seed, f.countFlags(), strings.Join(append([]string{path}, kinds...), " "))
+	printResult("%s", path)
+	return nil
+}
+
+// findFixtureKind looks up a kind by name
+func findFixtureKind(name string) (fixtureKind, error) {
+	var names []string
+	for _, kind := range fixtureKinds {
+		if kind.Name == name {
+			return kind, nil
+		}
+		names = append(names, kind.Name)
+	}
+	return fixtureKind{}, fmt.Errorf("unknown fixture kind %q, use %s", name, strings.Join(names, ", "))
+}
+
+// countFlags are the options besides the seed that change the layout
+func (f *fixture) countFlags() string {
+	var flags string
+	if f.options.Partitions > 0 {
+		flags += fmt.Sprintf(" --partitions %d", f.options.Partitions)
+	}
+	if f.kinds["ebr-chain"] || f.kinds["ebr-loop"] {
+		flags += fmt.Sprintf(" --depth %d", f.options.Depth)
+	}
+	return flags
+}
+
+// guid returns a version 4 GUID from the seed
+func (f *fixture) guid() [16]byte {
+	var g [16]byte
+	f.rng.Read(g[:])
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g
+}
+
+// spans splits first to last into count aligned partitions of random sizes
+// with random gaps between them
+func (f *fixture) spans(first, last uint64, count int) ([][2]uint64, error) {
+	first = (first + fixtureAlignment - 1) / fixtureAlignment * fixtureAlignment
+	slots := (last + 1 - first) / fixtureAlignment
+	if slots < uint64(count) {
+		return nil, fmt.Errorf("%d partitions of 1 MiB do not fit, make the fixture larger", count)
+	}
+	// Cut the slots at random distinct points, every partition gets at least one
+	cuts := []uint64{0, slots}
+	for picked := map[uint64]bool{}; len(cuts) < count+1; {
+		cut := 1 + uint64(f.rng.Int63n(int64(slots-1)+1))
+		if cut < slots && !picked[cut] {
+			picked[cut] = true
+			cuts = append(cuts, cut)
+		}
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i] < cuts[j] })
+
+	var spans [][2]uint64
+	for i := 0; i < count; i++ {
+		start, end := first+cuts[i]*fixtureAlignment, first+cuts[i+1]*fixtureAlignment-1
+		// Partitions of several slots leave some of them free
+		if length := cuts[i+1] - cuts[i]; length > 1 {
+			end -= uint64(f.rng.Int63n(int64(length/2)+1)) * fixtureAlignment
+		}
+		spans = append(spans, [2]uint64{start, min(end, last)})
+	}
+	return spans, nil
+}
+
+// gptLayout lays out the GPT partitions, overlapping if asked to
+func (f *fixture) gptLayout() (*partitionTable, error) {
+	table, err := newPartitionTable("GPT", 512, f.sectors)
+	if err != nil {
+		return nil, err
+	}
+	table.Header.DiskGUID = f.guid()
+	count := f.options.Partitions
+	if count == 0 {
+		count = 2 + f.rng.Intn(5)
+	}
+	if f.kinds["overlap"] && count < 2 {
+		return nil, fmt.Errorf("overlap needs at least 2 partitions")
+	}
+	spans, err := f.spans(table.Header.FirstUsableLBA, table.Header.LastUsableLBA, count)
+	if err != nil {
+		return nil, err
+	}
+	for i, span := range spans {
+		typeName := fixtureGPTTypes[f.rng.Intn(len(fixtureGPTTypes))]
+		part, err := table.createPartition(partitionSpec{Number: i + 1, FirstLBA: span[0], LastLBA: span[1], Type: typeName, Name: fmt.Sprintf("fixture %d", i+1)}, f.sectors)
+		if err != nil {
+			return nil, err
+		}
+		part.GPT.UniqueGUID = f.guid()
+	}
+	if f.kinds["overlap"] {
+		// Move the start of a partition back into its predecessor
+		i := 1 + f.rng.Intn(count-1)
+		prev, part := &table.Partitions[i-1], &table.Partitions[i]
+		part.FirstLBA = prev.FirstLBA + uint64(f.rng.Int63n(int64(prev.Sectors())))
+	}
+	return table, nil
+}
+
+// writeGPT writes the table and damages it
+func (f *fixture) writeGPT(table *partitionTable) error {
+	if err := writeGPT(f.file, f.file, f.options.Size, table); err != nil {
+		return err
+	}
+	if f.kinds["bad-header-crc"] {
+		// Bits of the stored checksum are flipped, the header itself reads fine
+		if err := f.flipByte(512 + 16 + int64(f.rng.Intn(4))); err != nil {
+			return err
+		}
+	}
+	if f.kinds["bad-entries-crc"] {
+		// A byte of the first entry's name changes under the checksum
+		if err := f.flipByte(2*512 + 56 + int64(f.rng.Intn(16))); err != nil {
+			return err
+		}
+	}
+	if f.kinds["truncated-backup"] {
+		// Cut into the backup entries, the backup header is always lost
+		entrySectors := f.sectors - 1 - table.Header.LastUsableLBA - 1
+		cut := 1 + f.rng.Int63n(int64(entrySectors))
+		if err := f.file.Truncate(f.options.Size - cut*512); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flipByte inverts a byte of the image
+func (f *fixture) flipByte(offset int64) error {
+	b := make([]byte, 1)
+	if _, err := f.file.ReadAt(b, offset); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err := f.file.WriteAt(b, offset)
+	return err
+}
+
+// mbrLayout lays out the primary partitions, the last one extended when a
+// chain of logical partitions is asked for
+func (f *fixture) mbrLayout() (*partitionTable, error) {
+	table, err := newPartitionTable("MBR", 512, f.sectors)
+	if err != nil {
+		return nil, err
+	}
+	chain := f.kinds["ebr-chain"] || f.kinds["ebr-loop"]
+	count := f.options.Partitions
+	if count == 0 {
+		count = 1 + f.rng.Intn(3)
+		if !chain {
+			count++
+		}
+	}
+	if count > 4 || (chain && count > 3) {
+		return nil, fmt.Errorf("MBR fixtures have up to 4 primary partitions, 3 next to an extended one")
+	}
+	primaries := count
+	if chain {
+		count++
+	}
+	spans, err := f.spans(fixtureAlignment, min(f.sectors-1, 0xffffffff), count)
+	if err != nil {
+		return nil, err
+	}
+	for i, span := range spans {
+		entry := &mbrPartition{Type: fixtureMBRTypes[f.rng.Intn(len(fixtureMBRTypes))]}
+		if i == primaries {
+			entry.Type = 0x0f
+		}
+		entry.FirstSector, entry.Sectors = uint32(span[0]), uint32(span[1]-span[0]+1)
+		table.Partitions = append(table.Partitions, partitionEntry{Number: i + 1, FirstLBA: span[0], LastLBA: span[1], MBR: entry})
+	}
+	if chain && table.Partitions[primaries].Sectors() < uint64(f.options.Depth)*2 {
+		return nil, fmt.Errorf("the extended partition is too small for %d logical partitions, make the fixture larger or lower --depth", f.options.Depth)
+	}
+	return table, nil
+}
+
+// writeMBR writes the primary partitions and the EBR chain
+func (f *fixture) writeMBR(table *partitionTable) error {
+	if err := writeMBR(f.file, f.file, table); err != nil {
+		return err
+	}
+	signature := make([]byte, 4)
+	binary.LittleEndian.PutUint32(signature, f.rng.Uint32())
+	if _, err := f.file.WriteAt(signature, 440); err != nil {
+		return err
+	}
+	if !f.kinds["ebr-chain"] && !f.kinds["ebr-loop"] {
+		return nil
+	}
+
+	// Each EBR heads an equal share of the extended partition: its first
+	// entry is the logical partition after it, its second the next EBR,
+	// both relative as the format has it
+	extended := table.Partitions[len(table.Partitions)-1]
+	share := extended.Sectors() / uint64(f.options.Depth)
+	for i := 0; i < f.options.Depth; i++ {
+		at := extended.FirstLBA + uint64(i)*share
+		ebr := make([]byte, 512)
+		logical := ebr[446:]
+		logical[4] = fixtureMBRTypes[f.rng.Intn(len(fixtureMBRTypes))]
+		binary.LittleEndian.PutUint32(logical[8:], 1)
+		binary.LittleEndian.PutUint32(logical[12:], uint32(share-1))
+		next := ebr[462:]
+		switch {
+		case i+1 < f.options.Depth:
+			next[4] = 0x05
+			binary.LittleEndian.PutUint32(next[8:], uint32(uint64(i+1)*share))
+			binary.LittleEndian.PutUint32(next[12:], uint32(share))
+		case f.kinds["ebr-loop"]:
+			next[4] = 0x05
+			binary.LittleEndian.PutUint32(next[12:], uint32(share))
+		}
+		ebr[510], ebr[511] = 0x55, 0xaa
+		if _, err := f.file.WriteAt(ebr, int64(at)*512); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// fsEntry describes a file, directory or symlink inside a filesystem
+type fsEntry struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Target  string // symlink target
+}
+
+// fsReader is implemented by the read-only filesystem parsers
+type fsReader interface {
+	Type() string
+	ReadDir(name string) ([]fsEntry, error)
+	Stat(name string) (fsEntry, error)
+	Open(name string) (*io.SectionReader, error)
+}
+
+// openFileSystem detects the filesystem in r and returns a reader for it
+func openFileSystem(r io.ReaderAt, size int64) (fsReader, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, fmt.Errorf("reading boot sector: %v", err)
+	}
+
+	if isFATBootSector(boot) {
+		return openFAT(r, size)
+	}
+
+	if isNTFSBootSector(boot) {
+		return openNTFS(r)
+	}
+
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, 1024); err == nil && isExtSuperblock(sb) {
+		return openExt(r)
+	}
+
+	return nil, fmt.Errorf("unsupported or unknown filesystem (%s)", detectFileSystem(r, 0))
+}
+
+// identifyFileSystem names the filesystem at offset, using the parsers before
+// falling back to signature matching. It is empty when nothing is recognised.
+func identifyFileSystem(r io.ReaderAt, offset, size int64) string {
+	if fsys, err := openFileSystem(io.NewSectionReader(r, offset, size), size); err == nil {
+		return fsys.Type()
+	}
+	if fsType := detectFileSystem(r, offset); fsType != "Unknown" {
+		return fsType
+	}
+	fsType, _ := probePlugins(r, offset, size)
+	return fsType
+}
+
+// volumeLabel returns the label of a filesystem, empty if it has none
+func volumeLabel(fsys fsReader) string {
+	switch f := fsys.(type) {
+	case *extFS:
+		return f.Label
+	case *fatFS:
+		return f.label
+	case *ntfsFS:
+		return f.volumeName()
+	}
+	return ""
+}
+
+// volumeID returns the UUID or serial number of a filesystem, empty if it has none
+func volumeID(fsys fsReader) string {
+	switch f := fsys.(type) {
+	case *extFS:
+		u := f.UUID
+		return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	case *fatFS:
+		if f.serial != 0 {
+			return fmt.Sprintf("%04X-%04X", f.serial>>16, f.serial&0xffff)
+		}
+	case *ntfsFS:
+		return fmt.Sprintf("%016X", f.serial)
+	}
+	return ""
+}
+
+// parsePartitionSpec splits DEVICE:N into the device and the partition number, 0 meaning the whole device
+func parsePartitionSpec(spec string) (string, int) {
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 {
+		return spec, 0
+	}
+	number, err := strconv.Atoi(spec[i+1:])
+	if err != nil || number <= 0 {
+		return spec, 0
+	}
+	return spec[:i], number
+}
+
+// openPartitionSpec opens DEVICE:N and returns the image together with the partition byte range
+func openPartitionSpec(spec string) (*diskImage, *io.SectionReader, error) {
+	device, number := parsePartitionSpec(spec)
+	image, err := openImage(device, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A partition image has no partition table, its block map says where the partition is
+	blocks, err := readBlockMap(device)
+	if err != nil {
+		image.Close()
+		return nil, nil, err
+	}
+	if blocks != nil && blocks.Partition > 0 && (number == 0 || number == blocks.Partition) {
+		r := blocks.PartitionRange
+		return image, io.NewSectionReader(image, r.Start, r.End-r.Start), nil
+	}
+
+	if number == 0 {
+		return image, io.NewSectionReader(image, 0, image.Size), nil
+	}
+
+	table, err := image.partitionTable()
+	if err != nil {
+		image.Close()
+		return nil, nil, err
+	}
+	part, err := table.findPartition(number)
+	if err != nil {
+		image.Close()
+		return nil, nil, err
+	}
+
+	return image, io.NewSectionReader(image, part.Offset(table.SectorSize), part.Size(table.SectorSize)), nil
+}
+
+// openFileSystemSpec opens the filesystem found at DEVICE:N
+func openFileSystemSpec(spec string) (*diskImage, fsReader, error) {
+	image, section, err := openPartitionSpec(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fsys, err := openFileSystem(section, section.Size())
+	if err != nil {
+		image.Close()
+		return nil, nil, err
+	}
+	return image, fsys, nil
+}
+
+// splitPath returns the cleaned components of a slash separated path
+func splitPath(name string) []string {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+func fsList(spec, name string) error {
+	image, fsys, err := openFileSystemSpec(spec)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	entry, err := fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	entries := []fsEntry{entry}
+	if entry.Mode.IsDir() {
+		entries, err = fsys.ReadDir(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%s filesystem, %s:\n", fsys.Type(), path.Clean("/"+name))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		displayName := e.Name
+		if e.Mode&os.ModeSymlink != 0 {
+			displayName += " -> " + e.Target
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), displayName)
+	}
+	return w.Flush()
+}
+
+func fsCopy(spec, name, destination string) error {
+	image, fsys, err := openFileSystemSpec(spec)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	entry, err := fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	// Copying into an existing directory keeps the source name
+	if info, err := os.Stat(destination); err == nil && info.IsDir() {
+		destination = filepath.Join(destination, entry.Name)
+	}
+
+	return fsCopyEntry(fsys, path.Clean("/"+name), entry, destination)
+}
+
+func fsCopyEntry(fsys fsReader, name string, entry fsEntry, destination string) error {
+	switch {
+	case entry.Mode.IsDir():
+		if err := os.MkdirAll(destination, 0755); err != nil {
+			return err
+		}
+		children, err := fsys.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			err := fsCopyEntry(fsys, path.Join(name, child.Name), child, filepath.Join(destination, child.Name))
+			if err != nil {
+				return err
+			}
+		}
+
+	case entry.Mode&os.ModeSymlink != 0:
+		fmt.Printf("%s -> %s\n", destination, entry.Target)
+		if err := os.Symlink(entry.Target, destination); err != nil {
+			return err
+		}
+
+	default:
+		src, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		dst, err := os.Create(destination)
+		if err != nil {
+			return err
+		}
+		n, err := copySparse(dst, src)
+		if err != nil {
+			dst.Close()
+			return fmt.Errorf("copying %s: %v", name, err)
+		}
+		if err := dst.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("%s (%s)\n", destination, formatBytes(n))
+	}
+
+	if !entry.ModTime.IsZero() && entry.Mode&os.ModeSymlink == 0 {
+		os.Chtimes(destination, entry.ModTime, entry.ModTime)
+	}
+	return nil
+}
+
+// copySparse copies src into dst, seeking over zeroed blocks so holes stay sparse
+func copySparse(dst *os.File, src *io.SectionReader) (int64, error) {
+	buf := make([]byte, 64*kb)
+	var written int64
+	for written < src.Size() {
+		n, err := src.ReadAt(buf, written)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				_, err = dst.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = dst.Write(buf[:n])
+			}
+			if err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	// Extend the file when it ends in a hole
+	return written, dst.Truncate(written)
+}
+
+// isZero reports whether buf only contains zero bytes
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// le16, le32 and le64 read little endian values from on-disk structures
+func le16(b []byte, off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+func le32(b []byte, off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+func le64(b []byte, off int) uint64 { return binary.LittleEndian.Uint64(b[off:]) }
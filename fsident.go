@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// fs label and fs uuid change the identifiers of a filesystem in place, the
+// way tune2fs -L and -U, fatlabel and exfatlabel do, so a clone can be told
+// apart from its original. ext superblocks are rewritten with their backups
+// and checksums, FAT labels go into the boot sector and the root directory,
+// exFAT labels into the root directory and serials into the boot region,
+// whose checksum is updated with it.
+
+const (
+	extROCompatSparseSuper  = 0x1
+	extROCompatGDTChecksum  = 0x10
+	extROCompatMetadataCsum = 0x400
+	extCompatSparseSuper2   = 0x200
+	extIncompatCsumSeed     = 0x2000
+
+	exfatLabelEntry      = 0x83
+	exfatEmptyLabelEntry = 0x03
+	exfatMaxLabel        = 11
+	exfatBootSectors     = 12 // of the boot region, the last holds its checksum
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// fsVolume is the filesystem of DEVICE:N opened for changing it
+type fsVolume struct {
+	writer *deviceWriter
+	r      io.ReaderAt
+	w      io.WriterAt
+	size   int64
+}
+
+// openFileSystemVolume opens the filesystem at DEVICE:N, or a whole device, for writing
+func openFileSystemVolume(spec, operation string) (*fsVolume, error) {
+	device, number := parsePartitionSpec(spec)
+	writer, err := openDeviceWriter(device, operation)
+	if err != nil {
+		return nil, err
+	}
+	offset, size := int64(0), writer.Size
+	if number > 0 {
+		table, err := writer.partitionTable()
+		if err != nil {
+			writer.Close()
+			return nil, err
+		}
+		part, err := table.findPartition(number)
+		if err != nil {
+			writer.Close()
+			return nil, err
+		}
+		offset, size = part.Offset(table.SectorSize), part.Size(table.SectorSize)
+	}
+	return &fsVolume{
+		writer: writer,
+		r:      io.NewSectionReader(writer, offset, size),
+		w:      io.NewOffsetWriter(writer, offset),
+		size:   size,
+	}, nil
+}
+
+// kind names the filesystem on the volume: ext, fat, exfat or the detected name
+func (v *fsVolume) kind() (string, error) {
+	boot := make([]byte, 2048)
+	if _, err := v.r.ReadAt(boot, 0); err != nil {
+		return "", fmt.Errorf("reading the boot sector: %v", err)
+	}
+	switch {
+	case isFATBootSector(boot):
+		return "fat", nil
+	case string(boot[3:11]) == "EXFAT   ":
+		return "exfat", nil
+	case isExtSuperblock(boot[1024:]):
+		return "ext", nil
+	}
+	return "", fmt.Errorf("changing the identifiers of %s filesystems is not supported, only ext, FAT and exFAT", detectFileSystem(v.r, 0))
+}
+
+// setFileSystemLabel writes a new label into the filesystem at spec, an empty
+// label removes it
+func setFileSystemLabel(spec, label string) error {
+	v, err := openFileSystemVolume(spec, "set the filesystem label")
+	if err != nil {
+		return err
+	}
+	defer v.writer.Close()
+	kind, err := v.kind()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "ext":
+		if len(label) > 16 {
+			return fmt.Errorf("ext labels are at most 16 bytes, %q is %d", label, len(label))
+		}
+		err = v.updateExtSuperblocks(func(sb []byte) error {
+			copy(sb[0x78:0x88], make([]byte, 16))
+			copy(sb[0x78:0x88], label)
+			return nil
+		})
+	case "fat":
+		err = v.setFATLabel(label)
+	case "exfat":
+		err = v.setExFATLabel(label)
+	}
+	if err != nil {
+		return err
+	}
+	v.report("label", spec, fmt.Sprintf("%q", strings.TrimSpace(label)))
+	return nil
+}
+
+// setFileSystemID writes a new UUID into an ext filesystem, or a new serial
+// number into a FAT or exFAT one. id "random" picks a new one.
+func setFileSystemID(spec, id string) error {
+	v, err := openFileSystemVolume(spec, "set the filesystem UUID")
+	if err != nil {
+		return err
+	}
+	defer v.writer.Close()
+	kind, err := v.kind()
+	if err != nil {
+		return err
+	}
+
+	var shown string
+	if kind == "ext" {
+		uuid, err := parseFileSystemUUID(id)
+		if err != nil {
+			return err
+		}
+		if err := v.setExtUUID(uuid); err != nil {
+			return err
+		}
+		shown = fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+	} else {
+		serial, err := parseVolumeSerial(id)
+		if err != nil {
+			return err
+		}
+		if kind == "fat" {
+			err = v.setFATSerial(serial)
+		} else {
+			err = v.setExFATSerial(serial)
+		}
+		if err != nil {
+			return err
+		}
+		shown = fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+	}
+	v.report("UUID", spec, shown)
+	return nil
+}
+
+// report tells what was set, or would have been on a dry run
+func (v *fsVolume) report(what, spec, value string) {
+	if v.writer.DryRun {
+		fmt.Printf("Dry run: would set the %s of %s to %s\n", what, spec, value)
+		return
+	}
+	fmt.Printf("Set the %s of %s to %s\n", what, spec, value)
+}
+
+// parseFileSystemUUID reads an ext UUID, or makes a random one
+func parseFileSystemUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+	if s == "random" {
+		if _, err := rand.Read(uuid[:]); err != nil {
+			return uuid, err
+		}
+		// Version 4, the layout of ext UUIDs is big endian throughout
+		uuid[6] = uuid[6]&0x0f | 0x40
+		uuid[8] = uuid[8]&0x3f | 0x80
+		return uuid, nil
+	}
+	parts := strings.Split(s, "-")
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || err != nil || len(raw) != 16 {
+		return uuid, fmt.Errorf("invalid UUID %q, use the xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form or random", s)
+	}
+	copy(uuid[:], raw)
+	return uuid, nil
+}
+
+// parseVolumeSerial reads a FAT or exFAT serial number like 1A2B-3C4D, or
+// makes a random one
+func parseVolumeSerial(s string) (uint32, error) {
+	if s == "random" {
+		var serial [4]byte
+		if _, err := rand.Read(serial[:]); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(serial[:]), nil
+	}
+	digits := strings.ReplaceAll(s, "-", "")
+	serial, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || len(digits) != 8 {
+		return 0, fmt.Errorf("invalid serial number %q, use the XXXX-XXXX form or random", s)
+	}
+	return uint32(serial), nil
+}
+
+// updateExtSuperblocks applies change to the primary superblock and its
+// backups and updates their checksums
+func (v *fsVolume) updateExtSuperblocks(change func(sb []byte) error) error {
+	sb := make([]byte, 1024)
+	if _, err := v.r.ReadAt(sb, 1024); err != nil {
+		return fmt.Errorf("reading the superblock: %v", err)
+	}
+	offsets := append([]int64{1024}, extBackupSuperblocks(sb)...)
+	for i, offset := range offsets {
+		if i > 0 {
+			if _, err := v.r.ReadAt(sb, offset); err != nil {
+				return fmt.Errorf("reading the backup superblock at %d: %v", offset, err)
+			}
+			// Backups the filesystem does not have are left alone
+			if !isExtSuperblock(sb) {
+				continue
+			}
+		}
+		if err := change(sb); err != nil {
+			return err
+		}
+		if le32(sb, 0x64)&extROCompatMetadataCsum != 0 {
+			binary.LittleEndian.PutUint32(sb[0x3fc:], extChecksum(sb[:0x3fc]))
+		}
+		if _, err := v.w.WriteAt(sb, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extBackupSuperblocks returns where the backup superblocks are
+func extBackupSuperblocks(sb []byte) []int64 {
+	blockSize := int64(1024) << le32(sb, 0x18)
+	firstDataBlock := int64(le32(sb, 0x14))
+	blocksPerGroup := int64(le32(sb, 0x20))
+	blocks := int64(le32(sb, 0x04))
+	if le32(sb, 0x60)&extIncompat64Bit != 0 {
+		blocks |= int64(le32(sb, 0x150)) << 32
+	}
+	if blocksPerGroup == 0 {
+		return nil
+	}
+	groups := (blocks - firstDataBlock + blocksPerGroup - 1) / blocksPerGroup
+
+	var backups []int64
+	for g := int64(1); g < groups; g++ {
+		switch {
+		case le32(sb, 0x5c)&extCompatSparseSuper2 != 0:
+			if g != int64(le32(sb, 0x24c)) && g != int64(le32(sb, 0x250)) {
+				continue
+			}
+		case le32(sb, 0x64)&extROCompatSparseSuper != 0:
+			if !isPowerOf(g, 3) && !isPowerOf(g, 5) && !isPowerOf(g, 7) {
+				continue
+			}
+		}
+		backups = append(backups, (firstDataBlock+g*blocksPerGroup)*blockSize)
+	}
+	return backups
+}
+
+func isPowerOf(n, base int64) bool {
+	for n > 1 && n%base == 0 {
+		n /= base
+	}
+	return n == 1
+}
+
+// extChecksum is the crc32c ext4 checksums metadata with, seeded with ~0
+// and not inverted at the end
+func extChecksum(data []byte) uint32 {
+	return ^crc32.Checksum(data, castagnoli)
+}
+
+// setExtUUID changes the UUID. With metadata checksums, which are seeded from
+// the UUID, the old seed is kept in the superblock the way tune2fs does, so
+// nothing else needs rewriting. Older group descriptor checksums include the
+// UUID itself and are left to tune2fs.
+func (v *fsVolume) setExtUUID(uuid [16]byte) error {
+	return v.updateExtSuperblocks(func(sb []byte) error {
+		roCompat, incompat := le32(sb, 0x64), le32(sb, 0x60)
+		if roCompat&extROCompatMetadataCsum == 0 && roCompat&extROCompatGDTChecksum != 0 {
+			return fmt.Errorf("the group descriptor checksums of this filesystem include the UUID, change it with tune2fs -U")
+		}
+		if roCompat&extROCompatMetadataCsum != 0 && incompat&extIncompatCsumSeed == 0 {
+			binary.LittleEndian.PutUint32(sb[0x270:], extChecksum(sb[0x68:0x78]))
+			binary.LittleEndian.PutUint32(sb[0x60:], incompat|extIncompatCsumSeed)
+		}
+		copy(sb[0x68:0x78], uuid[:])
+		return nil
+	})
+}
+
+// fatBootSectors reads the boot sector and returns it with the offsets of
+// its copies, the FAT32 backup boot sector being the second
+func (v *fsVolume) fatBootSectors() ([]byte, []int64, int, error) {
+	boot := make([]byte, 512)
+	if _, err := v.r.ReadAt(boot, 0); err != nil {
+		return nil, nil, 0, err
+	}
+	f, err := openFAT(v.r, v.size)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	offsets, ebpb := []int64{0}, 0x24
+	if f.fatType == "FAT32" {
+		ebpb = 0x40
+		if backup := le16(boot, 0x32); backup != 0 && backup != 0xffff {
+			offsets = append(offsets, int64(backup)*int64(f.bytesPerSector))
+		}
+	}
+	return boot, offsets, ebpb, nil
+}
+
+// writeFATBootField writes a field of the extended BPB into the boot sector and its backup
+func (v *fsVolume) writeFATBootField(field int, value []byte) error {
+	boot, offsets, ebpb, err := v.fatBootSectors()
+	if err != nil {
+		return err
+	}
+	if boot[ebpb+2] != 0x29 {
+		return fmt.Errorf("the boot sector has no extended BIOS parameter block to hold a label or serial number")
+	}
+	for _, offset := range offsets {
+		if _, err := v.w.WriteAt(value, offset+int64(ebpb+field)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *fsVolume) setFATSerial(serial uint32) error {
+	return v.writeFATBootField(3, binary.LittleEndian.AppendUint32(nil, serial))
+}
+
+// setFATLabel sets the label of the boot sector and the volume label entry
+// of the root directory, which is what most systems show
+func (v *fsVolume) setFATLabel(label string) error {
+	field, err := fatLabel(label)
+	if err != nil {
+		return err
+	}
+	if err := v.writeFATBootField(7, field); err != nil {
+		return err
+	}
+
+	f, err := openFAT(v.r, v.size)
+	if err != nil {
+		return err
+	}
+	data, err := f.dirData(0)
+	if err != nil {
+		return fmt.Errorf("reading the root directory: %v", err)
+	}
+	// entryOffset maps an offset of the root directory to the volume
+	entryOffset := func(at int) int64 {
+		if f.fatType != "FAT32" {
+			return int64(f.rootDirSector)*int64(f.bytesPerSector) + int64(at)
+		}
+		return f.clusterOffset(f.chain(f.rootCluster)[int64(at)/f.clusterSize]) + int64(at)%f.clusterSize
+	}
+
+	free := -1
+	for at := 0; at+32 <= len(data); at += 32 {
+		entry := data[at : at+32]
+		if entry[0] == fatEntryFree || entry[0] == fatEntryDeleted {
+			if free < 0 {
+				free = at
+			}
+			if entry[0] == fatEntryFree {
+				break
+			}
+			continue
+		}
+		if entry[11]&fatAttrVolumeID == 0 || entry[11] == fatAttrLongName {
+			continue
+		}
+		if label == "" {
+			_, err = v.w.WriteAt([]byte{fatEntryDeleted}, entryOffset(at))
+		} else {
+			_, err = v.w.WriteAt(field, entryOffset(at))
+		}
+		return err
+	}
+	if label == "" {
+		return nil
+	}
+	if free < 0 {
+		return fmt.Errorf("the root directory is full, only the boot sector label was set")
+	}
+	entry := make([]byte, 32)
+	copy(entry, field)
+	entry[11] = fatAttrVolumeID
+	_, err = v.w.WriteAt(entry, entryOffset(free))
+	return err
+}
+
+// exfatGeometry returns the sector size and where the root directory starts
+func (v *fsVolume) exfatGeometry() (int64, int64, int64, error) {
+	boot := make([]byte, 512)
+	if _, err := v.r.ReadAt(boot, 0); err != nil {
+		return 0, 0, 0, err
+	}
+	sectorShift, clusterShift := boot[0x6c], boot[0x6d]
+	if sectorShift < 9 || sectorShift > 12 || sectorShift+clusterShift > 25 {
+		return 0, 0, 0, fmt.Errorf("invalid exFAT boot sector")
+	}
+	sectorSize := int64(1) << sectorShift
+	clusterSize := sectorSize << clusterShift
+	root := int64(le32(boot, 0x58))*sectorSize + int64(le32(boot, 0x60)-2)*clusterSize
+	return sectorSize, root, clusterSize, nil
+}
+
+// setExFATLabel writes the volume label entry in the first cluster of the
+// root directory, where formatting puts it
+func (v *fsVolume) setExFATLabel(label string) error {
+	name := utf16.Encode([]rune(label))
+	if len(name) > exfatMaxLabel {
+		return fmt.Errorf("exFAT labels are at most %d characters, %q is %d", exfatMaxLabel, label, len(name))
+	}
+	_, root, clusterSize, err := v.exfatGeometry()
+	if err != nil {
+		return err
+	}
+	dir := make([]byte, clusterSize)
+	if _, err := v.r.ReadAt(dir, root); err != nil {
+		return fmt.Errorf("reading the root directory: %v", err)
+	}
+
+	entry := make([]byte, 32)
+	entry[0], entry[1] = exfatLabelEntry, byte(len(name))
+	if len(name) == 0 {
+		entry[0] = exfatEmptyLabelEntry
+	}
+	for i, c := range name {
+		binary.LittleEndian.PutUint16(entry[2+2*i:], c)
+	}
+	for at := 0; at+32 <= len(dir); at += 32 {
+		switch dir[at] {
+		case exfatLabelEntry, exfatEmptyLabelEntry:
+			_, err := v.w.WriteAt(entry, root+int64(at))
+			return err
+		case 0x00:
+			// The end of the directory, the label has never been set
+			if len(name) == 0 {
+				return nil
+			}
+			_, err := v.w.WriteAt(entry, root+int64(at))
+			return err
+		}
+	}
+	return fmt.Errorf("no room for a label in the root directory")
+}
+
+// setExFATSerial writes the serial number into the main and backup boot
+// regions and updates their checksum
+func (v *fsVolume) setExFATSerial(serial uint32) error {
+	sectorSize, _, _, err := v.exfatGeometry()
+	if err != nil {
+		return err
+	}
+	region := make([]byte, exfatBootSectors*sectorSize)
+	if _, err := v.r.ReadAt(region, 0); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(region[0x64:], serial)
+	checksum := exfatBootChecksum(region[:(exfatBootSectors-1)*sectorSize])
+	sums := region[(exfatBootSectors-1)*sectorSize:]
+	for i := 0; i+4 <= len(sums); i += 4 {
+		binary.LittleEndian.PutUint32(sums[i:], checksum)
+	}
+	for _, offset := range []int64{0, exfatBootSectors * sectorSize} {
+		if _, err := v.w.WriteAt(region[:sectorSize], offset); err != nil {
+			return err
+		}
+		if _, err := v.w.WriteAt(sums, offset+(exfatBootSectors-1)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exfatBootChecksum sums the boot region without the volume flags and the
+// percentage in use, which change without it being updated
+func exfatBootChecksum(region []byte) uint32 {
+	var sum uint32
+	for i, b := range region {
+		if i == 106 || i == 107 || i == 112 {
+			continue
+		}
+		sum = (sum<<31 | sum>>1) + uint32(b)
+	}
+	return sum
+}
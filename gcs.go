@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Google Cloud Storage outputs are given as gs://bucket/object. The access
+// token is taken from GOOGLE_OAUTH_ACCESS_TOKEN, e.g. from gcloud auth
+// print-access-token, or obtained with the service account key file in
+// GOOGLE_APPLICATION_CREDENTIALS. STORAGE_EMULATOR_HOST points to an
+// emulator, which needs no credentials.
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsLimits keep the chunks of resumable uploads, which have no limit on
+// their number, to what is sensible to hold in memory
+var gcsLimits = cloudLimits{maxPartSize: 256 * mb}
+
+// gcsAccessToken returns an OAuth access token for Cloud Storage
+func gcsAccessToken() (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return "", fmt.Errorf("set GOOGLE_OAUTH_ACCESS_TOKEN or GOOGLE_APPLICATION_CREDENTIALS for gs:// outputs")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	if account.Type != "service_account" {
+		return "", fmt.Errorf("%s is a %q credential, only service account keys are supported", path, account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("%s has no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parsing the private key in %s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("the private key in %s is not an RSA key", path)
+	}
+
+	// A self-signed JWT is exchanged for an access token
+	now := time.Now().Unix()
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]interface{}{
+		"iss": account.ClientEmail, "scope": gcsScope, "aud": account.TokenURI, "iat": now, "exp": now + 3600,
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequest(http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, _, err := cloudDo(req)
+	if err != nil {
+		return "", fmt.Errorf("getting an access token for %s: %v", account.ClientEmail, err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("no access token in the response for %s", account.ClientEmail)
+	}
+	return token.AccessToken, nil
+}
+
+// gcsUpload is a resumable upload. Its chunks must go in order, the session
+// URI authorises them so the token is only needed to start it.
+type gcsUpload struct {
+	endpoint  string
+	token     string
+	bucket    string
+	object    string
+	kmsKey    string
+	session   string
+	offset    int64
+	finalized bool
+}
+
+func (u *gcsUpload) uploadURL(uploadType string) string {
+	query := url.Values{"uploadType": {uploadType}, "name": {u.object}}
+	if u.kmsKey != "" {
+		query.Set("kmsKeyName", u.kmsKey)
+	}
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", u.endpoint, url.PathEscape(u.bucket), query.Encode())
+}
+
+func (u *gcsUpload) request(method, target string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	return req, nil
+}
+
+func (u *gcsUpload) begin() error {
+	req, err := u.request(http.MethodPost, u.uploadURL("resumable"), nil)
+	if err != nil {
+		return err
+	}
+	_, header, err := cloudDo(req)
+	if err != nil {
+		return err
+	}
+	if u.session = header.Get("Location"); u.session == "" {
+		return fmt.Errorf("no session URI in the response to starting the upload")
+	}
+	return nil
+}
+
+// put sends a chunk of the upload. Chunks before the last one are answered
+// with 308 Resume Incomplete.
+func (u *gcsUpload) put(data []byte, total string) error {
+	req, err := u.request(http.MethodPut, u.session, data)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", u.offset, u.offset+int64(len(data))-1, total))
+	} else {
+		req.Header.Set("Content-Range", "bytes */"+total)
+	}
+	_, _, err = cloudDo(req)
+	var httpErr *cloudHTTPError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusPermanentRedirect && total == "*" {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	u.offset += int64(len(data))
+	return nil
+}
+
+func (u *gcsUpload) uploadPart(number int, data []byte) error {
+	return u.put(data, "*")
+}
+
+// uploadLastPart sends the final chunk with the total size, which finalizes
+// the upload, chunks before it have to be multiples of 256 KiB
+func (u *gcsUpload) uploadLastPart(number int, data []byte) error {
+	if err := u.put(data, fmt.Sprint(u.offset+int64(len(data)))); err != nil {
+		return err
+	}
+	u.finalized = true
+	return nil
+}
+
+// complete finalizes an upload whose size was a whole number of chunks
+func (u *gcsUpload) complete() error {
+	if u.finalized {
+		return nil
+	}
+	return u.put(nil, fmt.Sprint(u.offset))
+}
+
+func (u *gcsUpload) abort() error {
+	req, err := u.request(http.MethodDelete, u.session, nil)
+	if err != nil {
+		return err
+	}
+	// A cancelled upload is answered with 499
+	_, _, err = cloudDo(req)
+	var httpErr *cloudHTTPError
+	if errors.As(err, &httpErr) && httpErr.Status == 499 {
+		return nil
+	}
+	return err
+}
+
+func (u *gcsUpload) putObject(data []byte) error {
+	req, err := u.request(http.MethodPost, u.uploadURL("media"), data)
+	if err != nil {
+		return err
+	}
+	_, _, err = cloudDo(req)
+	return err
+}
+
+// newGCSOutput streams to an object given as gs://bucket/object
+func newGCSOutput(target string, options outputOptions) (io.WriteCloser, error) {
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(target, "gs://"), "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("%s is not a valid Cloud Storage URL, use gs://bucket/object", target)
+	}
+	if options.SSE != "" {
+		return nil, fmt.Errorf("Cloud Storage always encrypts, use --sse-kms-key for a customer managed key")
+	}
+
+	upload := &gcsUpload{endpoint: "https://storage.googleapis.com", bucket: bucket, object: object, kmsKey: options.SSEKMSKey}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		upload.endpoint = strings.TrimSuffix(host, "/")
+		if !strings.Contains(host, "://") {
+			upload.endpoint = "http://" + upload.endpoint
+		}
+	} else {
+		token, err := gcsAccessToken()
+		if err != nil {
+			return nil, err
+		}
+		upload.token = token
+	}
+	return newCloudWriter(target, upload, 1, gcsLimits, options), nil
+}
@@ -5,11 +5,27 @@ go 1.21
 toolchain go1.22.5
 
 require (
+	filippo.io/age v1.2.1
 	github.com/dsnet/compress v0.0.1
+	github.com/gdamore/tcell/v2 v2.8.1
 	github.com/gosuri/uilive v0.0.4
+	github.com/hanwen/go-fuse/v2 v2.9.0
 	github.com/jawher/mow.cli v1.2.0
 	github.com/klauspost/compress v1.17.11
-	golang.org/x/sys v0.28.0
+	github.com/mattn/go-runewidth v0.0.16
+	github.com/pierrec/lz4/v4 v4.1.22
+	github.com/ulikunitz/xz v0.5.15
+	github.com/zeebo/blake3 v0.2.4
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
 )
 
-require github.com/mattn/go-isatty v0.0.20 // indirect
+require (
+	github.com/gdamore/encoding v1.0.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
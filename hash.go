@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+// hashAlgorithms are the algorithms hash accepts
+var hashAlgorithms = []string{"sha256", "sha512", "blake3", "sha1", "md5"}
+
+// newHash returns a hasher for one of the hashAlgorithms
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake3":
+		return blake3.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q, use one of %s", algorithm, strings.Join(hashAlgorithms, ", "))
+}
+
+var hashRecordHeaders = []string{"device", "algorithm", "offset_bytes", "length_bytes", "hash"}
+
+// hashDevice streams a device, a partition given as DEVICE:N, or a range of
+// either through one or more comma separated hashes in a single read and
+// prints the sums. The progress goes to stderr so the sums can be piped.
+func hashDevice(spec, algorithms, offset, length, format string) error {
+	names := strings.Split(algorithms, ",")
+	hashes := make([]hash.Hash, len(names))
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		h, err := newHash(names[i])
+		if err != nil {
+			return err
+		}
+		hashes[i] = h
+	}
+	image, section, err := openPartitionSpec(spec)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	// Offsets count from the start of the partition, percentages of its size
+	start, size := int64(0), section.Size()
+	if offset != "" {
+		if start, err = parseSize(offset, int64(image.SectorSize), section.Size()); err != nil {
+			return fmt.Errorf("invalid offset: %v", err)
+		}
+		if start > section.Size() {
+			return fmt.Errorf("the offset %d is past the end of %s (%d bytes)", start, spec, section.Size())
+		}
+		size -= start
+	}
+	if length != "" {
+		n, err := parseSize(length, int64(image.SectorSize), section.Size())
+		if err != nil {
+			return fmt.Errorf("invalid length: %v", err)
+		}
+		if n > size {
+			return fmt.Errorf("the length %d goes past the end of %s", n, spec)
+		}
+		size = n
+	}
+
+	tuning, err := tuneIO(image.File, image.Path, image.Size, image.SectorSize, ioTuning{})
+	if err != nil {
+		return err
+	}
+
+	listenForPauseTo(os.Stderr)
+	// The hashes are the output, progress goes to stderr
+	display := startProgressDisplay("", os.Stderr)
+
+	var hashed int64
+	begin := time.Now()
+	err = readChunks(io.NewSectionReader(section, start, size), size, tuning, func(chunk []byte, _ int64) error {
+		// Several hashes work on the chunk at the same time
+		var wg sync.WaitGroup
+		for _, h := range hashes {
+			wg.Add(1)
+			go func(h hash.Hash) {
+				defer wg.Done()
+				h.Write(chunk)
+			}(h)
+		}
+		wg.Wait()
+		hashed += int64(len(chunk))
+		reportProgress("hashing", hashed, size)
+		begin = begin.Add(pausePoint(display.Bypass(), nil))
+		return nil
+	})
+	display.stop()
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(begin)
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Hashed %s in %s (%.2f MB/s)\n", formatBytes(hashed), elapsed.Truncate(time.Second), float64(hashed)/mb/elapsed.Seconds())
+	}
+
+	var records [][]string
+	for i, h := range hashes {
+		sum := hex.EncodeToString(h.Sum(nil))
+		switch {
+		case format != "text":
+			records = append(records, []string{spec, names[i], strconv.FormatInt(start, 10), strconv.FormatInt(size, 10), sum})
+		case len(hashes) == 1:
+			// The layout of sha256sum and b3sum
+			fmt.Printf("%s  %s\n", sum, spec)
+		default:
+			// The layout of sha256sum --tag, which names the algorithm
+			fmt.Printf("%s (%s) = %s\n", strings.ToUpper(names[i]), spec, sum)
+		}
+	}
+	if format == "text" {
+		return nil
+	}
+	return writeRecords(os.Stdout, format, hashRecordHeaders, records)
+}
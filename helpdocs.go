@@ -0,0 +1,711 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The long form guidance lives in the binary, so it is there on a rescue
+// system without the README or network. Each topic is shown by
+// dsktool help TOPIC, in the --help of its commands and in the man page.
+
+// helpTopic is a page of guidance on one area, in every language it has
+type helpTopic struct {
+	Name     string
+	Commands []string          // commands whose --help shows the topic
+	Title    map[string]string // by language, "en" is always there
+	Text     map[string]string
+}
+
+// helpLanguages are the languages the topics and the man page come in
+var helpLanguages = []string{"en", "de"}
+
+var helpTopics = []helpTopic{
+	{
+		Name:     "imaging",
+		Commands: []string{"image", "image-recv", "manifest"},
+		Title: map[string]string{
+			"en": "Imaging disks",
+			"de": "Abbilder von Datenträgern",
+		},
+		Text: map[string]string{
+			"en": `image DEVICE FILE reads the whole disk into a compressed stream, gzip
+unless --compress picks bzip2, zip, snappy, s2, zlib, zstd, xz or lz4. The
+extension of the compression is added to FILE.
+
+--smart reads only the blocks the ext, FAT and NTFS filesystems use and
+writes FILE.blockmap with the ranges the image holds. The commands that read
+images rebuild the full disk from it.
+
+--partition N images only partition N and records where it was in
+FILE.blockmap, clone FILE DISK writes it back into the same partition.
+
+--skip-zeros leaves 1 MiB regions of zeros out of the image and lists the
+ranges it holds in FILE.blockmap, restoring it writes the zeros back.
+
+--rescue reads around bad sectors, retrying them --read-retries times,
+fills the unreadable ones with --fill and lists them in FILE.rescuemap, a
+ddrescue mapfile.
+
+--limit 50M reads at most 50 MB a second, so imaging a disk in use leaves
+it to the rest of the system.
+
+Local gzip, bzip2, snappy, s2, zstd, xz and lz4 images are checkpointed
+every 512 MB to FILE.state. If imaging stops, the same command with --resume
+continues from the last checkpoint.
+
+An existing image is only replaced with --overwrite, which removes its
+sidecars too, --unique writes to FILE-1, FILE-2 and so on instead. Images
+are not written to the disk being imaged, and imaging warns when the
+destination has less free space than the data to read.
+
+When imaging finishes FILE.manifest.json records the disk, its partition
+table and filesystems, the compression, the hash of the imaged data and how
+long it took. manifest FILE prints it, --json as written.
+
+--estimate N compresses N samples first, shows the expected size, time and
+free space and asks before imaging. --format qcow2 writes a sparse qcow2
+file for QEMU instead of a compressed stream, vhd and vhdx write dynamic
+images for Hyper-V, vhd-fixed and vhdx-fixed fixed ones.
+
+--level N sets the compression level, --zstd-window and --gzip-strategy
+tune zstd and the deflate methods. --auto compresses samples with each
+method and uses the one with the best trade of size and speed.
+
+--encrypt passphrase or --encrypt age1... encrypts the image as an age file.
+The passphrase comes from DSKTOOL_PASSPHRASE or the terminal, images for an
+age recipient are read with --identity KEYFILE.
+
+FILE can be an s3://, azure:// or gs:// URL, ssh://user@host:/path to write
+through ssh, or tcp://host:port/name for a dsktool image-recv on that host.`,
+			"de": `image GERÄT DATEI liest den ganzen Datenträger in einen komprimierten
+Strom, gzip, sofern --compress nicht bzip2, zip, snappy, s2, zlib, zstd, xz
+oder lz4 wählt. Die Endung der Kompression wird an DATEI angehängt.
+
+--smart liest nur die Blöcke, die ext-, FAT- und NTFS-Dateisysteme belegen,
+und schreibt DATEI.blockmap mit den Bereichen des Abbilds. Die Befehle, die
+Abbilder lesen, setzen daraus den ganzen Datenträger wieder zusammen.
+
+--partition N bildet nur Partition N ab und vermerkt ihre Lage in
+DATEI.blockmap, clone DATEI GERÄT schreibt sie in dieselbe Partition zurück.
+
+--skip-zeros lässt Bereiche von 1 MiB, die nur Nullen enthalten, im Abbild
+aus und führt die enthaltenen Bereiche in DATEI.blockmap, beim
+Wiederherstellen werden die Nullen zurückgeschrieben.
+
+--rescue liest um defekte Sektoren herum, versucht sie --read-retries Mal
+erneut, füllt die unlesbaren mit --fill und führt sie in DATEI.rescuemap,
+einer ddrescue-Mapdatei.
+
+--limit 50M liest höchstens 50 MB pro Sekunde, damit ein Datenträger im
+Betrieb beim Abbilden dem übrigen System erhalten bleibt.
+
+Lokale gzip-, bzip2-, snappy-, s2-, zstd-, xz- und lz4-Abbilder erhalten alle
+512 MB einen Sicherungspunkt in DATEI.state. Bricht das Abbilden ab, setzt
+derselbe Befehl mit --resume am letzten Sicherungspunkt fort.
+
+Ein vorhandenes Abbild wird nur mit --overwrite ersetzt, das auch seine
+Begleitdateien entfernt, --unique schreibt stattdessen nach DATEI-1, DATEI-2
+und so weiter. Abbilder werden nicht auf den abgebildeten Datenträger
+geschrieben, und es wird gewarnt, wenn das Ziel weniger freien Platz hat,
+als Daten zu lesen sind.
+
+Nach dem Abbilden hält DATEI.manifest.json den Datenträger, seine
+Partitionstabelle und Dateisysteme, die Kompression, die Prüfsumme der
+gelesenen Daten und die Dauer fest. manifest DATEI zeigt es an, mit --json
+so, wie es geschrieben wurde.
+
+--estimate N komprimiert zuerst N Stichproben, zeigt die erwartete Größe,
+Dauer und den freien Platz und fragt vor dem Abbilden nach. --format qcow2
+schreibt statt eines komprimierten Stroms eine dünn belegte qcow2-Datei für
+QEMU, vhd und vhdx schreiben dynamische Abbilder für Hyper-V, vhd-fixed und
+vhdx-fixed feste.
+
+--level N setzt die Kompressionsstufe, --zstd-window und --gzip-strategy
+stimmen zstd und die Deflate-Verfahren ab. --auto komprimiert Stichproben
+mit jedem Verfahren und wählt das mit dem besten Verhältnis von Größe und
+Geschwindigkeit.
+
+--encrypt passphrase oder --encrypt age1... verschlüsselt das Abbild als
+age-Datei. Die Passphrase kommt aus DSKTOOL_PASSPHRASE oder vom Terminal,
+Abbilder für einen age-Empfänger werden mit --identity SCHLÜSSELDATEI
+gelesen.
+
+DATEI kann eine s3://-, azure://- oder gs://-URL sein, ssh://user@host:/pfad
+zum Schreiben über ssh oder tcp://host:port/name für ein dsktool image-recv
+auf diesem Rechner.`,
+		},
+	},
+	{
+		Name:     "verifying",
+		Commands: []string{"verify", "hash", "scrub"},
+		Title: map[string]string{
+			"en": "Verifying and hashing",
+			"de": "Prüfen und Prüfsummen",
+		},
+		Text: map[string]string{
+			"en": `verify IMAGE DEVICE decompresses an image on the fly and compares it with
+a disk, listing the ranges that differ.
+
+hash DEVICE prints the sums of a disk, of a partition given as DEVICE:N or of
+a range of either without making an image. --algo takes several algorithms
+separated by commas, like sha256,md5, which are computed in the same read.
+
+scrub DEVICE --map FILE hashes the disk in chunks. The first run writes the
+hashes to FILE, later runs report the chunks that changed since, which finds
+silent corruption. --update accepts the changes.`,
+			"de": `verify ABBILD GERÄT entpackt ein Abbild während des Lesens und vergleicht
+es mit einem Datenträger. Abweichende Bereiche werden aufgelistet.
+
+hash GERÄT gibt die Prüfsummen eines Datenträgers, einer als GERÄT:N
+angegebenen Partition oder eines Bereichs davon aus, ohne ein Abbild
+anzulegen. --algo nimmt mehrere durch Kommas getrennte Verfahren wie
+sha256,md5, die im selben Lesevorgang berechnet werden.
+
+scrub GERÄT --map DATEI bildet Prüfsummen über Blöcke des Datenträgers. Der
+erste Lauf schreibt sie in DATEI, spätere Läufe melden die seither
+veränderten Blöcke und finden so stille Datenfehler. --update übernimmt die
+Änderungen.`,
+		},
+	},
+	{
+		Name:     "wiping",
+		Commands: []string{"wipe", "verify-wipe", "secure-erase"},
+		Title: map[string]string{
+			"en": "Wiping disks",
+			"de": "Datenträger löschen",
+		},
+		Text: map[string]string{
+			"en": `wipe DEVICE overwrites a disk, or partition N given as DEVICE:N, with
+zeros. --pattern random writes random data, --pattern dod the three passes of
+DoD 5220.22-M: zeros, ones and random data.
+
+The device path has to be typed before anything is overwritten, scripts pass
+it as --confirm DEVICE instead. --verify reads the device back after the last
+pass and stops at the first byte that differs. --sample PERCENT reads back
+only that share, in 1 MiB samples at random places plus the start and end.
+
+--certificate NAME writes NAME.json and NAME.pdf with the device serial, the
+wiped area, the passes, the times and the verification, signed off by
+--operator. The random data comes from a seed the certificate records, so
+verify-wipe NAME.json can check its signature and sample the disk again later.
+Certificates are signed with an ed25519 key created in the configuration
+directory on first use, or the key file DSKTOOL_SIGNING_KEY names.
+verify-wipe --public-key KEY checks that it was signed with that key.
+
+secure-erase DEVICE has the drive erase itself instead, with the ATA security
+erase or the NVMe format and sanitize commands. This also erases the spare
+areas software cannot reach, and self encrypting drives are done in seconds.
+--info shows the supported methods, the drive's time estimate and anything
+that blocks the erase. ATA drives the BIOS froze at boot are usually unfrozen
+by suspending and resuming. An erase cannot be stopped once it runs, and an
+ATA drive that loses power during it stays locked with the password dsktool,
+which hdparm --user-master u --security-disable dsktool removes.`,
+			"de": `wipe GERÄT überschreibt einen Datenträger oder eine als GERÄT:N
+angegebene Partition mit Nullen. --pattern random schreibt Zufallsdaten,
+--pattern dod die drei Durchgänge nach DoD 5220.22-M: Nullen, Einsen und
+Zufallsdaten.
+
+Vor dem Überschreiben muss der Gerätepfad eingetippt werden, Skripte geben
+ihn stattdessen als --confirm GERÄT an. --verify liest das Gerät nach dem
+letzten Durchgang zurück und hält beim ersten abweichenden Byte an.
+--sample PROZENT liest nur diesen Anteil zurück, in Stichproben von 1 MiB an
+zufälligen Stellen sowie am Anfang und Ende.
+
+--certificate NAME schreibt NAME.json und NAME.pdf mit der Seriennummer, dem
+gelöschten Bereich, den Durchgängen, den Zeiten und der Prüfung, mit
+--operator unterzeichnet. Die Zufallsdaten entstehen aus einem Startwert,
+den das Zertifikat festhält, daher kann verify-wipe NAME.json später seine
+Signatur kontrollieren und den Datenträger erneut stichprobenartig prüfen.
+Zertifikate werden mit einem ed25519-Schlüssel signiert, der beim ersten
+Gebrauch im Konfigurationsverzeichnis angelegt wird, oder mit der
+Schlüsseldatei aus DSKTOOL_SIGNING_KEY. verify-wipe --public-key SCHLÜSSEL
+prüft, dass es mit diesem Schlüssel signiert wurde.
+
+secure-erase GERÄT lässt stattdessen das Laufwerk sich selbst löschen, mit
+dem ATA Security Erase oder den NVMe-Befehlen Format und Sanitize. Das
+erreicht auch die Reservebereiche, an die Software nicht herankommt, und
+selbstverschlüsselnde Laufwerke sind in Sekunden fertig. --info zeigt die
+unterstützten Verfahren, die Zeitschätzung des Laufwerks und was das Löschen
+verhindert. ATA-Laufwerke, die das BIOS beim Start eingefroren hat, werden
+meist durch Suspend und Aufwecken wieder frei. Ein laufendes Löschen lässt
+sich nicht abbrechen, und ein ATA-Laufwerk, das dabei den Strom verliert,
+bleibt mit dem Passwort dsktool gesperrt, das hdparm --user-master u
+--security-disable dsktool entfernt.`,
+		},
+	},
+	{
+		Name:     "discard",
+		Commands: []string{"discard"},
+		Title: map[string]string{
+			"en": "Discarding blocks",
+			"de": "Blöcke verwerfen",
+		},
+		Text: map[string]string{
+			"en": `discard DEVICE tells an SSD or a thin provisioned volume that a disk, a
+partition given as DEVICE:N, or the range of --offset and --length holds no
+data, so it can reuse the space. Offsets count from the start of the
+partition and take sizes like 1M, 2048s or 50%. On image files it punches
+holes, which frees their space.
+
+--secure asks the device to erase the blocks as well, which few devices
+support. Like wipe, discard asks for the device path to be typed first.`,
+			"de": `discard GERÄT teilt einer SSD oder einem Thin-Provisioning-Volume mit, dass
+ein Datenträger, eine als GERÄT:N angegebene Partition oder der Bereich aus
+--offset und --length keine Daten enthält, damit der Platz wiederverwendet
+werden kann. Offsets zählen ab dem Anfang der Partition und nehmen Größen wie
+1M, 2048s oder 50%. In Abbilddateien werden Löcher gestanzt, was ihren Platz
+freigibt.
+
+--secure lässt das Gerät die Blöcke zusätzlich löschen, was nur wenige
+Geräte können. Wie wipe verlangt discard vorher den Gerätepfad.`,
+		},
+	},
+	{
+		Name:     "bootloader",
+		Commands: []string{"write-bootloader"},
+		Title: map[string]string{
+			"en": "Writing bootloaders",
+			"de": "Bootloader schreiben",
+		},
+		Text: map[string]string{
+			"en": `Single board computers boot from a bootloader at a fixed offset of the SD
+card or eMMC, like U-Boot with its SPL at 8K on Allwinner or at 32K on
+Rockchip. write-bootloader --offset OFFSET FILE DEVICE writes it there
+instead of dd, and refuses when it would overwrite the MBR partition table,
+the GPT headers and entries or a partition, or run past the end of the disk.
+
+A GPT keeps its entries at 1K to 17K, where the 8K of Allwinner go. Move the
+entries behind the bootloader first, e.g. with sgdisk -j 2048. The written
+data is read back and compared.`,
+			"de": `Einplatinencomputer starten von einem Bootloader an einem festen Offset der
+SD-Karte oder des eMMC, etwa U-Boot mit seinem SPL bei 8K auf Allwinner oder
+bei 32K auf Rockchip. write-bootloader --offset OFFSET DATEI GERÄT schreibt
+ihn dorthin statt dd und lehnt ab, wenn er die MBR-Partitionstabelle, die
+GPT-Header und -Einträge oder eine Partition überschreiben oder über das Ende
+des Datenträgers hinausgehen würde.
+
+Eine GPT hält ihre Einträge bei 1K bis 17K, wo die 8K von Allwinner liegen.
+Die Einträge vorher hinter den Bootloader verschieben, etwa mit
+sgdisk -j 2048. Die geschriebenen Daten werden zurückgelesen und verglichen.`,
+		},
+	},
+	{
+		Name:     "wsl",
+		Commands: []string{"wsl disks"},
+		Title: map[string]string{
+			"en": "Disks inside WSL",
+			"de": "Datenträger unter WSL",
+		},
+		Text: map[string]string{
+			"en": `WSL 1 gives no access to disks, run dsktool.exe on Windows or convert the
+distribution with wsl --set-version DISTRO 2.
+
+Inside WSL 2 the /dev/sd* disks are the virtual disks of WSL itself, the
+system distribution, swap and the ext4.vhdx of each distribution, and
+Windows disks attached from an administrator PowerShell with
+wsl --mount \\.\PHYSICALDRIVEn --bare. wsl disks lists them with the
+Windows drive each attached disk is. Writing to a virtual disk WSL is
+using is refused, and so is secure-erase, whose commands do not pass
+through wsl --mount.`,
+			"de": `WSL 1 bietet keinen Zugriff auf Datenträger, dsktool.exe unter Windows
+ausführen oder die Distribution mit wsl --set-version DISTRO 2 umstellen.
+
+Unter WSL 2 sind die /dev/sd*-Datenträger die virtuellen Datenträger von
+WSL selbst, die Systemdistribution, Swap und die ext4.vhdx jeder
+Distribution, sowie Windows-Datenträger, die in einer Administrator-
+PowerShell mit wsl --mount \\.\PHYSICALDRIVEn --bare eingebunden wurden.
+wsl disks listet sie mit dem Windows-Laufwerk jedes eingebundenen
+Datenträgers. Schreiben auf einen virtuellen Datenträger, den WSL nutzt,
+wird abgelehnt, ebenso secure-erase, dessen Befehle nicht durch
+wsl --mount gelangen.`,
+		},
+	},
+	{
+		Name: "devices",
+		Title: map[string]string{
+			"en": "Naming devices",
+			"de": "Geräte angeben",
+		},
+		Text: map[string]string{
+			"en": `A device is a path like /dev/sdb or \\.\PhysicalDrive1, or an image file.
+Commands that read images also take http(s) URLs and compressed images.
+DEVICE:N names partition N of a disk or image.
+
+Instead of a path that changes when disks are added, a device can be given
+by serial:WD-XYZ, wwn:0x5000c500a1b2c3d4, gpt: and the disk GUID, or
+label:BACKUP for the disk or partition whose filesystem has the label. It is
+an error if no device or more than one matches.`,
+			"de": `Ein Gerät ist ein Pfad wie /dev/sdb oder \\.\PhysicalDrive1 oder eine
+Abbilddatei. Befehle, die Abbilder lesen, nehmen auch http(s)-URLs und
+komprimierte Abbilder. GERÄT:N bezeichnet Partition N eines Datenträgers
+oder Abbilds.
+
+Statt eines Pfads, der sich beim Hinzufügen von Datenträgern ändert, kann
+ein Gerät mit serial:WD-XYZ, wwn:0x5000c500a1b2c3d4, gpt: und der GUID des
+Datenträgers oder label:BACKUP für den Datenträger oder die Partition mit
+dieser Dateisystembezeichnung angegeben werden. Passt kein oder mehr als ein
+Gerät, ist das ein Fehler.`,
+		},
+	},
+	{
+		Name: "automation",
+		Title: map[string]string{
+			"en": "Scripts and automation",
+			"de": "Skripte und Automatisierung",
+		},
+		Text: map[string]string{
+			"en": `--dry-run shows what destructive commands would write without writing.
+
+Before writing to a device or benchmarking a disk, dsktool watches its I/O
+counters for a second. A disk other processes keep busy, like one hosting a
+live database, is refused, light activity only warns. --allow-busy goes on
+anyway.
+
+--on-complete and --on-error run a shell command when a command finishes,
+with DSKTOOL_EVENT, DSKTOOL_COMMAND, DSKTOOL_ARGS, DSKTOOL_STATUS,
+DSKTOOL_ERROR, DSKTOOL_DURATION, DSKTOOL_DRY_RUN and DSKTOOL_WARNINGS in its
+environment. hooks.json in the config directory sets them for every run.
+
+Warnings carry a stable code, like gpt-primary-damaged, partition-misaligned,
+unreadable-region, size-mismatch, low-free-space or device-busy. With
+--format json they go to stderr as {"warning": {...}} lines, and they are
+kept in the state file, the --progress json events, the session file, the
+image manifest and, as a comma separated list of codes, DSKTOOL_WARNINGS.
+
+--state-file FILE keeps a JSON file with the phase, progress, rate, errors
+and finally the exit status of long operations up to date.
+
+--progress json writes the progress of long operations as JSON lines to
+stderr instead of the terminal display, or to the file or named pipe of
+--progress-to.
+
+--metrics :9101 serves the phase, progress, rate, errors, warnings and
+finally the exit status for Prometheus on /metrics while the command runs,
+--metrics FILE.prom writes them to a file for the textfile collector of the
+node exporter instead.
+
+--quiet leaves out progress and messages, image, clone, part clone and hash
+print only the hash and path of what they wrote, the exit status tells
+whether the command worked. Errors still go to stderr.
+
+--record FILE adds every command, the partition tables of its disks before
+and after and how it ended to a session file, dsktool replay FILE shows it.
+
+Imaging, wiping and scanning pause and resume with Enter, or with
+kill -USR1 on Linux.`,
+			"de": `--dry-run zeigt, was zerstörende Befehle schreiben würden, ohne zu
+schreiben.
+
+Vor dem Schreiben auf ein Gerät oder dem Benchmark eines Datenträgers
+beobachtet dsktool eine Sekunde lang seine I/O-Zähler. Ein Datenträger, den
+andere Prozesse auslasten, etwa einer mit einer laufenden Datenbank, wird
+abgelehnt, leichte Aktivität erzeugt nur eine Warnung. --allow-busy macht
+trotzdem weiter.
+
+--on-complete und --on-error führen einen Shell-Befehl aus, wenn ein Befehl
+endet, mit DSKTOOL_EVENT, DSKTOOL_COMMAND, DSKTOOL_ARGS, DSKTOOL_STATUS,
+DSKTOOL_ERROR, DSKTOOL_DURATION, DSKTOOL_DRY_RUN und DSKTOOL_WARNINGS in
+seiner Umgebung. hooks.json im Konfigurationsverzeichnis setzt sie für jeden
+Lauf.
+
+Warnungen tragen einen festen Code, etwa gpt-primary-damaged,
+partition-misaligned, unreadable-region, size-mismatch, low-free-space oder
+device-busy. Mit --format json gehen sie als {"warning": {...}}-Zeilen auf
+stderr, und sie stehen in der Statusdatei, den --progress-json-Ereignissen,
+der Sitzungsdatei, dem Image-Manifest und als kommagetrennte Liste der Codes
+in DSKTOOL_WARNINGS.
+
+--state-file DATEI hält eine JSON-Datei mit Phase, Fortschritt, Rate,
+Fehlern und schließlich dem Exit-Status langer Vorgänge aktuell.
+
+--progress json schreibt den Fortschritt langer Vorgänge statt der
+Terminalanzeige als JSON-Zeilen auf stderr, oder in die Datei oder benannte
+Pipe von --progress-to.
+
+--metrics :9101 stellt Phase, Fortschritt, Rate, Fehler, Warnungen und
+schließlich den Exit-Status für Prometheus unter /metrics bereit, solange
+der Befehl läuft, --metrics DATEI.prom schreibt sie stattdessen in eine
+Datei für den Textfile-Collector des Node Exporters.
+
+--quiet lässt Fortschritt und Meldungen weg, image, clone, part clone und
+hash geben nur Hash und Pfad des Geschriebenen aus, der Exit-Status sagt, ob
+der Befehl gelang. Fehler gehen weiter auf stderr.
+
+--record DATEI hängt jeden Befehl, die Partitionstabellen seiner Datenträger
+davor und danach und sein Ergebnis an eine Sitzungsdatei an, dsktool replay
+DATEI zeigt sie an.
+
+Abbilden, Löschen und Durchsuchen lassen sich mit Enter anhalten und
+fortsetzen, unter Linux auch mit kill -USR1.`,
+		},
+	},
+	{
+		Name: "rescue",
+		Title: map[string]string{
+			"en": "Rescue systems",
+			"de": "Rettungssysteme",
+		},
+		Text: map[string]string{
+			"en": `Building with -tags tiny leaves out the TUI and FUSE mounting for a small
+static binary to put in initramfs or PXE rescue images.
+
+All of this guidance is in the binary: dsktool help lists the topics,
+dsktool help TOPIC shows one and dsktool man writes the man page, so
+nothing needs to be looked up online.`,
+			"de": `Mit -tags tiny gebaut fehlen die TUI und das Einhängen über FUSE, und es
+entsteht ein kleines statisches Programm für initramfs- oder
+PXE-Rettungssysteme.
+
+Diese ganze Anleitung steckt im Programm: dsktool help listet die Themen,
+dsktool help THEMA zeigt eines davon und dsktool man schreibt die
+Handbuchseite, ohne dass etwas online nachgeschlagen werden muss.`,
+		},
+	},
+}
+
+// helpLanguage picks the language of the help, the given one or the locale
+// of the environment, English if there is no text in it
+func helpLanguage(lang string) string {
+	for _, value := range []string{lang, os.Getenv("DSKTOOL_LANG"), os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG")} {
+		if value == "" {
+			continue
+		}
+		value = strings.ToLower(value)
+		if i := strings.IndexAny(value, "_.@-"); i >= 0 {
+			value = value[:i]
+		}
+		for _, known := range helpLanguages {
+			if value == known {
+				return value
+			}
+		}
+		return "en"
+	}
+	return "en"
+}
+
+// localized returns the text in the language, English if it has none
+func localized(texts map[string]string, lang string) string {
+	if text, ok := texts[lang]; ok {
+		return text
+	}
+	return texts["en"]
+}
+
+// findHelpTopic returns the topic with the name
+func findHelpTopic(name string) (*helpTopic, error) {
+	var names []string
+	for i := range helpTopics {
+		if helpTopics[i].Name == name {
+			return &helpTopics[i], nil
+		}
+		names = append(names, helpTopics[i].Name)
+	}
+	return nil, fmt.Errorf("no help topic %q, there are %s", name, strings.Join(names, ", "))
+}
+
+// commandHelp is the long description --help shows for a command: its
+// summary and the topics that cover it
+func commandHelp(command, summary string) string {
+	parts := []string{summary}
+	lang := helpLanguage("")
+	for _, topic := range helpTopics {
+		for _, name := range topic.Commands {
+			if name == command {
+				parts = append(parts, localized(topic.Text, lang))
+			}
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// printHelpTopics prints a topic, or the list of topics if name is empty
+func printHelpTopics(w io.Writer, name, lang string) error {
+	lang = helpLanguage(lang)
+	if name == "" {
+		fmt.Fprintln(w, "Help topics, show one with dsktool help TOPIC:")
+		for _, topic := range helpTopics {
+			fmt.Fprintf(w, "  %-12s %s\n", topic.Name, localized(topic.Title, lang))
+		}
+		return nil
+	}
+	topic, err := findHelpTopic(name)
+	if err != nil {
+		return err
+	}
+	title := localized(topic.Title, lang)
+	fmt.Fprintf(w, "%s\n%s\n\n%s\n", title, strings.Repeat("=", len([]rune(title))), localized(topic.Text, lang))
+	return nil
+}
+
+// manHeadings are the section names of the man page by language
+var manHeadings = map[string]map[string]string{
+	"en": {"name": "NAME", "synopsis": "SYNOPSIS", "description": "DESCRIPTION", "options": "OPTIONS", "commands": "COMMANDS", "environment": "ENVIRONMENT"},
+	"de": {"name": "NAME", "synopsis": "ÜBERSICHT", "description": "BESCHREIBUNG", "options": "OPTIONEN", "commands": "BEFEHLE", "environment": "UMGEBUNG"},
+}
+
+// manDescription is the description of dsktool in the man page
+var manDescription = map[string]string{
+	"en": "dsktool lists, images, verifies, clones and wipes disks and edits their partition tables.",
+	"de": "dsktool listet, sichert, prüft, klont und löscht Datenträger und bearbeitet ihre Partitionstabellen.",
+}
+
+// manEnvironment lists the variables dsktool reads
+var manEnvironment = []struct {
+	Name string
+	Desc map[string]string
+}{
+	{"DSKTOOL_PASSPHRASE", map[string]string{
+		"en": "passphrase of encrypted images",
+		"de": "Passphrase verschlüsselter Abbilder",
+	}},
+	{"DSKTOOL_LANG", map[string]string{
+		"en": "language of the help and the man page, before LC_ALL, LC_MESSAGES and LANG",
+		"de": "Sprache der Hilfe und der Handbuchseite, vor LC_ALL, LC_MESSAGES und LANG",
+	}},
+	{"DSKTOOL_*", map[string]string{
+		"en": "set for --on-complete and --on-error commands, see dsktool help automation",
+		"de": "gesetzt für --on-complete- und --on-error-Befehle, siehe dsktool help automation",
+	}},
+}
+
+// roffEscape makes text safe for a roff paragraph
+func roffEscape(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\e`)
+	text = strings.ReplaceAll(text, "-", `\-`)
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			line = `\&` + line
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// roffParagraphs turns blank line separated paragraphs into roff
+func roffParagraphs(text string) string {
+	var out []string
+	for _, paragraph := range strings.Split(strings.TrimSpace(text), "\n\n") {
+		out = append(out, ".PP\n"+roffEscape(paragraph))
+	}
+	return strings.Join(out, "\n")
+}
+
+// commandHelpOutput runs this binary with --help after the command path in
+// the language and returns what it printed, mow.cli prints help to stderr
+// and exits
+func commandHelpOutput(lang string, path ...string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(self, append(path, "--help")...)
+	cmd.Env = append(os.Environ(), "DSKTOOL_LANG="+lang)
+	out, _ := cmd.CombinedOutput()
+	if len(out) == 0 {
+		return "", fmt.Errorf("no help for %s", strings.Join(path, " "))
+	}
+	// The columns are padded with spaces, also at the end of lines
+	lines := strings.Split(string(out), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// helpSection returns the lines of a section like Commands: in help output
+func helpSection(help, name string) []string {
+	var lines []string
+	in := false
+	for _, line := range strings.Split(help, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == name+":":
+			in = true
+		case !in:
+		case trimmed == "" || !strings.HasPrefix(line, "  "):
+			if len(lines) > 0 || trimmed != "" {
+				return lines
+			}
+		default:
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// subcommands parses the Commands: section of help output into the alias
+// list and the description of each command
+func subcommands(help string) [][2]string {
+	var commands [][2]string
+	for _, line := range helpSection(help, "Commands") {
+		names, desc, _ := strings.Cut(strings.TrimSpace(line), "  ")
+		commands = append(commands, [2]string{strings.TrimSpace(names), strings.TrimSpace(desc)})
+	}
+	return commands
+}
+
+// writeManPage writes the man page, built from the help of every command
+// and the help topics
+func writeManPage(w io.Writer, lang string) error {
+	lang = helpLanguage(lang)
+	headings := manHeadings[lang]
+
+	top, err := commandHelpOutput(lang)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, ".TH DSKTOOL 8 %q %q\n", time.Now().Format("2006-01-02"), "dsktool "+appversion)
+	fmt.Fprintf(w, ".SH %s\ndsktool \\- Earentir Disk Tools\n", headings["name"])
+	fmt.Fprintf(w, ".SH %s\n.B dsktool\n[OPTIONS] COMMAND [arg...]\n", headings["synopsis"])
+	fmt.Fprintf(w, ".SH %s\n", headings["description"])
+	fmt.Fprintln(w, roffParagraphs(localized(manDescription, lang)))
+
+	fmt.Fprintf(w, ".SH %s\n", headings["options"])
+	for _, line := range helpSection(top, "Options") {
+		names, desc, _ := strings.Cut(strings.TrimSpace(line), "  ")
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", roffEscape(strings.TrimSpace(names)), roffEscape(strings.TrimSpace(desc)))
+	}
+
+	fmt.Fprintf(w, ".SH %s\n", headings["commands"])
+	var walk func(path []string, help string) error
+	walk = func(path []string, help string) error {
+		for _, command := range subcommands(help) {
+			names := strings.Split(command[0], ", ")
+			sub := append(append([]string{}, path...), names[0])
+			usage, err := commandHelpOutput(lang, sub...)
+			if err != nil {
+				return err
+			}
+			title := strings.Join(append(append([]string{}, path...), command[0]), " ")
+			fmt.Fprintf(w, ".SS %s\n%s\n.PP\n.nf\n%s\n.fi\n", roffEscape(title), roffEscape(command[1]), roffEscape(strings.TrimSpace(usage)))
+			if err := walk(sub, usage); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(nil, top); err != nil {
+		return err
+	}
+
+	// The topics of commands are already in their help above
+	for _, topic := range helpTopics {
+		if len(topic.Commands) > 0 {
+			continue
+		}
+		fmt.Fprintf(w, ".SH %s\n%s\n", strings.ToUpper(roffEscape(localized(topic.Title, lang))), roffParagraphs(localized(topic.Text, lang)))
+	}
+
+	fmt.Fprintf(w, ".SH %s\n", headings["environment"])
+	for _, env := range manEnvironment {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", roffEscape(env.Name), roffEscape(localized(env.Desc, lang)))
+	}
+	return nil
+}
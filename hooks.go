@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+)
+
+const hooksFile = "hooks.json"
+
+// hookConfig holds the commands run when a dsktool command finishes. They
+// are run by the shell with the result described in DSKTOOL_* variables.
+type hookConfig struct {
+	OnComplete string `json:"on_complete,omitempty"`
+	OnError    string `json:"on_error,omitempty"`
+}
+
+var (
+	hooks     hookConfig
+	hookStart = time.Now()
+	hookRan   bool
+)
+
+// setupHooks loads the hooks from the config file and lets the command line
+// options override them
+func setupHooks(onComplete, onError string) error {
+	if err := loadConfigFile(hooksFile, &hooks); err != nil {
+		return fmt.Errorf("reading %s: %v", hooksFile, err)
+	}
+	if onComplete != "" {
+		hooks.OnComplete = onComplete
+	}
+	if onError != "" {
+		hooks.OnError = onError
+	}
+	return nil
+}
+
+// fatalf logs the error a command ends with and exits with status 1, after
+// offering elevation when access was refused, running the error hook and
+// ending the state file and the recording
+func fatalf(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	log.Print(message)
+	denied := isPermissionMessage(message)
+	for _, arg := range args {
+		if err, ok := arg.(error); ok && isPermissionError(err) {
+			denied = true
+		}
+	}
+	if denied {
+		offerElevation("dsktool " + hookCommand())
+	}
+	runHooks(1, errors.New(message))
+	os.Exit(1)
+}
+
+// appValueOptions are the app options that take a value, recorded as they
+// are declared so hookCommand can skip their values
+var appValueOptions = map[string]bool{}
+
+// appStringOpt declares an app option with a value
+func appStringOpt(app *cli.Cli, name, value, desc string) *string {
+	appValueOptions["--"+name] = true
+	return app.StringOpt(name, value, desc)
+}
+
+// appIntOpt declares an app option with a number
+func appIntOpt(app *cli.Cli, name string, value int, desc string) *int {
+	appValueOptions["--"+name] = true
+	return app.IntOpt(name, value, desc)
+}
+
+// hookCommand returns the dsktool command being run, skipping the app options
+func hookCommand() string {
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case appValueOptions[arg]:
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			return arg
+		}
+	}
+	return ""
+}
+
+// runHooks runs the hook for how the command ended, status is the exit status
+// and err why it failed. It runs at most once, failures of the hook are
+// reported but do not change the outcome.
+func runHooks(status int, err error) {
+	finishProgress(status, err)
+	finishRecording(status, err)
+
+	command := hooks.OnComplete
+	event := "complete"
+	if status != 0 || err != nil {
+		command, event = hooks.OnError, "error"
+	}
+	if command == "" || hookRan {
+		return
+	}
+	hookRan = true
+
+	cmd := shellCommand(command)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"DSKTOOL_EVENT="+event,
+		"DSKTOOL_COMMAND="+hookCommand(),
+		"DSKTOOL_ARGS="+strings.Join(os.Args[1:], " "),
+		fmt.Sprintf("DSKTOOL_STATUS=%d", status),
+		fmt.Sprintf("DSKTOOL_DURATION=%.0f", time.Since(hookStart).Seconds()),
+		fmt.Sprintf("DSKTOOL_DRY_RUN=%t", dryRun),
+		"DSKTOOL_VERSION="+appversion,
+		"DSKTOOL_WARNINGS="+strings.Join(warningCodes(), ","),
+	)
+	if err != nil {
+		cmd.Env = append(cmd.Env, "DSKTOOL_ERROR="+err.Error())
+	}
+	if runErr := cmd.Run(); runErr != nil {
+		fmt.Fprintf(os.Stderr, "%sThe %s hook failed: %v%s\n", red, event, runErr, reset)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// diskImage is a random access view of a device, a raw image or a decompressed image
+type diskImage struct {
+	*os.File
+	Path        string
+	Size        int64
+	SectorSize  uint64
+	Compression string
+	tempPath    string
+	mapped      *mappedReader
+}
+
+// imageOptions are the settings of imaging a disk
+type imageOptions struct {
+	Tuning ioTuning
+	// Smart images only the blocks filesystems use and writes a block map
+	Smart bool
+	// Resume continues an unfinished image from its last checkpoint
+	Resume bool
+	// Encrypt is "passphrase" or the age recipient the image is encrypted to
+	Encrypt string
+	// Estimate is how many samples to estimate the image size from first, 0 for none
+	Estimate int
+	// AssumeYes starts imaging after the estimate without asking
+	AssumeYes bool
+	// Partition images only this partition, 0 images the whole disk
+	Partition int
+	// Rescue reads around bad sectors, retrying each ReadRetries times and
+	// filling the unreadable ones with the Fill pattern
+	Rescue      bool
+	ReadRetries int
+	Fill        string
+	// SkipZeros leaves the regions that are all zeros out of the image
+	SkipZeros bool
+	// Compression tunes the compressor, AutoCompress picks the algorithm
+	// from samples of the device
+	Compression  compressionOptions
+	AutoCompress bool
+	// Output says what to do when the image file exists
+	Output outputPolicy
+}
+
+// openImage opens a device or image file for random access. Compressed images
+// and images given as http(s) URLs are copied into a temporary file first
+// since they cannot be seeked, smart images are rebuilt there from their
+// block map.
+func openImage(path string, writable bool) (*diskImage, error) {
+	reader, algorithm, err := openDecompressionReader(path)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := readBlockMap(path)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	if algorithm == "" && !isURL(path) && blocks == nil {
+		reader.Close()
+
+		flag := os.O_RDONLY
+		if writable {
+			flag = os.O_RDWR
+		}
+		file, err := os.OpenFile(path, flag, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := getFileSize(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		return &diskImage{
+			File:       file,
+			Path:       path,
+			Size:       size,
+			SectorSize: uint64(getSectorSize(file)),
+		}, nil
+	}
+	defer reader.Close()
+
+	if writable && algorithm == "" {
+		return nil, fmt.Errorf("%s is a download and cannot be opened for writing", path)
+	}
+	if writable && blocks != nil {
+		return nil, fmt.Errorf("%s is a smart image and cannot be opened for writing", path)
+	}
+	if writable {
+		return nil, fmt.Errorf("%s is a %s compressed image and cannot be opened for writing", path, algorithm)
+	}
+
+	temp, err := os.CreateTemp("", "dsktool-image-*.raw")
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	switch {
+	case blocks != nil:
+		// The unused blocks stay holes in the temporary file
+		fmt.Printf("Rebuilding %s from its block map in %s\n", path, temp.Name())
+		err = temp.Truncate(blocks.Size)
+		buf := make([]byte, 4*mb)
+		for _, r := range blocks.Ranges {
+			if err != nil {
+				break
+			}
+			var n int64
+			n, err = io.CopyBuffer(io.NewOffsetWriter(temp, r.Start), io.LimitReader(reader, r.End-r.Start), buf)
+			if err == nil && n < r.End-r.Start {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		size = blocks.Size
+	case algorithm == "":
+		fmt.Printf("Downloading %s to %s\n", path, temp.Name())
+		size, err = io.CopyBuffer(temp, reader, make([]byte, 4*mb))
+	default:
+		fmt.Printf("Decompressing %s image %s to %s\n", algorithm, path, temp.Name())
+		size, err = io.CopyBuffer(temp, reader, make([]byte, 4*mb))
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	return &diskImage{
+		File:        temp,
+		Path:        path,
+		Size:        size,
+		SectorSize:  512,
+		Compression: algorithm,
+		tempPath:    temp.Name(),
+	}, nil
+}
+
+// structure returns a reader for parsing partition tables and probing
+// filesystems, with the start and end of the image memory mapped
+func (d *diskImage) structure() io.ReaderAt {
+	if d.mapped == nil {
+		d.mapped = newMappedReader(d.File, d.Size)
+	}
+	return d.mapped
+}
+
+// Close closes the image and removes any temporary decompressed copy
+func (d *diskImage) Close() error {
+	if d.mapped != nil {
+		d.mapped.Close()
+	}
+	err := d.File.Close()
+	if d.tempPath != "" {
+		os.Remove(d.tempPath)
+	}
+	return err
+}
+
+// partitionTable reads the partition table of the image
+func (d *diskImage) partitionTable() (*partitionTable, error) {
+	return readPartitionTable(d.structure(), d.SectorSize)
+}
+
+// deviceWriter is a device or image opened for writing. In dry-run mode the
+// device is opened read-only and every write is reported instead of applied.
+type deviceWriter struct {
+	*diskImage
+	Operation string
+	DryRun    bool
+	report    io.Writer // where dry-run writes are reported
+	writes    int
+	written   int64
+}
+
+// openDeviceWriter checks the write policy and opens a device or image for writing.
+// Every command that modifies a device must go through it.
+func openDeviceWriter(path, operation string) (*deviceWriter, error) {
+	return openDeviceWriterTo(path, operation, os.Stdout)
+}
+
+// openDeviceWriterTo is openDeviceWriter with the dry-run report sent to report
+func openDeviceWriterTo(path, operation string, report io.Writer) (*deviceWriter, error) {
+	if err := checkWritePolicy(path, operation); err != nil {
+		return nil, err
+	}
+	if err := checkWSLDevice(path, operation); err != nil {
+		return nil, err
+	}
+	// Image files may sit on a busy disk, only devices are checked
+	if info, err := os.Stat(path); !dryRun && (err != nil || !info.Mode().IsRegular()) {
+		if err := checkDeviceActivity(path, operation); err != nil {
+			return nil, err
+		}
+	}
+
+	image, err := openImage(path, !dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		fmt.Fprintf(report, "Dry run: %s on %s, nothing will be written\n", operation, path)
+	}
+	return &deviceWriter{diskImage: image, Operation: operation, DryRun: dryRun, report: report}, nil
+}
+
+func (w *deviceWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > w.Size {
+		return 0, fmt.Errorf("write of %d bytes at offset %d is beyond the end of %s (%d bytes)", len(p), off, w.Path, w.Size)
+	}
+
+	w.writes++
+	w.written += int64(len(p))
+	if !w.DryRun {
+		return w.diskImage.WriteAt(p, off)
+	}
+
+	sector := int64(w.SectorSize)
+	fmt.Fprintf(w.report, "Would write %d bytes at offset %d-%d (LBA %d-%d)\n",
+		len(p), off, off+int64(len(p))-1, off/sector, (off+int64(len(p))-1)/sector)
+	return len(p), nil
+}
+
+func (w *deviceWriter) Sync() error {
+	if w.DryRun {
+		return nil
+	}
+	return w.diskImage.Sync()
+}
+
+// Close flushes the device and, in dry-run mode, summarises the skipped writes
+func (w *deviceWriter) Close() error {
+	if w.DryRun {
+		fmt.Fprintf(w.report, "Dry run: %d writes totalling %s skipped\n", w.writes, formatBytes(w.written))
+		return w.diskImage.Close()
+	}
+
+	err := w.diskImage.Sync()
+	if closeErr := w.diskImage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// imagingProgressLines are the lines shown below the progress of imaging:
+// the read limit, the disk statistics and the sectors rescued
+func imagingProgressLines(tuning ioTuning, stats *diskStatsSampler, rescue *rescueReader) []string {
+	var lines []string
+	if tuning.Limit > 0 {
+		lines = append(lines, fmt.Sprintf("Reading limited to %.2f MB/s", float64(tuning.Limit)/mb))
+	}
+	lines = append(lines, stats.progressLine())
+	if rescue != nil {
+		lines = append(lines, rescue.progressLine())
+	}
+	return lines
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readdisk images a device to a file or a storage URL. Every platform reads
+// through the same pipeline, opening the device with its size, the sector
+// size and the I/O tuning come from the platform files.
+func readdisk(device, outputfile, compressionAlgorithm string, options outputOptions, imaging imageOptions) {
+	// The size gives the estimate and where reading stops
+	disk, totalSize, err := openDiskForImaging(device)
+	if err != nil {
+		reportFailure("Failed to open Device:", err.Error())
+		return
+	}
+	defer disk.Close()
+	device = disk.Name()
+
+	tuning, err := tuneIO(disk, device, totalSize, uint64(getSectorSize(disk)), imaging.Tuning)
+	if err != nil {
+		reportFailure("Invalid I/O settings:", err.Error())
+		return
+	}
+	fmt.Printf("Reading %s\n", tuning)
+
+	// Rescue imaging reads around bad sectors instead of stopping at the first
+	var base io.ReaderAt = disk
+	var rescue *rescueReader
+	if imaging.Rescue {
+		fill, err := parseFillPattern(imaging.Fill)
+		if err != nil {
+			reportFailure(err.Error())
+			return
+		}
+		rescue = newRescueReader(disk, uint64(getSectorSize(disk)), imaging.ReadRetries, fill)
+		base = rescue
+	}
+
+	// Smart and partition images read their ranges as one stream
+	source := base
+	deviceSize := totalSize
+	var ranges []byteRange
+	var partition byteRange
+	if imaging.Partition > 0 {
+		if partition, err = partitionByteRange(device, imaging.Partition); err != nil {
+			reportFailure("Failed to find the partition:", err.Error())
+			return
+		}
+		ranges = []byteRange{partition}
+		fmt.Printf("Imaging partition %d, %s at offset %d\n", imaging.Partition, formatBytes(partition.End-partition.Start), partition.Start)
+	}
+	if imaging.Smart {
+		structure := newMappedReader(disk, totalSize)
+		var skipped int64
+		ranges, skipped, err = smartRanges(structure, totalSize, uint64(getSectorSize(disk)))
+		structure.Close()
+		if err != nil {
+			reportFailure("Smart imaging needs a partition table:", err.Error())
+			return
+		}
+		if imaging.Partition > 0 {
+			ranges = rangesWithin(ranges, partition)
+			skipped = partition.End - partition.Start - rangesLength(ranges)
+		}
+		fmt.Printf("Smart imaging %s of %s, skipping %s of unused filesystem blocks\n",
+			formatBytes(rangesLength(ranges)), formatBytes(deviceSize), formatBytes(skipped))
+	}
+	if ranges != nil {
+		source = newRangesReader(base, ranges)
+		totalSize = rangesLength(ranges)
+	}
+
+	// --auto picks the compression from samples of what is imaged
+	if imaging.AutoCompress {
+		if imaging.Resume {
+			reportFailure("Resuming needs the --compress the image was started with instead of --auto")
+			return
+		}
+		samples := imaging.Estimate
+		if samples == 0 {
+			samples = autoCompressionSamples
+		}
+		if compressionAlgorithm, err = pickCompression(source, totalSize, samples, imaging.Compression); err != nil {
+			reportFailure("Failed to pick the compression:", err.Error())
+			return
+		}
+		fmt.Printf("Compressing with %s\n", compressionAlgorithm)
+		// Options for the algorithms that were not picked are left out
+		if imaging.Compression.check(compressionAlgorithm) != nil {
+			imaging.Compression = compressionOptions{}
+		}
+	}
+	if err := imaging.Compression.check(compressionAlgorithm); err != nil {
+		reportFailure("Invalid compression options:", err.Error())
+		return
+	}
+
+	// Determine file extension based on compression algorithm
+	extension, err := getCompressionExtension(compressionAlgorithm)
+	if err != nil {
+		reportFailure("Unsupported compression algorithm:", compressionAlgorithm)
+		return
+	}
+
+	if imaging.Encrypt != "" {
+		if compressionAlgorithm == "zip" {
+			reportFailure("Zip archives cannot be encrypted, choose another compression")
+			return
+		}
+		extension += encryptExtension
+	}
+	if outputfile, err = prepareOutput(device, outputfile, extension, imaging.Output, imaging.Resume, totalSize, false); err != nil {
+		reportFailure("Cannot write the image:", err.Error())
+		return
+	}
+
+	// An estimate from samples helps to pick a destination with enough space
+	if imaging.Estimate > 0 {
+		estimate, err := estimateImage(source, totalSize, compressionAlgorithm, imaging.Compression, imaging.Estimate)
+		if err != nil {
+			reportFailure("Failed to estimate the image:", err.Error())
+			return
+		}
+		fmt.Printf("Estimated image: %s (%.1f%% of %s), about %s to make, from %d samples of %s\n",
+			formatBytes(estimate.Size), estimate.Ratio*100, formatBytes(totalSize),
+			estimate.Duration.Truncate(time.Second), imaging.Estimate, formatBytes(estimateSampleSize))
+		if !strings.Contains(outputfile, "://") {
+			dir := filepath.Dir(outputfile)
+			if _, _, free, err := getFsSpace(dir); err == nil {
+				fmt.Printf("Free space in %s: %s\n", dir, formatBytes(free))
+				if free < estimate.Size {
+					warnf(warnLowSpace, device, "the image is likely not to fit in %s", dir)
+				}
+			}
+		}
+		if !imaging.AssumeYes && !confirm("Start imaging?") {
+			reportFailure("Imaging cancelled")
+			return
+		}
+	}
+
+	// Encryption is set up first so a bad recipient or passphrase leaves no output
+	var encrypter *encryptWriter
+	if imaging.Encrypt != "" {
+		if encrypter, err = newEncryptWriter(imaging.Encrypt); err != nil {
+			reportFailure("Failed to set up encryption:", err.Error())
+			return
+		}
+	}
+
+	// Local images with a compression that can be continued are checkpointed
+	// to a sidecar so an interrupted run can be resumed
+	var state *imageState
+	resumable := !strings.Contains(outputfile, "://") && resumableAlgorithms[compressionAlgorithm] && imaging.Encrypt == "" && !imaging.Rescue
+	if resumable {
+		if state, err = loadImageState(outputfile); err != nil {
+			reportFailure("Failed to read the image state:", err.Error())
+			return
+		}
+	}
+	if imaging.Resume {
+		if !resumable {
+			reportFailure("Only local unencrypted images with gzip, bzip2, snappy, s2, zstd, xz or lz4 compression can be resumed, rescue images cannot")
+			return
+		}
+		if state == nil {
+			reportFailure("Nothing to resume, there is no", imageStatePath(outputfile))
+			return
+		}
+		if err := state.check(device, deviceSize, totalSize, compressionAlgorithm, imaging.Smart, imaging.Partition, imaging.SkipZeros); err != nil {
+			reportFailure("Cannot resume:", err.Error())
+			return
+		}
+	} else if state != nil {
+		reportFailure(fmt.Sprintf("%s is unfinished, continue it with --resume or delete %s to start over", outputfile, imageStatePath(outputfile)))
+		return
+	} else if resumable {
+		state = &imageState{Device: device, DeviceSize: deviceSize, Size: totalSize, Smart: imaging.Smart, Partition: imaging.Partition, SkipZeros: imaging.SkipZeros, Compression: compressionAlgorithm}
+	}
+
+	// Zero regions are left out of the stream and the block map tells where the rest goes
+	var zeros *zeroSkipper
+	if imaging.SkipZeros {
+		zeros = &zeroSkipper{}
+		if imaging.Resume {
+			zeros.kept = state.Kept
+		}
+	}
+
+	// Create a new file to write the data to, or continue the unfinished one
+	var output io.WriteCloser
+	if imaging.Resume {
+		output, err = openResumedOutput(outputfile, state.Written)
+	} else {
+		// Object stores size the parts of the upload from the device
+		imageOptions := options
+		imageOptions.SizeHint = totalSize
+		output, err = createOutput(outputfile, imageOptions)
+	}
+	if err != nil {
+		reportFailure("Failed to create output file:", outputfile, err.Error())
+		return
+	}
+	defer output.Close()
+
+	// The hash of the imaged data carries over checkpoints
+	imageHash := sha256.New()
+	var resumedFrom, resumedWritten int64
+	if state != nil {
+		if imageHash, err = state.restoreHash(); err != nil {
+			reportFailure("Cannot resume:", err.Error())
+			return
+		}
+		resumedFrom, resumedWritten = state.Offset, state.Written
+		if err := state.save(outputfile); err != nil {
+			reportFailure("Failed to write the image state:", err.Error())
+			return
+		}
+	}
+	if imaging.Resume {
+		fmt.Printf("Resuming at %s of %s, from the checkpoint of %s\n", formatBytes(resumedFrom), formatBytes(totalSize), state.Updated.Local().Format(time.DateTime))
+	}
+
+	// Wrap output with a countingWriter
+	cw := &countingWriter{w: output}
+
+	// Encryption seals the compressed stream
+	var compressedOutput io.Writer = cw
+	if encrypter != nil {
+		if err := encrypter.start(cw); err != nil {
+			reportFailure("Failed to write the encryption header:", err.Error())
+			return
+		}
+		compressedOutput = encrypter
+	}
+
+	// Create the compression writer based on the chosen algorithm
+	compressedWriter, err := createCompressionWriter(compressedOutput, compressionAlgorithm, imaging.Compression)
+	if err != nil {
+		reportFailure("Failed to create compression writer:", err.Error())
+		return
+	}
+
+	fmt.Printf("Writing to Image: %s\n", outputfile)
+
+	manifest := newImageManifest(device, outputfile, disk, deviceSize, uint64(getSectorSize(disk)))
+	manifest.Compression, manifest.Encrypted = compressionAlgorithm, imaging.Encrypt != ""
+	manifest.Smart, manifest.Partition, manifest.SkipZeros = imaging.Smart, imaging.Partition, imaging.SkipZeros
+
+	listenForPause()
+	start := time.Now()
+	stats := newDiskStatsSampler(device)
+
+	display := startProgressDisplay("", nil)
+	display.extra = func() []string { return imagingProgressLines(tuning, stats, rescue) }
+
+	var (
+		bytesRead      = resumedFrom
+		lastCheckpoint = resumedFrom
+	)
+
+	// A checkpoint ends the compression stream, so the image is valid up to
+	// it, and starts a new one after saving the state
+	checkpoint := func() error {
+		if err := compressedWriter.Close(); err != nil {
+			return fmt.Errorf("failed to close compressed stream: %v", err)
+		}
+		if err := output.(*os.File).Sync(); err != nil {
+			return err
+		}
+		state.Offset, state.Written = bytesRead, resumedWritten+cw.count
+		if zeros != nil {
+			state.Kept = zeros.kept
+		}
+		if err := state.recordHash(imageHash); err != nil {
+			return err
+		}
+		if err := state.save(outputfile); err != nil {
+			return fmt.Errorf("failed to write the image state: %v", err)
+		}
+		lastCheckpoint = bytesRead
+		compressedWriter, err = createCompressionWriter(cw, compressionAlgorithm, imaging.Compression)
+		return err
+	}
+
+	remaining := totalSize - resumedFrom
+	err = readChunks(io.NewSectionReader(source, resumedFrom, remaining), remaining, tuning, func(chunk []byte, offset int64) error {
+		write := func(data []byte) error {
+			if _, err := compressedWriter.Write(data); err != nil {
+				return fmt.Errorf("failed to write compressed stream: %v", err)
+			}
+			imageHash.Write(data)
+			return nil
+		}
+		var err error
+		if zeros != nil {
+			err = zeros.filter(chunk, resumedFrom+offset, write)
+		} else {
+			err = write(chunk)
+		}
+		if err != nil {
+			return err
+		}
+		bytesRead += int64(len(chunk))
+		reportWritten("imaging", resumedWritten+cw.count)
+		reportProgress("imaging", bytesRead, totalSize)
+
+		if state != nil && bytesRead-lastCheckpoint >= checkpointInterval && bytesRead < totalSize {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+
+		start = start.Add(pausePoint(display.Bypass(), func() error { return flushWriters(compressedWriter, output) }))
+		return nil
+	})
+	if err != nil {
+		reportProgressError(err.Error())
+		display.stop()
+		reportFailure("Error imaging disk:", err.Error())
+		if state != nil && lastCheckpoint > 0 {
+			fmt.Fprintf(messageOutput(os.Stdout), "The image is checkpointed at %s, continue it with --resume\n", formatBytes(lastCheckpoint))
+		}
+		return
+	}
+	display.stop()
+
+	totalBytes := bytesRead - resumedFrom
+	fmt.Println() // new line after finishing updates
+	fmt.Println("Written:", formatBytes(totalBytes), "(", totalBytes, "bytes )")
+
+	finished := true
+	err = compressedWriter.Close()
+	if err != nil {
+		reportFailure("Failed to close compression writer:", err.Error())
+		finished = false
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			reportFailure("Failed to finish the encrypted stream:", err.Error())
+			finished = false
+		}
+	}
+
+	// Plugin outputs only report whether storing the image worked on close
+	if err := output.Close(); err != nil {
+		reportFailure("Failed to close output:", err.Error())
+		finished = false
+	}
+	if state != nil && finished {
+		if err := os.Remove(imageStatePath(outputfile)); err != nil {
+			reportFailure("Failed to remove the image state:", err.Error())
+		}
+	}
+	fmt.Printf("SHA-256 of the imaged data: %x\n", imageHash.Sum(nil))
+
+	if zeros != nil {
+		fmt.Printf("Left out %s of zeros\n", formatBytes(totalSize-rangesLength(zeros.kept)))
+	}
+	if ranges != nil || zeros != nil {
+		blocks := &blockMap{Size: deviceSize, Ranges: ranges, Partition: imaging.Partition, PartitionRange: partition}
+		if zeros != nil {
+			blocks.Ranges, blocks.Zeros = zeros.deviceRanges(ranges), true
+		}
+		if err := writeImageBlockMap(outputfile, options, blocks); err != nil {
+			reportFailure("Failed to write the block map:", err.Error())
+		} else {
+			fmt.Println("Block map:", blockMapPath(outputfile))
+		}
+	}
+
+	if rescue != nil {
+		read := ranges
+		if read == nil {
+			read = []byteRange{{Start: 0, End: deviceSize}}
+		}
+		if err := rescue.writeImageRescueMap(outputfile, options, deviceSize, read); err != nil {
+			reportFailure("Failed to write the rescue map:", err.Error())
+		}
+	}
+
+	finalElapsed := time.Since(start).Truncate(time.Second)
+	finalReadMBps := (float64(totalBytes) / (1024.0 * 1024.0)) / time.Since(start).Seconds()
+	finalWriteMBps := (float64(cw.count) / (1024.0 * 1024.0)) / time.Since(start).Seconds()
+
+	// Calculate compression ratio: original_size / compressed_size
+	var compressionRatio string
+	if cw.count > 0 {
+		ratio := float64(totalBytes) / float64(cw.count)
+		compressionRatio = fmt.Sprintf("%.2f:1", ratio)
+	} else {
+		compressionRatio = "N/A"
+	}
+
+	fmt.Printf("Total actual time: %s (%.2f MB/s read, %.2f MB/s write) Compression ratio: %s\n",
+		finalElapsed, finalReadMBps, finalWriteMBps, compressionRatio)
+	if failure == nil {
+		if err := manifest.finish(options, bytesRead, resumedWritten+cw.count, imageHash.Sum(nil)); err != nil {
+			reportFailure("Failed to write the manifest:", err.Error())
+		} else {
+			fmt.Println("Manifest:", manifestPath(outputfile))
+		}
+	}
+	if failure == nil {
+		printResult("%x  %s", imageHash.Sum(nil), outputfile)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diskInventory identifies the hardware behind a disk
+type diskInventory struct {
+	Vendor    string
+	Model     string
+	Serial    string
+	WWN       string
+	Media     string // HDD or SSD, empty if unknown
+	Transport string // SATA, SAS, NVMe, USB, SD/MMC, virtio, ...
+}
+
+// known reports whether anything about the disk was found
+func (d diskInventory) known() bool {
+	return d != diskInventory{}
+}
+
+// name returns the vendor and model, without the vendor when the model
+// starts with it already
+func (d diskInventory) name() string {
+	if d.Vendor == "" || strings.HasPrefix(strings.ToLower(d.Model), strings.ToLower(d.Vendor)) {
+		return d.Model
+	}
+	return strings.TrimSpace(d.Vendor + " " + d.Model)
+}
+
+// kind returns the transport and media, like NVMe SSD or USB HDD
+func (d diskInventory) kind() string {
+	return strings.TrimSpace(d.Transport + " " + d.Media)
+}
+
+// describe returns the inventory in one line for listings and status bars
+func (d diskInventory) describe() string {
+	var parts []string
+	for _, part := range []string{d.name(), d.kind()} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if d.Serial != "" {
+		parts = append(parts, fmt.Sprintf("serial %s", d.Serial))
+	}
+	if d.WWN != "" {
+		parts = append(parts, fmt.Sprintf("WWN %s", d.WWN))
+	}
+	return strings.Join(parts, ", ")
+}
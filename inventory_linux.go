@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readDiskInventory reads the model, serial, WWN, media and transport of a
+// disk from sysfs, falling back to the udev database
+func readDiskInventory(device string) diskInventory {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return diskInventory{}
+	}
+	name := filepath.Base(resolved)
+	sysPath := filepath.Join("/sys/class/block", name)
+	if _, err := os.Stat(sysPath); err != nil {
+		return diskInventory{}
+	}
+	read := func(file string) string {
+		data, err := os.ReadFile(filepath.Join(sysPath, file))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	props := udevProperties(name)
+
+	inv := diskInventory{
+		Vendor: read("device/vendor"),
+		Model:  read("device/model"),
+		Serial: diskSerial(device),
+		WWN:    diskWWN(device),
+	}
+	// virtio and NVMe put the PCI vendor ID there
+	if strings.HasPrefix(inv.Vendor, "0x") {
+		inv.Vendor = ""
+	}
+	if inv.Vendor == "" {
+		inv.Vendor = strings.ReplaceAll(props["ID_VENDOR"], "_", " ")
+	}
+	if inv.Model == "" {
+		inv.Model = strings.ReplaceAll(props["ID_MODEL"], "_", " ")
+	}
+	// SATA disks behind libata report ATA as their vendor
+	if inv.Vendor == "ATA" {
+		inv.Vendor = ""
+	}
+
+	switch read("queue/rotational") {
+	case "1":
+		inv.Media = "HDD"
+	case "0":
+		inv.Media = "SSD"
+	}
+	inv.Transport = diskTransport(sysPath, props)
+	// Virtual disks have no media of their own
+	if inv.Transport == "virtio" || inv.Transport == "Xen" {
+		inv.Media = ""
+	}
+	return inv
+}
+
+// diskTransport works out how a disk is attached from where it is in the
+// sysfs device tree
+func diskTransport(sysPath string, props map[string]string) string {
+	resolved, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return ""
+	}
+	path := resolved + "/"
+	switch {
+	case strings.Contains(path, "/usb"):
+		return "USB"
+	case strings.Contains(path, "/nvme"):
+		return "NVMe"
+	case strings.Contains(path, "/mmc_host/"):
+		return "SD/MMC"
+	case strings.Contains(path, "/virtio"):
+		return "virtio"
+	case strings.Contains(path, "/vbd-"):
+		return "Xen"
+	case strings.Contains(path, "/ata"):
+		return "SATA"
+	case strings.Contains(path, "/host") && strings.Contains(path, "/port-"):
+		return "SAS"
+	}
+	switch props["ID_BUS"] {
+	case "ata":
+		return "SATA"
+	case "usb":
+		return "USB"
+	case "scsi":
+		return "SCSI"
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// storageBusTypes names the STORAGE_BUS_TYPE values
+var storageBusTypes = map[uint32]string{
+	0x01: "SCSI", 0x02: "ATAPI", 0x03: "ATA", 0x04: "FireWire", 0x05: "SSA",
+	0x06: "Fibre Channel", 0x07: "USB", 0x08: "RAID", 0x09: "iSCSI", 0x0A: "SAS",
+	0x0B: "SATA", 0x0C: "SD", 0x0D: "MMC", 0x0E: "virtual", 0x0F: "virtual",
+	0x10: "Storage Spaces", 0x11: "NVMe", 0x12: "SCM", 0x13: "UFS",
+}
+
+// readDiskInventory asks the storage stack of a physical drive for its
+// vendor, model, serial, bus and whether it seeks
+func readDiskInventory(device string) diskInventory {
+	handle, err := windows.CreateFile(windows.StringToUTF16Ptr(device), 0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return diskInventory{}
+	}
+	defer windows.CloseHandle(handle)
+
+	query := func(property uint32, out []byte) (int, error) {
+		q := StoragePropertyQuery{PropertyId: property}
+		var n uint32
+		err := windows.DeviceIoControl(handle, IOCTL_STORAGE_QUERY_PROPERTY,
+			(*byte)(unsafe.Pointer(&q)), uint32(unsafe.Sizeof(q)), &out[0], uint32(len(out)), &n, nil)
+		return int(n), err
+	}
+
+	var inv diskInventory
+	// STORAGE_DEVICE_DESCRIPTOR keeps offsets of NUL terminated strings
+	// behind its fixed part
+	descriptor := make([]byte, 1024)
+	if n, err := query(StorageDeviceProperty, descriptor); err == nil && n >= 32 {
+		descriptor = descriptor[:n]
+		text := func(at int) string {
+			offset := int(binary.LittleEndian.Uint32(descriptor[at:]))
+			if offset == 0 || offset >= len(descriptor) {
+				return ""
+			}
+			value := descriptor[offset:]
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				value = value[:end]
+			}
+			return strings.TrimSpace(string(value))
+		}
+		inv.Vendor, inv.Model, inv.Serial = text(12), text(16), text(24)
+		inv.Transport = storageBusTypes[binary.LittleEndian.Uint32(descriptor[28:])]
+	}
+
+	penalty := make([]byte, 12)
+	if n, err := query(StorageDeviceSeekPenaltyProperty, penalty); err == nil && n >= 9 {
+		inv.Media = "SSD"
+		if penalty[8] != 0 {
+			inv.Media = "HDD"
+		}
+	}
+	if inv.Transport == "virtual" {
+		inv.Media = ""
+	}
+	return inv
+}
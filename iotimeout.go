@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// A failing disk or a hung USB bridge can block a read for minutes. Reads
+// while probing and listing devices give up after ioTimeout and the device
+// is shown as unresponsive instead.
+
+// ioTimeout is how long a probing read may take, set by --io-timeout
+var ioTimeout = 10 * time.Second
+
+// unresponsiveError means a device did not answer within the timeout
+type unresponsiveError struct {
+	Device  string
+	Timeout time.Duration
+}
+
+func (e *unresponsiveError) Error() string {
+	return fmt.Sprintf("%s is unresponsive, it did not answer within %s", e.Device, e.Timeout)
+}
+
+// timeoutReaderAt gives up on reads that take longer than ioTimeout. Once a
+// read timed out every further read fails at once, the device is hung.
+type timeoutReaderAt struct {
+	r      io.ReaderAt
+	device string
+	hung   bool
+}
+
+func newTimeoutReaderAt(r io.ReaderAt, device string) *timeoutReaderAt {
+	return &timeoutReaderAt{r: r, device: device}
+}
+
+// Size returns the size of the underlying reader, if it is known
+func (t *timeoutReaderAt) Size() int64 {
+	return readerSize(t.r)
+}
+
+// ReadAt implements io.ReaderAt. The read goes to a buffer of its own, so a
+// read that completes after the timeout can not write into p.
+func (t *timeoutReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if t.hung {
+		return 0, &unresponsiveError{t.device, ioTimeout}
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	go func() {
+		n, err := t.r.ReadAt(buf, off)
+		done <- result{n, err}
+	}()
+
+	timer := time.NewTimer(ioTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		t.hung = true
+		return 0, &unresponsiveError{t.device, ioTimeout}
+	}
+}
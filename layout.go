@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Partition layouts are written as sfdisk scripts, the format of sfdisk --dump:
+//
+//	label: gpt
+//	/dev/sda1 : start=2048, size=1G, type=U, name="EFI System"
+//	,,L
+//
+// Plain numbers are sectors, sizes take units like 512M or 20GiB. A missing
+// start continues after the previous partition on a 1 MiB boundary, a
+// missing size fills the rest of the disk.
+
+// layoutPartition is a partition line of a layout script
+type layoutPartition struct {
+	Line     int
+	Number   int
+	Start    string
+	Size     string
+	Type     string
+	Name     string
+	UUID     string
+	Attrs    string
+	Bootable bool
+}
+
+// partitionLayout is a parsed layout script
+type partitionLayout struct {
+	Label       string
+	LabelID     string
+	FirstLBA    uint64
+	LastLBA     uint64
+	TableLength uint32
+	SectorSize  uint64
+	Partitions  []layoutPartition
+}
+
+// sfdiskTypeAliases are the sfdisk shortcuts for common partition types
+var sfdiskTypeAliases = map[string][2]string{
+	"L": {"Linux filesystem", "83"},
+	"S": {"Linux swap", "82"},
+	"U": {"EFI System", "ef"},
+	"R": {"Linux RAID", "fd"},
+	"V": {"Linux LVM", "8e"},
+	"H": {"Linux home", ""},
+}
+
+// gptAttributeBits are the names sfdisk uses for GPT attribute bits
+var gptAttributeBits = map[string]uint{
+	"RequiredPartition":  0,
+	"NoBlockIOProtocol":  1,
+	"LegacyBIOSBootable": 2,
+}
+
+// splitLayoutFields splits a partition line on commas and spaces outside
+// quotes. Dumps pad the values, so spaces after = are skipped.
+func splitLayoutFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t') && strings.HasSuffix(field.String(), "="):
+		case !quoted && (r == ',' || r == ' ' || r == '\t'):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(r)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// parseSfdiskScript reads a layout script in the sfdisk format
+func parseSfdiskScript(r io.Reader) (*partitionLayout, error) {
+	layout := &partitionLayout{Label: "dos"}
+	headers := []string{"label", "label-id", "device", "unit", "first-lba", "last-lba", "table-length", "sector-size", "grain"}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if key, value, ok := strings.Cut(line, ":"); ok && containsString(headers, strings.TrimSpace(key)) {
+			value = strings.TrimSpace(value)
+			var err error
+			switch strings.TrimSpace(key) {
+			case "label":
+				layout.Label = strings.ToLower(value)
+			case "label-id":
+				layout.LabelID = value
+			case "unit":
+				if value != "sectors" {
+					err = fmt.Errorf("unit %q is not supported, use sectors", value)
+				}
+			case "first-lba":
+				layout.FirstLBA, err = strconv.ParseUint(value, 10, 64)
+			case "last-lba":
+				layout.LastLBA, err = strconv.ParseUint(value, 10, 64)
+			case "table-length":
+				var n uint64
+				n, err = strconv.ParseUint(value, 10, 32)
+				layout.TableLength = uint32(n)
+			case "sector-size":
+				layout.SectorSize, err = strconv.ParseUint(value, 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			continue
+		}
+
+		part := layoutPartition{Line: lineNumber}
+		if name, rest, ok := strings.Cut(line, ":"); ok && !strings.Contains(name, "=") {
+			// The device name of a dump gives the partition number
+			name = strings.TrimSpace(name)
+			i := len(name)
+			for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+				i--
+			}
+			part.Number, _ = strconv.Atoi(name[i:])
+			line = rest
+		}
+
+		if !strings.Contains(line, "=") {
+			// The short form is start, size, type and bootable separated by commas
+			values := strings.Split(line, ",")
+			if len(values) == 1 {
+				values = strings.Fields(line)
+			}
+			for i, value := range values {
+				value = strings.TrimSpace(value)
+				switch i {
+				case 0:
+					part.Start = value
+				case 1:
+					part.Size = value
+				case 2:
+					part.Type = value
+				case 3:
+					part.Bootable = value == "*"
+				default:
+					return nil, fmt.Errorf("line %d: too many fields", lineNumber)
+				}
+			}
+			layout.Partitions = append(layout.Partitions, part)
+			continue
+		}
+
+		for _, field := range splitLayoutFields(line) {
+			key, value, _ := strings.Cut(field, "=")
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "start":
+				part.Start = value
+			case "size":
+				part.Size = value
+			case "type", "id", "ptype":
+				part.Type = value
+			case "name":
+				part.Name = value
+			case "uuid":
+				part.UUID = value
+			case "attrs":
+				part.Attrs = value
+			case "bootable":
+				part.Bootable = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown field %q", lineNumber, key)
+			}
+		}
+		layout.Partitions = append(layout.Partitions, part)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// layoutSectors converts a start or size of a layout to sectors, plain numbers
+// are sectors already
+func layoutSectors(value string, sectorSize uint64, roundUp bool) (uint64, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "+")
+	if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return n, nil
+	}
+	bytes, err := parseSize(value, int64(sectorSize), 0)
+	if err != nil {
+		return 0, err
+	}
+	if roundUp {
+		return (uint64(bytes) + sectorSize - 1) / sectorSize, nil
+	}
+	return uint64(bytes) / sectorSize, nil
+}
+
+// parseGPTAttributes parses sfdisk attribute names and GUID:bit lists
+func parseGPTAttributes(value string) (uint64, error) {
+	var flags uint64
+	for _, attr := range strings.Fields(strings.ReplaceAll(value, ",", " ")) {
+		if bit, ok := gptAttributeBits[attr]; ok {
+			flags |= 1 << bit
+			continue
+		}
+		// GUID:52,63 has the further bits as separate fields after the split
+		bitList := strings.TrimPrefix(attr, "GUID:")
+		bit, err := strconv.ParseUint(bitList, 10, 8)
+		if err != nil || bit > 63 {
+			return 0, fmt.Errorf("unknown partition attribute %q", attr)
+		}
+		flags |= 1 << bit
+	}
+	return flags, nil
+}
+
+// buildTable creates the partition table a layout describes on a disk
+func (l *partitionLayout) buildTable(sectorSize, diskSectors uint64) (*partitionTable, error) {
+	if l.SectorSize != 0 && l.SectorSize != sectorSize {
+		return nil, fmt.Errorf("the layout is for %d byte sectors, the disk has %d byte sectors", l.SectorSize, sectorSize)
+	}
+	tableType := map[string]string{"gpt": "GPT", "dos": "MBR", "mbr": "MBR"}[l.Label]
+	if tableType == "" {
+		return nil, fmt.Errorf("unsupported label %q, use gpt or dos", l.Label)
+	}
+	table, err := newPartitionTable(tableType, sectorSize, diskSectors)
+	if err != nil {
+		return nil, err
+	}
+
+	if table.Header != nil {
+		if l.TableLength != 0 {
+			entrySectors := (uint64(l.TableLength)*uint64(table.Header.PartEntrySize) + sectorSize - 1) / sectorSize
+			table.Header.NumPartEntries = l.TableLength
+			table.Header.FirstUsableLBA = 2 + entrySectors
+			table.Header.LastUsableLBA = diskSectors - 2 - entrySectors
+		}
+		if l.LabelID != "" {
+			if table.Header.DiskGUID, err = parseGUID(l.LabelID); err != nil {
+				return nil, fmt.Errorf("invalid label-id %q", l.LabelID)
+			}
+		}
+		// The usable area can be narrowed, not extended into the entry arrays
+		if l.FirstLBA > table.Header.FirstUsableLBA {
+			table.Header.FirstUsableLBA = l.FirstLBA
+		}
+		if l.LastLBA != 0 && l.LastLBA < table.Header.LastUsableLBA {
+			table.Header.LastUsableLBA = l.LastLBA
+		}
+	}
+
+	if tableType == "MBR" && l.LabelID != "" {
+		signature, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(l.LabelID), "0x"), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label-id %q", l.LabelID)
+		}
+		table.DiskSignature = uint32(signature)
+	}
+
+	usableFirst, usableLast := table.usableRange(diskSectors)
+	align := max(mb/sectorSize, 1)
+	next, number := usableFirst, 0
+	for _, lp := range l.Partitions {
+		fail := func(err error) error { return fmt.Errorf("line %d: %v", lp.Line, err) }
+
+		first := (next + align - 1) / align * align
+		if lp.Start != "" {
+			if first, err = layoutSectors(lp.Start, sectorSize, true); err != nil {
+				return nil, fail(fmt.Errorf("invalid start: %v", err))
+			}
+		}
+		last := usableLast
+		if lp.Size != "" && lp.Size != "+" {
+			sectors, err := layoutSectors(lp.Size, sectorSize, false)
+			if err != nil || sectors == 0 {
+				return nil, fail(fmt.Errorf("invalid size %q", lp.Size))
+			}
+			last = first + sectors - 1
+		}
+
+		number++
+		if lp.Number > 0 {
+			number = lp.Number
+		}
+		partType := lp.Type
+		if alias, ok := sfdiskTypeAliases[strings.ToUpper(partType)]; ok && len(partType) == 1 {
+			partType = alias[0]
+			if tableType == "MBR" {
+				partType = alias[1]
+			}
+		}
+		if partType == "" {
+			partType = partitionTypeChoices(tableType)[0]
+		}
+
+		spec := partitionSpec{Number: number, FirstLBA: first, LastLBA: last, Type: partType, Name: lp.Name}
+		part, err := table.createPartition(spec, diskSectors)
+		if err != nil {
+			return nil, fail(err)
+		}
+		switch {
+		case part.GPT != nil:
+			if lp.UUID != "" {
+				if part.GPT.UniqueGUID, err = parseGUID(lp.UUID); err != nil {
+					return nil, fail(fmt.Errorf("invalid uuid %q", lp.UUID))
+				}
+			}
+			if part.GPT.AttributeFlags, err = parseGPTAttributes(lp.Attrs); err != nil {
+				return nil, fail(err)
+			}
+			if lp.Bootable {
+				part.GPT.AttributeFlags |= 1 << gptAttributeBits["LegacyBIOSBootable"]
+			}
+		case part.MBR != nil && lp.Bootable:
+			part.MBR.Status = 0x80
+		}
+		next = last + 1
+	}
+	return table, nil
+}
+
+// applyLayout replaces the partition table of a device with the one a layout
+// script describes, read from file or from stdin if file is empty or -
+func applyLayout(device, file string, assumeYes bool) error {
+	var input io.Reader = os.Stdin
+	if file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	} else if !assumeYes && !dryRun {
+		return fmt.Errorf("the layout is read from stdin, so it can not ask for confirmation, use --yes or --dry-run")
+	}
+
+	layout, err := parseSfdiskScript(input)
+	if err != nil {
+		return err
+	}
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	sectorSize, diskSectors := image.SectorSize, uint64(image.Size)/image.SectorSize
+	image.Close()
+
+	table, err := layout.buildTable(sectorSize, diskSectors)
+	if err != nil {
+		return err
+	}
+	return commitPartitionTable(device, table, "apply partition layout", assumeYes)
+}
+
+// dumpLayout describes the partition table of a device as an sfdisk script
+// like sfdisk --dump writes, which table apply reads back. table apply makes
+// primary partitions only, so MBR tables with an extended partition are
+// refused rather than dumped without their logical partitions.
+func dumpLayout(w io.Writer, device string) error {
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	table, err := image.partitionTable()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	switch table.Type {
+	case "GPT":
+		h := table.Header
+		fmt.Fprintf(&b, "label: gpt\nlabel-id: %s\ndevice: %s\nunit: sectors\n", formatGUID(h.DiskGUID), device)
+		fmt.Fprintf(&b, "first-lba: %d\nlast-lba: %d\ntable-length: %d\n", h.FirstUsableLBA, h.LastUsableLBA, h.NumPartEntries)
+	case "MBR":
+		for _, part := range table.Partitions {
+			if isExtendedType(part.MBR.Type) {
+				return fmt.Errorf("%s has logical partitions in the extended partition %d, which a layout can not describe, use table backup to save them", device, part.Number)
+			}
+		}
+		signature := make([]byte, 4)
+		if _, err := image.ReadAt(signature, 440); err != nil {
+			return fmt.Errorf("reading the disk signature: %v", err)
+		}
+		fmt.Fprintf(&b, "label: dos\nlabel-id: 0x%08x\ndevice: %s\nunit: sectors\n", binary.LittleEndian.Uint32(signature), device)
+	default:
+		return fmt.Errorf("%s has an %s partition table, only GPT and MBR tables can be dumped", device, table.Type)
+	}
+	fmt.Fprintf(&b, "sector-size: %d\n\n", table.SectorSize)
+
+	for _, part := range table.Partitions {
+		fields := []string{fmt.Sprintf("start=%12d", part.FirstLBA), fmt.Sprintf("size=%12d", part.Sectors())}
+		switch {
+		case part.GPT != nil:
+			fields = append(fields, "type="+formatGUID(part.GPT.TypeGUID), "uuid="+formatGUID(part.GPT.UniqueGUID))
+			if part.Name != "" {
+				fields = append(fields, fmt.Sprintf("name=%q", part.Name))
+			}
+			if part.GPT.AttributeFlags != 0 {
+				attrs := strings.ReplaceAll(describeGPTAttributes(part.GPT.AttributeFlags), ", ", " ")
+				fields = append(fields, fmt.Sprintf("attrs=%q", attrs))
+			}
+		case part.MBR != nil:
+			fields = append(fields, fmt.Sprintf("type=%x", part.MBR.Type))
+			if part.MBR.Status == 0x80 {
+				fields = append(fields, "bootable")
+			}
+		}
+		fmt.Fprintf(&b, "%s : %s\n", partitionDevicePath(device, part.Number), strings.Join(fields, ", "))
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// LZ4 images use the frame format of the lz4 tool, written in independent
+// 4 MiB blocks with a content checksum. Reading continues across
+// concatenated frames, so resumed images read as one.
+
+// newLZ4Writer compresses into an LZ4 frame
+func newLZ4Writer(w io.Writer) (io.WriteCloser, error) {
+	z := lz4.NewWriter(w)
+	if err := z.Apply(lz4.BlockSizeOption(lz4.Block4Mb), lz4.ChecksumOption(true)); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// lz4Reader decompresses LZ4 frames one after the other, as lz4.Reader ends
+// with the first
+type lz4Reader struct {
+	src   *bufio.Reader
+	zr    *lz4.Reader
+	ended bool // the frame of zr ended, it must not be read again
+}
+
+func newLZ4Reader(r io.Reader) *lz4Reader {
+	src := bufio.NewReader(r)
+	return &lz4Reader{src: src, zr: lz4.NewReader(src)}
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	for {
+		if z.ended {
+			// Another frame follows when there is more input
+			if _, err := z.src.Peek(1); err != nil {
+				return 0, err
+			}
+			z.zr.Reset(z.src)
+			z.ended = false
+		}
+		n, err := z.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		z.ended = true
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
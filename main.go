@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	cli "github.com/jawher/mow.cli"
 )
@@ -13,78 +14,1237 @@ func main() {
 	app := cli.App("dsktool", "Earentir Disk Tools")
 	app.Version("v version", appversion)
 
+	dryRunOpt := app.BoolOpt("dry-run", false, "Show what destructive commands would write without writing")
+	retriesOpt := appIntOpt(app, "retries", networkRetry.Attempts, "Attempts for network transfers before giving up")
+	onCompleteOpt := appStringOpt(app, "on-complete", "", "Shell command to run when a command succeeds, see DSKTOOL_* in its environment")
+	onErrorOpt := appStringOpt(app, "on-error", "", "Shell command to run when a command fails, see DSKTOOL_* in its environment")
+	ioTimeoutOpt := appIntOpt(app, "io-timeout", int(ioTimeout.Seconds()), "Seconds a disk may take to answer while listing before it is shown as unresponsive")
+	stateFileOpt := appStringOpt(app, "state-file", "", "JSON file to keep up to date with the progress of long operations")
+	progressOpt := appStringOpt(app, "progress", "text", "How long operations show progress: text on the terminal, or json lines on stderr")
+	progressToOpt := appStringOpt(app, "progress-to", "", "File or named pipe to write --progress json lines to instead of stderr")
+	metricsOpt := appStringOpt(app, "metrics", "", "Serve the progress of long operations for Prometheus on an address like :9101, or write it to a .prom file")
+	quietOpt := app.BoolOpt("quiet", false, "Print only the result of imaging, cloning and other long commands, like the path and hash of the image")
+	identityOpt := appStringOpt(app, "identity", "", "age identity file to decrypt images encrypted to a recipient")
+	recordOpt := appStringOpt(app, "record", "", "Session file to record the commands, the disks they change and their results in, see replay")
+	allowBusyOpt := app.BoolOpt("allow-busy", false, "Write to or benchmark disks that other processes are using")
+	app.Before = func() {
+		dryRun = *dryRunOpt
+		allowBusy = *allowBusyOpt
+		setupQuiet(*quietOpt)
+		networkRetry.Attempts = *retriesOpt
+		if *ioTimeoutOpt < 1 {
+			fatalf("Error: --io-timeout must be at least 1 second")
+		}
+		ioTimeout = time.Duration(*ioTimeoutOpt) * time.Second
+		decryptIdentityFile = *identityOpt
+		if err := setupRecording(*recordOpt); err != nil {
+			fatalf("Error writing the session file: %v", err)
+		}
+		if err := setupStateFile(*stateFileOpt); err != nil {
+			fatalf("Error writing the state file: %v", err)
+		}
+		if err := setupProgress(*progressOpt, *progressToOpt); err != nil {
+			fatalf("Error setting up the progress output: %v", err)
+		}
+		if err := setupMetrics(*metricsOpt); err != nil {
+			fatalf("Error setting up the metrics: %v", err)
+		}
+		if err := setupHooks(*onCompleteOpt, *onErrorOpt); err != nil {
+			fatalf("Error loading hooks: %v", err)
+		}
+	}
+	app.After = func() {
+		if failure != nil {
+			runHooks(1, failure)
+			os.Exit(1)
+		}
+		runHooks(0, nil)
+	}
+
 	app.Command("d disk disks", "List Disks", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--tree | --format]"
+
+		var (
+			tree   = cmd.BoolOpt("tree", false, "Show disks and their partitions as a tree")
+			format = cmd.StringOpt("format", "text", "Output format (text, csv, tsv, json or a plugin format)")
+		)
+
 		cmd.Action = func() {
-			listDisks()
+			if err := checkOutputFormat(*format); err != nil {
+				fatalf("Error: %v", err)
+			}
+			switch {
+			case *tree:
+				listDisksTree()
+			case *format != "text":
+				if err := listDiskRecords(os.Stdout, *format); err != nil {
+					fatalf("Error listing disks: %v", err)
+				}
+			default:
+				listDisks()
+			}
 		}
 	})
 
 	app.Command("p part partitions", "List Partitions", func(cmd *cli.Cmd) {
-		cmd.Spec = "DEVICE"
-		deviceToRead := cmd.StringArg("DEVICE", "", "Disk To Use")
+		cmd.Spec = "[DEVICE] [--format]"
+
+		var (
+			deviceToRead = cmd.StringArg("DEVICE", "", "Disk To Use")
+			format       = cmd.StringOpt("format", "text", "Output format (text, csv, tsv, json or a plugin format)")
+		)
+
+		cmd.Command("info", "Show everything known about one partition", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE N"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Disk or image")
+				number = cmd.IntArg("N", 0, "Partition number")
+			)
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				if err := partitionInfo(*device, *number); err != nil {
+					fatalf("Error reading partition: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("sort", "Number the GPT entries in the order the partitions are on the disk", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] DEVICE"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				device    = cmd.StringArg("DEVICE", "", "Device or image to sort")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := sortPartitionTable(*device, *assumeYes); err != nil {
+					fatalf("Error sorting partitions: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("create", "Create a partition from --start with --size or --end", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] [--number] [--start] (--size | --end) [--type] [--name] DEVICE"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				number    = cmd.IntOpt("number", 0, "Partition number, the first free slot if not set")
+				start     = cmd.StringOpt("start", "", "Start like 1MiB, 2048s or 10%, the first aligned gap that fits if not set")
+				size      = cmd.StringOpt("size", "", "Size like 512MiB or max for the rest of the gap")
+				end       = cmd.StringOpt("end", "", "End like 1GiB or 100%, exclusive as in parted")
+				partType  = cmd.StringOpt("type", "", "Type name, GUID or MBR type byte, Linux filesystem if not set")
+				name      = cmd.StringOpt("name", "", "GPT partition name")
+				device    = cmd.StringArg("DEVICE", "", "Device or image")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := addPartition(*device, *number, *start, *end, *size, *partType, *name, *assumeYes); err != nil {
+					fatalf("Error creating partition: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("delete rm", "Delete a partition from the table, its data is left in place", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] DEVICE N"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				device    = cmd.StringArg("DEVICE", "", "Device or image")
+				number    = cmd.IntArg("N", 0, "Partition number")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := removePartition(*device, *number, *assumeYes); err != nil {
+					fatalf("Error deleting partition: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("set-type", "Change the type of a partition", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] DEVICE N TYPE"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				device    = cmd.StringArg("DEVICE", "", "Device or image")
+				number    = cmd.IntArg("N", 0, "Partition number")
+				partType  = cmd.StringArg("TYPE", "", "Type name like \"Linux swap\", a GUID or an MBR type byte like 82")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := setPartitionType(*device, *number, *partType, *assumeYes); err != nil {
+					fatalf("Error setting partition type: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("move", "Move a partition and its data to start at another LBA", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] [--journal] (--new-start=<LBA> | --resume | --rollback) DEVICE [N]"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				journal   = cmd.StringOpt("journal", "", "Journal file, kept in the configuration directory if not set")
+				newStart  = cmd.StringOpt("new-start", "", "LBA or offset like 1MiB the partition is to start at")
+				resume    = cmd.BoolOpt("resume", false, "Continue an interrupted move from its journal")
+				rollback  = cmd.BoolOpt("rollback", false, "Undo an interrupted move, moving the data back where it was")
+				device    = cmd.StringArg("DEVICE", "", "Device or image")
+				number    = cmd.IntArg("N", 0, "Partition number")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				var err error
+				if *resume || *rollback {
+					err = resumeMove(*device, *journal, *rollback)
+				} else if *number == 0 {
+					fatalf("Error moving partition: give the partition number to move")
+				} else {
+					err = movePartition(*device, *number, *newStart, *journal, *assumeYes)
+				}
+				if err != nil {
+					fatalf("Error moving partition: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("clone", "Copy one partition into an existing partition of another disk", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--verify] [--yes] [--block-size] [--queue-depth] SRC DST"
+
+			var (
+				verify     = cmd.BoolOpt("verify", false, "Re-read the target partition afterwards and compare its hash")
+				assumeYes  = cmd.BoolOpt("yes", false, "Do not ask before overwriting the target partition")
+				blockSize  = cmd.StringOpt("block-size", "", "Copy block size like 1M, probed from the device if not set")
+				queueDepth = cmd.IntOpt("queue-depth", 0, "Reads in flight, probed from the device if not set")
+				src        = cmd.StringArg("SRC", "", "Partition to copy as DEVICE:N, a partition image works too")
+				dst        = cmd.StringArg("DST", "", "Partition to overwrite as DEVICE:M, at least as large as SRC")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				device, _ := parsePartitionSpec(*dst)
+				checkForPerms(device)
+				options := cloneOptions{Verify: *verify, AssumeYes: *assumeYes, Tuning: ioTuning{QueueDepth: *queueDepth}}
+				if *blockSize != "" {
+					source, _ := parsePartitionSpec(*src)
+					size, err := parseDeviceSize(source, *blockSize)
+					if err != nil {
+						fatalf("Error parsing block size: %v", err)
+					}
+					options.Tuning.BlockSize = size
+				}
+				if err := clonePartition(*src, *dst, options); err != nil {
+					fatalf("Error cloning partition: %v", err)
+				}
+			}
+		})
 
 		cmd.Action = func() {
+			// DEVICE is optional for the subcommands only
+			if *deviceToRead == "" {
+				cmd.PrintHelp()
+				cli.Exit(2)
+			}
+			if err := checkOutputFormat(*format); err != nil {
+				fatalf("Error: %v", err)
+			}
 			checkForPerms(*deviceToRead)
+			if *format != "text" {
+				if err := listPartitionRecords(os.Stdout, *deviceToRead, *format); err != nil {
+					fatalf("Error listing partitions: %v", err)
+				}
+				return
+			}
 			listPartitions(*deviceToRead)
 		}
 	})
 
+	app.Command("tui", "Interactive disk and partition browser", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--pick-disk | --pick-partition] [DEVICE...]"
+
+		var (
+			pickDisk      = cmd.BoolOpt("pick-disk", false, "Only select a disk and print its path")
+			pickPartition = cmd.BoolOpt("pick-partition", false, "Only select a partition and print its path")
+			devices       = cmd.StringsArg("DEVICE", nil, "Disks or images to show instead of the attached disks")
+		)
+
+		cmd.Action = func() {
+			for _, device := range *devices {
+				checkForPerms(device)
+			}
+
+			var err error
+			switch {
+			case *pickDisk:
+				err = pickDevice(*devices, tuiPickDisk)
+			case *pickPartition:
+				err = pickDevice(*devices, tuiPickPartition)
+			default:
+				_, err = runTUI(*devices, "")
+			}
+			if err != nil {
+				fatalf("Error running TUI: %v", err)
+			}
+		}
+	})
+
 	app.Command("l list", "List bytes from disk", func(cmd *cli.Cmd) {
 		cmd.Spec = "DEVICE [--bytes] [--offset]"
 
 		var (
 			deviceToRead = cmd.StringArg("DEVICE", "", "Disk To Use")
-			bytes        = cmd.IntOpt("bytes", 512, "Number of bytes to read")
-			offset       = cmd.IntOpt("offset", 0, "Offset to start reading from")
+			bytes        = cmd.StringOpt("bytes", "512", "Number of bytes to read, e.g. 4K or 1s")
+			offset       = cmd.StringOpt("offset", "0", "Offset to start reading from, e.g. 1M, 2048s or 50%")
 		)
 
 		cmd.Action = func() {
 			checkForPerms(*deviceToRead)
-			//This is not good, we cant use an offset larger than 2^32
-			printDiskBytes(*deviceToRead, *bytes, int64(*offset))
+			count, err := parseDeviceSize(*deviceToRead, *bytes)
+			if err != nil {
+				fatalf("Error parsing --bytes: %v", err)
+			}
+			start, err := parseDeviceSize(*deviceToRead, *offset)
+			if err != nil {
+				fatalf("Error parsing --offset: %v", err)
+			}
+			printDiskBytes(*deviceToRead, int(count), start)
 		}
 	})
 
 	app.Command("b bench benchmaks", "Benchmark Disk", func(cmd *cli.Cmd) {
-		cmd.Spec = "[--size] [--dir] [--iterations]"
+		cmd.Spec = "[--size] [--dir] [--iterations] [--format]"
 
 		var (
-			size       = cmd.IntOpt("size", 1024, "Size of the file to write in MB")
+			size       = cmd.StringOpt("size", "1G", "Size of the file to write, e.g. 512M or 4G")
 			dir        = cmd.StringOpt("dir", ".", "Directory to write the file to")
 			iterations = cmd.IntOpt("iterations", 5, "Number of iterations to run")
+			format     = cmd.StringOpt("format", "text", "Output format (text, csv, tsv, json or a plugin format)")
 		)
 
 		cmd.Action = func() {
+			if err := checkOutputFormat(*format); err != nil {
+				fatalf("Error: %v", err)
+			}
 			checkForPerms(*dir)
-			benchFullTest(*size, *iterations, *dir)
+			bytes, err := parseSize(*size, 0, 0)
+			if err == nil && bytes <= 0 {
+				err = fmt.Errorf("the size must be more than 0")
+			}
+			if err != nil {
+				fatalf("Error parsing --size: %v", err)
+			}
+			report := &benchReport{format: *format}
+			benchFullTest(int(bytes), *iterations, *dir, report)
+			if err := report.flush(); err != nil {
+				fatalf("Error writing results: %v", err)
+			}
+		}
+	})
+
+	app.Command("monitor", "Show live read/write throughput, IOPS and utilization of disks", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--interval] [--count] [DEVICE...]"
+
+		var (
+			interval = cmd.IntOpt("interval", 1, "Seconds between updates")
+			count    = cmd.IntOpt("count", 0, "Stop after this many updates, 0 runs until interrupted")
+			devices  = cmd.StringsArg("DEVICE", nil, "Disks to monitor instead of all attached disks")
+		)
+
+		cmd.Action = func() {
+			err := monitorDisks(*devices, *interval, *count)
+			if err != nil {
+				fatalf("Error monitoring disks: %v", err)
+			}
 		}
 	})
 
 	app.Command("i image", "Image A Disk", func(cmd *cli.Cmd) {
-		cmd.Spec = "DEVICE OUTPUTFILE [--compress]"
+		cmd.LongDesc = commandHelp("image", "Image A Disk")
+		cmd.Spec = "DEVICE OUTPUTFILE [--compress | --auto] [--level] [--zstd-window] [--gzip-strategy] [--sse] [--sse-kms-key] [--block-size] [--queue-depth] [--limit] [--smart] [--resume] [--encrypt] [--estimate] [--yes] [--format] [--partition] [--skip-zeros] [--rescue [--read-retries] [--fill]] [--overwrite | --unique]"
 
 		var (
 			deviceToRead = cmd.StringArg("DEVICE", "", "Disk To Use")
-			outputfile   = cmd.StringArg("OUTPUTFILE", "diskimage", "File to write the Image into")
-			compress     = cmd.StringOpt("compress", "gzip", "Compression method to use (gzip, bzip2, zip, snappy, s2, zlib, zstd)")
+			outputfile   = cmd.StringArg("OUTPUTFILE", "diskimage", "File to write the Image into, or s3://, azure://, gs://, ssh:// or tcp:// URL")
+			compress     = cmd.StringOpt("compress", "gzip", "Compression method to use (gzip, bzip2, zip, snappy, s2, zlib, zstd, xz, lz4)")
+			auto         = cmd.BoolOpt("auto", false, "Compress samples of the device with each method and use the best trade of size and speed")
+			level        = cmd.IntOpt("level", 0, "Compression level, 1 for the fastest up to 9 (gzip, zlib, zip, bzip2), 22 (zstd) or 3 (s2)")
+			zstdWindow   = cmd.StringOpt("zstd-window", "", "zstd window size, a power of two like 8M, larger finds more repeats and needs more memory")
+			gzipStrategy = cmd.StringOpt("gzip-strategy", "", "Deflate strategy for gzip, zlib and zip: default, huffman or stateless")
+			sse          = cmd.StringOpt("sse", "", "Server-side encryption for s3:// outputs (AES256, aws:kms)")
+			sseKMSKey    = cmd.StringOpt("sse-kms-key", "", "KMS key for --sse aws:kms, or for gs:// outputs")
+			blockSize    = cmd.StringOpt("block-size", "", "Read block size like 1M, probed from the device if not set")
+			queueDepth   = cmd.IntOpt("queue-depth", 0, "Reads in flight, probed from the device if not set")
+			limit        = cmd.StringOpt("limit", "", "Read at most this much per second, like 50M, to leave the disk to others")
+			smart        = cmd.BoolOpt("smart", false, "Only image the blocks filesystems use (ext, FAT, NTFS) and write a block map next to the image")
+			resume       = cmd.BoolOpt("resume", false, "Continue an interrupted image from the checkpoint in its .state file")
+			encrypt      = cmd.StringOpt("encrypt", "", "Encrypt the image with a passphrase (passphrase) or to an age recipient (age1...)")
+			estimate     = cmd.IntOpt("estimate", 0, "Compress this many 1 MiB samples first to estimate the image size and time, and ask before imaging")
+			assumeYes    = cmd.BoolOpt("yes", false, "Do not ask before imaging after --estimate")
+			format       = cmd.StringOpt("format", "", "Image format instead of a compressed stream: qcow2 for QEMU, vhd, vhdx or their -fixed variants for Hyper-V")
+			partition    = cmd.IntOpt("partition", 0, "Only image partition N, clone puts the image back into the same partition")
+			skipZeros    = cmd.BoolOpt("skip-zeros", false, "Leave 1 MiB regions of zeros out of the image and list the rest in a block map next to it")
+			rescue       = cmd.BoolOpt("rescue", false, "Read around bad sectors, fill them and list them in a ddrescue map next to the image")
+			readRetries  = cmd.IntOpt("read-retries", 2, "Times to retry an unreadable sector in --rescue mode")
+			fill         = cmd.StringOpt("fill", "", "Pattern for unreadable sectors, text or 0x and hex bytes, zeros if not set")
+			overwrite    = cmd.BoolOpt("overwrite", false, "Replace an existing image and its block map, state and manifest")
+			unique       = cmd.BoolOpt("unique", false, "Write to NAME-1, NAME-2 and so on when the image exists")
 		)
 
 		cmd.Action = func() {
-			//Exit if we don't have permission to read the device
-			if !hasReadPermission(*deviceToRead) {
-				fmt.Printf("No permission to read the device: %s, try with elevated priviledges\n", *deviceToRead)
-				os.Exit(13)
-			}
+			silenceChatter()
+			checkForPerms(*deviceToRead)
 
 			if *compress == "" {
 				*compress = "gzip"
 			}
 
-			readdisk(*deviceToRead, *outputfile, *compress)
+			imaging := imageOptions{Tuning: ioTuning{QueueDepth: *queueDepth}, Smart: *smart, Resume: *resume, Encrypt: *encrypt, Estimate: *estimate, AssumeYes: *assumeYes, Partition: *partition,
+				SkipZeros: *skipZeros, Rescue: *rescue, ReadRetries: *readRetries, Fill: *fill, AutoCompress: *auto, Output: outputPolicy{Overwrite: *overwrite, Unique: *unique},
+				Compression: compressionOptions{Level: *level, GzipStrategy: *gzipStrategy}}
+			if *zstdWindow != "" {
+				size, err := parseSize(*zstdWindow, 0, 0)
+				if err != nil {
+					fatalf("Error parsing the zstd window: %v", err)
+				}
+				imaging.Compression.ZstdWindow = int(size)
+			}
+			if *blockSize != "" {
+				size, err := parseDeviceSize(*deviceToRead, *blockSize)
+				if err != nil {
+					fatalf("Error parsing block size: %v", err)
+				}
+				imaging.Tuning.BlockSize = size
+			}
+			if *limit != "" {
+				rate, err := parseSize(*limit, 0, 0)
+				if err != nil || rate <= 0 {
+					fatalf("Error parsing the limit: %q is not a size per second like 50M", *limit)
+				}
+				imaging.Tuning.Limit = rate
+			}
+
+			if *format == "" {
+				readdisk(*deviceToRead, *outputfile, *compress, outputOptions{SSE: *sse, SSEKMSKey: *sseKMSKey}, imaging)
+				return
+			}
+			if err := writeBlockImage(*deviceToRead, *outputfile, *format, imaging); err != nil {
+				fatalf("Error imaging disk: %v", err)
+			}
+		}
+	})
+
+	app.Command("image-recv", "Receive images sent to tcp:// outputs", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("image-recv", "Receive images sent to tcp:// outputs")
+		cmd.Spec = "LISTEN DIR [--count]"
+
+		var (
+			listen = cmd.StringArg("LISTEN", "", "Address to listen on, like :9000")
+			dir    = cmd.StringArg("DIR", "", "Directory to store the images in")
+			count  = cmd.IntOpt("count", 0, "Stop after this many images, 0 keeps listening (a smart image and its block map are two)")
+		)
+
+		cmd.Action = func() {
+			if err := receiveImages(*listen, *dir, *count); err != nil {
+				fatalf("Error receiving images: %v", err)
+			}
+		}
+	})
+
+	app.Command("manifest", "Show the manifest written next to an image", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("manifest", "Show the manifest written next to an image")
+		cmd.Spec = "[--json] IMAGEFILE"
+
+		var (
+			asJSON    = cmd.BoolOpt("json", false, "Print the manifest as written, in JSON")
+			imageFile = cmd.StringArg("IMAGEFILE", "", "Image, or its .manifest.json file")
+		)
+
+		cmd.Action = func() {
+			if err := showManifest(*imageFile, *asJSON); err != nil {
+				fatalf("Error showing the manifest: %v", err)
+			}
+		}
+	})
+
+	app.Command("decompress", "Turn an image taken by dsktool back into a raw image, checking it against its manifest", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--overwrite] IMAGE [OUT]"
+
+		var (
+			overwrite = cmd.BoolOpt("overwrite", false, "Replace OUT when it exists")
+			image     = cmd.StringArg("IMAGE", "", "Compressed, encrypted or smart image")
+			out       = cmd.StringArg("OUT", "", "Raw image to write, - for stdout, IMAGE without its compression extension if not set")
+		)
+
+		cmd.Action = func() {
+			if err := decompressImage(*image, *out, *overwrite); err != nil {
+				fatalf("Error decompressing image: %v", err)
+			}
+		}
+	})
+
+	app.Command("verify", "Compare an image against a disk", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("verify", "Compare an image against a disk")
+		cmd.Spec = "IMAGEFILE DEVICE"
+
+		var (
+			imageFile = cmd.StringArg("IMAGEFILE", "", "Image to compare, compressed or raw, or an http(s) URL")
+			device    = cmd.StringArg("DEVICE", "", "Disk to compare against the image")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			checkForPerms(*device)
+			if err := verifyImage(*imageFile, *device); err != nil {
+				fatalf("Error verifying image: %v", err)
+			}
+		}
+	})
+
+	app.Command("hash", "Hash a disk, a partition or a range of either", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("hash", "Hash a disk, a partition or a range of either")
+		cmd.Spec = "[--algo] [--offset] [--length] [--format] DEVICE"
+
+		var (
+			algo   = cmd.StringOpt("algo", "sha256", "Hash algorithms, comma separated (sha256, sha512, blake3, sha1, md5)")
+			offset = cmd.StringOpt("offset", "", "Start of the range, e.g. 1M, 2048s or 50%")
+			length = cmd.StringOpt("length", "", "Length of the range, up to the end if not set")
+			format = cmd.StringOpt("format", "text", "Output format (text, csv, tsv, json or a plugin format)")
+			device = cmd.StringArg("DEVICE", "", "Disk or image, or DEVICE:N for partition N")
+		)
+
+		cmd.Action = func() {
+			if err := checkOutputFormat(*format); err != nil {
+				fatalf("Error: %v", err)
+			}
+			path, _ := parsePartitionSpec(*device)
+			checkForPerms(path)
+			if err := hashDevice(*device, *algo, *offset, *length, *format); err != nil {
+				fatalf("Error hashing: %v", err)
+			}
+		}
+	})
+
+	app.Command("scrub", "Compare a disk against the chunk hashes of an earlier pass to find silent corruption", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("scrub", "Compare a disk against the chunk hashes of an earlier pass to find silent corruption")
+		cmd.Spec = "DEVICE --map [--algo] [--chunk-size] [--update]"
+
+		var (
+			device    = cmd.StringArg("DEVICE", "", "Disk or image to scrub")
+			mapFile   = cmd.StringOpt("map", "", "Hashmap JSON file, created by the first pass")
+			algo      = cmd.StringOpt("algo", "sha256", "Hash algorithm of a new hashmap (sha256, sha512, blake3)")
+			chunkSize = cmd.StringOpt("chunk-size", "4M", "Chunk size of a new hashmap")
+			update    = cmd.BoolOpt("update", false, "Accept the changes and rewrite the hashmap")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			checkForPerms(*device)
+			size, err := parseDeviceSize(*device, *chunkSize)
+			if err != nil {
+				fatalf("Error parsing chunk size: %v", err)
+			}
+			if err := scrubDevice(*device, *mapFile, *algo, size, *update); err != nil {
+				fatalf("Error scrubbing: %v", err)
+			}
+		}
+	})
+
+	app.Command("clone", "Copy a disk directly onto another disk", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--verify] [--yes] [--block-size] [--queue-depth] SRC DST"
+
+		var (
+			verify     = cmd.BoolOpt("verify", false, "Re-read both disks afterwards and compare their hashes")
+			assumeYes  = cmd.BoolOpt("yes", false, "Do not ask before overwriting DST")
+			blockSize  = cmd.StringOpt("block-size", "", "Copy block size like 1M, probed from the device if not set")
+			queueDepth = cmd.IntOpt("queue-depth", 0, "Reads in flight, probed from the device if not set")
+			src        = cmd.StringArg("SRC", "", "Disk or raw image to copy")
+			dst        = cmd.StringArg("DST", "", "Disk to overwrite, at least as large as SRC")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			checkForPerms(*dst)
+			options := cloneOptions{Verify: *verify, AssumeYes: *assumeYes, Tuning: ioTuning{QueueDepth: *queueDepth}}
+			if *blockSize != "" {
+				size, err := parseDeviceSize(*src, *blockSize)
+				if err != nil {
+					fatalf("Error parsing block size: %v", err)
+				}
+				options.Tuning.BlockSize = size
+			}
+			if err := cloneDevice(*src, *dst, options); err != nil {
+				fatalf("Error cloning disk: %v", err)
+			}
+		}
+	})
+
+	app.Command("fingerprint", "Fingerprint disks and detect clones", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--verbose] DEVICE..."
+
+		var (
+			devices = cmd.StringsArg("DEVICE", nil, "Disks or images to fingerprint, several are compared")
+			verbose = cmd.BoolOpt("verbose", false, "Show the hash of every region")
+		)
+
+		cmd.Action = func() {
+			for _, device := range *devices {
+				checkForPerms(device)
+			}
+			err := fingerprintDisks(*devices, *verbose)
+			if err != nil {
+				fatalf("Error fingerprinting: %v", err)
+			}
+		}
+	})
+
+	app.Command("tag tags", "Attach notes and tags to disks", func(cmd *cli.Cmd) {
+		cmd.Command("ls list", "List tagged disks", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				err := listDiskTags()
+				if err != nil {
+					fatalf("Error listing tags: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("add", "Tag a disk, keyed by its serial number or GPT disk GUID", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE [--note] [TAG...]"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Disk to tag")
+				note   = cmd.StringOpt("note", "", "Free form note for the disk")
+				tags   = cmd.StringsArg("TAG", nil, "Tags to add, e.g. backup-2024 \"DO NOT WIPE\"")
+			)
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				err := addDiskTags(*device, *tags, *note)
+				if err != nil {
+					fatalf("Error tagging %s: %v", *device, err)
+				}
+			}
+		})
+
+		cmd.Command("rm remove", "Remove tags from a disk, all of them if none are given", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE [TAG...]"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Disk to untag")
+				tags   = cmd.StringsArg("TAG", nil, "Tags to remove")
+			)
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				err := removeDiskTags(*device, *tags)
+				if err != nil {
+					fatalf("Error removing tags from %s: %v", *device, err)
+				}
+			}
+		})
+	})
+
+	app.Command("policy", "Show the write policy and check a device against it", func(cmd *cli.Cmd) {
+		cmd.Spec = "[DEVICE]"
+		device := cmd.StringArg("DEVICE", "", "Device to check")
+
+		cmd.Action = func() {
+			err := showPolicy(*device)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+		}
+	})
+
+	app.Command("nbd-serve", "Serve an image as an NBD export", func(cmd *cli.Cmd) {
+		cmd.Spec = "IMAGE [--listen] [--partition] [--writable]"
+
+		var (
+			imageFile = cmd.StringArg("IMAGE", "", "Raw or compressed image to serve")
+			listen    = cmd.StringOpt("listen", ":10809", "Address to listen on")
+			partition = cmd.IntOpt("partition", 0, "Only export this partition number")
+			writable  = cmd.BoolOpt("writable", false, "Allow clients to write (raw images only)")
+		)
+
+		cmd.Action = func() {
+			checkForPerms(*imageFile)
+			err := nbdServe(*imageFile, *listen, *partition, *writable)
+			if err != nil {
+				fatalf("Error serving image: %v", err)
+			}
 		}
 	})
 
-	err := app.Run(os.Args)
+	app.Command("mount-image", "Mount an image read-only using FUSE", func(cmd *cli.Cmd) {
+		cmd.Spec = "IMAGE MOUNTPOINT"
+
+		var (
+			imageFile  = cmd.StringArg("IMAGE", "", "Raw or compressed image to mount")
+			mountPoint = cmd.StringArg("MOUNTPOINT", "", "Directory to mount the image on")
+		)
+
+		cmd.Action = func() {
+			checkForPerms(*imageFile)
+			err := mountImage(*imageFile, *mountPoint)
+			if err != nil {
+				fatalf("Error mounting image: %v", err)
+			}
+		}
+	})
+
+	app.Command("help", "Show long form help on a topic, or list the topics", func(cmd *cli.Cmd) {
+		cmd.Spec = "[TOPIC] [--lang]"
+
+		var (
+			topic = cmd.StringArg("TOPIC", "", "Topic to show")
+			lang  = cmd.StringOpt("lang", "", "Language (en, de), from the locale if not set")
+		)
+
+		cmd.Action = func() {
+			if err := printHelpTopics(os.Stdout, *topic, *lang); err != nil {
+				fatalf("Error: %v", err)
+			}
+		}
+	})
+
+	app.Command("man", "Write the man page, built from the help of every command", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--lang]"
+		lang := cmd.StringOpt("lang", "", "Language (en, de), from the locale if not set")
+
+		cmd.Action = func() {
+			if err := writeManPage(os.Stdout, *lang); err != nil {
+				fatalf("Error writing the man page: %v", err)
+			}
+		}
+	})
+
+	app.Command("capabilities", "Show the features available in this build and on this platform", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--json]"
+		asJSON := cmd.BoolOpt("json", false, "Print JSON for scripts and orchestration tools")
+
+		cmd.Action = func() {
+			if err := showCapabilities(*asJSON); err != nil {
+				fatalf("Error showing capabilities: %v", err)
+			}
+		}
+	})
+
+	app.Command("selftest", "Test partitioning, filesystems, imaging and restoring on a temporary image", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--keep]"
+		keep := cmd.BoolOpt("keep", false, "Keep the temporary images and print where they are")
+
+		cmd.Action = func() {
+			if err := runSelftest(*keep); err != nil {
+				fatalf("Error: %v", err)
+			}
+		}
+	})
+
+	app.Command("mkfixture", "Write a test image with a seeded, optionally damaged, partition table", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("mkfixture", "Write a test image with a seeded, optionally damaged, partition table")
+		cmd.Spec = "[--size] [--seed] [--partitions] [--depth] [--force] FILE [KIND...]"
+
+		var (
+			size       = cmd.StringOpt("size", "64M", "Size of the image")
+			seed       = cmd.IntOpt("seed", 0, "Seed of the layout, the same seed makes the same image, picked if not set")
+			partitions = cmd.IntOpt("partitions", 0, "Number of partitions, picked from the seed if not set")
+			depth      = cmd.IntOpt("depth", 16, "Logical partitions in the extended partition of ebr-chain and ebr-loop")
+			force      = cmd.BoolOpt("force", false, "Replace FILE if it exists")
+			file       = cmd.StringArg("FILE", "", "Image file to write")
+			kinds      = cmd.StringsArg("KIND", nil, "Damage to build in: overlap, bad-header-crc, bad-entries-crc, truncated-backup, ebr-chain, ebr-loop")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			bytes, err := parseSize(*size, 512, 0)
+			if err != nil {
+				fatalf("Error parsing the size: %v", err)
+			}
+			options := fixtureOptions{Size: bytes, Seed: int64(*seed), Partitions: *partitions, Depth: *depth, Force: *force}
+			if err := makeFixture(*file, *kinds, options); err != nil {
+				fatalf("Error making the fixture: %v", err)
+			}
+		}
+	})
+
+	app.Command("plugin plugins", "Show installed plugins", func(cmd *cli.Cmd) {
+		cmd.Command("ls list", "List plugins and what they provide", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				if err := listPlugins(); err != nil {
+					fatalf("Error listing plugins: %v", err)
+				}
+			}
+		})
+	})
+
+	app.Command("wizard", "Back up a disk, restore an image or prepare a USB stick, step by step", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			if err := runWizard(); err != nil {
+				fatalf("Error: %v", err)
+			}
+		}
+	})
+
+	app.Command("batch", "Run a script of dsktool commands, e.g. a pipeline for every disk", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--set...] SCRIPT [DEVICE]"
+
+		var (
+			defines = cmd.StringsOpt("set", nil, "Define a script variable, NAME=VALUE")
+			script  = cmd.StringArg("SCRIPT", "", "Script with one command per line")
+			device  = cmd.StringArg("DEVICE", "", "Device the script works on, available as ${DEVICE}")
+		)
+
+		cmd.Action = func() {
+			err := runBatch(*script, *device, *defines)
+			if err != nil {
+				fatalf("Error running batch: %v", err)
+			}
+		}
+	})
+
+	app.Command("replay", "Show a session recorded with --record, command by command", func(cmd *cli.Cmd) {
+		cmd.Spec = "FILE"
+
+		var (
+			file = cmd.StringArg("FILE", "", "Session file written by --record")
+		)
+
+		cmd.Action = func() {
+			if err := replaySession(*file); err != nil {
+				fatalf("Error replaying session: %v", err)
+			}
+		}
+	})
+
+	app.Command("wipe", "Overwrite a disk or partition with zeros, random data or the DoD passes", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("wipe", "Overwrite a disk or partition with zeros, random data or the DoD passes")
+		cmd.Spec = "[--pattern] [--verify | --sample] [--certificate [--operator]] [--confirm] DEVICE"
+
+		var (
+			pattern     = cmd.StringOpt("pattern", "zero", "What to write: zero, random, or dod for zeros, ones and random data")
+			verify      = cmd.BoolOpt("verify", false, "Read the device back after the last pass and check it")
+			sample      = cmd.StringOpt("sample", "", "Check this percent of the device at random places after the last pass, e.g. 1")
+			certificate = cmd.StringOpt("certificate", "", "Write a certificate of the wipe to this base name, as .json and .pdf")
+			operator    = cmd.StringOpt("operator", "", "Name to sign the certificate off with")
+			confirmPath = cmd.StringOpt("confirm", "", "The device path, to wipe without typing it at the prompt")
+			device      = cmd.StringArg("DEVICE", "", "Disk or image to wipe, or DEVICE:N for partition N")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			disk, _ := parsePartitionSpec(*device)
+			checkForPerms(disk)
+			percent, err := parseSamplePercent(*sample)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+			err = wipe(*device, wipeOptions{Pattern: *pattern, Verify: *verify, Sample: percent, Confirm: *confirmPath,
+				Certificate: *certificate, Operator: *operator})
+			if err != nil {
+				fatalf("Error wiping: %v", err)
+			}
+		}
+	})
+
+	app.Command("verify-wipe", "Check a wipe certificate and sample the disk again for the data it certifies", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("verify-wipe", "Check a wipe certificate and sample the disk again for the data it certifies")
+		cmd.Spec = "[--sample] [--public-key] CERTIFICATE [DEVICE]"
+
+		var (
+			sample      = cmd.StringOpt("sample", "1", "Percent of the wiped area to read back, 100 for all of it")
+			publicKey   = cmd.StringOpt("public-key", "", "Public key in hex the certificate has to be signed with")
+			certificate = cmd.StringArg("CERTIFICATE", "", "Certificate JSON written by wipe --certificate")
+			device      = cmd.StringArg("DEVICE", "", "Disk to check, the one named in the certificate if not set")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			percent, err := parseSamplePercent(*sample)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+			if *device != "" {
+				checkForPerms(*device)
+			}
+			if err := verifyWipeCertificate(*certificate, *device, *publicKey, percent); err != nil {
+				fatalf("Error verifying wipe: %v", err)
+			}
+		}
+	})
+
+	app.Command("discard", "Discard a disk, partition or range on SSDs and thin volumes, or punch holes into an image", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("discard", "Discard a disk, partition or range on SSDs and thin volumes, or punch holes into an image")
+		cmd.Spec = "[--offset] [--length] [--secure] [--confirm] DEVICE"
+
+		var (
+			offset      = cmd.StringOpt("offset", "", "Start of the range, e.g. 1M, 2048s or 50%")
+			length      = cmd.StringOpt("length", "", "Length of the range, up to the end if not set")
+			secure      = cmd.BoolOpt("secure", false, "Have the device erase the discarded blocks too")
+			confirmPath = cmd.StringOpt("confirm", "", "The device path, to discard without typing it at the prompt")
+			device      = cmd.StringArg("DEVICE", "", "Disk or image to discard, or DEVICE:N for partition N")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			disk, _ := parsePartitionSpec(*device)
+			checkForPerms(disk)
+			err := discard(*device, discardOptions{Offset: *offset, Length: *length, Secure: *secure, Confirm: *confirmPath})
+			if err != nil {
+				fatalf("Error discarding: %v", err)
+			}
+		}
+	})
+
+	app.Command("write-bootloader", "Write a bootloader like U-Boot or an SPL at a raw offset, clear of the partition table and partitions", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("write-bootloader", "Write a bootloader like U-Boot or an SPL at a raw offset, clear of the partition table and partitions")
+		cmd.Spec = "--offset [--confirm] FILE DEVICE"
+
+		var (
+			offset      = cmd.StringOpt("offset", "", "Where the bootloader goes, e.g. 8K or 64s")
+			confirmPath = cmd.StringOpt("confirm", "", "The device path, to write without typing it at the prompt")
+			file        = cmd.StringArg("FILE", "", "Bootloader blob, like u-boot-sunxi-with-spl.bin")
+			device      = cmd.StringArg("DEVICE", "", "Disk or image to write it to")
+		)
+
+		cmd.Action = func() {
+			checkForPerms(*device)
+			if err := writeBootloader(*file, *device, *offset, *confirmPath); err != nil {
+				fatalf("Error writing the bootloader: %v", err)
+			}
+		}
+	})
+
+	app.Command("secure-erase", "Have a drive erase itself with the ATA security erase or NVMe format and sanitize", func(cmd *cli.Cmd) {
+		cmd.LongDesc = commandHelp("secure-erase", "Have a drive erase itself with the ATA security erase or NVMe format and sanitize")
+		cmd.Spec = "[--info | [--method] [--confirm]] DEVICE"
+
+		var (
+			info        = cmd.BoolOpt("info", false, "Show the erase commands the drive supports and its state, without erasing")
+			method      = cmd.StringOpt("method", "", "ata, ata-enhanced, sanitize-crypto, sanitize-block, sanitize-overwrite, format or format-crypto, the best supported if not set")
+			confirmPath = cmd.StringOpt("confirm", "", "The device path, to erase without typing it at the prompt")
+			device      = cmd.StringArg("DEVICE", "", "Drive to erase")
+		)
+
+		cmd.Action = func() {
+			if !*info {
+				silenceChatter()
+			}
+			checkForPerms(*device)
+			if err := secureErase(*device, secureEraseOptions{Method: *method, Info: *info, Confirm: *confirmPath}); err != nil {
+				fatalf("Error erasing: %v", err)
+			}
+		}
+	})
+
+	app.Command("refurb", "Wipe, scan and SMART check a disk and write a condition report", func(cmd *cli.Cmd) {
+		cmd.Spec = "--operator [--report] [--skip-wipe] [--skip-scan] [--yes] DEVICE"
+
+		var (
+			operator  = cmd.StringOpt("operator", "", "Name of the technician signing off the report")
+			report    = cmd.StringOpt("report", "", "Report path without extension, a .json and a .pdf are written")
+			skipWipe  = cmd.BoolOpt("skip-wipe", false, "Do not wipe the disk")
+			skipScan  = cmd.BoolOpt("skip-scan", false, "Do not read scan the disk")
+			assumeYes = cmd.BoolOpt("yes", false, "Do not ask before wiping")
+			device    = cmd.StringArg("DEVICE", "", "Device to refurbish")
+		)
+
+		cmd.Action = func() {
+			silenceChatter()
+			checkForPerms(*device)
+			err := refurbDisk(*device, refurbOptions{
+				Operator:  *operator,
+				Report:    *report,
+				SkipWipe:  *skipWipe,
+				SkipScan:  *skipScan,
+				AssumeYes: *assumeYes,
+			})
+			if err != nil {
+				fatalf("Error refurbishing disk: %v", err)
+			}
+		}
+	})
+
+	app.Command("nvme", "Show NVMe controller, namespace and health information", func(cmd *cli.Cmd) {
+		cmd.Command("info", "Show the model, firmware, LBA formats, wear and media errors of an NVMe namespace", func(cmd *cli.Cmd) {
+			cmd.LongDesc = commandHelp("nvme info", "Show the model, firmware, LBA formats, wear and media errors of an NVMe namespace")
+			cmd.Spec = "[--json] DEVICE"
+
+			var (
+				asJSON = cmd.BoolOpt("json", false, "Print the information as JSON")
+				device = cmd.StringArg("DEVICE", "", "NVMe namespace like /dev/nvme0n1")
+			)
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				if err := showNVMeInfo(*device, *asJSON); err != nil {
+					fatalf("Error reading NVMe information: %v", err)
+				}
+			}
+		})
+	})
+
+	app.Command("wsl", "Show how the disks inside WSL map to Windows disks", func(cmd *cli.Cmd) {
+		cmd.Command("disks", "List the disks of WSL 2, what each is and the Windows drive of attached disks", func(cmd *cli.Cmd) {
+			cmd.LongDesc = commandHelp("wsl disks", "List the disks of WSL 2, what each is and the Windows drive of attached disks")
+
+			cmd.Action = func() {
+				if err := showWSLDisks(); err != nil {
+					fatalf("Error listing the WSL disks: %v", err)
+				}
+			}
+		})
+	})
+
+	app.Command("fs", "Browse and create filesystems without mounting them", func(cmd *cli.Cmd) {
+		cmd.Command("ls", "List a directory", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE [PATH]"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Device or image, DEVICE:N for partition N")
+				path   = cmd.StringArg("PATH", "/", "Path inside the filesystem")
+			)
+
+			cmd.Action = func() {
+				devicePath, _ := parsePartitionSpec(*device)
+				checkForPerms(devicePath)
+				err := fsList(*device, *path)
+				if err != nil {
+					fatalf("Error listing %s: %v", *path, err)
+				}
+			}
+		})
+
+		cmd.Command("cp", "Copy files out of a filesystem", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE PATH DESTINATION"
+
+			var (
+				device      = cmd.StringArg("DEVICE", "", "Device or image, DEVICE:N for partition N")
+				path        = cmd.StringArg("PATH", "", "File or directory inside the filesystem")
+				destination = cmd.StringArg("DESTINATION", "", "Local path to copy to")
+			)
+
+			cmd.Action = func() {
+				devicePath, _ := parsePartitionSpec(*device)
+				checkForPerms(devicePath)
+				err := fsCopy(*device, *path, *destination)
+				if err != nil {
+					fatalf("Error copying %s: %v", *path, err)
+				}
+			}
+		})
+
+		cmd.Command("deleted", "List deleted files (FAT and NTFS)", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE [--extract]"
+
+			var (
+				device  = cmd.StringArg("DEVICE", "", "Device or image, DEVICE:N for partition N")
+				extract = cmd.StringOpt("extract", "", "Directory to copy recoverable files to")
+			)
+
+			cmd.Action = func() {
+				devicePath, _ := parsePartitionSpec(*device)
+				checkForPerms(devicePath)
+				err := fsListDeleted(*device, *extract)
+				if err != nil {
+					fatalf("Error listing deleted files: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("mkfs", "Create a filesystem (fat32 and fat16 natively, others with the system tools)", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--label] DEVICE TYPE"
+
+			var (
+				label  = cmd.StringOpt("label", "", "Volume label")
+				device = cmd.StringArg("DEVICE", "", "Device or image, DEVICE:N for partition N")
+				fstype = cmd.StringArg("TYPE", "", "Filesystem (fat32, fat16, ext4, xfs, btrfs, ntfs, swap)")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				devicePath, _ := parsePartitionSpec(*device)
+				checkForPerms(devicePath)
+				err := makeFileSystem(*device, *fstype, *label, os.Stdout)
+				if err != nil {
+					fatalf("Error creating filesystem: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("label", "Set the label of an ext, FAT or exFAT filesystem", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE LABEL"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Device or image, DEVICE:N for partition N")
+				label  = cmd.StringArg("LABEL", "", "New label, \"\" to remove it")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				devicePath, _ := parsePartitionSpec(*device)
+				checkForPerms(devicePath)
+				if err := setFileSystemLabel(*device, *label); err != nil {
+					fatalf("Error setting the label: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("uuid", "Set the UUID of an ext filesystem or the serial number of a FAT or exFAT one", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE [ID]"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Device or image, DEVICE:N for partition N")
+				id     = cmd.StringArg("ID", "random", "New UUID, or XXXX-XXXX serial number for FAT and exFAT")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				devicePath, _ := parsePartitionSpec(*device)
+				checkForPerms(devicePath)
+				if err := setFileSystemID(*device, *id); err != nil {
+					fatalf("Error setting the UUID: %v", err)
+				}
+			}
+		})
+	})
+
+	app.Command("table pt", "Back up, restore, repair, compare and apply partition tables", func(cmd *cli.Cmd) {
+		cmd.Command("backup", "Save the GPT in the sgdisk --backup format, or the MBR with its EBR chain, to a file", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE FILE"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Device or image to back up")
+				file   = cmd.StringArg("FILE", "", "Backup file to write")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := backupPartitionTable(*device, *file); err != nil {
+					fatalf("Error backing up partition table: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("restore", "Write the GPT or the MBR and EBRs from a dsktool or sgdisk backup file", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] FILE DEVICE"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				file      = cmd.StringArg("FILE", "", "Backup file to restore")
+				device    = cmd.StringArg("DEVICE", "", "Device or image to write the table to")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := restorePartitionTable(*file, *device, *assumeYes); err != nil {
+					fatalf("Error restoring partition table: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("repair", "Rewrite a damaged GPT from the intact copy, or a GPT written for another sector size", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] DEVICE"
+
+			var (
+				assumeYes = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				device    = cmd.StringArg("DEVICE", "", "Device or image to repair")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := repairPartitionTable(*device, *assumeYes); err != nil {
+					fatalf("Error repairing partition table: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("dump", "Describe the partition table as an sfdisk script that table apply reads back", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE"
+
+			var device = cmd.StringArg("DEVICE", "", "Device or image to describe")
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				if err := dumpLayout(os.Stdout, *device); err != nil {
+					fatalf("Error dumping partition table: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("apply", "Replace the partition table with a layout in the sfdisk script format", func(cmd *cli.Cmd) {
+			cmd.Spec = "[--yes] [--storage-config] DEVICE [FILE]"
+
+			var (
+				assumeYes     = cmd.BoolOpt("yes", false, "Do not ask for confirmation")
+				storageConfig = cmd.StringOpt("storage-config", "", "Also write a curtin/cloud-init storage config of the result to this file")
+				device        = cmd.StringArg("DEVICE", "", "Device or image to partition")
+				file          = cmd.StringArg("FILE", "", "Layout script, read from stdin if not given")
+			)
+
+			cmd.Action = func() {
+				silenceChatter()
+				checkForPerms(*device)
+				if err := applyLayout(*device, *file, *assumeYes); err != nil {
+					fatalf("Error applying layout: %v", err)
+				}
+				if *storageConfig != "" && !dryRun {
+					if err := writeStorageConfig(*device, *storageConfig); err != nil {
+						fatalf("Error writing storage config: %v", err)
+					}
+				}
+			}
+		})
+
+		cmd.Command("diff", "Compare the partitions with a baseline saved with p DEVICE --format json", func(cmd *cli.Cmd) {
+			cmd.LongDesc = commandHelp("table diff", "Compare the partitions with a baseline saved with p DEVICE --format json")
+			cmd.Spec = "DEVICE BASELINE"
+
+			var (
+				device   = cmd.StringArg("DEVICE", "", "Device or image to check")
+				baseline = cmd.StringArg("BASELINE", "", "Partition list saved with dsktool p DEVICE --format json")
+			)
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				if err := showPartitionBaselineDiff(*device, *baseline); err != nil {
+					fatalf("Error comparing the partitions: %v", err)
+				}
+			}
+		})
+
+		cmd.Command("storage-config", "Describe the partitions and filesystems as a curtin/cloud-init storage config", func(cmd *cli.Cmd) {
+			cmd.Spec = "DEVICE [FILE]"
+
+			var (
+				device = cmd.StringArg("DEVICE", "", "Device or image to describe")
+				file   = cmd.StringArg("FILE", "", "YAML file to write, stdout if not given")
+			)
+
+			cmd.Action = func() {
+				checkForPerms(*device)
+				if err := writeStorageConfig(*device, *file); err != nil {
+					fatalf("Error writing storage config: %v", err)
+				}
+			}
+		})
+	})
+
+	args, err := resolveDeviceArgs(os.Args)
+	if err != nil {
+		fatalf("Error: %v", err)
+	}
+	err = app.Run(args)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
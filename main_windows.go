@@ -1,11 +1,10 @@
 package main
 
 import (
-	"compress/gzip"
 	"fmt"
 	"os"
+	"os/exec"
 	"strings"
-	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -36,10 +35,9 @@ func listPartitions(diskDevice string) {
 		0)
 
 	if err != nil {
-		if err == windows.ERROR_ACCESS_DENIED {
-			fmt.Println("Access denied. Please run as administrator")
-		} else {
-			fmt.Printf("Error opening disk: %v\n", err)
+		fmt.Printf("Error opening disk: %v\n", err)
+		if isPermissionError(err) {
+			offerElevation("Reading " + physicalDrive)
 		}
 		return
 	}
@@ -106,10 +104,7 @@ func driveLetterToDiskNumber(driveLetter string) (int, error) {
 		0)
 
 	if err != nil {
-		if err == windows.ERROR_ACCESS_DENIED {
-			return -1, fmt.Errorf("Access denied. Please run as administrator")
-		}
-		return -1, fmt.Errorf("Error opening volume: %v", err)
+		return -1, fmt.Errorf("Error opening volume: %w", err)
 	}
 	defer windows.CloseHandle(volumeHandle)
 
@@ -161,58 +156,108 @@ func listDisks() {
 
 	for i := 0; i < 26; i++ {
 		if driveBits&(1<<uint(i)) != 0 {
-			driveLetter := string('A' + i)
+			driveLetter := string(rune('A' + i))
 			fmt.Printf("%s:\\\n", driveLetter)
 		}
 	}
-}
 
-func readdisk(device, outputfile, compressionAlgorithm string) {
-	devicename, err := syscall.UTF16PtrFromString(fmt.Sprintf("\\\\.\\%s", device))
+	disks, _ := discoverDisks()
+	for _, disk := range disks {
+		line := disk
+		if size, err := getBlockDeviceSize(disk); err == nil {
+			line += " - Total: " + formatBytes(size)
+		}
+		if inv := readDiskInventory(disk); inv.known() {
+			line += " [" + inv.describe() + "]"
+		}
+		fmt.Println(line)
+	}
+}
 
-	// Open the disk device file using the syscall package
-	disk, err := syscall.CreateFile(
-		devicename,
-		syscall.GENERIC_READ,
-		syscall.FILE_SHARE_READ,
-		nil,
-		syscall.OPEN_EXISTING,
-		syscall.FILE_ATTRIBUTE_NORMAL,
-		0,
-	)
+// openDiskForImaging opens a device or image for readdisk with its size.
+// Bare names like PhysicalDrive1 or C: get the \\.\ prefix of device
+// paths, image files are opened as they are.
+func openDiskForImaging(device string) (*os.File, int64, error) {
+	path := device
+	name := strings.ToLower(device)
+	if strings.HasPrefix(name, "physicaldrive") || len(name) == 2 && name[1] == ':' {
+		path = `\\.\` + device
+	}
+	disk, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := getFileSize(disk)
 	if err != nil {
-		// Handle error
+		disk.Close()
+		return nil, 0, fmt.Errorf("getting the size of %s: %v", path, err)
 	}
-	defer syscall.CloseHandle(disk)
+	return disk, size, nil
+}
 
-	// Create a new file to write the data to
-	output, err := os.Create(outputfile)
+// getBlockDeviceSize returns the size of a physical drive
+func getBlockDeviceSize(devPath string) (int64, error) {
+	f, err := os.Open(devPath)
 	if err != nil {
-		// Handle error
+		return 0, err
 	}
-	defer output.Close()
+	defer f.Close()
 
-	// Create a gzip writer
-	gzipWriter := gzip.NewWriter(output)
-	defer gzipWriter.Close()
+	return getFileSize(f)
+}
 
-	// Use a buffer to read the data from the disk and write it to the file
-	buf := make([]byte, 1024)
-	for {
-		var n uint32
-		err := syscall.ReadFile(disk, buf, &n, nil)
-		if err != nil {
-			break
-		}
-		gzipWriter.Write(buf[:n])
+// getFileSize returns the size of a regular file, or of a physical drive using the drive geometry
+func getFileSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err == nil && info.Mode().IsRegular() {
+		return info.Size(), nil
 	}
+
+	var diskGeometry DiskGeometryEx
+	err = windows.DeviceIoControl(
+		windows.Handle(f.Fd()),
+		IOCTL_DISK_GET_DRIVE_GEOMETRY_EX,
+		nil,
+		0,
+		(*byte)(unsafe.Pointer(&diskGeometry)),
+		uint32(unsafe.Sizeof(diskGeometry)),
+		nil,
+		nil)
+	if err != nil {
+		return 0, fmt.Errorf("error getting disk geometry: %v", err)
+	}
+	return diskGeometry.DiskSize, nil
+}
+
+// getSectorSize returns the logical sector size of a physical drive, 512 for files
+func getSectorSize(f *os.File) int {
+	var diskGeometry DiskGeometryEx
+	err := windows.DeviceIoControl(
+		windows.Handle(f.Fd()),
+		IOCTL_DISK_GET_DRIVE_GEOMETRY_EX,
+		nil,
+		0,
+		(*byte)(unsafe.Pointer(&diskGeometry)),
+		uint32(unsafe.Sizeof(diskGeometry)),
+		nil,
+		nil)
+	if err != nil || diskGeometry.Geometry.BytesPerSector == 0 {
+		return 512
+	}
+	return int(diskGeometry.Geometry.BytesPerSector)
+}
+
+// partitionUsage is not known on Windows yet
+func partitionUsage(path string) string {
+	return "not checked on Windows"
 }
 
 func printDiskBytes(diskDevice string, numOfBytes int, startIndex int64) {
 	fmt.Println("Windows unsupported for now")
 }
 
-func hasReadPermission(device string) bool {
+// readAccess opens the device for reading to find out whether that is allowed
+func readAccess(device string) error {
 	// Handle default case
 	if device == "." {
 		device = `\\.\PhysicalDrive0`
@@ -228,13 +273,10 @@ func hasReadPermission(device string) bool {
 		0,
 	)
 	if err != nil {
-		if err == windows.ERROR_ACCESS_DENIED {
-			fmt.Println("Access denied. Please run with administrator privileges.")
-		}
-		return false
+		return &os.PathError{Op: "open", Path: device, Err: err}
 	}
 	windows.CloseHandle(h)
-	return true
+	return nil
 }
 
 // Function to check if running with admin privileges
@@ -267,12 +309,134 @@ func isAdmin() bool {
 	return isMember
 }
 
-// Helper function to check and report admin status
-func checkAdminStatus() bool {
-	if !isAdmin() {
-		fmt.Println("This program requires administrator privileges.")
-		fmt.Println("Please right-click and select 'Run as administrator'.")
-		return false
+// diskSerial is not implemented on Windows yet, disks are identified by their GPT GUID
+func diskSerial(device string) string {
+	return ""
+}
+
+// diskWWN is not implemented on Windows yet
+func diskWWN(device string) string {
+	return ""
+}
+
+// devicesByLabel returns the drive letters of the volumes with the label
+func devicesByLabel(label string) ([]string, error) {
+	var matches []string
+	for i := 0; i < 26; i++ {
+		root := string(rune('A'+i)) + `:\`
+		rootPtr, err := windows.UTF16PtrFromString(root)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]uint16, windows.MAX_PATH+1)
+		if windows.GetVolumeInformation(rootPtr, &name[0], uint32(len(name)), nil, nil, nil, nil, 0) != nil {
+			continue
+		}
+		// Windows volume labels are not case sensitive
+		if strings.EqualFold(windows.UTF16ToString(name), label) {
+			matches = append(matches, root[:2])
+		}
+	}
+	return matches, nil
+}
+
+// systemConfigDir is where administrators put machine wide configuration
+func systemConfigDir() string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		return ""
+	}
+	return programData + `\dsktool`
+}
+
+// shellCommand runs a command line with cmd.exe
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd.exe", "/C", command)
+}
+
+// pauseSignals returns the signals that pause an operation, Windows has none
+func pauseSignals() []os.Signal {
+	return nil
+}
+
+// isTerminal reports whether f is attached to a console
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
+}
+
+// rereadPartitionTable asks Windows to pick up a new partition table
+func rereadPartitionTable(file *os.File) error {
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+		return nil
+	}
+	var bytesReturned uint32
+	return windows.DeviceIoControl(windows.Handle(file.Fd()), IOCTL_DISK_UPDATE_PROPERTIES, nil, 0, nil, 0, &bytesReturned, nil)
+}
+
+// listDisksTree falls back to the drive letter listing, Windows has no partition hierarchy view yet
+func listDisksTree() {
+	listDisks()
+}
+
+// getFsSpace returns total, used, and free space of the volume a path is on
+func getFsSpace(path string) (total, used, free int64, err error) {
+	var available, size, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(windows.StringToUTF16Ptr(path), &available, &size, &totalFree); err != nil {
+		return 0, 0, 0, err
+	}
+	return int64(size), int64(size - totalFree), int64(available), nil
+}
+
+// storedOnDevice is not checked on Windows yet
+func storedOnDevice(dir, device string) (bool, error) {
+	return false, nil
+}
+
+// diskRecords returns one record per drive letter
+func diskRecords() ([][]string, error) {
+	driveBits, err := windows.GetLogicalDrives()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	for i := 0; i < 26; i++ {
+		if driveBits&(1<<uint(i)) == 0 {
+			continue
+		}
+		root := string(rune('A'+i)) + `:\`
+		var free, total, totalFree uint64
+		var totalStr, usedStr, freeStr string
+		if windows.GetDiskFreeSpaceEx(windows.StringToUTF16Ptr(root), &free, &total, &totalFree) == nil {
+			totalStr = fmt.Sprint(total)
+			usedStr = fmt.Sprint(total - totalFree)
+			freeStr = fmt.Sprint(totalFree)
+		}
+		rows = append(rows, []string{root, "", "volume", totalStr, "", "", root, totalStr, usedStr, freeStr, "", "", "", "", "", "", ""})
+	}
+
+	disks, _ := discoverDisks()
+	for _, disk := range disks {
+		size := ""
+		if n, err := getBlockDeviceSize(disk); err == nil {
+			size = fmt.Sprint(n)
+		}
+		inv := readDiskInventory(disk)
+		rows = append(rows, []string{disk, "", "disk", size, "", "", "", "", "", "", inv.Serial, "", inv.Vendor, inv.Model, inv.WWN, inv.Media, inv.Transport})
+	}
+	return rows, nil
+}
+
+// discoverDisks returns the physical drives that can be opened
+func discoverDisks() ([]string, error) {
+	var paths []string
+	for i := 0; i < 32; i++ {
+		path := fmt.Sprintf(`\\.\PhysicalDrive%d`, i)
+		if f, err := os.Open(path); err == nil {
+			f.Close()
+			paths = append(paths, path)
+		}
 	}
-	return true
+	return paths, nil
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// imageManifest describes an image and the disk it was taken of, written
+// next to the image when imaging finishes
+type imageManifest struct {
+	Image       string         `json:"image"`
+	Device      string         `json:"device"`
+	Serial      string         `json:"serial,omitempty"`
+	DeviceSize  int64          `json:"device_size"`
+	SectorSize  uint64         `json:"sector_size"`
+	Format      string         `json:"format,omitempty"` // qcow2, vhd or vhdx, empty for compressed streams
+	Compression string         `json:"compression,omitempty"`
+	Encrypted   bool           `json:"encrypted,omitempty"`
+	Smart       bool           `json:"smart,omitempty"`
+	Partition   int            `json:"partition,omitempty"`
+	SkipZeros   bool           `json:"skip_zeros,omitempty"`
+	Imaged      int64          `json:"imaged_bytes"`
+	Written     int64          `json:"written_bytes"`
+	SHA256      string         `json:"sha256,omitempty"` // of the imaged data
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+	Duration    float64        `json:"duration_seconds"`
+	Version     string         `json:"dsktool_version"`
+	Table       *manifestTable `json:"partition_table,omitempty"`
+	TableError  string         `json:"partition_table_error,omitempty"`
+	Warnings    []warning      `json:"warnings,omitempty"` // noticed while imaging
+}
+
+// manifestTable is the partition table of the imaged disk
+type manifestTable struct {
+	Type       string              `json:"type"`
+	SectorSize uint64              `json:"sector_size"`
+	DiskGUID   string              `json:"disk_guid,omitempty"`
+	Partitions []manifestPartition `json:"partitions"`
+}
+
+// manifestPartition is a partition of the imaged disk and its filesystem
+type manifestPartition struct {
+	Number     int    `json:"number"`
+	FirstLBA   uint64 `json:"first_lba"`
+	LastLBA    uint64 `json:"last_lba"`
+	Size       int64  `json:"size"`
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	GUID       string `json:"guid,omitempty"`
+	FileSystem string `json:"filesystem,omitempty"`
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+}
+
+// manifestPath is where the manifest of an image is written
+func manifestPath(image string) string {
+	return image + ".manifest.json"
+}
+
+// newImageManifest starts the manifest of an image of device, with the
+// partition table and filesystems read from r
+func newImageManifest(device, image string, r io.ReaderAt, size int64, sectorSize uint64) *imageManifest {
+	m := &imageManifest{
+		Image:      image,
+		Device:     device,
+		Serial:     diskSerial(device),
+		DeviceSize: size,
+		SectorSize: sectorSize,
+		Started:    time.Now(),
+		Version:    appversion,
+	}
+	table, err := readPartitionTable(r, sectorSize)
+	if err != nil {
+		m.TableError = err.Error()
+		return m
+	}
+	m.Table = &manifestTable{Type: table.Type, SectorSize: table.SectorSize, Partitions: []manifestPartition{}}
+	if table.Header != nil {
+		m.Table.DiskGUID = formatGUID(table.Header.DiskGUID)
+	}
+	for _, part := range table.Partitions {
+		offset, length := int64(part.FirstLBA*table.SectorSize), part.Size(table.SectorSize)
+		p := manifestPartition{
+			Number:     part.Number,
+			FirstLBA:   part.FirstLBA,
+			LastLBA:    part.LastLBA,
+			Size:       length,
+			Type:       partitionTypeName(part),
+			Name:       part.Name,
+			FileSystem: identifyFileSystem(r, offset, length),
+		}
+		if part.GPT != nil {
+			p.GUID = formatGUID(part.GPT.UniqueGUID)
+		}
+		if fsys, err := openFileSystem(io.NewSectionReader(r, offset, length), length); err == nil {
+			p.Label, p.UUID = volumeLabel(fsys), volumeID(fsys)
+		}
+		m.Table.Partitions = append(m.Table.Partitions, p)
+	}
+	return m
+}
+
+// finish records the end of the imaging and writes the manifest next to the image
+func (m *imageManifest) finish(options outputOptions, imaged, written int64, hash []byte) error {
+	m.Finished = time.Now()
+	m.Duration = m.Finished.Sub(m.Started).Seconds()
+	m.Imaged, m.Written = imaged, written
+	m.Warnings = currentWarnings()
+	if hash != nil {
+		m.SHA256 = fmt.Sprintf("%x", hash)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	output, err := createOutput(manifestPath(m.Image), options)
+	if err != nil {
+		return err
+	}
+	if _, err := output.Write(append(data, '\n')); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// readManifest reads the manifest of an image, or a manifest file given itself
+func readManifest(path string) (*imageManifest, error) {
+	if !strings.HasSuffix(path, ".manifest.json") {
+		path = manifestPath(path)
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s has no manifest, images written by older versions have none", strings.TrimSuffix(path, ".manifest.json"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m imageManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// showManifest prints the manifest of an image, as written or readable
+func showManifest(path string, asJSON bool) error {
+	m, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	fmt.Printf("Image:        %s\n", m.Image)
+	fmt.Printf("Device:       %s, %s, %d byte sectors\n", m.Device, formatBytes(m.DeviceSize), m.SectorSize)
+	if m.Serial != "" {
+		fmt.Printf("Serial:       %s\n", m.Serial)
+	}
+	var kind []string
+	if m.Format != "" {
+		kind = append(kind, m.Format)
+	}
+	if m.Compression != "" {
+		kind = append(kind, m.Compression+" compressed")
+	}
+	if m.Encrypted {
+		kind = append(kind, "encrypted")
+	}
+	if m.Smart {
+		kind = append(kind, "smart")
+	}
+	if m.Partition > 0 {
+		kind = append(kind, fmt.Sprintf("partition %d", m.Partition))
+	}
+	if m.SkipZeros {
+		kind = append(kind, "zeros left out")
+	}
+	if len(kind) > 0 {
+		fmt.Printf("Image kind:   %s\n", strings.Join(kind, ", "))
+	}
+	fmt.Printf("Imaged:       %s, %s written\n", formatBytes(m.Imaged), formatBytes(m.Written))
+	if m.SHA256 != "" {
+		fmt.Printf("SHA-256:      %s\n", m.SHA256)
+	}
+	fmt.Printf("Taken:        %s, in %s\n", m.Started.Local().Format(time.DateTime),
+		(time.Duration(m.Duration * float64(time.Second))).Truncate(time.Second))
+	fmt.Printf("By:           dsktool %s\n", m.Version)
+	for _, w := range m.Warnings {
+		fmt.Printf("%sWarning:      %s (%s)%s\n", yellow, w.Message, w.Code, reset)
+	}
+
+	if m.Table == nil {
+		fmt.Printf("Partitions:   none read, %s\n", m.TableError)
+		return nil
+	}
+	fmt.Printf("Partitions:   %s", m.Table.Type)
+	if m.Table.DiskGUID != "" {
+		fmt.Printf(", disk GUID %s", m.Table.DiskGUID)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  #\tStart\tEnd\tSize\tType\tFilesystem\tLabel\tUUID")
+	for _, p := range m.Table.Partitions {
+		fmt.Fprintf(w, "  %d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", p.Number, p.FirstLBA, p.LastLBA,
+			formatBytes(p.Size), p.Type, p.FileSystem, p.Label, p.UUID)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// MBR tables are backed up raw: the MBR in the first 512 byte block, a
+// header block naming the format, the sector size and the number of EBRs,
+// then each EBR of the extended partition as its LBA and its 512 bytes.
+// The CRC32 in the header covers the MBR and the EBR records.
+
+// mbrBackupSignature marks a backup of an MBR and its EBR chain
+const mbrBackupSignature = "DSKTOOL MBR+EBR\x00"
+
+// maxEBRs stops walking an EBR chain that goes on and on
+const maxEBRs = 1024
+
+// mbrBackupHeader is the second block of an MBR backup
+type mbrBackupHeader struct {
+	Signature  [16]byte
+	Version    uint32
+	SectorSize uint32
+	EBRs       uint32
+	CRC32      uint32
+}
+
+// ebrRecord is an EBR and the LBA it was read from
+type ebrRecord struct {
+	LBA  uint64
+	Data [sgdiskBlockSize]byte
+}
+
+// isExtendedType reports whether an MBR partition type is an extended partition
+func isExtendedType(t uint8) bool {
+	return t == 0x05 || t == 0x0f || t == 0x85
+}
+
+// readEBRChain reads the EBRs of the extended partition of an MBR, following
+// the links from one to the next. A chain that links back on itself ends
+// where it loops.
+func readEBRChain(image *diskImage, mbr mbrStruct) ([]ebrRecord, error) {
+	var base uint64
+	for _, p := range mbr.Partitions {
+		if isExtendedType(p.Type) {
+			base = uint64(p.FirstSector)
+			break
+		}
+	}
+	if base == 0 {
+		return nil, nil
+	}
+
+	sectorSize := int64(image.SectorSize)
+	var records []ebrRecord
+	seen := map[uint64]bool{}
+	for lba := base; ; {
+		if seen[lba] {
+			warnf(warnEBRLoop, image.Path, "the EBR chain links back to LBA %d, the loop is kept as it is", lba)
+			return records, nil
+		}
+		if len(records) == maxEBRs {
+			return nil, fmt.Errorf("the EBR chain has more than %d links", maxEBRs)
+		}
+		seen[lba] = true
+
+		var record ebrRecord
+		record.LBA = lba
+		if int64(lba)*sectorSize+sgdiskBlockSize > image.Size {
+			return nil, fmt.Errorf("the EBR at LBA %d is past the end of the disk", lba)
+		}
+		if _, err := image.ReadAt(record.Data[:], int64(lba)*sectorSize); err != nil {
+			return nil, fmt.Errorf("reading the EBR at LBA %d: %v", lba, err)
+		}
+		if record.Data[510] != 0x55 || record.Data[511] != 0xaa {
+			return nil, fmt.Errorf("the EBR at LBA %d has no boot signature", lba)
+		}
+		records = append(records, record)
+
+		// The second entry links to the next EBR, relative to the extended partition
+		next := record.Data[462:478]
+		if !isExtendedType(next[4]) {
+			return records, nil
+		}
+		lba = base + uint64(binary.LittleEndian.Uint32(next[8:]))
+	}
+}
+
+// backupMBR saves the MBR and the EBR chain of a device or image to file
+func backupMBR(image *diskImage, table *partitionTable, device, file string) error {
+	mbr := make([]byte, sgdiskBlockSize)
+	if _, err := image.ReadAt(mbr, 0); err != nil {
+		return fmt.Errorf("reading MBR: %v", err)
+	}
+	ebrs, err := readEBRChain(image, table.MBR)
+	if err != nil {
+		return err
+	}
+
+	var records bytes.Buffer
+	records.Write(mbr)
+	for _, ebr := range ebrs {
+		binary.Write(&records, binary.LittleEndian, ebr)
+	}
+	header := mbrBackupHeader{
+		Version:    1,
+		SectorSize: uint32(image.SectorSize),
+		EBRs:       uint32(len(ebrs)),
+		CRC32:      crc32.ChecksumIEEE(records.Bytes()),
+	}
+	copy(header.Signature[:], mbrBackupSignature)
+
+	block := make([]byte, sgdiskBlockSize)
+	var encoded bytes.Buffer
+	binary.Write(&encoded, binary.LittleEndian, header)
+	copy(block, encoded.Bytes())
+
+	out := bytes.NewBuffer(nil)
+	out.Write(mbr)
+	out.Write(block)
+	out.Write(records.Bytes()[sgdiskBlockSize:])
+	if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Saved the MBR of %s with %d partitions and %d EBRs to %s\n", device, len(table.Partitions), len(ebrs), file)
+	return nil
+}
+
+// isMBRBackup reports whether a backup file holds an MBR and its EBR chain
+func isMBRBackup(data []byte) bool {
+	return len(data) >= 2*sgdiskBlockSize &&
+		string(data[sgdiskBlockSize:sgdiskBlockSize+len(mbrBackupSignature)]) == mbrBackupSignature
+}
+
+// loadMBRBackup parses an MBR backup, checking its CRC
+func loadMBRBackup(file string, data []byte) (mbr []byte, ebrs []ebrRecord, sectorSize uint32, err error) {
+	var header mbrBackupHeader
+	binary.Read(bytes.NewReader(data[sgdiskBlockSize:]), binary.LittleEndian, &header)
+	if header.Version != 1 {
+		return nil, nil, 0, fmt.Errorf("%s is an MBR backup of version %d, this dsktool reads version 1", file, header.Version)
+	}
+	recordSize := binary.Size(ebrRecord{})
+	want := 2*sgdiskBlockSize + int(header.EBRs)*recordSize
+	if header.EBRs > maxEBRs || len(data) < want {
+		return nil, nil, 0, fmt.Errorf("%s is truncated, it has %d of %d bytes", file, len(data), want)
+	}
+	records := append(append([]byte(nil), data[:sgdiskBlockSize]...), data[2*sgdiskBlockSize:want]...)
+	if crc32.ChecksumIEEE(records) != header.CRC32 {
+		return nil, nil, 0, fmt.Errorf("the MBR backup in %s has a bad CRC, the file is damaged", file)
+	}
+
+	ebrs = make([]ebrRecord, header.EBRs)
+	if err := binary.Read(bytes.NewReader(data[2*sgdiskBlockSize:want]), binary.LittleEndian, ebrs); err != nil {
+		return nil, nil, 0, err
+	}
+	return data[:sgdiskBlockSize], ebrs, header.SectorSize, nil
+}
+
+// restoreMBR writes an MBR and its EBR chain from a backup file to a device
+func restoreMBR(file string, data []byte, device string, assumeYes bool) error {
+	mbr, ebrs, sectorSize, err := loadMBRBackup(file, data)
+	if err != nil {
+		return err
+	}
+
+	writer, err := openDeviceWriter(device, "restore partition table")
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if uint64(sectorSize) != writer.SectorSize {
+		return fmt.Errorf("the backup is of a disk with %d byte sectors, %s has %d byte sectors", sectorSize, device, writer.SectorSize)
+	}
+
+	// Every partition and EBR has to fit the device
+	var table mbrStruct
+	binary.Read(bytes.NewReader(mbr), binary.LittleEndian, &table)
+	sectors := uint64(writer.Size) / writer.SectorSize
+	for i, p := range table.Partitions {
+		if p.Type != 0 && uint64(p.FirstSector)+uint64(p.Sectors) > sectors {
+			return fmt.Errorf("partition %d of the backup ends at LBA %d, past the end of %s at LBA %d",
+				i+1, uint64(p.FirstSector)+uint64(p.Sectors)-1, device, sectors-1)
+		}
+	}
+	for _, ebr := range ebrs {
+		if ebr.LBA >= sectors {
+			return fmt.Errorf("the EBR at LBA %d of the backup is past the end of %s", ebr.LBA, device)
+		}
+	}
+
+	fmt.Printf("Restoring the MBR with %d EBRs from %s to %s\n", len(ebrs), file, device)
+	if !writer.DryRun && !assumeYes && !confirm(fmt.Sprintf("Write the MBR and EBRs to %s?", device)) {
+		return fmt.Errorf("aborted, nothing was written")
+	}
+
+	if _, err := writer.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("writing MBR: %v", err)
+	}
+	for _, ebr := range ebrs {
+		if _, err := writer.WriteAt(ebr.Data[:], int64(ebr.LBA)*int64(sectorSize)); err != nil {
+			return fmt.Errorf("writing the EBR at LBA %d: %v", ebr.LBA, err)
+		}
+	}
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	if !writer.DryRun {
+		fmt.Printf("Partition table written to %s\n", device)
+		rereadPartitionTableOrWarn(writer.File, writer.Path)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --metrics long operations expose their progress in the Prometheus
+// text format, served on an address like :9101 for the whole run of the
+// command, or written to a .prom file for the textfile collector of the
+// node exporter, which also keeps the outcome once dsktool exited.
+
+// metricsFileInterval is how often the .prom file is rewritten
+const metricsFileInterval = 5 * time.Second
+
+// progressMetrics is the progress sink of --metrics
+type progressMetrics struct {
+	mu   sync.Mutex
+	path string // the .prom file, empty when served
+
+	command      string
+	started      time.Time
+	phase        string
+	done, total  int64
+	writtenBytes int64
+	writtenPhase string
+	startDone    int64
+	phaseStart   time.Time
+	errors       int
+	warnings     int
+	paused       bool
+	exitStatus   *int
+	lastWrite    time.Time
+}
+
+// setupMetrics serves the progress metrics on an address, or writes them
+// to target when it is a .prom file
+func setupMetrics(target string) error {
+	if target == "" {
+		return nil
+	}
+	m := &progressMetrics{command: hookCommand(), started: time.Now(), phaseStart: time.Now()}
+	if strings.HasSuffix(target, ".prom") {
+		m.path = target
+		if err := m.writeFile(); err != nil {
+			return err
+		}
+		addProgressSink(m)
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", target)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		fmt.Fprint(w, m.render())
+	})
+	go http.Serve(listener, mux)
+	addProgressSink(m)
+	return nil
+}
+
+// metricLabel quotes a label value of the text format
+func metricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// render writes the metrics in the Prometheus text format. The caller holds mu.
+func (m *progressMetrics) render() string {
+	var b strings.Builder
+	labels := fmt.Sprintf(`command="%s"`, metricLabel(m.command))
+	phaseLabels := fmt.Sprintf(`%s,phase="%s"`, labels, metricLabel(m.phase))
+	metric := func(name, kind, help, labels string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g\n", name, help, name, kind, name, labels, value)
+	}
+
+	metric("dsktool_start_time_seconds", "gauge", "When the command started, as a Unix time", labels, float64(m.started.UnixNano())/1e9)
+	metric("dsktool_progress_bytes_done", "gauge", "Bytes the current phase has done", phaseLabels, float64(m.done))
+	metric("dsktool_progress_bytes_total", "gauge", "Bytes of the current phase, 0 when not known", phaseLabels, float64(m.total))
+	if m.writtenPhase == m.phase {
+		metric("dsktool_progress_bytes_written", "gauge", "Bytes the current phase has written when it differs from what it read", phaseLabels, float64(m.writtenBytes))
+	}
+	rate := 0.0
+	if elapsed := time.Since(m.phaseStart).Seconds(); elapsed > 0 {
+		rate = float64(m.done-m.startDone) / elapsed
+	}
+	metric("dsktool_progress_bytes_per_second", "gauge", "Rate of the current phase", phaseLabels, rate)
+	metric("dsktool_errors_total", "counter", "Errors the command continued after", labels, float64(m.errors))
+	metric("dsktool_warnings_total", "counter", "Warnings of the command", labels, float64(m.warnings))
+	paused := 0.0
+	if m.paused {
+		paused = 1
+	}
+	metric("dsktool_paused", "gauge", "Whether the operation is paused", labels, paused)
+	if m.exitStatus != nil {
+		metric("dsktool_exit_status", "gauge", "Exit status of the command once it ended", labels, float64(*m.exitStatus))
+	}
+	return b.String()
+}
+
+// writeFile replaces the .prom file, renamed into place so the collector
+// never reads a partial file. The caller holds mu unless setting up.
+func (m *progressMetrics) writeFile() error {
+	m.lastWrite = time.Now()
+	if err := os.WriteFile(m.path+".tmp", []byte(m.render()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(m.path+".tmp", m.path)
+}
+
+// update writes the .prom file every few seconds, or right away when now
+// is set. The caller holds mu.
+func (m *progressMetrics) update(now bool) {
+	if m.path == "" || (!now && time.Since(m.lastWrite) < metricsFileInterval) {
+		return
+	}
+	if err := m.writeFile(); err != nil {
+		fmt.Fprintf(os.Stderr, "%sWarning: writing the metrics file: %v%s\n", yellow, err, reset)
+	}
+}
+
+func (m *progressMetrics) progress(phase string, done, total int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := phase != m.phase
+	if changed {
+		m.phase, m.startDone, m.phaseStart = phase, done, time.Now()
+	}
+	m.done, m.total = done, total
+	m.update(changed)
+}
+
+func (m *progressMetrics) written(phase string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writtenPhase, m.writtenBytes = phase, n
+}
+
+func (m *progressMetrics) message(event, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch event {
+	case "error":
+		m.errors++
+	case "paused":
+		m.paused = true
+	case "resumed":
+		m.paused = false
+	}
+	m.update(true)
+}
+
+func (m *progressMetrics) warning(w warning) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.warnings++
+	m.update(true)
+}
+
+func (m *progressMetrics) finish(status int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exitStatus != nil {
+		return
+	}
+	m.exitStatus = &status
+	if err != nil {
+		m.errors++
+	}
+	m.update(true)
+}
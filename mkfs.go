@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// mkfsTypes are the filesystems that can be created. FAT is written by
+// dsktool itself, the others need the system mkfs tools.
+var mkfsTypes = []string{"fat32", "fat16", "ext4", "xfs", "btrfs", "ntfs", "swap"}
+
+// makeFileSystem creates a filesystem on DEVICE:N, or on a whole device or
+// image. Progress and dry-run output go to report.
+func makeFileSystem(spec, fstype, label string, report io.Writer) error {
+	fstype = strings.ToLower(fstype)
+	if !containsString(mkfsTypes, fstype) {
+		return fmt.Errorf("unsupported filesystem %q, use one of %s", fstype, strings.Join(mkfsTypes, ", "))
+	}
+	if strings.HasPrefix(fstype, "fat") {
+		return makeFAT(spec, fstype, label, report)
+	}
+	return makeFileSystemExternal(spec, fstype, label, report)
+}
+
+// fatLabel validates a FAT volume label and pads it to the 11 byte field
+func fatLabel(label string) ([]byte, error) {
+	if label == "" {
+		return []byte("NO NAME    "), nil
+	}
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		return nil, fmt.Errorf("FAT labels are at most 11 characters, %q is %d", label, len(label))
+	}
+	for _, c := range []byte(label) {
+		if c < 0x20 || c > 0x7e || strings.IndexByte(`"*+,./:;<=>?[\]|`, c) >= 0 {
+			return nil, fmt.Errorf("FAT label %q contains the invalid character %q", label, c)
+		}
+	}
+	return []byte(fmt.Sprintf("%-11s", label)), nil
+}
+
+// fatGeometry is the layout of a new FAT filesystem
+type fatGeometry struct {
+	fatType           string
+	bytesPerSector    uint32
+	sectorsPerCluster uint32
+	reserved          uint32
+	fatSize           uint32
+	rootEntries       uint32
+	totalSectors      uint32
+	clusters          uint32
+}
+
+// computeFATGeometry picks the cluster size and FAT size for a volume of totalSectors
+func computeFATGeometry(fatType string, totalSectors uint64, bytesPerSector uint32) (fatGeometry, error) {
+	if totalSectors > 0xffffffff {
+		return fatGeometry{}, fmt.Errorf("the volume is too large for FAT")
+	}
+	g := fatGeometry{fatType: fatType, bytesPerSector: bytesPerSector, totalSectors: uint32(totalSectors)}
+	entryBytes := uint32(4)
+	minClusters, maxClusters := uint32(65525), uint32(0x0ffffff5)
+	if fatType == "fat16" {
+		entryBytes, minClusters, maxClusters = 2, 4085, 65524
+		g.reserved, g.rootEntries = 4, 512
+	} else {
+		g.reserved = 32
+	}
+	rootSectors := (g.rootEntries*32 + bytesPerSector - 1) / bytesPerSector
+
+	// Use the smallest cluster size, up to 32 KiB, that keeps the count in range.
+	// FAT32 starts at 4 KiB clusters like other formatters do for all but tiny volumes.
+	spc := uint32(1)
+	if fatType == "fat32" && totalSectors*uint64(bytesPerSector) > 260*mb {
+		spc = max(4096/bytesPerSector, 1)
+	}
+	for ; spc*bytesPerSector <= 32*kb; spc *= 2 {
+		data := g.totalSectors - g.reserved - rootSectors
+		// The FAT size depends on the cluster count and the other way round, an
+		// estimate from the whole data area is at most a sector or two too large
+		fatSize := ((data/spc+2)*entryBytes + bytesPerSector - 1) / bytesPerSector
+		if 2*fatSize >= data {
+			continue
+		}
+		clusters := (data - 2*fatSize) / spc
+		if clusters > maxClusters {
+			continue
+		}
+		if clusters < minClusters {
+			return fatGeometry{}, fmt.Errorf("%s is too small for %s, it needs at least %d clusters",
+				formatBytes(totalSectors*uint64(bytesPerSector)), strings.ToUpper(fatType), minClusters)
+		}
+		g.sectorsPerCluster, g.fatSize, g.clusters = spc, fatSize, clusters
+		return g, nil
+	}
+	return fatGeometry{}, fmt.Errorf("%s is too large for %s", formatBytes(totalSectors*uint64(bytesPerSector)), strings.ToUpper(fatType))
+}
+
+// makeFAT writes an empty FAT16 or FAT32 filesystem
+func makeFAT(spec, fstype, label string, report io.Writer) error {
+	labelField, err := fatLabel(label)
+	if err != nil {
+		return err
+	}
+
+	device, number := parsePartitionSpec(spec)
+	writer, err := openDeviceWriterTo(device, "mkfs "+fstype, report)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	offset, size, hidden := int64(0), writer.Size, uint64(0)
+	sectorSize := uint32(writer.SectorSize)
+	if number > 0 {
+		table, err := writer.partitionTable()
+		if err != nil {
+			return err
+		}
+		part, err := table.findPartition(number)
+		if err != nil {
+			return err
+		}
+		offset, size, hidden = part.Offset(table.SectorSize), part.Size(table.SectorSize), part.FirstLBA
+		sectorSize = uint32(table.SectorSize)
+	}
+
+	g, err := computeFATGeometry(fstype, uint64(size)/uint64(sectorSize), sectorSize)
+	if err != nil {
+		return err
+	}
+
+	var serial [4]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return err
+	}
+
+	bps := int64(g.bytesPerSector)
+	boot := make([]byte, bps)
+	copy(boot, []byte{0xeb, 0x58, 0x90})
+	copy(boot[3:], "DSKTOOL ")
+	binary.LittleEndian.PutUint16(boot[0x0b:], uint16(g.bytesPerSector))
+	boot[0x0d] = byte(g.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[0x0e:], uint16(g.reserved))
+	boot[0x10] = 2
+	binary.LittleEndian.PutUint16(boot[0x11:], uint16(g.rootEntries))
+	boot[0x15] = 0xf8
+	binary.LittleEndian.PutUint16(boot[0x18:], 63)
+	binary.LittleEndian.PutUint16(boot[0x1a:], 255)
+	binary.LittleEndian.PutUint32(boot[0x1c:], uint32(min(hidden, 0xffffffff)))
+
+	ebpb := 0x24
+	fsName := "FAT16   "
+	if fstype == "fat32" {
+		ebpb, fsName = 0x40, "FAT32   "
+		binary.LittleEndian.PutUint32(boot[0x20:], g.totalSectors)
+		binary.LittleEndian.PutUint32(boot[0x24:], g.fatSize)
+		binary.LittleEndian.PutUint32(boot[0x2c:], 2) // root directory cluster
+		binary.LittleEndian.PutUint16(boot[0x30:], 1) // FSInfo sector
+		binary.LittleEndian.PutUint16(boot[0x32:], 6) // backup boot sector
+	} else {
+		if g.totalSectors < 0x10000 {
+			binary.LittleEndian.PutUint16(boot[0x13:], uint16(g.totalSectors))
+		} else {
+			binary.LittleEndian.PutUint32(boot[0x20:], g.totalSectors)
+		}
+		binary.LittleEndian.PutUint16(boot[0x16:], uint16(g.fatSize))
+	}
+	boot[ebpb] = 0x80
+	boot[ebpb+2] = 0x29
+	copy(boot[ebpb+3:], serial[:])
+	copy(boot[ebpb+7:], labelField)
+	copy(boot[ebpb+18:], fsName)
+	boot[510], boot[511] = 0x55, 0xaa
+
+	w := io.NewOffsetWriter(writer, offset)
+
+	// Clear the reserved sectors, both FATs and the root directory so no
+	// signatures of an older filesystem are left behind
+	rootSectors := (g.rootEntries*32 + g.bytesPerSector - 1) / g.bytesPerSector
+	clearSectors := int64(g.reserved + 2*g.fatSize + rootSectors)
+	if fstype == "fat32" {
+		clearSectors += int64(g.sectorsPerCluster)
+	}
+	zero := make([]byte, mb)
+	for done := int64(0); done < clearSectors*bps; {
+		n := min(int64(len(zero)), clearSectors*bps-done)
+		if _, err := w.WriteAt(zero[:n], done); err != nil {
+			return err
+		}
+		done += n
+	}
+
+	if _, err := w.WriteAt(boot, 0); err != nil {
+		return err
+	}
+
+	fat := make([]byte, bps)
+	if fstype == "fat32" {
+		binary.LittleEndian.PutUint32(fat[0:], 0x0ffffff8)
+		binary.LittleEndian.PutUint32(fat[4:], 0x0fffffff)
+		binary.LittleEndian.PutUint32(fat[8:], 0x0fffffff) // root directory
+	} else {
+		binary.LittleEndian.PutUint16(fat[0:], 0xfff8)
+		binary.LittleEndian.PutUint16(fat[2:], 0xffff)
+	}
+	for i := int64(0); i < 2; i++ {
+		if _, err := w.WriteAt(fat, (int64(g.reserved)+i*int64(g.fatSize))*bps); err != nil {
+			return err
+		}
+	}
+
+	if fstype == "fat32" {
+		info := make([]byte, bps)
+		binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+		binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+		binary.LittleEndian.PutUint32(info[488:], g.clusters-1)
+		binary.LittleEndian.PutUint32(info[492:], 3)
+		binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+		// FSInfo, then the backup boot sector and its FSInfo copy
+		for sector, data := range [][]byte{1: info, 6: boot, 7: info} {
+			if data == nil {
+				continue
+			}
+			if _, err := w.WriteAt(data, int64(sector)*bps); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The root directory starts with the volume label entry
+	if label != "" {
+		entry := make([]byte, 32)
+		copy(entry, labelField)
+		entry[11] = fatAttrVolumeID
+		if _, err := w.WriteAt(entry, int64(g.reserved+2*g.fatSize)*bps); err != nil {
+			return err
+		}
+	}
+
+	verb := "Created"
+	if writer.DryRun {
+		verb = "Would create"
+	}
+	fmt.Fprintf(report, "%s %s on %s: %s, %d clusters of %s\n", verb, strings.ToUpper(fstype), spec,
+		formatBytes(int64(g.totalSectors)*bps), g.clusters, formatBytes(int64(g.sectorsPerCluster)*bps))
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// mkfsCommand is the tool that creates a filesystem and its flags
+type mkfsCommand struct {
+	Tool  string
+	Label string
+	Extra []string // overwrite existing signatures without asking, the user already confirmed
+}
+
+var mkfsCommands = map[string]mkfsCommand{
+	"ext4":  {"mkfs.ext4", "-L", []string{"-F"}},
+	"xfs":   {"mkfs.xfs", "-L", []string{"-f"}},
+	"btrfs": {"mkfs.btrfs", "-L", []string{"-f"}},
+	"ntfs":  {"mkfs.ntfs", "-L", []string{"-Q"}}, // a full format zeroes the whole volume
+	"swap":  {"mkswap", "-L", nil},
+}
+
+// externalMkfsTypes returns the filesystems whose mkfs tool is installed
+func externalMkfsTypes() []string {
+	var types []string
+	for _, fstype := range mkfsTypes {
+		if tool, ok := mkfsCommands[fstype]; ok {
+			if _, err := exec.LookPath(tool.Tool); err == nil {
+				types = append(types, fstype)
+			}
+		}
+	}
+	return types
+}
+
+// makeFileSystemExternal runs the system mkfs tool on the partition's block device
+func makeFileSystemExternal(spec, fstype, label string, report io.Writer) error {
+	tool := mkfsCommands[fstype]
+	path, err := exec.LookPath(tool.Tool)
+	if err != nil {
+		return fmt.Errorf("%s is needed to create %s filesystems: %v", tool.Tool, fstype, err)
+	}
+
+	device, number := parsePartitionSpec(spec)
+	info, err := os.Stat(device)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		return fmt.Errorf("%s can only be created on block devices, attach the image with losetup -P first", fstype)
+	}
+	if number > 0 {
+		device = partitionDevicePath(device, number)
+		// udev creates the node shortly after the kernel re-reads the table
+		for i := 0; i < 50; i++ {
+			if _, err = os.Stat(device); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			return fmt.Errorf("partition device %s did not appear: %v", device, err)
+		}
+	}
+
+	if err := checkWritePolicy(device, "mkfs "+fstype); err != nil {
+		return err
+	}
+	if err := checkWSLDevice(device, "mkfs "+fstype); err != nil {
+		return err
+	}
+	if !dryRun {
+		if err := checkDeviceActivity(device, "mkfs "+fstype); err != nil {
+			return err
+		}
+	}
+
+	args := append([]string{}, tool.Extra...)
+	if label != "" {
+		args = append(args, tool.Label, label)
+	}
+	args = append(args, device)
+
+	if dryRun {
+		fmt.Fprintf(report, "Dry run: would run %s %s\n", path, strings.Join(args, " "))
+		return nil
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdout, cmd.Stderr = report, report
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", tool.Tool, err)
+	}
+	return nil
+}
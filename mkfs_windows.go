@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// externalMkfsTypes returns the filesystems the system tools can create, none on Windows
+func externalMkfsTypes() []string {
+	return nil
+}
+
+// makeFileSystemExternal is not available on Windows, only FAT is created natively
+func makeFileSystemExternal(spec, fstype, label string, report io.Writer) error {
+	return fmt.Errorf("creating %s filesystems is not supported on Windows, use fat32 or fat16", fstype)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"runtime/debug"
+)
+
+// Partition tables and filesystem signatures sit at the start and the end of
+// a disk, and parsing them takes many small reads. Those two regions are
+// memory mapped where the platform allows, so the reads need no system calls.
+
+const mappedRegionSize = 4 * mb
+
+// mappedReader serves reads of the start and end of a file from memory maps
+// and all others from the file
+type mappedReader struct {
+	file       *os.File
+	size       int64
+	head, tail []byte
+	tailOffset int64
+}
+
+// newMappedReader maps the first and last few MiB of a device or image of
+// size bytes. Regions that can not be mapped are read from the file.
+func newMappedReader(file *os.File, size int64) *mappedReader {
+	m := &mappedReader{file: file, size: size}
+	if size <= 0 {
+		return m
+	}
+	if size <= 2*mappedRegionSize {
+		m.head, _ = mapRegion(file, 0, int(size))
+		return m
+	}
+	m.head, _ = mapRegion(file, 0, mappedRegionSize)
+	// Maps start on a page boundary
+	page := int64(os.Getpagesize())
+	m.tailOffset = (size - mappedRegionSize) / page * page
+	if m.tail, _ = mapRegion(file, m.tailOffset, int(size-m.tailOffset)); m.tail == nil {
+		m.tailOffset = 0
+	}
+	return m
+}
+
+// ReadAt implements io.ReaderAt
+func (m *mappedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	end := off + int64(len(p))
+	switch {
+	case m.head != nil && off >= 0 && end <= int64(len(m.head)):
+		if m.copyMapped(p, m.head[off:end]) {
+			return len(p), nil
+		}
+	case m.tail != nil && off >= m.tailOffset && end <= m.tailOffset+int64(len(m.tail)):
+		if m.copyMapped(p, m.tail[off-m.tailOffset:end-m.tailOffset]) {
+			return len(p), nil
+		}
+	}
+	return m.file.ReadAt(p, off)
+}
+
+// copyMapped copies from a map, a media error shows up as a fault instead
+// of an error, which is turned into a read from the file
+func (m *mappedReader) copyMapped(dst, src []byte) (ok bool) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	copy(dst, src)
+	return true
+}
+
+// Size returns the size of the device or image
+func (m *mappedReader) Size() int64 {
+	return m.size
+}
+
+// Close unmaps the regions, the file stays open
+func (m *mappedReader) Close() error {
+	for _, region := range [][]byte{m.head, m.tail} {
+		if region != nil {
+			unmapRegion(region)
+		}
+	}
+	m.head, m.tail = nil, nil
+	return nil
+}
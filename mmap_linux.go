@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapRegion maps length bytes of a file at offset read-only, shared so
+// writes through the file show up in the map
+func mapRegion(file *os.File, offset int64, length int) ([]byte, error) {
+	return unix.Mmap(int(file.Fd()), offset, length, unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func unmapRegion(region []byte) error {
+	return unix.Munmap(region)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mapRegion is not implemented on Windows, the reads go to the file
+func mapRegion(file *os.File, offset int64, length int) ([]byte, error) {
+	return nil, errors.New("memory maps are not supported on Windows")
+}
+
+func unmapRegion(region []byte) error {
+	return nil
+}
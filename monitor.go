@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gosuri/uilive"
+)
+
+// monitorDisks shows a live table of the I/O of the given disks, or of all
+// disks, from the OS counters every interval seconds until interrupted or
+// count updates were shown
+func monitorDisks(devices []string, interval, count int) error {
+	if interval <= 0 {
+		return fmt.Errorf("the interval must be positive")
+	}
+	if len(devices) == 0 {
+		var err error
+		if devices, err = discoverDisks(); err != nil {
+			return err
+		}
+	}
+
+	var samplers []*diskStatsSampler
+	for _, device := range devices {
+		sampler := newDiskStatsSampler(device)
+		if sampler == nil {
+			fmt.Fprintf(os.Stderr, "%sNo I/O counters for %s, skipping it%s\n", yellow, device, reset)
+			continue
+		}
+		samplers = append(samplers, sampler)
+	}
+	if len(samplers) == 0 {
+		return fmt.Errorf("no disks with I/O counters to monitor")
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	live := uilive.New()
+	live.Start()
+	defer live.Stop()
+	fmt.Fprintln(live, "Waiting for the first sample...")
+	live.Flush()
+
+	for updates := 0; count == 0 || updates < count; updates++ {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		w := tabwriter.NewWriter(live, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "Device\tRead MB/s\tRead IOPS\tWrite MB/s\tWrite IOPS\tBusy\tQueue\t")
+		for _, sampler := range samplers {
+			rates, err := sampler.sample()
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%s\t\t\t\t\t\t\n", sampler.device, err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%.2f\t%.0f\t%.2f\t%.0f\t%.0f%%\t%.1f\t\n", rates.Name,
+				rates.ReadMBps, rates.ReadIOPS, rates.WriteMBps, rates.WriteIOPS, rates.Utilization, rates.QueueDepth)
+		}
+		w.Flush()
+		live.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+//go:build !tiny
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fuseAvailable reports whether images can be mounted with FUSE
+const fuseAvailable = true
+
+// imageRoot is the root directory of a mounted image, with one directory per partition
+type imageRoot struct {
+	fs.Inode
+	image *diskImage
+	table *partitionTable
+}
+
+// sectionFile exposes a byte range of the image as a read-only file
+type sectionFile struct {
+	fs.Inode
+	section *io.SectionReader
+}
+
+var (
+	_ = (fs.NodeOnAdder)((*imageRoot)(nil))
+	_ = (fs.NodeGetattrer)((*sectionFile)(nil))
+	_ = (fs.NodeOpener)((*sectionFile)(nil))
+	_ = (fs.NodeReader)((*sectionFile)(nil))
+)
+
+func (r *imageRoot) OnAdd(ctx context.Context) {
+	disk := r.NewPersistentInode(ctx, &sectionFile{section: io.NewSectionReader(r.image, 0, r.image.Size)}, fs.StableAttr{Mode: fuse.S_IFREG})
+	r.AddChild("disk.img", disk, false)
+
+	if r.table == nil {
+		return
+	}
+
+	for _, part := range r.table.Partitions {
+		dir := r.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR})
+		r.AddChild(fmt.Sprintf("part%d", part.Number), dir, false)
+
+		section := io.NewSectionReader(r.image, part.Offset(r.table.SectorSize), part.Size(r.table.SectorSize))
+		raw := dir.NewPersistentInode(ctx, &sectionFile{section: section}, fs.StableAttr{Mode: fuse.S_IFREG})
+		dir.AddChild("raw.img", raw, false)
+
+		// Partitions with a filesystem we can parse also get their files listed
+		fsys, err := openFileSystem(section, section.Size())
+		if err != nil {
+			continue
+		}
+		files := dir.NewPersistentInode(ctx, &fsDirNode{fsys: fsys, path: "/"}, fs.StableAttr{Mode: fuse.S_IFDIR})
+		dir.AddChild("files", files, false)
+	}
+}
+
+// fsDirNode is a directory inside a parsed filesystem
+type fsDirNode struct {
+	fs.Inode
+	fsys fsReader
+	path string
+}
+
+// fsFileNode is a file or symlink inside a parsed filesystem
+type fsFileNode struct {
+	fs.Inode
+	fsys  fsReader
+	path  string
+	entry fsEntry
+}
+
+var (
+	_ = (fs.NodeLookuper)((*fsDirNode)(nil))
+	_ = (fs.NodeReaddirer)((*fsDirNode)(nil))
+	_ = (fs.NodeOpener)((*fsFileNode)(nil))
+	_ = (fs.NodeReader)((*fsFileNode)(nil))
+	_ = (fs.NodeGetattrer)((*fsFileNode)(nil))
+	_ = (fs.NodeReadlinker)((*fsFileNode)(nil))
+)
+
+func fuseMode(mode os.FileMode) uint32 {
+	switch {
+	case mode.IsDir():
+		return fuse.S_IFDIR | uint32(mode.Perm())
+	case mode&os.ModeSymlink != 0:
+		return fuse.S_IFLNK | 0777
+	}
+	return fuse.S_IFREG | uint32(mode.Perm()&0555)
+}
+
+func fillAttr(entry fsEntry, out *fuse.Attr) {
+	out.Mode = fuseMode(entry.Mode)
+	out.Size = uint64(entry.Size)
+	if !entry.ModTime.IsZero() {
+		out.SetTimes(nil, &entry.ModTime, nil)
+	}
+}
+
+func (d *fsDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, err := d.fsys.ReadDir(d.path)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, fuse.DirEntry{Name: e.Name, Mode: fuseMode(e.Mode)})
+	}
+	return fs.NewListDirStream(list), 0
+}
+
+func (d *fsDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	childPath := path.Join(d.path, name)
+	entry, err := d.fsys.Stat(childPath)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	fillAttr(entry, &out.Attr)
+
+	if entry.Mode.IsDir() {
+		return d.NewInode(ctx, &fsDirNode{fsys: d.fsys, path: childPath}, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+	}
+	return d.NewInode(ctx, &fsFileNode{fsys: d.fsys, path: childPath, entry: entry}, fs.StableAttr{Mode: fuseMode(entry.Mode)}), 0
+}
+
+func (f *fsFileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillAttr(f.entry, &out.Attr)
+	return 0
+}
+
+func (f *fsFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (f *fsFileNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	section, err := f.fsys.Open(f.path)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	n, err := section.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (f *fsFileNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(f.entry.Target), 0
+}
+
+func (f *sectionFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	out.Size = uint64(f.section.Size())
+	return 0
+}
+
+func (f *sectionFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (f *sectionFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := f.section.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// mountImage mounts the image read-only at mountPoint until interrupted
+func mountImage(imagePath, mountPoint string) error {
+	image, err := openImage(imagePath, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	// Images without a partition table (a bare filesystem) still get disk.img
+	table, err := image.partitionTable()
+	if err != nil {
+		fmt.Printf("No partition table found, only exposing the whole image: %v\n", err)
+		table = nil
+	}
+
+	root := &imageRoot{image: image, table: table}
+	server, err := fs.Mount(mountPoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:  imagePath,
+			Name:    "dsktool",
+			Options: []string{"ro"},
+			// Use mount(2) directly when running as root, fusermount otherwise
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Mounted %s on %s, press Ctrl+C to unmount\n", imagePath, mountPoint)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		server.Unmount()
+	}()
+
+	server.Wait()
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build tiny
+
+package main
+
+import "fmt"
+
+// fuseAvailable reports whether images can be mounted with FUSE
+const fuseAvailable = false
+
+func mountImage(imagePath, mountPoint string) error {
+	return fmt.Errorf("mount-image is %v, use nbd-serve instead", errTinyBuild)
+}
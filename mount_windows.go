@@ -0,0 +1,10 @@
+package main
+
+import "fmt"
+
+// fuseAvailable reports whether images can be mounted with FUSE
+const fuseAvailable = false
+
+func mountImage(imagePath, mountPoint string) error {
+	return fmt.Errorf("mounting images is not supported on Windows, use nbd-serve instead")
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// NBD fixed newstyle protocol constants, see https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic          = 0x4e42444d41474943 // NBDMAGIC
+	nbdOptMagic       = 0x49484156454f5054 // IHAVEOPT
+	nbdRepMagic       = 0x3e889045565a9
+	nbdRequestMagic   = 0x25609513
+	nbdSimpleRepMagic = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdFlagHasFlags  = 1 << 0
+	nbdFlagReadOnly  = 1 << 1
+	nbdFlagSendFlush = 1 << 2
+
+	nbdOptExportName = 1
+	nbdOptAbort      = 2
+	nbdOptList       = 3
+	nbdOptInfo       = 6
+	nbdOptGo         = 7
+
+	nbdRepAck      = 1
+	nbdRepServer   = 2
+	nbdRepInfo     = 3
+	nbdRepErrUnsup = 1<<31 + 1
+
+	nbdInfoExport = 0
+
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+
+	nbdEPERM  = 1
+	nbdEIO    = 5
+	nbdEINVAL = 22
+	nbdENOSPC = 28
+)
+
+// nbdBackend is the storage behind an export, a read-only image or a deviceWriter
+type nbdBackend interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+// nbdExport is the byte range of an image served to clients
+type nbdExport struct {
+	name     string
+	image    nbdBackend
+	offset   int64
+	size     int64
+	readOnly bool
+}
+
+type nbdRequest struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+// nbdServe exposes the image, or one of its partitions, as an NBD export
+func nbdServe(imagePath, listen string, partition int, writable bool) error {
+	var image *diskImage
+	var backend nbdBackend
+	if writable {
+		writer, err := openDeviceWriter(imagePath, "nbd-serve --writable")
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+		image, backend = writer.diskImage, writer
+	} else {
+		var err error
+		image, err = openImage(imagePath, false)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		backend = image
+	}
+
+	export := &nbdExport{
+		name:     filepath.Base(imagePath),
+		image:    backend,
+		size:     image.Size,
+		readOnly: !writable,
+	}
+
+	if partition > 0 {
+		table, err := image.partitionTable()
+		if err != nil {
+			return err
+		}
+		part, err := table.findPartition(partition)
+		if err != nil {
+			return err
+		}
+		export.offset = part.Offset(table.SectorSize)
+		export.size = part.Size(table.SectorSize)
+		export.name = fmt.Sprintf("%s-part%d", export.name, partition)
+	}
+
+	if export.offset+export.size > image.Size {
+		return fmt.Errorf("export range %d-%d is beyond the end of the image (%d bytes)", export.offset, export.offset+export.size, image.Size)
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// Stop listening on Ctrl+C so the deferred cleanup of temporary images runs
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	mode := "read-only"
+	if writable {
+		mode = "read-write"
+	}
+	fmt.Printf("Serving %s (%s, %s) as NBD export %q on %s\n", imagePath, formatBytes(export.size), mode, export.name, listener.Addr())
+	fmt.Printf("Attach with: nbd-client -N %s <host> %d /dev/nbd0\n", export.name, listener.Addr().(*net.TCPAddr).Port)
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := export.serveConn(conn)
+			if err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("NBD client %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (e *nbdExport) serveConn(conn net.Conn) error {
+	noZeroes, err := e.handshake(conn)
+	if err != nil {
+		return err
+	}
+
+	enter, err := e.negotiate(conn, noZeroes)
+	if err != nil || !enter {
+		return err
+	}
+
+	return e.transmission(conn)
+}
+
+func (e *nbdExport) handshake(conn net.Conn) (bool, error) {
+	hello := struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}{nbdMagic, nbdOptMagic, nbdFlagFixedNewstyle | nbdFlagNoZeroes}
+	if err := binary.Write(conn, binary.BigEndian, hello); err != nil {
+		return false, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return false, err
+	}
+	if clientFlags&nbdFlagFixedNewstyle == 0 {
+		return false, fmt.Errorf("client does not support fixed newstyle negotiation")
+	}
+	return clientFlags&nbdFlagNoZeroes != 0, nil
+}
+
+func (e *nbdExport) transmissionFlags() uint16 {
+	flags := uint16(nbdFlagHasFlags | nbdFlagSendFlush)
+	if e.readOnly {
+		flags |= nbdFlagReadOnly
+	}
+	return flags
+}
+
+// negotiate handles option haggling, it returns true once the client enters transmission
+func (e *nbdExport) negotiate(conn net.Conn, noZeroes bool) (bool, error) {
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
+			return false, err
+		}
+		if opt.Magic != nbdOptMagic {
+			return false, fmt.Errorf("bad option magic 0x%x", opt.Magic)
+		}
+		if opt.Length > 4096 {
+			return false, fmt.Errorf("option data too large (%d bytes)", opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return false, err
+		}
+
+		switch opt.Option {
+		case nbdOptExportName:
+			reply := struct {
+				Size  uint64
+				Flags uint16
+			}{uint64(e.size), e.transmissionFlags()}
+			if err := binary.Write(conn, binary.BigEndian, reply); err != nil {
+				return false, err
+			}
+			if !noZeroes {
+				if _, err := conn.Write(make([]byte, 124)); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+
+		case nbdOptAbort:
+			return false, e.optReply(conn, opt.Option, nbdRepAck, nil)
+
+		case nbdOptList:
+			name := make([]byte, 4+len(e.name))
+			binary.BigEndian.PutUint32(name, uint32(len(e.name)))
+			copy(name[4:], e.name)
+			if err := e.optReply(conn, opt.Option, nbdRepServer, name); err != nil {
+				return false, err
+			}
+			if err := e.optReply(conn, opt.Option, nbdRepAck, nil); err != nil {
+				return false, err
+			}
+
+		case nbdOptInfo, nbdOptGo:
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info[0:], nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(e.size))
+			binary.BigEndian.PutUint16(info[10:], e.transmissionFlags())
+			if err := e.optReply(conn, opt.Option, nbdRepInfo, info); err != nil {
+				return false, err
+			}
+			if err := e.optReply(conn, opt.Option, nbdRepAck, nil); err != nil {
+				return false, err
+			}
+			if opt.Option == nbdOptGo {
+				return true, nil
+			}
+
+		default:
+			if err := e.optReply(conn, opt.Option, nbdRepErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+func (e *nbdExport) optReply(conn net.Conn, option, replyType uint32, data []byte) error {
+	reply := struct {
+		Magic  uint64
+		Option uint32
+		Type   uint32
+		Length uint32
+	}{nbdRepMagic, option, replyType, uint32(len(data))}
+	if err := binary.Write(conn, binary.BigEndian, reply); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+func (e *nbdExport) transmission(conn net.Conn) error {
+	buf := make([]byte, 0, mb)
+	for {
+		var req nbdRequest
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			return err
+		}
+		if req.Magic != nbdRequestMagic {
+			return fmt.Errorf("bad request magic 0x%x", req.Magic)
+		}
+		if req.Length > 32*mb {
+			return fmt.Errorf("request length %d exceeds the 32MB limit", req.Length)
+		}
+
+		if cap(buf) < int(req.Length) {
+			buf = make([]byte, req.Length)
+		}
+		data := buf[:req.Length]
+
+		inRange := req.Offset+uint64(req.Length) <= uint64(e.size)
+		var errno uint32
+		switch req.Type {
+		case nbdCmdRead:
+			if !inRange {
+				errno = nbdEINVAL
+				break
+			}
+			if _, err := e.image.ReadAt(data, e.offset+int64(req.Offset)); err != nil && err != io.EOF {
+				errno = nbdEIO
+			}
+		case nbdCmdWrite:
+			// The payload always follows the request, even when we reject it
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return err
+			}
+			switch {
+			case e.readOnly:
+				errno = nbdEPERM
+			case !inRange:
+				errno = nbdENOSPC
+			default:
+				if _, err := e.image.WriteAt(data, e.offset+int64(req.Offset)); err != nil {
+					errno = nbdEIO
+				}
+			}
+		case nbdCmdFlush:
+			if !e.readOnly {
+				if err := e.image.Sync(); err != nil {
+					errno = nbdEIO
+				}
+			}
+		case nbdCmdDisc:
+			return nil
+		default:
+			errno = nbdEINVAL
+		}
+
+		reply := struct {
+			Magic  uint32
+			Error  uint32
+			Handle uint64
+		}{nbdSimpleRepMagic, errno, req.Handle}
+		if err := binary.Write(conn, binary.BigEndian, reply); err != nil {
+			return err
+		}
+		if req.Type == nbdCmdRead && errno == 0 {
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+}
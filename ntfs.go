@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ntfsAttrStandardInformation = 0x10
+	ntfsAttrAttributeList       = 0x20
+	ntfsAttrFileName            = 0x30
+	ntfsAttrVolumeName          = 0x60
+	ntfsAttrData                = 0x80
+	ntfsAttrIndexRoot           = 0x90
+	ntfsAttrIndexAllocation     = 0xa0
+	ntfsAttrBitmap              = 0xb0
+	ntfsAttrReparsePoint        = 0xc0
+	ntfsAttrEnd                 = 0xffffffff
+
+	ntfsRecordInUse     = 0x01
+	ntfsRecordDirectory = 0x02
+
+	ntfsAttrFlagCompressed = 0x0001
+	ntfsAttrFlagEncrypted  = 0x4000
+
+	ntfsNamespaceDOS = 2
+
+	ntfsVolumeRecord = 3
+	ntfsRootRecord   = 5
+	ntfsBitmapRecord = 6
+)
+
+// ntfsFS is a read-only NTFS filesystem
+type ntfsFS struct {
+	r           io.ReaderAt
+	clusterSize int64
+	recordSize  int64
+	serial      uint64
+	mft         *ntfsAttribute // $DATA of $MFT, maps record numbers to clusters
+}
+
+// ntfsRecord is a parsed MFT FILE record
+type ntfsRecord struct {
+	Number     uint64
+	Flags      uint16
+	Attributes []*ntfsAttribute
+}
+
+// ntfsAttribute is a resident or non-resident attribute
+type ntfsAttribute struct {
+	Type     uint32
+	Name     string
+	Flags    uint16
+	Resident bool
+	Value    []byte    // resident value
+	Runs     []ntfsRun // non-resident data runs
+	Size     int64     // data size of non-resident attributes
+	InitSize int64
+}
+
+// ntfsRun maps VCNs to LCNs, sparse runs have no LCN
+type ntfsRun struct {
+	VCN    int64
+	LCN    int64
+	Length int64
+	Sparse bool
+}
+
+// ntfsFileName is the content of a $FILE_NAME attribute or index entry
+type ntfsFileName struct {
+	Parent    uint64
+	ModTime   time.Time
+	Size      int64
+	Flags     uint32
+	Namespace uint8
+	Name      string
+}
+
+// isNTFSBootSector checks the OEM ID of the boot sector
+func isNTFSBootSector(boot []byte) bool {
+	return bytes.Equal(boot[3:11], []byte("NTFS    "))
+}
+
+func openNTFS(r io.ReaderAt) (*ntfsFS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if !isNTFSBootSector(boot) {
+		return nil, fmt.Errorf("not an NTFS filesystem")
+	}
+
+	bytesPerSector := int64(le16(boot, 0x0b))
+	sectorsPerCluster := int64(boot[0x0d])
+	if sectorsPerCluster > 0x80 {
+		sectorsPerCluster = 1 << (256 - sectorsPerCluster)
+	}
+	n := &ntfsFS{r: r, clusterSize: bytesPerSector * sectorsPerCluster, serial: le64(boot, 0x48)}
+	n.recordSize = ntfsClusterCount(int8(boot[0x40]), n.clusterSize)
+	if n.clusterSize == 0 || n.recordSize < 512 || n.recordSize > 64*kb {
+		return nil, fmt.Errorf("invalid NTFS geometry")
+	}
+
+	// Record 0 describes the MFT itself, its $DATA maps the rest of the records
+	mftOffset := int64(le64(boot, 0x30)) * n.clusterSize
+	raw := make([]byte, n.recordSize)
+	if _, err := r.ReadAt(raw, mftOffset); err != nil {
+		return nil, fmt.Errorf("reading $MFT: %v", err)
+	}
+	mft, err := n.parseRecord(raw, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing $MFT: %v", err)
+	}
+	n.mft = mft.attribute(ntfsAttrData, "")
+	if n.mft == nil || n.mft.Resident {
+		return nil, fmt.Errorf("$MFT has no data attribute")
+	}
+
+	return n, nil
+}
+
+// ntfsClusterCount decodes the boot sector size fields, negative values are 2^-n bytes
+func ntfsClusterCount(v int8, clusterSize int64) int64 {
+	if v < 0 {
+		return 1 << uint(-v)
+	}
+	return int64(v) * clusterSize
+}
+
+func (n *ntfsFS) Type() string {
+	return "NTFS"
+}
+
+// applyFixups restores the last two bytes of every sector from the update sequence array
+func applyFixups(raw []byte) error {
+	usaOffset := int(le16(raw, 4))
+	usaCount := int(le16(raw, 6))
+	if usaOffset+usaCount*2 > len(raw) {
+		return fmt.Errorf("update sequence array out of bounds")
+	}
+	usn := raw[usaOffset : usaOffset+2]
+	for i := 1; i < usaCount; i++ {
+		end := i*512 - 2
+		if end+2 > len(raw) {
+			break
+		}
+		if !bytes.Equal(raw[end:end+2], usn) {
+			return fmt.Errorf("torn write detected in sector %d", i-1)
+		}
+		copy(raw[end:end+2], raw[usaOffset+i*2:usaOffset+i*2+2])
+	}
+	return nil
+}
+
+func (n *ntfsFS) parseRecord(raw []byte, number uint64) (*ntfsRecord, error) {
+	if !bytes.Equal(raw[0:4], []byte("FILE")) {
+		return nil, fmt.Errorf("record %d: bad FILE signature", number)
+	}
+	if err := applyFixups(raw); err != nil {
+		return nil, fmt.Errorf("record %d: %v", number, err)
+	}
+
+	record := &ntfsRecord{Number: number, Flags: le16(raw, 22)}
+	for off := int(le16(raw, 20)); off+16 <= len(raw); {
+		attrType := le32(raw, off)
+		length := int(le32(raw, off+4))
+		if attrType == ntfsAttrEnd || length < 16 || off+length > len(raw) {
+			break
+		}
+		attr, err := parseAttribute(raw[off : off+length])
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", number, err)
+		}
+		record.Attributes = append(record.Attributes, attr)
+		off += length
+	}
+	return record, nil
+}
+
+func parseAttribute(raw []byte) (*ntfsAttribute, error) {
+	attr := &ntfsAttribute{
+		Type:     le32(raw, 0),
+		Resident: raw[8] == 0,
+		Flags:    le16(raw, 12),
+	}
+	if nameLen := int(raw[9]); nameLen > 0 {
+		nameOff := int(le16(raw, 10))
+		if nameOff+nameLen*2 > len(raw) {
+			return nil, fmt.Errorf("attribute name out of bounds")
+		}
+		attr.Name = decodeUTF16(raw[nameOff : nameOff+nameLen*2])
+	}
+
+	if attr.Resident {
+		valueLen := int(le32(raw, 16))
+		valueOff := int(le16(raw, 20))
+		if valueOff+valueLen > len(raw) {
+			return nil, fmt.Errorf("resident value out of bounds")
+		}
+		attr.Value = raw[valueOff : valueOff+valueLen]
+		attr.Size = int64(valueLen)
+		attr.InitSize = attr.Size
+		return attr, nil
+	}
+
+	startVCN := int64(le64(raw, 16))
+	runOff := int(le16(raw, 32))
+	attr.Size = int64(le64(raw, 48))
+	attr.InitSize = int64(le64(raw, 56))
+	runs, err := decodeRunList(raw[runOff:], startVCN)
+	if err != nil {
+		return nil, err
+	}
+	attr.Runs = runs
+	return attr, nil
+}
+
+// decodeRunList decodes the mapping pairs of a non-resident attribute
+func decodeRunList(raw []byte, vcn int64) ([]ntfsRun, error) {
+	var runs []ntfsRun
+	lcn := int64(0)
+	for i := 0; i < len(raw) && raw[i] != 0; {
+		lengthSize := int(raw[i] & 0x0f)
+		offsetSize := int(raw[i] >> 4)
+		i++
+		if lengthSize == 0 || lengthSize > 8 || offsetSize > 8 || i+lengthSize+offsetSize > len(raw) {
+			return nil, fmt.Errorf("corrupt run list")
+		}
+
+		length := int64(0)
+		for b := lengthSize - 1; b >= 0; b-- {
+			length = length<<8 | int64(raw[i+b])
+		}
+		i += lengthSize
+
+		run := ntfsRun{VCN: vcn, Length: length, Sparse: offsetSize == 0}
+		if offsetSize > 0 {
+			delta := int64(int8(raw[i+offsetSize-1])) // sign extend the top byte
+			for b := offsetSize - 2; b >= 0; b-- {
+				delta = delta<<8 | int64(raw[i+b])
+			}
+			lcn += delta
+			run.LCN = lcn
+		}
+		i += offsetSize
+
+		runs = append(runs, run)
+		vcn += length
+	}
+	return runs, nil
+}
+
+// ntfsAttrReader reads the contents of an attribute, sparse runs and data past
+// the initialized size read as zeros
+type ntfsAttrReader struct {
+	fs   *ntfsFS
+	attr *ntfsAttribute
+}
+
+func (a *ntfsAttrReader) ReadAt(p []byte, off int64) (int, error) {
+	if a.attr.Resident {
+		if off >= int64(len(a.attr.Value)) {
+			return 0, io.EOF
+		}
+		return copy(p, a.attr.Value[off:]), nil
+	}
+
+	cs := a.fs.clusterSize
+	total := 0
+	for len(p) > 0 {
+		vcn := off / cs
+		within := off % cs
+
+		i := sort.Search(len(a.attr.Runs), func(i int) bool {
+			return a.attr.Runs[i].VCN+a.attr.Runs[i].Length > vcn
+		})
+		if i == len(a.attr.Runs) || a.attr.Runs[i].VCN > vcn {
+			return total, io.EOF
+		}
+		run := a.attr.Runs[i]
+
+		// Read up to the end of this run in one go
+		n := int64(len(p))
+		if remaining := (run.VCN+run.Length)*cs - off; n > remaining {
+			n = remaining
+		}
+
+		switch {
+		case run.Sparse || off >= a.attr.InitSize:
+			clear(p[:n])
+		default:
+			if _, err := a.fs.r.ReadAt(p[:n], (run.LCN+vcn-run.VCN)*cs+within); err != nil {
+				return total, err
+			}
+			if end := off + n; end > a.attr.InitSize {
+				clear(p[a.attr.InitSize-off : n])
+			}
+		}
+
+		total += int(n)
+		p = p[n:]
+		off += n
+	}
+	return total, nil
+}
+
+func (n *ntfsFS) attrData(attr *ntfsAttribute) ([]byte, error) {
+	buf := make([]byte, attr.Size)
+	_, err := (&ntfsAttrReader{fs: n, attr: attr}).ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf, err
+}
+
+// readRecord reads MFT record number, following $ATTRIBUTE_LIST into extension records
+func (n *ntfsFS) readRecord(number uint64) (*ntfsRecord, error) {
+	record, err := n.readBaseRecord(number)
+	if err != nil {
+		return nil, err
+	}
+
+	list := record.attribute(ntfsAttrAttributeList, "")
+	if list == nil {
+		return record, nil
+	}
+	data, err := n.attrData(list)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the attributes stored in other records, the base record's own
+	// attributes are listed too and are skipped
+	loaded := map[uint64]bool{number: true}
+	for off := 0; off+26 <= len(data); {
+		length := int(le16(data, off+4))
+		if length < 26 {
+			break
+		}
+		ref := le64(data, off+16) & 0xffffffffffff
+		if !loaded[ref] {
+			loaded[ref] = true
+			extension, err := n.readBaseRecord(ref)
+			if err != nil {
+				return nil, err
+			}
+			record.Attributes = append(record.Attributes, extension.Attributes...)
+		}
+		off += length
+	}
+	record.mergeDataRuns()
+	return record, nil
+}
+
+func (n *ntfsFS) readBaseRecord(number uint64) (*ntfsRecord, error) {
+	raw := make([]byte, n.recordSize)
+	if number == 0 && n.mft == nil {
+		return nil, fmt.Errorf("MFT not loaded")
+	}
+	_, err := (&ntfsAttrReader{fs: n, attr: n.mft}).ReadAt(raw, int64(number)*n.recordSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading MFT record %d: %v", number, err)
+	}
+	return n.parseRecord(raw, number)
+}
+
+// mergeDataRuns joins non-resident attributes that were split over several records
+func (r *ntfsRecord) mergeDataRuns() {
+	var merged []*ntfsAttribute
+	for _, attr := range r.Attributes {
+		var base *ntfsAttribute
+		for _, m := range merged {
+			if !attr.Resident && !m.Resident && m.Type == attr.Type && m.Name == attr.Name {
+				base = m
+				break
+			}
+		}
+		if base == nil {
+			merged = append(merged, attr)
+			continue
+		}
+		base.Runs = append(base.Runs, attr.Runs...)
+		if attr.Size > base.Size {
+			base.Size, base.InitSize = attr.Size, attr.InitSize
+		}
+	}
+	for _, attr := range merged {
+		sort.Slice(attr.Runs, func(a, b int) bool { return attr.Runs[a].VCN < attr.Runs[b].VCN })
+	}
+	r.Attributes = merged
+}
+
+func (r *ntfsRecord) attribute(attrType uint32, name string) *ntfsAttribute {
+	for _, attr := range r.Attributes {
+		if attr.Type == attrType && attr.Name == name {
+			return attr
+		}
+	}
+	return nil
+}
+
+// fileName returns the long (non-DOS) name of the record
+func (r *ntfsRecord) fileName() *ntfsFileName {
+	var best *ntfsFileName
+	for _, attr := range r.Attributes {
+		if attr.Type != ntfsAttrFileName || !attr.Resident {
+			continue
+		}
+		fn := parseFileName(attr.Value)
+		if fn != nil && (best == nil || best.Namespace == ntfsNamespaceDOS) {
+			best = fn
+		}
+	}
+	return best
+}
+
+func parseFileName(raw []byte) *ntfsFileName {
+	if len(raw) < 66 {
+		return nil
+	}
+	nameLen := int(raw[64])
+	if 66+nameLen*2 > len(raw) {
+		return nil
+	}
+	return &ntfsFileName{
+		Parent:    le64(raw, 0) & 0xffffffffffff,
+		ModTime:   ntfsTime(le64(raw, 16)),
+		Size:      int64(le64(raw, 48)),
+		Flags:     le32(raw, 56),
+		Namespace: raw[65],
+		Name:      decodeUTF16(raw[66 : 66+nameLen*2]),
+	}
+}
+
+// ntfsIndexEntry is a directory entry found in an $I30 index
+type ntfsIndexEntry struct {
+	Record uint64
+	ntfsFileName
+}
+
+// readIndex returns all entries of a directory's $I30 index
+func (n *ntfsFS) readIndex(record *ntfsRecord) ([]ntfsIndexEntry, error) {
+	root := record.attribute(ntfsAttrIndexRoot, "$I30")
+	if root == nil {
+		return nil, fmt.Errorf("record %d is not a directory", record.Number)
+	}
+	if len(root.Value) < 32 {
+		return nil, fmt.Errorf("record %d: index root too small", record.Number)
+	}
+
+	entries := parseIndexEntries(root.Value[16:])
+
+	alloc := record.attribute(ntfsAttrIndexAllocation, "$I30")
+	if alloc == nil {
+		return entries, nil
+	}
+	blockSize := int64(le32(root.Value, 8))
+	if blockSize < 512 {
+		return nil, fmt.Errorf("record %d: invalid index block size", record.Number)
+	}
+
+	var bitmap []byte
+	if bm := record.attribute(ntfsAttrBitmap, "$I30"); bm != nil {
+		bitmap, _ = n.attrData(bm)
+	}
+
+	reader := &ntfsAttrReader{fs: n, attr: alloc}
+	block := make([]byte, blockSize)
+	for i := int64(0); i*blockSize < alloc.Size; i++ {
+		if bitmap != nil && (int(i/8) >= len(bitmap) || bitmap[i/8]&(1<<(i%8)) == 0) {
+			continue
+		}
+		if _, err := reader.ReadAt(block, i*blockSize); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if !bytes.Equal(block[0:4], []byte("INDX")) || applyFixups(block) != nil {
+			continue
+		}
+		entries = append(entries, parseIndexEntries(block[24:])...)
+	}
+	return entries, nil
+}
+
+// parseIndexEntries walks the entries following an index header
+func parseIndexEntries(header []byte) []ntfsIndexEntry {
+	var entries []ntfsIndexEntry
+	off := int(le32(header, 0))
+	end := int(le32(header, 4))
+	if end > len(header) {
+		end = len(header)
+	}
+	for off+16 <= end {
+		length := int(le16(header, off+8))
+		contentLen := int(le16(header, off+10))
+		flags := le32(header, off+12)
+		if flags&0x02 != 0 || length < 16 || off+length > end {
+			break
+		}
+		if fn := parseFileName(header[off+16 : off+16+contentLen]); fn != nil && fn.Namespace != ntfsNamespaceDOS {
+			entries = append(entries, ntfsIndexEntry{Record: le64(header, off) & 0xffffffffffff, ntfsFileName: *fn})
+		}
+		off += length
+	}
+	return entries
+}
+
+func (n *ntfsFS) lookup(name string) (*ntfsRecord, error) {
+	record, err := n.readRecord(ntfsRootRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range splitPath(name) {
+		entries, err := n.readIndex(record)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name, part) {
+				record, err = n.readRecord(e.Record)
+				if err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no such file or directory", name)
+		}
+	}
+	return record, nil
+}
+
+func (n *ntfsFS) entry(record *ntfsRecord) fsEntry {
+	entry := fsEntry{Name: "/", Mode: 0644}
+	if fn := record.fileName(); fn != nil {
+		entry.Name = fn.Name
+		entry.ModTime = fn.ModTime
+	}
+	if si := record.attribute(ntfsAttrStandardInformation, ""); si != nil && len(si.Value) >= 16 {
+		entry.ModTime = ntfsTime(le64(si.Value, 8))
+	}
+	if record.Flags&ntfsRecordDirectory != 0 {
+		entry.Mode = os.ModeDir | 0755
+	} else if data := record.attribute(ntfsAttrData, ""); data != nil {
+		entry.Size = data.Size
+	}
+	if record.attribute(ntfsAttrReparsePoint, "") != nil {
+		entry.Mode |= os.ModeIrregular
+	}
+	return entry
+}
+
+func (n *ntfsFS) Stat(name string) (fsEntry, error) {
+	record, err := n.lookup(name)
+	if err != nil {
+		return fsEntry{}, err
+	}
+	return n.entry(record), nil
+}
+
+func (n *ntfsFS) ReadDir(name string) ([]fsEntry, error) {
+	dir, err := n.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := n.readIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[uint64]bool{}
+	var result []fsEntry
+	for _, e := range entries {
+		// Hide the metafiles ($MFT, $Bitmap, ...) living in the root directory
+		if seen[e.Record] || (e.Record < 16 && strings.HasPrefix(e.Name, "$")) {
+			continue
+		}
+		seen[e.Record] = true
+
+		record, err := n.readRecord(e.Record)
+		if err != nil {
+			return nil, err
+		}
+		entry := n.entry(record)
+		entry.Name = e.Name
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Name < result[b].Name })
+	return result, nil
+}
+
+func (n *ntfsFS) Open(name string) (*io.SectionReader, error) {
+	record, err := n.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return n.openData(record)
+}
+
+func (n *ntfsFS) openData(record *ntfsRecord) (*io.SectionReader, error) {
+	if record.Flags&ntfsRecordDirectory != 0 {
+		return nil, fmt.Errorf("record %d is a directory", record.Number)
+	}
+	data := record.attribute(ntfsAttrData, "")
+	if data == nil {
+		return nil, fmt.Errorf("record %d has no data", record.Number)
+	}
+	if data.Flags&ntfsAttrFlagCompressed != 0 {
+		return nil, fmt.Errorf("record %d: NTFS compressed files are not supported", record.Number)
+	}
+	if data.Flags&ntfsAttrFlagEncrypted != 0 {
+		return nil, fmt.Errorf("record %d: EFS encrypted files are not supported", record.Number)
+	}
+	return io.NewSectionReader(&ntfsAttrReader{fs: n, attr: data}, 0, data.Size), nil
+}
+
+// ntfsTime converts 100ns intervals since 1601 to a time
+func ntfsTime(t uint64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	const epochDelta = 116444736000000000
+	return time.Unix(0, (int64(t)-epochDelta)*100)
+}
+
+func decodeUTF16(raw []byte) string {
+	u := make([]uint16, len(raw)/2)
+	for i := range u {
+		u[i] = le16(raw, i*2)
+	}
+	return string(utf16.Decode(u))
+}
+
+// volumeName returns the volume label stored in $Volume
+func (n *ntfsFS) volumeName() string {
+	record, err := n.readRecord(ntfsVolumeRecord)
+	if err != nil {
+		return ""
+	}
+	attr := record.attribute(ntfsAttrVolumeName, "")
+	if attr == nil || !attr.Resident {
+		return ""
+	}
+	return decodeUTF16(attr.Value)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// The NVMe data structures dsktool reads, parsed from the raw data of the
+// admin commands the platform files send.
+
+// nvmeController holds the fields of Identify Controller dsktool uses
+type nvmeController struct {
+	VendorID     uint16 `json:"vendor_id"`
+	Serial       string `json:"serial"`
+	Model        string `json:"model"`
+	Firmware     string `json:"firmware"`
+	ControllerID uint16 `json:"controller_id"`
+	Version      string `json:"version,omitempty"`
+	// FirmwareSlots is the number of firmware slots
+	FirmwareSlots int `json:"firmware_slots"`
+	// WarningTemp and CriticalTemp are the composite temperature thresholds
+	// in °C, 0 if not reported
+	WarningTemp  int `json:"warning_temp_c,omitempty"`
+	CriticalTemp int `json:"critical_temp_c,omitempty"`
+	// Capacity is the total NVM capacity in bytes, 0 if not reported
+	Capacity   uint64 `json:"capacity,omitempty"`
+	Namespaces uint32 `json:"namespaces"`
+	OACS       uint16 `json:"-"` // optional admin commands, bit 1 is Format NVM
+	SANICAP    uint32 `json:"-"` // sanitize capabilities: crypto erase, block erase, overwrite
+	FNA        uint8  `json:"-"` // format attributes, bit 2 is crypto erase
+}
+
+// parseNVMeController reads the 4096 bytes of Identify Controller
+func parseNVMeController(data []byte) *nvmeController {
+	le16, le32 := binary.LittleEndian.Uint16, binary.LittleEndian.Uint32
+	ctrl := &nvmeController{
+		VendorID:      le16(data[0:]),
+		Serial:        strings.TrimSpace(string(data[4:24])),
+		Model:         strings.TrimSpace(string(data[24:64])),
+		Firmware:      strings.TrimSpace(string(data[64:72])),
+		ControllerID:  le16(data[78:]),
+		FirmwareSlots: int(data[260]>>1) & 7,
+		WarningTemp:   kelvinToCelsius(le16(data[266:])),
+		CriticalTemp:  kelvinToCelsius(le16(data[268:])),
+		Capacity:      binary.LittleEndian.Uint64(data[280:]),
+		Namespaces:    le32(data[516:]),
+		OACS:          le16(data[256:]),
+		SANICAP:       le32(data[328:]),
+		FNA:           data[524],
+	}
+	if version := le32(data[80:]); version != 0 {
+		ctrl.Version = fmt.Sprintf("%d.%d", version>>16, version>>8&0xff)
+		if version&0xff != 0 {
+			ctrl.Version += fmt.Sprintf(".%d", version&0xff)
+		}
+	}
+	return ctrl
+}
+
+// kelvinToCelsius converts the temperatures NVMe reports, 0 stays unknown
+func kelvinToCelsius(kelvin uint16) int {
+	if kelvin == 0 {
+		return 0
+	}
+	return int(kelvin) - 273
+}
+
+// nvmeLBAFormat is an LBA format a namespace can be formatted with
+type nvmeLBAFormat struct {
+	DataSize     int `json:"data_size"`
+	MetadataSize int `json:"metadata_size"`
+	// Performance is relative, 0 best to 3 degraded
+	Performance int `json:"relative_performance"`
+}
+
+// nvmeNamespace holds the fields of Identify Namespace dsktool uses. The
+// sizes count blocks of the formatted LBA format.
+type nvmeNamespace struct {
+	ID        uint32          `json:"id"`
+	Size      uint64          `json:"size_blocks"`
+	Capacity  uint64          `json:"capacity_blocks"`
+	Used      uint64          `json:"used_blocks"`
+	Formats   []nvmeLBAFormat `json:"lba_formats"`
+	Formatted int             `json:"formatted_lba_format"`
+	EUI64     string          `json:"eui64,omitempty"`
+	NGUID     string          `json:"nguid,omitempty"`
+	FLBAS     uint8           `json:"-"` // formatted LBA size, with the metadata setting
+	DPS       uint8           `json:"-"` // end-to-end data protection settings
+}
+
+// parseNVMeNamespace reads the 4096 bytes of Identify Namespace
+func parseNVMeNamespace(nsid uint32, data []byte) *nvmeNamespace {
+	le64 := binary.LittleEndian.Uint64
+	ns := &nvmeNamespace{
+		ID:       nsid,
+		Size:     le64(data[0:]),
+		Capacity: le64(data[8:]),
+		Used:     le64(data[16:]),
+		FLBAS:    data[26],
+		DPS:      data[29],
+	}
+	// The LBA format index is bits 3:0 of FLBAS, with bits 6:5 above them for
+	// more than 16 formats
+	ns.Formatted = int(ns.FLBAS&0x0f) | int(ns.FLBAS>>5&3)<<4
+	for i := 0; i <= int(data[25]) && i < 64; i++ {
+		format := binary.LittleEndian.Uint32(data[128+4*i:])
+		ns.Formats = append(ns.Formats, nvmeLBAFormat{
+			MetadataSize: int(format & 0xffff),
+			DataSize:     1 << (format >> 16 & 0xff),
+			Performance:  int(format >> 24 & 3),
+		})
+	}
+	if nguid := data[104:120]; !isZero(nguid) {
+		ns.NGUID = hex.EncodeToString(nguid)
+	}
+	if eui := data[120:128]; !isZero(eui) {
+		ns.EUI64 = hex.EncodeToString(eui)
+	}
+	return ns
+}
+
+// formatFields returns the LBA format, metadata and protection information
+// settings of the namespace as Format NVM takes them in CDW10, so a format
+// keeps them
+func (ns *nvmeNamespace) formatFields() uint32 {
+	flbas, dps := uint32(ns.FLBAS), uint32(ns.DPS)
+	return flbas&0x0f | flbas&0x10 | (dps&7)<<5 | (dps>>3&1)<<8 | (flbas>>5&3)<<12
+}
+
+// nvmeHealth is the SMART / Health Information log page
+type nvmeHealth struct {
+	CriticalWarning uint8 `json:"critical_warning"`
+	// Temperature is the composite temperature in °C
+	Temperature    int   `json:"temperature_c"`
+	AvailableSpare uint8 `json:"available_spare"`
+	SpareThreshold uint8 `json:"available_spare_threshold"`
+	// PercentageUsed is the estimated wear, over 100 past the rated life
+	PercentageUsed      uint8  `json:"percentage_used"`
+	DataRead            uint64 `json:"data_read_bytes"`
+	DataWritten         uint64 `json:"data_written_bytes"`
+	HostReads           uint64 `json:"host_reads"`
+	HostWrites          uint64 `json:"host_writes"`
+	BusyMinutes         uint64 `json:"controller_busy_minutes"`
+	PowerCycles         uint64 `json:"power_cycles"`
+	PowerOnHours        uint64 `json:"power_on_hours"`
+	UnsafeShutdowns     uint64 `json:"unsafe_shutdowns"`
+	MediaErrors         uint64 `json:"media_errors"`
+	ErrorLogEntries     uint64 `json:"error_log_entries"`
+	WarningTempMinutes  uint32 `json:"warning_temp_minutes"`
+	CriticalTempMinutes uint32 `json:"critical_temp_minutes"`
+	Sensors             []int  `json:"temperature_sensors_c,omitempty"`
+}
+
+// parseNVMeHealth reads the 512 bytes of the SMART / Health Information log
+func parseNVMeHealth(data []byte) *nvmeHealth {
+	// The counters are 128 bits, the low 64 bits hold any real value. Data
+	// units are thousands of 512 byte blocks.
+	le64 := func(at int) uint64 { return binary.LittleEndian.Uint64(data[at:]) }
+	health := &nvmeHealth{
+		CriticalWarning:     data[0],
+		Temperature:         kelvinToCelsius(binary.LittleEndian.Uint16(data[1:])),
+		AvailableSpare:      data[3],
+		SpareThreshold:      data[4],
+		PercentageUsed:      data[5],
+		DataRead:            le64(32) * 512000,
+		DataWritten:         le64(48) * 512000,
+		HostReads:           le64(64),
+		HostWrites:          le64(80),
+		BusyMinutes:         le64(96),
+		PowerCycles:         le64(112),
+		PowerOnHours:        le64(128),
+		UnsafeShutdowns:     le64(144),
+		MediaErrors:         le64(160),
+		ErrorLogEntries:     le64(176),
+		WarningTempMinutes:  binary.LittleEndian.Uint32(data[192:]),
+		CriticalTempMinutes: binary.LittleEndian.Uint32(data[196:]),
+	}
+	for i := 0; i < 8; i++ {
+		if t := binary.LittleEndian.Uint16(data[200+2*i:]); t != 0 {
+			health.Sensors = append(health.Sensors, kelvinToCelsius(t))
+		}
+	}
+	return health
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// NVMe admin commands go to the controller through a namespace device with
+// the NVME_IOCTL_ADMIN_CMD ioctl.
+
+const (
+	nvmeIoctlID       = 0x4e40     // _IO('N', 0x40)
+	nvmeIoctlAdminCmd = 0xc0484e41 // _IOWR('N', 0x41, struct nvme_admin_cmd)
+
+	nvmeAdminGetLogPage = 0x02
+	nvmeAdminIdentify   = 0x06
+	nvmeAdminFormat     = 0x80
+	nvmeAdminSanitize   = 0x84
+
+	nvmeLogHealth   = 0x02
+	nvmeLogSanitize = 0x81
+)
+
+// nvmeAdminCmd is struct nvme_admin_cmd of <linux/nvme_ioctl.h>
+type nvmeAdminCmd struct {
+	Opcode      uint8
+	Flags       uint8
+	Rsvd1       uint16
+	NSID        uint32
+	Cdw2        uint32
+	Cdw3        uint32
+	Metadata    uint64
+	Addr        uint64
+	MetadataLen uint32
+	DataLen     uint32
+	Cdw10       uint32
+	Cdw11       uint32
+	Cdw12       uint32
+	Cdw13       uint32
+	Cdw14       uint32
+	Cdw15       uint32
+	TimeoutMs   uint32
+	Result      uint32
+}
+
+// nvmeAdmin runs an admin command that reads into or writes from data
+func nvmeAdmin(f *os.File, cmd *nvmeAdminCmd, data []byte) error {
+	if len(data) > 0 {
+		cmd.Addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+		cmd.DataLen = uint32(len(data))
+	}
+	status, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(cmd)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return fmt.Errorf("NVMe admin command 0x%02x: %v", cmd.Opcode, errno)
+	}
+	if status != 0 {
+		return fmt.Errorf("NVMe admin command 0x%02x failed: %s", cmd.Opcode, nvmeStatusText(uint16(status)))
+	}
+	return nil
+}
+
+// nvmeStatusText describes the status codes the commands here fail with
+func nvmeStatusText(status uint16) string {
+	switch status & 0x7ff {
+	case 0x001:
+		return "the controller does not support the command"
+	case 0x002:
+		return "a field of the command is invalid"
+	case 0x01d:
+		return "a sanitize is in progress"
+	case 0x01e:
+		return "the controller failed a sanitize before, exit the failure mode first"
+	case 0x10a:
+		return "the format is invalid"
+	case 0x115:
+		return "the namespace is write protected"
+	}
+	return fmt.Sprintf("status 0x%x", status)
+}
+
+// nvmeNamespaceID returns the namespace a device node is, an error for
+// devices that are no NVMe namespace
+func nvmeNamespaceID(f *os.File) (uint32, error) {
+	id, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), nvmeIoctlID, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint32(id), nil
+}
+
+func nvmeIdentifyController(f *os.File) (*nvmeController, error) {
+	data := make([]byte, 4096)
+	if err := nvmeAdmin(f, &nvmeAdminCmd{Opcode: nvmeAdminIdentify, Cdw10: 1}, data); err != nil {
+		return nil, err
+	}
+	return parseNVMeController(data), nil
+}
+
+func nvmeIdentifyNamespace(f *os.File, nsid uint32) (*nvmeNamespace, error) {
+	data := make([]byte, 4096)
+	if err := nvmeAdmin(f, &nvmeAdminCmd{Opcode: nvmeAdminIdentify, NSID: nsid}, data); err != nil {
+		return nil, err
+	}
+	return parseNVMeNamespace(nsid, data), nil
+}
+
+func nvmeReadHealth(f *os.File) (*nvmeHealth, error) {
+	data := make([]byte, 512)
+	cmd := &nvmeAdminCmd{Opcode: nvmeAdminGetLogPage, NSID: 0xffffffff, Cdw10: uint32(len(data)/4-1)<<16 | nvmeLogHealth}
+	if err := nvmeAdmin(f, cmd, data); err != nil {
+		return nil, err
+	}
+	return parseNVMeHealth(data), nil
+}
+
+// nvmeSanitizeLog is the state of the last or running sanitize
+type nvmeSanitizeLog struct {
+	Progress float64 // of the running sanitize, 0 to 1
+	Status   uint8   // 0 never sanitized, 1 done, 2 in progress, 3 failed, 4 done without deallocation
+	// Estimates for an overwrite, block erase and crypto erase, 0 if unknown
+	Overwrite, BlockErase, CryptoErase time.Duration
+}
+
+func nvmeReadSanitizeLog(f *os.File) (*nvmeSanitizeLog, error) {
+	data := make([]byte, 512)
+	cmd := &nvmeAdminCmd{Opcode: nvmeAdminGetLogPage, NSID: 0xffffffff, Cdw10: uint32(len(data)/4-1)<<16 | nvmeLogSanitize}
+	if err := nvmeAdmin(f, cmd, data); err != nil {
+		return nil, err
+	}
+	estimate := func(at int) time.Duration {
+		seconds := binary.LittleEndian.Uint32(data[at:])
+		if seconds == 0xffffffff {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return &nvmeSanitizeLog{
+		Progress:    float64(binary.LittleEndian.Uint16(data[0:])) / 65536,
+		Status:      data[2] & 7,
+		Overwrite:   estimate(8),
+		BlockErase:  estimate(12),
+		CryptoErase: estimate(16),
+	}, nil
+}
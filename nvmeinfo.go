@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// nvmeInfo is what nvme info shows of a namespace and its controller
+type nvmeInfo struct {
+	Device     string          `json:"device"`
+	Controller *nvmeController `json:"controller"`
+	Namespace  *nvmeNamespace  `json:"namespace"`
+	Health     *nvmeHealth     `json:"health"`
+}
+
+// nvmeCriticalWarnings names the bits of the critical warning of the health log
+var nvmeCriticalWarnings = []string{
+	"available spare below the threshold",
+	"temperature out of range",
+	"reliability degraded by media or internal errors",
+	"media placed in read only mode",
+	"volatile memory backup failed",
+	"persistent memory region read only",
+}
+
+// nvmePerformance names the relative performance of LBA formats
+var nvmePerformance = []string{"best", "better", "good", "degraded"}
+
+// criticalWarnings lists the warnings set in the health log
+func (h *nvmeHealth) criticalWarnings() []string {
+	var warnings []string
+	for i, name := range nvmeCriticalWarnings {
+		if h.CriticalWarning&(1<<i) != 0 {
+			warnings = append(warnings, name)
+		}
+	}
+	return warnings
+}
+
+// showNVMeInfo shows the controller, namespace and health of an NVMe namespace
+func showNVMeInfo(device string, asJSON bool) error {
+	info, err := readNVMeInfo(device)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	c, ns, h := info.Controller, info.Namespace, info.Health
+	fmt.Printf("Device:          %s\n", info.Device)
+	fmt.Printf("Model:           %s\n", c.Model)
+	fmt.Printf("Serial:          %s\n", c.Serial)
+	fmt.Printf("Firmware:        %s, %d slots\n", c.Firmware, c.FirmwareSlots)
+	controller := fmt.Sprintf("vendor 0x%04x, ID %d", c.VendorID, c.ControllerID)
+	if c.Version != "" {
+		controller += ", NVMe " + c.Version
+	}
+	controller += fmt.Sprintf(", %d namespaces", c.Namespaces)
+	if c.Capacity > 0 {
+		controller += ", " + formatBytes(int64(c.Capacity))
+	}
+	fmt.Printf("Controller:      %s\n", controller)
+
+	block := uint64(512)
+	if ns.Formatted < len(ns.Formats) {
+		block = uint64(ns.Formats[ns.Formatted].DataSize)
+	}
+	fmt.Printf("Namespace %d:     %s, %s used, %d byte blocks\n", ns.ID,
+		formatBytes(int64(ns.Size*block)), formatBytes(int64(ns.Used*block)), block)
+	if ns.NGUID != "" {
+		fmt.Printf("NGUID:           %s\n", ns.NGUID)
+	}
+	if ns.EUI64 != "" {
+		fmt.Printf("EUI-64:          %s\n", ns.EUI64)
+	}
+	fmt.Println("LBA formats:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  #\tData\tMetadata\tPerformance\t")
+	for i, format := range ns.Formats {
+		current := ""
+		if i == ns.Formatted {
+			current = "in use"
+		}
+		fmt.Fprintf(w, "  %d\t%d\t%d\t%s\t%s\n", i, format.DataSize, format.MetadataSize, nvmePerformance[format.Performance], current)
+	}
+	w.Flush()
+
+	fmt.Println("Health:")
+	if warnings := h.criticalWarnings(); len(warnings) > 0 {
+		fmt.Printf("  %sCritical warning: %s%s\n", red, strings.Join(warnings, ", "), reset)
+	} else {
+		fmt.Printf("  Critical warning: none\n")
+	}
+	temperature := fmt.Sprintf("%d °C", h.Temperature)
+	if c.WarningTemp > 0 {
+		temperature += fmt.Sprintf(", warning at %d °C", c.WarningTemp)
+	}
+	if c.CriticalTemp > 0 {
+		temperature += fmt.Sprintf(", critical at %d °C", c.CriticalTemp)
+	}
+	if h.WarningTempMinutes > 0 || h.CriticalTempMinutes > 0 {
+		temperature += fmt.Sprintf(", %d min above warning, %d min above critical", h.WarningTempMinutes, h.CriticalTempMinutes)
+	}
+	fmt.Printf("  Temperature:      %s\n", temperature)
+	spareColor := ""
+	if h.AvailableSpare < h.SpareThreshold {
+		spareColor = red
+	}
+	fmt.Printf("  Available spare:  %s%d%% (threshold %d%%)%s\n", spareColor, h.AvailableSpare, h.SpareThreshold, reset)
+	wearColor := ""
+	if h.PercentageUsed >= 90 {
+		wearColor = yellow
+	}
+	fmt.Printf("  Wear level:       %s%d%% of the rated endurance used%s\n", wearColor, h.PercentageUsed, reset)
+	fmt.Printf("  Data:             %s read, %s written\n", formatBytes(int64(h.DataRead)), formatBytes(int64(h.DataWritten)))
+	fmt.Printf("  Power on:         %d h, %d power cycles, %d unsafe shutdowns\n", h.PowerOnHours, h.PowerCycles, h.UnsafeShutdowns)
+	errorColor := ""
+	if h.MediaErrors > 0 {
+		errorColor = red
+	}
+	fmt.Printf("  Media errors:     %s%d%s, %d error log entries\n", errorColor, h.MediaErrors, reset, h.ErrorLogEntries)
+	return nil
+}
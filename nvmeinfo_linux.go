@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// readNVMeInfo asks the controller of an NVMe namespace for its identify
+// data and health log
+func readNVMeInfo(device string) (*nvmeInfo, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nsid, err := nvmeNamespaceID(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is no NVMe namespace, give one like /dev/nvme0n1", device)
+	}
+	info := &nvmeInfo{Device: device}
+	if info.Controller, err = nvmeIdentifyController(f); err != nil {
+		return nil, fmt.Errorf("identify controller: %v", err)
+	}
+	if info.Namespace, err = nvmeIdentifyNamespace(f, nsid); err != nil {
+		return nil, fmt.Errorf("identify namespace %d: %v", nsid, err)
+	}
+	if info.Health, err = nvmeReadHealth(f); err != nil {
+		return nil, fmt.Errorf("reading the health log: %v", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "fmt"
+
+// readNVMeInfo is not implemented on Windows yet
+func readNVMeInfo(device string) (*nvmeInfo, error) {
+	return nil, fmt.Errorf("nvme info is not supported on Windows yet")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// outputFormats are the machine readable formats accepted by --format, besides the default text
+var outputFormats = []string{"text", "csv", "tsv", "json"}
+
+// checkOutputFormat validates a --format value
+func checkOutputFormat(format string) error {
+	if !containsString(outputFormats, format) && pluginForFormat(format) == nil {
+		return fmt.Errorf("unknown output format %q, use one of %s", format, strings.Join(outputFormats, ", "))
+	}
+	outputFormat = format
+	return nil
+}
+
+// writeRecords writes a header line and rows as CSV or TSV, or the rows as
+// a JSON array of objects keyed by the headers
+func writeRecords(w io.Writer, format string, headers []string, rows [][]string) error {
+	switch format {
+	case "json":
+		// The fields keep the order of the headers, which a map would not
+		var b bytes.Buffer
+		b.WriteString("[")
+		for r, row := range rows {
+			if r > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n  {")
+			for i, header := range headers {
+				if i >= len(row) {
+					break
+				}
+				key, _ := json.Marshal(header)
+				value, err := json.Marshal(jsonRecordValue(header, row[i]))
+				if err != nil {
+					return err
+				}
+				if i > 0 {
+					b.WriteString(",")
+				}
+				fmt.Fprintf(&b, "\n    %s: %s", key, value)
+			}
+			b.WriteString("\n  }")
+		}
+		if len(rows) > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("]\n")
+		_, err := w.Write(b.Bytes())
+		return err
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(headers)
+		cw.WriteAll(rows)
+		return cw.Error()
+
+	case "tsv":
+		// Tabs and newlines inside values would break the columns
+		clean := func(values []string) string {
+			out := make([]string, len(values))
+			for i, v := range values {
+				out[i] = strings.Map(func(r rune) rune {
+					if r == '\t' || r == '\n' || r == '\r' {
+						return ' '
+					}
+					return r
+				}, v)
+			}
+			return strings.Join(out, "\t")
+		}
+		if _, err := fmt.Fprintln(w, clean(headers)); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if _, err := fmt.Fprintln(w, clean(row)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if plugin := pluginForFormat(format); plugin != nil {
+		return writePluginRecords(w, plugin, format, headers, rows)
+	}
+	return fmt.Errorf("output format %q is not a record format", format)
+}
+
+// jsonRecordValue types a record value for JSON. Counts, sizes, LBAs and
+// rates are numbers, null if they are unknown, everything else is a string.
+func jsonRecordValue(header, value string) any {
+	numeric := header == "number" || header == "sectors" ||
+		strings.HasSuffix(header, "_bytes") || strings.HasSuffix(header, "_lba") || strings.HasSuffix(header, "_mbps")
+	if !numeric {
+		return value
+	}
+	if value == "" {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return value
+	}
+	return json.Number(value)
+}
+
+// partitionDevicePath returns the kernel name of a partition, /dev/sda1 or /dev/nvme0n1p1
+func partitionDevicePath(disk string, number int) string {
+	if disk != "" && unicode.IsDigit(rune(disk[len(disk)-1])) {
+		return fmt.Sprintf("%sp%d", disk, number)
+	}
+	return fmt.Sprintf("%s%d", disk, number)
+}
+
+var partitionRecordHeaders = []string{
+	"device", "table", "number", "partition", "start_lba", "end_lba", "sectors", "size_bytes",
+	"type", "type_id", "name", "unique_guid", "filesystem",
+}
+
+// partitionRecords returns one record per partition of a device or image
+func partitionRecords(device string) ([][]string, error) {
+	image, err := openImage(device, false)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	table, err := image.partitionTable()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range table.warnings(device) {
+		addWarning(w)
+	}
+
+	// Partitions of image files are addressed as IMAGE:N like the fs commands expect
+	partitionPath := partitionDevicePath
+	if info, err := image.Stat(); err == nil && info.Mode().IsRegular() {
+		partitionPath = func(disk string, number int) string {
+			return fmt.Sprintf("%s:%d", disk, number)
+		}
+	}
+
+	var rows [][]string
+	add := func(tableType string, part partitionEntry, path string) {
+		typeID, uniqueGUID := "", ""
+		if part.GPT != nil {
+			typeID = formatGUID(part.GPT.TypeGUID)
+			uniqueGUID = formatGUID(part.GPT.UniqueGUID)
+		} else if part.MBR != nil {
+			typeID = fmt.Sprintf("0x%02x", part.MBR.Type)
+		} else if part.APM != nil {
+			typeID = apmString(part.APM.Type[:])
+		} else if part.BSD != nil {
+			typeID = strconv.Itoa(int(part.BSD.FSType))
+		} else if part.Sun != nil {
+			typeID = fmt.Sprintf("0x%02x", part.Sun.Tag)
+		} else if part.SGI != nil {
+			typeID = fmt.Sprintf("0x%02x", part.SGI.Type)
+		}
+
+		name := part.Name
+		if part.MBR != nil {
+			name = ""
+		}
+		typeName := partitionTypeName(part)
+		if part.MBR != nil {
+			typeName = mbrTypeNames[part.MBR.Type]
+		}
+
+		rows = append(rows, []string{
+			device,
+			tableType,
+			strconv.Itoa(part.Number),
+			path,
+			strconv.FormatUint(part.FirstLBA, 10),
+			strconv.FormatUint(part.LastLBA, 10),
+			strconv.FormatUint(part.Sectors(), 10),
+			strconv.FormatInt(part.Size(table.SectorSize), 10),
+			typeName,
+			typeID,
+			name,
+			uniqueGUID,
+			identifyFileSystem(image.structure(), part.Offset(table.SectorSize), part.Size(table.SectorSize)),
+		})
+	}
+	for _, part := range table.Partitions {
+		add(table.Type, part, partitionPath(device, part.Number))
+		// Nested disklabel partitions are named after their slice like on BSD, e.g. ada0s1a
+		for _, nested := range table.BSDLabels[part.Number] {
+			add("BSD", nested, partitionPath(device, part.Number)+nested.Name)
+		}
+	}
+	return rows, nil
+}
+
+func listPartitionRecords(w io.Writer, device, format string) error {
+	rows, err := partitionRecords(device)
+	if err != nil {
+		return err
+	}
+	return writeRecords(w, format, partitionRecordHeaders, rows)
+}
+
+var diskRecordHeaders = []string{
+	"device", "parent", "kind", "size_bytes", "fstype", "label", "mountpoint",
+	"fs_total_bytes", "fs_used_bytes", "fs_free_bytes", "serial", "tags",
+	"vendor", "model", "wwn", "media", "transport",
+}
+
+func listDiskRecords(w io.Writer, format string) error {
+	rows, err := diskRecords()
+	if err != nil {
+		return err
+	}
+	return writeRecords(w, format, diskRecordHeaders, rows)
+}
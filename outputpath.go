@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxFileName is the longest file name most filesystems take, in bytes
+const maxFileName = 255
+
+// imageSidecars are the suffixes of the files written next to an image
+var imageSidecars = []string{".state", ".blockmap", ".rescuemap", ".manifest.json"}
+
+// outputPolicy says what happens when the file an image goes to exists
+type outputPolicy struct {
+	// Overwrite replaces the file and removes the sidecars of the old image
+	Overwrite bool
+	// Unique writes to name-1.ext, name-2.ext and so on instead
+	Unique bool
+}
+
+// imageTaken reports whether an image or any of its sidecars exists at path
+func imageTaken(path string) bool {
+	for _, suffix := range append([]string{""}, imageSidecars...) {
+		if _, err := os.Lstat(path + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareOutput checks the local file an image of device is written to, base
+// with extension added, and returns the path to write. It refuses names too
+// long for the sidecars, images stored on the device itself and existing
+// files unless policy allows them. need is the most the image can take,
+// which has to fit in the free space when exact, like for fixed disk images,
+// and otherwise only warns. Resumed images are continued as they are.
+func prepareOutput(device, base, extension string, policy outputPolicy, resume bool, need int64, exact bool) (string, error) {
+	path := base + extension
+	if strings.Contains(path, "://") {
+		return path, nil
+	}
+
+	longest := filepath.Base(path) + ".manifest.json"
+	if len(longest) > maxFileName {
+		return "", fmt.Errorf("the file name %s is too long, with the extension and the sidecars it has to stay within %d bytes", filepath.Base(path), maxFileName-len(".manifest.json"))
+	}
+
+	onDevice, err := storedOnDevice(filepath.Dir(path), device)
+	if err != nil {
+		return "", fmt.Errorf("finding the disk %s is on: %v", filepath.Dir(path), err)
+	}
+	if onDevice {
+		return "", fmt.Errorf("%s is on %s, an image cannot be written to the disk it is taken of", filepath.Dir(path), device)
+	}
+	if info, err := os.Stat(path); err == nil {
+		if source, err := os.Stat(device); err == nil && os.SameFile(info, source) {
+			return "", fmt.Errorf("%s is the image being read, it cannot be written to", path)
+		}
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("%s exists and is not a file", path)
+		}
+	}
+
+	if !resume && imageTaken(path) {
+		switch {
+		case policy.Unique:
+			for n := 1; imageTaken(path); n++ {
+				path = fmt.Sprintf("%s-%d%s", base, n, extension)
+			}
+			fmt.Printf("%s exists, writing to %s\n", base+extension, path)
+		case policy.Overwrite:
+			for _, suffix := range append([]string{""}, imageSidecars...) {
+				if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return "", err
+				}
+			}
+		default:
+			return "", fmt.Errorf("%s or its sidecars exist, use --overwrite to replace them or --unique to pick a new name", path)
+		}
+	}
+
+	dir := filepath.Dir(path)
+	_, _, free, err := getFsSpace(dir)
+	if err != nil {
+		return "", fmt.Errorf("checking the free space in %s: %v", dir, err)
+	}
+	if resume || free >= need {
+		return path, nil
+	}
+	if exact {
+		return "", fmt.Errorf("the image takes %s, %s has only %s free", formatBytes(need), dir, formatBytes(free))
+	}
+	warnf(warnLowSpace, "", "%s has %s free, the image fits only if it compresses to under %.0f%% of %s",
+		dir, formatBytes(free), float64(free)*100/float64(need), formatBytes(need))
+	return path, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+)
+
+// part clone copies the contents of one partition into an existing
+// partition, on another disk or the same one, and leaves the rest of the
+// target disk and its partition table alone.
+
+// clonePartition copies partition N of a device, image or partition image
+// into partition M of another device, which must be at least as large
+func clonePartition(srcSpec, dstSpec string, options cloneOptions) error {
+	src, srcNumber := parsePartitionSpec(srcSpec)
+	if srcNumber == 0 {
+		return fmt.Errorf("%s names no partition, use DEVICE:N", srcSpec)
+	}
+	dst, number := parsePartitionSpec(dstSpec)
+	if number == 0 {
+		return fmt.Errorf("%s names no partition, use DEVICE:N", dstSpec)
+	}
+
+	source, section, err := openPartitionSpec(srcSpec)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	size := section.Size()
+
+	writer, err := openDeviceWriter(dst, fmt.Sprintf("clone partition %s into partition %d", srcSpec, number))
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	table, err := writer.partitionTable()
+	if err != nil {
+		return fmt.Errorf("%s has no partition table, create partition %d first: %v", dst, number, err)
+	}
+	part, err := table.findPartition(number)
+	if err != nil {
+		return err
+	}
+	target := byteRange{Start: part.Offset(table.SectorSize)}
+	target.End = target.Start + part.Size(table.SectorSize)
+
+	if sameFile(source.File, writer.File) {
+		from, err := partitionByteRange(src, srcNumber)
+		if err != nil {
+			return err
+		}
+		if from.Start < target.End && target.Start < from.End {
+			return fmt.Errorf("%s and %s overlap", srcSpec, dstSpec)
+		}
+	}
+	if target.End-target.Start < size {
+		return fmt.Errorf("partition %d of %s (%s) is smaller than %s (%s)",
+			number, dst, formatBytes(target.End-target.Start), srcSpec, formatBytes(size))
+	}
+	if target.End-target.Start > size {
+		warnf(warnFilesystemNotGrown, dst, "partition %d of %s is %s larger than %s, the filesystem keeps its size until it is grown",
+			number, dst, formatBytes(target.End-target.Start-size), srcSpec)
+	}
+
+	if writer.DryRun {
+		fmt.Printf("Dry run: would copy %s from %s into partition %d of %s\n", formatBytes(size), srcSpec, number, dst)
+		return nil
+	}
+	if !options.AssumeYes && !confirm(fmt.Sprintf("Overwrite partition %d of %s (%s) with %s?",
+		number, dst, formatBytes(target.End-target.Start), srcSpec)) {
+		return fmt.Errorf("aborted")
+	}
+
+	tuning, err := tuneIO(source.File, source.Path, size, source.SectorSize, options.Tuning)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Cloning %s (%s) into partition %d of %s with %s\n", srcSpec, formatBytes(size), number, dst, tuning)
+
+	listenForPause()
+	var (
+		copied    int64
+		source256 = sha256.New()
+		stats     = newDiskStatsSampler(dst)
+		start     = time.Now()
+		display   = startProgressDisplay("", nil)
+	)
+	display.extra = func() []string { return []string{stats.progressLine()} }
+	err = readChunks(section, size, tuning, func(chunk []byte, offset int64) error {
+		if _, err := writer.WriteAt(chunk, target.Start+offset); err != nil {
+			return fmt.Errorf("writing at offset %d: %v", target.Start+offset, err)
+		}
+		source256.Write(chunk)
+		copied += int64(len(chunk))
+		reportProgress("cloning", copied, size)
+		start = start.Add(pausePoint(display.Bypass(), writer.Sync))
+		return nil
+	})
+	display.stop()
+	if err != nil {
+		return err
+	}
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("Cloned %s in %s (%.2f MB/s)\n", formatBytes(copied), elapsed.Truncate(time.Second), float64(copied)/mb/elapsed.Seconds())
+
+	if !options.Verify {
+		printResult("%s", dstSpec)
+		return nil
+	}
+	fmt.Println("Verifying")
+	target256 := sha256.New()
+	if _, err := io.Copy(target256, io.NewSectionReader(writer, target.Start, size)); err != nil {
+		return fmt.Errorf("verifying: %v", err)
+	}
+	fmt.Printf("Source SHA-256: %x\nTarget SHA-256: %x\n", source256.Sum(nil), target256.Sum(nil))
+	if !bytes.Equal(source256.Sum(nil), target256.Sum(nil)) {
+		return fmt.Errorf("partition %d of %s does not match %s", number, dst, srcSpec)
+	}
+	fmt.Printf("%sVerified, the partition matches%s\n", green, reset)
+	printResult("%x  %s", target256.Sum(nil), dstSpec)
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// partitionSpec describes a partition to add to a table
+type partitionSpec struct {
+	Number   int // slot to use, 0 picks the first free one
+	FirstLBA uint64
+	LastLBA  uint64
+	Type     string // type name, GUID or MBR type byte
+	Name     string // GPT only
+}
+
+// parseGUID parses the canonical text form produced by formatGUID into the on-disk layout
+func parseGUID(s string) ([16]byte, error) {
+	var g [16]byte
+	parts := strings.Split(strings.Trim(s, "{}"), "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	// The first three groups are stored little endian
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(g[8:], raw[8:])
+	return g, nil
+}
+
+// randomGUID returns a new version 4 GUID in the on-disk layout
+func randomGUID() ([16]byte, error) {
+	var g [16]byte
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g, nil
+}
+
+// partitionTypeChoices lists the known type names for a table type, the common default first
+func partitionTypeChoices(tableType string) []string {
+	var names []string
+	def := "Linux filesystem"
+	if tableType == "MBR" {
+		def = "Linux"
+		for _, name := range mbrTypeNames {
+			names = append(names, name)
+		}
+	} else {
+		for _, name := range gptTypeNames {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	choices := []string{def}
+	for _, name := range names {
+		if name != def && name != "GPT protective" && name != "Extended" && name != "Extended LBA" {
+			choices = append(choices, name)
+		}
+	}
+	return choices
+}
+
+// parsePartitionType resolves a type name, GUID or MBR type byte for the given table type
+func parsePartitionType(tableType, value string) ([16]byte, uint8, error) {
+	var guid [16]byte
+	value = strings.TrimSpace(value)
+
+	if tableType == "MBR" {
+		for t, name := range mbrTypeNames {
+			if strings.EqualFold(name, value) {
+				return guid, t, nil
+			}
+		}
+		t, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 8)
+		if err != nil || t == 0 {
+			return guid, 0, fmt.Errorf("unknown MBR partition type %q", value)
+		}
+		return guid, uint8(t), nil
+	}
+
+	for g, name := range gptTypeNames {
+		if strings.EqualFold(name, value) {
+			guid, err := parseGUID(g)
+			return guid, 0, err
+		}
+	}
+	guid, err := parseGUID(value)
+	if err != nil {
+		return guid, 0, fmt.Errorf("unknown GPT partition type %q", value)
+	}
+	return guid, 0, nil
+}
+
+// maxPartitions returns the number of partition slots of the table
+func (pt *partitionTable) maxPartitions() int {
+	if pt.Type == "GPT" && pt.Header != nil {
+		return int(pt.Header.NumPartEntries)
+	}
+	return 4
+}
+
+// createPartition adds a partition to the table after checking that it fits in
+// unused space, and returns the new entry
+func (pt *partitionTable) createPartition(spec partitionSpec, diskSectors uint64) (*partitionEntry, error) {
+	if err := pt.checkWritable(); err != nil {
+		return nil, err
+	}
+	first, last := pt.usableRange(diskSectors)
+	if spec.LastLBA < spec.FirstLBA {
+		return nil, fmt.Errorf("partition ends at LBA %d before it starts at LBA %d", spec.LastLBA, spec.FirstLBA)
+	}
+	if spec.FirstLBA < first || spec.LastLBA > last {
+		return nil, fmt.Errorf("LBA %d-%d is outside the usable area %d-%d", spec.FirstLBA, spec.LastLBA, first, last)
+	}
+	for _, part := range pt.Partitions {
+		if spec.FirstLBA <= part.LastLBA && spec.LastLBA >= part.FirstLBA {
+			return nil, fmt.Errorf("LBA %d-%d overlaps partition %d (%d-%d)", spec.FirstLBA, spec.LastLBA, part.Number, part.FirstLBA, part.LastLBA)
+		}
+	}
+
+	number := spec.Number
+	if number == 0 {
+		for n := 1; n <= pt.maxPartitions(); n++ {
+			if _, err := pt.findPartition(n); err != nil {
+				number = n
+				break
+			}
+		}
+		if number == 0 {
+			return nil, fmt.Errorf("all %d partition slots are in use", pt.maxPartitions())
+		}
+	} else if number < 1 || number > pt.maxPartitions() {
+		return nil, fmt.Errorf("partition number %d out of range 1-%d", number, pt.maxPartitions())
+	} else if _, err := pt.findPartition(number); err == nil {
+		return nil, fmt.Errorf("partition %d already exists", number)
+	}
+
+	typeGUID, mbrType, err := parsePartitionType(pt.Type, spec.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	part := partitionEntry{Number: number, FirstLBA: spec.FirstLBA, LastLBA: spec.LastLBA}
+	switch pt.Type {
+	case "GPT":
+		if _, err := encodeGPTName(spec.Name); err != nil {
+			return nil, err
+		}
+		unique, err := randomGUID()
+		if err != nil {
+			return nil, err
+		}
+		part.Name = spec.Name
+		part.GPT = &gptPartition{TypeGUID: typeGUID, UniqueGUID: unique, FirstLBA: spec.FirstLBA, LastLBA: spec.LastLBA}
+	case "MBR":
+		if spec.LastLBA > 0xffffffff {
+			return nil, fmt.Errorf("partition ends beyond the 2 TiB MBR limit")
+		}
+		part.MBR = &mbrPartition{Type: mbrType, FirstSector: uint32(spec.FirstLBA), Sectors: uint32(spec.LastLBA - spec.FirstLBA + 1)}
+	default:
+		return nil, fmt.Errorf("unsupported partition table type %q", pt.Type)
+	}
+
+	pt.Partitions = append(pt.Partitions, part)
+	sort.Slice(pt.Partitions, func(i, j int) bool { return pt.Partitions[i].Number < pt.Partitions[j].Number })
+	return pt.findPartition(number)
+}
+
+// deletePartition removes a partition from the table
+func (pt *partitionTable) deletePartition(number int) error {
+	if err := pt.checkWritable(); err != nil {
+		return err
+	}
+	for i, part := range pt.Partitions {
+		if part.Number == number {
+			pt.Partitions = append(pt.Partitions[:i], pt.Partitions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("partition %d not found in %s table", number, pt.Type)
+}
+
+// offsetLBA converts an offset like 1MiB, 2048s or 50% of the disk into an
+// LBA, rounding partial sectors up
+func (pt *partitionTable) offsetLBA(value string, diskSectors uint64) (uint64, error) {
+	bytes, err := parseSize(value, int64(pt.SectorSize), int64(diskSectors*pt.SectorSize))
+	if err != nil {
+		return 0, err
+	}
+	return (uint64(bytes) + pt.SectorSize - 1) / pt.SectorSize, nil
+}
+
+// partitionRange resolves parted style --start with either --end or --size
+// into the first and last LBA of a partition. The end is exclusive like in
+// parted, and percentages are of the whole disk so 0% and 100% are clamped to
+// the usable area, as are max for the end and size.
+func (pt *partitionTable) partitionRange(start, end, size string, diskSectors uint64) (uint64, uint64, error) {
+	if (end == "") == (size == "") {
+		return 0, 0, fmt.Errorf("give either an end or a size")
+	}
+	usableFirst, usableLast := pt.usableRange(diskSectors)
+	clamped := func(value string) bool {
+		value = strings.ToLower(strings.TrimSpace(value))
+		return value == "max" || strings.HasSuffix(value, "%")
+	}
+
+	first, err := pt.offsetLBA(start, diskSectors)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start: %v", err)
+	}
+	if clamped(start) {
+		first = max(first, usableFirst)
+	}
+
+	var last uint64
+	switch {
+	case strings.EqualFold(strings.TrimSpace(end), "max") || strings.EqualFold(strings.TrimSpace(size), "max"):
+		last = usableLast
+	case end != "":
+		endLBA, err := pt.offsetLBA(end, diskSectors)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid end: %v", err)
+		}
+		if endLBA <= first {
+			return 0, 0, fmt.Errorf("the end %s is not after the start %s", end, start)
+		}
+		last = endLBA - 1
+		if clamped(end) {
+			last = min(last, usableLast)
+		}
+	default:
+		bytes, err := parseSize(size, int64(pt.SectorSize), int64(diskSectors*pt.SectorSize))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid size: %v", err)
+		}
+		sectors := uint64(bytes) / pt.SectorSize
+		if sectors == 0 {
+			return 0, 0, fmt.Errorf("the size must be at least one sector (%d bytes)", pt.SectorSize)
+		}
+		last = first + sectors - 1
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("the partition would end at LBA %d before it starts at LBA %d", last, first)
+	}
+	return first, last, nil
+}
+
+// newPartitionTable returns an empty GPT or MBR table for a disk of
+// diskSectors sectors. GPT tables get the usual 128 entries and a new disk GUID.
+func newPartitionTable(tableType string, sectorSize, diskSectors uint64) (*partitionTable, error) {
+	pt := &partitionTable{Type: tableType, SectorSize: sectorSize}
+	pt.MBR.Signature = 0xAA55
+	switch tableType {
+	case "MBR":
+		return pt, nil
+	case "GPT":
+	default:
+		return nil, fmt.Errorf("unsupported partition table type %q", tableType)
+	}
+
+	diskGUID, err := randomGUID()
+	if err != nil {
+		return nil, err
+	}
+	header := &gptHeader{
+		Revision:          [4]byte{0, 0, 1, 0},
+		HeaderSize:        92,
+		CurrentLBA:        1,
+		BackupLBA:         diskSectors - 1,
+		DiskGUID:          diskGUID,
+		PartitionEntryLBA: 2,
+		NumPartEntries:    128,
+		PartEntrySize:     128,
+	}
+	copy(header.Signature[:], "EFI PART")
+	entrySectors := (uint64(header.NumPartEntries)*uint64(header.PartEntrySize) + sectorSize - 1) / sectorSize
+	header.FirstUsableLBA = 2 + entrySectors
+	if diskSectors < 2*entrySectors+4 {
+		return nil, fmt.Errorf("the disk is too small for a GPT")
+	}
+	header.LastUsableLBA = diskSectors - 2 - entrySectors
+	pt.Header = header
+	return pt, nil
+}
+
+// loadEditableTable reads the partition table of a device for the part
+// commands, with the size of the device in sectors
+func loadEditableTable(device string) (*partitionTable, uint64, error) {
+	image, err := openImage(device, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	table, err := image.partitionTable()
+	diskSectors := uint64(image.Size) / image.SectorSize
+	image.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	if table.PrimaryDamage != nil || table.DeviceSectorSize != 0 {
+		return nil, 0, fmt.Errorf("the GPT of %s needs a table repair first", device)
+	}
+	return table, diskSectors, table.checkWritable()
+}
+
+// addPartition creates a partition on a device. Without a start it goes at
+// the first 1 MiB boundary of the first gap large enough for it.
+func addPartition(device string, number int, start, end, size, partType, name string, assumeYes bool) error {
+	table, diskSectors, err := loadEditableTable(device)
+	if err != nil {
+		return err
+	}
+	if partType == "" {
+		partType = partitionTypeChoices(table.Type)[0]
+	}
+
+	var first, last uint64
+	if start == "" {
+		align := uint64(mb) / table.SectorSize
+		for _, region := range table.freeRegions(diskSectors) {
+			aligned := (region.First + align - 1) / align * align
+			if aligned > region.Last {
+				continue
+			}
+			candidate := fmt.Sprintf("%ds", aligned)
+			if first, last, err = table.partitionRange(candidate, end, size, diskSectors); err == nil && last <= region.Last {
+				break
+			}
+			first, last = 0, 0
+		}
+		if first == 0 {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("no gap on %s is large enough, give a --start", device)
+		}
+	} else if first, last, err = table.partitionRange(start, end, size, diskSectors); err != nil {
+		return err
+	}
+
+	if _, err := table.createPartition(partitionSpec{Number: number, FirstLBA: first, LastLBA: last, Type: partType, Name: name}, diskSectors); err != nil {
+		return err
+	}
+	return commitPartitionTable(device, table, "create partition", assumeYes)
+}
+
+// removePartition deletes a partition from the table of a device, the data
+// stays where it was until it is overwritten
+func removePartition(device string, number int, assumeYes bool) error {
+	table, _, err := loadEditableTable(device)
+	if err != nil {
+		return err
+	}
+	if err := table.deletePartition(number); err != nil {
+		return err
+	}
+	return commitPartitionTable(device, table, fmt.Sprintf("delete partition %d", number), assumeYes)
+}
+
+// setPartitionType changes the type of a partition on a device to a type
+// name, GUID or MBR type byte
+func setPartitionType(device string, number int, partType string, assumeYes bool) error {
+	table, _, err := loadEditableTable(device)
+	if err != nil {
+		return err
+	}
+	part, err := table.findPartition(number)
+	if err != nil {
+		return err
+	}
+	typeGUID, mbrType, err := parsePartitionType(table.Type, partType)
+	if err != nil {
+		return err
+	}
+	switch {
+	case part.GPT != nil:
+		part.GPT.TypeGUID = typeGUID
+	case part.MBR != nil:
+		if isExtendedType(part.MBR.Type) != isExtendedType(mbrType) {
+			return fmt.Errorf("partition %d can not change between an extended and a regular partition", number)
+		}
+		part.MBR.Type = mbrType
+	}
+	return commitPartitionTable(device, table, fmt.Sprintf("set the type of partition %d", number), assumeYes)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A partition image holds the byte range of one partition. Its block map
+// records the partition and where it was on the disk, so commands that read
+// images see it in place on a disk of the original size, and clone writes it
+// back to the same offsets.
+
+// partitionByteRange returns where partition number is on a device or image
+func partitionByteRange(device string, number int) (byteRange, error) {
+	image, err := openImage(device, false)
+	if err != nil {
+		return byteRange{}, err
+	}
+	defer image.Close()
+	table, err := image.partitionTable()
+	if err != nil {
+		return byteRange{}, err
+	}
+	part, err := table.findPartition(number)
+	if err != nil {
+		return byteRange{}, err
+	}
+	start := part.Offset(table.SectorSize)
+	return byteRange{Start: start, End: start + part.Size(table.SectorSize)}, nil
+}
+
+// rangesWithin cuts sorted ranges down to the part inside limit
+func rangesWithin(ranges []byteRange, limit byteRange) []byteRange {
+	var within []byteRange
+	for _, r := range ranges {
+		start, end := max(r.Start, limit.Start), min(r.End, limit.End)
+		if start < end {
+			within = append(within, byteRange{Start: start, End: end})
+		}
+	}
+	return within
+}
+
+// rangesGaps returns the parts of limit that sorted ranges leave out
+func rangesGaps(ranges []byteRange, limit byteRange) []byteRange {
+	var gaps []byteRange
+	pos := limit.Start
+	for _, r := range rangesWithin(ranges, limit) {
+		if pos < r.Start {
+			gaps = append(gaps, byteRange{Start: pos, End: r.Start})
+		}
+		pos = r.End
+	}
+	if pos < limit.End {
+		gaps = append(gaps, byteRange{Start: pos, End: limit.End})
+	}
+	return gaps
+}
+
+// restorePartitionImage writes a partition image back at the offsets it was
+// taken from, once the target has the same partition there
+func restorePartitionImage(src, dst string, blocks *blockMap, options cloneOptions) error {
+	reader, algorithm, err := openDecompressionReader(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := openDeviceWriter(dst, fmt.Sprintf("restore partition %d from %s", blocks.Partition, src))
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	table, err := writer.partitionTable()
+	if err != nil {
+		return fmt.Errorf("%s has no partition table, restore the table first: %v", dst, err)
+	}
+	part, err := table.findPartition(blocks.Partition)
+	if err != nil {
+		return fmt.Errorf("%v, restore the table first", err)
+	}
+	start := part.Offset(table.SectorSize)
+	if at := (byteRange{Start: start, End: start + part.Size(table.SectorSize)}); at != blocks.PartitionRange {
+		return fmt.Errorf("partition %d of %s is at bytes %d-%d, the image was taken at %d-%d",
+			blocks.Partition, dst, at.Start, at.End, blocks.PartitionRange.Start, blocks.PartitionRange.End)
+	}
+
+	// The zeros a zero skipping image left out are written back in the gaps
+	var gaps []byteRange
+	if blocks.Zeros {
+		gaps = rangesGaps(blocks.Ranges, blocks.PartitionRange)
+	}
+	length := rangesLength(blocks.Ranges) + rangesLength(gaps)
+	if writer.DryRun {
+		fmt.Printf("Dry run: would write %s of %s into partition %d of %s\n", formatBytes(length), src, blocks.Partition, dst)
+		return nil
+	}
+	if !options.AssumeYes && !confirm(fmt.Sprintf("Overwrite partition %d of %s (%s) with %s?",
+		blocks.Partition, dst, formatBytes(blocks.PartitionRange.End-blocks.PartitionRange.Start), src)) {
+		return fmt.Errorf("aborted")
+	}
+	if algorithm == "" {
+		algorithm = "raw"
+	}
+	fmt.Printf("Restoring %s partition image %s into partition %d of %s\n", algorithm, src, blocks.Partition, dst)
+
+	listenForPause()
+	display := startProgressDisplay("", nil)
+
+	var (
+		written    int64
+		written256 = sha256.New()
+		buf        = make([]byte, 4*mb)
+		begin      = time.Now()
+	)
+	for _, r := range blocks.Ranges {
+		for off := r.Start; off < r.End && err == nil; {
+			var n int
+			if n, err = io.ReadFull(reader, buf[:min(int64(len(buf)), r.End-off)]); err != nil {
+				err = fmt.Errorf("reading %s: %v", src, err)
+				break
+			}
+			if _, err = writer.WriteAt(buf[:n], off); err != nil {
+				break
+			}
+			written256.Write(buf[:n])
+			off += int64(n)
+			written += int64(n)
+			reportProgress("restoring", written, length)
+			begin = begin.Add(pausePoint(display.Bypass(), writer.Sync))
+		}
+	}
+	zero := make([]byte, len(buf))
+	for _, r := range gaps {
+		for off := r.Start; off < r.End && err == nil; {
+			n := min(int64(len(zero)), r.End-off)
+			if _, err = writer.WriteAt(zero[:n], off); err != nil {
+				break
+			}
+			off += n
+			written += n
+			reportProgress("restoring", written, length)
+		}
+	}
+	display.stop()
+	if err != nil {
+		return err
+	}
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	elapsed := time.Since(begin)
+	fmt.Printf("Restored %s in %s (%.2f MB/s)\n", formatBytes(written), elapsed.Truncate(time.Second), float64(written)/mb/elapsed.Seconds())
+
+	if !options.Verify {
+		return nil
+	}
+	fmt.Println("Verifying")
+	target := newRangesReader(writer, blocks.Ranges)
+	read256 := sha256.New()
+	if _, err := io.CopyBuffer(read256, io.NewSectionReader(target, 0, target.size), buf); err != nil {
+		return fmt.Errorf("verifying: %v", err)
+	}
+	fmt.Printf("Image SHA-256:     %x\nPartition SHA-256: %x\n", written256.Sum(nil), read256.Sum(nil))
+	if !bytes.Equal(written256.Sum(nil), read256.Sum(nil)) {
+		return fmt.Errorf("partition %d of %s does not match %s", blocks.Partition, dst, src)
+	}
+	fmt.Printf("%sVerified, the partition matches%s\n", green, reset)
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// describeGPTAttributes lists the set attribute bits by their sfdisk names
+func describeGPTAttributes(flags uint64) string {
+	var names []string
+	for bit := uint(0); bit < 64; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		name := fmt.Sprintf("GUID:%d", bit)
+		for attr, attrBit := range gptAttributeBits {
+			if attrBit == bit {
+				name = attr
+			}
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// describeAlignment gives the largest power of two up to 1 MiB the offset is
+// a multiple of, with a warning below 4 KiB
+func describeAlignment(offset int64) string {
+	align := int64(mb)
+	for align > 1 && offset%align != 0 {
+		align /= 2
+	}
+	if align < 4*kb {
+		return fmt.Sprintf("%s%s, misaligned for 4K sectors%s", yellow, formatBytes(align), reset)
+	}
+	return formatBytes(align)
+}
+
+// detectContainer recognises encrypted, LVM and RAID containers in a partition
+func detectContainer(r io.ReaderAt, offset, size int64) string {
+	head := make([]byte, 8*kb)
+	if n, _ := r.ReadAt(head, offset); n < len(head) {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("LUKS\xba\xbe")):
+		return fmt.Sprintf("LUKS%d", binary.BigEndian.Uint16(head[6:]))
+	case bytes.Equal(head[3:11], []byte("-FVE-FS-")):
+		return "BitLocker"
+	}
+	for sector := 0; sector < 4; sector++ {
+		label := head[sector*512:]
+		if bytes.HasPrefix(label, []byte("LABELONE")) && bytes.HasPrefix(label[24:], []byte("LVM2 001")) {
+			return "LVM2 physical volume"
+		}
+	}
+
+	// Linux RAID superblocks sit at 4 KiB (1.2), the start (1.1), 8 KiB from
+	// the end (1.0) or in the last 64 KiB block (0.90)
+	const mdMagic = 0xa92b4efc
+	candidates := map[int64]string{
+		offset + 4*kb: "1.2",
+		offset:        "1.1",
+	}
+	if size >= 128*kb {
+		candidates[offset+(size-8*kb)&^(4*kb-1)] = "1.0"
+		candidates[offset+(size&^(64*kb-1))-64*kb] = "0.90"
+	}
+	magic := make([]byte, 4)
+	for at, version := range candidates {
+		if _, err := r.ReadAt(magic, at); err == nil && binary.LittleEndian.Uint32(magic) == mdMagic {
+			return "Linux RAID member (metadata " + version + ")"
+		}
+	}
+	return ""
+}
+
+// partitionInfo prints everything known about one partition: its table
+// entry, where it lies, the filesystem or container in it, whether it is in
+// use and a dump of its first sector
+func partitionInfo(device string, number int) error {
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	table, err := readPartitionTable(image, image.SectorSize)
+	if err != nil {
+		return err
+	}
+	part, err := table.findPartition(number)
+	if err != nil {
+		return err
+	}
+
+	sectorSize := table.SectorSize
+	offset, size := part.Offset(sectorSize), part.Size(sectorSize)
+	info, err := image.Stat()
+	isImage := err != nil || info.Mode()&os.ModeDevice == 0
+	path := partitionDevicePath(device, number)
+	if isImage {
+		path = fmt.Sprintf("%s:%d", device, number)
+	}
+	field := func(name, value string) {
+		fmt.Printf("%-16s: %s\n", name, value)
+	}
+
+	field("Disk", fmt.Sprintf("%s (%s)", device, table.Type))
+	field("Partition", path)
+	field("Number", fmt.Sprint(number))
+	field("Type", partitionTypeName(*part))
+	switch {
+	case part.GPT != nil:
+		field("Type GUID", formatGUID(part.GPT.TypeGUID))
+		field("Unique GUID", formatGUID(part.GPT.UniqueGUID))
+		field("Name", part.Name)
+		field("Attributes", fmt.Sprintf("0x%016x (%s)", part.GPT.AttributeFlags, describeGPTAttributes(part.GPT.AttributeFlags)))
+	case part.MBR != nil:
+		field("Type ID", fmt.Sprintf("0x%02x", part.MBR.Type))
+		status := "inactive"
+		if part.MBR.Status&0x80 != 0 {
+			status = "active (bootable)"
+		}
+		field("Status", fmt.Sprintf("0x%02x, %s", part.MBR.Status, status))
+	default:
+		if part.Name != "" {
+			field("Name", part.Name)
+		}
+	}
+
+	field("First LBA", fmt.Sprint(part.FirstLBA))
+	field("Last LBA", fmt.Sprint(part.LastLBA))
+	field("Sectors", fmt.Sprintf("%d of %d bytes", part.Sectors(), sectorSize))
+	field("Size", fmt.Sprintf("%s (%d bytes)", formatBytes(size), size))
+	field("Offset", fmt.Sprintf("%d bytes", offset))
+	field("Alignment", describeAlignment(offset))
+
+	fsType := identifyFileSystem(image, offset, size)
+	if fsType == "" {
+		fsType = "Unknown"
+	}
+	field("Filesystem", fsType)
+	if fsys, err := openFileSystem(io.NewSectionReader(image, offset, size), size); err == nil {
+		if label := volumeLabel(fsys); label != "" {
+			field("Label", label)
+		}
+		if id := volumeID(fsys); id != "" {
+			field("UUID", id)
+		}
+	}
+	if container := detectContainer(image, offset, size); container != "" {
+		field("Container", container)
+	}
+
+	if isImage {
+		field("In use", "n/a, an image")
+	} else if usage := partitionUsage(path); usage != "" {
+		field("In use", usage)
+	} else {
+		field("In use", "no")
+	}
+
+	first := make([]byte, sectorSize)
+	if _, err := image.ReadAt(first, offset); err != nil {
+		return fmt.Errorf("reading the first sector: %v", err)
+	}
+	fmt.Println()
+	fmt.Println("First sector:")
+	printHexDump(os.Stdout, first, offset)
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"unicode/utf16"
+)
+
+// partitionEntry is a table independent view of a single partition
+type partitionEntry struct {
+	Number   int // slot number in the table, 1 based like the kernel names them
+	FirstLBA uint64
+	LastLBA  uint64
+	Name     string
+	GPT      *gptPartition
+	MBR      *mbrPartition
+	APM      *apmPartition
+	BSD      *bsdPartition
+	Sun      *sunPartition
+	SGI      *sgiPartition
+}
+
+// partitionTable holds the parsed partition table of a disk or image
+type partitionTable struct {
+	Type       string // GPT, MBR, APM, BSD, Sun or SGI
+	SectorSize uint64
+	MBR        mbrStruct
+	Header     *gptHeader
+	Partitions []partitionEntry
+	// BSDLabels are the partitions of the disklabels in BSD slices of an MBR,
+	// by slice number
+	BSDLabels map[int][]partitionEntry
+
+	// PrimaryDamage is set when the primary GPT is damaged and the table was
+	// read from the backup GPT at the end of the disk
+	PrimaryDamage error
+	// DeviceSectorSize is set when the GPT was written for another logical
+	// sector size than the device has now, e.g. after moving a disk between
+	// 512e and 4Kn enclosures. SectorSize is the one of the table.
+	DeviceSectorSize uint64
+	// DiskSignature is written to an MBR when set, otherwise the one on the
+	// disk is kept
+	DiskSignature uint32
+}
+
+// Sectors returns the number of sectors the partition spans
+func (p partitionEntry) Sectors() uint64 {
+	return p.LastLBA - p.FirstLBA + 1
+}
+
+// Offset returns the byte offset of the partition
+func (p partitionEntry) Offset(sectorSize uint64) int64 {
+	return int64(p.FirstLBA * sectorSize)
+}
+
+// Size returns the size of the partition in bytes
+func (p partitionEntry) Size(sectorSize uint64) int64 {
+	return int64(p.Sectors() * sectorSize)
+}
+
+// readPartitionTable parses the GPT, or if there is none the Apple Partition
+// Map, Sun or SGI label, MBR or BSD disklabel, from r
+func readPartitionTable(r io.ReaderAt, sectorSize uint64) (*partitionTable, error) {
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+
+	pt := &partitionTable{SectorSize: sectorSize}
+	err := binary.Read(io.NewSectionReader(r, 0, 512), binary.LittleEndian, &pt.MBR)
+	if err != nil {
+		return nil, fmt.Errorf("reading MBR: %v", err)
+	}
+
+	header, damage := readGPTHeader(r, 1, sectorSize)
+	if damage != nil {
+		if backup := findBackupGPT(r, pt, header, sectorSize); backup != nil {
+			// The entries are read from the backup's own array, writing the
+			// table turns it into the primary again, see asPrimary
+			header, pt.PrimaryDamage = backup, damage
+		}
+	}
+	if header == nil {
+		// A GPT written with the other common sector size has its header
+		// at LBA 1 of that size
+		for _, size := range []uint64{512, 4096} {
+			if size == sectorSize {
+				continue
+			}
+			if found, err := readGPTHeader(r, 1, size); err == nil && found.CurrentLBA == 1 {
+				header, pt.SectorSize, pt.DeviceSectorSize = found, size, sectorSize
+				sectorSize = size
+				break
+			}
+		}
+	}
+	if header != nil {
+		// A damaged primary without a usable backup is still read as well as it can be
+		pt.Type = "GPT"
+		pt.Header = header
+		pt.Partitions, err = readGPTEntries(r, header, sectorSize)
+		if err != nil {
+			return nil, err
+		}
+		return pt, nil
+	}
+
+	if found, err := readAPM(r, pt); found {
+		if err != nil {
+			return nil, err
+		}
+		return pt, nil
+	}
+
+	if readSunLabel(r, pt) || readSGILabel(r, pt) {
+		return pt, nil
+	}
+
+	if pt.MBR.Signature != 0xAA55 {
+		// BSD disks without slices have just the disklabel
+		if parts, found := readBSDLabel(r, 0, sectorSize); found {
+			pt.Type = "BSD"
+			pt.Partitions = parts
+			return pt, nil
+		}
+		return nil, fmt.Errorf("invalid MBR signature 0x%04x", pt.MBR.Signature)
+	}
+
+	pt.Type = "MBR"
+	for i := range pt.MBR.Partitions {
+		part := pt.MBR.Partitions[i]
+		if part.Sectors == 0 {
+			continue
+		}
+		pt.Partitions = append(pt.Partitions, partitionEntry{
+			Number:   i + 1,
+			FirstLBA: uint64(part.FirstSector),
+			LastLBA:  uint64(part.FirstSector) + uint64(part.Sectors) - 1,
+			Name:     fmt.Sprintf("0x%02x", part.Type),
+			MBR:      &part,
+		})
+		if bsdSliceTypes[part.Type] {
+			if parts, found := readBSDLabel(r, uint64(part.FirstSector), sectorSize); found {
+				if pt.BSDLabels == nil {
+					pt.BSDLabels = make(map[int][]partitionEntry)
+				}
+				pt.BSDLabels[i+1] = parts
+			}
+		}
+	}
+
+	return pt, nil
+}
+
+// readGPTHeader reads the GPT header at lba and checks its CRC and the CRC of
+// its entry array. The header is nil if there is no GPT signature, the error
+// tells what is damaged.
+func readGPTHeader(r io.ReaderAt, lba, sectorSize uint64) (*gptHeader, error) {
+	block := make([]byte, 512)
+	if _, err := r.ReadAt(block, int64(lba*sectorSize)); err != nil {
+		return nil, fmt.Errorf("reading GPT header at LBA %d: %v", lba, err)
+	}
+	header := &gptHeader{}
+	binary.Read(bytes.NewReader(block), binary.LittleEndian, header)
+	if string(header.Signature[:]) != "EFI PART" {
+		return nil, fmt.Errorf("no GPT header at LBA %d", lba)
+	}
+
+	if header.HeaderSize < 92 || header.HeaderSize > 512 {
+		return header, fmt.Errorf("the GPT header at LBA %d has an invalid size %d", lba, header.HeaderSize)
+	}
+	binary.LittleEndian.PutUint32(block[16:], 0)
+	if crc32.ChecksumIEEE(block[:header.HeaderSize]) != header.CRC32 {
+		return header, fmt.Errorf("the GPT header at LBA %d has a bad CRC", lba)
+	}
+	if header.PartEntrySize < 128 || header.NumPartEntries > 65536 {
+		return header, fmt.Errorf("the GPT header at LBA %d has an invalid entry layout %dx%d", lba, header.NumPartEntries, header.PartEntrySize)
+	}
+	entries := make([]byte, int64(header.NumPartEntries)*int64(header.PartEntrySize))
+	if _, err := r.ReadAt(entries, int64(header.PartitionEntryLBA*sectorSize)); err != nil {
+		return header, fmt.Errorf("reading the GPT entries at LBA %d: %v", header.PartitionEntryLBA, err)
+	}
+	if crc32.ChecksumIEEE(entries) != header.PartEntryArrayCRC32 {
+		return header, fmt.Errorf("the GPT entries at LBA %d have a bad CRC", header.PartitionEntryLBA)
+	}
+	return header, nil
+}
+
+// asPrimary returns the primary header a GPT header describes. A backup
+// header, read when the primary was damaged, has its entries at the end of
+// the disk, the primary ones follow its header at LBA 1.
+func (h gptHeader) asPrimary() gptHeader {
+	if h.CurrentLBA != 1 {
+		h.CurrentLBA, h.BackupLBA = 1, h.CurrentLBA
+		h.PartitionEntryLBA = 2
+	}
+	return h
+}
+
+// findBackupGPT looks for an intact backup GPT header where the damaged
+// primary, the end of the disk and the protective MBR place it
+func findBackupGPT(r io.ReaderAt, pt *partitionTable, primary *gptHeader, sectorSize uint64) *gptHeader {
+	var candidates []uint64
+	if primary != nil {
+		candidates = append(candidates, primary.BackupLBA)
+	}
+	if size := readerSize(r); size > 0 {
+		candidates = append(candidates, uint64(size)/sectorSize-1)
+	}
+	for _, part := range pt.MBR.Partitions {
+		if part.Type == 0xee && part.Sectors != 0xffffffff {
+			candidates = append(candidates, uint64(part.FirstSector)+uint64(part.Sectors)-1)
+		}
+	}
+
+	for _, lba := range candidates {
+		if lba <= 1 {
+			continue
+		}
+		if header, err := readGPTHeader(r, lba, sectorSize); err == nil && header.CurrentLBA == lba {
+			return header
+		}
+	}
+	return nil
+}
+
+// readerSize returns the size of what r reads, 0 if it does not know
+func readerSize(r io.ReaderAt) int64 {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case *os.File:
+		size, _ := getFileSize(v)
+		return size
+	}
+	return 0
+}
+
+func readGPTEntries(r io.ReaderAt, header *gptHeader, sectorSize uint64) ([]partitionEntry, error) {
+	if header.PartEntrySize < 128 {
+		return nil, fmt.Errorf("invalid GPT entry size %d", header.PartEntrySize)
+	}
+
+	var entries []partitionEntry
+	base := int64(header.PartitionEntryLBA * sectorSize)
+	for i := uint32(0); i < header.NumPartEntries; i++ {
+		part := gptPartition{}
+		offset := base + int64(i)*int64(header.PartEntrySize)
+		err := binary.Read(io.NewSectionReader(r, offset, 128), binary.LittleEndian, &part)
+		if err != nil {
+			return nil, fmt.Errorf("reading partition entry %d: %v", i+1, err)
+		}
+		if part.FirstLBA == 0 {
+			continue
+		}
+
+		entries = append(entries, partitionEntry{
+			Number:   int(i) + 1,
+			FirstLBA: part.FirstLBA,
+			LastLBA:  part.LastLBA,
+			Name:     decodeGPTName(part.PartitionName),
+			GPT:      &part,
+		})
+	}
+
+	return entries, nil
+}
+
+// decodeGPTName converts the UTF-16LE partition name into a string
+func decodeGPTName(raw [72]byte) string {
+	u := make([]uint16, 0, 36)
+	for i := 0; i+1 < len(raw); i += 2 {
+		c := binary.LittleEndian.Uint16(raw[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// warnings describes a table recovered from the backup GPT or written for
+// another sector size, and how to repair it
+func (pt *partitionTable) warnings(device string) []warning {
+	var warnings []warning
+	if pt.PrimaryDamage != nil {
+		warnings = append(warnings, warning{Code: warnGPTPrimaryDamaged, Device: device,
+			Message: fmt.Sprintf("the primary GPT of %s is damaged (%v), the partitions were recovered from the backup GPT. Run dsktool table repair %s to rewrite it.",
+				device, pt.PrimaryDamage, device)})
+	}
+	if pt.DeviceSectorSize != 0 {
+		warnings = append(warnings, warning{Code: warnGPTSectorSize, Device: device,
+			Message: fmt.Sprintf("the GPT of %s was written for %d byte sectors but the device has %d byte sectors, it was probably moved between enclosures. Run dsktool table repair %s to rewrite it for %d byte sectors.",
+				device, pt.SectorSize, pt.DeviceSectorSize, device, pt.DeviceSectorSize)})
+	}
+	// Partitions off 4 KiB boundaries make disks with 4K physical sectors
+	// read and write two sectors for one
+	for _, part := range pt.Partitions {
+		if offset := part.Offset(pt.SectorSize); offset%4096 != 0 {
+			warnings = append(warnings, warning{Code: warnMisaligned, Device: device,
+				Message: fmt.Sprintf("partition %d of %s starts at byte %d, off the 4 KiB boundaries of disks with 4K sectors",
+					part.Number, device, offset)})
+		}
+	}
+	return warnings
+}
+
+// checkWritable returns an error for the table types that are only read
+func (pt *partitionTable) checkWritable() error {
+	switch pt.Type {
+	case "APM", "BSD", "Sun", "SGI":
+		return fmt.Errorf("%s partition tables are read-only, only GPT and MBR tables can be changed", pt.Type)
+	}
+	return nil
+}
+
+// findPartition returns the partition with the given slot number
+func (pt *partitionTable) findPartition(number int) (*partitionEntry, error) {
+	for i := range pt.Partitions {
+		if pt.Partitions[i].Number == number {
+			return &pt.Partitions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("partition %d not found in %s table", number, pt.Type)
+}
+
+// formatGUID renders an on-disk GUID in its canonical mixed endian form
+func formatGUID(g [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// freeRegion is an unpartitioned range of LBAs
+type freeRegion struct {
+	First uint64
+	Last  uint64
+}
+
+// Sectors returns the number of sectors in the region
+func (r freeRegion) Sectors() uint64 {
+	return r.Last - r.First + 1
+}
+
+// usableRange returns the LBAs partitions may occupy on a disk of diskSectors sectors
+func (pt *partitionTable) usableRange(diskSectors uint64) (uint64, uint64) {
+	if pt.Header != nil {
+		return pt.Header.FirstUsableLBA, pt.Header.LastUsableLBA
+	}
+	last := diskSectors - 1
+	if last > 0xffffffff {
+		last = 0xffffffff
+	}
+	return 1, last
+}
+
+// freeRegions returns the gaps between partitions in LBA order
+func (pt *partitionTable) freeRegions(diskSectors uint64) []freeRegion {
+	first, last := pt.usableRange(diskSectors)
+
+	parts := append([]partitionEntry{}, pt.Partitions...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].FirstLBA < parts[j].FirstLBA })
+
+	var regions []freeRegion
+	next := first
+	for _, part := range parts {
+		if part.FirstLBA > next {
+			regions = append(regions, freeRegion{First: next, Last: part.FirstLBA - 1})
+		}
+		if part.LastLBA+1 > next {
+			next = part.LastLBA + 1
+		}
+	}
+	if next <= last {
+		regions = append(regions, freeRegion{First: next, Last: last})
+	}
+	return regions
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// part move copies the data of a partition to its new place before the
+// table is changed. Where the old and new place overlap the copy overwrites
+// data it has not moved yet, so it goes from the end the partition moves
+// towards, in chunks no larger than the shift, and a journal records how far
+// it got before any write reaches data that is not recorded as moved. An
+// interrupted move can then be continued, or undone by moving the moved part
+// back, and the table only changes once all of the data is in place.
+
+// moveChunkSize is the largest amount copied at once
+const moveChunkSize = 4 * mb
+
+// moveJournal records a partition move that is under way
+type moveJournal struct {
+	Device      string `json:"device"`
+	Partition   int    `json:"partition"`
+	FirstLBA    uint64 `json:"first_lba"` // where the partition starts in the table
+	NewFirstLBA uint64 `json:"new_first_lba"`
+	// From, To and Length are the bytes being moved, all of the partition
+	// or the moved part of it when rolling back
+	From        int64     `json:"from"`
+	To          int64     `json:"to"`
+	Length      int64     `json:"length"`
+	Done        int64     `json:"done"` // moved from the end that is copied first
+	RollingBack bool      `json:"rolling_back,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// moveJournalPath returns the journal of moves on a device, kept in the
+// configuration directory unless a path is given
+func moveJournalPath(device, path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(device, `/\.`))
+	return filepath.Join(dir, "part-move-"+name+".json"), nil
+}
+
+// loadMoveJournal reads a journal, nil if there is none
+func loadMoveJournal(path string) (*moveJournal, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var journal moveJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return &journal, nil
+}
+
+// save writes the journal to disk before it is renamed into place, the
+// copy relies on it surviving a crash
+func (j *moveJournal) save(path string) error {
+	j.Updated = time.Now()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// shift is how far the data moves
+func (j *moveJournal) shift() int64 {
+	if j.To > j.From {
+		return j.To - j.From
+	}
+	return j.From - j.To
+}
+
+// relocate copies what is left of the move. Moving down it copies from the
+// start, moving up from the end, so a write only reaches data already copied.
+func (j *moveJournal) relocate(writer *deviceWriter, path, phase string) error {
+	shift := j.shift()
+	buf := make([]byte, min(moveChunkSize, shift))
+	saved := j.Done
+
+	listenForPause()
+	display := startProgressDisplay("", nil)
+	defer display.stop()
+	for j.Done < j.Length {
+		n := min(int64(len(buf)), j.Length-j.Done)
+		offset := j.Done
+		if j.To > j.From {
+			offset = j.Length - j.Done - n
+		}
+		// The write reaches data up to Done+n-shift from where the move
+		// started, which has to be recorded as moved first
+		if j.Done+n-shift > saved || j.Done-saved >= checkpointInterval {
+			if err := writer.Sync(); err != nil {
+				return err
+			}
+			if err := j.save(path); err != nil {
+				return fmt.Errorf("writing the journal: %v", err)
+			}
+			saved = j.Done
+		}
+		if _, err := writer.ReadAt(buf[:n], j.From+offset); err != nil {
+			return fmt.Errorf("reading at offset %d: %v", j.From+offset, err)
+		}
+		if _, err := writer.WriteAt(buf[:n], j.To+offset); err != nil {
+			return fmt.Errorf("writing at offset %d: %v", j.To+offset, err)
+		}
+		j.Done += n
+		reportProgress(phase, j.Done, j.Length)
+		pausePoint(display.Bypass(), writer.Sync)
+	}
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	return j.save(path)
+}
+
+// rollback turns the journal into the move of the moved part back to where
+// it came from
+func (j *moveJournal) rollback() {
+	if j.RollingBack {
+		return
+	}
+	if j.To < j.From {
+		j.From, j.To, j.Length = j.To, j.From, j.Done
+	} else {
+		rest := j.Length - j.Done
+		j.From, j.To, j.Length = j.To+rest, j.From+rest, j.Done
+	}
+	j.Done, j.RollingBack = 0, true
+}
+
+// placePartition sets where a partition starts in the table, keeping its size
+func placePartition(part *partitionEntry, firstLBA uint64) {
+	part.LastLBA = firstLBA + part.LastLBA - part.FirstLBA
+	part.FirstLBA = firstLBA
+	if part.GPT != nil {
+		part.GPT.FirstLBA, part.GPT.LastLBA = part.FirstLBA, part.LastLBA
+	}
+	if part.MBR != nil {
+		part.MBR.FirstSector = uint32(part.FirstLBA)
+	}
+}
+
+// parseNewStart reads the new start of a partition, an LBA or an offset
+// like 1MiB
+func parseNewStart(table *partitionTable, value string, diskSectors uint64) (uint64, error) {
+	if lba, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64); err == nil {
+		return lba, nil
+	}
+	lba, err := table.offsetLBA(value, diskSectors)
+	if err != nil {
+		return 0, fmt.Errorf("invalid new start %q: %v", value, err)
+	}
+	return lba, nil
+}
+
+// movePartition moves a partition and its data to start at newStart
+func movePartition(device string, number int, newStart, journalFile string, assumeYes bool) error {
+	path, err := moveJournalPath(device, journalFile)
+	if err != nil {
+		return err
+	}
+	if journal, err := loadMoveJournal(path); err != nil {
+		return err
+	} else if journal != nil {
+		return fmt.Errorf("the move of partition %d of %s is unfinished, continue it with --resume or undo it with --rollback (%s)", journal.Partition, journal.Device, path)
+	}
+
+	table, diskSectors, err := loadEditableTable(device)
+	if err != nil {
+		return err
+	}
+	part, err := table.findPartition(number)
+	if err != nil {
+		return err
+	}
+	if part.MBR != nil && isExtendedType(part.MBR.Type) {
+		return fmt.Errorf("partition %d is an extended partition, its logical partitions would have to move with it", number)
+	}
+	first, err := parseNewStart(table, newStart, diskSectors)
+	if err != nil {
+		return err
+	}
+	if first == part.FirstLBA {
+		return fmt.Errorf("partition %d starts at LBA %d already", number, first)
+	}
+	last := first + part.LastLBA - part.FirstLBA
+	usableFirst, usableLast := table.usableRange(diskSectors)
+	if first < usableFirst || last > usableLast {
+		return fmt.Errorf("LBA %d-%d is outside the usable area %d-%d", first, last, usableFirst, usableLast)
+	}
+	for _, other := range table.Partitions {
+		if other.Number != number && first <= other.LastLBA && last >= other.FirstLBA {
+			return fmt.Errorf("LBA %d-%d overlaps partition %d (%d-%d)", first, last, other.Number, other.FirstLBA, other.LastLBA)
+		}
+	}
+
+	journal := &moveJournal{
+		Device:      device,
+		Partition:   number,
+		FirstLBA:    part.FirstLBA,
+		NewFirstLBA: first,
+		From:        part.Offset(table.SectorSize),
+		To:          int64(first * table.SectorSize),
+		Length:      part.Size(table.SectorSize),
+	}
+	direction := "down"
+	if first > part.FirstLBA {
+		direction = "up"
+	}
+	fmt.Printf("Moving partition %d of %s (%s) from LBA %d to LBA %d, %s %s\n", number, device,
+		formatBytes(journal.Length), part.FirstLBA, first, formatBytes(journal.shift()), direction)
+	if dryRun {
+		fmt.Printf("Dry run: would move %s of data from offset %d to %d\n", formatBytes(journal.Length), journal.From, journal.To)
+		placePartition(part, first)
+		return commitPartitionTable(device, table, fmt.Sprintf("move partition %d", number), true)
+	}
+	if !assumeYes && !confirm(fmt.Sprintf("Move partition %d of %s? It must not be mounted until the move is done", number, device)) {
+		return fmt.Errorf("aborted, nothing was written")
+	}
+	// The checks of opening the device come before the journal, so a
+	// refused move leaves nothing to resume
+	writer, err := openDeviceWriter(device, fmt.Sprintf("move partition %d", number))
+	if err != nil {
+		return err
+	}
+	if err := journal.save(path); err != nil {
+		writer.Close()
+		return fmt.Errorf("writing the journal: %v", err)
+	}
+	fmt.Println("Journal:", path)
+	return finishMove(writer, journal, path)
+}
+
+// resumeMove continues an interrupted move, or undoes it with rollback
+func resumeMove(device, journalFile string, rollback bool) error {
+	path, err := moveJournalPath(device, journalFile)
+	if err != nil {
+		return err
+	}
+	journal, err := loadMoveJournal(path)
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return fmt.Errorf("no move of %s to continue, there is no %s", device, path)
+	}
+	if journal.Device != device {
+		return fmt.Errorf("%s is of a move on %s, not %s", path, journal.Device, device)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: would continue moving %s of partition %d from offset %d to %d\n",
+			formatBytes(journal.Length-journal.Done), journal.Partition, journal.From, journal.To)
+		return nil
+	}
+	writer, err := openDeviceWriter(device, fmt.Sprintf("move partition %d", journal.Partition))
+	if err != nil {
+		return err
+	}
+	if rollback && !journal.RollingBack {
+		journal.rollback()
+		if err := journal.save(path); err != nil {
+			writer.Close()
+			return fmt.Errorf("writing the journal: %v", err)
+		}
+	}
+	if journal.RollingBack {
+		fmt.Printf("Moving %s of partition %d of %s back to LBA %d\n", formatBytes(journal.Length-journal.Done), journal.Partition, device, journal.FirstLBA)
+	} else {
+		fmt.Printf("Continuing to move partition %d of %s to LBA %d, %s of %s left\n", journal.Partition, device,
+			journal.NewFirstLBA, formatBytes(journal.Length-journal.Done), formatBytes(journal.Length))
+	}
+	return finishMove(writer, journal, path)
+}
+
+// finishMove copies the rest of the data with the opened device, points the
+// table entry at where the data is and removes the journal
+func finishMove(writer *deviceWriter, journal *moveJournal, path string) error {
+	operation := fmt.Sprintf("move partition %d", journal.Partition)
+	phase := "moving"
+	if journal.RollingBack {
+		phase = "rolling back"
+	}
+	start := time.Now()
+	if err := journal.relocate(writer, path, phase); err != nil {
+		writer.Close()
+		reportProgressError(err.Error())
+		fmt.Fprintf(messageOutput(os.Stdout), "The journal is at %s of %s, continue the move with --resume or undo it with --rollback\n",
+			formatBytes(journal.Done), formatBytes(journal.Length))
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	verb := "Moved"
+	if journal.RollingBack {
+		verb = "Moved back"
+	}
+	fmt.Printf("%s %s in %s (%.2f MB/s)\n", verb, formatBytes(journal.Length), elapsed.Truncate(time.Second), float64(journal.Length)/mb/elapsed.Seconds())
+
+	// The table may point at the new place already when the journal was
+	// not removed after the last move
+	target := journal.NewFirstLBA
+	if journal.RollingBack {
+		target = journal.FirstLBA
+	}
+	table, _, err := loadEditableTable(journal.Device)
+	if err != nil {
+		return err
+	}
+	part, err := table.findPartition(journal.Partition)
+	if err != nil {
+		return err
+	}
+	if part.FirstLBA != target {
+		placePartition(part, target)
+		if err := commitPartitionTable(journal.Device, table, operation, true); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing the journal: %v", err)
+	}
+	printResult("%s partition %d at LBA %d", journal.Device, journal.Partition, target)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// part sort numbers the GPT entries in the order the partitions are on the
+// disk, like the s command of gdisk, after create and delete cycles left
+// the slots sparse or out of order.
+
+// sortPartitions renumbers the partitions 1, 2, 3 and so on by their first
+// LBA. It returns the old number of each partition whose number changed,
+// by its new number.
+func (pt *partitionTable) sortPartitions() map[int]int {
+	sort.SliceStable(pt.Partitions, func(i, j int) bool {
+		return pt.Partitions[i].FirstLBA < pt.Partitions[j].FirstLBA
+	})
+	moved := map[int]int{}
+	for i := range pt.Partitions {
+		if pt.Partitions[i].Number != i+1 {
+			moved[i+1] = pt.Partitions[i].Number
+			pt.Partitions[i].Number = i + 1
+		}
+	}
+	return moved
+}
+
+// sortPartitionTable sorts the GPT entries of a device and writes the table
+// after showing the changes
+func sortPartitionTable(device string, assumeYes bool) error {
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	table, err := image.partitionTable()
+	image.Close()
+	if err != nil {
+		return err
+	}
+	if table.Type != "GPT" {
+		return fmt.Errorf("%s has an %s partition table, only GPT entries are sorted", device, table.Type)
+	}
+	if table.PrimaryDamage != nil || table.DeviceSectorSize != 0 {
+		return fmt.Errorf("the GPT of %s needs a table repair first", device)
+	}
+
+	moved := table.sortPartitions()
+	if len(moved) == 0 {
+		fmt.Printf("The partitions of %s are already numbered in disk order\n", device)
+		return nil
+	}
+	for number := 1; number <= len(table.Partitions); number++ {
+		if old, ok := moved[number]; ok {
+			fmt.Printf("Partition %d becomes partition %d\n", old, number)
+		}
+	}
+	// Everything that names a partition by its number follows the new numbers
+	warnf(warnPartitionNumbering, device, "device names with partition numbers in fstab or crypttab, bootloader entries like (hd0,gpt2) and EFI boot entries refer to the new numbers once this is written. References by UUID, PARTUUID or label keep working.")
+	return commitPartitionTable(device, table, "sort partitions", assumeYes)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Long operations can be paused to free the disk for a while and resumed in
+// the same process, by pressing Enter on the terminal or with SIGUSR1.
+
+var (
+	pauseToggles    = make(chan struct{}, 1)
+	pauseListenOnce sync.Once
+)
+
+// togglePause requests a pause, or the end of one, without blocking
+func togglePause() {
+	select {
+	case pauseToggles <- struct{}{}:
+	default:
+	}
+}
+
+// listenForPause starts watching for pause requests. It is safe to call for
+// every operation, the listeners are started once.
+func listenForPause() {
+	listenForPauseTo(os.Stdout)
+}
+
+// listenForPauseTo is listenForPause with the hint how to pause written to report
+func listenForPauseTo(report io.Writer) {
+	pauseListenOnce.Do(func() {
+		var how []string
+		if signals := pauseSignals(); len(signals) > 0 {
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, signals...)
+			go func() {
+				for range ch {
+					togglePause()
+				}
+			}()
+			how = append(how, fmt.Sprintf("run kill -USR1 %d", os.Getpid()))
+		}
+		if isTerminal(os.Stdin) {
+			go func() {
+				reader := bufio.NewReader(os.Stdin)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					togglePause()
+				}
+			}()
+			how = append([]string{"press Enter"}, how...)
+		}
+		if len(how) > 0 && !quiet {
+			fmt.Fprintf(report, "To pause or resume, %s\n", strings.Join(how, " or "))
+		}
+	})
+}
+
+// pausePoint is called between the chunks of a long operation. If a pause
+// was requested it quiesces the operation, e.g. syncs written data, and
+// blocks until resumed. It returns how long it was paused, so rates can
+// leave the pause out.
+func pausePoint(report io.Writer, quiesce func() error) time.Duration {
+	select {
+	case <-pauseToggles:
+	default:
+		return 0
+	}
+
+	start := time.Now()
+	if quiesce != nil {
+		if err := quiesce(); err != nil {
+			fmt.Fprintf(report, "%sWarning: flushing before the pause failed: %v%s\n", yellow, err, reset)
+		}
+	}
+	fmt.Fprintf(report, "%sPaused, no I/O until resumed%s\n", yellow, reset)
+	reportPaused(true)
+	<-pauseToggles
+	reportPaused(false)
+	paused := time.Since(start).Truncate(time.Second)
+	fmt.Fprintf(report, "%sResumed after %s%s\n", green, paused, reset)
+	return time.Since(start)
+}
+
+// flushWriters pushes buffered data out of each writer that can flush and
+// syncs the ones backed by a file, in order
+func flushWriters(writers ...io.Writer) error {
+	for _, w := range writers {
+		if f, ok := w.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+		if f, ok := w.(interface{ Sync() error }); ok {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
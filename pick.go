@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Pick modes turn the TUI into a selector that prints the chosen path
+const (
+	tuiPickDisk      = "disk"
+	tuiPickPartition = "partition"
+)
+
+// pickDevice runs the TUI as a selector and prints the chosen path to stdout
+func pickDevice(devices []string, pick string) error {
+	selected, err := runTUI(devices, pick)
+	if err != nil {
+		return err
+	}
+	if selected == "" {
+		os.Exit(1)
+	}
+	fmt.Println(selected)
+	return nil
+}
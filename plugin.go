@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins are executables in the plugins directory of the dsktool
+// configuration directory. dsktool talks to them with JSON over stdin and
+// stdout, so they can be written in any language:
+//
+//	PLUGIN describe        print {"name", "version", "probe", "outputs", "formats"}
+//	PLUGIN probe           read {"offset", "size", "data"} with the first 64 KiB of a
+//	                       partition in base64, print {"type", "label"}, an empty
+//	                       type when the filesystem is not recognised
+//	PLUGIN output URL      read an image stream and store it at URL, for the URL
+//	                       schemes listed in outputs
+//	PLUGIN format NAME     read {"headers", "rows"} and print them in format NAME,
+//	                       for the names listed in formats
+//
+// A plugin exiting non-zero fails the operation, its stderr is passed through.
+
+const (
+	pluginDir       = "plugins"
+	pluginProbeSize = 64 * kb
+	pluginTimeout   = 10 * time.Second // for describe, probe and format, not for output
+)
+
+// pluginInfo is what a plugin reports about itself
+type pluginInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Probe   bool     `json:"probe"`
+	Outputs []string `json:"outputs"`
+	Formats []string `json:"formats"`
+	Path    string   `json:"-"`
+	Err     error    `json:"-"`
+}
+
+type pluginProbeRequest struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Data   string `json:"data"`
+}
+
+type pluginProbeResponse struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+}
+
+type pluginFormatRequest struct {
+	Headers []string   `json:"headers"`
+	Rows    [][]string `json:"rows"`
+}
+
+var (
+	pluginsOnce   sync.Once
+	pluginsLoaded []pluginInfo
+)
+
+// plugins describes every plugin once per run. Plugins that fail to describe
+// themselves are kept with Err set so plugin ls can show why.
+func plugins() []pluginInfo {
+	pluginsOnce.Do(func() {
+		dir, err := configDir()
+		if err != nil {
+			return
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, pluginDir))
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(dir, pluginDir, entry.Name())
+			info := pluginInfo{Name: entry.Name(), Path: path}
+			output, err := runPlugin(path, nil, "describe")
+			if err == nil {
+				err = json.Unmarshal(output, &info)
+			}
+			if err == nil && info.Name == "" {
+				err = fmt.Errorf("describe returned no name")
+			}
+			info.Path, info.Err = path, err
+			pluginsLoaded = append(pluginsLoaded, info)
+		}
+		sort.Slice(pluginsLoaded, func(i, j int) bool { return pluginsLoaded[i].Name < pluginsLoaded[j].Name })
+	})
+	return pluginsLoaded
+}
+
+// runPlugin runs a plugin with input on stdin and returns its stdout
+func runPlugin(path string, input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	timer := time.AfterFunc(pluginTimeout, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%s %s: %v: %s", filepath.Base(path), args[0], err, message)
+		}
+		return nil, fmt.Errorf("%s %s: %v", filepath.Base(path), args[0], err)
+	}
+	return output, nil
+}
+
+// probePlugins asks the plugins with a probe to identify a filesystem the
+// built in detection did not recognise
+func probePlugins(r io.ReaderAt, offset, size int64) (string, string) {
+	var request []byte
+	for _, plugin := range plugins() {
+		if plugin.Err != nil || !plugin.Probe {
+			continue
+		}
+		if request == nil {
+			data := make([]byte, min(size, pluginProbeSize))
+			n, _ := r.ReadAt(data, offset)
+			request, _ = json.Marshal(pluginProbeRequest{Offset: offset, Size: size, Data: base64.StdEncoding.EncodeToString(data[:n])})
+		}
+
+		output, err := runPlugin(plugin.Path, request, "probe")
+		if err != nil {
+			continue
+		}
+		var response pluginProbeResponse
+		if json.Unmarshal(output, &response) == nil && response.Type != "" {
+			return response.Type, response.Label
+		}
+	}
+	return "", ""
+}
+
+// pluginForFormat returns the plugin that provides a --format, nil if none does
+func pluginForFormat(format string) *pluginInfo {
+	for i, plugin := range plugins() {
+		if plugin.Err == nil && containsString(plugin.Formats, format) {
+			return &plugins()[i]
+		}
+	}
+	return nil
+}
+
+// writePluginRecords formats records with a plugin
+func writePluginRecords(w io.Writer, plugin *pluginInfo, format string, headers []string, rows [][]string) error {
+	request, err := json.Marshal(pluginFormatRequest{Headers: headers, Rows: rows})
+	if err != nil {
+		return err
+	}
+	output, err := runPlugin(plugin.Path, request, "format", format)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
+
+// pluginOutput streams to a plugin that stores the data at a URL
+type pluginOutput struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	once  sync.Once
+	err   error
+}
+
+func (o *pluginOutput) Write(p []byte) (int, error) {
+	return o.stdin.Write(p)
+}
+
+// Close ends the stream and waits for the plugin to finish storing it
+func (o *pluginOutput) Close() error {
+	o.once.Do(func() {
+		o.stdin.Close()
+		if err := o.cmd.Wait(); err != nil {
+			o.err = fmt.Errorf("%s output: %v", filepath.Base(o.cmd.Path), err)
+		}
+	})
+	return o.err
+}
+
+// createPluginOutput streams an image to the plugin that handles the URL scheme
+func createPluginOutput(scheme, path string) (io.WriteCloser, error) {
+	for _, plugin := range plugins() {
+		if plugin.Err != nil || !containsString(plugin.Outputs, scheme) {
+			continue
+		}
+		cmd := exec.Command(plugin.Path, "output", path)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &pluginOutput{cmd: cmd, stdin: stdin}, nil
+	}
+	return nil, fmt.Errorf("no plugin handles %s:// outputs", scheme)
+}
+
+// listPlugins prints the installed plugins and what they provide
+func listPlugins() error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	list := plugins()
+	if len(list) == 0 {
+		fmt.Printf("No plugins installed in %s\n", filepath.Join(dir, pluginDir))
+		return nil
+	}
+
+	for _, plugin := range list {
+		if plugin.Err != nil {
+			fmt.Printf("%s%s: %v%s\n", red, filepath.Base(plugin.Path), plugin.Err, reset)
+			continue
+		}
+		var provides []string
+		if plugin.Probe {
+			provides = append(provides, "filesystem probe")
+		}
+		for _, scheme := range plugin.Outputs {
+			provides = append(provides, scheme+":// output")
+		}
+		for _, format := range plugin.Formats {
+			provides = append(provides, format+" format")
+		}
+		fmt.Printf("%s%s%s %s (%s)\n  %s\n", green, plugin.Name, reset, plugin.Version, plugin.Path, strings.Join(provides, ", "))
+	}
+	return nil
+}
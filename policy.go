@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const policyFile = "policy.json"
+
+// policyRule matches devices by path, serial number or tag. Empty fields match
+// anything, so a rule with only a device pattern applies to every serial.
+type policyRule struct {
+	Device string `json:"device,omitempty"` // glob, e.g. /dev/nvme*
+	Serial string `json:"serial,omitempty"` // glob
+	Tag    string `json:"tag,omitempty"`    // exact tag from the tag store
+	Reason string `json:"reason,omitempty"`
+}
+
+// writePolicy lists the devices that may or may not be written to. Deny rules
+// always win, and once an allow list exists only the devices on it are writable.
+type writePolicy struct {
+	Path  string       `json:"-"`
+	Allow []policyRule `json:"allow,omitempty"`
+	Deny  []policyRule `json:"deny,omitempty"`
+}
+
+// policyViolation is returned when a policy forbids a write
+type policyViolation struct {
+	Device    string
+	Operation string
+	Policy    string
+	Rule      *policyRule
+}
+
+func (e *policyViolation) Error() string {
+	if e.Rule == nil {
+		return fmt.Sprintf("policy violation: %s on %s is not allowed, the device is not on the allow list of %s", e.Operation, e.Device, e.Policy)
+	}
+	msg := fmt.Sprintf("policy violation: %s on %s is denied by %s (%s)", e.Operation, e.Device, e.Policy, e.Rule)
+	if e.Rule.Reason != "" {
+		msg += ": " + e.Rule.Reason
+	}
+	return msg
+}
+
+func (r *policyRule) String() string {
+	var parts []string
+	if r.Device != "" {
+		parts = append(parts, "device="+r.Device)
+	}
+	if r.Serial != "" {
+		parts = append(parts, "serial="+r.Serial)
+	}
+	if r.Tag != "" {
+		parts = append(parts, "tag="+r.Tag)
+	}
+	return strings.Join(parts, " ")
+}
+
+// policyDevice is what rules are matched against
+type policyDevice struct {
+	Paths  []string
+	Serial string
+	Tags   []string
+}
+
+func (r *policyRule) matches(d *policyDevice) bool {
+	if r.Device == "" && r.Serial == "" && r.Tag == "" {
+		return false
+	}
+	if r.Device != "" {
+		found := false
+		for _, p := range d.Paths {
+			if ok, _ := path.Match(r.Device, p); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Serial != "" {
+		if ok, _ := path.Match(r.Serial, d.Serial); !ok || d.Serial == "" {
+			return false
+		}
+	}
+	if r.Tag != "" && !containsString(d.Tags, r.Tag) {
+		return false
+	}
+	return true
+}
+
+// loadPolicies reads the system wide policy and the user policy. Each one is
+// enforced on its own, so a user policy can only add restrictions.
+func loadPolicies() ([]*writePolicy, error) {
+	var candidates []string
+	if dir := systemConfigDir(); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, policyFile))
+	}
+	if dir, err := configDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, policyFile))
+	}
+
+	var policies []*writePolicy
+	for _, candidate := range candidates {
+		data, err := os.ReadFile(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		policy := &writePolicy{Path: candidate}
+		if err := json.Unmarshal(data, policy); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", candidate, err)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// check returns a policyViolation if the policy forbids writing to the device
+func (p *writePolicy) check(d *policyDevice, device, operation string) error {
+	for i := range p.Deny {
+		if p.Deny[i].matches(d) {
+			return &policyViolation{Device: device, Operation: operation, Policy: p.Path, Rule: &p.Deny[i]}
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for i := range p.Allow {
+		if p.Allow[i].matches(d) {
+			return nil
+		}
+	}
+	return &policyViolation{Device: device, Operation: operation, Policy: p.Path}
+}
+
+// checkWritePolicy must be called before anything writes to a device or image
+func checkWritePolicy(device, operation string) error {
+	policies, err := loadPolicies()
+	if err != nil {
+		// An unreadable policy must not be treated as no policy
+		return fmt.Errorf("reading write policy: %v", err)
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+
+	d := &policyDevice{Paths: []string{device}, Serial: diskSerial(device)}
+	if abs, err := filepath.Abs(device); err == nil && abs != device {
+		d.Paths = append(d.Paths, abs)
+	}
+	if resolved, err := filepath.EvalSymlinks(device); err == nil && !containsString(d.Paths, resolved) {
+		d.Paths = append(d.Paths, resolved)
+	}
+	if tags, err := loadTags(); err == nil {
+		if _, tag := tags.lookup(device); tag != nil {
+			d.Tags = tag.Tags
+		}
+	}
+
+	for _, policy := range policies {
+		if err := policy.check(d, device, operation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func showPolicy(device string) error {
+	policies, err := loadPolicies()
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		fmt.Println("No write policy configured")
+	}
+	for _, policy := range policies {
+		fmt.Printf("%s:\n", policy.Path)
+		for i := range policy.Allow {
+			fmt.Printf("  allow %s\n", &policy.Allow[i])
+		}
+		for i := range policy.Deny {
+			fmt.Printf("  deny  %s\n", &policy.Deny[i])
+		}
+	}
+
+	if device == "" {
+		return nil
+	}
+	if err := checkWritePolicy(device, "write"); err != nil {
+		return err
+	}
+	fmt.Printf("Writing to %s is allowed\n", device)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Listing disks probes every device, which adds up on a shelf with dozens of
+// bays. The devices are probed by a pool of workers, and a device that does
+// not answer in time is reported instead of stalling the whole listing.
+
+const probeWorkers = 8
+
+// probeParallel runs probe for every device with a few at a time and returns
+// the results in the order of devices. A probe that takes longer than twice
+// the I/O timeout, enough for its reads to time out, is left behind with an
+// unresponsiveError in its place.
+func probeParallel[T any](devices []string, probe func(device string) T) ([]T, []error) {
+	results := make([]T, len(devices))
+	errs := make([]error, len(devices))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(probeWorkers, len(devices)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				done := make(chan T, 1)
+				go func(device string) { done <- probe(device) }(devices[i])
+				select {
+				case results[i] = <-done:
+				case <-time.After(2 * ioTimeout):
+					errs[i] = &unresponsiveError{devices[i], 2 * ioTimeout}
+				}
+			}
+		}()
+	}
+	for i := range devices {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results, errs
+}
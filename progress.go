@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gosuri/uilive"
+)
+
+// With --progress json long operations write their progress as one JSON
+// object a line, to stderr or the file or named pipe of --progress-to,
+// instead of drawing it on the terminal, for wrappers and GUIs to follow.
+
+// progressEventInterval is how often progress events are written
+const progressEventInterval = time.Second
+
+// progressEvent is one line of --progress json output
+type progressEvent struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"` // progress, error, warning, paused, resumed or finished
+	Phase        string    `json:"phase,omitempty"`
+	BytesDone    int64     `json:"bytes_done"`
+	BytesTotal   int64     `json:"bytes_total"`
+	BytesWritten int64     `json:"bytes_written,omitempty"`
+	Percent      float64   `json:"percent"`
+	BytesPerSec  float64   `json:"bytes_per_second"`
+	ETASeconds   float64   `json:"eta_seconds"`
+	Message      string    `json:"message,omitempty"`
+	Code         string    `json:"code,omitempty"`
+	ExitStatus   *int      `json:"exit_status,omitempty"`
+}
+
+// progressStream is the progress sink of --progress json
+type progressStream struct {
+	mu         sync.Mutex
+	out        io.Writer
+	file       *os.File
+	last       progressEvent
+	phaseStart time.Time
+	// writtenPhase is the phase BytesWritten was recorded for
+	writtenPhase string
+	lastWrite    time.Time
+	finished     bool
+}
+
+var progressEvents *progressStream
+
+// setupProgress picks how progress is shown: text on the terminal, or json
+// lines to stderr or to path
+func setupProgress(format, path string) error {
+	switch format {
+	case "", "text":
+		if path != "" {
+			return fmt.Errorf("--progress-to needs --progress json")
+		}
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("unknown progress format %q, use text or json", format)
+	}
+
+	s := &progressStream{out: os.Stderr, phaseStart: time.Now()}
+	if path != "" {
+		// Named pipes block here until the reader opens them
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		s.out, s.file = file, file
+	}
+	progressEvents = s
+	addProgressSink(s)
+	// The live terminal display gives way to the events
+	uilive.Out = io.Discard
+	return nil
+}
+
+// emit works out the rate of the phase and writes an event. The caller
+// holds mu.
+func (s *progressStream) emit(event string) {
+	e := s.last
+	e.Time, e.Event = time.Now(), event
+	e.Percent, e.BytesPerSec, e.ETASeconds = 0, 0, 0
+	if s.writtenPhase != e.Phase {
+		e.BytesWritten = 0
+	}
+	if e.BytesTotal > 0 {
+		e.Percent = float64(e.BytesDone) * 100 / float64(e.BytesTotal)
+	}
+	// Right after a phase starts the rate says nothing yet
+	if elapsed := time.Since(s.phaseStart).Seconds(); elapsed >= 0.1 && e.BytesDone > 0 {
+		e.BytesPerSec = float64(e.BytesDone) / elapsed
+		if e.BytesTotal > e.BytesDone {
+			e.ETASeconds = float64(e.BytesTotal-e.BytesDone) / e.BytesPerSec
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.lastWrite = e.Time
+	// A reader that went away does not stop the operation
+	s.out.Write(append(data, '\n'))
+}
+
+// progress records how far the phase is, writing an event every second
+// and whenever the phase changes
+func (s *progressStream) progress(phase string, done, total int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := phase != s.last.Phase
+	if changed {
+		s.last.Phase, s.phaseStart = phase, time.Now()
+	}
+	s.last.BytesDone, s.last.BytesTotal = done, total
+	if !changed && done < total && time.Since(s.lastWrite) < progressEventInterval {
+		return
+	}
+	s.emit("progress")
+}
+
+// written records how much output the phase has written
+func (s *progressStream) written(phase string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last.BytesWritten, s.writtenPhase = n, phase
+}
+
+// message writes an event with a message, like an error
+func (s *progressStream) message(event, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last.Message = message
+	s.emit(event)
+	s.last.Message = ""
+}
+
+// warning writes a warning event with the code of the warning
+func (s *progressStream) warning(w warning) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last.Message, s.last.Code = w.Message, w.Code
+	s.emit("warning")
+	s.last.Message, s.last.Code = "", ""
+}
+
+// finish writes the last event with the exit status, only the first call counts
+func (s *progressStream) finish(status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.last.ExitStatus = &status
+	if err != nil {
+		s.last.Message = err.Error()
+	}
+	s.emit("finished")
+	if s.file != nil {
+		s.file.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import "sync"
+
+// Long operations report how far they are with reportProgress and the other
+// report functions, which hand it to every registered progress sink: the
+// live display on the terminal, the --progress json lines, the --state-file,
+// the --metrics endpoint and the TUI status bar. The operations do not know
+// who is watching.
+
+// progressSink receives the progress of the operations of a command
+type progressSink interface {
+	// progress is called for every chunk with how far the phase is
+	progress(phase string, done, total int64)
+	// written is called before progress when the phase writes another
+	// amount than it reads, like the compressed size of an image
+	written(phase string, n int64)
+	// message is called for the error, paused and resumed events
+	message(event, message string)
+	warning(w warning)
+	// finish is called once when the command ends, with its exit status
+	// and why it failed
+	finish(status int, err error)
+}
+
+var (
+	progressSinksMu sync.Mutex
+	progressSinks   []progressSink
+)
+
+// addProgressSink registers a sink and returns the function that removes it
+func addProgressSink(s progressSink) func() {
+	progressSinksMu.Lock()
+	defer progressSinksMu.Unlock()
+	progressSinks = append(progressSinks, s)
+	return func() {
+		progressSinksMu.Lock()
+		defer progressSinksMu.Unlock()
+		for i, sink := range progressSinks {
+			if sink == s {
+				progressSinks = append(progressSinks[:i:i], progressSinks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// currentProgressSinks returns the registered sinks, so they are called
+// without holding the lock
+func currentProgressSinks() []progressSink {
+	progressSinksMu.Lock()
+	defer progressSinksMu.Unlock()
+	return append([]progressSink(nil), progressSinks...)
+}
+
+// reportProgress records how far the phase of the operation is. It is
+// cheap to call for every chunk, the sinks decide how often they show it.
+func reportProgress(phase string, done, total int64) {
+	for _, s := range currentProgressSinks() {
+		s.progress(phase, done, total)
+	}
+}
+
+// reportWritten records how much output a phase has written when it differs
+// from what was read, like the compressed size of an image. Call it before
+// the reportProgress it belongs to.
+func reportWritten(phase string, n int64) {
+	for _, s := range currentProgressSinks() {
+		s.written(phase, n)
+	}
+}
+
+// reportProgressError records an error the operation continued after
+func reportProgressError(message string) {
+	recordEvent(sessionEventError, message)
+	for _, s := range currentProgressSinks() {
+		s.message("error", message)
+	}
+}
+
+// reportWarning records a warning of the operation
+func reportWarning(w warning) {
+	recordWarning(w)
+	for _, s := range currentProgressSinks() {
+		s.warning(w)
+	}
+}
+
+// reportPaused records that the operation is paused or running again
+func reportPaused(paused bool) {
+	event := "resumed"
+	if paused {
+		event = "paused"
+	}
+	for _, s := range currentProgressSinks() {
+		s.message(event, "")
+	}
+}
+
+// finishProgress tells the sinks how the command ended, status is the exit
+// status and err why it failed
+func finishProgress(status int, err error) {
+	for _, s := range currentProgressSinks() {
+		s.finish(status, err)
+	}
+}
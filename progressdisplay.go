@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gosuri/uilive"
+)
+
+// progressDisplay is the progress sink that draws the progress of an
+// operation on the terminal with uilive, redrawn every second
+type progressDisplay struct {
+	mu     sync.Mutex
+	live   *uilive.Writer
+	remove func()
+
+	// label names the operation on the line, the phase if empty
+	label string
+	// detail is added to the line, like how many bytes differ
+	detail func() string
+	// extra returns the lines shown below it, like the disk statistics
+	extra func() []string
+
+	phase        string
+	done, total  int64
+	writtenBytes int64
+	writtenPhase string
+	// startDone is where the phase started, resumed operations count
+	// their rate from there
+	startDone  int64
+	phaseStart time.Time
+	pausedAt   time.Time
+	lastDraw   time.Time
+	drawnDone  int64
+	reported   bool
+}
+
+// startProgressDisplay starts drawing the progress reported by an operation
+// to out, or to stdout if out is nil. The label names the operation on the
+// line, the phase does if it is empty.
+func startProgressDisplay(label string, out io.Writer) *progressDisplay {
+	d := &progressDisplay{label: label, live: uilive.New()}
+	// --quiet and --progress json turn the terminal display off
+	if out != nil && uilive.Out != io.Discard {
+		d.live.Out = out
+	}
+	d.live.Start()
+	d.remove = addProgressSink(d)
+	return d
+}
+
+// Bypass returns a writer for messages that go above the display
+func (d *progressDisplay) Bypass() io.Writer {
+	return d.live.Bypass()
+}
+
+// setLabel changes what the line calls the operation, like the pass of a wipe
+func (d *progressDisplay) setLabel(label string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.label = label
+}
+
+// stop draws the final progress and ends the display
+func (d *progressDisplay) stop() {
+	d.remove()
+	d.mu.Lock()
+	if d.reported && d.done != d.drawnDone {
+		d.draw()
+	}
+	d.mu.Unlock()
+	d.live.Stop()
+}
+
+// draw writes the progress line and the extra lines. The caller holds mu.
+func (d *progressDisplay) draw() {
+	d.lastDraw, d.drawnDone = time.Now(), d.done
+	label := d.label
+	if label == "" && d.phase == "" {
+		label = "Progress"
+	} else if label == "" {
+		first, size := utf8.DecodeRuneInString(d.phase)
+		label = string(unicode.ToUpper(first)) + d.phase[size:]
+	}
+	line := fmt.Sprintf("%s: %s", label, formatBytes(d.done))
+	if d.total > 0 {
+		line += fmt.Sprintf(" of %s (%.1f%%)", formatBytes(d.total), float64(d.done)*100/float64(d.total))
+	}
+	// Right after a phase starts the rate says nothing yet
+	if elapsed := time.Since(d.phaseStart).Seconds(); elapsed >= 0.1 && d.done > d.startDone {
+		rate := float64(d.done-d.startDone) / elapsed
+		line += fmt.Sprintf(", %.2f MB/s", rate/mb)
+		if d.total > d.done && rate > 0 {
+			left := time.Duration(float64(d.total-d.done) / rate * float64(time.Second))
+			line += fmt.Sprintf(", %s left", left.Truncate(time.Second))
+		}
+	}
+	if d.writtenPhase == d.phase && d.writtenBytes > 0 {
+		line += fmt.Sprintf(", %s written", formatBytes(d.writtenBytes))
+	}
+	if d.detail != nil {
+		if detail := d.detail(); detail != "" {
+			line += ", " + detail
+		}
+	}
+	fmt.Fprintln(d.live, line)
+	if d.extra != nil {
+		for _, extra := range d.extra() {
+			if extra != "" {
+				fmt.Fprintln(d.live, extra)
+			}
+		}
+	}
+	d.live.Flush()
+}
+
+// progress draws the progress every second, at the end of a phase and
+// when a new one starts
+func (d *progressDisplay) progress(phase string, done, total int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := !d.reported || phase != d.phase
+	if changed {
+		d.phase, d.startDone, d.phaseStart = phase, done, time.Now()
+	}
+	d.done, d.total, d.reported = done, total, true
+	if changed || done == total || time.Since(d.lastDraw) >= time.Second {
+		d.draw()
+	}
+}
+
+// written records the output of the phase to show next to its progress
+func (d *progressDisplay) written(phase string, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writtenPhase, d.writtenBytes = phase, n
+}
+
+// message leaves the time paused out of the rate, pausePoint tells the
+// user itself
+func (d *progressDisplay) message(event, message string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch event {
+	case "paused":
+		d.pausedAt = time.Now()
+	case "resumed":
+		if !d.pausedAt.IsZero() {
+			d.phaseStart = d.phaseStart.Add(time.Since(d.pausedAt))
+			d.pausedAt = time.Time{}
+		}
+	}
+}
+
+// warning is printed by warnf already
+func (d *progressDisplay) warning(w warning) {}
+
+// finish is not needed, the operation stops the display
+func (d *progressDisplay) finish(status int, err error) {}
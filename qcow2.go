@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// A qcow2 image is written in one pass: the header and the L1 table are
+// reserved at the start, the clusters with data follow in disk order with
+// each L2 table after the clusters it maps, and the refcounts come last.
+// Clusters that are all zeros, or outside the ranges of a smart image, are
+// left unallocated and read as zeros.
+
+const (
+	qcow2ClusterBits = 16
+	qcow2ClusterSize = 1 << qcow2ClusterBits
+	qcow2L2Entries   = qcow2ClusterSize / 8
+	qcow2Refcounts   = qcow2ClusterSize / 2 // 16 bit refcounts per block
+	qcow2Copied      = uint64(1) << 63      // the cluster is referenced once
+	qcow2HeaderSize  = 104
+)
+
+// qcow2Writer places the clusters of an image in the file
+type qcow2Writer struct {
+	file    *os.File
+	size    int64
+	l1      []uint64
+	l2      []uint64
+	l2Index int
+	next    int64 // where the next cluster goes
+	stored  int64
+}
+
+func newQcow2Writer(file *os.File, size, sectorSize int64) (blockImageWriter, error) {
+	l1Size := (size + qcow2ClusterSize*qcow2L2Entries - 1) / (qcow2ClusterSize * qcow2L2Entries)
+	l1Clusters := (l1Size*8 + qcow2ClusterSize - 1) / qcow2ClusterSize
+	return &qcow2Writer{
+		file:    file,
+		size:    size,
+		l1:      make([]uint64, l1Size),
+		l2:      make([]uint64, qcow2L2Entries),
+		l2Index: -1,
+		next:    (1 + l1Clusters) * qcow2ClusterSize,
+	}, nil
+}
+
+// writeBlock stores the cluster at index, clusters come in ascending order
+func (q *qcow2Writer) writeBlock(index int64, data []byte) error {
+	if l2Index := int(index / qcow2L2Entries); l2Index != q.l2Index {
+		if err := q.flushL2(); err != nil {
+			return err
+		}
+		q.l2Index = l2Index
+	}
+	if _, err := q.file.WriteAt(data, q.next); err != nil {
+		return err
+	}
+	q.l2[index%qcow2L2Entries] = uint64(q.next) | qcow2Copied
+	q.next += qcow2ClusterSize
+	q.stored += qcow2ClusterSize
+	return nil
+}
+
+func (q *qcow2Writer) allocated() int64 {
+	return q.stored
+}
+
+// flushL2 writes the L2 table being filled, if it maps any cluster
+func (q *qcow2Writer) flushL2() error {
+	if q.l2Index < 0 {
+		return nil
+	}
+	buf := make([]byte, qcow2ClusterSize)
+	used := false
+	for i, entry := range q.l2 {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+		used = used || entry != 0
+		q.l2[i] = 0
+	}
+	if !used {
+		return nil
+	}
+	if _, err := q.file.WriteAt(buf, q.next); err != nil {
+		return err
+	}
+	q.l1[q.l2Index] = uint64(q.next) | qcow2Copied
+	q.next += qcow2ClusterSize
+	return nil
+}
+
+// finish writes the last L2 table, the refcounts, the L1 table and the header
+func (q *qcow2Writer) finish() error {
+	if err := q.flushL2(); err != nil {
+		return err
+	}
+
+	// The refcount blocks and table count themselves, so grow them until
+	// they cover every cluster including their own
+	used := q.next / qcow2ClusterSize
+	var blocks, tableClusters int64
+	for {
+		total := used + blocks + tableClusters
+		needBlocks := (total + qcow2Refcounts - 1) / qcow2Refcounts
+		needTable := (needBlocks*8 + qcow2ClusterSize - 1) / qcow2ClusterSize
+		if needBlocks == blocks && needTable == tableClusters {
+			break
+		}
+		blocks, tableClusters = needBlocks, needTable
+	}
+	total := used + blocks + tableClusters
+
+	table := make([]byte, tableClusters*qcow2ClusterSize)
+	block := make([]byte, qcow2ClusterSize)
+	for b := int64(0); b < blocks; b++ {
+		clear(block)
+		for i := int64(0); i < qcow2Refcounts && b*qcow2Refcounts+i < total; i++ {
+			binary.BigEndian.PutUint16(block[i*2:], 1)
+		}
+		at := (used + b) * qcow2ClusterSize
+		if _, err := q.file.WriteAt(block, at); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(table[b*8:], uint64(at))
+	}
+	tableOffset := (used + blocks) * qcow2ClusterSize
+	if _, err := q.file.WriteAt(table, tableOffset); err != nil {
+		return err
+	}
+
+	l1 := make([]byte, len(q.l1)*8)
+	for i, entry := range q.l1 {
+		binary.BigEndian.PutUint64(l1[i*8:], entry)
+	}
+	if _, err := q.file.WriteAt(l1, qcow2ClusterSize); err != nil {
+		return err
+	}
+
+	header := make([]byte, qcow2HeaderSize)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3) // version
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(q.size))
+	binary.BigEndian.PutUint32(header[36:], uint32(len(q.l1)))
+	binary.BigEndian.PutUint64(header[40:], qcow2ClusterSize)
+	binary.BigEndian.PutUint64(header[48:], uint64(tableOffset))
+	binary.BigEndian.PutUint32(header[56:], uint32(tableClusters))
+	binary.BigEndian.PutUint32(header[96:], 4) // 16 bit refcounts
+	binary.BigEndian.PutUint32(header[100:], qcow2HeaderSize)
+	if _, err := q.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return q.file.Truncate(total * qcow2ClusterSize)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gosuri/uilive"
+)
+
+// With --quiet the commands that report as they work print only their
+// result to stdout, like the path and hash of what they wrote, so they fit
+// into pipelines. Progress displays are off, errors still go to stderr and
+// the exit status tells how the command ended.
+
+var quiet bool
+
+// resultOutput is stdout, kept for the results while the chatter is silenced
+var resultOutput io.Writer = os.Stdout
+
+// failure is the first problem reported with reportFailure, the command
+// exits with status 1 when it is set
+var failure error
+
+// setupQuiet turns the progress displays off for --quiet
+func setupQuiet(enabled bool) {
+	quiet = enabled
+	if quiet {
+		uilive.Out = io.Discard
+	}
+}
+
+// silenceChatter sends what the command prints to stdout nowhere with
+// --quiet, the commands that report as they work call it first
+func silenceChatter() {
+	if !quiet || os.Stdout != resultOutput {
+		return
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	os.Stdout = devNull
+}
+
+// printResult prints the result of a command with --quiet, without it the
+// command has already told it in its own words
+func printResult(format string, args ...any) {
+	if quiet {
+		fmt.Fprintf(resultOutput, format+"\n", args...)
+	}
+}
+
+// messageOutput is where messages the user has to see go, w normally and
+// stderr with --quiet
+func messageOutput(w io.Writer) io.Writer {
+	if quiet {
+		return os.Stderr
+	}
+	return w
+}
+
+// reportFailure prints why a command that does not return an error failed,
+// to stdout or with --quiet to stderr, and makes dsktool exit with status 1
+func reportFailure(a ...any) {
+	message := fmt.Sprintln(a...)
+	fmt.Fprint(messageOutput(os.Stdout), message)
+	if failure == nil {
+		failure = errors.New(message[:len(message)-1])
+	}
+}
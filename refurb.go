@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// refurbOptions are the settings of a refurbishment run
+type refurbOptions struct {
+	Operator  string
+	Report    string
+	SkipWipe  bool
+	SkipScan  bool
+	AssumeYes bool
+}
+
+// scanResult is the outcome of reading a whole device
+type scanResult struct {
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration_ns"`
+	BadSectors  int64         `json:"bad_sectors"`
+	BadLBAs     []int64       `json:"bad_lbas,omitempty"`
+	SlowChunks  int64         `json:"slow_chunks"`
+	MinMBps     float64       `json:"min_mbps"`
+	MaxMBps     float64       `json:"max_mbps"`
+	VerifyZero  bool          `json:"verify_zero"`
+	NonZeroLBAs int64         `json:"non_zero_sectors"`
+}
+
+// refurbReport is the condition report of a refurbished disk, signed with
+// the signing key
+type refurbReport struct {
+	Tool        string        `json:"tool"`
+	Device      string        `json:"device"`
+	Model       string        `json:"model,omitempty"`
+	Serial      string        `json:"serial,omitempty"`
+	Size        int64         `json:"size"`
+	Operator    string        `json:"operator"`
+	Started     time.Time     `json:"started"`
+	Finished    time.Time     `json:"finished"`
+	SMARTBefore smartSnapshot `json:"smart_before"`
+	SMARTAfter  smartSnapshot `json:"smart_after"`
+	Wipe        *wipeResult   `json:"wipe,omitempty"`
+	Scan        *scanResult   `json:"scan,omitempty"`
+	Result      string        `json:"result"`
+	Problems    []string      `json:"problems,omitempty"`
+	documentSignature
+}
+
+const (
+	refurbMaxBadLBAs = 100             // bad LBAs listed in the report
+	refurbSlowChunk  = 2 * time.Second // a 1 MiB read slower than this hints at a weak area
+)
+
+// scanDevice reads the whole device. Chunks that fail are re-read sector by
+// sector to find the bad LBAs. With verifyZero every sector must read back as
+// zeros, which proves a wipe reached the whole disk.
+func scanDevice(device string, verifyZero bool) (*scanResult, error) {
+	image, err := openImage(device, false)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	sector := int64(image.SectorSize)
+	result := &scanResult{VerifyZero: verifyZero}
+
+	listenForPause()
+	display := startProgressDisplay("Scanning "+device, nil)
+	defer display.stop()
+	stats := newDiskStatsSampler(device)
+	display.detail = func() string { return fmt.Sprintf("%d bad sectors", result.BadSectors) }
+	display.extra = func() []string { return []string{stats.progressLine()} }
+
+	buf := make([]byte, mb)
+	start := time.Now()
+	for result.Bytes < image.Size {
+		start = start.Add(pausePoint(display.Bypass(), nil))
+		n := min(int64(len(buf)), image.Size-result.Bytes)
+		chunkStart := time.Now()
+		_, err := image.ReadAt(buf[:n], result.Bytes)
+		elapsed := time.Since(chunkStart)
+
+		if err != nil {
+			for off := int64(0); off < n; off += sector {
+				s := buf[off:min(off+sector, n)]
+				if _, err := image.ReadAt(s, result.Bytes+off); err != nil {
+					result.BadSectors++
+					if len(result.BadLBAs) < refurbMaxBadLBAs {
+						result.BadLBAs = append(result.BadLBAs, (result.Bytes+off)/sector)
+					}
+					fmt.Fprintf(display.Bypass(), "%sRead error at LBA %d: %v%s\n", red, (result.Bytes+off)/sector, err, reset)
+					reportProgressError(fmt.Sprintf("read error at LBA %d: %v", (result.Bytes+off)/sector, err))
+					clear(s)
+				}
+			}
+		} else {
+			if elapsed > refurbSlowChunk {
+				result.SlowChunks++
+			}
+			mbps := float64(n) / mb / max(elapsed.Seconds(), 1e-9)
+			if result.MinMBps == 0 || mbps < result.MinMBps {
+				result.MinMBps = mbps
+			}
+			result.MaxMBps = max(result.MaxMBps, mbps)
+		}
+
+		if verifyZero {
+			for off := int64(0); off < n; off += sector {
+				if !isZero(buf[off:min(off+sector, n)]) {
+					result.NonZeroLBAs++
+				}
+			}
+		}
+		result.Bytes += n
+		reportProgress("scanning", result.Bytes, image.Size)
+	}
+
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// refurbDisk runs the refurbishment workflow on a device: SMART capture, a
+// zero wipe, a read scan that verifies the wipe, a second SMART capture and
+// a JSON and PDF condition report
+func refurbDisk(device string, options refurbOptions) error {
+	if options.Operator == "" {
+		return fmt.Errorf("an --operator is needed to sign off the report")
+	}
+
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	size := image.Size
+	image.Close()
+
+	report := refurbReport{
+		Tool:     "dsktool " + appversion,
+		Device:   device,
+		Serial:   diskSerial(device),
+		Size:     size,
+		Operator: options.Operator,
+		Started:  time.Now(),
+	}
+
+	fmt.Printf("%sCapturing SMART data%s\n", yellow, reset)
+	report.SMARTBefore = readSMART(device)
+	if report.SMARTBefore.Available {
+		report.Model = report.SMARTBefore.Model
+		if report.Serial == "" {
+			report.Serial = report.SMARTBefore.Serial
+		}
+	} else {
+		fmt.Printf("SMART data unavailable: %s\n", report.SMARTBefore.Error)
+	}
+
+	if !options.SkipWipe {
+		if !dryRun && !options.AssumeYes && !confirm(fmt.Sprintf("Erase all %s on %s (serial %s)?", formatBytes(size), device, report.Serial)) {
+			return fmt.Errorf("aborted")
+		}
+		fmt.Printf("%sWiping%s\n", yellow, reset)
+		report.Wipe, err = wipeDevice(device, "refurb", wipeOptions{Pattern: "zero", AssumeYes: true})
+		if err != nil {
+			return fmt.Errorf("wiping %s: %v", device, err)
+		}
+	}
+
+	if !options.SkipScan {
+		fmt.Printf("%sScanning%s\n", yellow, reset)
+		report.Scan, err = scanDevice(device, report.Wipe != nil && !report.Wipe.DryRun)
+		if err != nil {
+			return fmt.Errorf("scanning %s: %v", device, err)
+		}
+	}
+
+	fmt.Printf("%sCapturing SMART data%s\n", yellow, reset)
+	report.SMARTAfter = readSMART(device)
+	report.Finished = time.Now()
+	report.judge()
+
+	base := options.Report
+	if base == "" {
+		name := report.Serial
+		if name == "" {
+			name = filepath.Base(device)
+		}
+		base = fmt.Sprintf("refurb-%s-%s", name, report.Started.Format("20060102-150405"))
+	}
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".json"), ".pdf")
+
+	if err := signDocument(report, &report.documentSignature); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".json", append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".pdf", textPDF(report.lines()), 0o644); err != nil {
+		return err
+	}
+
+	color := green
+	if report.Result != "pass" {
+		color = red
+	}
+	fmt.Printf("%sResult: %s%s\n", color, strings.ToUpper(report.Result), reset)
+	for _, problem := range report.Problems {
+		fmt.Printf("  %s\n", problem)
+	}
+	fmt.Printf("Report written to %s.json and %s.pdf\n", base, base)
+	return nil
+}
+
+// judge decides whether the disk passes and records why it does not
+func (r *refurbReport) judge() {
+	before, after := r.SMARTBefore, r.SMARTAfter
+	if after.Passed != nil && !*after.Passed {
+		r.Problems = append(r.Problems, "SMART overall health check failed")
+	}
+	if after.Available && before.Available {
+		if grown := after.ReallocatedSectors - before.ReallocatedSectors; grown > 0 {
+			r.Problems = append(r.Problems, fmt.Sprintf("%d sectors were reallocated during the run", grown))
+		}
+	}
+	if after.PendingSectors > 0 {
+		r.Problems = append(r.Problems, fmt.Sprintf("%d sectors are pending reallocation", after.PendingSectors))
+	}
+	if after.Uncorrectable > 0 {
+		r.Problems = append(r.Problems, fmt.Sprintf("%d sectors are uncorrectable", after.Uncorrectable))
+	}
+	if after.MediaErrors > before.MediaErrors {
+		r.Problems = append(r.Problems, fmt.Sprintf("%d new NVMe media errors", after.MediaErrors-before.MediaErrors))
+	}
+	if r.Scan != nil {
+		if r.Scan.BadSectors > 0 {
+			r.Problems = append(r.Problems, fmt.Sprintf("%d sectors could not be read", r.Scan.BadSectors))
+		}
+		if r.Scan.NonZeroLBAs > 0 {
+			r.Problems = append(r.Problems, fmt.Sprintf("%d sectors were not erased", r.Scan.NonZeroLBAs))
+		}
+	}
+
+	switch {
+	case len(r.Problems) > 0:
+		r.Result = "fail"
+	case r.Wipe != nil && r.Wipe.DryRun:
+		r.Result = "dry-run"
+	default:
+		r.Result = "pass"
+	}
+}
+
+// lines renders the report as text for the PDF
+func (r *refurbReport) lines() []string {
+	unavailable := func(available bool, text string) string {
+		if !available {
+			return "unavailable"
+		}
+		return text
+	}
+	smart := func(s smartSnapshot) string {
+		health := "unknown"
+		if s.Passed != nil {
+			health = map[bool]string{true: "PASSED", false: "FAILED"}[*s.Passed]
+		}
+		return unavailable(s.Available, fmt.Sprintf("%s, %d h powered on, %d C, %d reallocated, %d pending",
+			health, s.PowerOnHours, s.Temperature, s.ReallocatedSectors, s.PendingSectors))
+	}
+
+	lines := []string{
+		"Disk Condition Report",
+		"",
+		fmt.Sprintf("Device:        %s", r.Device),
+		fmt.Sprintf("Model:         %s", r.Model),
+		fmt.Sprintf("Serial:        %s", r.Serial),
+		fmt.Sprintf("Capacity:      %s (%d bytes)", formatBytes(r.Size), r.Size),
+		fmt.Sprintf("Started:       %s", r.Started.Format(time.RFC1123)),
+		fmt.Sprintf("Finished:      %s", r.Finished.Format(time.RFC1123)),
+		"",
+		fmt.Sprintf("SMART before:  %s", smart(r.SMARTBefore)),
+		fmt.Sprintf("SMART after:   %s", smart(r.SMARTAfter)),
+	}
+	if r.Wipe != nil {
+		lines = append(lines, fmt.Sprintf("Wipe:          %s pass over %s in %s", r.Wipe.Pattern, formatBytes(r.Wipe.Bytes), r.Wipe.Duration.Round(time.Second)))
+	} else {
+		lines = append(lines, "Wipe:          skipped")
+	}
+	if r.Scan != nil {
+		verified := "not verified"
+		if r.Scan.VerifyZero {
+			verified = fmt.Sprintf("%d sectors not erased", r.Scan.NonZeroLBAs)
+		}
+		lines = append(lines, fmt.Sprintf("Read scan:     %s in %s, %d bad sectors, %s", formatBytes(r.Scan.Bytes),
+			r.Scan.Duration.Round(time.Second), r.Scan.BadSectors, verified))
+	} else {
+		lines = append(lines, "Read scan:     skipped")
+	}
+
+	lines = append(lines, "", fmt.Sprintf("RESULT:        %s", strings.ToUpper(r.Result)))
+	for _, problem := range r.Problems {
+		lines = append(lines, "  - "+problem)
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("Signed off by: %s", r.Operator),
+		fmt.Sprintf("Tool:          %s", r.Tool),
+		"",
+	)
+	return append(lines, r.documentSignature.lines()...)
+}
+
+// textPDF lays out lines of monospaced text as a PDF document
+func textPDF(lines []string) []byte {
+	const (
+		perPage    = 60
+		fontSize   = 10
+		lineHeight = 12
+	)
+
+	var pages [][]string
+	for len(lines) > perPage {
+		pages = append(pages, lines[:perPage])
+		lines = lines[perPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects: 1 catalog, 2 page tree, 3 font, then a page and its content per page
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	)
+	for i, page := range pages {
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL 50 790 Td\n", fontSize, lineHeight)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET\n")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape makes text safe inside a PDF string, replacing what the
+// standard font encoding cannot show
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Images can be streamed to another host as they are made, so imaging needs
+// no local space. ssh:// runs the ssh client and writes the image into a
+// remote file, tcp:// sends it to a dsktool image-recv on the other host.
+
+// sshOutput writes an image into a file on another host through ssh
+type sshOutput struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+// parseSSHURL splits ssh://user@host[:port]/path, the path is relative to the
+// home directory if it starts with /~/, and ssh://user@host:/path as scp
+// writes it is accepted too
+func parseSSHURL(url string) (host, port, path string, err error) {
+	rest := strings.TrimPrefix(url, "ssh://")
+	slash := strings.IndexByte(rest, '/')
+	if slash < 0 || slash == len(rest)-1 {
+		return "", "", "", fmt.Errorf("ssh:// outputs need a path, like ssh://user@host:/srv/images/disk")
+	}
+	host, path = strings.TrimSuffix(rest[:slash], ":"), rest[slash:]
+	if strings.HasPrefix(path, "/~/") {
+		path = path[1:]
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("%s has no host", url)
+	}
+	return host, port, path, nil
+}
+
+// shellQuote quotes a path for the remote shell, keeping ~/ so it expands
+func shellQuote(path string) string {
+	prefix := ""
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		prefix, path = "~/", rest
+	}
+	return prefix + "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+}
+
+func newSSHOutput(url string, options outputOptions) (io.WriteCloser, error) {
+	host, port, path, err := parseSSHURL(url)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, host, "cat > "+shellQuote(path))
+
+	o := &sshOutput{cmd: exec.Command("ssh", args...)}
+	o.cmd.Stderr = &o.stderr
+	if o.stdin, err = o.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := o.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("running ssh: %v", err)
+	}
+	return o, nil
+}
+
+func (o *sshOutput) Write(p []byte) (int, error) {
+	n, err := o.stdin.Write(p)
+	if err != nil {
+		return n, o.failure(err)
+	}
+	return n, nil
+}
+
+// Close ends the stream and waits for the remote file to be written
+func (o *sshOutput) Close() error {
+	o.stdin.Close()
+	if err := o.cmd.Wait(); err != nil {
+		return o.failure(err)
+	}
+	return nil
+}
+
+// failure explains an ssh error with what ssh printed
+func (o *sshOutput) failure(err error) error {
+	if msg := strings.TrimSpace(o.stderr.String()); msg != "" {
+		return fmt.Errorf("ssh: %s", msg)
+	}
+	return fmt.Errorf("ssh: %v", err)
+}
+
+// A tcp:// transfer starts with a line naming the image, then the data comes
+// in frames of a 4 byte length and the bytes, and an empty frame ends it, so
+// the receiver can tell a finished image from a dropped connection. The
+// receiver answers OK or ERR and the reason once the image is stored.
+const remoteImageMagic = "DSKTOOL-IMAGE 1 "
+
+// tcpOutput sends an image to dsktool image-recv
+type tcpOutput struct {
+	conn *net.TCPConn
+	w    *bufio.Writer
+}
+
+func newTCPOutput(url string, options outputOptions) (io.WriteCloser, error) {
+	addr, name, _ := strings.Cut(strings.TrimPrefix(url, "tcp://"), "/")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("tcp:// outputs need a file name, like tcp://host:9000/disk")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	o := &tcpOutput{conn: conn.(*net.TCPConn), w: bufio.NewWriterSize(conn, mb)}
+	if _, err := fmt.Fprintf(o.w, "%s%s\n", remoteImageMagic, name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *tcpOutput) frame(p []byte) error {
+	if err := binary.Write(o.w, binary.BigEndian, uint32(len(p))); err != nil {
+		return err
+	}
+	_, err := o.w.Write(p)
+	return err
+}
+
+func (o *tcpOutput) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := min(len(p)-written, 4*mb)
+		if err := o.frame(p[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
+
+// Flush sends what is buffered, so a paused transfer is not held back
+func (o *tcpOutput) Flush() error {
+	return o.w.Flush()
+}
+
+// Close ends the transfer and waits for the receiver to store the image
+func (o *tcpOutput) Close() error {
+	defer o.conn.Close()
+	if err := o.frame(nil); err != nil {
+		return err
+	}
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	o.conn.CloseWrite()
+	reply, err := bufio.NewReader(o.conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("the receiver did not confirm the image: %v", err)
+	}
+	if reply = strings.TrimSpace(reply); reply != "OK" {
+		return fmt.Errorf("the receiver failed: %s", strings.TrimPrefix(reply, "ERR "))
+	}
+	return nil
+}
+
+// frameReader reads the frames of a transfer up to the empty one
+type frameReader struct {
+	r      *bufio.Reader
+	remain uint32
+	done   bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for f.remain == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := binary.Read(f.r, binary.BigEndian, &f.remain); err != nil {
+			return 0, fmt.Errorf("the connection ended before the image was complete")
+		}
+		f.done = f.remain == 0
+	}
+	n, err := f.r.Read(p[:min(len(p), int(f.remain))])
+	f.remain -= uint32(n)
+	if err == io.EOF {
+		err = fmt.Errorf("the connection ended before the image was complete")
+	}
+	return n, err
+}
+
+// receiveImages stores the images sent to tcp:// outputs in dir, one
+// connection at a time, until count images arrived or forever if count is 0
+func receiveImages(listen, dir string, count int) error {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("Listening on %s, storing images in %s\n", ln.Addr(), dir)
+
+	for received := 0; count == 0 || received < count; {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if err := receiveImage(conn, dir); err != nil {
+			fmt.Printf("%sFailed to receive from %s: %v%s\n", red, conn.RemoteAddr(), err, reset)
+			reportProgressError(err.Error())
+			continue
+		}
+		received++
+	}
+	return nil
+}
+
+// receiveImage stores one transfer next to its final name and renames it
+// into place once it is complete, then answers the sender
+func receiveImage(conn net.Conn, dir string) (err error) {
+	defer conn.Close()
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(conn, "ERR %v\n", err)
+		}
+	}()
+
+	br := bufio.NewReaderSize(conn, mb)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	name, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), remoteImageMagic)
+	if !ok {
+		return fmt.Errorf("not a dsktool image transfer")
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	path := filepath.Join(dir, name)
+
+	file, err := os.Create(path + ".part")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(path + ".part")
+		}
+	}()
+
+	fmt.Printf("Receiving %s from %s\n", name, conn.RemoteAddr())
+	display := startProgressDisplay("", nil)
+	var (
+		frames  = &frameReader{r: br}
+		buf     = make([]byte, mb)
+		written int64
+	)
+	for {
+		n, readErr := frames.Read(buf)
+		if n > 0 {
+			if _, err := file.Write(buf[:n]); err != nil {
+				display.stop()
+				return err
+			}
+			written += int64(n)
+			reportProgress("receiving", written, 0)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			display.stop()
+			return readErr
+		}
+	}
+	display.stop()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".part", path); err != nil {
+		return err
+	}
+	fmt.Fprintln(conn, "OK")
+	fmt.Printf("Stored %s (%s)\n", path, formatBytes(written))
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Rescue imaging keeps going over a failing disk the way ddrescue does: a
+// read that fails is split in halves down to single sectors, each sector is
+// retried, and the sectors that stay unreadable are filled with a pattern in
+// the image and listed in FILE.rescuemap, a ddrescue mapfile.
+
+// rescueReader reads around the bad sectors of a device
+type rescueReader struct {
+	r          io.ReaderAt
+	sectorSize int64
+	retries    int
+	fill       []byte
+
+	mu  sync.Mutex
+	bad []byteRange
+}
+
+func newRescueReader(r io.ReaderAt, sectorSize uint64, retries int, fill []byte) *rescueReader {
+	return &rescueReader{r: r, sectorSize: int64(max(sectorSize, 512)), retries: retries, fill: fill}
+}
+
+// parseFillPattern reads the --fill pattern, 0x followed by hex bytes or
+// text, zeros if it is empty
+func parseFillPattern(s string) ([]byte, error) {
+	if s == "" {
+		return []byte{0}, nil
+	}
+	if digits, ok := strings.CutPrefix(s, "0x"); ok {
+		pattern, err := hex.DecodeString(digits)
+		if err != nil || len(pattern) == 0 {
+			return nil, fmt.Errorf("invalid fill pattern %q, use 0x and hex bytes or text", s)
+		}
+		return pattern, nil
+	}
+	return []byte(s), nil
+}
+
+// ReadAt implements io.ReaderAt, it only fails at the end of the device
+func (rr *rescueReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := rr.r.ReadAt(p, off)
+	if err == nil || n == len(p) || err == io.EOF {
+		return n, err
+	}
+	rr.rescue(p[n:], off+int64(n))
+	return len(p), nil
+}
+
+// rescue reads a range whose read failed in two halves, splitting the
+// halves that fail again until single sectors are left
+func (rr *rescueReader) rescue(p []byte, off int64) {
+	if int64(len(p)) <= rr.sectorSize {
+		for attempt := 0; attempt < rr.retries; attempt++ {
+			if n, _ := rr.r.ReadAt(p, off); n == len(p) {
+				return
+			}
+		}
+		rr.markBad(p, off)
+		return
+	}
+	half := (int64(len(p))/2 + rr.sectorSize - 1) / rr.sectorSize * rr.sectorSize
+	for _, part := range []struct {
+		p   []byte
+		off int64
+	}{{p[:half], off}, {p[half:], off + half}} {
+		if n, _ := rr.r.ReadAt(part.p, part.off); n < len(part.p) {
+			rr.rescue(part.p[n:], part.off+int64(n))
+		}
+	}
+}
+
+// markBad fills an unreadable sector with the pattern, starting it over at
+// the sector so the pattern is easy to spot, and records it
+func (rr *rescueReader) markBad(p []byte, off int64) {
+	for i := range p {
+		p[i] = rr.fill[i%len(rr.fill)]
+	}
+	rr.mu.Lock()
+	rr.bad = append(rr.bad, byteRange{Start: off, End: off + int64(len(p))})
+	rr.mu.Unlock()
+}
+
+// badRanges returns the unreadable ranges sorted and merged
+func (rr *rescueReader) badRanges() []byteRange {
+	rr.mu.Lock()
+	bad := append([]byteRange(nil), rr.bad...)
+	rr.mu.Unlock()
+	sort.Slice(bad, func(i, j int) bool { return bad[i].Start < bad[j].Start })
+	var merged []byteRange
+	for _, r := range bad {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// progressLine sums up the bad sectors so far, empty while there are none
+func (rr *rescueReader) progressLine() string {
+	bad := rr.badRanges()
+	if len(bad) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%sUnreadable: %s in %s, filled%s", red, formatBytes(rangesLength(bad)), regionCount(bad), reset)
+}
+
+// rescueMapPath returns the path of the rescue map of an image
+func rescueMapPath(image string) string {
+	return image + ".rescuemap"
+}
+
+// writeRescueMap writes a ddrescue mapfile of a device: the ranges that were
+// read are finished (+) except for the bad ones (-), the rest is non-tried (?)
+func writeRescueMap(w io.Writer, size int64, read, bad []byteRange) error {
+	type block struct {
+		byteRange
+		status byte
+	}
+	var blocks []block
+	add := func(start, end int64, status byte) {
+		if start >= end {
+			return
+		}
+		if n := len(blocks); n > 0 && blocks[n-1].status == status && blocks[n-1].End == start {
+			blocks[n-1].End = end
+			return
+		}
+		blocks = append(blocks, block{byteRange{start, end}, status})
+	}
+	var pos int64
+	for _, r := range read {
+		add(pos, r.Start, '?')
+		for _, b := range rangesWithin(bad, r) {
+			add(max(pos, r.Start), b.Start, '+')
+			add(b.Start, b.End, '-')
+			pos = b.End
+		}
+		add(max(pos, r.Start), r.End, '+')
+		pos = r.End
+	}
+	add(pos, size, '?')
+
+	fmt.Fprintf(w, "# Mapfile. Created by dsktool %s\n", appversion)
+	fmt.Fprintf(w, "# current_pos  current_status  current_pass\n0x%08X     +               1\n", size)
+	fmt.Fprintf(w, "#      pos        size  status\n")
+	for _, b := range blocks {
+		if _, err := fmt.Fprintf(w, "0x%08X  0x%08X  %c\n", b.Start, b.End-b.Start, b.status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeImageRescueMap stores the rescue map next to an image and sums up the bad sectors
+func (rr *rescueReader) writeImageRescueMap(image string, options outputOptions, size int64, read []byteRange) error {
+	bad := rr.badRanges()
+	output, err := createOutput(rescueMapPath(image), options)
+	if err != nil {
+		return err
+	}
+	if err := writeRescueMap(output, size, read, bad); err != nil {
+		output.Close()
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	if len(bad) == 0 {
+		fmt.Printf("%sNo unreadable sectors%s, rescue map: %s\n", green, reset, rescueMapPath(image))
+		return nil
+	}
+	warnf(warnUnreadable, "", "%s in %s could not be read and were filled, rescue map: %s",
+		formatBytes(rangesLength(bad)), regionCount(bad), rescueMapPath(image))
+	return nil
+}
+
+func regionCount(ranges []byteRange) string {
+	if len(ranges) == 1 {
+		return "1 region"
+	}
+	return fmt.Sprintf("%d regions", len(ranges))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// An image is resumable when its compressed stream can be cut at a checkpoint
+// and continued by appending a new stream. Every checkpoint ends the current
+// compression stream and records how far the device was read, how much of the
+// image was written and the state of the hash of the imaged data.
+
+// checkpointInterval is how much of the device is read between checkpoints
+const checkpointInterval = 512 * mb
+
+// resumableAlgorithms are the compressions whose readers continue across
+// concatenated streams
+var resumableAlgorithms = map[string]bool{"gzip": true, "bzip2": true, "snappy": true, "s2": true, "zstd": true, "xz": true, "lz4": true}
+
+// imageState is the sidecar of an image that was not finished
+type imageState struct {
+	Device      string      `json:"device"`
+	DeviceSize  int64       `json:"device_size"`
+	Size        int64       `json:"size"` // bytes to read, less than the device for smart images
+	Smart       bool        `json:"smart"`
+	Partition   int         `json:"partition,omitempty"`
+	SkipZeros   bool        `json:"skip_zeros,omitempty"`
+	Kept        []byteRange `json:"kept,omitempty"` // of the stream when skipping zeros, up to Offset
+	Compression string      `json:"compression"`
+	Offset      int64       `json:"offset"`
+	Written     int64       `json:"written"`
+	HashState   []byte      `json:"hash_state"`
+	Updated     time.Time   `json:"updated"`
+}
+
+// imageStatePath returns the path of the sidecar of an image
+func imageStatePath(image string) string {
+	return image + ".state"
+}
+
+// loadImageState reads the sidecar of an image, nil if there is none
+func loadImageState(image string) (*imageState, error) {
+	data, err := os.ReadFile(imageStatePath(image))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state imageState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", imageStatePath(image), err)
+	}
+	return &state, nil
+}
+
+// save writes the sidecar next to its path and renames it into place
+func (s *imageState) save(image string) error {
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := imageStatePath(image)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// check returns an error if the state is not of imaging device the same way
+func (s *imageState) check(device string, deviceSize, size int64, compression string, smart bool, partition int, skipZeros bool) error {
+	if s.Compression != compression {
+		return fmt.Errorf("the image was started with %s compression, not %s", s.Compression, compression)
+	}
+	if s.Smart && !smart {
+		return fmt.Errorf("the image was started with --smart")
+	}
+	if !s.Smart && smart {
+		return fmt.Errorf("the image was started without --smart")
+	}
+	if s.SkipZeros && !skipZeros {
+		return fmt.Errorf("the image was started with --skip-zeros")
+	}
+	if !s.SkipZeros && skipZeros {
+		return fmt.Errorf("the image was started without --skip-zeros")
+	}
+	if s.Partition != partition {
+		return fmt.Errorf("the image was started of partition %d, not %d", s.Partition, partition)
+	}
+	if s.DeviceSize != deviceSize {
+		return fmt.Errorf("the image was started from %s (%s), %s has %s", s.Device, formatBytes(s.DeviceSize), device, formatBytes(deviceSize))
+	}
+	if s.Size != size {
+		return fmt.Errorf("the allocated blocks of %s changed since the image was started", device)
+	}
+	if s.Offset > size {
+		return fmt.Errorf("the checkpoint is past the end of %s", device)
+	}
+	return nil
+}
+
+// openResumedOutput opens an unfinished image and cuts it back to the last
+// checkpoint, dropping the stream written after it
+func openResumedOutput(path string, written int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() < written {
+		err = fmt.Errorf("%s is %d bytes, shorter than the checkpoint at %d", path, info.Size(), written)
+	}
+	if err == nil {
+		err = file.Truncate(written)
+	}
+	if err == nil {
+		_, err = file.Seek(written, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// restoreHash returns a SHA-256 continuing from the state, a new one without
+func (s *imageState) restoreHash() (hash.Hash, error) {
+	h := sha256.New()
+	if len(s.HashState) == 0 {
+		return h, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.HashState); err != nil {
+		return nil, fmt.Errorf("restoring the hash state: %v", err)
+	}
+	return h, nil
+}
+
+// recordHash stores the state of the hash of the imaged data
+func (s *imageState) recordHash(h hash.Hash) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.HashState = state
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// retryPolicy controls how often and how patiently network requests are repeated
+type retryPolicy struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+// networkRetry is used by every network source and target, --retries sets the attempts
+var networkRetry = retryPolicy{Attempts: 5, Initial: time.Second, Max: time.Minute}
+
+// temporaryError is implemented by errors that know whether repeating the
+// request may help, errors without it are assumed to be temporary
+type temporaryError interface {
+	temporary() bool
+}
+
+// permanentError is a failure that repeating the request cannot fix
+type permanentError struct{ error }
+
+func (permanentError) temporary() bool { return false }
+
+// delay is the backoff before the given retry, doubling up to Max
+func (p retryPolicy) delay(retry int) time.Duration {
+	delay := p.Initial
+	for i := 1; i < retry && delay < p.Max; i++ {
+		delay *= 2
+	}
+	return min(delay, p.Max)
+}
+
+// retryable reports whether an error may go away when the request is repeated
+func retryable(err error) bool {
+	var temporary temporaryError
+	return !errors.As(err, &temporary) || temporary.temporary()
+}
+
+// do runs a request until it succeeds, fails permanently or runs out of attempts
+func (p retryPolicy) do(what string, request func() error) error {
+	var err error
+	for attempt := 1; attempt <= max(p.Attempts, 1); attempt++ {
+		if err = request(); err == nil || !retryable(err) {
+			break
+		}
+		if attempt < p.Attempts {
+			fmt.Fprintf(os.Stderr, "%s failed (%v), retrying in %s\n", what, err, p.delay(attempt))
+			time.Sleep(p.delay(attempt))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	return nil
+}
+
+// retryReader is a stream over the network that reconnects at the offset it
+// got to when the connection breaks, so a long transfer survives outages
+type retryReader struct {
+	what   string
+	policy retryPolicy
+	open   func(offset int64) (io.ReadCloser, error)
+	body   io.ReadCloser
+	offset int64
+	err    error // a failure that used up the retries, returned from then on
+}
+
+func newRetryReader(what string, policy retryPolicy, open func(offset int64) (io.ReadCloser, error)) *retryReader {
+	return &retryReader{what: what, policy: policy, open: open}
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for failures := 0; ; {
+		if r.body == nil {
+			err := r.policy.do(fmt.Sprintf("%s at offset %d", r.what, r.offset), func() error {
+				body, err := r.open(r.offset)
+				r.body = body
+				return err
+			})
+			if err != nil {
+				r.err = err
+				return 0, err
+			}
+		}
+
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || n > 0 {
+			if err != nil && err != io.EOF {
+				r.body.Close()
+				r.body = nil
+				err = nil
+			}
+			return n, err
+		}
+
+		// Nothing was read, reconnect unless this keeps happening
+		r.body.Close()
+		r.body = nil
+		failures++
+		if failures >= r.policy.Attempts || !retryable(err) {
+			r.err = fmt.Errorf("%s at offset %d: %v", r.what, r.offset, err)
+			return 0, r.err
+		}
+		fmt.Fprintf(os.Stderr, "%s interrupted at offset %d (%v), reconnecting in %s\n", r.what, r.offset, err, r.policy.delay(failures))
+		time.Sleep(r.policy.delay(failures))
+	}
+}
+
+func (r *retryReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// isURL reports whether a device or image argument is a network URL
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// openHTTPSource streams an image from a web server. Broken downloads resume
+// with a range request where they stopped.
+func openHTTPSource(url string) io.ReadCloser {
+	return newRetryReader(url, networkRetry, func(offset int64) (io.ReadCloser, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case offset > 0 && resp.StatusCode == http.StatusOK:
+			resp.Body.Close()
+			return nil, permanentError{fmt.Errorf("the server does not support resuming downloads")}
+		case resp.StatusCode/100 != 2:
+			resp.Body.Close()
+			return nil, &cloudHTTPError{Status: resp.StatusCode}
+		}
+		return resp.Body, nil
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 and compatible stores like MinIO are configured with the usual AWS
+// environment variables: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, the
+// optional AWS_SESSION_TOKEN and AWS_REGION, and AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL for stores other than AWS, which are addressed path style.
+
+const s3Concurrency = 4
+
+// s3Limits are the limits of S3 multipart uploads
+var s3Limits = cloudLimits{maxParts: 10000, maxPartSize: 5 * gb}
+
+// s3Client signs requests for one bucket
+type s3Client struct {
+	endpoint     *url.URL
+	pathStyle    bool
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Client(bucket string) (*s3Client, error) {
+	c := &s3Client{
+		bucket:       bucket,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for s3:// outputs")
+	}
+
+	endpoint := firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	if endpoint == "" {
+		// Virtual hosted buckets with dots in the name break TLS certificate checks
+		c.pathStyle = strings.Contains(bucket, ".")
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.region)
+		if !c.pathStyle {
+			endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, c.region)
+		}
+	} else {
+		c.pathStyle = true
+	}
+	var err error
+	if c.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %v", endpoint, err)
+	}
+	return c, nil
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters,
+// as the signature requires
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// request builds a signed request for an object key
+func (c *s3Client) request(method, key string, query url.Values, headers map[string]string, body []byte) (*http.Request, error) {
+	path := "/" + key
+	if c.pathStyle {
+		path = "/" + c.bucket + "/" + key
+	}
+	path = strings.TrimSuffix(c.endpoint.Path, "/") + path
+
+	var queryParts []string
+	for name, values := range query {
+		for _, value := range values {
+			queryParts = append(queryParts, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(queryParts)
+	canonicalQuery := strings.Join(queryParts, "&")
+
+	target := c.endpoint.Scheme + "://" + c.endpoint.Host + awsURIEncode(path, false)
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	c.sign(req, awsURIEncode(path, false), canonicalQuery, body, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds an AWS signature version 4 to a request
+func (c *s3Client) sign(req *http.Request, canonicalPath, canonicalQuery string, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	// Sign the host, the content type and every x-amz header
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "content-md5" || lower == "range" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, canonicalPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// do signs and sends a request, returning the response body
+func (c *s3Client) do(method, key string, query url.Values, headers map[string]string, body []byte) ([]byte, http.Header, error) {
+	req, err := c.request(method, key, query, headers, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cloudDo(req)
+}
+
+// s3Upload is a multipart upload of one object
+type s3Upload struct {
+	client   *s3Client
+	key      string
+	options  outputOptions
+	uploadID string
+
+	mu    sync.Mutex
+	etags map[int]string
+}
+
+// encryptionHeaders are the server-side encryption headers for the object
+func (u *s3Upload) encryptionHeaders() map[string]string {
+	headers := map[string]string{}
+	if u.options.SSE != "" {
+		headers["X-Amz-Server-Side-Encryption"] = u.options.SSE
+	}
+	if u.options.SSEKMSKey != "" {
+		headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = u.options.SSEKMSKey
+	}
+	return headers
+}
+
+func (u *s3Upload) begin() error {
+	body, _, err := u.client.do(http.MethodPost, u.key, url.Values{"uploads": {""}}, u.encryptionHeaders(), nil)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+		return fmt.Errorf("no upload ID in the response to starting the upload")
+	}
+	u.uploadID = result.UploadID
+	return nil
+}
+
+func (u *s3Upload) uploadPart(number int, data []byte) error {
+	query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {u.uploadID}}
+	_, header, err := u.client.do(http.MethodPut, u.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.etags[number] = header.Get("ETag")
+	u.mu.Unlock()
+	return nil
+}
+
+func (u *s3Upload) complete() error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for number, etag := range u.etags {
+		request.Parts = append(request.Parts, part{PartNumber: number, ETag: etag})
+	}
+	sort.Slice(request.Parts, func(i, j int) bool { return request.Parts[i].PartNumber < request.Parts[j].PartNumber })
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	// Completing can fail with a 200 status and an error document
+	response, _, err := u.client.do(http.MethodPost, u.key, url.Values{"uploadId": {u.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	var failure struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(response, &failure) == nil && failure.Code != "" {
+		return &cloudHTTPError{Status: http.StatusInternalServerError, Body: failure.Code + ": " + failure.Message}
+	}
+	return nil
+}
+
+func (u *s3Upload) abort() error {
+	_, _, err := u.client.do(http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadID}}, nil, nil)
+	return err
+}
+
+func (u *s3Upload) putObject(data []byte) error {
+	_, _, err := u.client.do(http.MethodPut, u.key, nil, u.encryptionHeaders(), data)
+	return err
+}
+
+// newS3Output streams to an object given as s3://bucket/key
+func newS3Output(target string, options outputOptions) (io.WriteCloser, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(target, "s3://"), "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("%s is not a valid S3 URL, use s3://bucket/key", target)
+	}
+	if options.SSE != "" && options.SSE != "AES256" && options.SSE != "aws:kms" {
+		return nil, fmt.Errorf("unknown server-side encryption %q, use AES256 or aws:kms", options.SSE)
+	}
+	if options.SSEKMSKey != "" && options.SSE != "aws:kms" {
+		return nil, fmt.Errorf("a KMS key needs --sse aws:kms")
+	}
+
+	client, err := newS3Client(bucket)
+	if err != nil {
+		return nil, err
+	}
+	upload := &s3Upload{client: client, key: key, options: options, etags: map[int]string{}}
+	return newCloudWriter(target, upload, s3Concurrency, s3Limits, options), nil
+}
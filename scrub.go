@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// scrubMap holds the hash of every chunk of a device from an earlier pass
+type scrubMap struct {
+	Device    string    `json:"device"`
+	Size      int64     `json:"size"`
+	Algorithm string    `json:"algorithm"`
+	ChunkSize int64     `json:"chunk_size"`
+	Created   time.Time `json:"created"`
+	Hashes    []string  `json:"hashes"`
+}
+
+// loadScrubMap reads a hashmap, nil if the file does not exist
+func loadScrubMap(path string) (*scrubMap, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m scrubMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if m.ChunkSize <= 0 || int64(len(m.Hashes)) != (m.Size+m.ChunkSize-1)/m.ChunkSize {
+		return nil, fmt.Errorf("%s is not a valid hashmap", path)
+	}
+	return &m, nil
+}
+
+// save writes the hashmap next to path and renames it into place
+func (m *scrubMap) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// scrubDevice hashes a device chunk by chunk and compares the hashes against
+// the hashmap of an earlier pass, reporting the chunks whose content changed.
+// Without a hashmap the pass creates one, with update a changed device is
+// accepted and the hashmap rewritten.
+func scrubDevice(device, mapPath, algorithm string, chunkSize int64, update bool) error {
+	previous, err := loadScrubMap(mapPath)
+	if err != nil {
+		return err
+	}
+	// An existing hashmap decides how the device is hashed
+	if previous != nil {
+		algorithm, chunkSize = previous.Algorithm, previous.ChunkSize
+	}
+	if _, err := newHash(algorithm); err != nil {
+		return err
+	}
+
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	tuning, err := tuneIO(image.File, image.Path, image.Size, image.SectorSize, ioTuning{BlockSize: chunkSize})
+	if err != nil {
+		return fmt.Errorf("invalid chunk size: %v", err)
+	}
+
+	size := image.Size
+	if previous == nil {
+		fmt.Printf("Creating hashmap %s of %s in %s %s chunks\n", mapPath, device, formatBytes(chunkSize), algorithm)
+	} else {
+		fmt.Printf("Scrubbing %s against the hashmap from %s\n", device, previous.Created.Local().Format(time.DateTime))
+		if previous.Size != image.Size {
+			warnf(warnSizeMismatch, device, "the hashmap is of %s, %s has %s, only the common part is compared",
+				formatBytes(previous.Size), device, formatBytes(image.Size))
+			size = min(size, previous.Size)
+		}
+	}
+
+	current := &scrubMap{
+		Device:    device,
+		Size:      size,
+		Algorithm: algorithm,
+		ChunkSize: chunkSize,
+		Created:   time.Now(),
+	}
+
+	listenForPause()
+	var (
+		changed  mismatchTracker
+		scrubbed int64
+		start    = time.Now()
+		display  = startProgressDisplay("", nil)
+	)
+	display.detail = func() string { return formatBytes(changed.bytes) + " changed" }
+	err = readChunks(image.File, size, tuning, func(chunk []byte, offset int64) error {
+		h, _ := newHash(algorithm)
+		h.Write(chunk)
+		sum := hex.EncodeToString(h.Sum(nil))
+		current.Hashes = append(current.Hashes, sum)
+		if previous != nil && previous.Hashes[offset/chunkSize] != sum {
+			changed.add(offset, offset+int64(len(chunk)))
+		}
+
+		scrubbed += int64(len(chunk))
+		reportProgress("scrubbing", scrubbed, size)
+		start = start.Add(pausePoint(display.Bypass(), nil))
+		return nil
+	})
+	display.stop()
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("Scrubbed %s in %s (%.2f MB/s)\n", formatBytes(scrubbed), elapsed.Truncate(time.Second), float64(scrubbed)/mb/elapsed.Seconds())
+
+	if previous == nil {
+		if err := current.save(mapPath); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d chunk hashes to %s\n", len(current.Hashes), mapPath)
+		printResult("%s", mapPath)
+		return nil
+	}
+
+	if changed.count == 0 {
+		fmt.Printf("%sNo changes, every chunk of %s matches the hashmap%s\n", green, device, reset)
+		return nil
+	}
+	fmt.Printf("%s%d changed ranges, %s in %d chunks:%s\n", red, changed.count, formatBytes(changed.bytes), (changed.bytes+chunkSize-1)/chunkSize, reset)
+	for _, r := range changed.ranges {
+		fmt.Printf("  %d-%d (%s, sector %d)\n", r.Start, r.End-1, formatBytes(r.End-r.Start), r.Start/int64(image.SectorSize))
+	}
+	if changed.count > len(changed.ranges) {
+		fmt.Printf("  ... and %d more\n", changed.count-len(changed.ranges))
+	}
+	if update {
+		if err := current.save(mapPath); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s with the current content\n", mapPath)
+		return nil
+	}
+	return fmt.Errorf("%s changed since the hashmap was created", device)
+}
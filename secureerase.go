@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// secure-erase has the drive erase itself with the ATA security erase or the
+// NVMe format and sanitize commands, instead of overwriting it with wipe.
+// This reaches the spare and remapped areas software cannot, and on self
+// encrypting drives it throws away the key in seconds.
+
+// secureEraseOptions are the settings of secure-erase
+type secureEraseOptions struct {
+	// Method is the erase command to use, the best the drive supports if empty
+	Method string
+	// Info shows what the drive supports and its state without erasing
+	Info bool
+	// Confirm is the device path typed on the command line instead of at the prompt
+	Confirm string
+}
+
+// eraseMethod is an erase command a drive supports
+type eraseMethod struct {
+	Name    string
+	Summary string
+	// Estimate is how long the drive says the erase takes, 0 if it does not say
+	Estimate time.Duration
+}
+
+// eraseDrive is what a drive tells about erasing itself
+type eraseDrive struct {
+	Kind   string // ATA or NVMe
+	Model  string
+	Serial string
+	// Methods are the supported erase commands, the best first
+	Methods []eraseMethod
+	// State describes the security or sanitize state
+	State []string
+	// Problems keep the drive from being erased now
+	Problems []string
+	// nsid is the NVMe namespace of the device
+	nsid uint32
+}
+
+// method returns the erase command with the name, the best for an empty name
+func (d *eraseDrive) method(name string) (eraseMethod, error) {
+	if len(d.Methods) == 0 {
+		return eraseMethod{}, fmt.Errorf("the %s drive supports none of the erase commands", d.Kind)
+	}
+	if name == "" {
+		return d.Methods[0], nil
+	}
+	var names []string
+	for _, m := range d.Methods {
+		if m.Name == name {
+			return m, nil
+		}
+		names = append(names, m.Name)
+	}
+	return eraseMethod{}, fmt.Errorf("the drive does not support %s, it supports %s", name, strings.Join(names, ", "))
+}
+
+// print shows the drive, its erase commands and its state
+func (d *eraseDrive) print(device string) {
+	fmt.Printf("%s: %s drive %s, serial %s\n", device, d.Kind, d.Model, d.Serial)
+	for _, line := range d.State {
+		fmt.Printf("  %s\n", line)
+	}
+	if len(d.Methods) == 0 {
+		fmt.Println("  No erase commands supported")
+	}
+	for _, m := range d.Methods {
+		estimate := "no estimate"
+		if m.Estimate > 0 {
+			estimate = "about " + m.Estimate.String()
+		}
+		fmt.Printf("  %-20s %s, %s\n", m.Name, m.Summary, estimate)
+	}
+	for _, problem := range d.Problems {
+		fmt.Printf("  %s%s%s\n", red, problem, reset)
+	}
+}
+
+// secureErase erases a whole drive with an erase command of its firmware
+func secureErase(device string, options secureEraseOptions) error {
+	if options.Info {
+		file, err := os.Open(device)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			return fmt.Errorf("%s is a file, secure-erase works on drives, use wipe for images", device)
+		}
+		drive, err := probeSecureErase(file, device)
+		if err != nil {
+			return err
+		}
+		drive.print(device)
+		return nil
+	}
+
+	writer, err := openDeviceWriterTo(device, "secure erase", io.Discard)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if info, err := writer.File.Stat(); err == nil && info.Mode().IsRegular() {
+		return fmt.Errorf("%s is a file, secure-erase works on drives, use wipe for images", device)
+	}
+	drive, err := probeSecureErase(writer.File, device)
+	if err != nil {
+		return err
+	}
+	drive.print(device)
+	method, err := drive.method(options.Method)
+	if err != nil {
+		return err
+	}
+	if len(drive.Problems) > 0 {
+		return fmt.Errorf("%s cannot be erased now: %s", device, strings.Join(drive.Problems, "; "))
+	}
+
+	warnf(warnIrreversible, device, "the drive erases itself with %s. Once started it cannot be stopped or paused, and the drive must stay powered and connected until it finishes, or it may be left locked or unusable.",
+		method.Name)
+	if writer.DryRun {
+		fmt.Printf("Dry run: would erase %s with %s\n", device, method.Name)
+		return nil
+	}
+	description := fmt.Sprintf("all %s on %s (%s, serial %s)", formatBytes(writer.Size), device, drive.Model, drive.Serial)
+	if err := confirmTyped(device, description, options.Confirm); err != nil {
+		return err
+	}
+
+	var progress float64
+	done := make(chan error, 1)
+	update := make(chan float64, 1)
+	go func() {
+		done <- runSecureErase(writer.File, drive, method, func(p float64) {
+			select {
+			case update <- p:
+			default:
+			}
+		})
+	}()
+
+	// The drive reports progress of sanitize only, the others go by the
+	// estimate of the drive, kept short of the end until it reports done
+	start := time.Now()
+	display := startProgressDisplay(fmt.Sprintf("Erasing %s with %s", device, method.Name), nil)
+	display.detail = func() string {
+		elapsed := time.Since(start).Truncate(time.Second)
+		if progress == 0 && method.Estimate > 0 {
+			return fmt.Sprintf("%s elapsed, estimated by the drive", elapsed)
+		}
+		return fmt.Sprintf("%s elapsed", elapsed)
+	}
+	show := func() {
+		var erased int64
+		switch {
+		case progress > 0:
+			erased = int64(progress * float64(writer.Size))
+		case method.Estimate > 0:
+			fraction := min(time.Since(start).Seconds()/method.Estimate.Seconds(), 0.99)
+			erased = int64(fraction * float64(writer.Size))
+		}
+		reportProgress("secure erase", erased, writer.Size)
+	}
+	show()
+	ticker := time.NewTicker(time.Second)
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		case progress = <-update:
+		case <-ticker.C:
+			show()
+		}
+	}
+	ticker.Stop()
+	if err == nil {
+		reportProgress("secure erase", writer.Size, writer.Size)
+	}
+	display.stop()
+	if err != nil {
+		return fmt.Errorf("erasing %s with %s: %v", device, method.Name, err)
+	}
+
+	rereadPartitionTableOrWarn(writer.File, writer.Path)
+	fmt.Printf("%sErased %s with %s in %s%s\n", green, device, method.Name, time.Since(start).Truncate(time.Second), reset)
+	printResult("%s", device)
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ataErasePassword is the temporary user password the ATA security erase
+// needs. A drive left locked by an interrupted erase is unlocked with
+// hdparm --user-master u --security-disable dsktool.
+const ataErasePassword = "dsktool"
+
+// probeSecureErase asks a drive which erase commands it supports and
+// whether anything keeps them from running
+func probeSecureErase(f *os.File, device string) (*eraseDrive, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(resolved)
+	if _, err := os.Stat(filepath.Join("/sys/class/block", name, "partition")); err == nil {
+		return nil, fmt.Errorf("%s is a partition, secure-erase erases whole drives, use wipe for partitions", device)
+	}
+
+	var drive *eraseDrive
+	if nsid, err := nvmeNamespaceID(f); err == nil {
+		if drive, err = probeNVMeErase(f, nsid); err != nil {
+			return nil, err
+		}
+	} else {
+		words, err := ataIdentify(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s answers neither NVMe nor ATA commands: %v", device, err)
+		}
+		drive = probeATAErase(words)
+	}
+
+	// The drive and all its partitions have to be out of use
+	if usage := partitionUsage(device); usage != "" {
+		drive.Problems = append(drive.Problems, fmt.Sprintf("%s is %s", device, usage))
+	}
+	entries, _ := os.ReadDir(filepath.Join("/sys/class/block", name))
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join("/sys/class/block", name, entry.Name(), "partition")); err != nil {
+			continue
+		}
+		if usage := partitionUsage("/dev/" + entry.Name()); usage != "" {
+			drive.Problems = append(drive.Problems, fmt.Sprintf("/dev/%s is %s", entry.Name(), usage))
+		}
+	}
+	return drive, nil
+}
+
+// probeATAErase reads the security feature set from IDENTIFY DEVICE data
+func probeATAErase(words [256]uint16) *eraseDrive {
+	security := parseATASecurity(words)
+	drive := &eraseDrive{Kind: "ATA", Model: ataString(words[27:47]), Serial: ataString(words[10:20])}
+	if !security.Supported {
+		drive.State = append(drive.State, "Security feature set: not supported")
+		return drive
+	}
+
+	state := []string{"supported"}
+	for _, flag := range []struct {
+		set     bool
+		yes, no string
+		problem string
+	}{
+		{security.Enabled, "password set", "no password", "a user password is set, if an interrupted erase left it, remove it with hdparm --user-master u --security-disable " + ataErasePassword},
+		{security.Locked, "locked", "not locked", "the drive is locked, unlock it with its password first"},
+		{security.Frozen, "frozen", "not frozen", "the drive is frozen, the BIOS locks the security commands at boot. Suspending and resuming the machine (rtcwake -m mem -s 5) or unplugging and replugging the drive usually unfreezes it"},
+		{security.CountExpired, "password attempts exhausted", "", "too many wrong passwords were tried, power cycle the drive"},
+	} {
+		if flag.set {
+			state = append(state, flag.yes)
+			drive.Problems = append(drive.Problems, flag.problem)
+		} else if flag.no != "" {
+			state = append(state, flag.no)
+		}
+	}
+	drive.State = append(drive.State, "Security feature set: "+strings.Join(state, ", "))
+
+	if security.EnhancedSupported {
+		drive.Methods = append(drive.Methods, eraseMethod{Name: "ata-enhanced",
+			Summary: "enhanced security erase, also the remapped sectors, self encrypting drives change their key", Estimate: security.EnhancedTime})
+	}
+	drive.Methods = append(drive.Methods, eraseMethod{Name: "ata",
+		Summary: "security erase of the user data", Estimate: security.NormalTime})
+	return drive
+}
+
+// probeNVMeErase reads the format and sanitize support of the controller
+func probeNVMeErase(f *os.File, nsid uint32) (*eraseDrive, error) {
+	ctrl, err := nvmeIdentifyController(f)
+	if err != nil {
+		return nil, err
+	}
+	drive := &eraseDrive{Kind: "NVMe", Model: ctrl.Model, Serial: ctrl.Serial, nsid: nsid}
+
+	var sanitize nvmeSanitizeLog
+	if ctrl.SANICAP&7 != 0 {
+		log, err := nvmeReadSanitizeLog(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading the sanitize status: %v", err)
+		}
+		sanitize = *log
+		switch sanitize.Status {
+		case 1, 4:
+			drive.State = append(drive.State, "Sanitize: the last one finished")
+		case 2:
+			drive.State = append(drive.State, fmt.Sprintf("Sanitize: running, %.1f%% done", sanitize.Progress*100))
+			drive.Problems = append(drive.Problems, "a sanitize is running, it continues after power loss until it is done")
+		case 3:
+			drive.State = append(drive.State, "Sanitize: the last one failed, a new one starts over")
+		default:
+			drive.State = append(drive.State, "Sanitize: never run")
+		}
+	}
+
+	// Sanitize works on every namespace, so does format on some controllers
+	all := ""
+	if ctrl.FNA&1 != 0 {
+		all = ", of every namespace"
+	}
+	if ctrl.SANICAP&1 != 0 {
+		drive.Methods = append(drive.Methods, eraseMethod{Name: "sanitize-crypto",
+			Summary: "sanitize by changing the media encryption key, of every namespace", Estimate: sanitize.CryptoErase})
+	}
+	if ctrl.SANICAP&2 != 0 {
+		drive.Methods = append(drive.Methods, eraseMethod{Name: "sanitize-block",
+			Summary: "sanitize by erasing every block, of every namespace", Estimate: sanitize.BlockErase})
+	}
+	if ctrl.OACS&2 != 0 {
+		if ctrl.FNA&4 != 0 {
+			drive.Methods = append(drive.Methods, eraseMethod{Name: "format-crypto",
+				Summary: "format with a cryptographic erase" + all})
+		}
+		drive.Methods = append(drive.Methods, eraseMethod{Name: "format",
+			Summary: "format with a user data erase" + all})
+	}
+	if ctrl.SANICAP&4 != 0 {
+		drive.Methods = append(drive.Methods, eraseMethod{Name: "sanitize-overwrite",
+			Summary: "sanitize by overwriting every block, of every namespace", Estimate: sanitize.Overwrite})
+	}
+	return drive, nil
+}
+
+// runSecureErase runs the erase command, reporting the progress of
+// sanitize operations as they go
+func runSecureErase(f *os.File, drive *eraseDrive, method eraseMethod, progress func(float64)) error {
+	switch method.Name {
+	case "ata", "ata-enhanced":
+		enhanced := method.Name == "ata-enhanced"
+		if err := ataCommand(f, ataSecuritySetPass, 0, ataProtocolPIODataOut, ataSecurityData(ataErasePassword, false), 30*time.Second); err != nil {
+			return fmt.Errorf("setting the temporary password: %v", err)
+		}
+		if err := ataCommand(f, ataSecurityErasePrep, 0, ataProtocolNonData, nil, 30*time.Second); err != nil {
+			return err
+		}
+		// The drive answers only when it is done
+		timeout := 24 * time.Hour
+		if method.Estimate > 0 {
+			timeout = 2*method.Estimate + time.Hour
+		}
+		return ataCommand(f, ataSecurityEraseUnit, 0, ataProtocolPIODataOut, ataSecurityData(ataErasePassword, enhanced), timeout)
+
+	case "format", "format-crypto":
+		ns, err := nvmeIdentifyNamespace(f, drive.nsid)
+		if err != nil {
+			return err
+		}
+		// The secure erase setting, 1 erases the user data, 2 the key
+		ses := uint32(1)
+		if method.Name == "format-crypto" {
+			ses = 2
+		}
+		cmd := &nvmeAdminCmd{Opcode: nvmeAdminFormat, NSID: drive.nsid,
+			Cdw10: ns.formatFields() | ses<<9, TimeoutMs: uint32((4 * time.Hour).Milliseconds())}
+		return nvmeAdmin(f, cmd, nil)
+	}
+
+	action := map[string]uint32{"sanitize-block": 2, "sanitize-overwrite": 3 | 1<<4, "sanitize-crypto": 4}[method.Name]
+	if action == 0 {
+		return fmt.Errorf("unknown erase method %s", method.Name)
+	}
+	if err := nvmeAdmin(f, &nvmeAdminCmd{Opcode: nvmeAdminSanitize, Cdw10: action}, nil); err != nil {
+		return err
+	}
+	// Sanitize runs in the background of the controller
+	for {
+		time.Sleep(time.Second)
+		log, err := nvmeReadSanitizeLog(f)
+		if err != nil {
+			return fmt.Errorf("reading the sanitize status: %v", err)
+		}
+		switch log.Status {
+		case 1, 4:
+			return nil
+		case 2:
+			progress(log.Progress)
+		case 3:
+			return fmt.Errorf("the sanitize failed, the drive stays in the failure mode until a new sanitize succeeds")
+		}
+	}
+}
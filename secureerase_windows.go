@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// probeSecureErase is not implemented on Windows yet
+func probeSecureErase(f *os.File, device string) (*eraseDrive, error) {
+	return nil, fmt.Errorf("secure erase is not supported on Windows yet")
+}
+
+// runSecureErase is not implemented on Windows yet
+func runSecureErase(f *os.File, drive *eraseDrive, method eraseMethod, progress func(float64)) error {
+	return fmt.Errorf("secure erase is not supported on Windows yet")
+}
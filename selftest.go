@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// The self-test runs the operations dsktool is trusted with against a
+// temporary sparse image: partition tables are written and read back,
+// partitions created, deleted and resized, filesystems made, and the disk
+// imaged, verified and restored with the dsktool commands a user would run.
+// It only ever writes inside its temporary directory.
+
+// selftestDiskSize is the size of the temporary image
+const selftestDiskSize = 256 * mb
+
+// selftest holds the files of a self-test run
+type selftest struct {
+	dir      string
+	disk     string
+	restored string
+	self     string
+	sectors  uint64
+}
+
+// selftestStep is one step of the self-test, later steps build on earlier ones
+type selftestStep struct {
+	name string
+	run  func() error
+}
+
+// runSelftest runs every step and reports it, stopping at the first failure.
+// With keep the temporary files stay for a look.
+func runSelftest(keep bool) error {
+	if dryRun {
+		return fmt.Errorf("the self-test only writes its own temporary image, run it without --dry-run")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "dsktool-selftest-*")
+	if err != nil {
+		return err
+	}
+	if keep {
+		defer fmt.Printf("The test files are in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	t := &selftest{
+		dir:      dir,
+		disk:     filepath.Join(dir, "disk.img"),
+		restored: filepath.Join(dir, "restored.img"),
+		self:     self,
+		sectors:  selftestDiskSize / 512,
+	}
+	steps := []selftestStep{
+		{"Create a sparse image", t.createImage},
+		{"Write a GPT and read it back", t.writeGPT},
+		{"Create FAT16 and FAT32 filesystems", t.makeFileSystems},
+		{"Delete a partition", t.deletePartition},
+		{"Create a partition", t.createPartition},
+		{"Resize a partition", t.resizePartition},
+		{"Image the disk", t.image},
+		{"Verify the image against the disk", t.verify},
+		{"Restore the image onto another disk", t.restore},
+		{"Write an MBR and read it back", t.writeMBR},
+		{"Read damaged GPTs made by mkfixture", t.readFixtures},
+	}
+
+	fmt.Printf("Testing dsktool %s on %s/%s with a %s image in %s\n", appversion, runtime.GOOS, runtime.GOARCH, formatBytes(selftestDiskSize), dir)
+	for i, step := range steps {
+		start := time.Now()
+		if err := step.run(); err != nil {
+			fmt.Printf("%sFAIL%s %s: %v\n", red, reset, step.name, err)
+			if skipped := len(steps) - i - 1; skipped > 0 {
+				fmt.Printf("%d later steps were not run, they need this one\n", skipped)
+			}
+			return fmt.Errorf("the self-test failed at: %s", step.name)
+		}
+		fmt.Printf("%sPASS%s %s (%s)\n", green, reset, step.name, time.Since(start).Round(time.Millisecond))
+	}
+	fmt.Printf("%sAll %d steps passed%s\n", green, len(steps), reset)
+	return nil
+}
+
+// createImage makes the sparse images the test writes to
+func (t *selftest) createImage() error {
+	for _, path := range []string{t.disk, t.restored} {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := file.Truncate(selftestDiskSize); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTable reads the partition table of an image
+func (t *selftest) readTable(path string) (*partitionTable, error) {
+	image, err := openImage(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+	return image.partitionTable()
+}
+
+// writeTable writes a table to an image and checks it reads back the same
+func (t *selftest) writeTable(path string, table *partitionTable) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := writePartitionTable(file, file, selftestDiskSize, table); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	read, err := t.readTable(path)
+	if err != nil {
+		return fmt.Errorf("reading the table back: %v", err)
+	}
+	if read.Type != table.Type {
+		return fmt.Errorf("wrote a %s table, read back %s", table.Type, read.Type)
+	}
+	if diff := diffPartitionTables(table, read); len(diff) > 0 {
+		return fmt.Errorf("the table read back differs: %s", strings.Join(diff, "; "))
+	}
+	return nil
+}
+
+// editTable reads the table of the disk, changes it and writes it back
+func (t *selftest) editTable(change func(table *partitionTable) error) error {
+	table, err := t.readTable(t.disk)
+	if err != nil {
+		return err
+	}
+	if err := change(table); err != nil {
+		return err
+	}
+	return t.writeTable(t.disk, table)
+}
+
+// addPartition adds a partition from start to end MiB, end 0 for the end of the usable area
+func (t *selftest) addPartition(table *partitionTable, number int, start, end uint64, typeName string) error {
+	first := start * mb / table.SectorSize
+	_, last := table.usableRange(t.sectors)
+	if end > 0 {
+		last = end*mb/table.SectorSize - 1
+	}
+	_, err := table.createPartition(partitionSpec{Number: number, FirstLBA: first, LastLBA: last, Type: typeName}, t.sectors)
+	return err
+}
+
+func (t *selftest) writeGPT() error {
+	table, err := newPartitionTable("GPT", 512, t.sectors)
+	if err != nil {
+		return err
+	}
+	if err := t.addPartition(table, 1, 1, 65, "EFI System"); err != nil {
+		return err
+	}
+	if err := t.addPartition(table, 2, 65, 200, "Microsoft basic data"); err != nil {
+		return err
+	}
+	return t.writeTable(t.disk, table)
+}
+
+// makeFileSystem makes a FAT filesystem and checks it opens with its label
+func (t *selftest) makeFileSystem(spec, fstype, label string) error {
+	if err := makeFileSystem(spec, fstype, label, io.Discard); err != nil {
+		return fmt.Errorf("%s on %s: %v", fstype, spec, err)
+	}
+	return t.checkFileSystem(spec, label)
+}
+
+// checkFileSystem checks that a partition holds a filesystem with label
+func (t *selftest) checkFileSystem(spec, label string) error {
+	image, fsys, err := openFileSystemSpec(spec)
+	if err != nil {
+		return fmt.Errorf("reading the filesystem on %s: %v", spec, err)
+	}
+	defer image.Close()
+	if got := volumeLabel(fsys); got != label {
+		return fmt.Errorf("the filesystem on %s has the label %q, not %q", spec, got, label)
+	}
+	if _, err := fsys.ReadDir("/"); err != nil {
+		return fmt.Errorf("listing the filesystem on %s: %v", spec, err)
+	}
+	return nil
+}
+
+func (t *selftest) makeFileSystems() error {
+	if err := t.makeFileSystem(t.disk+":1", "fat16", "SELFTEST1"); err != nil {
+		return err
+	}
+	return t.makeFileSystem(t.disk+":2", "fat32", "SELFTEST2")
+}
+
+func (t *selftest) deletePartition() error {
+	if err := t.editTable(func(table *partitionTable) error { return table.deletePartition(2) }); err != nil {
+		return err
+	}
+	// The partition in front must not notice
+	return t.checkFileSystem(t.disk+":1", "SELFTEST1")
+}
+
+func (t *selftest) createPartition() error {
+	if err := t.editTable(func(table *partitionTable) error {
+		return t.addPartition(table, 2, 65, 160, "Linux filesystem")
+	}); err != nil {
+		return err
+	}
+	return t.makeFileSystem(t.disk+":2", "fat32", "SELFTEST3")
+}
+
+// resizePartition grows partition 2 to the end of the disk, in place
+func (t *selftest) resizePartition() error {
+	if err := t.editTable(func(table *partitionTable) error {
+		_, last := table.usableRange(t.sectors)
+		for i := range table.Partitions {
+			if part := &table.Partitions[i]; part.Number == 2 {
+				part.LastLBA, part.GPT.LastLBA = last, last
+				return nil
+			}
+		}
+		return fmt.Errorf("partition 2 is missing")
+	}); err != nil {
+		return err
+	}
+	// Growing the partition leaves its filesystem where it was
+	return t.checkFileSystem(t.disk+":2", "SELFTEST3")
+}
+
+// run runs a dsktool command, showing its output only if it fails
+func (t *selftest) run(args ...string) error {
+	var output bytes.Buffer
+	cmd := exec.Command(t.self, args...)
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("dsktool %s: %v\n%s", strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+func (t *selftest) image() error {
+	if err := t.run("image", t.disk, t.disk, "--compress", "zstd"); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.disk + ".zst"); err != nil {
+		return fmt.Errorf("the image was not written: %v", err)
+	}
+	return nil
+}
+
+func (t *selftest) verify() error {
+	return t.run("verify", t.disk+".zst", t.disk)
+}
+
+// restore clones the image onto the second disk and compares the disks
+func (t *selftest) restore() error {
+	if err := t.run("clone", "--yes", "--verify", t.disk+".zst", t.restored); err != nil {
+		return err
+	}
+	original, err := fileSHA256(t.disk)
+	if err != nil {
+		return err
+	}
+	restored, err := fileSHA256(t.restored)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(original, restored) {
+		return fmt.Errorf("the restored disk differs from the original")
+	}
+	return t.checkFileSystem(t.restored+":2", "SELFTEST3")
+}
+
+// writeMBR replaces the GPT of the restored disk with an MBR and a FAT32 partition
+func (t *selftest) writeMBR() error {
+	table, err := newPartitionTable("MBR", 512, t.sectors)
+	if err != nil {
+		return err
+	}
+	if err := t.addPartition(table, 1, 1, 0, "FAT32 LBA"); err != nil {
+		return err
+	}
+	if err := t.writeTable(t.restored, table); err != nil {
+		return err
+	}
+	return t.makeFileSystem(t.restored+":1", "fat32", "SELFTEST4")
+}
+
+// readFixtures makes images with damaged GPTs and checks their partitions
+// are still found, from the backup when the primary is damaged, and that
+// repairing the table keeps them
+func (t *selftest) readFixtures() error {
+	for _, kind := range []string{"bad-header-crc", "bad-entries-crc", "truncated-backup"} {
+		path := filepath.Join(t.dir, kind+".img")
+		if err := t.run("mkfixture", "--seed", "1", "--partitions", "3", path, kind); err != nil {
+			return err
+		}
+		table, err := t.checkFixture(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", kind, err)
+		}
+		if damaged := table.PrimaryDamage != nil; damaged != strings.HasPrefix(kind, "bad-") {
+			return fmt.Errorf("%s: the primary GPT was taken as damaged: %v", kind, damaged)
+		}
+		if table.PrimaryDamage == nil {
+			continue
+		}
+		if err := t.run("table", "repair", "--yes", path); err != nil {
+			return err
+		}
+		if table, err = t.checkFixture(path); err != nil {
+			return fmt.Errorf("%s after the repair: %v", kind, err)
+		}
+		if table.PrimaryDamage != nil {
+			return fmt.Errorf("%s: the primary GPT is still damaged after the repair: %v", kind, table.PrimaryDamage)
+		}
+	}
+	return nil
+}
+
+// checkFixture reads the table of a fixture and checks it has the three
+// partitions mkfixture made, with their names intact
+func (t *selftest) checkFixture(path string) (*partitionTable, error) {
+	table, err := t.readTable(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(table.Partitions) != 3 {
+		return nil, fmt.Errorf("found %d partitions instead of 3", len(table.Partitions))
+	}
+	for _, part := range table.Partitions {
+		if want := fmt.Sprintf("fixture %d", part.Number); part.Name != want {
+			return nil, fmt.Errorf("partition %d is named %q instead of %q", part.Number, part.Name, want)
+		}
+	}
+	return table, nil
+}
+
+// fileSHA256 hashes a file
+func fileSHA256(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --record every command adds itself to a session file: its arguments,
+// the partition tables of the disks it names before and after it ran, the
+// errors it continued after, the TUI log and how it ended. Commands the
+// wizard and batch run record into the same session. dsktool replay shows a
+// session, so users can share exactly what happened when they ask for help.
+
+// sessionRecordEnv passes the session file on to the dsktool commands a command runs
+const sessionRecordEnv = "DSKTOOL_RECORD"
+
+// Kinds of the events of a command besides the TUI log entries
+const (
+	// sessionEventError is the kind of the errors a command continued after
+	sessionEventError = "error"
+	// sessionEventWarning is the kind of the warnings of a command
+	sessionEventWarning = "warning"
+)
+
+// sessionFormatVersion is the version of the session file format
+const sessionFormatVersion = 1
+
+// session is the content of a session file
+type session struct {
+	Version  int              `json:"version"`
+	Dsktool  string           `json:"dsktool"`
+	Host     string           `json:"host"`
+	OS       string           `json:"os"`
+	Started  time.Time        `json:"started"`
+	Commands []sessionCommand `json:"commands"`
+}
+
+// sessionCommand is one dsktool command of a session
+type sessionCommand struct {
+	PID        int            `json:"pid"`
+	Command    string         `json:"command"`
+	Args       []string       `json:"args"`
+	DryRun     bool           `json:"dry_run,omitempty"`
+	Started    time.Time      `json:"started"`
+	Ended      *time.Time     `json:"ended,omitempty"`
+	Before     []deviceState  `json:"before"`
+	After      []deviceState  `json:"after"`
+	Events     []sessionEvent `json:"events"`
+	ExitStatus *int           `json:"exit_status,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// sessionEvent is something that happened while a command ran
+type sessionEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // error, warning, or the kind of a TUI log entry
+	Message string    `json:"message"`
+	Code    string    `json:"code,omitempty"` // of warnings
+}
+
+// deviceState is what a disk or image looked like at one point of a session
+type deviceState struct {
+	Path       string    `json:"path"`
+	Time       time.Time `json:"time"`
+	Size       int64     `json:"size"`
+	Serial     string    `json:"serial,omitempty"`
+	Table      string    `json:"table,omitempty"`
+	SectorSize uint64    `json:"sector_size,omitempty"`
+	Partitions []string  `json:"partitions,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// sessionRecorder adds the running command to a session file, a nil
+// recorder does nothing
+type sessionRecorder struct {
+	path     string
+	mu       sync.Mutex
+	command  sessionCommand
+	devices  []string // whose state is recorded again when the command ends
+	finished bool
+}
+
+var recording *sessionRecorder
+
+// setupRecording starts recording the command into the session file at
+// path, or the one of the command that ran it
+func setupRecording(path string) error {
+	if path == "" {
+		path = os.Getenv(sessionRecordEnv)
+	}
+	if path == "" {
+		return nil
+	}
+	if err := os.Setenv(sessionRecordEnv, path); err != nil {
+		return err
+	}
+	r := &sessionRecorder{
+		path: path,
+		command: sessionCommand{
+			PID:     os.Getpid(),
+			Command: hookCommand(),
+			Args:    os.Args[1:],
+			DryRun:  dryRun,
+			Started: time.Now(),
+			Before:  []deviceState{},
+			After:   []deviceState{},
+			Events:  []sessionEvent{},
+		},
+	}
+	for _, arg := range os.Args[1:] {
+		if state, ok := argDeviceState(arg, path); ok {
+			r.command.Before = append(r.command.Before, state)
+			r.devices = append(r.devices, state.Path)
+		}
+	}
+	recording = r
+	return r.save()
+}
+
+// argDeviceState returns the state of the disk or image an argument names.
+// Devices are always recorded, files if they hold a partition table or are
+// big enough to be a disk image that gets one.
+func argDeviceState(arg, sessionPath string) (deviceState, bool) {
+	device, _ := parsePartitionSpec(arg)
+	if strings.HasPrefix(device, "-") || device == sessionPath {
+		return deviceState{}, false
+	}
+	info, err := os.Stat(device)
+	if err != nil || !(info.Mode().IsRegular() || info.Mode()&os.ModeDevice != 0) {
+		return deviceState{}, false
+	}
+	state := readDeviceState(device)
+	return state, info.Mode()&os.ModeDevice != 0 || state.Table != "" || info.Size() >= mb
+}
+
+// readDeviceState reads the size and partition table of a disk or image
+func readDeviceState(device string) deviceState {
+	state := deviceState{Path: device, Time: time.Now()}
+	file, err := os.Open(device)
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	defer file.Close()
+	if state.Size, err = getFileSize(file); err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	state.Serial = diskSerial(device)
+	table, err := readPartitionTable(newTimeoutReaderAt(file, device), uint64(getSectorSize(file)))
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	state.Table, state.SectorSize = table.Type, table.SectorSize
+	for _, part := range table.Partitions {
+		state.Partitions = append(state.Partitions,
+			fmt.Sprintf("%d  %s", part.Number, joinFields(partitionFields(part, table.SectorSize))))
+	}
+	return state
+}
+
+// recordDevice records the state of a device a command is about to change,
+// and records it again when the command ends
+func recordDevice(device string) {
+	r := recording
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.devices {
+		if d == device {
+			return
+		}
+	}
+	r.devices = append(r.devices, device)
+	r.command.Before = append(r.command.Before, readDeviceState(device))
+}
+
+// recordEvent adds something that happened to the command's events
+func recordEvent(kind, message string) {
+	r := recording
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.command.Events = append(r.command.Events, sessionEvent{Time: time.Now(), Kind: kind, Message: message})
+}
+
+// recordWarning adds a warning with its code to the command's events
+func recordWarning(w warning) {
+	r := recording
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.command.Events = append(r.command.Events, sessionEvent{Time: time.Now(), Kind: sessionEventWarning, Message: w.Message, Code: w.Code})
+}
+
+// finishRecording records how the command ended and the state of its
+// devices afterwards, status is the exit status
+func finishRecording(status int, err error) {
+	r := recording
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished {
+		return
+	}
+	r.finished = true
+
+	ended := time.Now()
+	r.command.Ended, r.command.ExitStatus = &ended, &status
+	if err != nil {
+		r.command.Error = err.Error()
+	}
+	for _, device := range r.devices {
+		r.command.After = append(r.command.After, readDeviceState(device))
+	}
+	if err := r.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "%sWarning: writing the session file: %v%s\n", yellow, err, reset)
+	}
+}
+
+// save adds the command to the session file or updates it there. The file
+// is read again each time, as commands run by this one add theirs in between.
+// The caller holds mu unless setting up.
+func (r *sessionRecorder) save() error {
+	s, err := readSession(r.path)
+	if os.IsNotExist(err) {
+		host, _ := os.Hostname()
+		s, err = &session{
+			Version: sessionFormatVersion,
+			Dsktool: appversion,
+			Host:    host,
+			OS:      runtime.GOOS + "/" + runtime.GOARCH,
+			Started: r.command.Started,
+		}, nil
+	}
+	if err != nil {
+		return err
+	}
+	updated := false
+	for i, c := range s.Commands {
+		if c.PID == r.command.PID && c.Started.Equal(r.command.Started) {
+			s.Commands[i], updated = r.command, true
+		}
+	}
+	if !updated {
+		s.Commands = append(s.Commands, r.command)
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(r.path+".tmp", r.path)
+}
+
+// readSession loads a session file
+func readSession(path string) (*session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s is not a dsktool session: %v", path, err)
+	}
+	if s.Version > sessionFormatVersion {
+		return nil, fmt.Errorf("%s was recorded by a newer dsktool, version %d", path, s.Version)
+	}
+	return &s, nil
+}
+
+// replaySession prints a recorded session command by command, with the
+// changes each made to the partition tables
+func replaySession(path string) error {
+	s, err := readSession(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Session recorded by dsktool %s on %s (%s), started %s, %d commands\n",
+		s.Dsktool, s.Host, s.OS, s.Started.Format(time.RFC3339), len(s.Commands))
+
+	for i, c := range s.Commands {
+		fmt.Println()
+		result := yellow + "did not finish" + reset
+		duration := ""
+		if c.ExitStatus != nil {
+			result = green + "ok" + reset
+			if *c.ExitStatus != 0 || c.Error != "" {
+				result = fmt.Sprintf("%sfailed, exit status %d%s", red, *c.ExitStatus, reset)
+			}
+			duration = ", " + c.Ended.Sub(c.Started).Round(time.Millisecond).String()
+		}
+		fmt.Printf("%d. %s dsktool %s  (%s%s)\n", i+1, c.Started.Format("15:04:05"), strings.Join(c.Args, " "), result, duration)
+		if c.DryRun {
+			fmt.Println("   Dry run, nothing was written")
+		}
+
+		for _, before := range c.Before {
+			fmt.Printf("   %s before: %s\n", before.Path, before.summary())
+			for _, part := range before.Partitions {
+				fmt.Printf("     %s\n", part)
+			}
+		}
+		for _, event := range c.Events {
+			line := fmt.Sprintf("   %s %-5s %s", event.Time.Format("15:04:05"), event.Kind, event.Message)
+			switch event.Kind {
+			case sessionEventError:
+				line = red + line + reset
+			case sessionEventWarning:
+				line = yellow + line + reset
+			}
+			fmt.Println(line)
+		}
+		for _, after := range c.After {
+			before := after
+			for _, b := range c.Before {
+				if b.Path == after.Path {
+					before = b
+				}
+			}
+			changes := before.changes(after)
+			if len(changes) == 0 {
+				fmt.Printf("   %s after: unchanged\n", after.Path)
+				continue
+			}
+			fmt.Printf("   %s after: %s\n", after.Path, after.summary())
+			for _, change := range changes {
+				fmt.Printf("     %s\n", change)
+			}
+		}
+		if c.Error != "" {
+			fmt.Printf("   %sError: %s%s\n", red, c.Error, reset)
+		}
+	}
+	return nil
+}
+
+// summary describes the device and its table in one line
+func (d deviceState) summary() string {
+	if d.Error != "" && d.Table == "" {
+		return fmt.Sprintf("%s, %s", formatBytes(d.Size), d.Error)
+	}
+	partitions := "1 partition"
+	if len(d.Partitions) != 1 {
+		partitions = fmt.Sprintf("%d partitions", len(d.Partitions))
+	}
+	line := fmt.Sprintf("%s, %s table with %s", formatBytes(d.Size), d.Table, partitions)
+	if d.Serial != "" {
+		line += ", serial " + d.Serial
+	}
+	return line
+}
+
+// changes lists the partitions that went away (-) or appeared or changed (+)
+// between two states of a device
+func (d deviceState) changes(after deviceState) []string {
+	var changes []string
+	if d.Table != after.Table || d.Error != after.Error {
+		changes = append(changes, fmt.Sprintf("table %s -> %s", orNone(d.Table), orNone(after.Table)))
+	}
+	for _, part := range d.Partitions {
+		if !containsString(after.Partitions, part) {
+			changes = append(changes, red+"- "+part+reset)
+		}
+	}
+	for _, part := range after.Partitions {
+		if !containsString(d.Partitions, part) {
+			changes = append(changes, green+"+ "+part+reset)
+		}
+	}
+	return changes
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The SGI volume header of IRIX disks is big endian and lists 16 partitions
+// in 512 byte blocks. Partition 8 is the volume header itself and 10 the
+// whole volume by convention.
+
+const sgiLabelMagic = 0x0be5a941
+
+// sgiPartition is a partition of an SGI volume header
+type sgiPartition struct {
+	Blocks     uint32
+	FirstBlock uint32
+	Type       uint32
+}
+
+// sgiTypeNames are the names of the SGI partition types
+var sgiTypeNames = map[uint32]string{
+	0x00: "volume header",
+	0x01: "track replacement",
+	0x02: "sector replacement",
+	0x03: "raw",
+	0x04: "BSD",
+	0x05: "SysV",
+	0x06: "volume",
+	0x07: "EFS",
+	0x08: "logical volume",
+	0x09: "raw logical volume",
+	0x0a: "XFS",
+	0x0b: "XFS log",
+	0x0c: "XLV",
+	0x0d: "XVM",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x8e: "Linux LVM",
+	0xfd: "Linux RAID",
+}
+
+// readSGILabel fills pt from an SGI volume header and reports whether there
+// is one
+func readSGILabel(r io.ReaderAt, pt *partitionTable) bool {
+	block := make([]byte, 512)
+	if _, err := r.ReadAt(block, 0); err != nil {
+		return false
+	}
+	be := binary.BigEndian
+	if be.Uint32(block[0:]) != sgiLabelMagic {
+		return false
+	}
+	// The 32 bit words of the header add up to zero with the checksum
+	var sum uint32
+	for i := 0; i < 512; i += 4 {
+		sum += be.Uint32(block[i:])
+	}
+	if sum != 0 {
+		return false
+	}
+
+	pt.Type = "SGI"
+	pt.SectorSize = 512
+	for i := 0; i < 16; i++ {
+		part := sgiPartition{
+			Blocks:     be.Uint32(block[312+i*12:]),
+			FirstBlock: be.Uint32(block[316+i*12:]),
+			Type:       be.Uint32(block[320+i*12:]),
+		}
+		if part.Blocks == 0 {
+			continue
+		}
+		pt.Partitions = append(pt.Partitions, partitionEntry{
+			Number:   i + 1,
+			FirstLBA: uint64(part.FirstBlock),
+			LastLBA:  uint64(part.FirstBlock) + uint64(part.Blocks) - 1,
+			SGI:      &part,
+		})
+	}
+	return true
+}
+
+// sgiTypeName returns the name of an SGI partition type
+func sgiTypeName(t uint32) string {
+	if name, ok := sgiTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type 0x%02x", t)
+}
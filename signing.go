@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Wipe certificates and refurb reports are signed with an ed25519 key, kept
+// in the configuration directory and created on first use, or read from the
+// file DSKTOOL_SIGNING_KEY names. The document carries the public key, so
+// checking it against the public key of the site shows that it was signed
+// there and not changed since.
+
+// documentSignature is the signature part of a signed document
+type documentSignature struct {
+	PublicKey string `json:"public_key,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// signingKeyPath returns the file of the signing key
+func signingKeyPath() (string, error) {
+	if path := os.Getenv("DSKTOOL_SIGNING_KEY"); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "signing.key"), nil
+}
+
+// loadSigningKey reads the signing key, holding its seed in hex, and creates
+// it when there is none yet
+func loadSigningKey() (ed25519.PrivateKey, error) {
+	path, err := signingKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("writing the signing key: %v", err)
+		}
+		fmt.Fprintf(messageOutput(os.Stdout), "Created the signing key %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is no signing key, it holds the %d byte seed of an ed25519 key in hex", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signedData is the JSON of a document without its signature, which is
+// what is signed
+func signedData(doc any, sig *documentSignature) ([]byte, error) {
+	signature := sig.Signature
+	sig.Signature = ""
+	data, err := json.Marshal(doc)
+	sig.Signature = signature
+	return data, err
+}
+
+// signDocument signs doc, whose signature part is sig, with the signing key
+func signDocument(doc any, sig *documentSignature) error {
+	key, err := loadSigningKey()
+	if err != nil {
+		return err
+	}
+	sig.PublicKey = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	data, err := signedData(doc, sig)
+	if err != nil {
+		return err
+	}
+	sig.Signature = hex.EncodeToString(ed25519.Sign(key, data))
+	return nil
+}
+
+// verifyDocument checks the signature of doc. With a trusted public key it
+// also has to be the key the document was signed with.
+func verifyDocument(doc any, sig *documentSignature, trusted string) error {
+	if sig.Signature == "" {
+		return fmt.Errorf("it is not signed")
+	}
+	publicKey, err := hex.DecodeString(sig.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("its public key %q is invalid", sig.PublicKey)
+	}
+	if trusted != "" {
+		want, err := hex.DecodeString(strings.TrimSpace(trusted))
+		if err != nil || !bytes.Equal(want, publicKey) {
+			return fmt.Errorf("it was signed with the key %s, not %s", sig.PublicKey, trusted)
+		}
+	}
+	signature, err := hex.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("its signature is invalid")
+	}
+	data, err := signedData(doc, sig)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, data, signature) {
+		return fmt.Errorf("the signature does not match, it was changed")
+	}
+	return nil
+}
+
+// lines renders the signature for the PDF, the signature split in two
+func (s documentSignature) lines() []string {
+	return []string{
+		"Signed with the ed25519 key",
+		"  " + s.PublicKey,
+		"Signature",
+		"  " + s.Signature[:len(s.Signature)/2],
+		"  " + s.Signature[len(s.Signature)/2:],
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a size or offset argument into bytes. It takes plain byte
+// counts, units like 100M, 1.5GiB or 20G (always binary, to match how sizes
+// are displayed), sector counts like 2048s and, when total is known, a
+// percentage of it like 50%. A sectorSize of 0 means 512 byte sectors.
+func parseSize(value string, sectorSize, total int64) (int64, error) {
+	value = strings.TrimSpace(value)
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		if total <= 0 {
+			return 0, fmt.Errorf("a percentage like %q can not be used here", value)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentage %q, use 0%% up to 100%%", value)
+		}
+		return int64(float64(total) * p / 100), nil
+	}
+
+	i := 0
+	for i < len(value) && (value[i] >= '0' && value[i] <= '9' || value[i] == '.') {
+		i++
+	}
+	number, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	unit := strings.ToUpper(strings.TrimSpace(value[i:]))
+	if unit == "S" {
+		if sectorSize <= 0 {
+			sectorSize = 512
+		}
+		if number > float64(math.MaxInt64/sectorSize) {
+			return 0, fmt.Errorf("size %q is too large", value)
+		}
+		if number != float64(int64(number)) {
+			return 0, fmt.Errorf("invalid sector count %q, use whole sectors", value)
+		}
+		return int64(number) * sectorSize, nil
+	}
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "IB"), "B")
+	multipliers := map[string]float64{"": 1, "K": kb, "M": mb, "G": gb, "T": tb, "P": pb}
+	multiplier, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q, use K, M, G, T, P or s for sectors", value)
+	}
+	if number*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// parseDeviceSize parses a size or offset on a device or image, so sector
+// counts use its sector size and percentages its size
+func parseDeviceSize(device, value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasSuffix(value, "%") && !strings.HasSuffix(strings.ToLower(value), "s") {
+		return parseSize(value, 0, 0)
+	}
+	image, err := openImage(device, false)
+	if err != nil {
+		return 0, err
+	}
+	defer image.Close()
+	return parseSize(value, int64(image.SectorSize), image.Size)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// smartSnapshot is the part of the SMART data that matters for judging a disk
+type smartSnapshot struct {
+	Available          bool   `json:"available"`
+	Error              string `json:"error,omitempty"`
+	Model              string `json:"model,omitempty"`
+	Serial             string `json:"serial,omitempty"`
+	Firmware           string `json:"firmware,omitempty"`
+	Passed             *bool  `json:"passed,omitempty"`
+	PowerOnHours       int64  `json:"power_on_hours,omitempty"`
+	Temperature        int64  `json:"temperature_c,omitempty"`
+	ReallocatedSectors int64  `json:"reallocated_sectors"`
+	PendingSectors     int64  `json:"pending_sectors"`
+	Uncorrectable      int64  `json:"uncorrectable_sectors"`
+	MediaErrors        int64  `json:"media_errors,omitempty"`
+	PercentageUsed     int64  `json:"percentage_used,omitempty"`
+}
+
+// smartctlOutput is the subset of smartctl --json output that is read
+type smartctlOutput struct {
+	Smartctl struct {
+		Messages []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	ModelName       string `json:"model_name"`
+	SerialNumber    string `json:"serial_number"`
+	FirmwareVersion string `json:"firmware_version"`
+	SmartStatus     *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	PowerOnTime struct {
+		Hours int64 `json:"hours"`
+	} `json:"power_on_time"`
+	Temperature struct {
+		Current int64 `json:"current"`
+	} `json:"temperature"`
+	ATASmartAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value int64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMeHealth *struct {
+		MediaErrors    int64 `json:"media_errors"`
+		PercentageUsed int64 `json:"percentage_used"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// readSMART captures the SMART state of a device with smartctl. A missing
+// smartctl or a device without SMART, like an image, is not an error, the
+// snapshot is marked unavailable instead.
+func readSMART(device string) smartSnapshot {
+	path, err := exec.LookPath("smartctl")
+	if err != nil {
+		return smartSnapshot{Error: "smartctl is not installed"}
+	}
+
+	// smartctl sets bits of the exit status for disk problems too, so the
+	// output is parsed whatever the status is
+	output, runErr := exec.Command(path, "--json", "-a", device).Output()
+	var parsed smartctlOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		if runErr != nil {
+			return smartSnapshot{Error: fmt.Sprintf("smartctl: %v", runErr)}
+		}
+		return smartSnapshot{Error: fmt.Sprintf("parsing smartctl output: %v", err)}
+	}
+
+	if parsed.SmartStatus == nil && parsed.NVMeHealth == nil && len(parsed.ATASmartAttributes.Table) == 0 {
+		snapshot := smartSnapshot{Error: "no SMART data"}
+		for _, message := range parsed.Smartctl.Messages {
+			if message.Severity == "error" {
+				snapshot.Error = message.String
+				break
+			}
+		}
+		return snapshot
+	}
+
+	snapshot := smartSnapshot{
+		Available:    true,
+		Model:        parsed.ModelName,
+		Serial:       parsed.SerialNumber,
+		Firmware:     parsed.FirmwareVersion,
+		PowerOnHours: parsed.PowerOnTime.Hours,
+		Temperature:  parsed.Temperature.Current,
+	}
+	if parsed.SmartStatus != nil {
+		passed := parsed.SmartStatus.Passed
+		snapshot.Passed = &passed
+	}
+	for _, attribute := range parsed.ATASmartAttributes.Table {
+		switch attribute.ID {
+		case 5:
+			snapshot.ReallocatedSectors = attribute.Raw.Value
+		case 197:
+			snapshot.PendingSectors = attribute.Raw.Value
+		case 198:
+			snapshot.Uncorrectable = attribute.Raw.Value
+		}
+	}
+	if parsed.NVMeHealth != nil {
+		snapshot.MediaErrors = parsed.NVMeHealth.MediaErrors
+		snapshot.PercentageUsed = parsed.NVMeHealth.PercentageUsed
+	}
+	return snapshot
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// With --state-file long operations keep a JSON file up to date with their
+// progress, so wrappers and orchestrators can poll it instead of parsing the
+// terminal output.
+
+// stateFileInterval is how often progress is written to the state file
+const stateFileInterval = 2 * time.Second
+
+// maxStateErrors is how many error messages the state file keeps, the rest are counted
+const maxStateErrors = 100
+
+// operationState is the content of the state file
+type operationState struct {
+	PID         int       `json:"pid"`
+	Command     string    `json:"command"`
+	Args        []string  `json:"args"`
+	Status      string    `json:"status"` // running, paused, complete or failed
+	Phase       string    `json:"phase"`
+	BytesDone   int64     `json:"bytes_done"`
+	BytesTotal  int64     `json:"bytes_total"`
+	Percent     float64   `json:"percent"`
+	BytesPerSec float64   `json:"bytes_per_second"`
+	ETASeconds  float64   `json:"eta_seconds"`
+	Errors      []string  `json:"errors"`
+	ErrorCount  int       `json:"error_count"`
+	Warnings    []warning `json:"warnings"`
+	ExitStatus  *int      `json:"exit_status,omitempty"`
+	Started     time.Time `json:"started"`
+	Updated     time.Time `json:"updated"`
+}
+
+// stateFile is the progress sink of --state-file, it writes the operationState
+type stateFile struct {
+	path       string
+	mu         sync.Mutex
+	state      operationState
+	phaseStart time.Time
+	lastWrite  time.Time
+	finished   bool
+}
+
+// setupStateFile starts the state file of the command at path
+func setupStateFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	now := time.Now()
+	s := &stateFile{
+		path: path,
+		state: operationState{
+			PID:      os.Getpid(),
+			Command:  hookCommand(),
+			Args:     os.Args[1:],
+			Status:   "running",
+			Errors:   []string{},
+			Warnings: []warning{},
+			Started:  now,
+		},
+		phaseStart: now,
+	}
+	addProgressSink(s)
+	return s.write()
+}
+
+// write saves the state next to the file and renames it into place, so
+// readers never see a partial file. The caller holds mu unless setting up.
+func (s *stateFile) write() error {
+	s.state.Updated = time.Now()
+	s.lastWrite = s.state.Updated
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// writeOrWarn works out the rate of the phase, writes the state and reports
+// a failure without stopping the operation
+func (s *stateFile) writeOrWarn() {
+	done, total := s.state.BytesDone, s.state.BytesTotal
+	s.state.Percent, s.state.BytesPerSec, s.state.ETASeconds = 0, 0, 0
+	if total > 0 {
+		s.state.Percent = float64(done) * 100 / float64(total)
+	}
+	if elapsed := time.Since(s.phaseStart).Seconds(); elapsed > 0 && done > 0 {
+		s.state.BytesPerSec = float64(done) / elapsed
+		if total > done {
+			s.state.ETASeconds = float64(total-done) / s.state.BytesPerSec
+		}
+	}
+	if err := s.write(); err != nil {
+		fmt.Fprintf(os.Stderr, "%sWarning: writing the state file: %v%s\n", yellow, err, reset)
+	}
+}
+
+// progress writes how far the phase is every few seconds and whenever the
+// phase changes
+func (s *stateFile) progress(phase string, done, total int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := phase != s.state.Phase
+	if changed {
+		s.state.Phase, s.phaseStart = phase, time.Now()
+	}
+	s.state.BytesDone, s.state.BytesTotal = done, total
+	if !changed && time.Since(s.lastWrite) < stateFileInterval {
+		return
+	}
+
+	s.writeOrWarn()
+}
+
+// written is not part of the state
+func (s *stateFile) written(phase string, n int64) {}
+
+// message records an error the operation continued after, or that it is
+// paused or running again
+func (s *stateFile) message(event, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch event {
+	case "error":
+		s.state.ErrorCount++
+		if len(s.state.Errors) < maxStateErrors {
+			s.state.Errors = append(s.state.Errors, message)
+		}
+	case "paused":
+		s.state.Status = "paused"
+	case "resumed":
+		s.state.Status = "running"
+	}
+	s.writeOrWarn()
+}
+
+// warning records a warning of the operation
+func (s *stateFile) warning(w warning) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.state.Warnings) < maxStateErrors {
+		s.state.Warnings = append(s.state.Warnings, w)
+	}
+	s.writeOrWarn()
+}
+
+// finish records how the command ended, status is the exit status and err
+// why it failed. Only the first call counts.
+func (s *stateFile) finish(status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	s.state.Status = "complete"
+	if status != 0 || err != nil {
+		s.state.Status = "failed"
+	}
+	if err != nil {
+		s.state.ErrorCount++
+		if len(s.state.Errors) < maxStateErrors {
+			s.state.Errors = append(s.state.Errors, err.Error())
+		}
+	}
+	s.state.ExitStatus = &status
+	s.writeOrWarn()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The storage config is the curtin format that cloud-init, MAAS and
+// autoinstall use to describe disks. Everything is marked preserve, so the
+// provisioning consumes the layout dsktool built instead of recreating it.
+
+// curtinGPTFlags maps GPT type names to curtin partition flags
+var curtinGPTFlags = map[string]string{
+	"EFI System":         "boot",
+	"BIOS boot":          "bios_grub",
+	"Linux swap":         "swap",
+	"Linux LVM":          "lvm",
+	"Linux RAID":         "raid",
+	"Linux home":         "home",
+	"Microsoft reserved": "msftres",
+}
+
+// curtinMBRFlags maps MBR type bytes to curtin partition flags
+var curtinMBRFlags = map[uint8]string{
+	0x05: "extended",
+	0x0f: "extended",
+	0x82: "swap",
+	0x8e: "lvm",
+	0xfd: "raid",
+	0xef: "boot",
+}
+
+// curtinFSType returns the curtin fstype of the filesystem in a partition,
+// empty if it is unknown or has none
+func curtinFSType(r io.ReaderAt, offset, size int64) (string, string) {
+	if fsys, err := openFileSystem(io.NewSectionReader(r, offset, size), size); err == nil {
+		fsType := strings.ToLower(fsys.Type())
+		if strings.HasPrefix(fsType, "fat") {
+			fsType = "vfat"
+		}
+		return fsType, volumeLabel(fsys)
+	}
+	switch detectFileSystem(r, offset) {
+	case "Swap (Linux)":
+		return "swap", ""
+	case "XFS":
+		return "xfs", ""
+	case "Btrfs":
+		return "btrfs", ""
+	}
+	return "", ""
+}
+
+// curtinID turns a name into an id usable in the storage config
+func curtinID(parts ...string) string {
+	id := strings.Join(parts, "-")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, id)
+}
+
+// storageConfig describes the partitions and filesystems of a device as a
+// curtin storage config
+func storageConfig(device string) (string, error) {
+	image, err := openImage(device, false)
+	if err != nil {
+		return "", err
+	}
+	defer image.Close()
+	table, err := readPartitionTable(image, image.SectorSize)
+	if err != nil {
+		return "", err
+	}
+	if table.Type != "GPT" && table.Type != "MBR" {
+		return "", fmt.Errorf("the storage config has no %s partition tables", table.Type)
+	}
+
+	name := filepath.Base(device)
+	diskID := curtinID("disk", name)
+	var b strings.Builder
+	item := func(fields ...string) {
+		for i := 0; i+1 < len(fields); i += 2 {
+			prefix := "    "
+			if i == 0 {
+				prefix = "  - "
+			}
+			fmt.Fprintf(&b, "%s%s: %s\n", prefix, fields[i], fields[i+1])
+		}
+	}
+
+	fmt.Fprintf(&b, "# Storage config for %s, written by dsktool %s\n", device, appversion)
+	b.WriteString("storage:\n  version: 1\n  config:\n")
+	ptable := "gpt"
+	if table.Type == "MBR" {
+		ptable = "msdos"
+	}
+	disk := []string{"id", diskID, "type", "disk", "ptable", ptable, "path", strconv.Quote(device), "name", strconv.Quote(name), "preserve", "true"}
+	if serial := diskSerial(device); serial != "" {
+		disk = append(disk, "serial", strconv.Quote(serial))
+	}
+	item(disk...)
+
+	for _, part := range table.Partitions {
+		partID := curtinID(name, "part"+strconv.Itoa(part.Number))
+		fields := []string{"id", partID, "type", "partition", "device", diskID,
+			"number", strconv.Itoa(part.Number),
+			"offset", strconv.FormatInt(part.Offset(table.SectorSize), 10),
+			"size", strconv.FormatInt(part.Size(table.SectorSize), 10),
+		}
+		switch {
+		case part.GPT != nil:
+			if flag := curtinGPTFlags[partitionTypeName(part)]; flag != "" {
+				fields = append(fields, "flag", flag)
+			}
+			fields = append(fields, "partition_type", strings.ToLower(formatGUID(part.GPT.TypeGUID)))
+		case part.MBR != nil:
+			if flag := curtinMBRFlags[part.MBR.Type]; flag != "" {
+				fields = append(fields, "flag", flag)
+			} else if part.MBR.Status == 0x80 {
+				fields = append(fields, "flag", "boot")
+			}
+			fields = append(fields, "partition_type", fmt.Sprintf("\"0x%02x\"", part.MBR.Type))
+		}
+		item(append(fields, "preserve", "true")...)
+
+		fsType, label := curtinFSType(image, part.Offset(table.SectorSize), part.Size(table.SectorSize))
+		if fsType == "" {
+			continue
+		}
+		format := []string{"id", partID + "-format", "type", "format", "volume", partID, "fstype", fsType}
+		if label != "" {
+			format = append(format, "label", strconv.Quote(label))
+		}
+		item(append(format, "preserve", "true")...)
+	}
+	return b.String(), nil
+}
+
+// writeStorageConfig writes the storage config of a device to file, or to
+// stdout if file is empty or -
+func writeStorageConfig(device, file string) error {
+	config, err := storageConfig(device)
+	if err != nil {
+		return err
+	}
+	if file == "" || file == "-" {
+		fmt.Print(config)
+		return nil
+	}
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Storage config for %s written to %s\n", device, file)
+	return nil
+}
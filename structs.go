@@ -3,6 +3,9 @@ package main
 var (
 	sectorSize uint64
 	appversion = "0.4.31"
+
+	// dryRun makes destructive commands report what they would write instead of writing
+	dryRun bool
 )
 
 const (
@@ -11,6 +14,12 @@ const (
 	gb = 1 << 30
 	tb = 1 << 40
 	pb = 1 << 50
+
+	red    = "\033[31m"
+	green  = "\033[32m"
+	yellow = "\033[33m"
+	blink  = "\033[5m"
+	reset  = "\033[0m"
 )
 
 // DataSizeNumber is a type constraint that allows any signed or unsigned integer type.
@@ -35,3 +44,50 @@ var units = []Unit{
 	{"KB", kb},
 	{"bytes", 1},
 }
+
+type gptHeader struct {
+	Signature           [8]byte
+	Revision            [4]byte
+	HeaderSize          uint32
+	CRC32               uint32
+	_                   [4]byte
+	CurrentLBA          uint64
+	BackupLBA           uint64
+	FirstUsableLBA      uint64
+	LastUsableLBA       uint64
+	DiskGUID            [16]byte
+	PartitionEntryLBA   uint64
+	NumPartEntries      uint32
+	PartEntrySize       uint32
+	PartEntryArrayCRC32 uint32
+}
+
+type gptPartition struct {
+	TypeGUID       [16]byte
+	UniqueGUID     [16]byte
+	FirstLBA       uint64
+	LastLBA        uint64
+	AttributeFlags uint64
+	PartitionName  [72]byte
+}
+
+type mbrPartition struct {
+	Status      uint8
+	_           [3]byte
+	Type        uint8
+	_           [3]byte
+	FirstSector uint32
+	Sectors     uint32
+}
+
+type mbrStruct struct {
+	_          [446]byte
+	Partitions [4]mbrPartition
+	Signature  uint16
+}
+
+type fileSystemStruct struct {
+	Name      string
+	Signature []byte
+	Offset    int64
+}
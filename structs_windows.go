@@ -8,6 +8,15 @@ const (
 	IOCTL_DISK_GET_DRIVE_GEOMETRY_EX     = 0x000700A0
 	IOCTL_DISK_GET_DRIVE_LAYOUT_EX       = 0x00070050
 	IOCTL_VOLUME_GET_VOLUME_DISK_EXTENTS = 0x00560000
+	IOCTL_DISK_UPDATE_PROPERTIES         = 0x00070140
+	IOCTL_DISK_PERFORMANCE               = 0x00070020
+	IOCTL_STORAGE_QUERY_PROPERTY         = 0x002D1400
+)
+
+// Properties asked for with IOCTL_STORAGE_QUERY_PROPERTY
+const (
+	StorageDeviceProperty            = 0
+	StorageDeviceSeekPenaltyProperty = 7
 )
 
 type DiskGeometry struct {
@@ -39,3 +48,24 @@ type DriveLayoutInformationEx struct {
 	PartitionCount uint32
 	PartitionEntry [128]PartitionInformationEx
 }
+
+type DiskPerformance struct {
+	BytesRead           int64
+	BytesWritten        int64
+	ReadTime            int64
+	WriteTime           int64
+	IdleTime            int64
+	ReadCount           uint32
+	WriteCount          uint32
+	QueueDepth          uint32
+	SplitCount          uint32
+	QueryTime           int64
+	StorageDeviceNumber uint32
+	StorageManagerName  [8]uint16
+}
+
+type StoragePropertyQuery struct {
+	PropertyId           uint32
+	QueryType            uint32
+	AdditionalParameters [1]byte
+}
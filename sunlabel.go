@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The Sun VTOC of SPARC disks is a big endian label in sector 0 with eight
+// slices given in cylinders. Slice 2, the backup slice, covers the whole
+// disk by convention.
+
+const sunLabelMagic = 0xdabe
+
+// sunPartition is a slice of a Sun label with its VTOC tag
+type sunPartition struct {
+	Tag           uint16
+	Flags         uint16
+	StartCylinder uint32
+	Sectors       uint32
+}
+
+// sunTagNames are the names of the VTOC slice tags
+var sunTagNames = map[uint16]string{
+	0x00: "unassigned",
+	0x01: "boot",
+	0x02: "root",
+	0x03: "swap",
+	0x04: "usr",
+	0x05: "backup",
+	0x06: "stand",
+	0x07: "var",
+	0x08: "home",
+	0x09: "alternates",
+	0x0a: "reserved",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x8e: "Linux LVM",
+	0xfd: "Linux RAID",
+}
+
+// readSunLabel fills pt from a Sun label and reports whether there is one
+func readSunLabel(r io.ReaderAt, pt *partitionTable) bool {
+	block := make([]byte, 512)
+	if _, err := r.ReadAt(block, 0); err != nil {
+		return false
+	}
+	be := binary.BigEndian
+	if be.Uint16(block[508:]) != sunLabelMagic {
+		return false
+	}
+	// The 16 bit words of the label XOR to zero with the checksum
+	var sum uint16
+	for i := 0; i < 512; i += 2 {
+		sum ^= be.Uint16(block[i:])
+	}
+	if sum != 0 {
+		return false
+	}
+
+	tracks, sectors := uint64(be.Uint16(block[436:])), uint64(be.Uint16(block[438:]))
+	if tracks == 0 || sectors == 0 {
+		return false
+	}
+	pt.Type = "Sun"
+	pt.SectorSize = 512
+	for i := 0; i < 8; i++ {
+		part := sunPartition{
+			Tag:           be.Uint16(block[142+i*4:]),
+			Flags:         be.Uint16(block[144+i*4:]),
+			StartCylinder: be.Uint32(block[444+i*8:]),
+			Sectors:       be.Uint32(block[448+i*8:]),
+		}
+		if part.Sectors == 0 {
+			continue
+		}
+		first := uint64(part.StartCylinder) * tracks * sectors
+		pt.Partitions = append(pt.Partitions, partitionEntry{
+			Number:   i + 1,
+			FirstLBA: first,
+			LastLBA:  first + uint64(part.Sectors) - 1,
+			Sun:      &part,
+		})
+	}
+	return true
+}
+
+// sunTagName returns the name of a VTOC slice tag
+func sunTagName(tag uint16) string {
+	if name, ok := sunTagNames[tag]; ok {
+		return name
+	}
+	return fmt.Sprintf("tag 0x%02x", tag)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// GPT backups use the sgdisk --backup format, so they can be restored with
+// sgdisk --load-backup and the other way round: the MBR, the main and the
+// backup GPT header each in a 512 byte block, then the entry array. The LBAs
+// in the headers are in sectors of the disk. MBR tables are backed up with
+// their EBR chain, see mbrbackup.go.
+
+const sgdiskBlockSize = 512
+
+// backupPartitionTable saves the GPT, or the MBR and its EBRs, of a device or image to file
+func backupPartitionTable(device, file string) error {
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	table, err := readPartitionTable(image, image.SectorSize)
+	if err != nil {
+		return err
+	}
+	if table.Type == "MBR" {
+		return backupMBR(image, table, device, file)
+	}
+	if table.Type != "GPT" {
+		return fmt.Errorf("%s has an %s partition table, only GPT and MBR tables can be backed up", device, table.Type)
+	}
+	stored := *table.Header
+	sectorSize := int64(image.SectorSize)
+
+	mbr := make([]byte, sgdiskBlockSize)
+	if _, err := image.ReadAt(mbr, 0); err != nil {
+		return fmt.Errorf("reading MBR: %v", err)
+	}
+	// The entries are read where the header found them, from the backup
+	// GPT when the primary is damaged, and saved with a primary header
+	entries := make([]byte, int64(stored.NumPartEntries)*int64(stored.PartEntrySize))
+	if _, err := image.ReadAt(entries, int64(stored.PartitionEntryLBA)*sectorSize); err != nil {
+		return fmt.Errorf("reading partition entries: %v", err)
+	}
+	header := stored.asPrimary()
+	// Like sgdisk the CRCs are recomputed, so the backup loads without errors
+	header.PartEntryArrayCRC32 = crc32.ChecksumIEEE(entries)
+
+	// The backup header is taken from the disk if it is there, otherwise it
+	// is derived from the main one
+	backup := header
+	backup.CurrentLBA, backup.BackupLBA = header.BackupLBA, header.CurrentLBA
+	backup.PartitionEntryLBA = header.BackupLBA - (uint64(len(entries))+uint64(sectorSize)-1)/uint64(sectorSize)
+	var onDisk gptHeader
+	err = binary.Read(bytes.NewReader(readSector(image, int64(header.BackupLBA)*sectorSize)), binary.LittleEndian, &onDisk)
+	if err == nil && string(onDisk.Signature[:]) == "EFI PART" {
+		backup = onDisk
+		backup.PartEntryArrayCRC32 = header.PartEntryArrayCRC32
+	} else {
+		warnf(warnGPTBackupMissing, device, "no backup GPT header at LBA %d, saving one derived from the main header", header.BackupLBA)
+	}
+
+	out := bytes.NewBuffer(mbr)
+	for _, h := range []gptHeader{header, backup} {
+		block, err := encodeGPTHeader(h, sgdiskBlockSize)
+		if err != nil {
+			return err
+		}
+		out.Write(block)
+	}
+	out.Write(entries)
+
+	if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Saved the GPT of %s with %d partitions to %s\n", device, len(table.Partitions), file)
+	return nil
+}
+
+// readSector reads a block at offset, returning zeros if it can not be read
+func readSector(image *diskImage, offset int64) []byte {
+	block := make([]byte, sgdiskBlockSize)
+	if offset >= 0 && offset+sgdiskBlockSize <= image.Size {
+		image.ReadAt(block, offset)
+	}
+	return block
+}
+
+// loadPartitionTableBackup parses an sgdisk backup file, checking its CRCs
+func loadPartitionTableBackup(file string) (*partitionTable, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 3*sgdiskBlockSize {
+		return nil, fmt.Errorf("%s is too short for a partition table backup", file)
+	}
+
+	table := &partitionTable{Type: "GPT"}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &table.MBR); err != nil {
+		return nil, fmt.Errorf("reading MBR: %v", err)
+	}
+	var header gptHeader
+	if err := binary.Read(bytes.NewReader(data[sgdiskBlockSize:]), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("reading main header: %v", err)
+	}
+	if string(header.Signature[:]) != "EFI PART" {
+		return nil, fmt.Errorf("%s is not an sgdisk partition table backup, it has no GPT header", file)
+	}
+	if header.HeaderSize < 92 || header.HeaderSize > sgdiskBlockSize || header.PartEntrySize < 128 {
+		return nil, fmt.Errorf("%s has an invalid GPT header", file)
+	}
+	block := append([]byte(nil), data[sgdiskBlockSize:sgdiskBlockSize+header.HeaderSize]...)
+	binary.LittleEndian.PutUint32(block[16:], 0)
+	if crc32.ChecksumIEEE(block) != header.CRC32 {
+		return nil, fmt.Errorf("the GPT header in %s has a bad CRC, the file is damaged", file)
+	}
+
+	entries := data[3*sgdiskBlockSize:]
+	size := int64(header.NumPartEntries) * int64(header.PartEntrySize)
+	if int64(len(entries)) < size {
+		return nil, fmt.Errorf("%s is truncated, it has %d of %d bytes of partition entries", file, len(entries), size)
+	}
+	if crc32.ChecksumIEEE(entries[:size]) != header.PartEntryArrayCRC32 {
+		return nil, fmt.Errorf("the partition entries in %s have a bad CRC, the file is damaged", file)
+	}
+
+	// readGPTEntries reads the entries by LBA, which is 0 in the stripped array
+	table.Header = &header
+	placed := header
+	placed.PartitionEntryLBA = 0
+	table.Partitions, err = readGPTEntries(bytes.NewReader(entries[:size]), &placed, 1)
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// restorePartitionTable writes the GPT, or the MBR and its EBRs, from a
+// backup file to a device or image
+func restorePartitionTable(file, device string, assumeYes bool) error {
+	if data, err := os.ReadFile(file); err == nil && isMBRBackup(data) {
+		return restoreMBR(file, data, device, assumeYes)
+	}
+	table, err := loadPartitionTableBackup(file)
+	if err != nil {
+		return err
+	}
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	table.SectorSize = image.SectorSize
+	image.Close()
+
+	return commitPartitionTable(device, table, "restore partition table", assumeYes)
+}
+
+// repairPartitionTable rewrites both copies of a GPT from the intact one,
+// after the primary or the backup header or entries were damaged
+func repairPartitionTable(device string, assumeYes bool) error {
+	writer, err := openDeviceWriter(device, "repair partition table")
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	table, err := writer.partitionTable()
+	if err != nil {
+		return err
+	}
+	if table.Type != "GPT" {
+		return fmt.Errorf("%s has an %s partition table, only GPT tables have a backup to repair from", device, table.Type)
+	}
+
+	if table.DeviceSectorSize != 0 {
+		return rewriteForSectorSize(writer, table, assumeYes)
+	}
+
+	damage := table.PrimaryDamage
+	source := "backup"
+	if damage == nil {
+		_, damage = readGPTHeader(writer.structure(), table.Header.BackupLBA, table.SectorSize)
+		source = "primary"
+	}
+	if damage == nil {
+		fmt.Printf("Both GPT copies on %s are intact, nothing to repair\n", device)
+		return nil
+	}
+	fmt.Printf("%sDamaged: %v%s\n", yellow, damage, reset)
+	fmt.Printf("Rewriting both GPT copies with the %d partitions of the %s GPT\n", len(table.Partitions), source)
+
+	if !writer.DryRun && !assumeYes && !confirm(fmt.Sprintf("Repair the GPT of %s?", device)) {
+		return fmt.Errorf("aborted, nothing was written")
+	}
+	if err := writePartitionTable(writer, writer, writer.Size, table); err != nil {
+		return err
+	}
+	if !writer.DryRun {
+		fmt.Printf("Partition table of %s repaired\n", device)
+		rereadPartitionTableOrWarn(writer.File, writer.Path)
+	}
+	return nil
+}
+
+// rewriteForSectorSize rewrites a GPT written for another sector size in the
+// sectors of the device. The partitions keep their byte offsets, so they
+// must be aligned to the larger of the two sector sizes.
+func rewriteForSectorSize(writer *deviceWriter, table *partitionTable, assumeYes bool) error {
+	oldSize, newSize := table.SectorSize, table.DeviceSectorSize
+	converted, err := newPartitionTable("GPT", newSize, uint64(writer.Size)/newSize)
+	if err != nil {
+		return err
+	}
+	converted.MBR = table.MBR
+	converted.Header.DiskGUID = table.Header.DiskGUID
+
+	fmt.Printf("Rewriting the GPT of %s from %d to %d byte sectors:\n", writer.Path, oldSize, newSize)
+	for _, part := range table.Partitions {
+		start, end := part.FirstLBA*oldSize, (part.LastLBA+1)*oldSize
+		if start%newSize != 0 || end%newSize != 0 {
+			return fmt.Errorf("partition %d (bytes %d-%d) is not aligned to %d byte sectors, it can not be converted", part.Number, start, end-1, newSize)
+		}
+		part.FirstLBA, part.LastLBA = start/newSize, end/newSize-1
+		converted.Partitions = append(converted.Partitions, part)
+		fmt.Printf("  %d: LBA %d-%d\n", part.Number, part.FirstLBA, part.LastLBA)
+	}
+
+	if !writer.DryRun && !assumeYes && !confirm(fmt.Sprintf("Rewrite the GPT of %s?", writer.Path)) {
+		return fmt.Errorf("aborted, nothing was written")
+	}
+	// The old headers would be found again by the sector size detection
+	for _, offset := range []int64{int64(oldSize), writer.Size - int64(oldSize)} {
+		if _, err := writer.WriteAt(make([]byte, 512), offset); err != nil {
+			return err
+		}
+	}
+	if err := writePartitionTable(writer, writer, writer.Size, converted); err != nil {
+		return err
+	}
+	if !writer.DryRun {
+		fmt.Printf("GPT of %s rewritten for %d byte sectors\n", writer.Path, newSize)
+		rereadPartitionTableOrWarn(writer.File, writer.Path)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A baseline is the partition list saved with dsktool p DEVICE --format json.
+// table diff compares a disk with it, so fleets of kiosks and appliances
+// notice when a partition table was changed.
+
+// baselineFields are the fields compared, the device and partition paths
+// may differ when the disk shows up under another name
+var baselineFields = []string{
+	"table", "start_lba", "end_lba", "sectors", "size_bytes", "type", "type_id", "name", "unique_guid", "filesystem",
+}
+
+// baselineRecord is a partition of a baseline or of the disk by field
+type baselineRecord map[string]string
+
+// key identifies a partition independent of the disk name, 1 for /dev/sda1,
+// p1 for /dev/nvme0n1p1 and :1 for image.img:1
+func (r baselineRecord) key() string {
+	return strings.TrimPrefix(r["partition"], r["device"])
+}
+
+// loadPartitionBaseline reads a baseline, the numbers and nulls of the JSON
+// records become the strings of the text records
+func loadPartitionBaseline(file string) ([]baselineRecord, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw []map[string]any
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s is no partition list saved with dsktool p DEVICE --format json: %v", file, err)
+	}
+	var records []baselineRecord
+	for _, fields := range raw {
+		record := baselineRecord{}
+		for name, value := range fields {
+			if value != nil {
+				record[name] = fmt.Sprint(value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// diffPartitionBaseline lists how the partitions of a device differ from a baseline
+func diffPartitionBaseline(device, file string) ([]string, error) {
+	baseline, err := loadPartitionBaseline(file)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := partitionRecords(device)
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]baselineRecord{}
+	var order []string
+	for _, row := range rows {
+		record := baselineRecord{}
+		for i, header := range partitionRecordHeaders {
+			record[header] = row[i]
+		}
+		live[record.key()] = record
+		order = append(order, record.key())
+	}
+
+	describe := func(r baselineRecord) string {
+		return fmt.Sprintf("LBA %s-%s, %s, %s", r["start_lba"], r["end_lba"], r["type"], r["unique_guid"])
+	}
+	var changes []string
+	seen := map[string]bool{}
+	for _, old := range baseline {
+		key := old.key()
+		seen[key] = true
+		now, ok := live[key]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("partition %s was removed, it was %s", old["partition"], describe(old)))
+			continue
+		}
+		for _, field := range baselineFields {
+			if old[field] != now[field] {
+				changes = append(changes, fmt.Sprintf("partition %s: %s %q -> %q", now["partition"], field, old[field], now[field]))
+			}
+		}
+	}
+	for _, key := range order {
+		if !seen[key] {
+			changes = append(changes, fmt.Sprintf("partition %s was added, %s", live[key]["partition"], describe(live[key])))
+		}
+	}
+	return changes, nil
+}
+
+// showPartitionBaselineDiff reports the differences from a baseline, any
+// difference makes dsktool exit with status 1
+func showPartitionBaselineDiff(device, file string) error {
+	changes, err := diffPartitionBaseline(device, file)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%sThe partitions of %s match %s%s\n", green, device, file, reset)
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Printf("%s%s%s\n", red, change, reset)
+	}
+	reportFailure(fmt.Sprintf("%d differences between %s and %s", len(changes), device, file))
+	return nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// clone returns a deep copy of the table so it can be edited while the original is kept for diffing
+func (pt *partitionTable) clone() *partitionTable {
+	c := *pt
+	if pt.Header != nil {
+		header := *pt.Header
+		c.Header = &header
+	}
+	c.Partitions = make([]partitionEntry, len(pt.Partitions))
+	for i, part := range pt.Partitions {
+		if part.GPT != nil {
+			gpt := *part.GPT
+			part.GPT = &gpt
+		}
+		if part.MBR != nil {
+			mbr := *part.MBR
+			part.MBR = &mbr
+		}
+		if part.APM != nil {
+			apm := *part.APM
+			part.APM = &apm
+		}
+		if part.BSD != nil {
+			bsd := *part.BSD
+			part.BSD = &bsd
+		}
+		if part.Sun != nil {
+			sun := *part.Sun
+			part.Sun = &sun
+		}
+		if part.SGI != nil {
+			sgi := *part.SGI
+			part.SGI = &sgi
+		}
+		c.Partitions[i] = part
+	}
+	return &c
+}
+
+// encodeGPTName converts a partition name into the UTF-16LE on-disk field
+func encodeGPTName(name string) ([72]byte, error) {
+	var raw [72]byte
+	u := utf16.Encode([]rune(name))
+	if len(u) > 36 {
+		return raw, fmt.Errorf("partition name %q is longer than 36 UTF-16 characters", name)
+	}
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(raw[i*2:], c)
+	}
+	return raw, nil
+}
+
+// writePartitionTable writes the table to w. For GPT both the primary and the
+// backup header and entry arrays are written with fresh CRCs.
+func writePartitionTable(w io.WriterAt, r io.ReaderAt, size int64, pt *partitionTable) error {
+	if err := pt.checkWritable(); err != nil {
+		return err
+	}
+	switch pt.Type {
+	case "GPT":
+		return writeGPT(w, r, size, pt)
+	case "MBR":
+		if err := clearGPTHeaders(w, r, size, int64(pt.SectorSize)); err != nil {
+			return err
+		}
+		return writeMBR(w, r, pt)
+	}
+	return fmt.Errorf("unsupported partition table type %q", pt.Type)
+}
+
+// clearGPTHeaders zeroes the GPT headers left from an earlier table, which
+// would otherwise take precedence over a new MBR
+func clearGPTHeaders(w io.WriterAt, r io.ReaderAt, size, sectorSize int64) error {
+	sector := make([]byte, sectorSize)
+	for _, offset := range []int64{sectorSize, size - sectorSize} {
+		if _, err := r.ReadAt(sector, offset); err != nil || string(sector[:8]) != "EFI PART" {
+			continue
+		}
+		if _, err := w.WriteAt(make([]byte, sectorSize), offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMBR updates the four primary entries, keeping the boot code and disk signature
+func writeMBR(w io.WriterAt, r io.ReaderAt, pt *partitionTable) error {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return fmt.Errorf("reading MBR: %v", err)
+	}
+
+	entries := pt.MBR.Partitions
+	for _, part := range pt.Partitions {
+		if part.Number < 1 || part.Number > 4 {
+			return fmt.Errorf("MBR partition number %d out of range, only primary partitions are supported", part.Number)
+		}
+		if part.LastLBA > 0xffffffff {
+			return fmt.Errorf("partition %d ends beyond the 2 TiB MBR limit", part.Number)
+		}
+		entry := mbrPartition{}
+		if part.MBR != nil {
+			entry = *part.MBR
+		}
+		entry.FirstSector = uint32(part.FirstLBA)
+		entry.Sectors = uint32(part.Sectors())
+		entries[part.Number-1] = entry
+	}
+	// Slots no longer present in the table are cleared
+	for i := range entries {
+		if _, err := pt.findPartition(i + 1); err != nil {
+			entries[i] = mbrPartition{}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, entries)
+	raw := buf.Bytes()
+	for i := range entries {
+		// CHS addressing is meaningless on modern disks, mark the entries as LBA only
+		if entries[i].Sectors != 0 {
+			copy(raw[i*16+1:], []byte{0xfe, 0xff, 0xff})
+			copy(raw[i*16+5:], []byte{0xfe, 0xff, 0xff})
+		}
+	}
+	copy(sector[446:510], raw)
+	sector[510], sector[511] = 0x55, 0xaa
+	if pt.DiskSignature != 0 {
+		binary.LittleEndian.PutUint32(sector[440:], pt.DiskSignature)
+	}
+
+	_, err := w.WriteAt(sector, 0)
+	return err
+}
+
+func writeGPT(w io.WriterAt, r io.ReaderAt, size int64, pt *partitionTable) error {
+	if pt.Header == nil {
+		return fmt.Errorf("GPT table without a header")
+	}
+	sectorSize := int64(pt.SectorSize)
+	header := *pt.Header
+	if header.PartEntrySize < 128 || header.NumPartEntries == 0 {
+		return fmt.Errorf("invalid GPT entry layout %dx%d", header.NumPartEntries, header.PartEntrySize)
+	}
+
+	entries := make([]byte, int64(header.NumPartEntries)*int64(header.PartEntrySize))
+	for _, part := range pt.Partitions {
+		if part.Number < 1 || part.Number > int(header.NumPartEntries) {
+			return fmt.Errorf("partition number %d out of range 1-%d", part.Number, header.NumPartEntries)
+		}
+		if part.FirstLBA < header.FirstUsableLBA || part.LastLBA > header.LastUsableLBA || part.LastLBA < part.FirstLBA {
+			return fmt.Errorf("partition %d (%d-%d) is outside the usable area %d-%d", part.Number, part.FirstLBA, part.LastLBA, header.FirstUsableLBA, header.LastUsableLBA)
+		}
+		entry := gptPartition{}
+		if part.GPT != nil {
+			entry = *part.GPT
+		}
+		entry.FirstLBA = part.FirstLBA
+		entry.LastLBA = part.LastLBA
+		name, err := encodeGPTName(part.Name)
+		if err != nil {
+			return err
+		}
+		entry.PartitionName = name
+
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, entry)
+		copy(entries[int64(part.Number-1)*int64(header.PartEntrySize):], buf.Bytes())
+	}
+
+	lastLBA := uint64(size/sectorSize) - 1
+	entrySectors := (uint64(len(entries)) + uint64(sectorSize) - 1) / uint64(sectorSize)
+	header.PartEntryArrayCRC32 = crc32.ChecksumIEEE(entries)
+	if header.HeaderSize < 92 {
+		header.HeaderSize = 92
+	}
+
+	primary := header.asPrimary()
+	primary.BackupLBA = lastLBA
+	if primary.PartitionEntryLBA < 2 {
+		primary.PartitionEntryLBA = 2
+	}
+
+	backup := header
+	backup.CurrentLBA = lastLBA
+	backup.BackupLBA = 1
+	backup.PartitionEntryLBA = lastLBA - entrySectors
+
+	if backup.PartitionEntryLBA <= header.LastUsableLBA || primary.PartitionEntryLBA+entrySectors > header.FirstUsableLBA {
+		return fmt.Errorf("GPT entry arrays overlap the usable area, the disk may have been resized")
+	}
+
+	if err := writePMBR(w, r, lastLBA); err != nil {
+		return err
+	}
+	for _, h := range []gptHeader{primary, backup} {
+		if _, err := w.WriteAt(entries, int64(h.PartitionEntryLBA)*sectorSize); err != nil {
+			return err
+		}
+		sector, err := encodeGPTHeader(h, sectorSize)
+		if err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(sector, int64(h.CurrentLBA)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeGPTHeader serialises a header into a full sector with its CRC filled in
+func encodeGPTHeader(h gptHeader, sectorSize int64) ([]byte, error) {
+	h.CRC32 = 0
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	sector := make([]byte, sectorSize)
+	copy(sector, buf.Bytes())
+	binary.LittleEndian.PutUint32(sector[16:], crc32.ChecksumIEEE(sector[:h.HeaderSize]))
+	return sector, nil
+}
+
+// writePMBR makes sure sector 0 holds a protective MBR covering the disk, keeping any boot code
+func writePMBR(w io.WriterAt, r io.ReaderAt, lastLBA uint64) error {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return fmt.Errorf("reading MBR: %v", err)
+	}
+
+	sectors := lastLBA
+	if sectors > 0xffffffff {
+		sectors = 0xffffffff
+	}
+	entry := mbrPartition{Type: 0xee, FirstSector: 1, Sectors: uint32(sectors)}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, entry)
+
+	// The CHS fields are not part of mbrPartition, fill in the conventional values
+	pmbr := buf.Bytes()
+	pmbr[1], pmbr[2], pmbr[3] = 0x00, 0x02, 0x00
+	pmbr[5], pmbr[6], pmbr[7] = 0xff, 0xff, 0xff
+
+	current := sector[446:462]
+	if bytes.Equal(current, pmbr) && sector[510] == 0x55 && sector[511] == 0xaa {
+		return nil
+	}
+
+	copy(sector[446:], pmbr)
+	for i := 462; i < 510; i++ {
+		sector[i] = 0
+	}
+	sector[510], sector[511] = 0x55, 0xaa
+	_, err := w.WriteAt(sector, 0)
+	return err
+}
+
+// partitionTypeName returns a friendly name for the partition type
+func partitionTypeName(part partitionEntry) string {
+	if part.GPT != nil {
+		guid := formatGUID(part.GPT.TypeGUID)
+		if name, ok := gptTypeNames[guid]; ok {
+			return name
+		}
+		return guid
+	}
+	if part.MBR != nil {
+		if name, ok := mbrTypeNames[part.MBR.Type]; ok {
+			return fmt.Sprintf("0x%02x %s", part.MBR.Type, name)
+		}
+		return fmt.Sprintf("0x%02x", part.MBR.Type)
+	}
+	if part.APM != nil {
+		return apmString(part.APM.Type[:])
+	}
+	if part.BSD != nil {
+		return bsdTypeName(part.BSD.FSType)
+	}
+	if part.Sun != nil {
+		return sunTagName(part.Sun.Tag)
+	}
+	if part.SGI != nil {
+		return sgiTypeName(part.SGI.Type)
+	}
+	return ""
+}
+
+var gptTypeNames = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI System",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+	"E3C9E316-0B5C-4DB8-817D-F92DF00215AE": "Microsoft reserved",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "Microsoft basic data",
+	"DE94BBA4-06D1-4D40-A16A-BFD50179D6AC": "Windows recovery",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": "Linux root (x86-64)",
+	"933AC7E1-2EB4-4F13-B844-0E14E2AEF915": "Linux home",
+	"BC13C2FF-59E6-4262-A352-B275FD6F7172": "Linux extended boot",
+	"48465300-0000-11AA-AA11-00306543ECAC": "Apple HFS+",
+	"7C3457EF-0000-11AA-AA11-00306543ECAC": "Apple APFS",
+	"516E7CB6-6ECF-11D6-8FF8-00022D09712B": "FreeBSD UFS",
+}
+
+var mbrTypeNames = map[uint8]string{
+	0x01: "FAT12",
+	0x05: "Extended",
+	0x06: "FAT16",
+	0x07: "NTFS/exFAT",
+	0x0b: "FAT32",
+	0x0c: "FAT32 LBA",
+	0x0e: "FAT16 LBA",
+	0x0f: "Extended LBA",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x8e: "Linux LVM",
+	0xa5: "FreeBSD",
+	0xa6: "OpenBSD",
+	0xa9: "NetBSD",
+	0xee: "GPT protective",
+	0xef: "EFI System",
+	0xfd: "Linux RAID",
+}
+
+// partitionFields returns the displayed fields of a partition in a stable order
+func partitionFields(part partitionEntry, sectorSize uint64) [][2]string {
+	fields := [][2]string{
+		{"start", fmt.Sprint(part.FirstLBA)},
+		{"end", fmt.Sprint(part.LastLBA)},
+		{"size", formatBytes(part.Size(sectorSize))},
+		{"type", partitionTypeName(part)},
+	}
+	if part.GPT != nil {
+		fields = append(fields,
+			[2]string{"name", fmt.Sprintf("%q", part.Name)},
+			[2]string{"guid", formatGUID(part.GPT.UniqueGUID)},
+			[2]string{"attrs", fmt.Sprintf("0x%x", part.GPT.AttributeFlags)})
+	}
+	if part.MBR != nil {
+		fields = append(fields, [2]string{"boot", fmt.Sprint(part.MBR.Status == 0x80)})
+	}
+	if part.APM != nil {
+		fields = append(fields, [2]string{"name", fmt.Sprintf("%q", part.Name)})
+	}
+	return fields
+}
+
+// diffPartitionTables renders the differences between two tables, one line per
+// changed partition, with changed fields highlighted. It is empty when nothing changed.
+func diffPartitionTables(old, new *partitionTable) []string {
+	var lines []string
+	if old.Type != new.Type {
+		lines = append(lines, fmt.Sprintf("%s~ table type %s -> %s%s", yellow, old.Type, new.Type, reset))
+	}
+	if old.Header != nil && new.Header != nil && old.Header.DiskGUID != new.Header.DiskGUID {
+		lines = append(lines, fmt.Sprintf("%s~ disk GUID %s -> %s%s", yellow, formatGUID(old.Header.DiskGUID), formatGUID(new.Header.DiskGUID), reset))
+	}
+
+	// Walk the union of slot numbers in order
+	numbers := map[int]bool{}
+	maxNumber := 0
+	for _, p := range append(append([]partitionEntry{}, old.Partitions...), new.Partitions...) {
+		numbers[p.Number] = true
+		if p.Number > maxNumber {
+			maxNumber = p.Number
+		}
+	}
+
+	for n := 1; n <= maxNumber; n++ {
+		if !numbers[n] {
+			continue
+		}
+		before, errBefore := old.findPartition(n)
+		after, errAfter := new.findPartition(n)
+
+		switch {
+		case errBefore != nil:
+			lines = append(lines, fmt.Sprintf("%s+ %-3d %s%s", green, n, joinFields(partitionFields(*after, new.SectorSize)), reset))
+		case errAfter != nil:
+			lines = append(lines, fmt.Sprintf("%s- %-3d %s%s", red, n, joinFields(partitionFields(*before, old.SectorSize)), reset))
+		default:
+			oldFields := partitionFields(*before, old.SectorSize)
+			newFields := partitionFields(*after, new.SectorSize)
+			changed := false
+			var parts []string
+			for i, field := range newFields {
+				if i < len(oldFields) && oldFields[i] == field {
+					parts = append(parts, field[0]+" "+field[1])
+					continue
+				}
+				changed = true
+				from := ""
+				if i < len(oldFields) {
+					from = oldFields[i][1]
+				}
+				parts = append(parts, fmt.Sprintf("%s%s %s -> %s%s", yellow, field[0], from, field[1], reset))
+			}
+			if changed {
+				lines = append(lines, fmt.Sprintf("~ %-3d %s", n, strings.Join(parts, "  ")))
+			}
+		}
+	}
+	return lines
+}
+
+func joinFields(fields [][2]string) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field[0] + " " + field[1]
+	}
+	return strings.Join(parts, "  ")
+}
+
+// confirm asks a yes/no question on the terminal, defaulting to no
+func confirm(prompt string) bool {
+	fmt.Fprintf(messageOutput(os.Stdout), "%s [y/N]: ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// commitPartitionTable shows the diff between the table on the device and the
+// new one, asks for confirmation unless assumeYes is set and writes it
+func commitPartitionTable(device string, table *partitionTable, operation string, assumeYes bool) error {
+	writer, err := openDeviceWriter(device, operation)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	// A missing or unreadable table diffs as empty, so everything shows as added
+	current, err := writer.partitionTable()
+	if err != nil {
+		current = &partitionTable{Type: "none", SectorSize: table.SectorSize}
+	}
+
+	diff := diffPartitionTables(current, table)
+	if len(diff) == 0 {
+		fmt.Printf("No partition table changes for %s\n", device)
+		return nil
+	}
+
+	fmt.Printf("Partition table changes for %s (%s):\n", device, table.Type)
+	for _, line := range diff {
+		fmt.Println("  " + line)
+	}
+
+	if !writer.DryRun && !assumeYes && !confirm(fmt.Sprintf("Write these changes to %s?", device)) {
+		return fmt.Errorf("aborted, nothing was written")
+	}
+
+	if err := writePartitionTable(writer, writer, writer.Size, table); err != nil {
+		return err
+	}
+	if !writer.DryRun {
+		fmt.Printf("Partition table written to %s\n", device)
+		rereadPartitionTableOrWarn(writer.File, writer.Path)
+	}
+	return nil
+}
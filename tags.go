@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const tagsFile = "tags.json"
+
+// diskTag holds the user notes attached to a disk
+type diskTag struct {
+	Device string   `json:"device,omitempty"` // last path the disk was seen at
+	Tags   []string `json:"tags,omitempty"`
+	Note   string   `json:"note,omitempty"`
+}
+
+// tagStore maps disk identities ("serial:..." or "gpt:...") to their tags
+type tagStore map[string]*diskTag
+
+func loadTags() (tagStore, error) {
+	store := tagStore{}
+	if err := loadConfigFile(tagsFile, &store); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", tagsFile, err)
+	}
+	return store, nil
+}
+
+func (s tagStore) save() error {
+	return saveConfigFile(tagsFile, s)
+}
+
+// diskKeys returns the identities of a device, most stable first
+func diskKeys(device string) []string {
+	var keys []string
+	if serial := diskSerial(device); serial != "" {
+		keys = append(keys, "serial:"+serial)
+	}
+
+	file, err := os.Open(device)
+	if err != nil {
+		return keys
+	}
+	defer file.Close()
+
+	if table, err := readPartitionTable(file, uint64(getSectorSize(file))); err == nil && table.Header != nil {
+		keys = append(keys, "gpt:"+formatGUID(table.Header.DiskGUID))
+	}
+	return keys
+}
+
+// lookup finds the tags of a device by any of its identities
+func (s tagStore) lookup(device string) (string, *diskTag) {
+	keys := diskKeys(device)
+	for _, key := range keys {
+		if tag, ok := s[key]; ok {
+			return key, tag
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil
+	}
+	return keys[0], nil
+}
+
+// describe formats the tags of a device for disk listings, empty if it has none
+func (s tagStore) describe(device string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	_, tag := s.lookup(device)
+	if tag == nil {
+		return ""
+	}
+
+	var parts []string
+	if len(tag.Tags) > 0 {
+		parts = append(parts, "["+strings.Join(tag.Tags, ", ")+"]")
+	}
+	if tag.Note != "" {
+		parts = append(parts, tag.Note)
+	}
+	return strings.Join(parts, " ")
+}
+
+func addDiskTags(device string, tags []string, note string) error {
+	store, err := loadTags()
+	if err != nil {
+		return err
+	}
+
+	key, tag := store.lookup(device)
+	if key == "" {
+		return fmt.Errorf("%s has no serial number or GPT disk GUID to attach tags to", device)
+	}
+	if tag == nil {
+		tag = &diskTag{}
+		store[key] = tag
+	}
+
+	tag.Device = device
+	for _, t := range tags {
+		if !containsString(tag.Tags, t) {
+			tag.Tags = append(tag.Tags, t)
+		}
+	}
+	if note != "" {
+		tag.Note = note
+	}
+
+	if err := store.save(); err != nil {
+		return err
+	}
+	fmt.Printf("%s (%s): %s\n", device, key, store.describe(device))
+	return nil
+}
+
+// removeDiskTags removes the given tags, or everything when none are given
+func removeDiskTags(device string, tags []string) error {
+	store, err := loadTags()
+	if err != nil {
+		return err
+	}
+
+	key, tag := store.lookup(device)
+	if tag == nil {
+		return fmt.Errorf("%s has no tags", device)
+	}
+
+	if len(tags) == 0 {
+		delete(store, key)
+	} else {
+		var kept []string
+		for _, t := range tag.Tags {
+			if !containsString(tags, t) {
+				kept = append(kept, t)
+			}
+		}
+		tag.Tags = kept
+		if len(tag.Tags) == 0 && tag.Note == "" {
+			delete(store, key)
+		}
+	}
+
+	return store.save()
+}
+
+func listDiskTags() error {
+	store, err := loadTags()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(store))
+	for key := range store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENTITY\tLAST SEEN\tTAGS\tNOTE")
+	for _, key := range keys {
+		tag := store[key]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key, tag.Device, strings.Join(tag.Tags, ", "), tag.Note)
+	}
+	return w.Flush()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
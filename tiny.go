@@ -0,0 +1,19 @@
+//go:build tiny
+
+package main
+
+import "fmt"
+
+// The tiny build leaves out the TUI and FUSE so the binary stays small
+// enough for initramfs and PXE rescue images. Their commands stay in place
+// and explain what is missing.
+
+// tuiAvailable reports whether this build has the TUI
+const tuiAvailable = false
+
+// errTinyBuild is returned by the commands that are not part of the tiny build
+var errTinyBuild = fmt.Errorf("not available in the tiny build, use the full dsktool binary")
+
+func runTUI(devices []string, pick string) (string, error) {
+	return "", fmt.Errorf("the TUI is %v", errTinyBuild)
+}
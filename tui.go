@@ -0,0 +1,546 @@
+//go:build !tiny
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// tuiAvailable reports whether this build has the TUI
+const tuiAvailable = true
+
+// tuiDisk is a disk shown in the TUI together with its parsed partition table
+type tuiDisk struct {
+	Path      string
+	Size      int64
+	Tags      string
+	Image     bool // a regular file, partitions are addressed as IMAGE:N
+	Inventory diskInventory
+	Table     *partitionTable
+	Rows      []tuiPartRow
+	Err       error
+}
+
+// tuiPartRow is a line of the partition pane, either a partition or a free gap
+type tuiPartRow struct {
+	Part   *partitionEntry // nil for free space
+	First  uint64
+	Last   uint64
+	FSType string
+	Label  string
+}
+
+const (
+	tuiFocusDisks = iota
+	tuiFocusPartitions
+)
+
+type tuiApp struct {
+	screen    tcell.Screen
+	devices   []string // explicit devices or images, discovered when empty
+	disks     []*tuiDisk
+	diskIndex int
+	partIndex int
+	focus     int
+	pick      string
+	selected  string
+	status    string
+	quit      bool
+
+	logEntries []tuiLogEntry
+	logVisible bool
+
+	form *tuiForm // open dialog, it gets all keys
+}
+
+// runTUI runs the interactive interface. In pick mode it returns the selected
+// disk or partition path, empty if the user cancelled.
+func runTUI(devices []string, pick string) (string, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return "", err
+	}
+	if err := screen.Init(); err != nil {
+		return "", err
+	}
+	defer screen.Fini()
+
+	app := &tuiApp{screen: screen, devices: devices, pick: pick}
+	defer addProgressSink(&tuiProgress{a: app})()
+	app.reload()
+	if pick == tuiPickPartition {
+		app.focus = tuiFocusPartitions
+	}
+
+	for !app.quit {
+		app.draw()
+		app.handle(screen.PollEvent())
+	}
+	return app.selected, nil
+}
+
+// loadTUIDisk reads the size, tags and partitions of a disk
+func loadTUIDisk(path string, tags tagStore) *tuiDisk {
+	disk := &tuiDisk{Path: path, Tags: tags.describe(path)}
+
+	image, err := openImage(path, false)
+	if err != nil {
+		disk.Err = err
+		return disk
+	}
+	defer image.Close()
+
+	disk.Size = image.Size
+	if info, err := image.Stat(); err == nil && info.Mode().IsRegular() {
+		disk.Image = true
+	} else {
+		disk.Inventory = readDiskInventory(path)
+	}
+
+	// A hung disk fails the reads instead of freezing the TUI
+	structure := newTimeoutReaderAt(image.structure(), path)
+	disk.Table, disk.Err = readPartitionTable(structure, image.SectorSize)
+	if disk.Err != nil {
+		return disk
+	}
+
+	diskSectors := uint64(image.Size) / disk.Table.SectorSize
+	var rows []tuiPartRow
+	for i := range disk.Table.Partitions {
+		part := &disk.Table.Partitions[i]
+		row := tuiPartRow{Part: part, First: part.FirstLBA, Last: part.LastLBA}
+		section := io.NewSectionReader(structure, part.Offset(disk.Table.SectorSize), part.Size(disk.Table.SectorSize))
+		if fsys, err := openFileSystem(section, section.Size()); err == nil {
+			row.FSType, row.Label = fsys.Type(), volumeLabel(fsys)
+		} else {
+			row.FSType = identifyFileSystem(structure, part.Offset(disk.Table.SectorSize), part.Size(disk.Table.SectorSize))
+		}
+		rows = append(rows, row)
+	}
+
+	// Show gaps of at least 1 MiB, smaller ones are alignment padding
+	for _, region := range disk.Table.freeRegions(diskSectors) {
+		if region.Sectors()*disk.Table.SectorSize >= mb {
+			rows = append(rows, tuiPartRow{First: region.First, Last: region.Last})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].First < rows[j].First })
+	disk.Rows = rows
+	return disk
+}
+
+// reload rescans the disks, keeping the selection where possible
+func (a *tuiApp) reload() {
+	paths := a.devices
+	if len(paths) == 0 {
+		var err error
+		paths, err = discoverDisks()
+		if err != nil {
+			a.fail("Error listing disks: %v", err)
+		}
+	}
+
+	tags, _ := loadTags()
+	disks, errs := probeParallel(paths, func(path string) *tuiDisk {
+		return loadTUIDisk(path, tags)
+	})
+	a.disks = nil
+	for i, path := range paths {
+		disk := disks[i]
+		if errs[i] != nil {
+			disk = &tuiDisk{Path: path, Err: errs[i]}
+		}
+		if disk.Err != nil {
+			a.logf(tuiLogError, "Reading %s: %v", path, disk.Err)
+		} else {
+			a.logf(tuiLogRead, "Read %s table of %s (%s, %d partitions)", disk.Table.Type, path, formatBytes(disk.Size), len(disk.Table.Partitions))
+			for _, w := range disk.Table.warnings(path) {
+				a.logf(tuiLogError, "Warning: %s", w.Message)
+			}
+		}
+		a.disks = append(a.disks, disk)
+	}
+	a.diskIndex = clamp(a.diskIndex, 0, len(a.disks)-1)
+	a.partIndex = clamp(a.partIndex, 0, len(a.partRows())-1)
+}
+
+func clamp(v, low, high int) int {
+	if v > high {
+		v = high
+	}
+	if v < low {
+		v = low
+	}
+	return v
+}
+
+func (a *tuiApp) currentDisk() *tuiDisk {
+	if a.diskIndex < 0 || a.diskIndex >= len(a.disks) {
+		return nil
+	}
+	return a.disks[a.diskIndex]
+}
+
+func (a *tuiApp) partRows() []tuiPartRow {
+	if disk := a.currentDisk(); disk != nil {
+		return disk.Rows
+	}
+	return nil
+}
+
+func (a *tuiApp) currentRow() *tuiPartRow {
+	rows := a.partRows()
+	if a.partIndex < 0 || a.partIndex >= len(rows) {
+		return nil
+	}
+	return &rows[a.partIndex]
+}
+
+// partitionPath returns the path a partition is addressed by
+func (d *tuiDisk) partitionPath(number int) string {
+	if d.Image {
+		return fmt.Sprintf("%s:%d", d.Path, number)
+	}
+	return partitionDevicePath(d.Path, number)
+}
+
+func (a *tuiApp) handle(ev tcell.Event) {
+	switch ev := ev.(type) {
+	case *tcell.EventResize:
+		a.screen.Sync()
+
+	case *tcell.EventKey:
+		a.status = ""
+		if a.form != nil {
+			// Submitting a form may open the next one, keep that open
+			form := a.form
+			if form.handle(ev) && a.form == form {
+				a.form = nil
+			}
+			return
+		}
+		switch ev.Key() {
+		case tcell.KeyEscape, tcell.KeyCtrlC:
+			a.quit = true
+		case tcell.KeyUp:
+			a.move(-1)
+		case tcell.KeyDown:
+			a.move(1)
+		case tcell.KeyPgUp:
+			a.move(-10)
+		case tcell.KeyPgDn:
+			a.move(10)
+		case tcell.KeyTab, tcell.KeyRight, tcell.KeyLeft, tcell.KeyBacktab:
+			a.switchFocus()
+		case tcell.KeyEnter:
+			a.enter()
+		case tcell.KeyRune:
+			switch ev.Rune() {
+			case 'q':
+				a.quit = true
+			case 'k':
+				a.move(-1)
+			case 'j':
+				a.move(1)
+			case 'r':
+				a.logf(tuiLogInfo, "Reload requested")
+				a.reload()
+				a.status = "Reloaded"
+			case 'l':
+				a.logVisible = !a.logVisible
+			case 'e':
+				a.exportLog()
+			case 'n':
+				if a.pick == "" {
+					a.openCreateForm()
+				}
+			case 'd':
+				if a.pick == "" {
+					a.openDeleteConfirm()
+				}
+			}
+		}
+	}
+}
+
+func (a *tuiApp) move(delta int) {
+	if a.focus == tuiFocusDisks {
+		a.diskIndex = clamp(a.diskIndex+delta, 0, len(a.disks)-1)
+		a.partIndex = 0
+		return
+	}
+	a.partIndex = clamp(a.partIndex+delta, 0, len(a.partRows())-1)
+}
+
+func (a *tuiApp) switchFocus() {
+	// Picking a disk never needs the partition pane
+	if a.pick == tuiPickDisk {
+		return
+	}
+	if a.focus == tuiFocusDisks {
+		a.focus = tuiFocusPartitions
+		a.partIndex = clamp(a.partIndex, 0, len(a.partRows())-1)
+	} else {
+		a.focus = tuiFocusDisks
+	}
+}
+
+func (a *tuiApp) enter() {
+	disk := a.currentDisk()
+	if disk == nil {
+		return
+	}
+
+	switch a.pick {
+	case tuiPickDisk:
+		a.selected = disk.Path
+		a.logf(tuiLogInfo, "Picked %s", a.selected)
+		a.quit = true
+	case tuiPickPartition:
+		if a.focus == tuiFocusDisks {
+			a.switchFocus()
+			return
+		}
+		row := a.currentRow()
+		if row == nil || row.Part == nil {
+			a.status = "Select a partition, not free space"
+			return
+		}
+		a.selected = disk.partitionPath(row.Part.Number)
+		a.logf(tuiLogInfo, "Picked %s", a.selected)
+		a.quit = true
+	default:
+		if a.focus == tuiFocusDisks {
+			a.switchFocus()
+		}
+	}
+}
+
+var (
+	tuiStyleDefault  = tcell.StyleDefault
+	tuiStyleTitle    = tcell.StyleDefault.Reverse(true).Bold(true)
+	tuiStyleBorder   = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	tuiStyleFocus    = tcell.StyleDefault.Foreground(tcell.ColorWhite).Bold(true)
+	tuiStyleSelected = tcell.StyleDefault.Reverse(true)
+	tuiStyleDim      = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	tuiStyleTags     = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	tuiStyleError    = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
+func (a *tuiApp) draw() {
+	s := a.screen
+	s.Clear()
+	width, height := s.Size()
+
+	// The layout is computed from the current size on every frame, so a
+	// resize only needs a redraw
+	layout := computeLayout(width, height, a.logVisible)
+	if layout.TooSmall {
+		drawTooSmall(s)
+		s.Show()
+		return
+	}
+
+	title := fmt.Sprintf(" dsktool %s", appversion)
+	switch a.pick {
+	case tuiPickDisk:
+		title += " - select a disk"
+	case tuiPickPartition:
+		title += " - select a partition"
+	}
+	titleView := newTUIView(s, layout.Title)
+	titleView.FillRow(0, tuiStyleTitle)
+	titleView.Text(0, 0, tuiStyleTitle, title)
+
+	a.drawDisks(newTUIView(s, layout.Disks))
+	a.drawPartitions(newTUIView(s, layout.Partitions))
+	a.drawDetails(newTUIView(s, layout.Details))
+	if layout.Log.H > 0 {
+		a.drawLog(newTUIView(s, layout.Log))
+	}
+	a.drawStatus(newTUIView(s, layout.Status))
+
+	if a.form != nil {
+		a.form.draw(s)
+	} else {
+		s.HideCursor()
+	}
+	s.Show()
+}
+
+func (a *tuiApp) paneStyle(focus int) tcell.Style {
+	if a.focus == focus {
+		return tuiStyleFocus
+	}
+	return tuiStyleBorder
+}
+
+func (a *tuiApp) drawDisks(v tuiView) {
+	inner := v.Box("Disks", a.paneStyle(tuiFocusDisks))
+
+	if len(a.disks) == 0 {
+		inner.Text(1, 0, tuiStyleDim, "No disks found")
+		return
+	}
+
+	visible := inner.Height()
+	top := scrollTop(a.diskIndex, visible)
+	for i := top; i < len(a.disks) && i-top < visible; i++ {
+		disk := a.disks[i]
+		row := i - top
+		style := tuiStyleDefault
+		if i == a.diskIndex {
+			style = tuiStyleSelected
+			inner.FillRow(row, style)
+		}
+		line := inner.Sub(1, row, inner.Width()-2, 1)
+		end := line.Text(0, 0, style, fmt.Sprintf("%s  %s", disk.Path, formatBytes(disk.Size)))
+		if disk.Tags != "" {
+			line.Text(end+1, 0, style.Foreground(tcell.ColorYellow), disk.Tags)
+		}
+	}
+}
+
+// scrollTop returns the first visible line so that index stays in view
+func scrollTop(index, visible int) int {
+	if visible <= 0 || index < visible {
+		return 0
+	}
+	return index - visible + 1
+}
+
+func (a *tuiApp) drawPartitions(v tuiView) {
+	disk := a.currentDisk()
+	title := "Partitions"
+	if disk != nil && disk.Table != nil {
+		title = fmt.Sprintf("Partitions (%s)", disk.Table.Type)
+	}
+	inner := v.Box(title, a.paneStyle(tuiFocusPartitions))
+	text := inner.Sub(1, 0, inner.Width()-2, inner.Height())
+
+	if disk == nil {
+		return
+	}
+	if disk.Err != nil {
+		text.Text(0, 0, tuiStyleError, disk.Err.Error())
+		return
+	}
+
+	header := fmt.Sprintf("%-3s %12s %12s %9s  %-10s %s", "#", "START", "END", "SIZE", "FS", "NAME / TYPE")
+	text.Text(0, 0, tuiStyleDim, header)
+
+	visible := inner.Height() - 1
+	top := scrollTop(a.partIndex, visible)
+	for i := top; i < len(disk.Rows) && i-top < visible; i++ {
+		r := disk.Rows[i]
+		row := 1 + i - top
+		size := formatBytes((r.Last - r.First + 1) * disk.Table.SectorSize)
+
+		var line string
+		style := tuiStyleDefault
+		if r.Part == nil {
+			line = fmt.Sprintf("%-3s %12d %12d %9s  %s %s", "-", r.First, r.Last, size, tuiPad("", 10), "free space")
+			style = tuiStyleDim
+		} else {
+			name := r.Part.Name
+			if r.Part.GPT == nil || name == "" {
+				name = partitionTypeName(*r.Part)
+			}
+			line = fmt.Sprintf("%-3d %12d %12d %9s  %s %s", r.Part.Number, r.First, r.Last, size, tuiPad(r.FSType, 10), name)
+		}
+
+		if i == a.partIndex && a.focus == tuiFocusPartitions {
+			style = tuiStyleSelected
+			inner.FillRow(row, style)
+		}
+		text.Text(0, row, style, line)
+	}
+}
+
+func (a *tuiApp) drawDetails(v tuiView) {
+	inner := v.Box("Details", tuiStyleBorder)
+
+	disk := a.currentDisk()
+	if disk == nil {
+		return
+	}
+
+	var lines [][2]string
+	row := a.currentRow()
+	switch {
+	case a.focus == tuiFocusPartitions && row != nil && row.Part != nil:
+		part := row.Part
+		lines = append(lines,
+			[2]string{"Partition", disk.partitionPath(part.Number)},
+			[2]string{"Type", partitionTypeName(*part)},
+			[2]string{"Range", fmt.Sprintf("LBA %d - %d (%d sectors, %s)", part.FirstLBA, part.LastLBA, part.Sectors(), formatBytes(part.Size(disk.Table.SectorSize)))},
+			[2]string{"Filesystem", row.FSType},
+			[2]string{"Label", row.Label},
+		)
+		if part.GPT != nil {
+			lines = append(lines,
+				[2]string{"Name", part.Name},
+				[2]string{"GUID", formatGUID(part.GPT.UniqueGUID)})
+		}
+	case a.focus == tuiFocusPartitions && row != nil:
+		lines = append(lines,
+			[2]string{"Free space", fmt.Sprintf("LBA %d - %d", row.First, row.Last)},
+			[2]string{"Size", formatBytes((row.Last - row.First + 1) * disk.Table.SectorSize)})
+	default:
+		lines = append(lines,
+			[2]string{"Disk", disk.Path},
+			[2]string{"Size", formatBytes(disk.Size)})
+		if disk.Table != nil {
+			lines = append(lines,
+				[2]string{"Table", disk.Table.Type},
+				[2]string{"Sector size", fmt.Sprintf("%d bytes", disk.Table.SectorSize)},
+				[2]string{"Partitions", fmt.Sprint(len(disk.Table.Partitions))})
+			if disk.Table.Header != nil {
+				lines = append(lines, [2]string{"Disk GUID", formatGUID(disk.Table.Header.DiskGUID)})
+			}
+		}
+		if disk.Tags != "" {
+			lines = append(lines, [2]string{"Tags", disk.Tags})
+		}
+	}
+
+	labels := inner.Sub(1, 0, 14, inner.Height())
+	values := inner.Sub(15, 0, inner.Width()-16, inner.Height())
+	for i, line := range lines {
+		labels.Text(0, i, tuiStyleDim, line[0])
+		style := tuiStyleDefault
+		if line[0] == "Tags" {
+			style = tuiStyleTags
+		}
+		values.Text(0, i, style, line[1])
+	}
+}
+
+func (a *tuiApp) drawStatus(v tuiView) {
+	text := a.status
+	if text == "" {
+		switch a.pick {
+		case tuiPickDisk:
+			text = "↑/↓ move  Enter select  Esc cancel"
+		case tuiPickPartition:
+			text = "↑/↓ move  Tab switch pane  Enter select  Esc cancel"
+		default:
+			text = "↑/↓ move  Tab switch pane  n new  d delete  r reload  l log  e export log  q quit"
+		}
+	}
+	line := v.Sub(1, 0, v.Width()-2, 1)
+	end := line.Text(0, 0, tuiStyleDim, text)
+
+	// The hardware of the selected disk goes to the right if it fits
+	if disk := a.currentDisk(); disk != nil && disk.Inventory.known() {
+		inventory := disk.Inventory.describe()
+		if x := line.Width() - runewidth.StringWidth(inventory); x > end+2 {
+			line.Text(x, 0, tuiStyleDefault, inventory)
+		}
+	}
+}
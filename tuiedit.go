@@ -0,0 +1,285 @@
+//go:build !tiny
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// stripANSI removes the color codes the CLI output uses
+func stripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// sizeFieldSectors converts a size field to sectors. Besides sizes with units it
+// accepts max or a percentage of the available space, like parted does.
+func sizeFieldSectors(value string, available, sectorSize uint64) (uint64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "max" {
+		return available, nil
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentage %q, use more than 0%% up to 100%%", value)
+		}
+		return max(uint64(float64(available)*p/100), 1), nil
+	}
+
+	size, err := parseSize(value, int64(sectorSize), 0)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(size) < sectorSize {
+		return 0, fmt.Errorf("size must be at least one sector (%d bytes)", sectorSize)
+	}
+	// Partial sectors are rounded down
+	return uint64(size) / sectorSize, nil
+}
+
+// selectedFreeRegion returns the free space under the cursor, or the first gap of the disk
+func (a *tuiApp) selectedFreeRegion(disk *tuiDisk) (freeRegion, bool) {
+	if row := a.currentRow(); row != nil && row.Part == nil && a.focus == tuiFocusPartitions {
+		return freeRegion{First: row.First, Last: row.Last}, true
+	}
+	for _, row := range disk.Rows {
+		if row.Part == nil {
+			return freeRegion{First: row.First, Last: row.Last}, true
+		}
+	}
+	return freeRegion{}, false
+}
+
+// openCreateForm asks for the details of a new partition in the selected free space
+func (a *tuiApp) openCreateForm() {
+	disk := a.currentDisk()
+	if disk == nil || disk.Table == nil {
+		a.status = "No partition table to add a partition to"
+		return
+	}
+	region, ok := a.selectedFreeRegion(disk)
+	if !ok {
+		a.status = "No free space on " + disk.Path
+		return
+	}
+
+	// Start on a 1 MiB boundary like other partitioning tools do
+	sectorSize := disk.Table.SectorSize
+	align := mb / sectorSize
+	start := (region.First + align - 1) / align * align
+	if start > region.Last {
+		start = region.First
+	}
+
+	fields := []*tuiField{
+		newTextField("Start", fmt.Sprintf("%ds", start)),
+		newTextField("Size", "max"),
+		newSelectField("Type", partitionTypeChoices(disk.Table.Type)),
+	}
+	if disk.Table.Type == "GPT" {
+		fields = append(fields, newTextField("Name", ""))
+	}
+
+	// parse turns the start and size fields into a partition range inside the gap
+	parse := func(f *tuiForm) (uint64, uint64, error) {
+		// The start takes sectors like 2048s, sizes like 1MiB or a percentage of the disk
+		first, err := disk.Table.offsetLBA(f.Field("Start").Text(), uint64(disk.Size)/sectorSize)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid start: %v", err)
+		}
+		if first < region.First || first > region.Last {
+			return 0, 0, fmt.Errorf("start must be within the free space, LBA %d - %d", region.First, region.Last)
+		}
+		available := region.Last - first + 1
+		sectors, err := sizeFieldSectors(f.Field("Size").Text(), available, sectorSize)
+		if err != nil {
+			return 0, 0, err
+		}
+		if sectors > available {
+			return 0, 0, fmt.Errorf("%s is %s more than the %s available, use max to fill the gap",
+				formatBytes(sectors*sectorSize), formatBytes((sectors-available)*sectorSize), formatBytes(available*sectorSize))
+		}
+		return first, first + sectors - 1, nil
+	}
+
+	form := &tuiForm{
+		Title:  "New partition on " + disk.Path,
+		Lines:  []string{fmt.Sprintf("Free space LBA %d - %d (%s)", region.First, region.Last, formatBytes(region.Sectors()*sectorSize))},
+		Fields: fields,
+	}
+	form.Preview = func(f *tuiForm) (string, error) {
+		first, last, err := parse(f)
+		if err != nil {
+			return "", err
+		}
+		remaining := (first - region.First + region.Last - last) * sectorSize
+		if remaining == 0 {
+			return fmt.Sprintf("Ends at LBA %d, %s, fills the gap", last, formatBytes((last-first+1)*sectorSize)), nil
+		}
+		return fmt.Sprintf("Ends at LBA %d, %s, %s of the gap left unused", last, formatBytes((last-first+1)*sectorSize), formatBytes(remaining)), nil
+	}
+	form.Submit = func(f *tuiForm) error {
+		first, last, err := parse(f)
+		if err != nil {
+			return err
+		}
+		spec := partitionSpec{FirstLBA: first, LastLBA: last, Type: f.Field("Type").Text()}
+		if name := f.Field("Name"); name != nil {
+			spec.Name = name.Text()
+		}
+		table := disk.Table.clone()
+		part, err := table.createPartition(spec, uint64(disk.Size)/sectorSize)
+		if err != nil {
+			return err
+		}
+		number, name := part.Number, part.Name
+		a.confirmTableChange(disk, table, fmt.Sprintf("create partition %d", number), func() {
+			a.openMkfsForm(disk.Path, number, name)
+		})
+		return nil
+	}
+	a.form = form
+}
+
+// openMkfsForm offers to put a filesystem on a freshly created partition. The
+// label defaults to the GPT name, and a different label renames the partition.
+func (a *tuiApp) openMkfsForm(path string, number int, name string) {
+	form := &tuiForm{
+		Title: fmt.Sprintf("Filesystem for partition %d", number),
+		Lines: []string{"Create a filesystem on the new partition, or Esc to leave it empty"},
+		Fields: []*tuiField{
+			newSelectField("Filesystem", mkfsTypes),
+			newTextField("Label", name),
+		},
+	}
+	form.Submit = func(f *tuiForm) error {
+		fstype, label := f.Field("Filesystem").Text(), strings.TrimSpace(f.Field("Label").Text())
+		spec := fmt.Sprintf("%s:%d", path, number)
+		a.logf(tuiLogInfo, "Creating %s on %s", fstype, spec)
+		if err := makeFileSystem(spec, fstype, label, tuiLogWriter{a}); err != nil {
+			a.logf(tuiLogError, "Creating %s on %s: %v", fstype, spec, err)
+			return err
+		}
+		a.reload()
+		a.status = fmt.Sprintf("Created %s on %s", fstype, spec)
+
+		disk := a.diskByPath(path)
+		if disk == nil || disk.Table == nil || disk.Table.Type != "GPT" || label == "" || label == name {
+			return nil
+		}
+		table := disk.Table.clone()
+		part, err := table.findPartition(number)
+		if err != nil {
+			return err
+		}
+		part.Name = label
+		if err := a.writeTable(disk, table, fmt.Sprintf("rename partition %d", number)); err != nil {
+			return err
+		}
+		a.status = fmt.Sprintf("Created %s on %s and named the partition %q", fstype, spec, label)
+		return nil
+	}
+	a.form = form
+}
+
+// diskByPath returns the loaded disk with the given path
+func (a *tuiApp) diskByPath(path string) *tuiDisk {
+	for _, disk := range a.disks {
+		if disk.Path == path {
+			return disk
+		}
+	}
+	return nil
+}
+
+// openDeleteConfirm asks before deleting the selected partition
+func (a *tuiApp) openDeleteConfirm() {
+	disk := a.currentDisk()
+	row := a.currentRow()
+	if disk == nil || row == nil || row.Part == nil || a.focus != tuiFocusPartitions {
+		a.status = "Select a partition to delete"
+		return
+	}
+	table := disk.Table.clone()
+	if err := table.deletePartition(row.Part.Number); err != nil {
+		a.fail("%v", err)
+		return
+	}
+	a.confirmTableChange(disk, table, fmt.Sprintf("delete partition %d", row.Part.Number), nil)
+}
+
+// confirmTableChange shows the table diff and writes the table once the user
+// confirms. then, if set, runs after a successful write that was not a dry run.
+func (a *tuiApp) confirmTableChange(disk *tuiDisk, table *partitionTable, operation string, then func()) {
+	question := fmt.Sprintf("Write these changes to %s?", disk.Path)
+	if dryRun {
+		question = fmt.Sprintf("Dry run, the writes to %s are only logged", disk.Path)
+	}
+	lines := []string{question, ""}
+	for _, line := range diffPartitionTables(disk.Table, table) {
+		lines = append(lines, stripANSI(line))
+	}
+
+	a.form = &tuiForm{
+		Title: strings.ToUpper(operation[:1]) + operation[1:],
+		Lines: lines,
+		Submit: func(*tuiForm) error {
+			if err := a.writeTable(disk, table, operation); err != nil {
+				return err
+			}
+			if then != nil && !dryRun {
+				then()
+			}
+			return nil
+		},
+	}
+}
+
+// writeTable writes an edited table to a disk, refusing if the table on the
+// disk changed since it was loaded
+func (a *tuiApp) writeTable(disk *tuiDisk, table *partitionTable, operation string) error {
+	writer, err := openDeviceWriterTo(disk.Path, operation, tuiLogWriter{a})
+	if err != nil {
+		a.logf(tuiLogError, "Opening %s for %s: %v", disk.Path, operation, err)
+		return err
+	}
+
+	current, err := writer.partitionTable()
+	if err != nil || len(diffPartitionTables(disk.Table, current)) > 0 {
+		writer.Close()
+		return fmt.Errorf("the partition table of %s changed since it was read, press r to reload", disk.Path)
+	}
+
+	recordDevice(disk.Path)
+	if err := writePartitionTable(writer, writer, writer.Size, table); err != nil {
+		writer.Close()
+		a.logf(tuiLogError, "Writing %s table to %s: %v", table.Type, disk.Path, err)
+		return err
+	}
+	if !writer.DryRun {
+		if err := writer.Sync(); err != nil {
+			writer.Close()
+			return err
+		}
+		if err := rereadPartitionTable(writer.File); err != nil {
+			a.logf(tuiLogError, "The kernel could not re-read the partition table of %s (%v), a reboot or partprobe may be needed", disk.Path, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if writer.DryRun {
+		a.status = fmt.Sprintf("Dry run: %s on %s, nothing was written", operation, disk.Path)
+		return nil
+	}
+	a.logf(tuiLogWrite, "%s on %s", strings.ToUpper(operation[:1])+operation[1:], disk.Path)
+	a.reload()
+	a.status = fmt.Sprintf("Partition table of %s updated", disk.Path)
+	return nil
+}
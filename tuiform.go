@@ -0,0 +1,275 @@
+//go:build !tiny
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// tuiField is a text field, or a select field when it has options
+type tuiField struct {
+	Label   string
+	Value   []rune
+	Cursor  int // rune index into Value
+	Options []string
+	Choice  int
+}
+
+func newTextField(label, value string) *tuiField {
+	v := []rune(value)
+	return &tuiField{Label: label, Value: v, Cursor: len(v)}
+}
+
+func newSelectField(label string, options []string) *tuiField {
+	return &tuiField{Label: label, Options: options}
+}
+
+// Text returns the entered text or the chosen option
+func (f *tuiField) Text() string {
+	if f.Options != nil {
+		return f.Options[f.Choice]
+	}
+	return string(f.Value)
+}
+
+// handle edits the field and reports whether the key was used
+func (f *tuiField) handle(ev *tcell.EventKey) bool {
+	if f.Options != nil {
+		switch {
+		case ev.Key() == tcell.KeyLeft:
+			f.Choice = (f.Choice + len(f.Options) - 1) % len(f.Options)
+		case ev.Key() == tcell.KeyRight, ev.Key() == tcell.KeyRune && ev.Rune() == ' ':
+			f.Choice = (f.Choice + 1) % len(f.Options)
+		case ev.Key() == tcell.KeyHome:
+			f.Choice = 0
+		case ev.Key() == tcell.KeyEnd:
+			f.Choice = len(f.Options) - 1
+		default:
+			return false
+		}
+		return true
+	}
+
+	switch ev.Key() {
+	case tcell.KeyLeft:
+		f.Cursor = max(f.Cursor-1, 0)
+	case tcell.KeyRight:
+		f.Cursor = min(f.Cursor+1, len(f.Value))
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		f.Cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		f.Cursor = len(f.Value)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if f.Cursor > 0 {
+			f.Value = append(f.Value[:f.Cursor-1], f.Value[f.Cursor:]...)
+			f.Cursor--
+		}
+	case tcell.KeyDelete, tcell.KeyCtrlD:
+		if f.Cursor < len(f.Value) {
+			f.Value = append(f.Value[:f.Cursor], f.Value[f.Cursor+1:]...)
+		}
+	case tcell.KeyCtrlU:
+		f.Value, f.Cursor = nil, 0
+	case tcell.KeyRune:
+		f.Value = append(f.Value[:f.Cursor], append([]rune{ev.Rune()}, f.Value[f.Cursor:]...)...)
+		f.Cursor++
+	default:
+		return false
+	}
+	return true
+}
+
+// tuiForm is a modal dialog with informational lines and fields. Enter
+// submits, Esc cancels. A form without fields is a confirmation.
+type tuiForm struct {
+	Title  string
+	Lines  []string
+	Fields []*tuiField
+	Focus  int
+	Err    string
+
+	// Submit is called on Enter, an error keeps the form open and is shown in it
+	Submit func(f *tuiForm) error
+
+	// Preview, when set, validates the fields as they are typed and returns
+	// a line describing the result
+	Preview func(f *tuiForm) (string, error)
+}
+
+// handle processes a key and reports whether the form is finished
+func (f *tuiForm) handle(ev *tcell.EventKey) bool {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return true
+	case tcell.KeyEnter:
+		if err := f.Submit(f); err != nil {
+			f.Err = err.Error()
+			return false
+		}
+		return true
+	case tcell.KeyTab, tcell.KeyDown:
+		if len(f.Fields) > 0 {
+			f.Focus = (f.Focus + 1) % len(f.Fields)
+		}
+		return false
+	case tcell.KeyBacktab, tcell.KeyUp:
+		if len(f.Fields) > 0 {
+			f.Focus = (f.Focus + len(f.Fields) - 1) % len(f.Fields)
+		}
+		return false
+	}
+	if f.Focus < len(f.Fields) && f.Fields[f.Focus].handle(ev) {
+		f.Err = ""
+	}
+	return false
+}
+
+// Field returns the field with the given label
+func (f *tuiForm) Field(label string) *tuiField {
+	for _, field := range f.Fields {
+		if field.Label == label {
+			return field
+		}
+	}
+	return nil
+}
+
+const tuiFormLabelWidth = 12
+
+var (
+	tuiStyleInput  = tcell.StyleDefault.Underline(true)
+	tuiStyleOption = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	tuiStyleAdded  = tcell.StyleDefault.Foreground(tcell.ColorGreen)
+)
+
+// draw renders the form centered on the screen, with the option list of a
+// focused select field next to it
+func (f *tuiForm) draw(s tcell.Screen) {
+	width, height := s.Size()
+	w := min(72, width-4)
+	h := len(f.Lines) + len(f.Fields) + 5
+	if f.Preview != nil {
+		h += 2
+	}
+	h = min(h, height-2)
+	x, y := (width-w)/2, (height-h)/2
+
+	box := newTUIView(s, tuiRect{x, y, w, h})
+	for row := 0; row < h; row++ {
+		box.FillRow(row, tuiStyleDefault)
+	}
+	inner := box.Box(f.Title, tuiStyleFocus)
+	content := inner.Sub(1, 0, inner.Width()-2, inner.Height())
+
+	row := 0
+	for _, line := range f.Lines {
+		style := tuiStyleDefault
+		switch {
+		case strings.HasPrefix(line, "+"):
+			style = tuiStyleAdded
+		case strings.HasPrefix(line, "-"):
+			style = tuiStyleError
+		case strings.HasPrefix(line, "~"):
+			style = tuiStyleTags
+		}
+		content.Text(0, row, style, line)
+		row++
+	}
+	if len(f.Lines) > 0 && len(f.Fields) > 0 {
+		row++
+	}
+
+	s.HideCursor()
+	var dropdown *tuiField
+	dropdownRow := 0
+	input := content.Sub(tuiFormLabelWidth+1, 0, content.Width()-tuiFormLabelWidth-1, content.Height())
+	for i, field := range f.Fields {
+		focused := i == f.Focus
+		labelStyle := tuiStyleDim
+		if focused {
+			labelStyle = tuiStyleFocus
+		}
+		content.Sub(0, row, tuiFormLabelWidth, 1).Text(0, 0, labelStyle, field.Label)
+
+		if field.Options != nil {
+			style := tuiStyleDefault
+			if focused {
+				style = tuiStyleSelected
+				dropdown, dropdownRow = field, row
+			}
+			input.Text(0, row, style, fmt.Sprintf("‹ %s ›", field.Text()))
+		} else {
+			line := input.Sub(0, row, input.Width(), 1)
+			line.FillRow(0, tuiStyleInput)
+			// Scroll long values so the cursor stays visible
+			start := 0
+			for runewidth.StringWidth(string(field.Value[start:field.Cursor])) >= line.Width() && start < field.Cursor {
+				start++
+			}
+			line.Text(0, 0, tuiStyleInput, string(field.Value[start:]))
+			if focused {
+				cx := runewidth.StringWidth(string(field.Value[start:field.Cursor]))
+				s.ShowCursor(line.rect.X+cx, line.rect.Y)
+			}
+		}
+		row++
+	}
+
+	if f.Preview != nil {
+		if info, err := f.Preview(f); err != nil {
+			content.Text(0, row+1, tuiStyleError, err.Error())
+		} else {
+			content.Text(0, row+1, tuiStyleAdded, info)
+		}
+	}
+
+	help := "Enter confirm  Esc cancel"
+	if len(f.Fields) > 0 {
+		help = "Tab next field  ←/→ move or choose  Enter confirm  Esc cancel"
+	}
+	if f.Err != "" {
+		content.Text(0, content.Height()-1, tuiStyleError, f.Err)
+	} else {
+		content.Text(0, content.Height()-1, tuiStyleDim, help)
+	}
+
+	// The option list opens beside the field so it does not hide the next ones
+	if dropdown != nil {
+		widest := 0
+		for _, option := range dropdown.Options {
+			widest = max(widest, runewidth.StringWidth(option))
+		}
+		f.drawOptions(s, input.rect.X+widest+5, input.rect.Y+dropdownRow-1, dropdown)
+	}
+}
+
+// drawOptions shows the choices of a select field as a list with the current one highlighted
+func (f *tuiForm) drawOptions(s tcell.Screen, x, y int, field *tuiField) {
+	_, height := s.Size()
+	w := 0
+	for _, option := range field.Options {
+		w = max(w, runewidth.StringWidth(option))
+	}
+	h := min(len(field.Options), 8, height-y-1)
+	if h <= 0 {
+		return
+	}
+	list := newTUIView(s, tuiRect{x, y, w + 4, h + 2})
+	for row := 0; row < list.Height(); row++ {
+		list.FillRow(row, tuiStyleDefault)
+	}
+	inner := list.Box("", tuiStyleBorder)
+	top := scrollTop(field.Choice, inner.Height())
+	for i := top; i < len(field.Options) && i-top < inner.Height(); i++ {
+		style := tuiStyleOption
+		if i == field.Choice {
+			style = tuiStyleSelected
+			inner.FillRow(i-top, style)
+		}
+		inner.Text(1, i-top, style, field.Options[i])
+	}
+}
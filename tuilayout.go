@@ -0,0 +1,184 @@
+//go:build !tiny
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// Below this size the TUI only shows a message asking for a bigger terminal
+const (
+	tuiMinWidth  = 60
+	tuiMinHeight = 16
+)
+
+// tuiRect is a screen region in absolute coordinates
+type tuiRect struct {
+	X, Y, W, H int
+}
+
+// intersect returns the part of r that is inside o
+func (r tuiRect) intersect(o tuiRect) tuiRect {
+	x0, y0 := max(r.X, o.X), max(r.Y, o.Y)
+	x1, y1 := min(r.X+r.W, o.X+o.W), min(r.Y+r.H, o.Y+o.H)
+	if x1 <= x0 || y1 <= y0 {
+		return tuiRect{X: x0, Y: y0}
+	}
+	return tuiRect{X: x0, Y: y0, W: x1 - x0, H: y1 - y0}
+}
+
+// tuiLayout holds the regions of every part of the screen for one frame
+type tuiLayout struct {
+	Title      tuiRect
+	Disks      tuiRect
+	Partitions tuiRect
+	Details    tuiRect
+	Log        tuiRect
+	Status     tuiRect
+	TooSmall   bool
+}
+
+// computeLayout splits the screen into regions. Optional parts shrink or
+// disappear first so the disk and partition panes keep at least 5 lines.
+func computeLayout(width, height int, logVisible bool) tuiLayout {
+	if width < tuiMinWidth || height < tuiMinHeight {
+		return tuiLayout{TooSmall: true}
+	}
+
+	const minPane = 5
+	details := clamp(height-2-minPane, 4, 9)
+	logHeight := 0
+	if logVisible {
+		logHeight = clamp(height-2-details-minPane, 0, tuiLogHeight)
+		// A log box with fewer than two lines of content is not worth showing
+		if logHeight < 4 {
+			logHeight = 0
+		}
+	}
+	pane := height - 2 - details - logHeight
+	diskWidth := clamp(width/3, 20, width-30)
+
+	return tuiLayout{
+		Title:      tuiRect{0, 0, width, 1},
+		Disks:      tuiRect{0, 1, diskWidth, pane},
+		Partitions: tuiRect{diskWidth, 1, width - diskWidth, pane},
+		Details:    tuiRect{0, 1 + pane, width, details},
+		Log:        tuiRect{0, 1 + pane + details, width, logHeight},
+		Status:     tuiRect{0, height - 1, width, 1},
+	}
+}
+
+// tuiView is a clipped region of the screen. Coordinates passed to its
+// methods are relative to the region and nothing is drawn outside of it.
+type tuiView struct {
+	screen tcell.Screen
+	rect   tuiRect
+}
+
+func newTUIView(s tcell.Screen, r tuiRect) tuiView {
+	width, height := s.Size()
+	return tuiView{screen: s, rect: r.intersect(tuiRect{0, 0, width, height})}
+}
+
+func (v tuiView) Width() int  { return v.rect.W }
+func (v tuiView) Height() int { return v.rect.H }
+
+// Sub returns a view of a region inside v, clipped to v
+func (v tuiView) Sub(x, y, w, h int) tuiView {
+	return tuiView{screen: v.screen, rect: tuiRect{v.rect.X + x, v.rect.Y + y, w, h}.intersect(v.rect)}
+}
+
+// Set draws a single cell, ignoring anything outside the view
+func (v tuiView) Set(x, y int, r rune, style tcell.Style) {
+	if x < 0 || y < 0 || x >= v.rect.W || y >= v.rect.H {
+		return
+	}
+	v.screen.SetContent(v.rect.X+x, v.rect.Y+y, r, nil, style)
+}
+
+// Text draws text on one line and returns the column after it. Wide runes
+// take two cells and are not split at the edge, zero width runes are
+// combined with the cell before them.
+func (v tuiView) Text(x, y int, style tcell.Style, text string) int {
+	lastX := -1
+	for _, r := range text {
+		w := runewidth.RuneWidth(r)
+		if w == 0 {
+			if lastX >= 0 && lastX < v.rect.W {
+				mainc, combc, _, _ := v.screen.GetContent(v.rect.X+lastX, v.rect.Y+y)
+				v.screen.SetContent(v.rect.X+lastX, v.rect.Y+y, mainc, append(combc, r), style)
+			}
+			continue
+		}
+		if x+w > v.rect.W {
+			// Blank the cell a wide rune would have been cut in
+			if x < v.rect.W {
+				v.Set(x, y, ' ', style)
+			}
+			x = v.rect.W
+			break
+		}
+		v.Set(x, y, r, style)
+		lastX = x
+		x += w
+	}
+	return x
+}
+
+// tuiPad truncates or pads text to exactly width terminal columns
+func tuiPad(text string, width int) string {
+	return runewidth.FillRight(runewidth.Truncate(text, width, ""), width)
+}
+
+// FillRow paints a whole line, used for selection bars
+func (v tuiView) FillRow(y int, style tcell.Style) {
+	for x := 0; x < v.rect.W; x++ {
+		v.Set(x, y, ' ', style)
+	}
+}
+
+// Box draws a border with a title around the view and returns the inside
+func (v tuiView) Box(title string, style tcell.Style) tuiView {
+	w, h := v.rect.W, v.rect.H
+	if w < 2 || h < 2 {
+		return v.Sub(0, 0, 0, 0)
+	}
+	for x := 1; x < w-1; x++ {
+		v.Set(x, 0, tcell.RuneHLine, style)
+		v.Set(x, h-1, tcell.RuneHLine, style)
+	}
+	for y := 1; y < h-1; y++ {
+		v.Set(0, y, tcell.RuneVLine, style)
+		v.Set(w-1, y, tcell.RuneVLine, style)
+	}
+	v.Set(0, 0, tcell.RuneULCorner, style)
+	v.Set(w-1, 0, tcell.RuneURCorner, style)
+	v.Set(0, h-1, tcell.RuneLLCorner, style)
+	v.Set(w-1, h-1, tcell.RuneLRCorner, style)
+	if title != "" {
+		v.Sub(2, 0, w-4, 1).Text(0, 0, style, " "+title+" ")
+	}
+	return v.Sub(1, 1, w-2, h-2)
+}
+
+// drawTooSmall asks for a bigger terminal instead of drawing a broken layout
+func drawTooSmall(s tcell.Screen) {
+	width, height := s.Size()
+	v := newTUIView(s, tuiRect{0, 0, width, height})
+	lines := []string{
+		"Terminal too small",
+		fmt.Sprintf("%dx%d, need at least %dx%d", width, height, tuiMinWidth, tuiMinHeight),
+		"q to quit",
+	}
+	top := (height - len(lines)) / 2
+	for i, line := range lines {
+		style := tuiStyleDim
+		if i == 0 {
+			style = tuiStyleError
+		}
+		v.Text(max((width-runewidth.StringWidth(line))/2, 0), top+i, style, line)
+	}
+}
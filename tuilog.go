@@ -0,0 +1,97 @@
+//go:build !tiny
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Kinds of entries in the TUI session log
+const (
+	tuiLogInfo  = "info"
+	tuiLogRead  = "read"
+	tuiLogWrite = "write"
+	tuiLogError = "error"
+)
+
+// tuiLogEntry is one action recorded during a TUI session
+type tuiLogEntry struct {
+	Time    time.Time
+	Kind    string
+	Message string
+}
+
+func (e tuiLogEntry) String() string {
+	return fmt.Sprintf("%s %-5s %s", e.Time.Format("15:04:05"), e.Kind, e.Message)
+}
+
+const tuiLogHeight = 8
+
+// logf records an action in the session log
+func (a *tuiApp) logf(kind, format string, args ...interface{}) {
+	entry := tuiLogEntry{Time: time.Now(), Kind: kind, Message: fmt.Sprintf(format, args...)}
+	a.logEntries = append(a.logEntries, entry)
+	recordEvent(entry.Kind, entry.Message)
+}
+
+// fail logs an error and shows it on the status line
+func (a *tuiApp) fail(format string, args ...interface{}) {
+	a.logf(tuiLogError, format, args...)
+	a.status = fmt.Sprintf(format, args...)
+}
+
+// exportLog writes the session log to a timestamped file in the current directory
+func (a *tuiApp) exportLog() {
+	name := fmt.Sprintf("dsktool-session-%s.log", time.Now().Format("20060102-150405"))
+	file, err := os.Create(name)
+	if err != nil {
+		a.fail("Exporting log: %v", err)
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "dsktool %s session log, %d entries\n", appversion, len(a.logEntries))
+	for _, entry := range a.logEntries {
+		fmt.Fprintf(file, "%s %-5s %s\n", entry.Time.Format(time.RFC3339), entry.Kind, entry.Message)
+	}
+	a.status = "Session log exported to " + name
+	a.logf(tuiLogInfo, "Exported session log to %s", name)
+}
+
+func (a *tuiApp) drawLog(v tuiView) {
+	inner := v.Box(fmt.Sprintf("Log (%d)", len(a.logEntries)), tuiStyleBorder)
+	text := inner.Sub(1, 0, inner.Width()-2, inner.Height())
+
+	start := len(a.logEntries) - inner.Height()
+	if start < 0 {
+		start = 0
+	}
+	for i, entry := range a.logEntries[start:] {
+		style := tuiStyleDefault
+		switch entry.Kind {
+		case tuiLogWrite:
+			style = tuiStyleTags
+		case tuiLogError:
+			style = tuiStyleError
+		case tuiLogRead:
+			style = tuiStyleDim
+		}
+		text.Text(0, i, style, entry.String())
+	}
+}
+
+// tuiLogWriter records reports written by a device writer, such as the
+// dry-run write listing, in the session log instead of on the terminal
+type tuiLogWriter struct {
+	app *tuiApp
+}
+
+func (w tuiLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.app.logf(tuiLogWrite, "%s", line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,46 @@
+//go:build !tiny
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tuiProgressInterval is how often the TUI redraws for progress
+const tuiProgressInterval = 250 * time.Millisecond
+
+// tuiProgress is the progress sink of the TUI. What the TUI runs, like
+// creating a filesystem, runs on its event loop, so the progress is drawn
+// on the status line right away and errors and warnings go to the log.
+type tuiProgress struct {
+	a        *tuiApp
+	lastDraw time.Time
+}
+
+func (p *tuiProgress) progress(phase string, done, total int64) {
+	status := fmt.Sprintf("%s%s: %s", strings.ToUpper(phase[:1]), phase[1:], formatBytes(done))
+	if total > 0 {
+		status += fmt.Sprintf(" of %s (%.1f%%)", formatBytes(total), float64(done)*100/float64(total))
+	}
+	p.a.status = status
+	if done == total || time.Since(p.lastDraw) >= tuiProgressInterval {
+		p.a.draw()
+		p.lastDraw = time.Now()
+	}
+}
+
+func (p *tuiProgress) written(phase string, n int64) {}
+
+func (p *tuiProgress) message(event, message string) {
+	if event == "error" {
+		p.a.logf(tuiLogError, "%s", message)
+	}
+}
+
+func (p *tuiProgress) warning(w warning) {
+	p.a.logf(tuiLogError, "Warning: %s", w.Message)
+}
+
+func (p *tuiProgress) finish(status int, err error) {}
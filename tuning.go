@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Imaging reads in blocks sized for the device, with a few reads in flight on
+// devices that gain from a deeper queue. Both are probed when they are not
+// given: the kernel queue limits say what the device takes, a few timed reads
+// what it delivers.
+
+const (
+	defaultBlockSize = mb
+	maxBlockSize     = 64 * mb
+	maxQueueDepth    = 32
+	// limitedReadsPerSecond is how often a --limit read gets a block
+	limitedReadsPerSecond = 4
+)
+
+// ioTuning is the block size and queue depth used to read a device
+type ioTuning struct {
+	BlockSize  int64
+	QueueDepth int
+	// Limit caps reading at this many bytes per second, 0 for no limit
+	Limit  int64
+	Reason string
+}
+
+// queueLimits describes what the kernel knows about a device queue, zero
+// fields are unknown
+type queueLimits struct {
+	Known       bool
+	Rotational  bool
+	MaxTransfer int64
+	OptimalIO   int64
+	Requests    int
+}
+
+// tuningCandidates are the block sizes tried when probing
+var tuningCandidates = []int64{64 * kb, 256 * kb, mb, 4 * mb}
+
+// tuneIO fills the block size and queue depth not set in override from the
+// device characteristics
+func tuneIO(file *os.File, device string, size int64, sectorSize uint64, override ioTuning) (ioTuning, error) {
+	tuning := override
+	if tuning.BlockSize < 0 || tuning.BlockSize > maxBlockSize || tuning.BlockSize%int64(sectorSize) != 0 {
+		return tuning, fmt.Errorf("the block size must be a multiple of the %d byte sector size up to %s", sectorSize, formatBytes(maxBlockSize))
+	}
+	if tuning.QueueDepth < 0 || tuning.QueueDepth > maxQueueDepth {
+		return tuning, fmt.Errorf("the queue depth must be between 1 and %d", maxQueueDepth)
+	}
+	if tuning.BlockSize != 0 && tuning.QueueDepth != 0 {
+		tuning.Reason = "set"
+		return tuning, nil
+	}
+
+	var reasons []string
+	limits := deviceQueueLimits(device)
+	switch {
+	case !limits.Known:
+		reasons = append(reasons, "no queue limits")
+	case limits.Rotational:
+		reasons = append(reasons, "rotational")
+	default:
+		reasons = append(reasons, "non-rotational")
+	}
+
+	if tuning.QueueDepth == 0 {
+		tuning.QueueDepth = 1
+		if limits.Known && !limits.Rotational {
+			// Seeks are free, a few reads in flight keep the device busy
+			tuning.QueueDepth = 4
+			if limits.Requests > 0 {
+				tuning.QueueDepth = min(tuning.QueueDepth, limits.Requests)
+			}
+		}
+	}
+
+	if tuning.BlockSize == 0 {
+		tuning.BlockSize = defaultBlockSize
+		if limits.OptimalIO > 0 && limits.OptimalIO <= maxBlockSize {
+			tuning.BlockSize = max(tuning.BlockSize/limits.OptimalIO, 1) * limits.OptimalIO
+		}
+		if info, err := file.Stat(); err == nil && info.Mode()&os.ModeDevice != 0 {
+			if probed, latency, ok := probeBlockSize(file, size, limits); ok {
+				tuning.BlockSize = probed
+				reasons = append(reasons, fmt.Sprintf("%s reads in %s", formatBytes(probed), latency.Round(10*time.Microsecond)))
+			}
+		}
+	}
+	if tuning.Limit > 0 && override.BlockSize == 0 {
+		// A few reads a second keep a limited read smooth instead of bursty
+		limited := max(tuning.Limit/limitedReadsPerSecond/int64(sectorSize)*int64(sectorSize), int64(sectorSize))
+		if limited < tuning.BlockSize {
+			tuning.BlockSize = limited
+			reasons = append(reasons, "smaller blocks for the limit")
+		}
+	}
+	tuning.Reason = "probed: " + strings.Join(reasons, ", ")
+	return tuning, nil
+}
+
+// probeBlockSize times reads of each candidate size spread over the device
+// and picks the smallest that gets within 10% of the best throughput. It
+// returns the chosen size and how long one read of it took.
+func probeBlockSize(r io.ReaderAt, size int64, limits queueLimits) (int64, time.Duration, bool) {
+	const readsPerSize = 4
+	var (
+		sizes     []int64
+		latencies []time.Duration
+		best      float64
+	)
+	for c, candidate := range tuningCandidates {
+		if candidate*readsPerSize*4 > size {
+			break
+		}
+		buf := make([]byte, candidate)
+		var total time.Duration
+		for i := 0; i < readsPerSize; i++ {
+			// Every read has its own spot, so the cache of an earlier read does not help
+			spot := int64(i*len(tuningCandidates) + c + 1)
+			offset := size / int64(readsPerSize*len(tuningCandidates)+1) * spot / candidate * candidate
+			start := time.Now()
+			if _, err := r.ReadAt(buf, min(offset, size-candidate)); err != nil {
+				return 0, 0, false
+			}
+			total += time.Since(start)
+		}
+		latency := total / readsPerSize
+		sizes = append(sizes, candidate)
+		latencies = append(latencies, latency)
+		best = max(best, float64(candidate)/max(latency.Seconds(), 1e-9))
+	}
+	if len(sizes) == 0 {
+		return 0, 0, false
+	}
+
+	for i, candidate := range sizes {
+		// Reads past the transfer limit are split by the kernel anyway
+		if limits.MaxTransfer > 0 && candidate > limits.MaxTransfer*4 {
+			break
+		}
+		if float64(candidate)/max(latencies[i].Seconds(), 1e-9) >= best*0.9 {
+			return candidate, latencies[i], true
+		}
+	}
+	last := len(sizes) - 1
+	return sizes[last], latencies[last], true
+}
+
+// String describes the tuning for the progress output
+func (t ioTuning) String() string {
+	if t.Limit > 0 {
+		return fmt.Sprintf("%s blocks, queue depth %d, limited to %s/s (%s)", formatBytes(t.BlockSize), t.QueueDepth, formatBytes(t.Limit), t.Reason)
+	}
+	return fmt.Sprintf("%s blocks, queue depth %d (%s)", formatBytes(t.BlockSize), t.QueueDepth, t.Reason)
+}
+
+// readChunks reads r up to size in blocks, with up to the queue depth of reads
+// in flight, and passes the blocks to fn in order
+func readChunks(r io.ReaderAt, size int64, tuning ioTuning, fn func(chunk []byte, offset int64) error) error {
+	type result struct {
+		chunk  []byte
+		offset int64
+		err    error
+	}
+	// One buffer more than the depth, for the block fn works on
+	depth := max(tuning.QueueDepth, 1)
+	buffers := make(chan []byte, depth+1)
+	for i := 0; i <= depth; i++ {
+		buffers <- make([]byte, tuning.BlockSize)
+	}
+	pending := make(chan chan result, depth)
+	done := make(chan struct{})
+	defer close(done)
+
+	limiter := newRateLimiter(tuning.Limit)
+	go func() {
+		defer close(pending)
+		for offset := int64(0); offset < size; offset += tuning.BlockSize {
+			var buf []byte
+			select {
+			case buf = <-buffers:
+			case <-done:
+				return
+			}
+			select {
+			case <-limiter.wait(min(tuning.BlockSize, size-offset)):
+			case <-done:
+				return
+			}
+			ch := make(chan result, 1)
+			select {
+			case pending <- ch:
+			case <-done:
+				return
+			}
+			go func(buf []byte, offset int64) {
+				n, err := r.ReadAt(buf[:min(int64(len(buf)), size-offset)], offset)
+				ch <- result{buf[:n], offset, err}
+			}(buf, offset)
+		}
+	}()
+
+	for ch := range pending {
+		res := <-ch
+		if res.err != nil {
+			return fmt.Errorf("reading at offset %d: %v", res.offset, res.err)
+		}
+		if err := fn(res.chunk, res.offset); err != nil {
+			return err
+		}
+		buffers <- res.chunk[:cap(res.chunk)]
+	}
+	return nil
+}
+
+// rateLimiter spaces reads so they average a number of bytes per second.
+// Each read is let through once the ones before it have had their time, so
+// the limit holds whatever the block size, and time spent waiting elsewhere,
+// like a pause, is not made up with a burst.
+type rateLimiter struct {
+	rate int64
+	next time.Time
+}
+
+// newRateLimiter limits to rate bytes per second, 0 lets everything through
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait returns a channel that fires when n more bytes may be read
+func (l *rateLimiter) wait(n int64) <-chan time.Time {
+	if l.rate <= 0 {
+		ready := make(chan time.Time, 1)
+		ready <- time.Now()
+		return ready
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	return time.After(delay)
+}
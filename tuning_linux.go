@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceQueueLimits reads the queue limits of the disk a device or image file
+// is on from sysfs. Partitions share the queue of their disk.
+func deviceQueueLimits(device string) queueLimits {
+	name, err := diskStatsName(device)
+	if err != nil {
+		return queueLimits{}
+	}
+	queue := filepath.Join("/sys/class/block", name, "queue")
+	if _, err := os.Stat(queue); err != nil {
+		queue = filepath.Join("/sys/class/block", name, "..", "queue")
+	}
+	value := func(file string) (int64, bool) {
+		data, err := os.ReadFile(filepath.Join(queue, file))
+		if err != nil {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		return n, err == nil
+	}
+
+	rotational, ok := value("rotational")
+	if !ok {
+		return queueLimits{}
+	}
+	limits := queueLimits{Known: true, Rotational: rotational == 1}
+	if n, ok := value("max_sectors_kb"); ok {
+		limits.MaxTransfer = n * kb
+	}
+	if n, ok := value("optimal_io_size"); ok {
+		limits.OptimalIO = n
+	}
+	if n, ok := value("nr_requests"); ok {
+		limits.Requests = int(n)
+	}
+	return limits
+}
+
+// dropCache evicts the cached pages of a file or device, so reading it back
+// reads what is on the disk. Written data has to be synced first.
+func dropCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
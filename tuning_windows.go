@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+// deviceQueueLimits is not implemented on Windows yet, the defaults are used
+func deviceQueueLimits(device string) queueLimits {
+	return queueLimits{}
+}
+
+// dropCache is not implemented on Windows yet, reads may come from the cache
+func dropCache(f *os.File) error {
+	return nil
+}
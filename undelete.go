@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// deletedEntry is a deleted file whose data may still be on disk
+type deletedEntry struct {
+	fsEntry
+	Path        string
+	Recoverable bool
+	Hint        string
+	open        func() (*io.SectionReader, error)
+}
+
+// fsUndeleter is implemented by the filesystems that can find deleted entries
+type fsUndeleter interface {
+	Deleted() ([]deletedEntry, error)
+}
+
+func fsListDeleted(spec, extractDir string) error {
+	image, fsys, err := openFileSystemSpec(spec)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	undeleter, ok := fsys.(fsUndeleter)
+	if !ok {
+		return fmt.Errorf("listing deleted files is not supported on %s", fsys.Type())
+	}
+
+	entries, err := undeleter.Deleted()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s filesystem, %d deleted entries:\n", fsys.Type(), len(entries))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), e.Path, e.Hint)
+	}
+	w.Flush()
+
+	if extractDir == "" {
+		return nil
+	}
+
+	fmt.Printf("\nExtracting recoverable files to %s\n", extractDir)
+	for _, e := range entries {
+		if !e.Recoverable || e.Mode.IsDir() {
+			continue
+		}
+		destination := filepath.Join(extractDir, filepath.FromSlash(e.Path))
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return err
+		}
+		src, err := e.open()
+		if err != nil {
+			fmt.Printf("%s: %v\n", e.Path, err)
+			continue
+		}
+		dst, err := os.Create(destination)
+		if err != nil {
+			return err
+		}
+		n, err := copySparse(dst, src)
+		dst.Close()
+		if err != nil {
+			fmt.Printf("%s: %v\n", e.Path, err)
+			continue
+		}
+		fmt.Printf("%s (%s)\n", destination, formatBytes(n))
+	}
+	return nil
+}
+
+// Deleted walks every live directory looking for 0xE5 entries. The cluster
+// chain of a deleted file is gone, so recovery assumes the data was contiguous.
+func (f *fatFS) Deleted() ([]deletedEntry, error) {
+	var result []deletedEntry
+	var walk func(dir string, cluster uint32, depth int) error
+	walk = func(dir string, cluster uint32, depth int) error {
+		if depth > 32 {
+			return nil
+		}
+		entries, err := f.readDirEntries(cluster, true)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			entryPath := path.Join(dir, e.Name)
+			if !e.Deleted {
+				if e.Mode.IsDir() {
+					if err := walk(entryPath, e.Cluster, depth+1); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			result = append(result, f.deletedEntry(entryPath, e))
+		}
+		return nil
+	}
+
+	return result, walk("/", 0, 0)
+}
+
+func (f *fatFS) deletedEntry(entryPath string, e fatDirEntry) deletedEntry {
+	d := deletedEntry{fsEntry: e.fsEntry, Path: entryPath}
+
+	clusterCount := (e.Size + f.clusterSize - 1) / f.clusterSize
+	switch {
+	case e.Mode.IsDir():
+		d.Hint = "deleted directory"
+		return d
+	case e.Size == 0:
+		d.Hint = "empty file"
+		return d
+	case e.Cluster < 2 || uint64(e.Cluster)+uint64(clusterCount) > uint64(f.clusterCount)+2:
+		d.Hint = "unrecoverable, invalid start cluster"
+		return d
+	}
+
+	clusters := make([]uint32, clusterCount)
+	reused := 0
+	for i := range clusters {
+		clusters[i] = e.Cluster + uint32(i)
+		if f.allocated(clusters[i]) {
+			reused++
+		}
+	}
+
+	d.Recoverable = reused == 0
+	if d.Recoverable {
+		d.Hint = "good, clusters are free (assumes unfragmented data)"
+	} else {
+		d.Hint = fmt.Sprintf("overwritten, %d of %d clusters reused", reused, clusterCount)
+	}
+	d.open = func() (*io.SectionReader, error) {
+		return io.NewSectionReader(&clusterReader{fs: f, clusters: clusters}, 0, e.Size), nil
+	}
+	return d
+}
+
+// allocated reports whether a cluster is in use according to the FAT
+func (f *fatFS) allocated(cluster uint32) bool {
+	next, ok := f.next(cluster)
+	return ok || next != 0
+}
+
+// Deleted scans the MFT for FILE records that are no longer in use
+func (n *ntfsFS) Deleted() ([]deletedEntry, error) {
+	// Without $Bitmap the clusters can still be read, only their state is unknown
+	bitmap, _ := n.clusterBitmap()
+
+	var result []deletedEntry
+	records := n.mft.Size / n.recordSize
+	for number := uint64(16); number < uint64(records); number++ {
+		record, err := n.readBaseRecord(number)
+		if err != nil || record.Flags&ntfsRecordInUse != 0 {
+			continue
+		}
+		fn := record.fileName()
+		if fn == nil {
+			continue
+		}
+
+		d := deletedEntry{fsEntry: n.entry(record), Path: path.Join(n.parentPath(fn.Parent), fn.Name)}
+		data := record.attribute(ntfsAttrData, "")
+		switch {
+		case record.Flags&ntfsRecordDirectory != 0:
+			d.Hint = "deleted directory"
+		case data == nil:
+			d.Hint = "unrecoverable, no data attribute"
+		case data.Resident:
+			d.Recoverable = true
+			d.Hint = "good, resident data"
+		default:
+			total, reused := int64(0), int64(0)
+			for _, run := range data.Runs {
+				if run.Sparse {
+					continue
+				}
+				for c := run.LCN; c < run.LCN+run.Length; c++ {
+					total++
+					if int(c/8) < len(bitmap) && bitmap[c/8]&(1<<(c%8)) != 0 {
+						reused++
+					}
+				}
+			}
+			d.Recoverable = reused == 0
+			switch {
+			case bitmap == nil:
+				d.Hint = "unknown, cluster bitmap unreadable"
+			case d.Recoverable:
+				d.Hint = "good, clusters are free"
+			default:
+				d.Hint = fmt.Sprintf("overwritten, %d of %d clusters reused", reused, total)
+			}
+		}
+
+		rec := record
+		d.open = func() (*io.SectionReader, error) {
+			return n.openData(rec)
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// clusterBitmap returns the allocation bitmap stored in $Bitmap (record 6)
+func (n *ntfsFS) clusterBitmap() ([]byte, error) {
+	record, err := n.readRecord(6)
+	if err != nil {
+		return nil, err
+	}
+	data := record.attribute(ntfsAttrData, "")
+	if data == nil {
+		return nil, nil
+	}
+	return n.attrData(data)
+}
+
+// parentPath rebuilds the path of a directory record by following parent references
+func (n *ntfsFS) parentPath(parent uint64) string {
+	var parts []string
+	for depth := 0; parent != ntfsRootRecord && depth < 64; depth++ {
+		record, err := n.readRecord(parent)
+		if err != nil {
+			return path.Join(append([]string{"/$orphan"}, parts...)...)
+		}
+		fn := record.fileName()
+		if fn == nil {
+			return path.Join(append([]string{"/$orphan"}, parts...)...)
+		}
+		parts = append([]string{fn.Name}, parts...)
+		parent = fn.Parent
+	}
+	return path.Join(append([]string{"/"}, parts...)...)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// maxListedRanges is how many differing ranges verify prints, the rest are counted
+const maxListedRanges = 20
+
+// byteRange is a range of offsets, End is exclusive
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// mismatchTracker merges differing bytes into ranges as blocks are compared
+type mismatchTracker struct {
+	ranges []byteRange
+	count  int
+	bytes  int64
+	last   byteRange
+}
+
+// add records the bytes in [start, end) as differing
+func (t *mismatchTracker) add(start, end int64) {
+	t.bytes += end - start
+	if t.count > 0 && start == t.last.End {
+		t.last.End = end
+		if len(t.ranges) > 0 && t.ranges[len(t.ranges)-1].Start == t.last.Start {
+			t.ranges[len(t.ranges)-1] = t.last
+		}
+		return
+	}
+	t.count++
+	t.last = byteRange{start, end}
+	if len(t.ranges) < maxListedRanges {
+		t.ranges = append(t.ranges, t.last)
+	}
+}
+
+// compare records the differences between two blocks read at offset
+func (t *mismatchTracker) compare(a, b []byte, offset int64) {
+	if bytes.Equal(a, b) {
+		return
+	}
+	for i := 0; i < len(a); {
+		if a[i] == b[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(a) && a[j] != b[j] {
+			j++
+		}
+		t.add(offset+int64(i), offset+int64(j))
+		i = j
+	}
+}
+
+// verifyImage decompresses an image on the fly and compares it block by block
+// against a device, reporting the first mismatch and the differing ranges
+func verifyImage(imagePath, device string) error {
+	image, algorithm, err := openDecompressionReader(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	disk, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	deviceSize, err := getFileSize(disk)
+	if err != nil {
+		return err
+	}
+
+	// A smart image is compared against the ranges of its block map
+	var (
+		target   io.ReaderAt = disk
+		physical             = func(off int64) int64 { return off }
+	)
+	blocks, err := readBlockMap(imagePath)
+	if err != nil {
+		return err
+	}
+	if blocks != nil {
+		if blocks.Size != deviceSize {
+			warnf(warnSizeMismatch, device, "the image is of a %s disk, %s has %s", formatBytes(blocks.Size), device, formatBytes(deviceSize))
+		}
+		view := newRangesReader(disk, clampRanges(blocks.Ranges, deviceSize))
+		target, physical, deviceSize = view, view.physical, view.size
+		fmt.Printf("Comparing the %s in %d ranges of the block map\n", formatBytes(view.size), len(blocks.Ranges))
+	}
+
+	// The raw size of a compressed image is only known at its end, images are
+	// usually of the whole device so its size gives the estimate
+	totalSize := deviceSize
+	if algorithm == "" && !isURL(imagePath) {
+		if info, err := os.Stat(imagePath); err == nil && info.Mode().IsRegular() {
+			totalSize = min(info.Size(), deviceSize)
+		}
+		algorithm = "raw"
+	}
+	fmt.Printf("Verifying %s image %s against %s\n", algorithm, imagePath, device)
+
+	listenForPause()
+	var (
+		mismatches mismatchTracker
+		compared   int64
+		start      = time.Now()
+		imageBuf   = make([]byte, 4*mb)
+		deviceBuf  = make([]byte, 4*mb)
+		display    = startProgressDisplay("", nil)
+	)
+	display.detail = func() string { return formatBytes(mismatches.bytes) + " differing" }
+
+	imageLonger := false
+	for {
+		n, err := io.ReadFull(image, imageBuf)
+		if n > 0 {
+			if compared+int64(n) > deviceSize {
+				imageLonger = true
+				n = int(deviceSize - compared)
+			}
+			if _, err := target.ReadAt(deviceBuf[:n], compared); err != nil && err != io.EOF {
+				display.stop()
+				return fmt.Errorf("reading %s at offset %d: %v", device, physical(compared), err)
+			}
+			mismatches.compare(imageBuf[:n], deviceBuf[:n], compared)
+			compared += int64(n)
+			reportProgress("verifying", compared, totalSize)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF || imageLonger {
+			break
+		}
+		if err != nil {
+			display.stop()
+			return fmt.Errorf("reading %s: %v", imagePath, err)
+		}
+		start = start.Add(pausePoint(display.Bypass(), nil))
+	}
+	totalSize = compared
+	display.stop()
+
+	elapsed := time.Since(start)
+	fmt.Printf("Compared %s in %s (%.2f MB/s)\n", formatBytes(compared), elapsed.Truncate(time.Second), float64(compared)/mb/elapsed.Seconds())
+	if compared < deviceSize && !imageLonger {
+		fmt.Printf("The image ends %s before the end of %s, the rest was not compared\n", formatBytes(deviceSize-compared), device)
+	}
+
+	if mismatches.count == 0 && !imageLonger {
+		fmt.Printf("%sVerified, %s matches the image%s\n", green, device, reset)
+		return nil
+	}
+	if mismatches.count > 0 {
+		first := physical(mismatches.ranges[0].Start)
+		fmt.Printf("%sFirst mismatch at offset %d (sector %d)%s\n", red, first, first/int64(getSectorSize(disk)), reset)
+		fmt.Printf("%d differing ranges, %s in total:\n", mismatches.count, formatBytes(mismatches.bytes))
+		for _, r := range mismatches.ranges {
+			start := physical(r.Start)
+			fmt.Printf("  %d-%d (%s)\n", start, start+r.End-r.Start-1, formatBytes(r.End-r.Start))
+		}
+		if mismatches.count > len(mismatches.ranges) {
+			fmt.Printf("  ... and %d more\n", mismatches.count-len(mismatches.ranges))
+		}
+	}
+	if imageLonger {
+		return fmt.Errorf("the image is larger than %s (%s)", device, formatBytes(deviceSize))
+	}
+	return fmt.Errorf("%s does not match %s", device, imagePath)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+	"unicode/utf16"
+)
+
+// VHD and VHDX images attach in Hyper-V and Windows Disk Management. A fixed
+// image keeps the disk at its own offsets, so the blocks that are left out
+// are holes in the file. A dynamic image places only the blocks with data
+// and maps them with a block allocation table (BAT).
+
+const (
+	vhdBlockSize = 2 * mb
+	vhdMaxSize   = 2040 * gb
+	vhdNoOffset  = ^uint64(0)
+	vhdUnused    = ^uint32(0)
+)
+
+// vhdWriter writes a VHD image, all fields are big endian
+type vhdWriter struct {
+	file   *os.File
+	size   int64
+	fixed  bool
+	bat    []uint32 // sector of each block, vhdUnused if it is not stored
+	next   int64    // where the next block goes in a dynamic image
+	stored int64
+	id     [16]byte
+}
+
+func newVHDWriter(file *os.File, size int64, fixed bool) (blockImageWriter, error) {
+	size = (size + 511) &^ 511
+	if size > vhdMaxSize {
+		return nil, fmt.Errorf("VHD images hold up to %s, use vhdx for this disk", formatBytes(vhdMaxSize))
+	}
+	id, err := randomGUID()
+	if err != nil {
+		return nil, err
+	}
+	v := &vhdWriter{file: file, size: size, fixed: fixed, id: id}
+	if !fixed {
+		v.bat = make([]uint32, (size+vhdBlockSize-1)/vhdBlockSize)
+		for i := range v.bat {
+			v.bat[i] = vhdUnused
+		}
+		// The footer copy, the dynamic header and the BAT come first, blocks
+		// start one bitmap sector before a 4K boundary so their data is
+		// aligned, and a block takes a 4K step for its bitmap to stay so
+		batEnd := 1536 + (int64(len(v.bat))*4+511)&^511
+		v.next = (batEnd+512+4095)&^4095 - 512
+	}
+	return v, nil
+}
+
+func (v *vhdWriter) writeBlock(index int64, data []byte) error {
+	if v.fixed {
+		at := index * int64(len(data))
+		data = data[:min(int64(len(data)), v.size-at)]
+		v.stored += int64(len(data))
+		_, err := v.file.WriteAt(data, at)
+		return err
+	}
+	// Every block starts with a bitmap of the sectors it holds, which is all of them
+	bitmap := make([]byte, 512)
+	for i := range bitmap {
+		bitmap[i] = 0xff
+	}
+	if _, err := v.file.WriteAt(bitmap, v.next); err != nil {
+		return err
+	}
+	if _, err := v.file.WriteAt(data, v.next+512); err != nil {
+		return err
+	}
+	v.bat[index] = uint32(v.next / 512)
+	v.next += 4*kb + vhdBlockSize
+	v.stored += vhdBlockSize
+	return nil
+}
+
+func (v *vhdWriter) allocated() int64 {
+	return v.stored
+}
+
+// finish writes the footer, and for a dynamic image its copy at the start,
+// the dynamic header and the BAT
+func (v *vhdWriter) finish() error {
+	if v.fixed {
+		if _, err := v.file.WriteAt(v.footer(), v.size); err != nil {
+			return err
+		}
+		return v.file.Truncate(v.size + 512)
+	}
+
+	bat := make([]byte, (len(v.bat)*4+511)&^511)
+	for i := range bat {
+		bat[i] = 0xff
+	}
+	for i, sector := range v.bat {
+		binary.BigEndian.PutUint32(bat[i*4:], sector)
+	}
+	if _, err := v.file.WriteAt(bat, 1536); err != nil {
+		return err
+	}
+
+	header := make([]byte, 1024)
+	copy(header, "cxsparse")
+	binary.BigEndian.PutUint64(header[8:], vhdNoOffset)
+	binary.BigEndian.PutUint64(header[16:], 1536) // BAT offset
+	binary.BigEndian.PutUint32(header[24:], 0x00010000)
+	binary.BigEndian.PutUint32(header[28:], uint32(len(v.bat)))
+	binary.BigEndian.PutUint32(header[32:], vhdBlockSize)
+	binary.BigEndian.PutUint32(header[36:], vhdChecksum(header))
+	if _, err := v.file.WriteAt(header, 512); err != nil {
+		return err
+	}
+
+	footer := v.footer()
+	if _, err := v.file.WriteAt(footer, 0); err != nil {
+		return err
+	}
+	if _, err := v.file.WriteAt(footer, v.next); err != nil {
+		return err
+	}
+	return v.file.Truncate(v.next + 512)
+}
+
+// footer is the 512 byte record that ends every VHD
+func (v *vhdWriter) footer() []byte {
+	footer := make([]byte, 512)
+	copy(footer, "conectix")
+	binary.BigEndian.PutUint32(footer[8:], 2) // features, always set
+	binary.BigEndian.PutUint32(footer[12:], 0x00010000)
+	diskType, dataOffset := uint32(3), uint64(512)
+	if v.fixed {
+		diskType, dataOffset = 2, vhdNoOffset
+	}
+	binary.BigEndian.PutUint64(footer[16:], dataOffset)
+	binary.BigEndian.PutUint32(footer[24:], uint32(time.Since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Seconds()))
+	copy(footer[28:], "dskt")
+	binary.BigEndian.PutUint32(footer[32:], 0x00010000)
+	copy(footer[36:], "Wi2k")
+	binary.BigEndian.PutUint64(footer[40:], uint64(v.size))
+	binary.BigEndian.PutUint64(footer[48:], uint64(v.size))
+	binary.BigEndian.PutUint32(footer[56:], vhdGeometry(v.size))
+	binary.BigEndian.PutUint32(footer[60:], diskType)
+	copy(footer[68:], v.id[:])
+	binary.BigEndian.PutUint32(footer[64:], vhdChecksum(footer))
+	return footer
+}
+
+// vhdChecksum is the one's complement of the byte sum, with the checksum field still zero
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// vhdGeometry packs the CHS geometry the VHD specification derives from the size
+func vhdGeometry(size int64) uint32 {
+	sectors := min(size/512, 65535*16*255)
+	var spt, heads, cylHeads int64
+	if sectors >= 65535*16*63 {
+		spt, heads = 255, 16
+		cylHeads = sectors / spt
+	} else {
+		spt = 17
+		cylHeads = sectors / spt
+		heads = max((cylHeads+1023)/1024, 4)
+		if cylHeads >= heads*1024 || heads > 16 {
+			spt, heads = 31, 16
+			cylHeads = sectors / spt
+		}
+		if cylHeads >= heads*1024 {
+			spt, heads = 63, 16
+			cylHeads = sectors / spt
+		}
+	}
+	return uint32(cylHeads/heads)<<16 | uint32(heads)<<8 | uint32(spt)
+}
+
+// A VHDX starts with 1 MB of identifier, two headers and two region tables,
+// then come the log, the metadata region and the BAT, each 1 MB aligned, and
+// the payload blocks. All fields are little endian and the checksums are CRC-32C.
+const (
+	vhdxBlockSize       = 2 * mb
+	vhdxMaxSize         = 64 * tb
+	vhdxLogOffset       = 1 * mb
+	vhdxMetadataOffset  = 2 * mb
+	vhdxBATOffset       = 3 * mb
+	vhdxMetadataItems   = 64 * kb // where the metadata values start in their region
+	vhdxFullyPresent    = 6       // payload block state in a BAT entry
+	vhdxVirtualDiskItem = 1 << 1  // metadata item flags
+	vhdxRequiredItem    = 1 << 2
+	vhdxLeaveAllocated  = 1 << 0 // file parameter flag of fixed images
+)
+
+var (
+	vhdxCRC = crc32.MakeTable(crc32.Castagnoli)
+
+	vhdxBATRegion       = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion  = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters  = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxVirtualDiskID   = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSector   = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSector  = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// mustParseGUID parses the GUID constants of the formats
+func mustParseGUID(s string) [16]byte {
+	g, err := parseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// vhdxWriter writes a VHDX image
+type vhdxWriter struct {
+	file       *os.File
+	size       int64
+	sectorSize int64
+	fixed      bool
+	bat        []uint64 // file offset of each payload block, 0 if it is not stored
+	dataStart  int64
+	next       int64 // where the next block goes in a dynamic image
+	stored     int64
+	id         [16]byte
+}
+
+func newVHDXWriter(file *os.File, size, sectorSize int64, fixed bool) (blockImageWriter, error) {
+	if sectorSize != 4096 {
+		sectorSize = 512
+	}
+	size = (size + sectorSize - 1) / sectorSize * sectorSize
+	if size > vhdxMaxSize {
+		return nil, fmt.Errorf("VHDX images hold up to %s", formatBytes(vhdxMaxSize))
+	}
+	id, err := randomGUID()
+	if err != nil {
+		return nil, err
+	}
+	v := &vhdxWriter{file: file, size: size, sectorSize: sectorSize, fixed: fixed, id: id}
+	v.bat = make([]uint64, (size+vhdxBlockSize-1)/vhdxBlockSize)
+	v.dataStart = vhdxBATOffset + (int64(v.batEntries())*8+mb-1)&^(mb-1)
+	v.next = v.dataStart
+	if fixed {
+		for i := range v.bat {
+			v.bat[i] = uint64(v.dataStart + int64(i)*vhdxBlockSize)
+		}
+	}
+	return v, nil
+}
+
+// chunkRatio is how many payload blocks share a sector bitmap block, the BAT
+// has an entry for the bitmap after each such run
+func (v *vhdxWriter) chunkRatio() int {
+	return int((1 << 23) * v.sectorSize / vhdxBlockSize)
+}
+
+func (v *vhdxWriter) batEntries() int {
+	return len(v.bat) + (len(v.bat)-1)/v.chunkRatio()
+}
+
+func (v *vhdxWriter) writeBlock(index int64, data []byte) error {
+	if v.fixed {
+		at := index * int64(len(data))
+		data = data[:min(int64(len(data)), v.size-at)]
+		v.stored += int64(len(data))
+		_, err := v.file.WriteAt(data, v.dataStart+at)
+		return err
+	}
+	if _, err := v.file.WriteAt(data, v.next); err != nil {
+		return err
+	}
+	v.bat[index] = uint64(v.next)
+	v.next += vhdxBlockSize
+	v.stored += vhdxBlockSize
+	return nil
+}
+
+func (v *vhdxWriter) allocated() int64 {
+	return v.stored
+}
+
+// finish writes the BAT, the metadata, the region tables, the headers and
+// the file identifier
+func (v *vhdxWriter) finish() error {
+	bat := make([]byte, v.dataStart-vhdxBATOffset)
+	ratio := v.chunkRatio()
+	for i, offset := range v.bat {
+		if offset == 0 {
+			continue
+		}
+		// The offset is in MB above the 20 state bits
+		entry := uint64(offset) | vhdxFullyPresent
+		binary.LittleEndian.PutUint64(bat[(i+i/ratio)*8:], entry)
+	}
+	if _, err := v.file.WriteAt(bat, vhdxBATOffset); err != nil {
+		return err
+	}
+	if _, err := v.file.WriteAt(v.metadata(), vhdxMetadataOffset); err != nil {
+		return err
+	}
+
+	regions := make([]byte, 64*kb)
+	copy(regions, "regi")
+	binary.LittleEndian.PutUint32(regions[8:], 2)
+	for i, region := range []struct {
+		guid   [16]byte
+		offset int64
+		length int64
+	}{
+		{vhdxBATRegion, vhdxBATOffset, int64(len(bat))},
+		{vhdxMetadataRegion, vhdxMetadataOffset, mb},
+	} {
+		entry := regions[16+i*32:]
+		copy(entry, region.guid[:])
+		binary.LittleEndian.PutUint64(entry[16:], uint64(region.offset))
+		binary.LittleEndian.PutUint32(entry[24:], uint32(region.length))
+		binary.LittleEndian.PutUint32(entry[28:], 1) // required
+	}
+	binary.LittleEndian.PutUint32(regions[4:], crc32.Checksum(regions, vhdxCRC))
+	for _, at := range []int64{192 * kb, 256 * kb} {
+		if _, err := v.file.WriteAt(regions, at); err != nil {
+			return err
+		}
+	}
+
+	fileWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	dataWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	for i, at := range []int64{64 * kb, 128 * kb} {
+		header := make([]byte, 4*kb)
+		copy(header, "head")
+		binary.LittleEndian.PutUint64(header[8:], uint64(i)) // sequence number, the higher one is current
+		copy(header[16:], fileWrite[:])
+		copy(header[32:], dataWrite[:])
+		binary.LittleEndian.PutUint16(header[66:], 1)  // version
+		binary.LittleEndian.PutUint32(header[68:], mb) // the log is empty
+		binary.LittleEndian.PutUint64(header[72:], vhdxLogOffset)
+		binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(header, vhdxCRC))
+		if _, err := v.file.WriteAt(header, at); err != nil {
+			return err
+		}
+	}
+
+	identifier := make([]byte, 8+512)
+	copy(identifier, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("dsktool " + appversion)) {
+		binary.LittleEndian.PutUint16(identifier[8+i*2:], c)
+	}
+	if _, err := v.file.WriteAt(identifier, 0); err != nil {
+		return err
+	}
+
+	end := v.next
+	if v.fixed {
+		end = v.dataStart + int64(len(v.bat))*vhdxBlockSize
+	}
+	return v.file.Truncate(end)
+}
+
+// metadata builds the metadata region, a table of items with their values after it
+func (v *vhdxWriter) metadata() []byte {
+	region := make([]byte, mb)
+	copy(region, "metadata")
+
+	params := make([]byte, 8)
+	binary.LittleEndian.PutUint32(params, vhdxBlockSize)
+	if v.fixed {
+		binary.LittleEndian.PutUint32(params[4:], vhdxLeaveAllocated)
+	}
+	items := []struct {
+		guid  [16]byte
+		flags uint32
+		value []byte
+	}{
+		{vhdxFileParameters, vhdxRequiredItem, params},
+		{vhdxVirtualDiskSize, vhdxVirtualDiskItem | vhdxRequiredItem, binary.LittleEndian.AppendUint64(nil, uint64(v.size))},
+		{vhdxVirtualDiskID, vhdxVirtualDiskItem | vhdxRequiredItem, v.id[:]},
+		{vhdxLogicalSector, vhdxVirtualDiskItem | vhdxRequiredItem, binary.LittleEndian.AppendUint32(nil, uint32(v.sectorSize))},
+		{vhdxPhysicalSector, vhdxVirtualDiskItem | vhdxRequiredItem, binary.LittleEndian.AppendUint32(nil, uint32(v.sectorSize))},
+	}
+	binary.LittleEndian.PutUint16(region[10:], uint16(len(items)))
+	at := vhdxMetadataItems
+	for i, item := range items {
+		entry := region[32+i*32:]
+		copy(entry, item.guid[:])
+		binary.LittleEndian.PutUint32(entry[16:], uint32(at))
+		binary.LittleEndian.PutUint32(entry[20:], uint32(len(item.value)))
+		binary.LittleEndian.PutUint32(entry[24:], item.flags)
+		copy(region[at:], item.value)
+		at += len(item.value)
+	}
+	return region
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Warnings are conditions a command notices that do not stop it. Each has a
+// stable code for scripts to react to, they go with the message into the
+// --progress json events, the state file, the session record, the image
+// manifest and DSKTOOL_WARNINGS of hooks.
+
+// Warning codes. Scripts match on these, so they never change.
+const (
+	warnGPTPrimaryDamaged  = "gpt-primary-damaged"
+	warnGPTSectorSize      = "gpt-sector-size-mismatch"
+	warnSectorSize         = "sector-size-mismatch"
+	warnGPTBackupMissing   = "gpt-backup-missing"
+	warnMisaligned         = "partition-misaligned"
+	warnUnreadable         = "unreadable-region"
+	warnSizeMismatch       = "size-mismatch"
+	warnLowSpace           = "low-free-space"
+	warnDeviceActivity     = "device-activity"
+	warnDeviceBusy         = "device-busy"
+	warnRereadFailed       = "partition-table-reread-failed"
+	warnPartitionNumbering = "partition-numbers-changed"
+	warnFilesystemNotGrown = "filesystem-not-grown"
+	warnIrreversible       = "irreversible-operation"
+	warnWSL                = "wsl"
+	warnEBRLoop            = "ebr-chain-loop"
+)
+
+// warning is one condition a command noticed
+type warning struct {
+	Code    string `json:"code"`
+	Device  string `json:"device,omitempty"`
+	Message string `json:"message"`
+}
+
+var (
+	warningsMu sync.Mutex
+	// commandWarnings are the warnings of the running command
+	commandWarnings []warning
+	// outputFormat is the --format of the running command, warnings stay
+	// off stdout when it is machine readable
+	outputFormat string
+)
+
+// warnf records a warning and shows it, in yellow on the terminal, or as a
+// JSON line on stderr when the command prints JSON
+func warnf(code, device, format string, args ...any) {
+	addWarning(warning{Code: code, Device: device, Message: fmt.Sprintf(format, args...)})
+}
+
+// addWarning records and shows a warning made elsewhere
+func addWarning(w warning) {
+	warningsMu.Lock()
+	commandWarnings = append(commandWarnings, w)
+	warningsMu.Unlock()
+
+	reportWarning(w)
+
+	switch outputFormat {
+	case "", "text":
+		fmt.Fprintf(messageOutput(os.Stdout), "%sWarning: %s%s\n", yellow, w.Message, reset)
+	case "json":
+		data, _ := json.Marshal(struct {
+			Warning warning `json:"warning"`
+		}{w})
+		os.Stderr.Write(append(data, '\n'))
+	default:
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w.Message)
+	}
+}
+
+// rereadPartitionTableOrWarn asks the kernel to pick up a new partition
+// table, a failure only warns as the table is written
+func rereadPartitionTableOrWarn(file *os.File, device string) {
+	if err := rereadPartitionTable(file); err != nil {
+		warnf(warnRereadFailed, device, "the kernel could not re-read the partition table of %s (%v), a reboot or partprobe may be needed", device, err)
+	}
+}
+
+// warningCodes returns the codes of the command's warnings, each once
+func warningCodes() []string {
+	var codes []string
+	for _, w := range currentWarnings() {
+		if !containsString(codes, w.Code) {
+			codes = append(codes, w.Code)
+		}
+	}
+	return codes
+}
+
+// currentWarnings returns the warnings the command has recorded so far
+func currentWarnings() []warning {
+	warningsMu.Lock()
+	defer warningsMu.Unlock()
+	return append([]warning(nil), commandWarnings...)
+}
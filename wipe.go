@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wipePass is one overwrite of a device, with a byte or random data
+type wipePass struct {
+	Name   string
+	Fill   byte
+	Random bool
+}
+
+// wipePatterns are the patterns wipe writes, as their passes. dod is the
+// three passes of DoD 5220.22-M.
+var wipePatterns = map[string][]wipePass{
+	"zero":   {{Name: "zeros"}},
+	"random": {{Name: "random data", Random: true}},
+	"dod":    {{Name: "zeros"}, {Name: "ones", Fill: 0xff}, {Name: "random data", Random: true}},
+}
+
+// wipeOptions are the settings of a wipe
+type wipeOptions struct {
+	Pattern string // zero, random or dod
+	// Verify reads the device back after the last pass
+	Verify bool
+	// Sample reads back this percent of the device at random places instead
+	Sample float64
+	// Confirm is the device path typed on the command line instead of at the prompt
+	Confirm string
+	// AssumeYes skips the typed confirmation, for refurb that asks on its own
+	AssumeYes bool
+	// Certificate is the base name of a certificate of the wipe to write
+	Certificate string
+	// Operator signs the certificate off
+	Operator string
+}
+
+// wipeResult describes a completed overwrite of a device
+type wipeResult struct {
+	Pattern   string `json:"pattern"`
+	Passes    int    `json:"passes,omitempty"`
+	Partition int    `json:"partition,omitempty"`
+	// Offset and Length are the wiped area of the device
+	Offset   int64         `json:"offset,omitempty"`
+	Length   int64         `json:"length,omitempty"`
+	Bytes    int64         `json:"bytes"`
+	Started  time.Time     `json:"started,omitempty"`
+	Finished time.Time     `json:"finished,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+	// Seed is the AES-256 key of the random data of the last pass, in hex,
+	// which reproduces the data to check the wipe later
+	Seed         string            `json:"seed,omitempty"`
+	Verified     bool              `json:"verified,omitempty"`
+	Verification *wipeVerification `json:"verification,omitempty"`
+	DryRun       bool              `json:"dry_run,omitempty"`
+}
+
+// wipeVerification is how the last pass of a wipe was read back
+type wipeVerification struct {
+	Mode    string  `json:"mode"` // full or sample
+	Percent float64 `json:"percent,omitempty"`
+	Samples int     `json:"samples"`
+	Bytes   int64   `json:"bytes"`
+	// Finished is when the check was done
+	Finished time.Time `json:"finished"`
+}
+
+// wipeStream makes the data of a pass. Random passes are an AES-CTR
+// keystream, which the verify pass makes again from the same key.
+type wipeStream struct {
+	pass wipePass
+	key  []byte
+	ctr  cipher.Stream
+}
+
+// newWipeStream starts the data of a pass. Random passes use key, or a new
+// random key if it is nil.
+func newWipeStream(pass wipePass, key []byte) (*wipeStream, error) {
+	s := &wipeStream{pass: pass, key: key}
+	if pass.Random && key == nil {
+		s.key = make([]byte, 32)
+		if _, err := rand.Read(s.key); err != nil {
+			return nil, err
+		}
+	}
+	return s, s.seek(0)
+}
+
+// seek continues the data at an offset of the wiped area. The counter of
+// CTR mode counts AES blocks, so any offset can be reached directly.
+func (s *wipeStream) seek(offset int64) error {
+	if !s.pass.Random {
+		return nil
+	}
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	s.ctr = cipher.NewCTR(block, iv)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		s.ctr.XORKeyStream(discard, discard)
+	}
+	return nil
+}
+
+// fill writes the next len(buf) bytes of the pass into buf
+func (s *wipeStream) fill(buf []byte) {
+	if s.ctr == nil {
+		for i := range buf {
+			buf[i] = s.pass.Fill
+		}
+		return
+	}
+	clear(buf)
+	s.ctr.XORKeyStream(buf, buf)
+}
+
+// confirmTyped makes the user type the path of the device, or pass it as
+// --confirm, before it is erased
+func confirmTyped(spec, description, typed string) error {
+	if typed != "" {
+		if typed != spec {
+			return fmt.Errorf("--confirm %s does not match %s", typed, spec)
+		}
+		return nil
+	}
+	fmt.Fprintf(messageOutput(os.Stdout), "%sThis erases %s for good.%s\nType %s to go on: ", red, description, reset, spec)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil || strings.TrimSpace(answer) != spec {
+		return fmt.Errorf("aborted")
+	}
+	return nil
+}
+
+// wipeDevice overwrites a device, or partition N of DEVICE:N, with the passes
+// of a pattern through the device writer, so the write policy and --dry-run
+// apply
+func wipeDevice(spec, operation string, options wipeOptions) (*wipeResult, error) {
+	passes, ok := wipePatterns[options.Pattern]
+	if !ok {
+		return nil, fmt.Errorf("unknown pattern %q, use zero, random or dod", options.Pattern)
+	}
+	device, number := parsePartitionSpec(spec)
+	writer, err := openDeviceWriterTo(device, operation, io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	defer writer.Close()
+
+	area := byteRange{End: writer.Size}
+	description := fmt.Sprintf("all %s on %s", formatBytes(writer.Size), device)
+	if serial := diskSerial(device); serial != "" {
+		description += fmt.Sprintf(" (serial %s)", serial)
+	}
+	if number > 0 {
+		table, err := writer.partitionTable()
+		if err != nil {
+			return nil, fmt.Errorf("reading the partition table: %v", err)
+		}
+		part, err := table.findPartition(number)
+		if err != nil {
+			return nil, err
+		}
+		area.Start = part.Offset(table.SectorSize)
+		area.End = area.Start + part.Size(table.SectorSize)
+		description = fmt.Sprintf("partition %d of %s, %s", number, device, formatBytes(area.End-area.Start))
+	}
+	size := area.End - area.Start
+
+	result := &wipeResult{Pattern: options.Pattern, Passes: len(passes), Partition: number, DryRun: writer.DryRun}
+	if writer.DryRun {
+		fmt.Printf("Dry run: would overwrite %s with %s\n", description, wipePassNames(passes))
+		return result, nil
+	}
+	if !options.AssumeYes {
+		if err := confirmTyped(spec, description, options.Confirm); err != nil {
+			return nil, err
+		}
+	}
+
+	listenForPause()
+	display := startProgressDisplay("", nil)
+	defer display.stop()
+
+	stats := newDiskStatsSampler(device)
+	buf := make([]byte, 4*mb)
+	// The time left of the phase is shown, and of all passes and the
+	// verify pass when there are more
+	work := size * int64(len(passes))
+	if options.Verify {
+		work += size
+	} else if options.Sample > 0 {
+		work += int64(float64(size) * min(options.Sample, 100) / 100)
+	}
+	var done int64
+	start := time.Now()
+	display.detail = func() string {
+		if work == size || done == 0 || done >= work {
+			return ""
+		}
+		left := time.Duration(float64(work-done) / (float64(done) / time.Since(start).Seconds()) * float64(time.Second))
+		return fmt.Sprintf("%s left in all", left.Truncate(time.Second))
+	}
+	display.extra = func() []string { return []string{stats.progressLine()} }
+
+	result.Offset, result.Length, result.Started = area.Start, size, time.Now()
+	var stream *wipeStream
+	for i, pass := range passes {
+		if stream, err = newWipeStream(pass, nil); err != nil {
+			return result, err
+		}
+		display.setLabel(fmt.Sprintf("Pass %d of %d, %s, %s", i+1, len(passes), pass.Name, spec))
+		phase := fmt.Sprintf("wiping pass %d", i+1)
+		for offset := int64(0); offset < size; {
+			start = start.Add(pausePoint(display.Bypass(), writer.Sync))
+			n := min(int64(len(buf)), size-offset)
+			stream.fill(buf[:n])
+			if _, err := writer.WriteAt(buf[:n], area.Start+offset); err != nil {
+				return result, fmt.Errorf("writing at offset %d: %v", area.Start+offset, err)
+			}
+			offset += n
+			done += n
+			reportProgress(phase, offset, size)
+		}
+		if err := writer.Sync(); err != nil {
+			return result, err
+		}
+	}
+	result.Bytes = size * int64(len(passes))
+
+	if stream.pass.Random {
+		result.Seed = hex.EncodeToString(stream.key)
+	}
+
+	if options.Verify || options.Sample > 0 {
+		if err := dropCache(writer.File); err != nil {
+			return result, fmt.Errorf("dropping the cache before verifying: %v", err)
+		}
+		percent, step := 100.0, "Verifying"
+		if !options.Verify {
+			percent, step = options.Sample, "Verifying samples of"
+		}
+		display.setLabel(step + " " + spec)
+		var checked int64
+		result.Verification, err = checkWipe(writer, area, stream, percent, func(n, total int64) {
+			start = start.Add(pausePoint(display.Bypass(), nil))
+			checked += n
+			done += n
+			reportProgress("verifying wipe", checked, total)
+		})
+		if err != nil {
+			return result, fmt.Errorf("verifying: %v", err)
+		}
+		result.Verified = true
+	}
+
+	result.Finished = time.Now()
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// checkWipe reads an area back and compares it with the data of the last
+// pass. Below 100 percent it reads that share of the area in 1 MiB samples
+// at random places, always including the start and the end. progress is
+// called with the bytes of each chunk read and the bytes to read in all.
+func checkWipe(r io.ReaderAt, area byteRange, stream *wipeStream, percent float64, progress func(n, total int64)) (*wipeVerification, error) {
+	size := area.End - area.Start
+	check := &wipeVerification{Mode: "full"}
+	chunk := int64(4 * mb)
+	var offsets []int64
+	if count := int64(math.Ceil(float64(size) * percent / 100 / mb)); percent < 100 && count*mb < size {
+		check.Mode, check.Percent, chunk = "sample", percent, mb
+		offsets = append(offsets, 0, max(size-chunk, 0)&^(4*kb-1))
+		for i := int64(2); i < count; i++ {
+			offsets = append(offsets, mathrand.Int63n(max(size-chunk, 0)+1)&^(4*kb-1))
+		}
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	} else {
+		for offset := int64(0); offset < size; offset += chunk {
+			offsets = append(offsets, offset)
+		}
+	}
+
+	var total int64
+	for _, offset := range offsets {
+		total += min(chunk, size-offset)
+	}
+	buf, want := make([]byte, chunk), make([]byte, chunk)
+	for _, offset := range offsets {
+		n := min(chunk, size-offset)
+		if _, err := r.ReadAt(buf[:n], area.Start+offset); err != nil {
+			return nil, fmt.Errorf("reading back at offset %d: %v", area.Start+offset, err)
+		}
+		if err := stream.seek(offset); err != nil {
+			return nil, err
+		}
+		stream.fill(want[:n])
+		if !bytes.Equal(buf[:n], want[:n]) {
+			at := area.Start + offset
+			for j := range buf[:n] {
+				if buf[j] != want[j] {
+					at += int64(j)
+					break
+				}
+			}
+			return nil, fmt.Errorf("offset %d does not hold the %s written", at, stream.pass.Name)
+		}
+		check.Samples++
+		check.Bytes += n
+		progress(n, total)
+	}
+	check.Finished = time.Now()
+	return check, nil
+}
+
+// parseSamplePercent reads the --sample percent, 0 if it is not set
+func parseSamplePercent(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("--sample %s is no percent above 0 up to 100", value)
+	}
+	return percent, nil
+}
+
+// wipePassNames lists the passes of a pattern for messages
+func wipePassNames(passes []wipePass) string {
+	names := make([]string, len(passes))
+	for i, pass := range passes {
+		names[i] = pass.Name
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and then " + names[len(names)-1]
+}
+
+// wipe overwrites a device or partition and reports how it went
+func wipe(spec string, options wipeOptions) error {
+	result, err := wipeDevice(spec, "wipe", options)
+	if err != nil {
+		return err
+	}
+	if result.DryRun {
+		return nil
+	}
+	fmt.Printf("%sWiped %s with %s in %s", green, spec, wipePassNames(wipePatterns[result.Pattern]), result.Duration.Truncate(time.Second))
+	if v := result.Verification; v != nil && v.Mode == "sample" {
+		fmt.Printf(", verified %d samples", v.Samples)
+	} else if result.Verified {
+		fmt.Print(", verified")
+	}
+	fmt.Printf("%s\n", reset)
+	if options.Certificate != "" {
+		if err := writeWipeCertificate(options.Certificate, spec, result, options.Operator); err != nil {
+			return fmt.Errorf("writing the certificate: %v", err)
+		}
+	}
+	printResult("%s", spec)
+	return nil
+}
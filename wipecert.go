@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// wipeCertificate records a wipe and how it was verified. The seed of random
+// data and the wiped area let verify-wipe sample the device again later.
+// It is signed with the signing key, see signing.go.
+type wipeCertificate struct {
+	Tool     string      `json:"tool"`
+	Device   string      `json:"device"`
+	Serial   string      `json:"serial,omitempty"`
+	Size     int64       `json:"size"`
+	Passes   []string    `json:"passes"`
+	Wipe     *wipeResult `json:"wipe"`
+	Result   string      `json:"result"`
+	Operator string      `json:"operator,omitempty"`
+	documentSignature
+}
+
+// writeWipeCertificate writes the certificate of a wipe as base.json and
+// base.pdf
+func writeWipeCertificate(base, spec string, result *wipeResult, operator string) error {
+	device, _ := parsePartitionSpec(spec)
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	size := image.Size
+	image.Close()
+
+	var passes []string
+	for _, pass := range wipePatterns[result.Pattern] {
+		passes = append(passes, pass.Name)
+	}
+	cert := wipeCertificate{
+		Tool:     "dsktool " + appversion,
+		Device:   device,
+		Serial:   diskSerial(device),
+		Size:     size,
+		Passes:   passes,
+		Wipe:     result,
+		Result:   "not verified",
+		Operator: operator,
+	}
+	if result.Verified {
+		cert.Result = "verified"
+	}
+	if err := signDocument(&cert, &cert.documentSignature); err != nil {
+		return err
+	}
+
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".json"), ".pdf")
+	data, err := json.MarshalIndent(cert, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".json", append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".pdf", textPDF(cert.lines()), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Certificate written to %s.json and %s.pdf, signed with the key %s\n", base, base, cert.PublicKey)
+	return nil
+}
+
+// lines renders the certificate as text for the PDF
+func (c *wipeCertificate) lines() []string {
+	w := c.Wipe
+	area := "whole disk"
+	if w.Partition > 0 {
+		area = fmt.Sprintf("partition %d", w.Partition)
+	}
+	lines := []string{
+		"Data Sanitization Certificate",
+		"",
+		fmt.Sprintf("Device:        %s", c.Device),
+		fmt.Sprintf("Serial:        %s", c.Serial),
+		fmt.Sprintf("Capacity:      %s (%d bytes)", formatBytes(c.Size), c.Size),
+		fmt.Sprintf("Area:          %s, bytes %d to %d", area, w.Offset, w.Offset+w.Length),
+		fmt.Sprintf("Method:        overwrite, %s", strings.Join(c.Passes, ", ")),
+		fmt.Sprintf("Started:       %s", w.Started.Format(time.RFC1123)),
+		fmt.Sprintf("Finished:      %s", w.Finished.Format(time.RFC1123)),
+	}
+	if w.Seed != "" {
+		lines = append(lines, fmt.Sprintf("Random seed:   %s", w.Seed))
+	}
+	switch v := w.Verification; {
+	case v == nil:
+		lines = append(lines, "Verification:  none")
+	case v.Mode == "sample":
+		lines = append(lines, fmt.Sprintf("Verification:  %d samples, %s (%g%%), at %s", v.Samples, formatBytes(v.Bytes), v.Percent, v.Finished.Format(time.RFC1123)))
+	default:
+		lines = append(lines, fmt.Sprintf("Verification:  full read back, %s, at %s", formatBytes(v.Bytes), v.Finished.Format(time.RFC1123)))
+	}
+	lines = append(lines, "", fmt.Sprintf("RESULT:        %s", strings.ToUpper(c.Result)), "")
+	if c.Operator != "" {
+		lines = append(lines, fmt.Sprintf("Signed off by: %s", c.Operator))
+	}
+	lines = append(lines, fmt.Sprintf("Tool:          %s", c.Tool), "")
+	return append(lines, c.documentSignature.lines()...)
+}
+
+// verifyWipeCertificate checks the signature of a certificate, against the
+// trusted public key if one is given, and samples the device again for the
+// data of the last pass, to show it is still wiped
+func verifyWipeCertificate(path, device, publicKey string, percent float64) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cert wipeCertificate
+	if err := json.Unmarshal(data, &cert); err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+	if cert.Wipe == nil {
+		return fmt.Errorf("%s is no wipe certificate", path)
+	}
+	if err := verifyDocument(&cert, &cert.documentSignature, publicKey); err != nil {
+		return fmt.Errorf("the certificate %s: %v", path, err)
+	}
+	fmt.Printf("Certificate signature matches, %s wiped with %s on %s\n", cert.Device, strings.Join(cert.Passes, ", "),
+		cert.Wipe.Finished.Format(time.RFC1123))
+	if publicKey == "" {
+		fmt.Printf("Signed with the key %s, --public-key checks that it is yours\n", cert.PublicKey)
+	}
+
+	if device == "" {
+		device = cert.Device
+	}
+	if serial := diskSerial(device); cert.Serial != "" && serial != "" && serial != cert.Serial {
+		return fmt.Errorf("%s has serial %s, the certificate is for serial %s", device, serial, cert.Serial)
+	}
+	passes := wipePatterns[cert.Wipe.Pattern]
+	if len(passes) == 0 {
+		return fmt.Errorf("unknown pattern %q in the certificate", cert.Wipe.Pattern)
+	}
+	var key []byte
+	if cert.Wipe.Seed != "" {
+		if key, err = hex.DecodeString(cert.Wipe.Seed); err != nil {
+			return fmt.Errorf("reading the seed: %v", err)
+		}
+	}
+	stream, err := newWipeStream(passes[len(passes)-1], key)
+	if err != nil {
+		return err
+	}
+
+	image, err := openImage(device, false)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	if image.Size != cert.Size {
+		return fmt.Errorf("%s holds %s, the certificate is for %s", device, formatBytes(image.Size), formatBytes(cert.Size))
+	}
+	area := byteRange{Start: cert.Wipe.Offset, End: cert.Wipe.Offset + cert.Wipe.Length}
+	var checked int64
+	display := startProgressDisplay("", nil)
+	check, err := checkWipe(image, area, stream, percent, func(n, total int64) {
+		checked += n
+		reportProgress("verifying wipe", checked, total)
+	})
+	display.stop()
+	if err != nil {
+		return fmt.Errorf("%s is not wiped as certified: %v", device, err)
+	}
+	fmt.Printf("%s%s holds the %s written, %d samples, %s checked%s\n", green, device, stream.pass.Name, check.Samples, formatBytes(check.Bytes), reset)
+	printResult("%s", device)
+	return nil
+}
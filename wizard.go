@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The wizard walks through the common tasks with plain questions and then
+// runs the same dsktool commands a user would type, printing each one first
+// so it can be repeated or put in a script later.
+
+// wizardDisk is a disk offered in the wizard's picker
+type wizardDisk struct {
+	Path   string
+	Size   int64
+	Serial string
+	Parts  []string // partitions with what they hold
+	Mounts []string // where its partitions are mounted
+}
+
+type wizard struct {
+	in   *bufio.Reader
+	self string
+}
+
+// runWizard asks what to do and walks through it
+func runWizard() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	w := &wizard{in: bufio.NewReader(os.Stdin), self: self}
+
+	fmt.Println("This wizard asks a few questions and then runs the dsktool commands for you.")
+	fmt.Println("Nothing is written before you confirm it, press Ctrl+C to leave at any time.")
+	fmt.Println()
+	task, err := w.choose("What would you like to do?", []string{
+		"Back up a disk into an image file",
+		"Restore an image file onto a disk",
+		"Prepare a USB stick",
+	})
+	if err != nil {
+		return err
+	}
+	switch task {
+	case 0:
+		return w.backup()
+	case 1:
+		return w.restore()
+	default:
+		return w.prepareUSB()
+	}
+}
+
+// line reads one answer, running out of input ends the wizard
+func (w *wizard) line() (string, error) {
+	answer, err := w.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if err != nil && answer == "" {
+		return "", fmt.Errorf("no answer, leaving the wizard")
+	}
+	return answer, nil
+}
+
+// ask prints a question and returns the answer, or def for an empty one
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := w.line()
+	if err != nil || answer != "" {
+		return answer, err
+	}
+	return def, nil
+}
+
+// yes asks a yes/no question
+func (w *wizard) yes(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		fmt.Printf("%s [%s]: ", question, hint)
+		answer, err := w.line()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Println("Please answer y or n.")
+	}
+}
+
+// choose shows numbered options and returns the index of the chosen one
+func (w *wizard) choose(question string, options []string) (int, error) {
+	fmt.Println(question)
+	for i, option := range options {
+		fmt.Printf("  %d) %s\n", i+1, option)
+	}
+	for {
+		answer, err := w.ask("Enter a number", "")
+		if err != nil {
+			return 0, err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+			return n - 1, nil
+		}
+		fmt.Printf("Please enter a number from 1 to %d.\n", len(options))
+	}
+}
+
+// askFile asks for an existing file
+func (w *wizard) askFile(question string) (string, error) {
+	for {
+		path, err := w.ask(question, "")
+		if err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+		fmt.Printf("%s%s is not a file, please check the name.%s\n", red, path, reset)
+	}
+}
+
+// wizardDisks lists the disks with their partitions and mounts
+func wizardDisks() ([]wizardDisk, error) {
+	records, err := diskRecords()
+	if err != nil {
+		return nil, err
+	}
+	var disks []wizardDisk
+	index := map[string]int{}
+	for _, r := range records {
+		// path, parent, kind, size, fstype, label, mountpoint, total, used, free, serial, tags
+		size, _ := strconv.ParseInt(r[3], 10, 64)
+		if r[2] == "disk" {
+			index[r[0]] = len(disks)
+			disks = append(disks, wizardDisk{Path: r[0], Size: size, Serial: r[10]})
+			continue
+		}
+		i, ok := index[r[1]]
+		if !ok {
+			continue
+		}
+		if r[2] == "part" {
+			index[r[0]] = i
+			desc := strings.TrimSpace(fmt.Sprintf("%s %s %s", formatBytes(size), r[4], r[5]))
+			disks[i].Parts = append(disks[i].Parts, fmt.Sprintf("%s (%s)", r[0], desc))
+		}
+		if r[6] != "" {
+			disks[i].Mounts = append(disks[i].Mounts, r[6])
+		}
+	}
+	return disks, nil
+}
+
+// pickDisk shows the disks and returns the chosen one, a device or image
+// path can be typed instead of a number
+func (w *wizard) pickDisk(question string) (wizardDisk, error) {
+	disks, err := wizardDisks()
+	if err != nil {
+		return wizardDisk{}, err
+	}
+	fmt.Println(question)
+	for i, d := range disks {
+		line := fmt.Sprintf("  %d) %-16s %10s", i+1, d.Path, formatBytes(d.Size))
+		if d.Serial != "" {
+			line += "  serial " + d.Serial
+		}
+		if len(d.Mounts) > 0 {
+			line += "  in use at " + strings.Join(d.Mounts, ", ")
+		}
+		fmt.Println(line)
+	}
+	for {
+		answer, err := w.ask("Enter a number, or the path of a disk or image file", "")
+		if err != nil {
+			return wizardDisk{}, err
+		}
+		if n, err := strconv.Atoi(answer); err == nil {
+			if n >= 1 && n <= len(disks) {
+				return disks[n-1], nil
+			}
+			fmt.Printf("Please enter a number from 1 to %d.\n", len(disks))
+			continue
+		}
+		for _, d := range disks {
+			if d.Path == answer {
+				return d, nil
+			}
+		}
+		file, err := os.Open(answer)
+		if err != nil {
+			fmt.Printf("%sCannot open %s: %v%s\n", red, answer, err, reset)
+			continue
+		}
+		size, err := getFileSize(file)
+		file.Close()
+		if err != nil {
+			fmt.Printf("%sCannot read the size of %s: %v%s\n", red, answer, err, reset)
+			continue
+		}
+		return wizardDisk{Path: answer, Size: size}, nil
+	}
+}
+
+// confirmErase refuses disks in use and makes the user type the disk's name
+// before anything on it is replaced
+func (w *wizard) confirmErase(d wizardDisk) (bool, error) {
+	if len(d.Mounts) > 0 {
+		return false, fmt.Errorf("%s is in use at %s, unmount it first, or pick another disk", d.Path, strings.Join(d.Mounts, ", "))
+	}
+	fmt.Printf("%sEverything on %s (%s) will be replaced.%s\n", yellow, d.Path, formatBytes(d.Size), reset)
+	if len(d.Parts) > 0 {
+		fmt.Println("It holds:")
+		for _, part := range d.Parts {
+			fmt.Println("  " + part)
+		}
+	}
+	name := filepath.Base(d.Path)
+	answer, err := w.ask(fmt.Sprintf("Type %s to go ahead, anything else stops", name), "")
+	if err != nil {
+		return false, err
+	}
+	return answer == name || answer == d.Path, nil
+}
+
+// run shows a dsktool command and runs it, with input on its stdin if given
+func (w *wizard) run(input io.Reader, args ...string) error {
+	fmt.Printf("\n%sRunning: dsktool %s%s\n", green, strings.Join(args, " "), reset)
+	name := args[0]
+	if dryRun {
+		args = append([]string{"--dry-run"}, args...)
+	}
+	cmd := exec.Command(w.self, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if input != nil {
+		cmd.Stdin = input
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("dsktool %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// backup images a disk into a gzip file and can check it afterwards
+func (w *wizard) backup() error {
+	disk, err := w.pickDisk("Which disk do you want to back up?")
+	if err != nil {
+		return err
+	}
+	if len(disk.Mounts) > 0 {
+		fmt.Printf("%s%s is in use, files that change while it is copied may be inconsistent in the backup.%s\n", yellow, disk.Path, reset)
+	}
+
+	def := fmt.Sprintf("%s-%s", filepath.Base(disk.Path), time.Now().Format("2006-01-02"))
+	var file string
+	var overwrite bool
+	for {
+		if file, err = w.ask("Where should the backup go? .gz is added to the name", def); err != nil {
+			return err
+		}
+		if info, err := os.Stat(filepath.Dir(file)); err != nil || !info.IsDir() {
+			fmt.Printf("%sThe folder %s does not exist.%s\n", red, filepath.Dir(file), reset)
+			continue
+		}
+		if !imageTaken(file + ".gz") {
+			break
+		}
+		if overwrite, err = w.yes(fmt.Sprintf("There is a backup in %s.gz already. Replace it?", file), false); err != nil {
+			return err
+		}
+		if overwrite {
+			break
+		}
+	}
+
+	smart, err := w.yes("Copy only the space files use? It is faster and smaller and needs a partitioned disk", true)
+	if err != nil {
+		return err
+	}
+	verify, err := w.yes("Check the backup against the disk afterwards? This reads the disk again", true)
+	if err != nil {
+		return err
+	}
+
+	// The estimate shows the size, time and free space and asks before imaging
+	args := []string{"image", disk.Path, file, "--estimate", "8"}
+	if smart {
+		args = append(args, "--smart")
+	}
+	if overwrite {
+		args = append(args, "--overwrite")
+	}
+	if err := w.run(nil, args...); err != nil {
+		return err
+	}
+	if verify && !dryRun {
+		if err := w.run(nil, "verify", file+".gz", disk.Path); err != nil {
+			return err
+		}
+	}
+	if !dryRun {
+		fmt.Printf("\n%sThe backup is in %s.gz. To put it back, run the wizard again or: dsktool clone %s.gz DISK%s\n", green, file, file, reset)
+	}
+	return nil
+}
+
+// restore writes an image onto a disk
+func (w *wizard) restore() error {
+	image, err := w.askFile("Which image file do you want to restore?")
+	if err != nil {
+		return err
+	}
+	disk, err := w.pickDisk("Which disk should it be written to?")
+	if err != nil {
+		return err
+	}
+	return w.writeImage(image, disk)
+}
+
+// writeImage clones an image onto a disk after the user confirmed it
+func (w *wizard) writeImage(image string, disk wizardDisk) error {
+	ok, err := w.confirmErase(disk)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("stopped, nothing was written")
+	}
+	if err := w.run(nil, "clone", "--yes", "--verify", image, disk.Path); err != nil {
+		return err
+	}
+	if !dryRun {
+		fmt.Printf("\n%s%s was written to %s and checked.%s\n", green, image, disk.Path, reset)
+	}
+	return nil
+}
+
+// prepareUSB writes a bootable image onto a stick or makes it an empty FAT32 stick
+func (w *wizard) prepareUSB() error {
+	disk, err := w.pickDisk("Which disk is the USB stick?")
+	if err != nil {
+		return err
+	}
+	if disk.Size > 256*gb {
+		fmt.Printf("%s%s has %s, more than most USB sticks, make sure it is the right disk.%s\n", yellow, disk.Path, formatBytes(disk.Size), reset)
+	}
+
+	task, err := w.choose("What should be on it?", []string{
+		"A bootable image, like an installer .iso or .img",
+		"Nothing, an empty FAT32 stick for files that every system reads",
+	})
+	if err != nil {
+		return err
+	}
+	if task == 0 {
+		image, err := w.askFile("Which image file?")
+		if err != nil {
+			return err
+		}
+		return w.writeImage(image, disk)
+	}
+
+	label, err := w.ask("Name for the stick, up to 11 letters", "USB")
+	if err != nil {
+		return err
+	}
+	ok, err := w.confirmErase(disk)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("stopped, nothing was written")
+	}
+	// One partition over the whole stick, in an MBR table every system boots and reads
+	if err := w.run(strings.NewReader("label: dos\n,,c\n"), "table", "apply", "--yes", disk.Path); err != nil {
+		return err
+	}
+	if err := w.run(nil, "fs", "mkfs", "--label", label, disk.Path+":1", "fat32"); err != nil {
+		return err
+	}
+	if !dryRun {
+		fmt.Printf("\n%s%s is ready.%s\n", green, disk.Path, reset)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Inside WSL 2 the /dev/sd* disks are virtual disks of WSL itself, the
+// system distribution, swap and the ext4.vhdx of each distribution, or
+// Windows disks attached with wsl --mount. WSL 1 has no disks at all.
+
+// wslAttachHint tells how to give WSL 2 a Windows disk
+const wslAttachHint = `attach it from an administrator PowerShell with wsl --mount \\.\PHYSICALDRIVEn --bare`
+
+// wslVersion returns 1 or 2 inside WSL, 0 otherwise
+func wslVersion() int {
+	data, err := os.ReadFile("/proc/version")
+	if err != nil {
+		return 0
+	}
+	version := strings.ToLower(string(data))
+	switch {
+	case !strings.Contains(version, "microsoft"):
+		return 0
+	case strings.Contains(version, "wsl2") || strings.Contains(version, "microsoft-standard"):
+		return 2
+	}
+	return 1
+}
+
+// checkWSL warns that disks look different inside WSL
+func checkWSL() bool {
+	switch wslVersion() {
+	case 1:
+		warnf(warnWSL, "", "running inside WSL 1, which gives no access to disks. Run dsktool.exe on Windows, or convert the distribution with wsl --set-version DISTRO 2 and %s", wslAttachHint)
+	case 2:
+		warnf(warnWSL, "", "running inside WSL 2, the disks are virtual disks of WSL or Windows disks attached with wsl --mount, dsktool wsl disks shows which")
+	default:
+		return false
+	}
+	return true
+}
+
+// wslDisk is a disk as seen inside WSL 2
+type wslDisk struct {
+	Path      string
+	Size      int64
+	Inventory diskInventory
+	Role      string // what the disk is to WSL
+	InUse     bool   // mounted or used as swap
+	Windows   string // the physical drive of attached disks, if found
+}
+
+// virtual reports whether the disk is a VHD of WSL rather than an attached disk
+func (d wslDisk) virtual() bool {
+	return d.Inventory.Vendor == "Msft" && d.Inventory.Model == "Virtual Disk"
+}
+
+// wslParentDisk returns the disk a partition is on, or the disk itself
+func wslParentDisk(name string) string {
+	sysPath := filepath.Join("/sys/class/block", name)
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err != nil {
+		return name
+	}
+	resolved, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return name
+	}
+	return filepath.Base(filepath.Dir(resolved))
+}
+
+// wslUsage returns, per disk, where it or its partitions are mounted or
+// that it is swap
+func wslUsage() map[string][]string {
+	usage := map[string][]string{}
+	if f, err := os.Open("/proc/self/mountinfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// The mount point is field 5, the source follows the " - " separator
+			fields := strings.Fields(scanner.Text())
+			sep := -1
+			for i, field := range fields {
+				if field == "-" {
+					sep = i
+					break
+				}
+			}
+			if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) || !strings.HasPrefix(fields[sep+2], "/dev/") {
+				continue
+			}
+			disk := wslParentDisk(filepath.Base(fields[sep+2]))
+			usage[disk] = append(usage[disk], fields[4])
+		}
+		f.Close()
+	}
+	if data, err := os.ReadFile("/proc/swaps"); err == nil {
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "/dev/") {
+				disk := wslParentDisk(filepath.Base(fields[0]))
+				usage[disk] = append(usage[disk], "swap")
+			}
+		}
+	}
+	return usage
+}
+
+// windowsDiskDrive is a Win32_DiskDrive of the Windows host
+type windowsDiskDrive struct {
+	Index        int
+	Model        string
+	SerialNumber string
+	Size         int64
+}
+
+// windowsDiskDrives asks Windows for its physical drives through the WSL
+// interop, nil if it cannot be reached
+func windowsDiskDrives() []windowsDiskDrive {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command",
+		"Get-CimInstance Win32_DiskDrive | Select-Object Index,Model,SerialNumber,Size | ConvertTo-Json").Output()
+	if err != nil {
+		return nil
+	}
+	// A single drive comes as an object, not an array
+	out = []byte(strings.TrimSpace(string(out)))
+	if len(out) > 0 && out[0] == '{' {
+		out = append(append([]byte("["), out...), ']')
+	}
+	var drives []windowsDiskDrive
+	if err := json.Unmarshal(out, &drives); err != nil {
+		return nil
+	}
+	return drives
+}
+
+// matchWindowsDrive finds the Windows drive of an attached disk by its
+// serial, or by model and size, which Windows rounds down to whole cylinders
+func matchWindowsDrive(disk wslDisk, drives []windowsDiskDrive) string {
+	for _, drive := range drives {
+		serial := strings.TrimSpace(drive.SerialNumber)
+		if serial != "" && strings.EqualFold(serial, disk.Inventory.Serial) {
+			return fmt.Sprintf(`\\.\PHYSICALDRIVE%d`, drive.Index)
+		}
+	}
+	for _, drive := range drives {
+		if strings.EqualFold(strings.TrimSpace(drive.Model), disk.Inventory.name()) &&
+			drive.Size <= disk.Size && disk.Size-drive.Size < disk.Size/100 {
+			return fmt.Sprintf(`\\.\PHYSICALDRIVE%d`, drive.Index)
+		}
+	}
+	return ""
+}
+
+// describeWSLDisk works out what a disk is to WSL
+func describeWSLDisk(name string, usage map[string][]string) wslDisk {
+	disk := wslDisk{Path: "/dev/" + name, Inventory: readDiskInventory("/dev/" + name)}
+	disk.Size, _ = getBlockDeviceSize(disk.Path)
+	mounts := usage[name]
+	disk.InUse = len(mounts) > 0
+	switch {
+	case !disk.virtual():
+		disk.Role = "Windows disk attached with wsl --mount"
+	case containsString(mounts, "/"):
+		disk.Role = "ext4.vhdx of this distribution"
+	case containsString(mounts, "swap"):
+		disk.Role = "swap of WSL"
+	case containsString(mounts, "/mnt/wslg/distro"):
+		disk.Role = "system distribution of WSL"
+	case disk.InUse:
+		disk.Role = "virtual disk of WSL, mounted on " + strings.Join(mounts, ", ")
+	default:
+		disk.Role = "virtual disk, another distribution or a VHD attached with wsl --mount --vhd"
+	}
+	return disk
+}
+
+// listWSLDisks returns the disks WSL 2 shows and what each is
+func listWSLDisks() ([]wslDisk, error) {
+	entries, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		return nil, err
+	}
+	usage := wslUsage()
+	var disks []wslDisk
+	var drives []windowsDiskDrive
+	for _, entry := range entries {
+		name := entry.Name()
+		if excludedBlockDevice(name) || wslParentDisk(name) != name {
+			continue
+		}
+		disk := describeWSLDisk(name, usage)
+		if !disk.virtual() {
+			if drives == nil {
+				drives = windowsDiskDrives()
+			}
+			disk.Windows = matchWindowsDrive(disk, drives)
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// showWSLDisks lists the disks of WSL 2 and the Windows disks they are
+func showWSLDisks() error {
+	switch wslVersion() {
+	case 0:
+		return fmt.Errorf("not running inside WSL, dsktool disks lists the disks")
+	case 1:
+		return fmt.Errorf("WSL 1 gives no access to disks. Run dsktool.exe on Windows, or convert the distribution with wsl --set-version DISTRO 2 and %s", wslAttachHint)
+	}
+	disks, err := listWSLDisks()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("WSL 2")
+	if distro := os.Getenv("WSL_DISTRO_NAME"); distro != "" {
+		fmt.Printf(", distribution %s", distro)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tSIZE\tMODEL\tWINDOWS\tWHAT")
+	attached := false
+	for _, disk := range disks {
+		windows := disk.Windows
+		if !disk.virtual() {
+			attached = true
+			if windows == "" {
+				windows = "not found"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", disk.Path, formatBytes(disk.Size), disk.Inventory.name(), windows, disk.Role)
+	}
+	w.Flush()
+	if !attached {
+		fmt.Printf("\nNo Windows disk is attached. Find its number with Get-CimInstance Win32_DiskDrive and %s.\n", wslAttachHint)
+	}
+	return nil
+}
+
+// checkWSLDevice refuses writes WSL cannot do or that would break WSL itself
+func checkWSLDevice(path, operation string) error {
+	version := wslVersion()
+	if version == 0 {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		return nil
+	}
+	if version == 1 {
+		return fmt.Errorf("WSL 1 gives no access to disks. Run dsktool.exe on Windows, or convert the distribution with wsl --set-version DISTRO 2 and %s", wslAttachHint)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	disk := describeWSLDisk(wslParentDisk(filepath.Base(resolved)), wslUsage())
+	if disk.virtual() && disk.InUse {
+		return fmt.Errorf("%s is the %s, %s on it would break WSL. Windows disks show up once you %s, dsktool wsl disks lists them",
+			path, disk.Role, operation, wslAttachHint)
+	}
+	// The Hyper-V SCSI passthrough of wsl --mount forwards reads and
+	// writes, not ATA security or NVMe admin commands
+	if operation == "secure erase" {
+		return fmt.Errorf("secure erase commands do not reach the drive through wsl --mount, run dsktool.exe secure-erase on Windows")
+	}
+	return nil
+}
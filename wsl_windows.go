@@ -0,0 +1,13 @@
+package main
+
+import "fmt"
+
+// showWSLDisks only makes sense inside WSL, Windows sees its disks directly
+func showWSLDisks() error {
+	return fmt.Errorf("wsl disks runs inside WSL, on Windows dsktool disks lists the disks")
+}
+
+// checkWSLDevice has nothing to check on Windows
+func checkWSLDevice(path, operation string) error {
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+// Images taken with --skip-zeros leave out the 1 MiB regions that hold only
+// zeros, whatever the compression. The block map lists the ranges the image
+// holds and marks the rest of the disk as zeros, so restoring the image
+// writes them back.
+
+// zeroRegionSize is the unit zero regions are left out in
+const zeroRegionSize = mb
+
+// zeroSkipper passes on the parts of the image stream that are not zero regions
+type zeroSkipper struct {
+	kept []byteRange // of the stream, in order
+}
+
+// filter calls write for the parts of chunk, at offset off of the stream,
+// outside the zero regions and records what was kept. Regions are aligned to
+// the stream, a chunk that ends inside one only decides for its part of it.
+func (z *zeroSkipper) filter(chunk []byte, off int64, write func([]byte) error) error {
+	for at := int64(0); at < int64(len(chunk)); {
+		end := min(int64(len(chunk)), (off+at)/zeroRegionSize*zeroRegionSize+zeroRegionSize-off)
+		part := chunk[at:end]
+		if !isZero(part) {
+			if err := write(part); err != nil {
+				return err
+			}
+			z.keep(byteRange{Start: off + at, End: off + end})
+		}
+		at = end
+	}
+	return nil
+}
+
+// keep adds a range of the stream to the kept ones, joining it to the last
+func (z *zeroSkipper) keep(r byteRange) {
+	if n := len(z.kept); n > 0 && z.kept[n-1].End == r.Start {
+		z.kept[n-1].End = r.End
+		return
+	}
+	z.kept = append(z.kept, r)
+}
+
+// deviceRanges returns where the kept ranges of the stream are on the
+// device, the stream being read from ranges of it, or all of it if nil
+func (z *zeroSkipper) deviceRanges(ranges []byteRange) []byteRange {
+	if ranges == nil {
+		return z.kept
+	}
+	var mapped []byteRange
+	var streamStart int64 // of ranges[i]
+	i := 0
+	for _, k := range z.kept {
+		for i < len(ranges) {
+			r := ranges[i]
+			streamEnd := streamStart + r.End - r.Start
+			start, end := max(k.Start, streamStart), min(k.End, streamEnd)
+			if start < end {
+				at := byteRange{Start: r.Start + start - streamStart, End: r.Start + end - streamStart}
+				if n := len(mapped); n > 0 && mapped[n-1].End == at.Start {
+					mapped[n-1].End = at.End
+				} else {
+					mapped = append(mapped, at)
+				}
+			}
+			if streamEnd > k.End {
+				break
+			}
+			streamStart = streamEnd
+			i++
+		}
+	}
+	return mapped
+}